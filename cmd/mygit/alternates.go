@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxAlternateDepth is how deep alternates of alternates are followed, like
+// git.
+const maxAlternateDepth = 5
+
+// AlternatesStore reads the objects of the object directories listed in
+// <dir>/info/alternates, eg: a repository sharing the objects of another
+// one. Each line is the path of an object directory, relative paths being
+// relative to the directory of the file, and both its loose objects and
+// packs are searched. The alternates of these directories are searched
+// too, up to maxAlternateDepth; a directory already searched is skipped, so
+// circular alternates do no harm.
+//
+// Only the local object directory is written to, so Write fails.
+type AlternatesStore struct {
+	dir    string
+	loaded bool
+	stores *StackedStore
+}
+
+// NewAlternatesStore returns the store of the alternates of the object
+// directory dir, eg: .git/objects. The alternates file is read on the first
+// lookup.
+func NewAlternatesStore(dir string) *AlternatesStore {
+	return &AlternatesStore{dir: dir}
+}
+
+// load reads the alternates files, a missing one meaning no alternates.
+func (s *AlternatesStore) load() *StackedStore {
+	if s.loaded {
+		return s.stores
+	}
+	s.loaded = true
+	s.stores = NewStackedStore()
+
+	seen := map[string]bool{}
+	if dir, err := filepath.EvalSymlinks(s.dir); err == nil {
+		seen[dir] = true
+	}
+	s.readAlternates(s.dir, 0, seen)
+	return s.stores
+}
+
+// readAlternates adds the object directories listed in the alternates file
+// of dir, each followed by its own alternates. Blank lines and lines
+// starting with '#' are skipped.
+func (s *AlternatesStore) readAlternates(dir string, depth int, seen map[string]bool) {
+	file := filepath.Join(dir, "info", "alternates")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if depth > maxAlternateDepth {
+		abs, _ := filepath.Abs(dir)
+		fmt.Fprintf(os.Stderr, "error: %s: ignoring alternate object stores, nesting too deep\n", abs)
+		return
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		alternate := line
+		if !filepath.IsAbs(alternate) {
+			alternate = filepath.Join(dir, alternate)
+		}
+		if info, err := os.Stat(alternate); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "error: object directory %s does not exist; check %s\n", alternate, file)
+			continue
+		}
+
+		real, err := filepath.EvalSymlinks(alternate)
+		if err != nil || seen[real] {
+			continue
+		}
+		seen[real] = true
+
+		trace("alternate object directory %s", alternate)
+		s.stores.stores = append(s.stores.stores, NewStackedStore(NewLooseStore(alternate), NewPackStore(filepath.Join(alternate, "pack"))))
+		s.readAlternates(alternate, depth+1, seen)
+	}
+}
+
+func (s *AlternatesStore) Read(sha string) ([]byte, string, error) {
+	return s.load().Read(sha)
+}
+
+func (s *AlternatesStore) Write(objectType string, content []byte) (string, error) {
+	return "", fmt.Errorf("alternate object directories are read-only")
+}
+
+func (s *AlternatesStore) Has(sha string) bool {
+	return s.load().Has(sha)
+}
+
+func (s *AlternatesStore) Iterate(visit func(sha string)) error {
+	return s.load().Iterate(visit)
+}
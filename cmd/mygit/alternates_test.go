@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCatFileFromAlternate(t *testing.T) {
+	testRepository(t)
+	shared := filepath.Join(t.TempDir(), "objects")
+	sha, err := NewLooseStore(shared).Write("blob", []byte("only in the alternate\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects.Has(sha) {
+		t.Fatal("the object is found before the alternate is listed")
+	}
+
+	if err := os.MkdirAll(".git/objects/info", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(".git/objects/info/alternates", []byte(shared+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupGitDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := captureStdout(t, func() { catFile([]string{"-p", sha}) }); got != "only in the alternate\n" {
+		t.Errorf("cat-file -p printed %q, expected the content of the blob of the alternate", got)
+	}
+	if got := captureStdout(t, func() { catFile([]string{"-t", sha}) }); got != "blob\n" {
+		t.Errorf("cat-file -t printed %q, expected blob", got)
+	}
+	if fileExists(filepath.Join(".git/objects", sha[:2], sha[2:])) {
+		t.Error("the object of the alternate was copied to the repository")
+	}
+}
+
+func TestObjectDirectory(t *testing.T) {
+	dir := testRepository(t)
+	if got, err := objectDirectory("."); err != nil || got != filepath.Join(dir, ".git", "objects") {
+		t.Errorf("objectDirectory of a work tree = %q, %v, expected its .git/objects", got, err)
+	}
+	if got, err := objectDirectory("file://" + filepath.Join(dir, ".git")); err != nil || got != filepath.Join(dir, ".git", "objects") {
+		t.Errorf("objectDirectory of a git directory = %q, %v, expected its objects", got, err)
+	}
+	if _, err := objectDirectory(t.TempDir()); err == nil {
+		t.Error("objectDirectory of a directory that isn't a repository didn't fail")
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// filePatch is the patch of a single file, as read by readPatches. A
+// side that doesn't exist, for a file added or deleted, has no path.
+type filePatch struct {
+	oldPath, newPath string
+	oldMode, newMode string
+	oldSha, newSha   string // abbreviated, from the index line
+	hunks            []patchHunk
+}
+
+// patchHunk is a hunk of a patch: its lines start with ' ', '-' or '+' and
+// keep their "\n", but the ones followed by "\ No newline at end of file".
+type patchHunk struct {
+	oldStart, newStart int
+	lines              []string
+}
+
+// images returns the lines the hunk replaces and the lines it replaces
+// them with.
+func (h *patchHunk) images() ([]string, []string) {
+	var pre, post []string
+	for _, line := range h.lines {
+		if line[0] != '+' {
+			pre = append(pre, line[1:])
+		}
+		if line[0] != '-' {
+			post = append(post, line[1:])
+		}
+	}
+	return pre, post
+}
+
+// readPatches reads the patches of the files in a diff, as written by
+// writePatch: what comes before the first "diff --git" line, like the
+// headers of a mail of format-patch, is ignored, and so is what follows
+// the hunks of a file.
+func readPatches(r io.Reader) ([]*filePatch, error) {
+	in := bufio.NewReader(r)
+	var patches []*filePatch
+	var patch *filePatch
+	lineNumber := 0
+	readLine := func() (string, bool) {
+		line, err := in.ReadString('\n')
+		if line == "" && err != nil {
+			return "", false
+		}
+		lineNumber++
+		return line, true
+	}
+	// a/<path> or b/<path>, or /dev/null
+	path := func(name string) string {
+		name = strings.TrimRight(name, "\n")
+		if name, _, found := strings.Cut(name, "\t"); found {
+			return name
+		}
+		if name == "/dev/null" {
+			return ""
+		}
+		if _, rest, found := strings.Cut(name, "/"); found {
+			return rest
+		}
+		return name
+	}
+
+	for {
+		line, ok := readLine()
+		if !ok {
+			return patches, nil
+		}
+		text := strings.TrimRight(line, "\n")
+
+		if rest, found := strings.CutPrefix(text, "diff --git "); found {
+			// a/<path> b/<path>, where the paths are the same unless
+			// renamed, which the headers then say
+			name := path(strings.TrimPrefix(rest[len(rest)/2:], " "))
+			patch = &filePatch{oldPath: name, newPath: name}
+			patches = append(patches, patch)
+			continue
+		}
+		if patch == nil {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(text, "new file mode "):
+			patch.oldPath, patch.newMode = "", strings.TrimPrefix(text, "new file mode ")
+		case strings.HasPrefix(text, "deleted file mode "):
+			patch.newPath, patch.oldMode = "", strings.TrimPrefix(text, "deleted file mode ")
+		case strings.HasPrefix(text, "old mode "):
+			patch.oldMode = strings.TrimPrefix(text, "old mode ")
+		case strings.HasPrefix(text, "new mode "):
+			patch.newMode = strings.TrimPrefix(text, "new mode ")
+		case strings.HasPrefix(text, "rename from "):
+			patch.oldPath = strings.TrimPrefix(text, "rename from ")
+		case strings.HasPrefix(text, "rename to "):
+			patch.newPath = strings.TrimPrefix(text, "rename to ")
+		case strings.HasPrefix(text, "index "):
+			fields := strings.Fields(text)
+			patch.oldSha, patch.newSha, _ = strings.Cut(fields[1], "..")
+			if len(fields) > 2 {
+				patch.oldMode, patch.newMode = fields[2], fields[2]
+			}
+		case strings.HasPrefix(text, "--- "):
+			patch.oldPath = path(text[4:])
+		case strings.HasPrefix(text, "+++ "):
+			patch.newPath = path(text[4:])
+		case strings.HasPrefix(text, "Binary files ") || text == "GIT binary patch":
+			return nil, fmt.Errorf("cannot apply binary patch to '%s' without full index line", patch.newPath)
+
+		case strings.HasPrefix(text, "@@ "):
+			fields := strings.Fields(text)
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("corrupt patch at line %d", lineNumber)
+			}
+			start := func(r string) int {
+				n, _ := strconv.Atoi(strings.Split(r[1:], ",")[0])
+				return n
+			}
+			hunk := patchHunk{oldStart: start(fields[1]), newStart: start(fields[2])}
+			// the counts tell where the hunk ends, whatever follows
+			oldCount, newCount := scanHunkHeader(text)
+			for oldCount > 0 || newCount > 0 {
+				line, ok := readLine()
+				if !ok {
+					return nil, fmt.Errorf("corrupt patch at line %d", lineNumber)
+				}
+				switch {
+				case line == "\n":
+					line = " \n"
+				case line[0] == '\\':
+					continue
+				}
+				switch line[0] {
+				case ' ':
+					oldCount--
+					newCount--
+				case '-':
+					oldCount--
+				case '+':
+					newCount--
+				default:
+					return nil, fmt.Errorf("corrupt patch at line %d", lineNumber)
+				}
+				hunk.lines = append(hunk.lines, line)
+			}
+			if next, err := in.Peek(1); err == nil && next[0] == '\\' {
+				readLine()
+				last := &hunk.lines[len(hunk.lines)-1]
+				*last = strings.TrimSuffix(*last, "\n")
+			}
+			patch.hunks = append(patch.hunks, hunk)
+		}
+	}
+}
+
+// applyHunks applies the hunks of a patch to the lines of a file. Like
+// git, each hunk must match its context exactly, but may be found some
+// lines before or after where it says.
+func applyHunks(lines []string, hunks []patchHunk) ([]string, error) {
+	result := append([]string(nil), lines...)
+	offset := 0
+	for _, hunk := range hunks {
+		pre, post := hunk.images()
+		expected := hunk.oldStart - 1 + offset
+		if len(pre) == 0 {
+			expected++
+		}
+		matches := func(at int) bool {
+			if at < 0 || at+len(pre) > len(result) {
+				return false
+			}
+			for i, line := range pre {
+				if result[at+i] != line {
+					return false
+				}
+			}
+			return true
+		}
+		at := -1
+		for distance := 0; at < 0 && (expected-distance >= 0 || expected+distance <= len(result)); distance++ {
+			switch {
+			case matches(expected - distance):
+				at = expected - distance
+			case matches(expected + distance):
+				at = expected + distance
+			}
+		}
+		if at < 0 {
+			return nil, fmt.Errorf("patch failed at line %d", hunk.oldStart)
+		}
+		result = append(result[:at], append(append([]string(nil), post...), result[at+len(pre):]...)...)
+		offset = at - (hunk.oldStart - 1) + len(post) - len(pre)
+		if len(pre) == 0 {
+			offset--
+		}
+	}
+	return result, nil
+}
+
+// findBlob returns the blob an abbreviated sha names, when there is one
+// and only one.
+func findBlob(prefix string) (string, bool) {
+	if len(prefix) < 4 || strings.Trim(prefix, "0") == "" {
+		return "", false
+	}
+	shas, err := listObjects()
+	if err != nil {
+		return "", false
+	}
+	found := ""
+	for _, sha := range shas {
+		if !strings.HasPrefix(sha, prefix) {
+			continue
+		}
+		if objectType, _, err := readObject(sha); err != nil || objectType != "blob" {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = sha
+	}
+	return found, found != ""
+}
+
+// applyOptions are the options of apply.
+type applyOptions struct {
+	check    bool // only tell whether the patches apply
+	index    bool // apply to the index and the work tree
+	cached   bool // apply to the index only
+	threeWay bool // fall back to a three-way merge, see applyThreeWay
+}
+
+// appliedFile is the result of the patch of a file: its new content, or
+// the stages of its conflicts.
+type appliedFile struct {
+	patch   *filePatch
+	content string
+	mode    string
+	stages  [3]*treeEntry
+	merged  bool // applied with a three-way merge
+}
+
+// applyThreeWay merges the patch of a file with its current content: the
+// blob the index line of the patch names is the base, the patch applied
+// to the base is theirs, and the current content is ours, see mergeLines.
+func applyThreeWay(patch *filePatch, ours []string, oursSha string, mode string) (*appliedFile, error) {
+	base, ok := findBlob(patch.oldSha)
+	if !ok {
+		return nil, fmt.Errorf("repository lacks the necessary blob to perform 3-way merge.")
+	}
+	content, err := readBlob(base)
+	if err != nil {
+		return nil, err
+	}
+	baseLines := splitLines(content)
+	theirs, err := applyHunks(baseLines, patch.hunks)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, conflict := mergeLines(baseLines, ours, theirs, "ours", "theirs")
+	result := &appliedFile{patch: patch, content: merged, mode: mode, merged: true}
+	if patch.newMode != "" {
+		result.mode = patch.newMode
+	}
+	if conflict {
+		theirSha, err := writeObject("blob", []byte(strings.Join(theirs, "")))
+		if err != nil {
+			return nil, err
+		}
+		result.stages = [3]*treeEntry{
+			{mode: mode, sha: base},
+			{mode: mode, sha: oursSha},
+			{mode: result.mode, sha: theirSha},
+		}
+	}
+	return result, nil
+}
+
+// applyPatch applies the patch of a file to what is in the work tree, or in
+// the index with --index or --cached, without writing anything yet.
+func applyPatch(patch *filePatch, idx *index, opts *applyOptions) (*appliedFile, error) {
+	result := &appliedFile{patch: patch, mode: patch.newMode}
+	if patch.oldPath == "" {
+		if _, err := os.Lstat(patch.newPath); err == nil && !opts.cached {
+			return nil, fmt.Errorf("%s: already exists in working directory", patch.newPath)
+		}
+		if entry := indexFiles(idx)[patch.newPath]; entry.sha != "" && (opts.index || opts.cached) {
+			return nil, fmt.Errorf("%s: already exists in index", patch.newPath)
+		}
+		lines, err := applyHunks(nil, patch.hunks)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", patch.newPath, err)
+		}
+		result.content = strings.Join(lines, "")
+		return result, nil
+	}
+
+	var content []byte
+	entry, indexed := indexFiles(idx)[patch.oldPath]
+	mode := entry.mode
+	if opts.index || opts.cached {
+		if !indexed {
+			return nil, fmt.Errorf("%s: does not exist in index", patch.oldPath)
+		}
+		var err error
+		if content, err = readBlob(entry.sha); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.cached {
+		current, err := os.ReadFile(patch.oldPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: No such file or directory", patch.oldPath)
+		}
+		current = cleanText(current, newAttrMatcher().attributes(patch.oldPath))
+		if opts.index && string(current) != string(content) {
+			return nil, fmt.Errorf("%s: does not match index", patch.oldPath)
+		}
+		content = current
+		if !indexed {
+			mode = modeFile
+			if info, err := os.Stat(patch.oldPath); err == nil && info.Mode()&0111 != 0 {
+				mode = modeExecutable
+			}
+		}
+	}
+	if result.mode == "" {
+		result.mode = mode
+	}
+
+	lines, err := applyHunks(splitLines(content), patch.hunks)
+	if err != nil {
+		if !opts.threeWay || patch.newPath == "" {
+			return nil, fmt.Errorf("patch failed: %s:%d\nerror: %s: patch does not apply", patch.oldPath, patch.hunks[0].oldStart, patch.oldPath)
+		}
+		fmt.Fprintf(os.Stderr, "error: patch failed: %s:%d\n", patch.oldPath, patch.hunks[0].oldStart)
+		fmt.Fprintln(os.Stderr, "Falling back to three-way merge...")
+		return applyThreeWay(patch, splitLines(content), entry.sha, mode)
+	}
+	result.content = strings.Join(lines, "")
+	return result, nil
+}
+
+// writeApplied writes the result of a patch to the work tree, and the
+// index with --index or --cached.
+func writeApplied(result *appliedFile, idx *index, opts *applyOptions) error {
+	patch := result.patch
+	if patch.oldPath != "" && patch.oldPath != patch.newPath {
+		if !opts.cached {
+			if err := os.Remove(patch.oldPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		setIndexPath(idx, patch.oldPath, nil)
+	}
+	if patch.newPath == "" {
+		return nil
+	}
+
+	sha, err := writeObject("blob", []byte(result.content))
+	if err != nil {
+		return err
+	}
+	entry := treeEntry{mode: result.mode, name: filepath.Base(patch.newPath), sha: sha}
+	if !opts.cached {
+		if err := os.Remove(patch.newPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := writeWorkTreeFile(patch.newPath, entry, newAttrMatcher()); err != nil {
+			return err
+		}
+	}
+
+	var entries []indexEntry
+	if result.stages[0] != nil {
+		for n, stage := range result.stages {
+			mode, _ := strconv.ParseUint(stage.mode, 8, 32)
+			entries = append(entries, indexEntry{mode: uint32(mode), sha: stage.sha, path: patch.newPath, flags: uint16(n+1) << 12})
+		}
+	} else {
+		mode, _ := strconv.ParseUint(entry.mode, 8, 32)
+		indexed := indexEntry{mode: uint32(mode), sha: sha, path: patch.newPath}
+		if info, err := os.Lstat(patch.newPath); err == nil && !opts.cached {
+			indexed.mtimeSec = uint32(info.ModTime().Unix())
+			indexed.mtimeNsec = uint32(info.ModTime().Nanosecond())
+			indexed.ctimeSec, indexed.ctimeNsec = indexed.mtimeSec, indexed.mtimeNsec
+			indexed.size = uint32(info.Size())
+		}
+		entries = append(entries, indexed)
+	}
+	setIndexPath(idx, patch.newPath, entries)
+	return nil
+}
+
+// setIndexPath replaces the entries of a path in the index, keeping the
+// entries sorted.
+func setIndexPath(idx *index, path string, entries []indexEntry) {
+	kept := idx.entries[:0]
+	for _, entry := range idx.entries {
+		if entry.path != path {
+			kept = append(kept, entry)
+		}
+	}
+	idx.entries = append(kept, entries...)
+	sort.SliceStable(idx.entries, func(i, j int) bool {
+		a, b := idx.entries[i], idx.entries[j]
+		if a.path != b.path {
+			return a.path < b.path
+		}
+		return a.stage() < b.stage()
+	})
+}
+
+// apply implements `git apply [--check] [--index | --cached] [-3 | --3way] [<patch>...]`
+//
+// It applies the patches of a diff, from the files given or the standard
+// input, to the work tree, and to the index too with --index, or only to
+// the index with --cached:
+//
+//	$ git diff > fix.patch
+//	$ git apply fix.patch
+//
+// It's all or nothing: when the patch of a file doesn't apply, nothing is
+// changed. --check only tells whether the patches apply.
+//
+// With --3way, or -3, which implies --index, a file the patch of doesn't
+// apply is merged instead, see applyThreeWay, like git: its changes and
+// those made since are merged, and conflicts are left between markers,
+// with the base, our and their versions in the index, to resolve like
+// the conflicts of a merge.
+func apply(args []string) {
+	flag := flag.NewFlagSet("git apply", flag.ExitOnError)
+	opts := &applyOptions{}
+	flag.BoolVar(&opts.check, "check", false, "only tell whether the patches apply")
+	flag.BoolVar(&opts.index, "index", false, "apply to the index and the work tree")
+	flag.BoolVar(&opts.cached, "cached", false, "apply to the index only")
+	flag.BoolVar(&opts.threeWay, "3way", false, "merge the files the patches don't apply to")
+	flag.BoolVar(&opts.threeWay, "3", false, "short for --3way")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if opts.threeWay {
+		if opts.cached {
+			fail(fmt.Errorf("--3way and --cached are incompatible"))
+		}
+		opts.index = true
+	}
+	if opts.index && bareRepository {
+		fmt.Fprintln(os.Stderr, "fatal: this operation must be run in a work tree")
+		os.Exit(128)
+	}
+
+	var patches []*filePatch
+	read := func(r io.Reader) {
+		read, err := readPatches(r)
+		if err != nil {
+			fail(err)
+		}
+		patches = append(patches, read...)
+	}
+	if len(args) == 0 {
+		read(os.Stdin)
+	}
+	for _, name := range args {
+		f, err := os.Open(name)
+		if err != nil {
+			fail(fmt.Errorf("can't open patch '%s': %s", name, err))
+		}
+		read(f)
+		f.Close()
+	}
+	if len(patches) == 0 {
+		fail(fmt.Errorf("No valid patches in input (allow with \"--allow-empty\")"))
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		fail(err)
+	}
+	var results []*appliedFile
+	for _, patch := range patches {
+		result, err := applyPatch(patch, idx, opts)
+		if err != nil {
+			fail(err)
+		}
+		results = append(results, result)
+	}
+	if opts.check {
+		return
+	}
+
+	conflicts := false
+	for _, result := range results {
+		if err := writeApplied(result, idx, opts); err != nil {
+			fail(err)
+		}
+		switch {
+		case result.stages[0] != nil:
+			conflicts = true
+			fmt.Fprintf(os.Stderr, "Applied patch to '%s' with conflicts.\n", result.patch.newPath)
+		case result.merged:
+			fmt.Fprintf(os.Stderr, "Applied patch to '%s' cleanly.\n", result.patch.newPath)
+		}
+	}
+	if opts.index || opts.cached {
+		if err := writeIndex(idx); err != nil {
+			fail(err)
+		}
+	}
+	if conflicts {
+		for _, result := range results {
+			if result.stages[0] != nil {
+				fmt.Fprintf(os.Stderr, "U %s\n", result.patch.newPath)
+			}
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testFilePatch is a patch changing line 3 of a 5-line f from "3" to
+// "three", as git diff writes it, with the abbreviated sha of the original.
+func testFilePatch(t *testing.T, original string) *filePatch {
+	t.Helper()
+	sha, err := writeObject("blob", []byte(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := fmt.Sprintf("diff --git a/f b/f\nindex %s..1234567 100644\n--- a/f\n+++ b/f\n@@ -1,5 +1,5 @@\n 1\n 2\n-3\n+three\n 4\n 5\n", sha[:7])
+	patches, err := readPatches(strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("read %d patches, expected 1", len(patches))
+	}
+	return patches[0]
+}
+
+func TestApplyHunks(t *testing.T) {
+	testRepository(t)
+	patch := testFilePatch(t, "1\n2\n3\n4\n5\n")
+	if patch.oldPath != "f" || patch.newPath != "f" || patch.newMode != modeFile {
+		t.Errorf("read the patch of %s to %s, mode %s", patch.oldPath, patch.newPath, patch.newMode)
+	}
+
+	for _, test := range []struct {
+		lines, want string
+	}{
+		{"1\n2\n3\n4\n5\n", "1\n2\nthree\n4\n5\n"},
+		// found some lines after where the hunk says
+		{"a\nb\n1\n2\n3\n4\n5\n", "a\nb\n1\n2\nthree\n4\n5\n"},
+	} {
+		lines, err := applyHunks(splitLines([]byte(test.lines)), patch.hunks)
+		if err != nil {
+			t.Errorf("applying to %q failed: %s", test.lines, err)
+			continue
+		}
+		if got := strings.Join(lines, ""); got != test.want {
+			t.Errorf("applying to %q gave %q, expected %q", test.lines, got, test.want)
+		}
+	}
+
+	if _, err := applyHunks(splitLines([]byte("1\n2\nTHREE\n4\n")), patch.hunks); err == nil {
+		t.Error("applying where the context changed succeeded")
+	}
+}
+
+func TestApplyThreeWay(t *testing.T) {
+	testRepository(t)
+	patch := testFilePatch(t, "1\n2\n3\n4\n5\n")
+	idx := &index{version: 2}
+	opts := &applyOptions{index: true, threeWay: true}
+
+	// line 1 changed since, which the patch has as context: merged cleanly
+	writeTestFiles(t, map[string]string{"f": "one\n2\n3\n4\n5\n"})
+	sha, err := writeObject("blob", []byte("one\n2\n3\n4\n5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setIndexPath(idx, "f", []indexEntry{{mode: 0100644, sha: sha, path: "f"}})
+	result, err := applyPatch(patch, idx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.merged || result.stages[0] != nil || result.content != "one\n2\nthree\n4\n5\n" {
+		t.Errorf("the merge gave %q, conflicts %v", result.content, result.stages[0] != nil)
+	}
+
+	// line 3 changed since: a conflict
+	writeTestFiles(t, map[string]string{"f": "1\n2\nTHREE\n4\n5\n"})
+	if sha, err = writeObject("blob", []byte("1\n2\nTHREE\n4\n5\n")); err != nil {
+		t.Fatal(err)
+	}
+	setIndexPath(idx, "f", []indexEntry{{mode: 0100644, sha: sha, path: "f"}})
+	if result, err = applyPatch(patch, idx, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeApplied(result, idx, opts); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile("f")
+	if got, want := string(content), "1\n2\n<<<<<<< ours\nTHREE\n=======\nthree\n>>>>>>> theirs\n4\n5\n"; got != want {
+		t.Errorf("f is\n%s\nexpected\n%s", got, want)
+	}
+	var stages []string
+	for _, entry := range idx.entries {
+		stages = append(stages, fmt.Sprintf("%s:%d", entry.path, entry.stage()))
+	}
+	if got, want := strings.Join(stages, " "), "f:1 f:2 f:3"; got != want {
+		t.Errorf("the index has %s, expected %s", got, want)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveFormats are the formats of archive, with the extensions of the
+// output files that pick them.
+var archiveFormats = []struct {
+	name       string
+	extensions []string
+}{
+	{"tar", []string{".tar"}},
+	{"tgz", []string{".tgz", ".tar.gz"}},
+	{"tar.gz", nil},
+	{"zip", []string{".zip"}},
+}
+
+// isArchiveFormat checks that archive knows a format.
+func isArchiveFormat(format string) bool {
+	for _, f := range archiveFormats {
+		if f.name == format {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveFormatOf returns the format an output file name asks for, "" when
+// its extension doesn't say.
+func archiveFormatOf(output string) string {
+	for _, f := range archiveFormats {
+		for _, extension := range f.extensions {
+			if strings.HasSuffix(output, extension) {
+				return f.name
+			}
+		}
+	}
+	return ""
+}
+
+// archiveEntry is a file or directory of an archive, its path includes the
+// prefix and ends with a / for a directory.
+type archiveEntry struct {
+	path string
+	treeEntry
+}
+
+// archiveEntries lists the content of a tree in the order of the tree,
+// each directory before what it contains. With paths, only what's under
+// them is listed, along with the directories leading to them.
+func archiveEntries(tree string, prefix string, paths []string) ([]archiveEntry, error) {
+	for i, path := range paths {
+		paths[i] = cleanPath(path)
+	}
+	matched := make([]bool, len(paths))
+	selected := func(name string, isDir bool) bool {
+		if len(paths) == 0 {
+			return true
+		}
+		for i, path := range paths {
+			if path == "" || name == path || strings.HasPrefix(name, path+"/") {
+				matched[i] = true
+				return true
+			}
+			if isDir && strings.HasPrefix(path, name+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var entries []archiveEntry
+	if prefix != "" && strings.HasSuffix(prefix, "/") {
+		entries = append(entries, archiveEntry{path: prefix, treeEntry: treeEntry{mode: modeTree, sha: tree}})
+	}
+
+	var walk func(sha string, dir string) error
+	walk = func(sha string, dir string) error {
+		children, err := readTree(sha)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			name := dir + child.name
+			if !selected(name, child.isTree()) {
+				continue
+			}
+			if !child.isTree() {
+				entries = append(entries, archiveEntry{path: prefix + name, treeEntry: child})
+				continue
+			}
+			entries = append(entries, archiveEntry{path: prefix + name + "/", treeEntry: child})
+			if err := walk(child.sha, name+"/"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(tree, ""); err != nil {
+		return nil, err
+	}
+
+	for i, path := range paths {
+		if !matched[i] {
+			return nil, fmt.Errorf("pathspec '%s' did not match any files", path)
+		}
+	}
+	return entries, nil
+}
+
+// writeArchive writes the tree of a tree-ish as a tar, tgz (or tar.gz) or
+// zip archive. The files are given the time of the commit, or the current
+// time for a tree, and the commit's name is stored in the archive, where
+// `git get-tar-commit-id` finds it for tar. Like git with the default
+// tar.umask, files and directories aren't writable by others.
+func writeArchive(w io.Writer, format string, treeish string, prefix string, paths []string) error {
+	sha, err := resolveRevision(treeish)
+	if err != nil {
+		return fmt.Errorf("not a valid object name: %s", treeish)
+	}
+	sha, objectType, err := peelTag(sha)
+	if err != nil {
+		return err
+	}
+
+	tree, commitSha, mtime := sha, "", time.Now()
+	switch objectType {
+	case "commit":
+		c, err := readCommit(sha)
+		if err != nil {
+			return err
+		}
+		tree, commitSha = c.tree, sha
+		_, _, mtime = parseIdent(c.committer)
+	case "tree":
+	default:
+		return fmt.Errorf("not a tree object: %s", sha)
+	}
+
+	entries, err := archiveEntries(tree, prefix, paths)
+	if err != nil {
+		return err
+	}
+
+	mode := func(entry archiveEntry) fs.FileMode {
+		switch entry.mode {
+		case modeTree, modeSubmodule:
+			return fs.ModeDir | 0775
+		case modeExecutable:
+			return 0775
+		case modeSymlink:
+			return fs.ModeSymlink | 0777
+		}
+		return 0664
+	}
+
+	switch format {
+	case "tar":
+		return writeTarArchive(w, entries, commitSha, mtime, mode)
+
+	case "tgz", "tar.gz":
+		gz := gzip.NewWriter(w)
+		if err := writeTarArchive(gz, entries, commitSha, mtime, mode); err != nil {
+			return err
+		}
+		return gz.Close()
+
+	case "zip":
+		zw := zip.NewWriter(w)
+		if commitSha != "" {
+			zw.SetComment(commitSha)
+		}
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.path, Modified: mtime, Method: zip.Deflate}
+			header.SetMode(mode(entry))
+			if strings.HasSuffix(entry.path, "/") {
+				header.Method = zip.Store
+			}
+			file, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(entry.path, "/") {
+				continue
+			}
+			_, content, err := readObject(entry.sha)
+			if err != nil {
+				return err
+			}
+			if _, err := file.Write(content); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
+	return fmt.Errorf("Unknown archive format '%s'", format)
+}
+
+// writeTarArchive writes the entries as a tar archive, starting with a pax
+// global header holding the commit, if any.
+func writeTarArchive(w io.Writer, entries []archiveEntry, commitSha string, mtime time.Time, mode func(archiveEntry) fs.FileMode) error {
+	tw := tar.NewWriter(w)
+	if commitSha != "" {
+		header := &tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{"comment": commitSha},
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:    entry.path,
+			Mode:    int64(mode(entry).Perm()),
+			ModTime: mtime,
+			Uname:   "root",
+			Gname:   "root",
+		}
+
+		var content []byte
+		if strings.HasSuffix(entry.path, "/") {
+			header.Typeflag = tar.TypeDir
+		} else {
+			var err error
+			if _, content, err = readObject(entry.sha); err != nil {
+				return err
+			}
+			if entry.mode == modeSymlink {
+				header.Typeflag, header.Linkname, content = tar.TypeSymlink, string(content), nil
+			} else {
+				header.Typeflag, header.Size = tar.TypeReg, int64(len(content))
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// startUploadArchive runs upload-archive for a remote repository: over ssh
+// for ssh://[user@]host[:port]/path and [user@]host:path, and locally for
+// a path or file://path. program is the command run, git-upload-archive by
+// default; locally, this program's own upload-archive is run unless one is
+// given.
+func startUploadArchive(remote string, program string) (*exec.Cmd, error) {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	if program == "" {
+		program = "git-upload-archive"
+	}
+
+	var host, port, path string
+	switch {
+	case strings.HasPrefix(remote, "ssh://"):
+		rest := strings.TrimPrefix(remote, "ssh://")
+		slash := strings.Index(rest, "/")
+		if slash < 0 {
+			return nil, fmt.Errorf("no path specified in '%s'", remote)
+		}
+		host, path = rest[:slash], rest[slash:]
+		if at := strings.LastIndex(host, ":"); at >= 0 {
+			host, port = host[:at], host[at+1:]
+		}
+	case strings.Contains(remote, "://") && !strings.HasPrefix(remote, "file://"):
+		return nil, fmt.Errorf("unsupported protocol for archive --remote: %s", remote)
+	default:
+		colon := strings.Index(remote, ":")
+		if colon > 0 && !strings.Contains(remote[:colon], "/") && !strings.HasPrefix(remote, "file://") {
+			host, path = remote[:colon], remote[colon+1:]
+		}
+	}
+
+	var cmd *exec.Cmd
+	switch {
+	case host != "":
+		args := []string{host}
+		if port != "" {
+			args = []string{"-p", port, host}
+		}
+		cmd = exec.Command("ssh", append(args, program+" "+quote(path))...)
+	case program != "git-upload-archive":
+		path = strings.TrimPrefix(remote, "file://")
+		cmd = exec.Command("sh", "-c", program+" "+quote(path))
+	default:
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(self, "upload-archive", strings.TrimPrefix(remote, "file://"))
+	}
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// fetchRemoteArchive asks upload-archive for the archive of the arguments,
+// see uploadArchive, and writes it to w.
+func fetchRemoteArchive(w io.Writer, remote string, program string, args []string) error {
+	cmd, err := startUploadArchive(remote, program)
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+
+	request := bufio.NewWriter(stdin)
+	for _, arg := range args {
+		if err := writePktLine(request, "argument "+arg+"\n"); err != nil {
+			return err
+		}
+	}
+	writeFlushPkt(request)
+	if err := request.Flush(); err != nil {
+		return err
+	}
+	stdin.Close()
+
+	response := bufio.NewReader(stdout)
+	line, _, err := readPktLine(response)
+	if err != nil {
+		return fmt.Errorf("git archive: expected ACK/NAK, got a flush packet")
+	}
+	switch {
+	case strings.HasPrefix(line, "NACK "):
+		return fmt.Errorf("git archive: NACK %s", strings.TrimPrefix(line, "NACK "))
+	case strings.HasPrefix(line, "ERR "):
+		return fmt.Errorf("remote error: %s", strings.TrimPrefix(line, "ERR "))
+	case line != "ACK":
+		return fmt.Errorf("git archive: protocol error")
+	}
+	if _, flush, err := readPktLine(response); err != nil || !flush {
+		return fmt.Errorf("git archive: expected a flush")
+	}
+
+	return readSideband(response, w, os.Stderr)
+}
+
+// archive implements `git archive [--format=<fmt>] [--prefix=<prefix>] [-o <file>] [--remote=<repo> [--exec=<program>]] <tree-ish> [<path>...]`
+//
+// It writes the files of a commit or tree as a tar (the default), tgz or
+// zip archive, to stdout or the -o file, whose extension picks the format
+// when --format isn't given:
+//
+//	$ git archive --prefix=project-1.0/ -o project-1.0.tar.gz v1.0
+//
+// Every path in the archive starts with the prefix, and with paths only
+// what's under them is archived.
+//
+// With --remote, the archive is made by the remote repository, see
+// uploadArchive, which only archives refs unless its
+// uploadarchive.allowUnreachable is set. --list prints the formats.
+func archive(args []string) {
+	flag := flag.NewFlagSet("git archive", flag.ExitOnError)
+	var (
+		format  = flag.String("format", "", "archive format: tar, tgz, tar.gz or zip")
+		prefix  = flag.String("prefix", "", "prepend prefix to each path in the archive")
+		output  = flag.String("output", "", "write the archive to this file")
+		remote  = flag.String("remote", "", "retrieve the archive from this remote repository")
+		program = flag.String("exec", "", "path to git-upload-archive on the remote")
+		list    = flag.Bool("list", false, "list the supported archive formats")
+	)
+	flag.StringVar(output, "o", "", "same as --output")
+	flag.BoolVar(list, "l", false, "same as --list")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if *list {
+		for _, f := range archiveFormats {
+			fmt.Println(f.name)
+		}
+		return
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git archive [<options>] <tree-ish> [<path>...]")
+		os.Exit(129)
+	}
+
+	if *format == "" && *output != "" {
+		*format = archiveFormatOf(*output)
+	}
+	formatGiven := *format != ""
+	if *format == "" {
+		*format = "tar"
+	}
+	if !isArchiveFormat(*format) {
+		fail(fmt.Errorf("Unknown archive format '%s'", *format))
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fail(fmt.Errorf("could not create archive file '%s': %s", *output, err))
+		}
+		defer file.Close()
+		w = file
+	}
+	out := bufio.NewWriter(w)
+
+	var err error
+	if *remote != "" {
+		var remoteArgs []string
+		if formatGiven {
+			remoteArgs = append(remoteArgs, "--format="+*format)
+		}
+		if *prefix != "" {
+			remoteArgs = append(remoteArgs, "--prefix="+*prefix)
+		}
+		err = fetchRemoteArchive(out, *remote, *program, append(remoteArgs, args...))
+	} else {
+		err = writeArchive(out, *format, args[0], *prefix, args[1:])
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		if *output != "" {
+			os.Remove(filepath.Clean(*output))
+		}
+		fail(err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Values of an attribute besides a string, eg: `eol=crlf`.
+const (
+	attrSet         = "set"         // `text`
+	attrUnset       = "unset"       // `-text`
+	attrUnspecified = "unspecified" // `!text`, or not mentioned at all
+)
+
+// attrRule is a line of a .gitattributes file: a pattern and the
+// attributes it gives the paths matching it, in the order of the line.
+type attrRule struct {
+	pattern  string
+	anchored bool     // a pattern with a slash matches the path relative to base, not the basename
+	base     string   // directory of the .gitattributes, "" for the top-level one
+	names    []string // attribute names
+	values   []string // attrSet, attrUnset, attrUnspecified or the value after =
+	macro    string   // for `[attr]<macro>` lines, the name of the macro defined
+}
+
+// builtinAttributes are defined before any attributes file is read.
+const builtinAttributes = "[attr]binary -diff -merge -text\n"
+
+// parseAttributesFile parses the content of a .gitattributes file found in
+// base:
+//
+//	<pattern> <attr>... where <attr> is one of name, -name, !name or name=value
+//	[attr]<macro> <attr>...
+//
+// Blank lines and lines starting with '#' are skipped. Patterns work like
+// in .gitignore, but there are no negative or directory-only patterns.
+//
+// A macro is an attribute that sets others when it's set itself, eg: the
+// builtin `binary` is `-diff -merge -text`. Macros can only be defined in
+// the top-level .gitattributes or in .git/info/attributes.
+func parseAttributesFile(content []byte, base string) []attrRule {
+	var rules []attrRule
+
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0][0] == '#' || fields[0][0] == '!' {
+			continue
+		}
+
+		rule := attrRule{pattern: fields[0], base: base}
+		if macro, found := strings.CutPrefix(rule.pattern, "[attr]"); found {
+			if base != "" {
+				file := path.Join(base, ".gitattributes")
+				fmt.Fprintf(os.Stderr, "%s not allowed: %s:%d\n", strings.TrimSpace(line), file, i+1)
+				continue
+			}
+			rule.macro = macro
+		} else if strings.Contains(rule.pattern, "/") {
+			rule.anchored = true
+			rule.pattern = strings.TrimPrefix(rule.pattern, "/")
+		}
+
+		for _, attr := range fields[1:] {
+			name, value := attr, attrSet
+			switch {
+			case attr[0] == '-':
+				name, value = attr[1:], attrUnset
+			case attr[0] == '!':
+				name, value = attr[1:], attrUnspecified
+			case strings.Contains(attr, "="):
+				name, value, _ = strings.Cut(attr, "=")
+			}
+			if name != "" {
+				rule.names = append(rule.names, name)
+				rule.values = append(rule.values, value)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// matches checks the rule against a path relative to the top of the
+// repository.
+func (r attrRule) matches(name string) bool {
+	if r.base != "" {
+		if !strings.HasPrefix(name, r.base+"/") {
+			return false
+		}
+		name = name[len(r.base)+1:]
+	}
+
+	if r.anchored {
+		return wildmatch(r.pattern, name)
+	}
+	return wildmatch(r.pattern, path.Base(name))
+}
+
+// attrMatcher finds the attributes of paths, using (from the highest to the
+// lowest precedence):
+//
+//   - .git/info/attributes
+//   - the .gitattributes of the path's directory, then of its parents up to the top
+//
+// Within a file, the last line setting an attribute wins. The
+// per-directory files are loaded lazily, like for ignoreMatcher.
+type attrMatcher struct {
+	perDir map[string][]attrRule
+	info   []attrRule
+	macros map[string]attrRule
+	order  map[string]int // when each attribute was first seen, see names
+}
+
+func newAttrMatcher() *attrMatcher {
+	m := &attrMatcher{perDir: map[string][]attrRule{}, macros: map[string]attrRule{}, order: map[string]int{}}
+	m.register(parseAttributesFile([]byte(builtinAttributes), ""))
+	// like git, the top-level .gitattributes is read before info/attributes
+	m.rulesFor("")
+	if content, err := os.ReadFile(gitPath("info/attributes")); err == nil {
+		m.info = parseAttributesFile(content, "")
+		m.register(m.info)
+	}
+	return m
+}
+
+// register records the attributes of new rules, in the order they appear,
+// and the macros they define.
+func (m *attrMatcher) register(rules []attrRule) {
+	for _, rule := range rules {
+		names := rule.names
+		if rule.macro != "" {
+			m.macros[rule.macro] = rule
+			names = append([]string{rule.macro}, names...)
+		}
+		for _, name := range names {
+			if _, ok := m.order[name]; !ok {
+				m.order[name] = len(m.order)
+			}
+		}
+	}
+}
+
+// names returns the names of attributes in the order git lists them: the
+// order in which they were first seen in the attributes files.
+func (m *attrMatcher) names(attrs map[string]string) []string {
+	var names []string
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return m.order[names[i]] < m.order[names[j]]
+	})
+	return names
+}
+
+// rulesFor returns the rules of the .gitattributes in dir ("" for the
+// top-level).
+func (m *attrMatcher) rulesFor(dir string) []attrRule {
+	if rules, loaded := m.perDir[dir]; loaded {
+		return rules
+	}
+
+	content, err := os.ReadFile(path.Join(dir, ".gitattributes"))
+	if err != nil {
+		m.perDir[dir] = nil
+		return nil
+	}
+
+	m.perDir[dir] = parseAttributesFile(content, dir)
+	m.register(m.perDir[dir])
+	return m.perDir[dir]
+}
+
+// attributes returns the attributes of a path. Attributes that end up
+// unspecified are left out.
+//
+// Like git, rules are applied from the highest precedence to the lowest and
+// the first one to mention an attribute decides its value. This way a macro
+// being set only gives the attributes nothing with a higher precedence
+// decided on, and a macro unset somewhere doesn't leave behind what it
+// would have set elsewhere.
+func (m *attrMatcher) attributes(name string) map[string]string {
+	attrs := map[string]string{}
+	var fill func(rule attrRule)
+	fill = func(rule attrRule) {
+		for i := len(rule.names) - 1; i >= 0; i-- {
+			attr := rule.names[i]
+			if _, decided := attrs[attr]; decided {
+				continue
+			}
+			attrs[attr] = rule.values[i]
+			if macro, ok := m.macros[attr]; ok && rule.values[i] == attrSet {
+				fill(macro)
+			}
+		}
+	}
+	apply := func(rules []attrRule) {
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].macro == "" && rules[i].matches(name) {
+				fill(rules[i])
+			}
+		}
+	}
+
+	apply(m.info)
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		apply(m.rulesFor(dir))
+		if dir == "" {
+			break
+		}
+	}
+
+	for attr, value := range attrs {
+		if value == attrUnspecified {
+			delete(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// smudgeText converts the content of a blob to what checkout writes in the
+// working tree for a path with the given attributes, following the `text`
+// and `eol` attributes and core.autocrlf:
+//
+//	text            always text, eol gives the line endings
+//	-text           never converted
+//	text=auto       text unless it looks binary or already has CRs
+//	eol=crlf|lf     text with these line endings, unless -text
+//
+// Only CRLF line endings need a conversion, as blobs are stored with LF.
+func smudgeText(content []byte, attrs map[string]string) []byte {
+	text, hasText := attrs["text"]
+	eol, hasEol := attrs["eol"]
+	autocrlf, _ := configGet("core.autocrlf")
+
+	switch {
+	case text == attrUnset:
+		return content
+	case !hasText && !hasEol:
+		// nothing in the attributes, core.autocrlf=true acts like text=auto
+		if b, ok := parseBool(autocrlf); !ok || !b {
+			return content
+		}
+		text = "auto"
+	case !hasText:
+		text = attrSet
+	}
+
+	crlf := eol == "crlf"
+	if !hasEol {
+		coreEol, _ := configGet("core.eol")
+		b, _ := parseBool(autocrlf)
+		crlf = b || coreEol == "crlf"
+	}
+	if !crlf {
+		return content
+	}
+
+	if text == "auto" && (isBinary(content) || strings.Contains(string(content), "\r")) {
+		return content
+	}
+
+	var converted strings.Builder
+	for i, c := range content {
+		if c == '\n' && (i == 0 || content[i-1] != '\r') {
+			converted.WriteByte('\r')
+		}
+		converted.WriteByte(c)
+	}
+	return []byte(converted.String())
+}
+
+// cleanText converts the content of a file to what gets stored in the blob
+// for a path with the given attributes, undoing smudgeText: text gets LF
+// line endings. With text=auto, or core.autocrlf set to true or input and
+// nothing in the attributes, content that looks binary or has a lone CR is
+// left alone.
+func cleanText(content []byte, attrs map[string]string) []byte {
+	text, hasText := attrs["text"]
+	_, hasEol := attrs["eol"]
+
+	switch {
+	case text == attrUnset:
+		return content
+	case !hasText && !hasEol:
+		autocrlf, _ := configGet("core.autocrlf")
+		if b, ok := parseBool(autocrlf); autocrlf != "input" && (!ok || !b) {
+			return content
+		}
+		text = "auto"
+	}
+
+	if text == "auto" {
+		if isBinary(content) {
+			return content
+		}
+		for i, c := range content {
+			if c == '\r' && (i+1 == len(content) || content[i+1] != '\n') {
+				return content
+			}
+		}
+	}
+	return []byte(strings.ReplaceAll(string(content), "\r\n", "\n"))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// batchAtoms are the %(atom)s known to `cat-file --batch-check=<format>`.
+var batchAtoms = []string{"objectname", "objecttype", "objectsize", "objectsize:disk", "deltabase"}
+
+const defaultBatchFormat = "%(objectname) %(objecttype) %(objectsize)"
+
+// catFileBatch implements `git cat-file --batch[=<format>]` and
+// `git cat-file --batch-check[=<format>]`
+//
+// Every line on stdin names an object. For each of them the format is printed,
+// followed by the object's content and a newline in --batch mode:
+//
+//	<sha> <type> <size>
+//	<content>
+//
+// Objects that can't be found are reported as `<name> missing`.
+//
+// Each object is flushed once written, so that another program can wait
+// for it. With buffer, stdout is only flushed at the end, which is much
+// faster for thousands of objects.
+func catFileBatch(format string, withContents bool, buffer bool) {
+	parts, err := parseFormat(format, batchAtoms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := writeBatchObject(out, parts, scanner.Text(), withContents); err != nil {
+			out.Flush()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if buffer {
+			continue
+		}
+		if err := out.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			os.Exit(128)
+		}
+	}
+}
+
+// catFileBatchCommand implements `git cat-file --batch-command[=<format>]`
+//
+// Every line on stdin is a command, so that a single process can answer
+// both kinds of requests of another program:
+//
+//	contents <object>    the object as --batch prints it
+//	info <object>        the object as --batch-check prints it
+//	flush                flushes stdout, with buffer only
+//
+// The answer to each command is flushed once written, or with buffer, only
+// on flush and at the end.
+func catFileBatchCommand(format string, buffer bool) {
+	parts, err := parseFormat(format, batchAtoms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	fail := func(err error) {
+		out.Flush()
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		command, object, hasArgument := strings.Cut(line, " ")
+
+		switch {
+		case line == "":
+			fail(fmt.Errorf("empty command in input"))
+		case command == "flush" && hasArgument:
+			fail(fmt.Errorf("flush takes no arguments"))
+		case command == "flush" && !buffer:
+			fail(fmt.Errorf("flush is only for --buffer mode"))
+		case command == "flush":
+		case command != "contents" && command != "info":
+			fail(fmt.Errorf("unknown command: '%s'", line))
+		case object == "":
+			fail(fmt.Errorf("%s requires arguments", command))
+		default:
+			if err := writeBatchObject(out, parts, object, command == "contents"); err != nil {
+				out.Flush()
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		if buffer && command != "flush" {
+			continue
+		}
+		if err := out.Flush(); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// writeBatchObject writes an object the way --batch does, or --batch-check
+// without its contents.
+func writeBatchObject(w io.Writer, parts []formatPart, name string, withContents bool) error {
+	sha, err := resolveRevision(name)
+	if err != nil {
+		fmt.Fprintf(w, "%s missing\n", name)
+		return nil
+	}
+
+	objectType, content, err := readObject(sha)
+	if err != nil {
+		fmt.Fprintf(w, "%s missing\n", name)
+		return nil
+	}
+
+	line, err := expandFormat(parts, func(atom string) (string, error) {
+		switch atom {
+		case "objectname":
+			return sha, nil
+		case "objecttype":
+			return objectType, nil
+		case "objectsize":
+			return strconv.Itoa(len(content)), nil
+		}
+
+		stored, err := replaceObject(sha)
+		if err != nil {
+			return "", err
+		}
+		size, base, err := objectStorage(objects, stored)
+		if err != nil {
+			return "", err
+		}
+		if atom == "deltabase" {
+			return base, nil
+		}
+		return strconv.FormatInt(size, 10), nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to format '%s': %s", name, err)
+	}
+
+	fmt.Fprintln(w, line)
+	if withContents {
+		w.Write(content)
+		fmt.Fprintln(w)
+	}
+	return nil
+}
@@ -0,0 +1,978 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+)
+
+// bisectFiles are the files of .git a bisection keeps its state in, besides
+// the refs under refs/bisect/.
+var bisectFiles = []string{"BISECT_START", "BISECT_TERMS", "BISECT_NAMES", "BISECT_LOG", "BISECT_EXPECTED_REV", "BISECT_ANCESTORS_OK"}
+
+// bisect implements `git bisect start [<bad> [<good>...]]`, `git bisect
+// (bad | good) [<revision>...]`, `git bisect skip [(<revision> |
+// <range>)...]`, `git bisect reset [<commit>]`, `git bisect (visualize |
+// view) [--all]`, `git bisect log` and `git bisect replay <logfile>`
+//
+// It finds the commit that introduced a bug by binary search: each time a
+// commit is marked good or bad, the commit halfway between them is checked
+// out to be tested, until the first bad commit is found. The state is kept
+// like git does:
+//
+//	.git/BISECT_START          the branch bisecting started from, or its commit
+//	.git/BISECT_TERMS          the words for bad and good commits
+//	.git/BISECT_NAMES          the paths bisecting is limited to, none here
+//	.git/BISECT_LOG            what was done, as the commands to do it again
+//	.git/BISECT_EXPECTED_REV   the commit checked out to be tested
+//	.git/BISECT_ANCESTORS_OK   the good commits were checked to be ancestors of the bad one
+//	refs/bisect/bad            the bad commit
+//	refs/bisect/good-<sha>     the good commits
+//	refs/bisect/skip-<sha>     the commits that can't be tested, eg: they don't build
+//
+// bisect skip marks commits that can't be tested, the commits of a range
+// <from>..<to> too, and another commit is checked out instead, see
+// bisectSkipAway. When only skipped commits are left, they are shown as
+// what the first bad commit could be, and bisect exits with 2.
+//
+// bisect reset checks out the branch bisecting started from again, or the
+// given commit, and forgets about the bisection.
+//
+// bisect visualize shows the commits left to test, the ones reachable from
+// the bad commit but not from a good one, as log --graph --oneline does. The
+// commit checked out is marked, see bisectVisualize:
+//
+//	$ git bisect visualize
+//	    * 3f2a1c9 Merge branch 'parser'
+//	    |\
+//	>>> | * 8b7d6e5 Rewrite the parser
+//	    * | 1a2b3c4 Speed up the lexer
+//	    |/
+//	    * 9c8d7e6 Add a test for the parser
+//
+// --all shows the whole history of the bisection instead, down to its root
+// commits.
+//
+// bisect log shows BISECT_LOG, the commands that led to where the bisection
+// is, with the commits they marked as comments:
+//
+//	git bisect start 'main' 'v1.0'
+//	# good: [61d529a2b801240cf4c2d63f34eeaea2abe96be1] Fix the parser
+//	git bisect good 61d529a2b801240cf4c2d63f34eeaea2abe96be1
+//
+// Saved to a file, maybe edited, bisect replay does them again, see
+// bisectReplay, eg: to share a bisection or go back on a wrong mark.
+func bisect(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git bisect start [<bad> [<good>...]]")
+		fmt.Fprintln(os.Stderr, "   or: git bisect (bad | good) [<revision>...]")
+		fmt.Fprintln(os.Stderr, "   or: git bisect skip [(<revision> | <range>)...]")
+		fmt.Fprintln(os.Stderr, "   or: git bisect reset [<commit>]")
+		fmt.Fprintln(os.Stderr, "   or: git bisect (visualize | view) [--all]")
+		fmt.Fprintln(os.Stderr, "   or: git bisect log")
+		fmt.Fprintln(os.Stderr, "   or: git bisect replay <logfile>")
+		os.Exit(129)
+	}
+
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var err error
+	switch args[0] {
+	case "start":
+		err = bisectStart(out, args[1:])
+	case "bad", "good", "skip":
+		if !bisectStarted() {
+			fmt.Fprintln(os.Stderr, "You need to start by \"git bisect start\"")
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		revisions := args[1:]
+		if len(revisions) == 0 {
+			revisions = []string{"HEAD"}
+		}
+		if args[0] == "bad" && len(revisions) > 1 {
+			fail(fmt.Errorf("'git bisect bad' can take only one argument."))
+		}
+		if args[0] == "skip" {
+			if revisions, err = bisectExpandRanges(revisions); err != nil {
+				fail(err)
+			}
+		}
+		for _, revision := range revisions {
+			var sha string
+			if sha, err = bisectMark(args[0], revision); err != nil {
+				break
+			}
+			if err = bisectLog(fmt.Sprintf("git bisect %s %s", args[0], sha)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = bisectNext(out)
+		}
+	case "reset":
+		err = bisectReset(out, args[1:])
+	case "visualize", "view":
+		if !bisectStarted() {
+			fail(fmt.Errorf("error: We are not bisecting."))
+		}
+		all := false
+		for _, arg := range args[1:] {
+			if arg != "--all" {
+				fail(fmt.Errorf("error: unknown option: `%s'", arg))
+			}
+			all = true
+		}
+		err = bisectVisualize(out, all)
+	case "log":
+		if !bisectStarted() {
+			fail(fmt.Errorf("error: We are not bisecting."))
+		}
+		var content []byte
+		if content, err = os.ReadFile(gitPath("BISECT_LOG")); err == nil {
+			out.Write(content)
+		}
+	case "replay":
+		if len(args) != 2 {
+			fail(fmt.Errorf("error: no logfile given"))
+		}
+		err = bisectReplay(out, args[1])
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown subcommand: `%s'\n", args[0])
+		os.Exit(129)
+	}
+
+	if errors.Is(err, errBisectOnlySkipped) {
+		out.Flush()
+		os.Exit(2)
+	}
+	if err != nil {
+		out.Flush()
+		fail(err)
+	}
+}
+
+// bisectStarted reports whether a bisection is going on.
+func bisectStarted() bool {
+	_, err := os.Stat(gitPath("BISECT_START"))
+	return err == nil
+}
+
+// bisectLog adds lines to .git/BISECT_LOG.
+func bisectLog(lines ...string) error {
+	file, err := os.OpenFile(gitPath("BISECT_LOG"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Fprintln(file, line)
+	}
+	return file.Close()
+}
+
+// bisectCommit resolves a revision given to bisect to a commit.
+func bisectCommit(revision string) (string, *commit, error) {
+	sha, err := resolveRevision(revision)
+	if err != nil {
+		return "", nil, fmt.Errorf("Bad rev input: %s", revision)
+	}
+	sha, objectType, err := peelTag(sha)
+	if err != nil {
+		return "", nil, err
+	}
+	if objectType != "commit" {
+		return "", nil, fmt.Errorf("Bad rev input: %s", revision)
+	}
+	c, err := readCommit(sha)
+	return sha, c, err
+}
+
+// bisectExpandRanges replaces the ranges <from>..<to> given to bisect skip
+// with the commits reachable from <to> but not from <from>, newest first.
+func bisectExpandRanges(revisions []string) ([]string, error) {
+	var expanded []string
+	for _, revision := range revisions {
+		from, to, isRange := strings.Cut(revision, "..")
+		if !isRange {
+			expanded = append(expanded, revision)
+			continue
+		}
+		fromSha, _, err := bisectCommit(from)
+		if err != nil {
+			return nil, err
+		}
+		toSha, _, err := bisectCommit(to)
+		if err != nil {
+			return nil, err
+		}
+
+		excluded := map[string]bool{}
+		err = walkCommits([]string{fromSha}, func(node *commitNode) bool {
+			excluded[node.sha] = true
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = walkCommits([]string{toSha}, func(node *commitNode) bool {
+			if !excluded[node.sha] {
+				expanded = append(expanded, node.sha)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// bisectReplay does the commands of a bisect log again, see bisect log,
+// after forgetting about the bisection going on: a start, then the marks,
+// with the commit to test checked out once they are all done. Lines that
+// aren't bisect commands, eg: the comments, are skipped. Like git, it stops
+// at the first command it can't do: an unknown one or a revision that
+// doesn't resolve. It also stops at a commit outside of the bisection, see
+// bisectCheckReplayed, since the log can't be of this history.
+func bisectReplay(w io.Writer, name string) error {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("error: cannot read file '%s' for replaying", name)
+	}
+	if err := bisectReset(w, nil); err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		command, ok := strings.CutPrefix(strings.TrimSpace(line), "git bisect ")
+		if !ok {
+			command, ok = strings.CutPrefix(strings.TrimSpace(line), "git-bisect ")
+		}
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(command)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "start":
+			// the log quotes the arguments of start, eg: 'main'
+			var args []string
+			for _, arg := range fields[1:] {
+				args = append(args, strings.TrimSuffix(strings.TrimPrefix(arg, "'"), "'"))
+			}
+			if err := bisectStart(w, args); err != nil {
+				return err
+			}
+		case "bad", "good", "skip":
+			if len(fields) != 2 {
+				return fmt.Errorf("error: '%s' needs exactly one commit", fields[0])
+			}
+			sha, _, err := bisectCommit(fields[1])
+			if err != nil {
+				return fmt.Errorf("error: couldn't get the oid of the rev '%s'", fields[1])
+			}
+			if err := bisectCheckReplayed(fields[0], sha); err != nil {
+				return err
+			}
+			sha, err = bisectMark(fields[0], fields[1])
+			if err != nil {
+				return err
+			}
+			if err := bisectLog(fmt.Sprintf("git bisect %s %s", fields[0], sha)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("error: '%s'?? what are you talking about?", fields[0])
+		}
+	}
+	return bisectNext(w)
+}
+
+// bisectCheckReplayed fails unless a commit marked by a replayed log is
+// within the bounds of the marks so far: reachable from the bad commit,
+// once known, and for a bad or skipped commit, not from a good one.
+func bisectCheckReplayed(term string, sha string) error {
+	outside := fmt.Errorf("error: %s is not between the good and bad commits of the bisection", sha)
+	if bad, err := readRef("refs/bisect/bad"); err == nil {
+		if reachable, err := isAncestor(sha, bad); err != nil {
+			return err
+		} else if !reachable {
+			return outside
+		}
+	}
+	if term == "good" {
+		return nil
+	}
+
+	goodRefs, err := listRefsWithPrefix("refs/bisect/good-")
+	if err != nil {
+		return err
+	}
+	for _, ref := range goodRefs {
+		if reachable, err := isAncestor(sha, ref.sha); err != nil {
+			return err
+		} else if reachable {
+			return outside
+		}
+	}
+	return nil
+}
+
+// bisectStart starts a new bisection from the branch, or commit, checked
+// out, forgetting about any previous one.
+func bisectStart(w io.Writer, args []string) error {
+	start := ""
+	if content, err := os.ReadFile(gitPath("BISECT_START")); err == nil {
+		// restarting goes back to where the first start was
+		start = strings.TrimSpace(string(content))
+	} else if branch, symbolic, err := readSymbolicRef("HEAD"); err != nil {
+		return err
+	} else if symbolic {
+		start = strings.TrimPrefix(branch, "refs/heads/")
+	} else if start, err = resolveRevision("HEAD"); err != nil {
+		return err
+	}
+	if err := bisectClean(); err != nil {
+		return err
+	}
+
+	var revisions, quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, "'"+arg+"'")
+		if arg == "--" {
+			break
+		}
+		revisions = append(revisions, arg)
+	}
+	// check the revisions before writing anything
+	for _, revision := range revisions {
+		if _, _, err := bisectCommit(revision); err != nil {
+			return err
+		}
+	}
+
+	files := map[string]string{"BISECT_START": start, "BISECT_TERMS": "bad\ngood", "BISECT_NAMES": ""}
+	for name, content := range files {
+		if err := os.WriteFile(gitPath(name), []byte(content+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	for i, revision := range revisions {
+		term := "good"
+		if i == 0 {
+			term = "bad"
+		}
+		if _, err := bisectMark(term, revision); err != nil {
+			return err
+		}
+	}
+	if err := bisectLog(strings.TrimSpace("git bisect start " + strings.Join(quoted, " "))); err != nil {
+		return err
+	}
+	if err := bisectNext(w); err != nil {
+		// like git, a bisection that can't start is forgotten
+		bisectClean()
+		return err
+	}
+	return nil
+}
+
+// bisectMark marks a commit as bad, good or skipped, and returns it.
+func bisectMark(term string, revision string) (string, error) {
+	sha, c, err := bisectCommit(revision)
+	if err != nil {
+		return "", err
+	}
+
+	ref := "refs/bisect/bad"
+	if term != "bad" {
+		ref = "refs/bisect/" + term + "-" + sha
+	}
+	if err := updateRef(ref, sha); err != nil {
+		return "", err
+	}
+	return sha, bisectLog(fmt.Sprintf("# %s: [%s] %s", term, sha, subject(c.message)))
+}
+
+// bisectSteps estimates how many more commits will be tested among the
+// given number of candidates, the way git does.
+func bisectSteps(candidates int) int {
+	if candidates < 3 {
+		return 0
+	}
+	n := bits.Len(uint(candidates)) - 1
+	e := 1 << n
+	if e < 3*(candidates-e) {
+		return n
+	}
+	return n - 1
+}
+
+// bisectWeights counts how many candidates each of the candidates, oldest
+// first, reaches among its ancestors, itself included: its weight. They are
+// counted the way git does, in this order:
+//
+//   - the candidates without a parent among them weigh 1
+//   - merges are counted, in order
+//   - the others weigh one more than their parent, in order, until all are known
+//
+// With halfway, counting stops at the first commit whose weight it accepts,
+// whose index is returned, -1 when there's none.
+func bisectWeights(candidates []*commitNode, halfway func(weight int) bool) ([]int, int) {
+	index := map[string]int{}
+	for i, node := range candidates {
+		index[node.sha] = i
+	}
+
+	weights := make([]int, len(candidates))
+	counted := 0
+	for i, node := range candidates {
+		parents := 0
+		for _, parent := range node.parents {
+			if _, ok := index[parent]; ok {
+				parents++
+			}
+		}
+		switch parents {
+		case 0:
+			weights[i] = 1
+			counted++
+		case 1:
+			weights[i] = -1
+		default:
+			weights[i] = -2
+		}
+	}
+
+	for i, node := range candidates {
+		if weights[i] != -2 {
+			continue
+		}
+		seen := map[string]bool{node.sha: true}
+		queue := []*commitNode{node}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, parent := range current.parents {
+				if j, ok := index[parent]; ok && !seen[parent] {
+					seen[parent] = true
+					queue = append(queue, candidates[j])
+				}
+			}
+		}
+		weights[i] = len(seen)
+		if halfway != nil && halfway(weights[i]) {
+			return weights, i
+		}
+		counted++
+	}
+
+	for counted < len(candidates) {
+		for i, node := range candidates {
+			if weights[i] >= 0 {
+				continue
+			}
+			for _, parent := range node.parents {
+				if j, ok := index[parent]; ok && weights[j] >= 0 {
+					weights[i] = weights[j] + 1
+					counted++
+					break
+				}
+			}
+			if weights[i] >= 0 && halfway != nil && halfway(weights[i]) {
+				return weights, i
+			}
+		}
+	}
+	return weights, -1
+}
+
+// bisectMidpoint picks the commit to test among the candidates, oldest
+// first: the one splitting them in the most even halves, with as many
+// candidates among its ancestors, itself included, as not. It returns the
+// commit and how many candidates it reaches, its weight.
+//
+// Ties are broken the way git does, which stops at the first commit within
+// one of the half, in the order the weights are counted, see bisectWeights.
+// When no commit is that close, the first one closest to the half wins.
+func bisectMidpoint(candidates []*commitNode) (string, int) {
+	weights, found := bisectWeights(candidates, func(weight int) bool {
+		diff := 2*weight - len(candidates)
+		return diff >= -1 && diff <= 1
+	})
+	if found >= 0 {
+		return candidates[found].sha, weights[found]
+	}
+
+	best, bestDistance := 0, -1
+	for i, weight := range weights {
+		if distance := min(weight, len(candidates)-weight); distance > bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return candidates[best].sha, weights[best]
+}
+
+// bisectPrnModulo bounds the pseudo-random numbers of bisectSkipAway.
+const bisectPrnModulo = 32768
+
+// bisectSkipAway picks the commit to test among the candidates, oldest
+// first, when some commits were skipped, the way git does: the candidates
+// are sorted from the one splitting them in the most even halves, by sha on
+// a tie. When the first one was skipped, another one is picked, pseudo
+// randomly but closer to the best ones, away from the skipped one since
+// the commits next to it may well be broken the same way.
+//
+// It returns the commit, "" when all the candidates were skipped, the
+// weight of the best one, skipped or not, see bisectMidpoint, and the
+// skipped candidates in their order, when the best one was skipped.
+func bisectSkipAway(candidates []*commitNode, skipped map[string]bool, bad string) (string, int, []string) {
+	weights, _ := bisectWeights(candidates, nil)
+	distance := func(i int) int {
+		return min(weights[i], len(candidates)-weights[i])
+	}
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		if distance(order[a]) != distance(order[b]) {
+			return distance(order[a]) > distance(order[b])
+		}
+		return candidates[order[a]].sha < candidates[order[b]].sha
+	})
+
+	best := candidates[order[0]]
+	if !skipped[best.sha] {
+		return best.sha, weights[order[0]], nil
+	}
+	var tried, left []string
+	for _, i := range order {
+		if skipped[candidates[i].sha] {
+			tried = append(tried, candidates[i].sha)
+		} else {
+			left = append(left, candidates[i].sha)
+		}
+	}
+	if len(left) == 0 {
+		return "", weights[order[0]], tried
+	}
+
+	// git's generator of "man 3 rand", seeded with the number of commits
+	prn := int((uint32(len(left))*1103515245 + 12345) / 65536 % bisectPrnModulo)
+	index := len(left) * prn / bisectPrnModulo * sqrti(prn) / sqrti(bisectPrnModulo)
+	switch {
+	case index >= len(left):
+		return left[0], weights[order[0]], tried
+	case left[index] != bad:
+		return left[index], weights[order[0]], tried
+	case index > 0:
+		return left[index-1], weights[order[0]], tried
+	}
+	return left[0], weights[order[0]], tried
+}
+
+// sqrti is the integer square root of git, computed the same way with
+// floats, so that bisectSkipAway picks the same commits.
+func sqrti(value int) int {
+	if value == 0 {
+		return 0
+	}
+	x := float32(value)
+	for {
+		y := (x + float32(value)/x) / 2
+		d := y - x
+		if d < 0 {
+			d = -d
+		}
+		x = y
+		if d < 0.5 {
+			return int(x)
+		}
+	}
+}
+
+// bisectNext checks out the next commit to test, or shows the first bad
+// commit when it's found.
+//
+// The candidates are the commits reachable from the bad one, but not from
+// any good one, see bisectMidpoint.
+func bisectNext(w io.Writer) error {
+	bad, err := readRef("refs/bisect/bad")
+	if err != nil {
+		bad = ""
+	}
+	goodRefs, err := listRefsWithPrefix("refs/bisect/good-")
+	if err != nil {
+		return err
+	}
+
+	status := ""
+	switch {
+	case bad == "" && len(goodRefs) == 0:
+		status = "waiting for both good and bad commits"
+	case bad == "" && len(goodRefs) == 1:
+		status = "waiting for bad commit, 1 good commit known"
+	case bad == "":
+		status = fmt.Sprintf("waiting for bad commit, %d good commits known", len(goodRefs))
+	case len(goodRefs) == 0:
+		status = "waiting for good commit(s), bad commit known"
+	}
+	if status != "" {
+		fmt.Fprintf(w, "status: %s\n", status)
+		return bisectLog("# status: " + status)
+	}
+
+	var goods []string
+	for _, ref := range goodRefs {
+		if ref.sha == bad {
+			return fmt.Errorf("%s was both good and bad", bad)
+		}
+		goods = append(goods, ref.sha)
+	}
+	excluded := map[string]bool{}
+	err = walkCommits(goods, func(node *commitNode) bool {
+		excluded[node.sha] = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// oldest first
+	var candidates []*commitNode
+	reachable := map[string]bool{}
+	err = walkCommits([]string{bad}, func(node *commitNode) bool {
+		reachable[node.sha] = true
+		if !excluded[node.sha] {
+			candidates = append([]*commitNode{node}, candidates...)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// like git, the good commits are only checked once, a later bad commit
+	// may well be on another branch
+	_, err = os.Stat(gitPath("BISECT_ANCESTORS_OK"))
+	checked := err == nil
+	for _, good := range goods {
+		if (!checked && !reachable[good]) || len(candidates) == 0 {
+			return fmt.Errorf("Some good revs are not ancestors of the bad rev.\ngit bisect cannot work properly in this case.\nMaybe you mistook good and bad revs?")
+		}
+	}
+	if err := os.WriteFile(gitPath("BISECT_ANCESTORS_OK"), nil, 0644); err != nil {
+		return err
+	}
+
+	skipRefs, err := listRefsWithPrefix("refs/bisect/skip-")
+	if err != nil {
+		return err
+	}
+	var best string
+	var bestWeight int
+	if len(skipRefs) == 0 {
+		if len(candidates) == 1 {
+			return bisectFound(w, bad)
+		}
+		best, bestWeight = bisectMidpoint(candidates)
+	} else {
+		// like git, once a commit is skipped, the candidates are all weighed
+		skipped := map[string]bool{}
+		for _, ref := range skipRefs {
+			skipped[ref.sha] = true
+		}
+		var tried []string
+		best, bestWeight, tried = bisectSkipAway(candidates, skipped, bad)
+		switch {
+		case len(tried) > 0 && (best == "" || best == bad):
+			return bisectOnlySkipped(w, tried, best, candidates)
+		case best == bad:
+			return bisectFound(w, bad)
+		}
+	}
+	left, steps := len(candidates)-bestWeight-1, bisectSteps(len(candidates))
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	fmt.Fprintf(w, "Bisecting: %s left to test after this (roughly %s)\n", plural(left, "revision"), plural(steps, "step"))
+
+	if err := os.WriteFile(gitPath("BISECT_EXPECTED_REV"), []byte(best+"\n"), 0644); err != nil {
+		return err
+	}
+	previous, _ := resolveRevision("HEAD")
+	c, err := switchCommit(best)
+	if err != nil {
+		return fmt.Errorf("error: %s", err)
+	}
+	if err := updateRef("HEAD", best); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "[%s] %s\n", best, subject(c.message))
+	// like git, a failing hook doesn't stop the bisection
+	runHook("post-checkout", previous, best, "1")
+	return nil
+}
+
+// bisectFound shows the first bad commit, with the files it changed:
+//
+//	<sha> is the first bad commit
+//	commit <sha>
+//	Author: ...
+//
+//	    <message>
+//
+//	 <path> | 2 +-
+//	 1 file changed, 1 insertion(+), 1 deletion(-)
+func bisectFound(w io.Writer, sha string) error {
+	c, err := readCommit(sha)
+	if err != nil {
+		return err
+	}
+	format, err := parsePrettyFormat("medium")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s is the first bad commit\n", sha)
+	writeCommit(w, sha, c, format)
+	if len(c.parents) <= 1 {
+		changes, err := commitChanges(c)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			startLogPatch(w, format)
+			if err := writeChanges(w, changes, nil, &diffOptions{}, &optionalString{set: true}, false, false); err != nil {
+				return err
+			}
+			writeSummary(w, changes)
+		}
+	}
+	return bisectLog(fmt.Sprintf("# first bad commit: [%s] %s", sha, subject(c.message)))
+}
+
+// errBisectOnlySkipped is returned when the first bad commit can't be told
+// apart from skipped commits, for bisect to exit with 2 like git.
+var errBisectOnlySkipped = errors.New("only skipped commits left to test")
+
+// bisectOnlySkipped shows the commits the first bad one could be when only
+// skipped commits are left to test, the skipped ones and the bad one,
+// unless it was skipped too:
+//
+//	There are only 'skip'ped commits left to test.
+//	The first bad commit could be any of:
+//	<sha>
+//	We cannot bisect more!
+//
+// Like git, the log gets every candidate, newest first.
+func bisectOnlySkipped(w io.Writer, tried []string, bad string, candidates []*commitNode) error {
+	fmt.Fprintln(w, "There are only 'skip'ped commits left to test.")
+	fmt.Fprintln(w, "The first bad commit could be any of:")
+	for _, sha := range tried {
+		fmt.Fprintln(w, sha)
+	}
+	if bad != "" {
+		fmt.Fprintln(w, bad)
+	}
+	fmt.Fprintln(w, "We cannot bisect more!")
+
+	lines := []string{"# only skipped commits left to test"}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		c, err := readCommit(candidates[i].sha)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("# possible first bad commit: [%s] %s", candidates[i].sha, subject(c.message)))
+	}
+	if err := bisectLog(lines...); err != nil {
+		return err
+	}
+	return errBisectOnlySkipped
+}
+
+// bisectVisualize writes the graph of the commits left to test, or of all
+// the commits of the bisection with all, with `>>> ` before the line of the
+// commit checked out.
+func bisectVisualize(w io.Writer, all bool) error {
+	bad, err := readRef("refs/bisect/bad")
+	if err != nil {
+		bad = ""
+	}
+	goodRefs, err := listRefsWithPrefix("refs/bisect/good-")
+	if err != nil {
+		return err
+	}
+	if bad == "" || len(goodRefs) == 0 {
+		return fmt.Errorf("You need to give me at least one good and one bad revision.\n" +
+			"(You can use \"git bisect bad\" and \"git bisect good\" for that.)")
+	}
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+
+	starts := []string{bad}
+	excluded := map[string]bool{}
+	if all {
+		skipRefs, err := listRefsWithPrefix("refs/bisect/skip-")
+		if err != nil {
+			return err
+		}
+		for _, ref := range append(goodRefs, skipRefs...) {
+			starts = append(starts, ref.sha)
+		}
+		starts = append(starts, head)
+	} else {
+		var goods []string
+		for _, ref := range goodRefs {
+			goods = append(goods, ref.sha)
+		}
+		err = walkCommits(goods, func(node *commitNode) bool {
+			excluded[node.sha] = true
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var walked []*commitNode
+	entries := map[string]*logEntry{}
+	var readErr error
+	err = walkCommits(starts, func(node *commitNode) bool {
+		if excluded[node.sha] {
+			return true
+		}
+		c, err := readCommit(node.sha)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		walked = append(walked, node)
+		entries[node.sha] = &logEntry{commit: c}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return err
+	}
+
+	format, err := parsePrettyFormat("oneline")
+	if err != nil {
+		return err
+	}
+	format.abbrev = true
+	var graph bytes.Buffer
+	if err := writeGraphLog(&graph, walked, entries, -1, format, nil); err != nil {
+		return err
+	}
+
+	// the commit line of HEAD is the one whose sha follows the graph
+	for _, line := range strings.SplitAfter(graph.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		prefix := "    "
+		if strings.HasPrefix(strings.TrimLeft(line, "*|/\\_-. "), head[:7]+" ") {
+			prefix = ">>> "
+		}
+		io.WriteString(w, prefix+line)
+	}
+	return nil
+}
+
+// bisectReset ends the bisection, going back to where it started or to the
+// given commit.
+func bisectReset(w io.Writer, args []string) error {
+	if !bisectStarted() {
+		fmt.Fprintln(w, "We are not bisecting.")
+		return nil
+	}
+	content, err := os.ReadFile(gitPath("BISECT_START"))
+	if err != nil {
+		return err
+	}
+	target := strings.TrimSpace(string(content))
+	if len(args) > 0 {
+		target = args[0]
+	}
+
+	branch := ""
+	if _, err := readRef("refs/heads/" + target); err == nil {
+		branch = "refs/heads/" + target
+	}
+	sha, c, err := bisectCommit(target)
+	if err != nil {
+		return fmt.Errorf("could not check out original HEAD '%s'. Try 'git bisect reset <commit>'.", target)
+	}
+
+	current, symbolic, _ := readSymbolicRef("HEAD")
+	switch {
+	case symbolic && current == branch:
+		fmt.Fprintf(w, "Already on '%s'\n", target)
+	default:
+		headSha, err := resolveRevision("HEAD")
+		if err == nil {
+			if head, err := readCommit(headSha); err == nil && !symbolic {
+				fmt.Fprintf(w, "Previous HEAD position was %s %s\n", headSha[:7], subject(head.message))
+			}
+		}
+		if _, err := switchCommit(sha); err != nil {
+			return fmt.Errorf("error: %s", err)
+		}
+		if branch != "" {
+			err = updateSymbolicRef("HEAD", branch)
+			fmt.Fprintf(w, "Switched to branch '%s'\n", target)
+		} else {
+			err = updateRef("HEAD", sha)
+			fmt.Fprintf(w, "HEAD is now at %s %s\n", sha[:7], subject(c.message))
+		}
+		if err != nil {
+			return err
+		}
+		runHook("post-checkout", headSha, sha, "1")
+	}
+
+	return bisectClean()
+}
+
+// bisectClean forgets about the bisection: its refs and its files.
+func bisectClean() error {
+	refs, err := listRefsWithPrefix("refs/bisect/")
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := deleteRef(ref.name); err != nil {
+			return err
+		}
+	}
+	for _, name := range bisectFiles {
+		if err := os.Remove(gitPath(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
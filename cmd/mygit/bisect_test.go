@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testBisectHistory makes a linear history of n commits on main, checked
+// out, and returns them, oldest first.
+func testBisectHistory(t *testing.T, n int) []string {
+	t.Helper()
+	var shas []string
+	for i := 1; i <= n; i++ {
+		var parents []string
+		if i > 1 {
+			parents = []string{shas[i-2]}
+		}
+		shas = append(shas, writeTestCommit(t, fmt.Sprintf("c%d", i), parents...))
+	}
+	if err := updateRef("refs/heads/main", shas[n-1]); err != nil {
+		t.Fatal(err)
+	}
+	return shas
+}
+
+// testBisectHead returns the commit bisect checked out.
+func testBisectHead(t *testing.T) string {
+	t.Helper()
+	sha, err := resolveRevision("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+func TestBisectSkip(t *testing.T) {
+	testRepository(t)
+	shas := testBisectHistory(t, 10)
+	if err := bisectStart(&bytes.Buffer{}, []string{shas[9], shas[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if head := testBisectHead(t); head != shas[4] {
+		t.Fatalf("bisect start checked out %s, expected the midpoint c5 %s", head, shas[4])
+	}
+
+	// each skipped commit is tested no more, another candidate is instead
+	skipped := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		head := testBisectHead(t)
+		skipped[head] = true
+		captureStdout(t, func() { bisect([]string{"skip"}) })
+		next := testBisectHead(t)
+		if skipped[next] || next == shas[0] || next == shas[9] {
+			t.Fatalf("after skipping %s, %s was checked out", head, next)
+		}
+		if !fileExists(gitPath("refs/bisect/skip-" + head)) {
+			t.Errorf("no refs/bisect/skip- ref for %s", head)
+		}
+	}
+
+	content, err := os.ReadFile(gitPath("BISECT_LOG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sha := range skipped {
+		if !strings.Contains(string(content), "\ngit bisect skip "+sha+"\n") {
+			t.Errorf("the log doesn't have the skip of %s\n%s", sha, content)
+		}
+	}
+}
+
+func TestBisectOnlySkippedLeft(t *testing.T) {
+	testRepository(t)
+	shas := testBisectHistory(t, 4)
+	if err := bisectStart(&bytes.Buffer{}, []string{shas[3], shas[0]}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range shas[1:3] {
+		if _, err := bisectMark("skip", sha); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := bisectNext(&out); !errors.Is(err, errBisectOnlySkipped) {
+		t.Fatalf("with only skipped commits left, got %v, expected errBisectOnlySkipped", err)
+	}
+	// c2 and c3 are as close to the middle, by sha, then the bad c4
+	tried := shas[1:3]
+	if tried[0] > tried[1] {
+		tried = []string{tried[1], tried[0]}
+	}
+	want := "There are only 'skip'ped commits left to test.\n" +
+		"The first bad commit could be any of:\n" +
+		tried[0] + "\n" + tried[1] + "\n" + shas[3] + "\n" +
+		"We cannot bisect more!\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nexpected\n%s", out.String(), want)
+	}
+}
+
+func TestBisectReplaySkip(t *testing.T) {
+	testRepository(t)
+	shas := testBisectHistory(t, 10)
+	if err := bisectStart(&bytes.Buffer{}, []string{shas[9], shas[0]}); err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() { bisect([]string{"skip"}) })
+	captureStdout(t, func() { bisect([]string{"good"}) })
+	captureStdout(t, func() { bisect([]string{"skip"}) })
+	head := testBisectHead(t)
+	log := captureStdout(t, func() { bisect([]string{"log"}) })
+	if err := os.WriteFile("bisect.log", []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bisectReplay(&bytes.Buffer{}, "bisect.log"); err != nil {
+		t.Fatal(err)
+	}
+	if replayed := testBisectHead(t); replayed != head {
+		t.Errorf("the replay checked out %s, expected %s like the bisection replayed", replayed, head)
+	}
+	skips, err := listRefsWithPrefix("refs/bisect/skip-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skips) != 2 {
+		t.Errorf("the replay skipped %d commits, expected 2", len(skips))
+	}
+}
+
+func TestBisectReplayOutsideOfTheBisection(t *testing.T) {
+	testRepository(t)
+	shas := testBisectHistory(t, 10)
+	other := writeTestCommit(t, "elsewhere")
+
+	tests := []struct {
+		line, sha string
+	}{
+		// an ancestor of the good commit can't be the first bad one
+		{"git bisect skip " + shas[1], shas[1]},
+		{"git bisect bad " + shas[1], shas[1]},
+		// not reachable from the bad commit
+		{"git bisect good " + other, other},
+		{"git bisect skip " + other, other},
+	}
+	for _, test := range tests {
+		log := fmt.Sprintf("git bisect start '%s' '%s'\n%s\n", shas[9], shas[2], test.line)
+		if err := os.WriteFile("bisect.log", []byte(log), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := bisectReplay(&bytes.Buffer{}, "bisect.log")
+		want := fmt.Sprintf("error: %s is not between the good and bad commits of the bisection", test.sha)
+		if err == nil || err.Error() != want {
+			t.Errorf("replaying %q failed with %v, expected %q", test.line, err, want)
+		}
+	}
+}
+
+func TestBisectVisualize(t *testing.T) {
+	testRepository(t)
+	shas := testBisectHistory(t, 5)
+	if err := bisectStart(&bytes.Buffer{}, []string{shas[4], shas[0]}); err != nil {
+		t.Fatal(err)
+	}
+	head := testBisectHead(t)
+
+	line := func(i int) string {
+		prefix := "    "
+		if shas[i] == head {
+			prefix = ">>> "
+		}
+		return fmt.Sprintf("%s* %s c%d\n", prefix, shas[i][:7], i+1)
+	}
+	// the good commit isn't left to test
+	want := line(4) + line(3) + line(2) + line(1)
+	var out bytes.Buffer
+	if err := bisectVisualize(&out, false); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("got\n%s\nexpected\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := bisectVisualize(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	if want += line(0); out.String() != want {
+		t.Errorf("with --all, got\n%s\nexpected\n%s", out.String(), want)
+	}
+}
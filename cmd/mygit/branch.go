@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// columnFlag adds `--column[=<options>]` and `--no-column` to a command's
+// flags. The returned function gives the mode to use: the flags win over
+// `column.<command>` and `column.ui` in the config.
+func columnFlag(flag *flag.FlagSet, command string) func() ColumnMode {
+	column := &optionalString{value: "always"}
+	flag.Var(column, "column", "show the list in columns, `<options>` as in column.ui")
+	noColumn := flag.Bool("no-column", false, "don't show the list in columns")
+
+	return func() ColumnMode {
+		if *noColumn {
+			return ColumnNever
+		}
+		if !column.set {
+			return columnModeFor(command)
+		}
+		mode, err := parseColumnMode(column.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+			os.Exit(1)
+		}
+		return mode
+	}
+}
+
+// listRefsWithPrefix returns the refs under prefix, eg: refs/heads/.
+func listRefsWithPrefix(prefix string) ([]ref, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []ref
+	for _, r := range refs {
+		if strings.HasPrefix(r.name, prefix) {
+			matching = append(matching, r)
+		}
+	}
+	return matching, nil
+}
+
+// branch implements `git branch [--column[=<options>] | --no-column]`
+//
+// It only lists the local branches, one per line as `* <name>` for the
+// current branch and `  <name>` for the others. A detached HEAD is listed
+// first as `* (HEAD detached at <sha>)`.
+func branch(args []string) {
+	flag := flag.NewFlagSet("git branch", flag.ExitOnError)
+	columnMode := columnFlag(flag, "branch")
+	flag.Parse(args)
+
+	refs, err := listRefsWithPrefix("refs/heads/")
+	if err != nil {
+		error := fmt.Sprintf("Failed to list branches: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	current, symbolic, err := readSymbolicRef("HEAD")
+	if err != nil {
+		error := fmt.Sprintf("Failed to read HEAD: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	var items []string
+	if !symbolic {
+		// a detached HEAD holds the sha of a commit instead
+		if sha, err := readRef("HEAD"); err == nil && isObjectName(sha) {
+			items = append(items, fmt.Sprintf("* (HEAD detached at %s)", sha[:7]))
+		}
+	}
+	for _, r := range refs {
+		if r.name == current {
+			items = append(items, "* "+shortRefName(r.name))
+		} else {
+			items = append(items, "  "+shortRefName(r.name))
+		}
+	}
+
+	fmt.Print(FormatColumns(items, terminalWidth(), ColumnOptions{Padding: 1, Mode: columnMode()}))
+}
+
+// tagCmd implements `git tag [--column[=<options>] | --no-column]`
+//
+// It only lists the tags, by name.
+func tagCmd(args []string) {
+	flag := flag.NewFlagSet("git tag", flag.ExitOnError)
+	columnMode := columnFlag(flag, "tag")
+	flag.Parse(args)
+
+	refs, err := listRefsWithPrefix("refs/tags/")
+	if err != nil {
+		error := fmt.Sprintf("Failed to list tags: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	var items []string
+	for _, r := range refs {
+		items = append(items, shortRefName(r.name))
+	}
+
+	fmt.Print(FormatColumns(items, terminalWidth(), ColumnOptions{Padding: 2, Mode: columnMode()}))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// checkAttr implements `git check-attr [-a | --all | <attr>...] [--] <pathname>...`
+// and `git check-attr --stdin [-a | --all | <attr>...]`
+//
+// It prints the value of each attribute for each path, see attrMatcher:
+//
+//	<path>: <attr>: <value>
+//
+// where the value is set, unset, unspecified or the value given with =.
+// Macros, like the builtin binary, show as set and give their attributes.
+// With --all, every attribute set on a path is printed instead, in the
+// order they appear in the attributes files; unspecified ones are left out.
+//
+// Without --, only the first argument is an attribute. With --stdin, the
+// paths are read from stdin, one per line.
+func checkAttr(args []string) {
+	flag := flag.NewFlagSet("git check-attr", flag.ExitOnError)
+	var (
+		all   = flag.Bool("all", false, "report all attributes set on file")
+		stdin = flag.Bool("stdin", false, "read file names from stdin")
+	)
+	flag.BoolVar(all, "a", false, "same as --all")
+	flag.Parse(args)
+	args = flag.Args()
+
+	usage := func(message string) {
+		fmt.Fprintf(os.Stderr, "error: %s\n", message)
+		fmt.Fprintln(os.Stderr, "usage: git check-attr [-a | --all | <attr>...] [--] <pathname>...")
+		fmt.Fprintln(os.Stderr, "   or: git check-attr --stdin [-a | --all | <attr>...]")
+		os.Exit(129)
+	}
+
+	var attrs, paths []string
+	dashdash := -1
+	for i, arg := range args {
+		if arg == "--" {
+			dashdash = i
+			break
+		}
+	}
+	switch {
+	case dashdash >= 0:
+		attrs, paths = args[:dashdash], args[dashdash+1:]
+	case *all || *stdin:
+		attrs, paths = nil, args
+		if !*all {
+			attrs, paths = args, nil
+		}
+	case len(args) > 0:
+		attrs, paths = args[:1], args[1:]
+	}
+
+	if *all && len(attrs) > 0 {
+		usage("Attributes and --all both specified")
+	}
+	if !*all && len(attrs) == 0 {
+		usage("No attribute specified")
+	}
+	if *stdin && len(paths) > 0 {
+		usage("Can't specify files with --stdin")
+	}
+	if !*stdin && len(paths) == 0 {
+		usage("No file specified")
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	matcher := newAttrMatcher()
+	check := func(path string) {
+		values := matcher.attributes(cleanPath(path))
+		names := attrs
+		if *all {
+			names = matcher.names(values)
+		}
+
+		for _, name := range names {
+			value, ok := values[name]
+			if !ok {
+				value = attrUnspecified
+			}
+			fmt.Fprintf(out, "%s: %s: %s\n", path, name, value)
+		}
+	}
+
+	if !*stdin {
+		for _, path := range paths {
+			check(path)
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		check(scanner.Text())
+		// whoever writes the paths may wait for the answer before the next one
+		out.Flush()
+	}
+	if err := scanner.Err(); err != nil {
+		out.Flush()
+		error := fmt.Sprintf("Failed to read stdin: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkIgnore implements `git check-ignore [-v] [-n] [-q] [--no-index] [-z] (--stdin | <path>...)`
+//
+// It prints the paths that are ignored, as decided by the same rules as
+// clean, see ignoreMatcher: the .gitignore of each directory, with negation,
+// then .git/info/exclude and core.excludesFile. A path under an ignored
+// directory is ignored by the directory's pattern.
+//
+// With -v, the pattern that decided is shown before each path, even when it
+// is a negated one that re-includes the path:
+//
+//	.gitignore:1:*.log	debug.log
+//	sub/.gitignore:2:!keep	sub/keep
+//
+// -n also shows the paths that match nothing, as `::\t<path>`. Tracked
+// files are never ignored, unless --no-index is given. It exits with 0 when
+// a path is ignored, 1 when none is.
+func checkIgnore(args []string) {
+	flag := flag.NewFlagSet("git check-ignore", flag.ExitOnError)
+	var (
+		verbose     = flag.Bool("v", false, "show the pattern that matched each path")
+		nonMatching = flag.Bool("n", false, "also show the paths that don't match, with -v")
+		quiet       = flag.Bool("q", false, "only tell with the exit code whether the path is ignored")
+		stdin       = flag.Bool("stdin", false, "read the paths from stdin, one per line")
+		nulls       = flag.Bool("z", false, "separate the paths read and written with NUL instead of newlines")
+		noIndex     = flag.Bool("no-index", false, "don't look in the index, tracked files can be ignored too")
+	)
+	flag.BoolVar(verbose, "verbose", false, "same as -v")
+	flag.BoolVar(nonMatching, "non-matching", false, "same as -n")
+	flag.BoolVar(quiet, "quiet", false, "same as -q")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	switch {
+	case *stdin && len(args) > 0:
+		fail(fmt.Errorf("cannot specify pathnames with --stdin"))
+	case !*stdin && len(args) == 0:
+		fail(fmt.Errorf("no path specified"))
+	case *quiet && *verbose:
+		fail(fmt.Errorf("cannot have both --quiet and --verbose"))
+	case *quiet && len(args) != 1:
+		fail(fmt.Errorf("--quiet is only valid with a single pathname"))
+	case *nulls && !*stdin:
+		fail(fmt.Errorf("-z only makes sense with --stdin"))
+	case *nonMatching && !*verbose:
+		fail(fmt.Errorf("--non-matching is only valid with --verbose"))
+	}
+
+	tracked := map[string]bool{}
+	if !*noIndex {
+		if idx, err := readIndex(); err == nil {
+			tracked, _ = idx.trackedPaths()
+		}
+	}
+	workTree, err := os.Getwd()
+	if err != nil {
+		fail(err)
+	}
+
+	matcher := newIgnoreMatcher()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	separator := "\n"
+	if *nulls {
+		separator = "\x00"
+	}
+
+	ignored := 0
+	check := func(path string) {
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			fail(err)
+		}
+		relative, err := filepath.Rel(workTree, absolute)
+		if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+			out.Flush()
+			fail(fmt.Errorf("%s: '%s' is outside repository at '%s'", path, path, workTree))
+		}
+		name := cleanPath(relative)
+
+		var rule *ignoreRule
+		if name != "" && !tracked[name] {
+			info, err := os.Lstat(name)
+			rule = matcher.decidingRule(name, err == nil && info.IsDir())
+		}
+		if rule != nil && rule.negate && !*verbose {
+			rule = nil
+		}
+		if rule != nil {
+			ignored++
+		}
+
+		switch {
+		case *quiet || rule == nil && !*nonMatching:
+		case !*verbose:
+			fmt.Fprintf(out, "%s%s", path, separator)
+		case rule == nil && *nulls:
+			fmt.Fprintf(out, "\x00\x00\x00%s\x00", path)
+		case rule == nil:
+			fmt.Fprintf(out, "::\t%s\n", path)
+		case *nulls:
+			fmt.Fprintf(out, "%s\x00%d\x00%s\x00%s\x00", rule.source, rule.line, rule.text, path)
+		default:
+			fmt.Fprintf(out, "%s:%d:%s\t%s\n", rule.source, rule.line, rule.text, path)
+		}
+	}
+
+	if *stdin {
+		in := bufio.NewReader(os.Stdin)
+		for {
+			path, err := in.ReadString(separator[0])
+			path = strings.TrimSuffix(path, separator)
+			if path != "" {
+				check(path)
+				// another program may wait for the answer before sending more
+				out.Flush()
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(err)
+			}
+		}
+	} else {
+		for _, path := range args {
+			check(path)
+		}
+	}
+
+	out.Flush()
+	if ignored == 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checkMailmap implements `git check-mailmap [--stdin] <contact>...`
+//
+// It prints the canonical form of each contact, `Name <email>` or
+// `<email>`, as given by the mailmap, see readMailmap:
+//
+//	$ git check-mailmap "jo <jo@old.example.com>"
+//	Jo Smith <jo@example.com>
+//
+// A contact that isn't in the mailmap is printed as it is. With --stdin,
+// the contacts are read from stdin too, one per line, once the arguments
+// are done.
+func checkMailmap(args []string) {
+	flag := flag.NewFlagSet("git check-mailmap", flag.ExitOnError)
+	var (
+		stdin = flag.Bool("stdin", false, "also read contacts from stdin")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) == 0 && !*stdin {
+		fmt.Fprintln(os.Stderr, "usage: git check-mailmap [<options>] <contact>...")
+		os.Exit(129)
+	}
+
+	m := readMailmap()
+	check := func(contact string) {
+		name, rest, ok := strings.Cut(contact, "<")
+		email, _, closed := strings.Cut(rest, ">")
+		if !ok || !closed {
+			error := fmt.Sprintf("fatal: unable to parse contact: %s", contact)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(128)
+		}
+
+		name, email = m.lookup(strings.TrimSpace(name), email)
+		if name == "" {
+			fmt.Printf("<%s>\n", email)
+		} else {
+			fmt.Printf("%s <%s>\n", name, email)
+		}
+	}
+
+	for _, arg := range args {
+		check(arg)
+	}
+	if *stdin {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			check(scanner.Text())
+		}
+	}
+}
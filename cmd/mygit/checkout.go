@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// checkout implements `git checkout (--ours | --theirs) [--] <path>...`
+//
+// It resolves the conflicts a merge left in files to one side, our version
+// or theirs, see resolveConflicts:
+//
+//	$ git checkout --theirs parser.go
+//
+// Unlike git, which checks out the version of the index, the conflict
+// markers of the work tree are resolved, so the changes merged cleanly are
+// kept. A file without conflicts is an error, and is left as it is.
+func checkout(args []string) {
+	flag := flag.NewFlagSet("git checkout", flag.ExitOnError)
+	var (
+		ours   = flag.Bool("ours", false, "resolve the conflicts of the paths to our version")
+		theirs = flag.Bool("theirs", false, "resolve the conflicts of the paths to their version")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if *ours && *theirs {
+		fmt.Fprintln(os.Stderr, "fatal: --ours and --theirs are incompatible")
+		os.Exit(128)
+	}
+	if !*ours && !*theirs || len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git checkout (--ours | --theirs) [--] <path>...")
+		os.Exit(129)
+	}
+
+	choice, side := Ours, "our"
+	if *theirs {
+		choice, side = Theirs, "their"
+	}
+
+	failed := false
+	for _, path := range args {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: pathspec '%s' did not match any file(s) known to git\n", path)
+			failed = true
+			continue
+		}
+		resolved, conflicts, err := resolveConflicts(content, choice)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %s\n", path, err)
+			failed = true
+			continue
+		}
+		if conflicts == 0 {
+			fmt.Fprintf(os.Stderr, "error: path '%s' does not have %s version\n", path, side)
+			failed = true
+			continue
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			err = os.WriteFile(path, resolved, info.Mode().Perm())
+		}
+		if err != nil {
+			error := fmt.Sprintf("fatal: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(128)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
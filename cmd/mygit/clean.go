@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// cleaner walks the working tree and collects the untracked paths to remove.
+type cleaner struct {
+	tracked     map[string]bool
+	trackedDirs map[string]bool
+	ignore      *ignoreMatcher
+	directories bool // -d
+	ignored     bool // -x
+	paths       []string
+	removals    []string
+}
+
+// matches tells whether a path is in the paths to clean, all of them when
+// none were given.
+func (c *cleaner) matches(name string) bool {
+	return touchesPath(treeChange{path: name}, c.paths)
+}
+
+// leadsTo tells whether a directory holds some of the paths to clean, without
+// being in them itself, eg: sub for sub/file.
+func (c *cleaner) leadsTo(dir string) bool {
+	for _, path := range c.paths {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// skip reports whether an untracked path has to stay: ignored paths are only
+// removed with -x, and nested repositories are never touched.
+func (c *cleaner) skip(name string, isDir bool) bool {
+	if isDir {
+		if _, err := os.Stat(path.Join(name, ".git")); err == nil {
+			return true
+		}
+	}
+	return !c.ignored && c.ignore.isIgnored(name, isDir)
+}
+
+// walk goes through a directory that contains tracked files.
+func (c *cleaner) walk(dir string) error {
+	entries, err := os.ReadDir(dirOrDot(dir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if name == ".git" {
+			continue
+		}
+
+		if !entry.IsDir() {
+			if c.matches(name) && !c.tracked[name] && !c.skip(name, false) {
+				c.removals = append(c.removals, name)
+			}
+			continue
+		}
+
+		if !c.matches(name) && !c.leadsTo(name) {
+			continue
+		}
+		if c.trackedDirs[name] || !c.matches(name) && !c.skip(name, true) {
+			if err := c.walk(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// untracked directories are only cleaned with -d
+		if !c.directories || c.skip(name, true) {
+			continue
+		}
+
+		all, removals, err := c.untracked(name)
+		if err != nil {
+			return err
+		}
+		if all {
+			c.removals = append(c.removals, name+"/")
+		} else {
+			c.removals = append(c.removals, removals...)
+		}
+	}
+
+	return nil
+}
+
+// untracked goes through an untracked directory. It reports whether the
+// whole directory can go, and otherwise which paths inside it can.
+func (c *cleaner) untracked(dir string) (bool, []string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, nil, err
+	}
+
+	all := true
+	var removals []string
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if c.skip(name, entry.IsDir()) {
+			all = false
+			continue
+		}
+
+		if !entry.IsDir() {
+			removals = append(removals, name)
+			continue
+		}
+
+		subAll, subRemovals, err := c.untracked(name)
+		if err != nil {
+			return false, nil, err
+		}
+		if subAll {
+			removals = append(removals, name+"/")
+		} else {
+			all = false
+			removals = append(removals, subRemovals...)
+		}
+	}
+
+	return all, removals, nil
+}
+
+// dirOrDot turns the top-level directory "" into ".".
+func dirOrDot(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// clean implements `git clean [-n] [-f] [-d] [-x] [--] [<path>...]`
+//
+// It removes the files in the working tree that are not in the index, only
+// under the paths given, if any:
+//
+//	-f  actually remove them, clean refuses to run without -f or -n
+//	-n  only show what would be removed
+//	-d  also remove untracked directories
+//	-x  also remove files ignored by .gitignore
+//
+// Like git, the untracked directories under the paths given are removed
+// even without -d. Nothing inside .git/ or inside a nested repository is
+// ever removed.
+func clean(args []string) {
+	flag := flag.NewFlagSet("git clean", flag.ExitOnError)
+	var (
+		force       = flag.Bool("f", false, "remove the untracked files")
+		dryRun      = flag.Bool("n", false, "dry run, only show what would be removed")
+		directories = flag.Bool("d", false, "also remove untracked directories")
+		ignored     = flag.Bool("x", false, "also remove ignored files")
+	)
+	flag.BoolVar(dryRun, "dry-run", false, "dry run, only show what would be removed")
+	flag.Parse(expandShortFlags(args, "fndx"))
+	args = flag.Args()
+
+	if !*force && !*dryRun {
+		fmt.Fprintln(os.Stderr, "fatal: refusing to clean without -f or -n")
+		os.Exit(1)
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		error := fmt.Sprintf("Failed to read index: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	for i, path := range args {
+		args[i] = cleanPath(path)
+	}
+	tracked, trackedDirs := idx.trackedPaths()
+	c := &cleaner{
+		tracked:     tracked,
+		trackedDirs: trackedDirs,
+		ignore:      newIgnoreMatcher(),
+		directories: *directories || len(args) > 0,
+		ignored:     *ignored,
+		paths:       args,
+	}
+
+	err = c.walk("")
+	if err != nil {
+		error := fmt.Sprintf("Failed to walk the working tree: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	for _, removal := range c.removals {
+		if *dryRun {
+			fmt.Printf("Would remove %s\n", removal)
+			continue
+		}
+
+		fmt.Printf("Removing %s\n", removal)
+		err := os.RemoveAll(removal)
+		if err != nil {
+			error := fmt.Sprintf("Failed to remove '%s': %s", removal, err)
+			fmt.Fprintln(os.Stderr, error)
+		}
+	}
+}
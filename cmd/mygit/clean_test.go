@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestCleanPathspec(t *testing.T) {
+	testRepository(t)
+	writeTestFiles(t, map[string]string{
+		"top.txt":         "top\n",
+		"sub/a.txt":       "a\n",
+		"sub/tracked.txt": "tracked\n",
+		"sub/deep/b.txt":  "b\n",
+		"other/c.txt":     "c\n",
+	})
+	sha, err := writeObject("blob", []byte("tracked\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := indexEntry{mode: 0100644, sha: sha, path: "sub/tracked.txt"}
+	if err := writeIndex(&index{version: 2, entries: []indexEntry{entry}}); err != nil {
+		t.Fatal(err)
+	}
+
+	clean([]string{"-f", "sub"})
+
+	for _, path := range []string{"sub/a.txt", "sub/deep"} {
+		if fileExists(path) {
+			t.Errorf("%s is under the pathspec and should have been removed", path)
+		}
+	}
+	for _, path := range []string{"top.txt", "other/c.txt", "sub/tracked.txt"} {
+		if !fileExists(path) {
+			t.Errorf("%s should have survived clean -f sub", path)
+		}
+	}
+}
+
+func TestCleanPathspecInUntrackedDirectory(t *testing.T) {
+	testRepository(t)
+	writeTestFiles(t, map[string]string{
+		"untracked/keep.txt":   "keep\n",
+		"untracked/remove.txt": "remove\n",
+	})
+
+	clean([]string{"-f", "untracked/remove.txt"})
+
+	if fileExists("untracked/remove.txt") {
+		t.Error("untracked/remove.txt should have been removed")
+	}
+	if !fileExists("untracked/keep.txt") {
+		t.Error("untracked/keep.txt is outside the pathspec and should have survived")
+	}
+}
+
+func TestCleanWithoutPathspec(t *testing.T) {
+	testRepository(t)
+	writeTestFiles(t, map[string]string{
+		"top.txt":   "top\n",
+		"sub/a.txt": "a\n",
+	})
+
+	clean([]string{"-f"})
+
+	if fileExists("top.txt") {
+		t.Error("top.txt should have been removed")
+	}
+	if !fileExists("sub/a.txt") {
+		t.Error("untracked directories are only removed with -d")
+	}
+}
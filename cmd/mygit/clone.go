@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cloneDirectory returns the directory a repository is cloned into when
+// none is given: the last part of its path or URL, without .git, eg: mygit
+// for https://github.com/cvanlabe/mygit.git.
+func cloneDirectory(url string) string {
+	name := strings.TrimRight(url, "/")
+	name = strings.TrimSuffix(name, "/.git")
+	name = strings.TrimSuffix(name, ".git")
+	name = strings.TrimRight(name, "/")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// remoteHead returns the ref HEAD of a remote points to, eg:
+// refs/heads/main, or else HEAD itself when it's detached. It is empty when
+// the remote has no HEAD, eg: an empty repository.
+func remoteHead(remote string, url string) (remoteRef, error) {
+	t, err := openTransport(remote, url)
+	if err != nil {
+		return remoteRef{}, err
+	}
+	refs, err := t.list(false)
+	if closeErr := t.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return remoteRef{}, err
+	}
+	for _, r := range refs {
+		if r.name == "HEAD" && r.sha != "" {
+			return r, nil
+		}
+	}
+	return remoteRef{}, nil
+}
+
+// objectDirectory returns the absolute path of the object directory of the
+// local repository at path: <path>/.git/objects, or <path>/objects when it's
+// a bare repository.
+func objectDirectory(path string) (string, error) {
+	path, err := filepath.Abs(strings.TrimPrefix(path, "file://"))
+	if err != nil {
+		return "", err
+	}
+	if isGitDirectory(path) {
+		return filepath.Join(path, "objects"), nil
+	}
+	if isGitDirectory(filepath.Join(path, ".git")) {
+		return filepath.Join(path, ".git", "objects"), nil
+	}
+	return "", fmt.Errorf("reference repository '%s' is not a local repository.", path)
+}
+
+// clone implements `git clone [--depth=<depth>] [--filter=<filter-spec>] [--shared] [--reference <repository>] [--progress | --no-progress] <repository> [<directory>]`
+//
+// It creates a repository in a new directory, named after the repository
+// cloned when not given, with the branches of the one cloned as its
+// refs/remotes/origin/* refs, see fetchRemote, and checks out the branch
+// HEAD points to there:
+//
+//	$ git clone ../upstream work
+//	Cloning into 'work'...
+//
+// With --filter=blob:none, a partial clone, the blobs aren't fetched but
+// promised by origin, which the repository records in its config:
+//
+//	[remote "origin"]
+//		promisor = true
+//		partialclonefilter = blob:none
+//	[extensions]
+//		partialClone = origin
+//
+// The blobs of the files checked out are then fetched at once, and any
+// other blob when it's first read, see PromisorStore. Like git, the remote
+// has to allow the filter, with uploadpack.allowFilter, and the fetches of
+// blobs, with uploadpack.allowAnySHA1InWant.
+//
+// With --depth, a shallow clone, only that many commits of history are
+// fetched from each branch, the commits where it's cut recorded in
+// .git/shallow, see loadShallow.
+//
+// With --shared, a local repository's objects aren't copied but borrowed,
+// its object directory listed in .git/objects/info/alternates, see
+// AlternatesStore. With --reference, the objects of another local
+// repository are borrowed the same way, and only those it lacks are
+// fetched. Either way, the clone breaks if the objects it borrows are
+// deleted.
+//
+// The progress of the fetch is reported, see progressFlag.
+func clone(args []string) {
+	flag := flag.NewFlagSet("git clone", flag.ExitOnError)
+	filter := flag.String("filter", "", "leave out the objects the filter says, eg: blob:none")
+	depth := flag.Int("depth", 0, "fetch only `<depth>` commits of history")
+	shared := flag.Bool("shared", false, "borrow the objects of the local repository instead of copying them")
+	flag.BoolVar(shared, "s", false, "same as --shared")
+	reference := flag.String("reference", "", "borrow the objects of the local `<repository>`")
+	progress := progressFlag(flag)
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: git clone [--depth=<depth>] [--filter=<filter-spec>] [--shared] [--reference <repository>] [--progress | --no-progress] <repository> [<directory>]")
+		os.Exit(129)
+	}
+	if *depth < 0 {
+		fail(fmt.Errorf("depth %d is not a positive number", *depth))
+	}
+	url, dir := args[0], cloneDirectory(args[0])
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	if *filter != "" {
+		if err := parseObjectFilter(*filter); err != nil {
+			fail(err)
+		}
+	}
+
+	// a local repository is cloned from wherever the clone is
+	if _, _, ok := remoteHelperFor(url); !ok && !strings.Contains(url, "://") {
+		if _, err := os.Stat(url); err != nil {
+			fail(fmt.Errorf("repository '%s' does not exist", url))
+		}
+		abs, err := filepath.Abs(url)
+		if err != nil {
+			fail(err)
+		}
+		url = abs
+	}
+	var alternates []string
+	if *shared {
+		dir, err := objectDirectory(url)
+		if err != nil {
+			fail(fmt.Errorf("--shared is only supported for local repositories"))
+		}
+		alternates = append(alternates, dir)
+	}
+	if *reference != "" {
+		dir, err := objectDirectory(*reference)
+		if err != nil {
+			fail(err)
+		}
+		alternates = append(alternates, dir)
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 || err != nil && !os.IsNotExist(err) {
+		fail(fmt.Errorf("destination path '%s' already exists and is not an empty directory.", dir))
+	}
+
+	fmt.Fprintf(os.Stderr, "Cloning into '%s'...\n", dir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		fail(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fail(err)
+	}
+	for _, folder := range []string{".git", filepath.Join(".git", "objects"), filepath.Join(".git", "refs")} {
+		if err := os.Mkdir(folder, 0750); err != nil {
+			fail(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(".git", "HEAD"), []byte("ref: refs/heads/"+defaultBranch()+"\n"), 0644); err != nil {
+		fail(err)
+	}
+	if len(alternates) > 0 {
+		info := filepath.Join(".git", "objects", "info")
+		if err := os.Mkdir(info, 0750); err != nil {
+			fail(err)
+		}
+		if err := os.WriteFile(filepath.Join(info, "alternates"), []byte(strings.Join(alternates, "\n")+"\n"), 0644); err != nil {
+			fail(err)
+		}
+	}
+
+	config, err := readConfigFile(filepath.Join(".git", "config"))
+	if err != nil {
+		fail(err)
+	}
+	if *filter != "" {
+		// extensions need version 1
+		config.add("core.repositoryformatversion", "1")
+	}
+	config.add("core.bare", "false")
+	config.add("remote.origin.url", url)
+	config.add("remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*")
+	if *filter != "" {
+		config.add("remote.origin.promisor", "true")
+		config.add("remote.origin.partialclonefilter", *filter)
+		config.add("extensions.partialClone", "origin")
+	}
+	if err := config.write(); err != nil {
+		fail(err)
+	}
+	if err := setupGitDir(); err != nil {
+		fail(err)
+	}
+
+	head, err := remoteHead("origin", url)
+	if err != nil {
+		fail(err)
+	}
+	if _, err := fetchRemote("origin", nil, fetchOptions{filter: *filter, depth: *depth, progress: progress()}, io.Discard); err != nil {
+		fail(err)
+	}
+	if head.sha == "" {
+		fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+		return
+	}
+
+	branch, found := strings.CutPrefix(head.symref, "refs/heads/")
+	if found {
+		if err := updateRef("refs/heads/"+branch, head.sha); err != nil {
+			fail(err)
+		}
+		if err := updateSymbolicRef("HEAD", "refs/heads/"+branch); err != nil {
+			fail(err)
+		}
+		if err := updateSymbolicRef("refs/remotes/origin/HEAD", "refs/remotes/origin/"+branch); err != nil {
+			fail(err)
+		}
+		config, err := readConfigFile(gitPath("config"))
+		if err != nil {
+			fail(err)
+		}
+		config.add("branch."+branch+".remote", "origin")
+		config.add("branch."+branch+".merge", "refs/heads/"+branch)
+		if err := config.write(); err != nil {
+			fail(err)
+		}
+	} else if err := updateRef("HEAD", head.sha); err != nil {
+		fail(err)
+	}
+
+	c, err := readCommit(head.sha)
+	if err != nil {
+		fail(err)
+	}
+	files, err := flattenTree(c.tree)
+	if err != nil {
+		fail(err)
+	}
+	shas := make([]string, 0, len(files))
+	for _, entry := range files {
+		if entry.mode != modeSubmodule {
+			shas = append(shas, entry.sha)
+		}
+	}
+	if err := prefetchObjects(shas); err != nil {
+		fail(err)
+	}
+	if _, err := checkoutCommit(head.sha); err != nil {
+		fail(err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ANSI escapes of the colors git uses by default.
+const (
+	colorReset  = "\x1b[m"
+	colorBold   = "\x1b[1m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+
+	colorWhitespace = "\x1b[41m" // whitespace errors, on a red background
+)
+
+// useColor says whether the running command colors its output. Commands
+// set it from colorFlag after parsing their flags.
+var useColor bool
+
+// colored wraps text in a color when the output is colored.
+func colored(color string, text string) string {
+	if !useColor {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// colorFlag adds `--color[=<when>]` and `--no-color` to a command's flags.
+// The returned function tells whether to color the output: the flags win
+// over the config key, eg: color.diff, then color.ui. Plumbing commands
+// pass no key, so they only color with --color.
+func colorFlag(flag *flag.FlagSet, key string) func() bool {
+	color := &optionalString{value: "always"}
+	flag.Var(color, "color", "color the output, `<when>`: always, never or auto")
+	noColor := flag.Bool("no-color", false, "don't color the output")
+
+	return func() bool {
+		if *noColor {
+			return false
+		}
+		if color.set {
+			when, ok := parseColorWhen(color.value, false)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "error: option `color' expects \"always\", \"auto\", or \"never\"\n")
+				exit(129)
+			}
+			return when
+		}
+		if key == "" {
+			return false
+		}
+
+		for _, key := range []string{key, "color.ui"} {
+			if value, ok := configGet(key); ok {
+				if when, ok := parseColorWhen(value, true); ok {
+					return when
+				}
+				fmt.Fprintf(os.Stderr, "warning: %s: invalid color setting '%s'\n", key, value)
+				return false
+			}
+		}
+		return colorAuto()
+	}
+}
+
+// parseColorWhen parses always, never or auto. In the config, true means
+// auto and false never.
+func parseColorWhen(value string, config bool) (bool, bool) {
+	switch value {
+	case "always":
+		return true, true
+	case "never":
+		return false, true
+	case "auto":
+		return colorAuto(), true
+	}
+	if b, ok := parseBool(value); config && ok {
+		return b && colorAuto(), true
+	}
+	return false, false
+}
+
+// colorAuto colors when the output goes to a terminal, or the pager, that
+// isn't dumb.
+func colorAuto() bool {
+	return os.Getenv("TERM") != "dumb" && (pager.cmd != nil || isTerminal(os.Stdout))
+}
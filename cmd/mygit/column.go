@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ColumnMode says when lists are shown in columns.
+type ColumnMode int
+
+const (
+	// ColumnNever shows one item per line.
+	ColumnNever ColumnMode = iota
+	// ColumnAlways always uses columns.
+	ColumnAlways
+	// ColumnAuto uses columns when the output goes to a terminal or the pager.
+	ColumnAuto
+)
+
+// ColumnOptions controls how FormatColumns lays out a list.
+type ColumnOptions struct {
+	// Indent is the number of spaces at the start of each line.
+	Indent int
+	// Padding is the number of spaces between two columns.
+	Padding int
+	// Mode says whether to use columns at all.
+	Mode ColumnMode
+}
+
+// FormatColumns arranges items in as many columns as fit in termWidth,
+// filling each column from top to bottom like `ls` and git do:
+//
+//	a  d  g
+//	b  e
+//	c  f
+//
+// All columns are as wide as the longest item plus the padding, items are
+// left-aligned and lines have no trailing spaces. Each line ends with a
+// newline.
+func FormatColumns(items []string, termWidth int, opts ColumnOptions) string {
+	indent := strings.Repeat(" ", opts.Indent)
+
+	useColumns := opts.Mode == ColumnAlways || (opts.Mode == ColumnAuto && (pager.cmd != nil || isTerminal(os.Stdout)))
+	if !useColumns {
+		var lines strings.Builder
+		for _, item := range items {
+			lines.WriteString(indent + item + "\n")
+		}
+		return lines.String()
+	}
+
+	width := 0
+	for _, item := range items {
+		width = max(width, utf8.RuneCountInString(item))
+	}
+	width += opts.Padding
+
+	cols := 1
+	if width > 0 {
+		cols = max((termWidth-opts.Indent)/width, 1)
+	}
+	rows := (len(items) + cols - 1) / cols
+
+	var lines strings.Builder
+	for row := 0; row < rows; row++ {
+		lines.WriteString(indent)
+		for i := row; i < len(items); i += rows {
+			lines.WriteString(items[i])
+			if i+rows >= len(items) {
+				break
+			}
+			lines.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(items[i])))
+		}
+		lines.WriteString("\n")
+	}
+	return lines.String()
+}
+
+// terminalWidth returns the width of the terminal from $COLUMNS, or 80.
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+// parseColumnMode parses a column setting, eg: `always`, `never` or
+// `auto`. Layout keywords git accepts (column, row, plain, dense) are
+// allowed next to it but only the column layout is supported.
+func parseColumnMode(value string) (ColumnMode, error) {
+	mode := ColumnNever
+	for _, word := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		switch word {
+		case "always":
+			mode = ColumnAlways
+		case "never":
+			mode = ColumnNever
+		case "auto":
+			mode = ColumnAuto
+		case "column", "plain", "nodense":
+		case "row", "dense":
+			return mode, fmt.Errorf("column layout '%s' is not supported", word)
+		default:
+			return mode, fmt.Errorf("unknown column option '%s'", word)
+		}
+	}
+	return mode, nil
+}
+
+// columnModeFor returns the column mode of a command from the config:
+// `column.<command>` if set, else `column.ui`, else never.
+func columnModeFor(command string) ColumnMode {
+	for _, key := range []string{"column." + command, "column.ui"} {
+		if value, ok := configGet(key); ok {
+			mode, err := parseColumnMode(value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %s: %s\n", key, err)
+				return ColumnNever
+			}
+			return mode
+		}
+	}
+	return ColumnNever
+}
+
+// column implements `git column [--mode=<mode>] [--width=<n>] [--indent=<n>] [--padding=<n>]`
+//
+// It reads lines from stdin and prints them in columns.
+func column(args []string) {
+	flag := flag.NewFlagSet("git column", flag.ExitOnError)
+	var (
+		mode    = flag.String("mode", "always", "`<mode>`: always, never or auto")
+		width   = flag.Int("width", terminalWidth(), "width of the output")
+		indent  = flag.Int("indent", 0, "spaces at the start of each line")
+		padding = flag.Int("padding", 1, "spaces between columns")
+	)
+	flag.Parse(args)
+
+	columnMode, err := parseColumnMode(*mode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var items []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		items = append(items, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		error := fmt.Sprintf("Failed to read stdin: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	fmt.Print(FormatColumns(items, *width, ColumnOptions{Indent: *indent, Padding: *padding, Mode: columnMode}))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commit holds the parsed content of a commit object:
+//
+//	tree <sha>
+//	parent <sha>        (zero or more)
+//	author <ident>
+//	committer <ident>
+//
+//	<message>
+type commit struct {
+	tree      string
+	parents   []string
+	author    string
+	committer string
+	message   string
+}
+
+// parseCommit parses the content of a commit object (without its header).
+func parseCommit(content []byte) (*commit, error) {
+	headers, message, _ := strings.Cut(string(content), "\n\n")
+
+	c := &commit{message: message}
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			c.tree = value
+		case "parent":
+			c.parents = append(c.parents, value)
+		case "author":
+			c.author = value
+		case "committer":
+			c.committer = value
+		}
+	}
+
+	if c.tree == "" {
+		return nil, fmt.Errorf("commit has no tree")
+	}
+
+	return c, nil
+}
+
+// readCommit reads and parses the commit object with the given sha. A
+// grafted commit has the parents of its graft, see loadGrafts.
+func readCommit(sha string) (*commit, error) {
+	objectType, content, err := readObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if objectType != "commit" {
+		return nil, fmt.Errorf("object '%s' is a %s, not a commit", sha, objectType)
+	}
+
+	c, err := parseCommit(content)
+	if err != nil {
+		return nil, err
+	}
+	if parents, ok := graftParents(sha); ok {
+		c.parents = parents
+	}
+	return c, nil
+}
+
+// commitTime returns the committer timestamp (seconds since epoch).
+//
+// An ident looks like:
+//
+//	Name <email> 1700000000 +0100
+func (c *commit) commitTime() int64 {
+	fields := strings.Fields(c.committer)
+	if len(fields) < 2 {
+		return 0
+	}
+
+	timestamp, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return timestamp
+}
+
+// encode returns the raw content of the commit, as stored in its object.
+func (c *commit) encode() []byte {
+	var content strings.Builder
+	fmt.Fprintf(&content, "tree %s\n", c.tree)
+	for _, parent := range c.parents {
+		fmt.Fprintf(&content, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&content, "author %s\ncommitter %s\n\n%s", c.author, c.committer, c.message)
+	return []byte(content.String())
+}
+
+// makeIdent builds the author or committer ident of a new object, from
+// $GIT_<role>_NAME, $GIT_<role>_EMAIL and $GIT_<role>_DATE, or else the
+// user.name and user.email config and the current time. role is AUTHOR or
+// COMMITTER.
+//
+// The date can be given as `<timestamp> <timezone>`, with an optional @, or
+// any way parseGitDate accepts.
+func makeIdent(role string) (string, error) {
+	return buildIdent(role, true)
+}
+
+// defaultIdent is makeIdent for what git doesn't insist on a real identity
+// for, eg: reflog entries. A name or email that isn't set falls back to the
+// user's name in the passwd entry, or else unknown, and user@hostname.
+func defaultIdent(role string) (string, error) {
+	return buildIdent(role, false)
+}
+
+// buildIdent builds the ident of makeIdent, failing when the name or email
+// are unknown if strict, or else falling back like defaultIdent does.
+func buildIdent(role string, strict bool) (string, error) {
+	lookup := func(env string, key string) string {
+		if value, ok := os.LookupEnv("GIT_" + role + "_" + env); ok {
+			return value
+		}
+		value, _ := configGet(key)
+		return value
+	}
+
+	name, email := lookup("NAME", "user.name"), lookup("EMAIL", "user.email")
+	if (name == "" || email == "") && strict {
+		return "", fmt.Errorf("%s identity unknown, set user.name and user.email", strings.ToLower(role))
+	}
+	if name == "" || email == "" {
+		login, fullName := "unknown", ""
+		if u, err := user.Current(); err == nil {
+			login, fullName = u.Username, u.Name
+		}
+		if name == "" {
+			name = fullName
+		}
+		if name == "" {
+			name = "unknown"
+		}
+		if email == "" {
+			host, err := os.Hostname()
+			if err != nil || host == "" {
+				host = "(none)"
+			}
+			email = login + "@" + host
+		}
+	}
+
+	now := time.Now()
+	date := fmt.Sprintf("%d %s", now.Unix(), now.Format("-0700"))
+	if value, ok := os.LookupEnv("GIT_" + role + "_DATE"); ok {
+		when, err := parseGitDate(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid date format: %s", value)
+		}
+		date = fmt.Sprintf("%d %s", when.Unix(), when.Format("-0700"))
+	}
+
+	return fmt.Sprintf("%s <%s> %s", name, email, date), nil
+}
+
+// parseIdent splits an author, committer or tagger line into the name, the
+// email and the time in the ident's own timezone:
+//
+//	Name <email> 1700000000 +0100
+func parseIdent(ident string) (string, string, time.Time) {
+	name, rest, _ := strings.Cut(ident, "<")
+	email, date, _ := strings.Cut(rest, ">")
+
+	var when time.Time
+	fields := strings.Fields(date)
+	if len(fields) >= 1 {
+		timestamp, _ := strconv.ParseInt(fields[0], 10, 64)
+		when = time.Unix(timestamp, 0).UTC()
+	}
+	if len(fields) >= 2 && len(fields[1]) == 5 {
+		hours, _ := strconv.Atoi(fields[1][1:3])
+		minutes, _ := strconv.Atoi(fields[1][3:5])
+		offset := hours*3600 + minutes*60
+		if fields[1][0] == '-' {
+			offset = -offset
+		}
+		when = when.In(time.FixedZone(fields[1], offset))
+	}
+
+	return strings.TrimSpace(name), email, when
+}
+
+// commitNode is the part of a commit needed to walk history.
+type commitNode struct {
+	sha     string
+	parents []string
+	time    int64
+}
+
+// readCommitNode returns the parents and commit time of a commit.
+//
+// When a commit-graph file is present and contains the commit, they are taken
+// from there so we don't need to decompress the commit object. A replaced
+// commit is read from its replacement instead, see replaceObject, since the
+// graph has the parents of the commit as it's stored.
+//
+// Grafted commits are returned with the parents of their graft, see
+// loadGrafts, and commits on the boundary of a shallow clone without
+// parents.
+func readCommitNode(sha string) (*commitNode, error) {
+	node, err := readGraphOrCommitNode(sha)
+	if err != nil {
+		return nil, err
+	}
+
+	if parents, ok := graftParents(sha); ok {
+		node.parents = parents
+	}
+	if isShallow(sha) {
+		node.parents = nil
+	}
+	return node, nil
+}
+
+func readGraphOrCommitNode(sha string) (*commitNode, error) {
+	if _, replaced := replacements()[sha]; replaced && !noReplaceObjects {
+		trace("commit-graph: %s is replaced", sha)
+	} else if graph := loadCommitGraph(); graph != nil {
+		if node, ok := graph.node(sha); ok {
+			return node, nil
+		}
+	}
+
+	c, err := readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	return &commitNode{sha: sha, parents: c.parents, time: c.commitTime()}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReadCommitNodeReplacedWithCommitGraph(t *testing.T) {
+	testRepository(t)
+	first := writeTestCommit(t, "first")
+	second := writeTestCommit(t, "second", first)
+	other := writeTestCommit(t, "other")
+	replacement := writeTestCommit(t, "second, on other", other)
+
+	commits := map[string]*commit{}
+	for _, sha := range []string{first, second, other, replacement} {
+		c, err := readCommit(sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits[sha] = c
+	}
+	graph, err := buildCommitGraph(commits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(gitPath("objects/info"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gitPath(commitGraphFile), graph, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateRef("refs/replace/"+second, replacement); err != nil {
+		t.Fatal(err)
+	}
+	replaceRefs = nil
+
+	node, err := readCommitNode(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(node.parents, []string{other}) {
+		t.Errorf("parents of the replaced commit are %v, expected those of its replacement %v", node.parents, []string{other})
+	}
+
+	noReplaceObjects = true
+	defer func() { noReplaceObjects = false }()
+	node, err = readCommitNode(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(node.parents, []string{first}) {
+		t.Errorf("parents with --no-replace-objects are %v, expected %v", node.parents, []string{first})
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// commitStatus is what a new commit would contain and what it would leave
+// out, as listed in the message template.
+type commitStatus struct {
+	branch    string // "" when HEAD is detached
+	head      string // "" before the first commit
+	merging   bool   // a merge stopped on conflicts, see merge
+	hints     bool   // say how to go on, like git status
+	staged    []treeChange
+	unmerged  []unmergedPath
+	unstaged  []treeChange
+	untracked []string
+}
+
+// unmergedPath is a path with conflicts in the index, with the stages it
+// has as bits: 1 for the base, 2 for ours and 4 for theirs.
+type unmergedPath struct {
+	path   string
+	stages int
+}
+
+// unmergedLabels describe the conflicts by the stages they have.
+var unmergedLabels = map[int]string{
+	1: "both deleted:",
+	2: "added by us:",
+	3: "deleted by them:",
+	4: "added by them:",
+	5: "deleted by us:",
+	6: "both added:",
+	7: "both modified:",
+}
+
+// readCommitStatus compares HEAD with the index, and the index with the
+// work tree, and finds the untracked files like `git clean -d` does.
+func readCommitStatus(idx *index, head string, branch string) (*commitStatus, error) {
+	status := &commitStatus{branch: branch, head: head}
+
+	headFiles := map[string]treeEntry{}
+	if head != "" {
+		c, err := readCommit(head)
+		if err != nil {
+			return nil, err
+		}
+		if headFiles, err = flattenTree(c.tree); err != nil {
+			return nil, err
+		}
+	}
+	workTree, err := workTreeFiles(idx, &diffOptions{blobs: map[string][]byte{}})
+	if err != nil {
+		return nil, err
+	}
+	stages := map[string]int{}
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 {
+			stages[entry.path] |= 1 << (entry.stage() - 1)
+		}
+	}
+	for _, change := range diffFiles(headFiles, indexFiles(idx)) {
+		if stages[change.path] == 0 {
+			status.staged = append(status.staged, change)
+		}
+	}
+	for path, stages := range stages {
+		status.unmerged = append(status.unmerged, unmergedPath{path: path, stages: stages})
+	}
+	sort.Slice(status.unmerged, func(i, j int) bool { return status.unmerged[i].path < status.unmerged[j].path })
+	status.unstaged = diffFiles(indexFiles(idx), workTree)
+	_, err = os.Stat(gitPath("MERGE_HEAD"))
+	status.merging = err == nil
+
+	tracked, trackedDirs := idx.trackedPaths()
+	c := &cleaner{tracked: tracked, trackedDirs: trackedDirs, ignore: newIgnoreMatcher(), directories: true}
+	if err := c.walk(""); err != nil {
+		return nil, err
+	}
+	status.untracked = c.removals
+
+	return status, nil
+}
+
+// write writes the status, each line after prefix:
+//
+//	On branch main
+//	You have unmerged paths.
+//
+//	Changes to be committed:
+//		modified:   a
+//
+//	Unmerged paths:
+//		both modified:   d
+//
+//	Changes not staged for commit:
+//		deleted:    b
+//
+//	Untracked files:
+//		c
+func (s *commitStatus) write(w io.Writer, prefix string) {
+	line := func(text string) {
+		switch {
+		case text == "":
+			fmt.Fprintln(w, strings.TrimRight(prefix, " "))
+		case text[0] == '\t':
+			fmt.Fprintln(w, strings.TrimRight(prefix, " ")+text)
+		default:
+			fmt.Fprintln(w, prefix+text)
+		}
+	}
+	changes := func(title string, changes []treeChange, color string) {
+		if len(changes) == 0 {
+			return
+		}
+		line(title)
+		for _, change := range changes {
+			label := map[byte]string{'A': "new file:", 'D': "deleted:", 'M': "modified:", 'T': "typechange:"}[change.status]
+			line("\t" + colored(color, fmt.Sprintf("%-12s%s", label, change.path)))
+		}
+		line("")
+	}
+
+	if s.branch != "" {
+		line("On branch " + shortRefName(s.branch))
+	} else {
+		line("HEAD detached at " + s.head[:7])
+	}
+	switch {
+	case s.merging && len(s.unmerged) > 0:
+		line("You have unmerged paths.")
+		if s.hints {
+			line(`  (fix conflicts and run "git commit")`)
+			line(`  (use "git merge --abort" to abort the merge)`)
+		}
+		line("")
+	case s.merging:
+		line("All conflicts fixed but you are still merging.")
+		if s.hints {
+			line(`  (use "git commit" to conclude merge)`)
+		}
+		line("")
+	}
+	if s.head == "" {
+		line("")
+		line("Initial commit")
+		line("")
+	}
+	changes("Changes to be committed:", s.staged, colorGreen)
+	if len(s.unmerged) > 0 {
+		line("Unmerged paths:")
+		for _, unmerged := range s.unmerged {
+			line("\t" + colored(colorRed, fmt.Sprintf("%-17s%s", unmergedLabels[unmerged.stages], unmerged.path)))
+		}
+		line("")
+	}
+	changes("Changes not staged for commit:", s.unstaged, colorRed)
+	if len(s.untracked) > 0 {
+		line("Untracked files:")
+		for _, path := range s.untracked {
+			line("\t" + colored(colorRed, path))
+		}
+		line("")
+	}
+}
+
+// summary is the line after the status when nothing would be committed,
+// or "".
+func (s *commitStatus) summary() string {
+	switch {
+	case len(s.staged) > 0 || s.merging && len(s.unmerged) == 0:
+		return ""
+	case len(s.unstaged) > 0 || len(s.unmerged) > 0:
+		return "no changes added to commit"
+	case len(s.untracked) > 0:
+		return "nothing added to commit but untracked files present"
+	default:
+		return "nothing to commit, working tree clean"
+	}
+}
+
+// editCommitMessage has the user write the message of a commit in their
+// editor, see launchEditor. The file starts with the template, followed by
+// the status of the commit in comments, which are stripped afterwards.
+func editCommitMessage(template string, status *commitStatus) (string, error) {
+	comment := commentChar()
+
+	var content strings.Builder
+	content.WriteString(template)
+	fmt.Fprintf(&content, "\n%s Please enter the commit message for your changes. Lines starting\n", comment)
+	fmt.Fprintf(&content, "%s with '%s' will be ignored, and an empty message aborts the commit.\n", comment, comment)
+	fmt.Fprintln(&content, comment)
+	status.write(&content, comment+" ")
+
+	path := gitPath("COMMIT_EDITMSG")
+	if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		return "", err
+	}
+	if err := launchEditor(path); err != nil {
+		return "", err
+	}
+
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return stripSpace(string(edited), true), nil
+}
+
+// readMergeHeads returns the commits being merged, the other parents of the
+// next commit, listed in .git/MERGE_HEAD.
+func readMergeHeads() ([]string, error) {
+	content, err := os.ReadFile(gitPath("MERGE_HEAD"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// readMergeMessage returns the message left for the next commit by a merge
+// stopped before committing, the one of a squash first.
+func readMergeMessage() (string, bool) {
+	var message []byte
+	found := false
+	for _, name := range []string{"SQUASH_MSG", "MERGE_MSG"} {
+		if content, err := os.ReadFile(gitPath(name)); err == nil {
+			message = append(message, content...)
+			found = true
+		}
+	}
+	return string(message), found
+}
+
+// commitCmd implements `git commit [--amend] [--no-edit] [-m <message>]... [-F <file>] [-t <file>] [-n] [--allow-empty] [--allow-empty-message]`
+//
+// It records the content of the index as a new commit on top of HEAD, and
+// moves the current branch, or the detached HEAD, to it.
+//
+// Without -m or -F, the message is written in an editor, see
+// editCommitMessage. It starts from the template given with -t, or in the
+// commit.template config, and the commit is aborted when the message is
+// empty or the template wasn't edited. Several -m are separate paragraphs.
+//
+// The commit concludes a merge or a squash in progress, see merge: the
+// commits merged are its other parents, and their message is edited
+// instead of the template, or kept as it is with --no-edit.
+//
+// Committing the same tree as HEAD needs --allow-empty.
+//
+// --amend replaces HEAD instead, by a commit with its parents, its author
+// and the content of the index. Its message is edited, unless -m, -F or
+// --no-edit keeps it. The old commit is only left in the reflog, where
+// commits are recorded, see appendReflog, and the post-rewrite hook gets
+// both shas.
+//
+// The pre-commit hook runs first and the commit-msg hook gets the message
+// in .git/COMMIT_EDITMSG, see runHook, either can abort the commit unless
+// -n, --no-verify. The post-commit hook runs once the commit is made.
+func commitCmd(args []string) {
+	flag := flag.NewFlagSet("git commit", flag.ExitOnError)
+	var (
+		messages          stringList
+		file              = flag.String("F", "", "read the message from `<file>`, - for stdin")
+		template          = flag.String("t", "", "start the message from the template `<file>`")
+		allowEmpty        = flag.Bool("allow-empty", false, "allow a commit with the same tree as its parent")
+		allowEmptyMessage = flag.Bool("allow-empty-message", false, "allow a commit with an empty message")
+		noVerify          = flag.Bool("no-verify", false, "skip the pre-commit and commit-msg hooks")
+		amend             = flag.Bool("amend", false, "replace the commit checked out")
+		noEdit            = flag.Bool("no-edit", false, "keep the message of the commit amended, or of the merge, without editing it")
+	)
+	flag.BoolVar(noVerify, "n", false, "same as --no-verify")
+	flag.Var(&messages, "m", "use `<message>` as the commit message")
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: git commit [--amend] [--no-edit] [-m <message>]... [-F <file>] [-t <file>] [-n] [--allow-empty] [--allow-empty-message]")
+		os.Exit(129)
+	}
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if len(messages) > 0 && *file != "" {
+		fail(fmt.Errorf("Option -m cannot be combined with -F"))
+	}
+
+	// the hook can change the index, so it's read afterwards
+	if !*noVerify {
+		if err := runHook("pre-commit"); err != nil {
+			os.Exit(1)
+		}
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		fail(fmt.Errorf("unable to read the index: %s", err))
+	}
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 {
+			fmt.Fprintln(os.Stderr, "error: Committing is not possible because you have unmerged files.")
+			os.Exit(128)
+		}
+	}
+
+	head, branch := readWorktreeHead(gitDir)
+	if head == zeroSha {
+		head = ""
+	}
+	mergeHeads, err := readMergeHeads()
+	if err != nil {
+		fail(err)
+	}
+	var amended *commit
+	if *amend {
+		if len(mergeHeads) > 0 {
+			fail(fmt.Errorf("You are in the middle of a merge -- cannot amend."))
+		}
+		if head == "" {
+			fail(fmt.Errorf("You have nothing to amend."))
+		}
+		if amended, err = readCommit(head); err != nil {
+			fail(err)
+		}
+	}
+
+	files := indexFiles(idx)
+	tree, err := writeTreeFromFiles(files)
+	if err != nil {
+		fail(err)
+	}
+	c := &commit{tree: tree}
+	if head != "" {
+		c.parents = []string{head}
+	}
+	if amended != nil {
+		c.parents = amended.parents
+	}
+	c.parents = append(c.parents, mergeHeads...)
+
+	empty := len(files) == 0 && len(mergeHeads) == 0
+	if len(c.parents) > 0 && len(mergeHeads) == 0 {
+		parent, err := readCommit(c.parents[0])
+		if err != nil {
+			fail(err)
+		}
+		empty = parent.tree == tree
+	}
+	if empty && !*allowEmpty && amended != nil {
+		fmt.Fprintln(os.Stderr, "You asked to amend the most recent commit, but doing so would make")
+		fmt.Fprintln(os.Stderr, "it empty. You can repeat your command with --allow-empty, or you can")
+		fmt.Fprintln(os.Stderr, "remove the commit entirely with \"git reset HEAD^\".")
+		os.Exit(1)
+	}
+
+	var status *commitStatus
+	if empty && !*allowEmpty || len(messages) == 0 && *file == "" {
+		if status, err = readCommitStatus(idx, head, branch); err != nil {
+			fail(err)
+		}
+	}
+	if empty && !*allowEmpty {
+		status.write(os.Stdout, "")
+		if summary := status.summary(); summary != "" {
+			fmt.Println(summary)
+		}
+		os.Exit(1)
+	}
+
+	mergeMessage, _ := readMergeMessage()
+	switch {
+	case len(messages) > 0:
+		c.message = stripSpace(strings.Join(messages, "\n\n"), false)
+
+	case *file != "":
+		var content []byte
+		if *file == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(*file)
+		}
+		if err != nil {
+			fail(fmt.Errorf("could not read log file '%s': %s", *file, err))
+		}
+		c.message = stripSpace(string(content), false)
+
+	case amended != nil && *noEdit:
+		c.message = amended.message
+
+	case *noEdit && mergeMessage != "":
+		c.message = stripSpace(mergeMessage, false)
+
+	default:
+		templateFile := *template
+		if templateFile == "" {
+			templateFile, _ = configGet("commit.template")
+		}
+		if strings.HasPrefix(templateFile, "~/") {
+			home, _ := os.UserHomeDir()
+			templateFile = filepath.Join(home, templateFile[2:])
+		}
+
+		var templateContent []byte
+		if amended != nil {
+			// the message is edited from the one of the commit amended
+			templateContent, templateFile = []byte(amended.message), ""
+		} else if mergeMessage != "" {
+			templateContent, templateFile = []byte(mergeMessage), ""
+			if len(mergeHeads) > 0 {
+				comment := commentChar()
+				for _, line := range []string{"", " It looks like you may be committing a merge.", " If this is not correct, please run", "\tgit update-ref -d MERGE_HEAD", " and try again."} {
+					templateContent = append(templateContent, comment+line+"\n"...)
+				}
+				templateContent = append(templateContent, '\n')
+			}
+		} else if templateFile != "" {
+			if templateContent, err = os.ReadFile(templateFile); err != nil {
+				fail(fmt.Errorf("could not read '%s': %s", templateFile, err))
+			}
+		}
+
+		if c.message, err = editCommitMessage(string(templateContent), status); err != nil {
+			fail(err)
+		}
+		if c.message != "" && templateFile != "" && c.message == stripSpace(string(templateContent), true) {
+			fmt.Fprintln(os.Stderr, "Aborting commit; you did not edit the message.")
+			os.Exit(1)
+		}
+	}
+	if !*noVerify {
+		path := gitPath("COMMIT_EDITMSG")
+		if err := os.WriteFile(path, []byte(c.message), 0644); err != nil {
+			fail(err)
+		}
+		if err := runHook("commit-msg", path); err != nil {
+			os.Exit(1)
+		}
+		edited, err := os.ReadFile(path)
+		if err != nil {
+			fail(err)
+		}
+		c.message = stripSpace(string(edited), false)
+	}
+	if c.message == "" && !*allowEmptyMessage {
+		fmt.Fprintln(os.Stderr, "Aborting commit due to empty commit message.")
+		os.Exit(1)
+	}
+
+	if amended != nil {
+		c.author = amended.author
+	} else if c.author, err = makeIdent("AUTHOR"); err != nil {
+		fail(err)
+	}
+	if c.committer, err = makeIdent("COMMITTER"); err != nil {
+		fail(err)
+	}
+	sha, err := writeObject("commit", c.encode())
+	if err != nil {
+		fail(err)
+	}
+
+	ref, name := "HEAD", "detached HEAD"
+	if branch != "" {
+		ref, name = branch, shortRefName(branch)
+	}
+	if err := updateRefIf(ref, sha, head); err != nil {
+		fail(fmt.Errorf("cannot update ref '%s': %s", ref, err))
+	}
+
+	action := "commit"
+	switch {
+	case amended != nil:
+		action = "commit (amend)"
+	case len(mergeHeads) > 0:
+		action = "commit (merge)"
+	case head == "":
+		action = "commit (initial)"
+	}
+	logged := []string{ref}
+	if ref != "HEAD" {
+		logged = append(logged, "HEAD")
+	}
+	for _, name := range logged {
+		if err := appendReflog(name, head, sha, action+": "+subject(c.message)); err != nil {
+			fail(err)
+		}
+	}
+
+	// the merge or the squash in progress is concluded, and its resolutions
+	// recorded
+	if err := rerere(os.Stderr); err != nil {
+		fail(err)
+	}
+	if err := removeMergeState(); err != nil {
+		fail(err)
+	}
+
+	runHook("post-commit")
+	if amended != nil {
+		runHookWith("post-rewrite", []byte(head+" "+sha+"\n"), os.Stderr, "amend")
+	}
+
+	if head == "" {
+		name += " (root-commit)"
+	}
+	fmt.Printf("[%s %s] %s\n", name, sha[:7], subject(c.message))
+	if amended != nil {
+		// the date is the one of the commit amended
+		_, _, when := parseIdent(c.author)
+		fmt.Printf(" Date: %s\n", when.Format(gitDateFormat))
+	}
+}
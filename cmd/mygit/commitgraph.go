@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const commitGraphFile = "objects/info/commit-graph"
+
+// Values used in the CDAT chunk for the parent positions.
+const (
+	graphParentNone  = 0x70000000
+	graphExtraEdges  = 0x80000000
+	graphLastEdge    = 0x80000000
+	graphDataWidth   = sha1.Size + 16
+	graphChunkLookup = 12
+)
+
+// commitGraph implements `git commit-graph write [--progress | --no-progress]`,
+// and verify, see commitGraphVerify.
+//
+// It precomputes the parents and generation number of every commit in the
+// object database into .git/objects/info/commit-graph, so history walks can
+// skip decompressing commit objects. Finding the commits among the objects
+// is reported on stderr, see progressFlag.
+//
+// The file follows git's commit-graph v1 format:
+//
+//	header:  "CGPH" <version=1> <hash version=1> <number of chunks> <0>
+//	chunk lookup table: (<chunk id> <8-byte offset>)* followed by a 0 id
+//	OIDF: 256 fan-out entries, the number of commits with first byte <= i
+//	OIDL: the sorted commit ids
+//	CDAT: per commit the root tree id, the positions of the first two parents
+//	      and the generation number + commit time
+//	EDGE: the extra parents of octopus merges (optional)
+//	trailer: SHA-1 checksum of everything above
+func commitGraph(args []string) {
+	if len(args) > 0 && args[0] == "verify" {
+		commitGraphVerify(args[1:])
+		return
+	}
+	if len(args) == 0 || args[0] != "write" {
+		fmt.Fprintln(os.Stderr, "usage: git commit-graph write [--progress | --no-progress]")
+		fmt.Fprintln(os.Stderr, "   or: git commit-graph verify [--progress | --no-progress]")
+		os.Exit(1)
+	}
+
+	flag := flag.NewFlagSet("git commit-graph write", flag.ExitOnError)
+	progress := progressFlag(flag)
+	flag.Parse(args[1:])
+
+	defer tracePerformance(time.Now(), "write commit-graph")
+
+	shas, err := listObjects()
+	if err != nil {
+		error := fmt.Sprintf("Failed to list objects: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	p := startProgress(progress(), "Finding commits for commit graph among objects", len(shas))
+	commits := map[string]*commit{}
+	for i, sha := range shas {
+		p.update(i + 1)
+		objectType, content, err := readObject(sha)
+		if err != nil {
+			error := fmt.Sprintf("Failed to read object '%s': %s", sha, err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+		if objectType != "commit" {
+			continue
+		}
+
+		c, err := parseCommit(content)
+		if err != nil {
+			error := fmt.Sprintf("Failed to parse commit '%s': %s", sha, err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+		commits[sha] = c
+	}
+	p.done()
+
+	graph, err := buildCommitGraph(commits)
+	if err != nil {
+		error := fmt.Sprintf("Failed to build commit-graph: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	err = os.MkdirAll(gitPath("objects/info"), 0750)
+	if err != nil {
+		error := fmt.Sprintf("Failed to create folder '.git/objects/info': %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(gitPath(commitGraphFile), graph, 0444)
+	if err != nil && os.IsPermission(err) {
+		// the graph is written read-only like git does, so replace it
+		os.Remove(gitPath(commitGraphFile))
+		err = os.WriteFile(gitPath(commitGraphFile), graph, 0444)
+	}
+	if err != nil {
+		error := fmt.Sprintf("Failed to write '%s': %s", gitPath(commitGraphFile), err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
+
+// commitGraphVerify implements `git commit-graph verify [--progress | --no-progress]`
+//
+// It checks .git/objects/info/commit-graph the way fsck checks objects: the
+// header and checksum of the file, then every entry against the commit
+// object it stands for. An entry's commit must exist, and its tree, parents
+// and commit time must be those of the commit object; its generation must
+// be 1 + the largest generation of its parents. Each problem is reported
+// with the position of the entry and its commit:
+//
+//	error: commit-graph entry 3 (<sha>): parent 1 is <sha> != <sha>
+//
+// It exits with 1 when anything is wrong. No commit-graph is fine.
+func commitGraphVerify(args []string) {
+	flag := flag.NewFlagSet("git commit-graph verify", flag.ExitOnError)
+	progress := progressFlag(flag)
+	flag.Parse(args)
+
+	content, err := os.ReadFile(gitPath(commitGraphFile))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		error := fmt.Sprintf("Failed to read '%s': %s", gitPath(commitGraphFile), err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	problems := verifyCommitGraph(content, progress())
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "error: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyCommitGraph returns what's wrong with a commit-graph file, nothing
+// when it matches the object database, see commitGraphVerify.
+func verifyCommitGraph(content []byte, w io.Writer) []error {
+	var problems []error
+
+	if len(content) >= sha1.Size {
+		checksum := sha1.Sum(content[:len(content)-sha1.Size])
+		if !bytes.Equal(checksum[:], content[len(content)-sha1.Size:]) {
+			problems = append(problems, fmt.Errorf("the commit-graph file has incorrect checksum and is likely corrupt"))
+		}
+	}
+	graph, err := parseCommitGraph(content)
+	if err != nil {
+		return append(problems, fmt.Errorf("commit-graph: %s", err))
+	}
+
+	count := len(graph.oids) / sha1.Size
+	for i := 0; i < 256; i++ {
+		expected := 0
+		for expected < count && int(graph.oids[expected*sha1.Size]) <= i {
+			expected++
+		}
+		if value := int(binary.BigEndian.Uint32(graph.fanout[i*4:])); value != expected {
+			problems = append(problems, fmt.Errorf("commit-graph has incorrect fanout value: fanout[%d] = %d != %d", i, value, expected))
+		}
+	}
+	for i := 1; i < count; i++ {
+		if bytes.Compare(graph.oids[(i-1)*sha1.Size:i*sha1.Size], graph.oids[i*sha1.Size:(i+1)*sha1.Size]) >= 0 {
+			problems = append(problems, fmt.Errorf("commit-graph has incorrect OID order: %s then %s", graph.oid(uint32(i-1)), graph.oid(uint32(i))))
+		}
+	}
+
+	// the parents and generation of an entry, as the graph records them
+	parents := func(entry []byte) ([]uint32, error) {
+		var positions []uint32
+		for _, position := range []uint32{binary.BigEndian.Uint32(entry[sha1.Size:]), binary.BigEndian.Uint32(entry[sha1.Size+4:])} {
+			if position == graphParentNone {
+				return positions, nil
+			}
+			if position&graphExtraEdges != 0 && len(positions) == 1 {
+				for i := position &^ graphExtraEdges; ; i++ {
+					if int(i+1)*4 > len(graph.edges) {
+						return nil, fmt.Errorf("extra edges run past the EDGE chunk")
+					}
+					edge := binary.BigEndian.Uint32(graph.edges[i*4:])
+					positions = append(positions, edge&^graphLastEdge)
+					if edge&graphLastEdge != 0 {
+						break
+					}
+				}
+			} else {
+				positions = append(positions, position)
+			}
+			for _, position := range positions {
+				if int(position) >= count {
+					return nil, fmt.Errorf("parent position %d is out of range", position)
+				}
+			}
+		}
+		return positions, nil
+	}
+	generation := func(position uint32) uint32 {
+		return binary.BigEndian.Uint32(graph.data[int(position)*graphDataWidth+sha1.Size+8:]) >> 2
+	}
+
+	p := startProgress(w, "Verifying commits in commit graph", count)
+	for i := 0; i < count; i++ {
+		p.update(i + 1)
+		sha := graph.oid(uint32(i))
+		entry := graph.data[i*graphDataWidth:]
+		fail := func(format string, a ...any) {
+			problems = append(problems, fmt.Errorf("commit-graph entry %d (%s): %s", i, sha, fmt.Sprintf(format, a...)))
+		}
+
+		objectType, object, err := readObject(sha)
+		if err != nil || objectType != "commit" {
+			fail("not a commit in the object database")
+			continue
+		}
+		c, err := parseCommit(object)
+		if err != nil {
+			fail("%s", err)
+			continue
+		}
+
+		if tree := hex.EncodeToString(entry[:sha1.Size]); tree != c.tree {
+			fail("root tree is %s != %s", tree, c.tree)
+		}
+
+		positions, err := parents(entry)
+		if err != nil {
+			fail("%s", err)
+			continue
+		}
+		maxGeneration := uint32(0)
+		for n, position := range positions {
+			parent := graph.oid(position)
+			switch {
+			case n >= len(c.parents):
+				fail("parent list is too long, %s isn't a parent", parent)
+			case parent != c.parents[n]:
+				fail("parent %d is %s != %s", n+1, parent, c.parents[n])
+			}
+			maxGeneration = max(maxGeneration, generation(position))
+		}
+		if len(positions) < len(c.parents) {
+			fail("parent list terminates early, %s is missing", c.parents[len(positions)])
+		}
+
+		if generation(uint32(i)) != maxGeneration+1 {
+			fail("generation is %d != %d", generation(uint32(i)), maxGeneration+1)
+		}
+
+		time := int64(binary.BigEndian.Uint32(entry[sha1.Size+8:])&0x3)<<32 | int64(binary.BigEndian.Uint32(entry[sha1.Size+12:]))
+		if time != c.commitTime() {
+			fail("commit time is %d != %d", time, c.commitTime())
+		}
+	}
+	p.done()
+
+	return problems
+}
+
+// buildCommitGraph serializes the given commits into the commit-graph format.
+//
+// Every parent must be part of the set as well, since the graph refers to
+// parents by their position.
+func buildCommitGraph(commits map[string]*commit) ([]byte, error) {
+	shas := make([]string, 0, len(commits))
+	for sha := range commits {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	positions := make(map[string]uint32, len(shas))
+	for i, sha := range shas {
+		positions[sha] = uint32(i)
+		for _, parent := range commits[sha].parents {
+			if _, ok := commits[parent]; !ok {
+				return nil, fmt.Errorf("parent '%s' of commit '%s' is missing", parent, sha)
+			}
+		}
+	}
+
+	generations := commitGenerations(commits)
+
+	var fanout, oids, data, edges bytes.Buffer
+	var count [256]uint32
+	for _, sha := range shas {
+		id, _ := hex.DecodeString(sha)
+		count[id[0]]++
+		oids.Write(id)
+
+		c := commits[sha]
+		tree, _ := hex.DecodeString(c.tree)
+		data.Write(tree)
+
+		parent1, parent2 := uint32(graphParentNone), uint32(graphParentNone)
+		if len(c.parents) > 0 {
+			parent1 = positions[c.parents[0]]
+		}
+		if len(c.parents) == 2 {
+			parent2 = positions[c.parents[1]]
+		}
+		if len(c.parents) > 2 {
+			parent2 = graphExtraEdges | uint32(edges.Len()/4)
+			for i, parent := range c.parents[1:] {
+				edge := positions[parent]
+				if i == len(c.parents)-2 {
+					edge |= graphLastEdge
+				}
+				binary.Write(&edges, binary.BigEndian, edge)
+			}
+		}
+		binary.Write(&data, binary.BigEndian, parent1)
+		binary.Write(&data, binary.BigEndian, parent2)
+
+		// top 30 bits hold the generation, the remaining 34 bits the commit time
+		time := uint64(c.commitTime())
+		binary.Write(&data, binary.BigEndian, generations[sha]<<2|uint32(time>>32)&0x3)
+		binary.Write(&data, binary.BigEndian, uint32(time))
+	}
+
+	total := uint32(0)
+	for _, n := range count {
+		total += n
+		binary.Write(&fanout, binary.BigEndian, total)
+	}
+
+	chunks := []struct {
+		id   string
+		data []byte
+	}{
+		{"OIDF", fanout.Bytes()},
+		{"OIDL", oids.Bytes()},
+		{"CDAT", data.Bytes()},
+	}
+	if edges.Len() > 0 {
+		chunks = append(chunks, struct {
+			id   string
+			data []byte
+		}{"EDGE", edges.Bytes()})
+	}
+
+	var graph bytes.Buffer
+	graph.WriteString("CGPH")
+	graph.Write([]byte{1, 1, byte(len(chunks)), 0})
+
+	offset := uint64(graph.Len() + (len(chunks)+1)*graphChunkLookup)
+	for _, chunk := range chunks {
+		graph.WriteString(chunk.id)
+		binary.Write(&graph, binary.BigEndian, offset)
+		offset += uint64(len(chunk.data))
+	}
+	graph.Write([]byte{0, 0, 0, 0})
+	binary.Write(&graph, binary.BigEndian, offset)
+
+	for _, chunk := range chunks {
+		graph.Write(chunk.data)
+	}
+
+	checksum := sha1.Sum(graph.Bytes())
+	graph.Write(checksum[:])
+
+	return graph.Bytes(), nil
+}
+
+// commitGenerations computes the generation number of every commit:
+// 1 for root commits, otherwise 1 + the maximum generation of its parents.
+func commitGenerations(commits map[string]*commit) map[string]uint32 {
+	generations := make(map[string]uint32, len(commits))
+
+	for sha := range commits {
+		// walk depth-first without recursion, long histories would blow the stack
+		stack := []string{sha}
+		for len(stack) > 0 {
+			current := stack[len(stack)-1]
+			if _, done := generations[current]; done {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+
+			generation := uint32(1)
+			pending := false
+			for _, parent := range commits[current].parents {
+				parentGeneration, done := generations[parent]
+				if !done {
+					stack = append(stack, parent)
+					pending = true
+				} else if parentGeneration+1 > generation {
+					generation = parentGeneration + 1
+				}
+			}
+
+			if !pending {
+				generations[current] = generation
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	return generations
+}
+
+// commitGraphData is a parsed commit-graph file.
+type commitGraphData struct {
+	fanout []byte
+	oids   []byte
+	data   []byte
+	edges  []byte
+}
+
+var (
+	commitGraphLoaded bool
+	commitGraphCache  *commitGraphData
+)
+
+// loadCommitGraph reads .git/objects/info/commit-graph once.
+//
+// It returns nil when there is no (valid) commit-graph, in which case callers
+// should fall back to reading the commit objects.
+func loadCommitGraph() *commitGraphData {
+	if commitGraphLoaded {
+		return commitGraphCache
+	}
+	commitGraphLoaded = true
+
+	content, err := os.ReadFile(gitPath(commitGraphFile))
+	if err != nil {
+		return nil
+	}
+
+	commitGraphCache, err = parseCommitGraph(content)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring commit-graph: %s\n", err)
+		return nil
+	}
+	return commitGraphCache
+}
+
+// parseCommitGraph parses the content of a commit-graph file.
+func parseCommitGraph(content []byte) (*commitGraphData, error) {
+	if len(content) < 8+graphChunkLookup+sha1.Size || string(content[:4]) != "CGPH" {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if content[4] != 1 || content[5] != 1 {
+		return nil, fmt.Errorf("unsupported version %d or hash version %d", content[4], content[5])
+	}
+
+	chunkCount := int(content[6])
+	if len(content) < 8+(chunkCount+1)*graphChunkLookup+sha1.Size {
+		return nil, fmt.Errorf("truncated chunk lookup table")
+	}
+
+	graph := &commitGraphData{}
+	for i := 0; i < chunkCount; i++ {
+		entry := content[8+i*graphChunkLookup:]
+		start := binary.BigEndian.Uint64(entry[4:12])
+		end := binary.BigEndian.Uint64(entry[4+graphChunkLookup : 12+graphChunkLookup])
+		if start > end || end > uint64(len(content)-sha1.Size) {
+			return nil, fmt.Errorf("chunk '%s' is out of bounds", entry[:4])
+		}
+
+		chunk := content[start:end]
+		switch string(entry[:4]) {
+		case "OIDF":
+			graph.fanout = chunk
+		case "OIDL":
+			graph.oids = chunk
+		case "CDAT":
+			graph.data = chunk
+		case "EDGE":
+			graph.edges = chunk
+		}
+	}
+
+	if len(graph.fanout) != 256*4 {
+		return nil, fmt.Errorf("missing or bad OIDF chunk")
+	}
+	count := int(binary.BigEndian.Uint32(graph.fanout[255*4:]))
+	if len(graph.oids) != count*sha1.Size || len(graph.data) != count*graphDataWidth {
+		return nil, fmt.Errorf("missing or bad OIDL/CDAT chunk")
+	}
+
+	return graph, nil
+}
+
+// position finds the position of a commit in the graph using the fan-out table.
+func (g *commitGraphData) position(sha string) (uint32, bool) {
+	id, err := hex.DecodeString(sha)
+	if err != nil || len(id) != sha1.Size {
+		return 0, false
+	}
+
+	lo := uint32(0)
+	if id[0] > 0 {
+		lo = binary.BigEndian.Uint32(g.fanout[(int(id[0])-1)*4:])
+	}
+	hi := binary.BigEndian.Uint32(g.fanout[int(id[0])*4:])
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		switch bytes.Compare(g.oids[mid*sha1.Size:(mid+1)*sha1.Size], id) {
+		case 0:
+			return mid, true
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+// oid returns the commit id stored at the given position.
+func (g *commitGraphData) oid(position uint32) string {
+	return hex.EncodeToString(g.oids[position*sha1.Size : (position+1)*sha1.Size])
+}
+
+// node looks up the parents and commit time of a commit in the graph.
+func (g *commitGraphData) node(sha string) (*commitNode, bool) {
+	position, ok := g.position(sha)
+	if !ok {
+		return nil, false
+	}
+
+	entry := g.data[position*graphDataWidth:]
+	parent1 := binary.BigEndian.Uint32(entry[sha1.Size:])
+	parent2 := binary.BigEndian.Uint32(entry[sha1.Size+4:])
+	time := int64(binary.BigEndian.Uint32(entry[sha1.Size+8:])&0x3)<<32 |
+		int64(binary.BigEndian.Uint32(entry[sha1.Size+12:]))
+
+	node := &commitNode{sha: sha, parents: []string{}, time: time}
+	if parent1 == graphParentNone {
+		return node, true
+	}
+	node.parents = append(node.parents, g.oid(parent1))
+
+	if parent2 == graphParentNone {
+		return node, true
+	}
+	if parent2&graphExtraEdges == 0 {
+		node.parents = append(node.parents, g.oid(parent2))
+		return node, true
+	}
+
+	for i := parent2 &^ graphExtraEdges; int(i+1)*4 <= len(g.edges); i++ {
+		edge := binary.BigEndian.Uint32(g.edges[i*4:])
+		node.parents = append(node.parents, g.oid(edge&^graphLastEdge))
+		if edge&graphLastEdge != 0 {
+			break
+		}
+	}
+	return node, true
+}
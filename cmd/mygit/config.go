@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// configEntry is a single `key = value` from a config file.
+//
+// The key is fully qualified: section[.subsection].name, where the section and
+// the name are lowercased (they're case-insensitive) but the subsection is not.
+type configEntry struct {
+	key       string
+	value     string
+	noValue   bool // `[core] bare` without '=' is a boolean true
+	line      int  // index of the line in the file, used when editing it
+	continued int  // how many more lines the value goes on for
+}
+
+// parseConfig parses git's config file format:
+//
+//	# comment
+//	[section]
+//		key = value ; comment
+//	[section "subsection"]
+//		key = "quoted value with \"escapes\""
+//		flag
+//		long = a value going on \
+//	on the next line
+//
+// Like git, a value ending with a backslash goes on on the next line,
+// without the newline.
+func parseConfig(content []byte) ([]configEntry, error) {
+	var entries []configEntry
+	section := ""
+
+	lines := strings.Split(string(content), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			name, err := parseConfigSection(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad config line %d: %s", i+1, err)
+			}
+			section = name
+			continue
+		}
+
+		if section == "" {
+			return nil, fmt.Errorf("bad config line %d: key outside of a section", i+1)
+		}
+
+		name, value, hasValue := strings.Cut(line, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		entry := configEntry{key: section + "." + name, noValue: !hasValue, line: i}
+		for hasValue && continuesLine(value) && i+1 < len(lines) {
+			i++
+			entry.continued++
+			value = value[:len(value)-1] + strings.TrimRight(lines[i], " \t\r")
+		}
+		if hasValue {
+			parsed, err := parseConfigValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad config line %d: %s", i+1, err)
+			}
+			entry.value = parsed
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// continuesLine tells whether a value ends with a backslash that isn't
+// escaped, which continues it on the next line.
+func continuesLine(value string) bool {
+	backslashes := len(value) - len(strings.TrimRight(value, `\`))
+	return backslashes%2 == 1
+}
+
+// parseConfigSection parses a `[section]` or `[section "subsection"]` header
+// into section or section.subsection, with the section lowercased.
+//
+// The deprecated [section.subsection] syntax ends up lowercased as a whole.
+func parseConfigSection(line string) (string, error) {
+	end := strings.LastIndexByte(line, ']')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated section header")
+	}
+
+	name, subsection, hasSubsection := strings.Cut(line[1:end], " ")
+	section := strings.ToLower(name)
+	if hasSubsection {
+		subsection = strings.TrimSpace(subsection)
+		subsection = strings.TrimSuffix(strings.TrimPrefix(subsection, "\""), "\"")
+		subsection = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(subsection)
+		section += "." + subsection
+	}
+
+	return section, nil
+}
+
+// parseConfigValue unquotes a config value, handles escapes and strips
+// trailing comments.
+func parseConfigValue(raw string) (string, error) {
+	var value strings.Builder
+	quoted := false
+	pendingSpace := ""
+
+	raw = strings.TrimSpace(raw)
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\':
+			if i+1 >= len(raw) {
+				return "", fmt.Errorf("dangling escape")
+			}
+			i++
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'b':
+				value.WriteByte('\b')
+			case '"', '\\':
+				value.WriteByte(raw[i])
+			default:
+				return "", fmt.Errorf("unknown escape \\%c", raw[i])
+			}
+		case !quoted && (c == '#' || c == ';'):
+			return value.String(), nil
+		case !quoted && (c == ' ' || c == '\t'):
+			// only keep inner whitespace, not the one before a comment
+			pendingSpace += string(c)
+		default:
+			value.WriteString(pendingSpace)
+			pendingSpace = ""
+			value.WriteByte(c)
+		}
+	}
+
+	if quoted {
+		return "", fmt.Errorf("unterminated quote")
+	}
+	return value.String(), nil
+}
+
+// normalizeConfigKey lowercases the section and name of a key,
+// eg: Core.Pager becomes core.pager, but pager.Log.enabled keeps "Log".
+func normalizeConfigKey(key string) string {
+	first := strings.IndexByte(key, '.')
+	last := strings.LastIndexByte(key, '.')
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
+
+var configCache []configEntry
+
+// loadConfig reads the global ~/.gitconfig and the repository's .git/config,
+// in that order, so the repository settings win when looking up a key.
+//
+// Unreadable or malformed files are reported once and skipped.
+func loadConfig() []configEntry {
+	if configCache != nil {
+		return configCache
+	}
+	configCache = []configEntry{}
+
+	files := []string{globalConfigPath(), gitPath("config")}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		entries, err := parseConfig(content)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: ignoring '%s': %s\n", file, err)
+			continue
+		}
+		configCache = append(configCache, entries...)
+	}
+
+	return configCache
+}
+
+// configGet returns the last value set for a key.
+func configGet(key string) (string, bool) {
+	key = normalizeConfigKey(key)
+
+	entries := loadConfig()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].key == key {
+			return entries[i].value, true
+		}
+	}
+	return "", false
+}
+
+// configGetAll returns every value set for a key, in order, for the keys
+// that can be repeated, eg: remote.origin.fetch.
+func configGetAll(key string) []string {
+	key = normalizeConfigKey(key)
+
+	var values []string
+	for _, entry := range loadConfig() {
+		if entry.key == key {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
+
+// configBool looks up a boolean key, falling back to def when it's not set
+// or not a boolean.
+//
+// true/yes/on/1 and a key without a value are true, false/no/off/0 and the
+// empty string are false.
+func configBool(key string, def bool) bool {
+	key = normalizeConfigKey(key)
+
+	entries := loadConfig()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].key != key {
+			continue
+		}
+		if entries[i].noValue {
+			return true
+		}
+
+		value, ok := parseBool(entries[i].value)
+		if !ok {
+			return def
+		}
+		return value
+	}
+	return def
+}
+
+// parseBool parses git's boolean values.
+func parseBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0", "":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConfigScopePrecedence(t *testing.T) {
+	testRepository(t)
+	global := "[user]\n\tname = Global Name\n\temail = global@example.com\n" +
+		"[core]\n\tfsyncObjectFiles = true\n" +
+		"[remote \"origin\"]\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n"
+	local := "[user]\n\tname = Local Name\n" +
+		"[core]\n\tfsyncObjectFiles = false\n" +
+		"[remote \"origin\"]\n\tfetch = +refs/tags/*:refs/tags/*\n"
+	if err := os.WriteFile(globalConfigPath(), []byte(global), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(".git/config", []byte(local), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+
+	// the repository wins over the global file, which fills in the rest
+	if value, ok := configGet("user.name"); !ok || value != "Local Name" {
+		t.Errorf("user.name is %q, expected the local one", value)
+	}
+	if value, ok := configGet("user.email"); !ok || value != "global@example.com" {
+		t.Errorf("user.email is %q, expected the global one", value)
+	}
+	if configBool("core.fsyncObjectFiles", true) {
+		t.Error("core.fsyncObjectFiles is true, expected the local false")
+	}
+
+	// a multivalued key has the values of both, the global ones first
+	want := []string{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"}
+	if values := configGetAll("remote.origin.fetch"); !reflect.DeepEqual(values, want) {
+		t.Errorf("remote.origin.fetch is %q, expected %q", values, want)
+	}
+
+	// once unset locally, the global value shows through
+	file, err := readConfigFile(".git/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := file.find("user.name")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("found %v (%v) for user.name in .git/config", entries, err)
+	}
+	file.remove(entries[0])
+	if err := file.write(); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+	if value, ok := configGet("user.name"); !ok || value != "Global Name" {
+		t.Errorf("user.name is %q once unset in the repository, expected the global one", value)
+	}
+}
+
+func TestConfigLineContinuation(t *testing.T) {
+	testRepository(t)
+	content := "[alias]\n\tlg = log \\\n--oneline \\\n\t--graph\n\tpath = \"C:\\\\\"\n[user]\n\tname = Name\n"
+	if err := os.WriteFile(".git/config", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+	if value, _ := configGet("alias.lg"); value != "log --oneline \t--graph" {
+		t.Errorf("alias.lg is %q, expected the value going on over the next lines", value)
+	}
+	if value, _ := configGet("alias.path"); value != `C:\` {
+		t.Errorf("alias.path is %q, an escaped backslash doesn't go on", value)
+	}
+	if value, _ := configGet("user.name"); value != "Name" {
+		t.Errorf("user.name is %q after a value on several lines", value)
+	}
+
+	// the value is replaced along with the lines it goes on for
+	file, err := readConfigFile(".git/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := file.find("alias.lg")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("found %v (%v) for alias.lg", entries, err)
+	}
+	file.remove(entries[0])
+	if err := file.write(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(".git/config"); string(got) != "[alias]\n\tpath = \"C:\\\\\"\n[user]\n\tname = Name\n" {
+		t.Errorf("the config is\n%s\nonce alias.lg is removed", got)
+	}
+	if fileExists(".git/config.lock") {
+		t.Error("the lock of the config was left behind")
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFile is a config file kept as its raw lines, so it can be edited
+// without losing comments, formatting or the order of the sections.
+type configFile struct {
+	path  string
+	lines []string
+}
+
+// readConfigFile loads a config file for editing. A missing file is empty.
+func readConfigFile(path string) (*configFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f := &configFile{path: path}
+	if len(content) > 0 {
+		f.lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+	return f, nil
+}
+
+// entries parses the current lines.
+func (f *configFile) entries() ([]configEntry, error) {
+	return parseConfig([]byte(strings.Join(f.lines, "\n")))
+}
+
+// write saves the file back to disk, through <path>.lock so that it's
+// never left half written, see AcquireLock.
+func (f *configFile) write() error {
+	content := strings.Join(f.lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	lock, err := AcquireLock(f.path)
+	if err != nil {
+		return err
+	}
+	if _, err := lock.Write([]byte(content)); err != nil {
+		lock.Rollback()
+		return err
+	}
+	return lock.Commit()
+}
+
+// find returns the entries matching a (normalized) key.
+func (f *configFile) find(key string) ([]configEntry, error) {
+	entries, err := f.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []configEntry
+	for _, entry := range entries {
+		if entry.key == key {
+			found = append(found, entry)
+		}
+	}
+	return found, nil
+}
+
+// sectionEnd returns the index of the last line belonging to the last
+// occurrence of a section, or -1 when the section doesn't exist.
+func (f *configFile) sectionEnd(section string) int {
+	end := -1
+	current := ""
+	for i, line := range f.lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			current, _ = parseConfigSection(trimmed)
+			if current == section {
+				end = i
+			}
+			continue
+		}
+		if current == section && trimmed != "" {
+			end = i
+		}
+	}
+	return end
+}
+
+// add appends a new `name = value` line at the end of the section, creating
+// the section at the end of the file when it doesn't exist yet.
+func (f *configFile) add(key string, value string) {
+	section, name := splitConfigKey(key)
+	line := "\t" + name + " = " + quoteConfigValue(value)
+
+	normalizedSection, _ := splitConfigKey(normalizeConfigKey(key))
+	end := f.sectionEnd(normalizedSection)
+	if end < 0 {
+		f.lines = append(f.lines, configSectionHeader(section), line)
+		return
+	}
+
+	f.lines = append(f.lines[:end+1], append([]string{line}, f.lines[end+1:]...)...)
+}
+
+// remove drops the lines of an entry.
+func (f *configFile) remove(entry configEntry) {
+	f.lines = append(f.lines[:entry.line], f.lines[entry.line+1+entry.continued:]...)
+}
+
+// splitConfigKey splits section[.subsection].name into its section part and
+// its name, keeping the case the user typed.
+func splitConfigKey(key string) (string, string) {
+	last := strings.LastIndexByte(key, '.')
+	return key[:last], key[last+1:]
+}
+
+// configSectionHeader formats the header for section or section.subsection.
+func configSectionHeader(section string) string {
+	name, subsection, hasSubsection := strings.Cut(section, ".")
+	if !hasSubsection {
+		return "[" + strings.ToLower(name) + "]"
+	}
+
+	subsection = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+	return fmt.Sprintf("[%s \"%s\"]", strings.ToLower(name), subsection)
+}
+
+// quoteConfigValue escapes a value and quotes it when it would otherwise
+// be mangled when read back: leading/trailing spaces or comment characters.
+func quoteConfigValue(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(value)
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return `"` + escaped + `"`
+	}
+	return escaped
+}
+
+// globalConfigPath is where --global settings are read from and written to.
+func globalConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gitconfig")
+}
+
+// configCmd implements `git config`
+//
+//	git config [--global] <key>                   print the value of a key
+//	git config [--global] --get <key>             same
+//	git config [--global] --get-all <key>         print all values of a multivalued key
+//	git config [--global] --list                  print all settings as key=value
+//	git config [--global] <key> <value>           set a key, replacing its single value
+//	git config [--global] --add <key> <value>     add another value to a key
+//	git config [--global] --unset <key>           remove a key
+//
+// Without --global, reads look at the global file first and then the
+// repository's .git/config, so the repository wins; writes go to .git/config.
+func configCmd(args []string) {
+	flag := flag.NewFlagSet("git config", flag.ExitOnError)
+	var (
+		global = flag.Bool("global", false, "use the global config file (~/.gitconfig)")
+		local  = flag.Bool("local", false, "use the repository config file (.git/config)")
+		get    = flag.Bool("get", false, "get the value of a key")
+		getAll = flag.Bool("get-all", false, "get all values of a multivalued key")
+		list   = flag.Bool("list", false, "list all variables")
+		add    = flag.Bool("add", false, "add a new value to a multivalued key")
+		unset  = flag.Bool("unset", false, "remove a key")
+	)
+	flag.BoolVar(list, "l", false, "list all variables")
+	flag.Parse(args)
+	args = flag.Args()
+
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: git config [--global | --local] [--get | --get-all | --add | --unset] <key> [<value>]")
+		fmt.Fprintln(os.Stderr, "   or: git config [--global | --local] --list")
+		os.Exit(2)
+	}
+
+	// reads without a scope see every file, writes default to the repository
+	var entries []configEntry
+	path := gitPath("config")
+	if *global {
+		path = globalConfigPath()
+	}
+	if *global || *local {
+		file, err := readConfigFile(path)
+		if err == nil {
+			entries, err = file.entries()
+		}
+		if err != nil {
+			error := fmt.Sprintf("Failed to read '%s': %s", path, err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+	} else {
+		entries = loadConfig()
+	}
+
+	if *list {
+		if len(args) != 0 {
+			usage()
+		}
+		for _, entry := range entries {
+			if entry.noValue {
+				fmt.Println(entry.key)
+			} else {
+				fmt.Printf("%s=%s\n", entry.key, entry.value)
+			}
+		}
+		return
+	}
+
+	if len(args) == 0 {
+		usage()
+	}
+
+	key := normalizeConfigKey(args[0])
+	if !strings.Contains(key, ".") || strings.HasSuffix(key, ".") {
+		fmt.Fprintf(os.Stderr, "error: key does not contain a section: %s\n", args[0])
+		os.Exit(2)
+	}
+
+	if *get || *getAll || (len(args) == 1 && !*unset) {
+		if len(args) != 1 {
+			usage()
+		}
+
+		var values []string
+		for _, entry := range entries {
+			if entry.key == key {
+				values = append(values, entry.value)
+			}
+		}
+		if len(values) == 0 {
+			os.Exit(1)
+		}
+
+		if !*getAll {
+			values = values[len(values)-1:]
+		}
+		for _, value := range values {
+			fmt.Println(value)
+		}
+		return
+	}
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		error := fmt.Sprintf("Failed to read '%s': %s", path, err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	existing, err := file.find(key)
+	if err != nil {
+		error := fmt.Sprintf("Failed to parse '%s': %s", path, err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	switch {
+	case *unset:
+		if len(args) != 1 {
+			usage()
+		}
+		if len(existing) == 0 {
+			os.Exit(5)
+		}
+		if len(existing) > 1 {
+			fmt.Fprintf(os.Stderr, "warning: %s has multiple values\n", args[0])
+			os.Exit(5)
+		}
+		file.remove(existing[0])
+
+	case *add:
+		if len(args) != 2 {
+			usage()
+		}
+		file.add(args[0], args[1])
+
+	default:
+		if len(args) != 2 {
+			usage()
+		}
+		if len(existing) > 1 {
+			fmt.Fprintf(os.Stderr, "warning: %s has multiple values\n", args[0])
+			fmt.Fprintf(os.Stderr, "error: cannot overwrite multiple values with a single value\n")
+			os.Exit(5)
+		}
+
+		if len(existing) == 1 {
+			_, name := splitConfigKey(args[0])
+			line := existing[0].line
+			indent := file.lines[line][:len(file.lines[line])-len(strings.TrimLeft(file.lines[line], " \t"))]
+			file.remove(existing[0])
+			file.lines = append(file.lines[:line], append([]string{indent + name + " = " + quoteConfigValue(args[1])}, file.lines[line:]...)...)
+		} else {
+			file.add(args[0], args[1])
+		}
+	}
+
+	err = file.write()
+	if err != nil {
+		error := fmt.Sprintf("Failed to write '%s': %s", path, err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
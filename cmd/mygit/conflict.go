@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// conflictMarkerSize is the length of the markers of a conflict, like git.
+const conflictMarkerSize = 7
+
+// Conflict is a region of a file left between conflict markers by a merge,
+// see mergeLines:
+//
+//	<<<<<<< <ours label>
+//	<our lines>
+//	||||||| <base label>
+//	<the lines of the merge base>
+//	=======
+//	<their lines>
+//	>>>>>>> <their label>
+//
+// The base is only there in the diff3 style. start and end are the offsets
+// of the region in the file, its markers included.
+type Conflict struct {
+	start, end                        int
+	oursLabel, baseLabel, theirsLabel string
+	Ours, Base, Theirs                []byte
+	hasBase                           bool
+}
+
+// Resolution is the side a conflict is resolved to.
+type Resolution int
+
+const (
+	Ours Resolution = iota
+	Theirs
+	Union // our lines, then theirs
+)
+
+// conflictMarker tells whether a line is a conflict marker made of the
+// given character, and returns the label after it, if any.
+func conflictMarker(line string, marker byte) (string, bool) {
+	line = strings.TrimSuffix(line, "\n")
+	prefix := strings.Repeat(string(marker), conflictMarkerSize)
+	rest, ok := strings.CutPrefix(line, prefix)
+	if !ok || rest != "" && rest[0] != ' ' {
+		return "", false
+	}
+	return strings.TrimPrefix(rest, " "), true
+}
+
+// ParseConflicts finds the conflicts of a file, in order. A conflict whose
+// markers are out of order or not closed is an error, since resolving it
+// would lose lines.
+func ParseConflicts(data []byte) ([]Conflict, error) {
+	const (
+		outside = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+
+	var conflicts []Conflict
+	var current Conflict
+	state, offset, start := outside, 0, 0
+	for n, line := range strings.SplitAfter(string(data), "\n") {
+		lineStart := offset
+		offset += len(line)
+		if line == "" {
+			continue
+		}
+
+		if label, ok := conflictMarker(line, '<'); ok {
+			if state != outside {
+				return nil, fmt.Errorf("line %d: conflict started inside another one", n+1)
+			}
+			current, state, start = Conflict{start: lineStart, oursLabel: label}, inOurs, n+1
+			continue
+		}
+		if label, ok := conflictMarker(line, '|'); ok && state == inOurs {
+			current.baseLabel, current.hasBase, state = label, true, inBase
+			continue
+		}
+		if label, ok := conflictMarker(line, '='); ok && label == "" && (state == inOurs || state == inBase) {
+			state = inTheirs
+			continue
+		}
+		if label, ok := conflictMarker(line, '>'); ok && state == inTheirs {
+			current.theirsLabel, current.end = label, offset
+			conflicts = append(conflicts, current)
+			state = outside
+			continue
+		}
+
+		switch state {
+		case inOurs:
+			current.Ours = append(current.Ours, line...)
+		case inBase:
+			current.Base = append(current.Base, line...)
+		case inTheirs:
+			current.Theirs = append(current.Theirs, line...)
+		}
+	}
+
+	if state != outside {
+		return nil, fmt.Errorf("line %d: conflict not closed", start)
+	}
+	return conflicts, nil
+}
+
+// ResolveConflict returns the lines a conflict is replaced with, as the
+// resolution says.
+func ResolveConflict(c Conflict, choice Resolution) []byte {
+	switch choice {
+	case Theirs:
+		return c.Theirs
+	case Union:
+		return append(append([]byte{}, c.Ours...), c.Theirs...)
+	default:
+		return c.Ours
+	}
+}
+
+// resolveConflicts resolves all the conflicts of a file the same way, see
+// ResolveConflict, and returns the result with how many there were.
+func resolveConflicts(data []byte, choice Resolution) ([]byte, int, error) {
+	conflicts, err := ParseConflicts(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resolved bytes.Buffer
+	last := 0
+	for _, c := range conflicts {
+		resolved.Write(data[last:c.start])
+		resolved.Write(ResolveConflict(c, choice))
+		last = c.end
+	}
+	resolved.Write(data[last:])
+	return resolved.Bytes(), len(conflicts), nil
+}
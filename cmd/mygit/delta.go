@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// deltaBlock is the length of the chunks of a base indexed by createDelta,
+// the shortest copy it looks for.
+const deltaBlock = 16
+
+// maxDeltaCopy is the most a copy instruction of createDelta copies, like
+// git, which keeps copies to 64 KiB for the readers of old packs.
+const maxDeltaCopy = 0x10000
+
+// appendDeltaSize appends one of the sizes at the start of a delta, see
+// readDeltaSize.
+func appendDeltaSize(delta []byte, size int) []byte {
+	for size >= 0x80 {
+		delta = append(delta, byte(size&0x7f|0x80))
+		size >>= 7
+	}
+	return append(delta, byte(size))
+}
+
+// appendDeltaCopy appends the instruction copying size bytes of the base
+// at offset, see applyDelta. Only the non-zero bytes of the offset and size
+// are written, their bits in the first byte say which.
+func appendDeltaCopy(delta []byte, offset int, size int) []byte {
+	at := len(delta)
+	delta = append(delta, 0x80)
+	for i := 0; i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			delta[at] |= 1 << i
+			delta = append(delta, b)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if b := byte(size >> (8 * i)); b != 0 {
+			delta[at] |= 1 << (4 + i)
+			delta = append(delta, b)
+		}
+	}
+	return delta
+}
+
+// appendDeltaInsert appends the instructions inserting data, 127 bytes at
+// most each.
+func appendDeltaInsert(delta []byte, data []byte) []byte {
+	for len(data) > 0 {
+		n := min(len(data), 0x7f)
+		delta = append(delta, byte(n))
+		delta = append(delta, data[:n]...)
+		data = data[n:]
+	}
+	return delta
+}
+
+// blockHash hashes deltaBlock bytes, to find the chunks of a base.
+func blockHash(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data)*0x9e3779b97f4a7c15 ^ binary.LittleEndian.Uint64(data[8:])
+}
+
+// createDelta returns a delta turning base into target, see applyDelta, or
+// nil when it would take more than maxSize bytes.
+//
+// The base is indexed by chunks of deltaBlock bytes. At each position of
+// the target, the chunks of the base starting with the same bytes are
+// extended as far as they match, backwards into what was going to be
+// inserted too, and the longest one is copied. Anything else is inserted.
+func createDelta(base []byte, target []byte, maxSize int) []byte {
+	if len(base) < deltaBlock || len(target) == 0 {
+		return nil
+	}
+
+	index := map[uint64][]int{}
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		hash := blockHash(base[i:])
+		// a chunk repeated over and over doesn't need every occurrence
+		if len(index[hash]) < 64 {
+			index[hash] = append(index[hash], i)
+		}
+	}
+
+	delta := appendDeltaSize(nil, len(base))
+	delta = appendDeltaSize(delta, len(target))
+	inserted := 0 // start of the bytes of target still to insert
+	for i := 0; i < len(target); {
+		if i+deltaBlock > len(target) {
+			break
+		}
+
+		bestOffset, bestSize, bestBack := 0, 0, 0
+		for _, offset := range index[blockHash(target[i:])] {
+			size := 0
+			for offset+size < len(base) && i+size < len(target) && base[offset+size] == target[i+size] {
+				size++
+			}
+			if size < deltaBlock {
+				continue
+			}
+			back := 0
+			for back < i-inserted && back < offset && base[offset-back-1] == target[i-back-1] {
+				back++
+			}
+			if size+back > bestSize+bestBack {
+				bestOffset, bestSize, bestBack = offset, size, back
+			}
+		}
+		if bestSize == 0 {
+			i++
+			continue
+		}
+
+		delta = appendDeltaInsert(delta, target[inserted:i-bestBack])
+		offset, size := bestOffset-bestBack, bestSize+bestBack
+		for size > 0 {
+			n := min(size, maxDeltaCopy)
+			delta = appendDeltaCopy(delta, offset, n)
+			offset, size = offset+n, size-n
+		}
+		i += bestSize
+		inserted = i
+		if len(delta) > maxSize {
+			return nil
+		}
+	}
+
+	delta = appendDeltaInsert(delta, target[inserted:])
+	if len(delta) > maxSize {
+		return nil
+	}
+	return delta
+}
+
+// packOptions are how writePack stores the objects of a pack.
+type packOptions struct {
+	level  int  // the zlib level, see packCompression
+	window int  // how many objects each one is tried as a delta of, 0 for no deltas
+	depth  int  // how long the chains of deltas can get
+	reuse  bool // keep the deltas objects already have in the packs
+}
+
+// defaultPackOptions returns how packs are written when nothing says
+// otherwise: at pack.compression, reusing the deltas of the packs, and
+// searching new ones within pack.window objects, 10 by default, in chains
+// of pack.depth, 50 by default, like git.
+func defaultPackOptions() packOptions {
+	return packOptions{
+		level:  packCompression(),
+		window: configInt("pack.window", 10),
+		depth:  configInt("pack.depth", 50),
+		reuse:  true,
+	}
+}
+
+// configInt looks up a number, falling back to def when it's not set or not
+// a number.
+func configInt(key string, def int) int {
+	value, ok := configGet(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// packCandidate is an object to write in a pack, and how: whole, or as a
+// delta of base, either computed by findDeltas or reused as it's stored.
+type packCandidate struct {
+	sha        string
+	objectType string
+	size       int
+	base       string
+	delta      []byte        // a delta computed
+	reused     *packedObject // a delta as it is in a pack
+	depth      int           // how many deltas are applied to read it
+}
+
+// findDeltas picks how each object is stored in a new pack.
+//
+// With reuse, an object that is a delta in a pack stays one, as long as its
+// base goes in the new pack too: that saves the time to compute it again.
+//
+// The other objects are sorted by type and size, the largest first, since
+// objects of similar sizes are the likeliest to be versions of each other.
+// Each is tried as a delta of the window objects before it, and stored as
+// the smallest delta found, if smaller than half the object, within depth.
+// Only the window objects are in memory at a time.
+func findDeltas(shas []string, opts packOptions, progress io.Writer) (map[string]*packCandidate, error) {
+	candidates := make(map[string]*packCandidate, len(shas))
+	for _, sha := range shas {
+		candidates[sha] = &packCandidate{sha: sha}
+	}
+
+	var packs *PackStore
+	if opts.reuse {
+		packs = packStore()
+	}
+	var searched []*packCandidate
+	for _, sha := range shas {
+		candidate := candidates[sha]
+		if packs != nil && packs.Has(sha) {
+			packed, err := packs.packed(sha)
+			if err != nil {
+				return nil, err
+			}
+			if packed.baseSha != "" && candidates[packed.baseSha] != nil {
+				candidate.base, candidate.reused = packed.baseSha, packed
+				continue
+			}
+		}
+
+		objectType, content, err := readObject(sha)
+		if err != nil {
+			return nil, err
+		}
+		candidate.objectType, candidate.size = objectType, len(content)
+		searched = append(searched, candidate)
+	}
+
+	if opts.window > 0 && opts.depth > 0 {
+		sort.SliceStable(searched, func(i, j int) bool {
+			if searched[i].objectType != searched[j].objectType {
+				return searched[i].objectType < searched[j].objectType
+			}
+			return searched[i].size > searched[j].size
+		})
+
+		type windowed struct {
+			candidate *packCandidate
+			content   []byte
+		}
+		var window []windowed
+		p := startProgress(progress, "Compressing objects", len(searched))
+		for n, candidate := range searched {
+			_, content, err := readObject(candidate.sha)
+			if err != nil {
+				return nil, err
+			}
+
+			for i := len(window) - 1; i >= 0; i-- {
+				base := window[i]
+				if base.candidate.objectType != candidate.objectType || base.candidate.depth >= opts.depth {
+					continue
+				}
+				// an object much smaller than its base would be a poor delta
+				if len(content) < len(base.content)/32 {
+					continue
+				}
+				maxSize := len(content)/2 - 20
+				if candidate.delta != nil {
+					maxSize = len(candidate.delta) - 1
+				}
+				if maxSize <= 0 {
+					break
+				}
+				if delta := createDelta(base.content, content, maxSize); delta != nil {
+					candidate.base, candidate.delta = base.candidate.sha, delta
+					candidate.depth = base.candidate.depth + 1
+				}
+			}
+
+			window = append(window, windowed{candidate, content})
+			if len(window) > opts.window {
+				window = window[1:]
+			}
+			p.update(n + 1)
+		}
+		p.done()
+	}
+
+	// the chains of the deltas reused go on from their bases. Two packs
+	// could each have the object the other one's base is a delta of, such
+	// a cycle is broken by storing one of them whole.
+	visiting := map[*packCandidate]bool{}
+	var depth func(candidate *packCandidate) int
+	depth = func(candidate *packCandidate) int {
+		if candidate.reused == nil || candidate.depth > 0 {
+			return candidate.depth
+		}
+		if visiting[candidate] {
+			candidate.base, candidate.reused = "", nil
+			return 0
+		}
+		visiting[candidate] = true
+		baseDepth := depth(candidates[candidate.base])
+		if candidate.reused != nil {
+			candidate.depth = baseDepth + 1
+		}
+		return candidate.depth
+	}
+	for _, sha := range shas {
+		depth(candidates[sha])
+	}
+	return candidates, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCreateDelta(t *testing.T) {
+	base := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 200))
+	target := append([]byte("a new first line\n"), base[:4000]...)
+	target = append(target, "something in the middle\n"...)
+	target = append(target, base[5000:]...)
+
+	delta := createDelta(base, target, len(target))
+	if delta == nil {
+		t.Fatal("no delta between two versions of the same text")
+	}
+	if len(delta) > len(target)/10 {
+		t.Errorf("delta of %d bytes for %d bytes mostly copied", len(delta), len(target))
+	}
+	result, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, target) {
+		t.Error("applying the delta doesn't give the target back")
+	}
+}
+
+func TestCreateDeltaLargeCopy(t *testing.T) {
+	base := make([]byte, 3*maxDeltaCopy+123)
+	for i := range base {
+		base[i] = byte(i * 7 % 251)
+	}
+	target := append(append([]byte{}, base...), "tail"...)
+
+	delta := createDelta(base, target, len(target))
+	result, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, target) {
+		t.Error("applying the delta doesn't give the target back")
+	}
+}
+
+func TestCreateDeltaMaxSize(t *testing.T) {
+	base := []byte(strings.Repeat("0123456789abcdef", 10))
+	target := []byte(strings.Repeat("fedcba9876543210", 10))
+	if delta := createDelta(base, target, len(target)/2); delta != nil {
+		t.Errorf("delta of %d bytes for unrelated content should have been given up", len(delta))
+	}
+}
+
+func TestEncodeOfsDeltaHeader(t *testing.T) {
+	for _, distance := range []int64{1, 127, 128, 16511, 16512, 1 << 20} {
+		header := encodeOfsDeltaHeader(10, distance)
+		pack := append(make([]byte, distance), header...)
+		reader := bytes.NewReader(append(pack, zlibTest(t, make([]byte, 10))...))
+		reader.Seek(distance, 0)
+		entry, err := parsePackEntry(reader, distance)
+		if err != nil {
+			t.Fatalf("distance %d: %s", distance, err)
+		}
+		if entry.baseOffset != 0 {
+			t.Errorf("distance %d: base offset %d, expected 0", distance, entry.baseOffset)
+		}
+	}
+}
+
+// zlibTest compresses data at the default level.
+func zlibTest(t *testing.T, data []byte) []byte {
+	t.Helper()
+	compressed, err := zlibCompress(data, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
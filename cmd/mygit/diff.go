@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around a change.
+const diffContext = 3
+
+// diffOptions changes how patches are written, the zero value gives the
+// usual unified diff.
+type diffOptions struct {
+	wordDiff  string            // show the changed words in this mode, see wordDiffStyles
+	wordRegex *regexp.Regexp    // what a word is, runs of non-whitespace when nil
+	blobs     map[string][]byte // content of blobs that aren't objects, eg: files of the work tree
+
+	ignoreAllSpace    bool          // whitespace doesn't count when comparing lines
+	ignoreSpaceChange bool          // only whether there is whitespace counts, not how much
+	ignoreSpaceAtEOL  bool          // whitespace at the end of lines doesn't count
+	ignoreBlankLines  bool          // changes made of blank lines only don't make hunks
+	wsHighlight       map[byte]bool // the kinds of lines ('+', '-', ' ') whose whitespace errors are highlighted
+}
+
+// lineKey returns what is compared of a line, without the whitespace the
+// options ignore, or nil when lines are compared as they are.
+func (opts *diffOptions) lineKey() func(string) string {
+	switch {
+	case opts.ignoreAllSpace:
+		return func(line string) string {
+			return strings.Map(func(r rune) rune {
+				if r < 0x80 && isSpace(byte(r)) {
+					return -1
+				}
+				return r
+			}, line)
+		}
+	case opts.ignoreSpaceChange:
+		return func(line string) string {
+			var key strings.Builder
+			for i := 0; i < len(line); i++ {
+				if !isSpace(line[i]) {
+					key.WriteByte(line[i])
+					continue
+				}
+				for i+1 < len(line) && isSpace(line[i+1]) {
+					i++
+				}
+				if i+1 < len(line) {
+					key.WriteByte(' ')
+				}
+			}
+			return key.String()
+		}
+	case opts.ignoreSpaceAtEOL:
+		return func(line string) string {
+			return strings.TrimRight(line, " \t\n\v\f\r")
+		}
+	}
+	return nil
+}
+
+// isBlankLine tells whether a line only has whitespace.
+func isBlankLine(line string) bool {
+	return strings.TrimLeft(line, " \t\n\v\f\r") == ""
+}
+
+// readBlob is readBlob, for the blobs given in the options too.
+func (opts *diffOptions) readBlob(sha string) ([]byte, error) {
+	if content, ok := opts.blobs[sha]; ok {
+		return content, nil
+	}
+	return readBlob(sha)
+}
+
+// splitLines splits content into lines, each keeping its "\n". Only the
+// last line can be without one.
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		lines = append(lines, string(content[:end]))
+		content = content[end:]
+	}
+	return lines
+}
+
+// lineDiff finds which lines are removed from a and which are added in b,
+// using Myers' O(ND) algorithm in linear space: the middle snake of the
+// shortest edit script splits the problem in two halves that are solved
+// recursively.
+type lineDiff struct {
+	a, b           []int
+	removed, added []bool
+}
+
+// diffLines compares two lists of lines and returns, for each line, whether
+// it was removed from a or added in b.
+func diffLines(a []string, b []string) ([]bool, []bool) {
+	return diffLinesBy(a, b, nil)
+}
+
+// diffLinesBy is diffLines comparing the keys of lines, see lineKey, when
+// key isn't nil.
+func diffLinesBy(a []string, b []string, key func(string) string) ([]bool, []bool) {
+	// compare numbers instead of strings
+	ids := map[string]int{}
+	id := func(lines []string) []int {
+		result := make([]int, len(lines))
+		for i, line := range lines {
+			if key != nil {
+				line = key(line)
+			}
+			if _, ok := ids[line]; !ok {
+				ids[line] = len(ids)
+			}
+			result[i] = ids[line]
+		}
+		return result
+	}
+
+	d := &lineDiff{a: id(a), b: id(b), removed: make([]bool, len(a)), added: make([]bool, len(b))}
+	d.compare(0, len(a), 0, len(b))
+	compactChanges(d.a, d.removed, d.b, d.added)
+	compactChanges(d.b, d.added, d.a, d.removed)
+
+	return d.removed, d.added
+}
+
+func (d *lineDiff) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	if aLo == aHi {
+		for i := bLo; i < bHi; i++ {
+			d.added[i] = true
+		}
+		return
+	}
+	if bLo == bHi {
+		for i := aLo; i < aHi; i++ {
+			d.removed[i] = true
+		}
+		return
+	}
+
+	x, y := d.middleSnake(aLo, aHi, bLo, bHi)
+	d.compare(aLo, x, bLo, y)
+	d.compare(x, aHi, y, bHi)
+}
+
+// middleSnake searches the shortest edit script from both ends at once and
+// returns a point where the two searches meet.
+//
+// vf holds the furthest x reached going forward on each diagonal k = x - y,
+// vb the same going backward from the end, where the diagonals are
+// numbered from the end too.
+func (d *lineDiff) middleSnake(aLo, aHi, bLo, bHi int) (int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+	offset := max + 1
+
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+
+	for depth := 0; depth <= max; depth++ {
+		for k := -depth; k <= depth; k += 2 {
+			var x int
+			if k == -depth || (k != depth && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			vf[offset+k] = x
+
+			if reverse := delta - k; odd && reverse >= -(depth-1) && reverse <= depth-1 {
+				if x+vb[offset+reverse] >= n {
+					return aLo + x, bLo + y
+				}
+			}
+		}
+
+		for k := -depth; k <= depth; k += 2 {
+			var x int
+			if k == -depth || (k != depth && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.a[aHi-1-x] == d.b[bHi-1-y] {
+				x++
+				y++
+			}
+			vb[offset+k] = x
+
+			if forward := delta - k; !odd && forward >= -depth && forward <= depth {
+				if x+vf[offset+forward] >= n {
+					return aHi - x, bHi - y
+				}
+			}
+		}
+	}
+
+	// unreachable, the searches always meet within max steps
+	return aLo + n/2, bLo + m/2
+}
+
+// diffGroup is a run of changed lines [start, end) in one side of a diff.
+// Between two groups there is exactly one unchanged line, so groups can be
+// empty, and the n-th group of one side pairs with the n-th of the other.
+type diffGroup struct {
+	lines      []int
+	changed    []bool
+	start, end int
+}
+
+func newDiffGroup(lines []int, changed []bool) *diffGroup {
+	g := &diffGroup{lines: lines, changed: changed}
+	for g.end < len(changed) && changed[g.end] {
+		g.end++
+	}
+	return g
+}
+
+func (g *diffGroup) isChanged(i int) bool {
+	return i >= 0 && i < len(g.changed) && g.changed[i]
+}
+
+// next moves to the next group, it returns false at the end.
+func (g *diffGroup) next() bool {
+	if g.end >= len(g.changed) {
+		return false
+	}
+	g.start = g.end + 1
+	g.end = g.start
+	for g.isChanged(g.end) {
+		g.end++
+	}
+	return true
+}
+
+// previous moves to the previous group, it returns false at the start.
+func (g *diffGroup) previous() bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	g.start = g.end
+	for g.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// slideUp moves the group up one line, possible when the line before it
+// equals its last line. It merges with the group it runs into.
+func (g *diffGroup) slideUp() bool {
+	if g.start == 0 || g.lines[g.start-1] != g.lines[g.end-1] {
+		return false
+	}
+	g.start--
+	g.end--
+	g.changed[g.start] = true
+	g.changed[g.end] = false
+	for g.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// slideDown moves the group down one line, possible when the line after it
+// equals its first line. It merges with the group it runs into.
+func (g *diffGroup) slideDown() bool {
+	if g.end == len(g.lines) || g.lines[g.start] != g.lines[g.end] {
+		return false
+	}
+	g.changed[g.start] = false
+	g.changed[g.end] = true
+	g.start++
+	g.end++
+	for g.isChanged(g.end) {
+		g.end++
+	}
+	return true
+}
+
+// compactChanges moves the groups of changed lines of one side the way
+// git's xdiff does. The diff stays as short, but reads better:
+//
+//   - each group is slid up and down as far as possible, merging with the
+//     groups it runs into
+//   - it is then put back in line with the last change of the other side it
+//     could face, so a modification shows as - and + lines next to each other
+//   - otherwise it stays at the bottom, eg: a new function is shown after
+//     the blank line that precedes it, not before
+func compactChanges(lines []int, changed []bool, otherLines []int, otherChanged []bool) {
+	g := newDiffGroup(lines, changed)
+	other := newDiffGroup(otherLines, otherChanged)
+
+	for {
+		if g.end != g.start {
+			var earliestEnd, endMatchingOther, size int
+			for {
+				size = g.end - g.start
+				endMatchingOther = -1
+
+				for g.slideUp() {
+					other.previous()
+				}
+				earliestEnd = g.end
+				if other.end > other.start {
+					endMatchingOther = g.end
+				}
+
+				for g.slideDown() {
+					other.next()
+					if other.end > other.start {
+						endMatchingOther = g.end
+					}
+				}
+
+				if size == g.end-g.start {
+					break
+				}
+			}
+
+			if g.end != earliestEnd && endMatchingOther != -1 {
+				for other.end == other.start {
+					g.slideUp()
+					other.previous()
+				}
+			}
+		}
+
+		if !g.next() {
+			return
+		}
+		other.next()
+	}
+}
+
+// diffLine is a line of an edit script: ' ' for context, '-' or '+'.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// editScript merges the result of diffLines into one list of lines, with
+// the removed lines of a change before the added ones. Lines are compared
+// by key when it isn't nil, see lineKey; like git, unchanged lines are then
+// the ones of b.
+func editScript(a []string, b []string, key func(string) string) []diffLine {
+	removed, added := diffLinesBy(a, b, key)
+
+	var script []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for ; i < len(a) && removed[i]; i++ {
+			script = append(script, diffLine{'-', a[i]})
+		}
+		for ; j < len(b) && added[j]; j++ {
+			script = append(script, diffLine{'+', b[j]})
+		}
+		if i < len(a) && j < len(b) {
+			script = append(script, diffLine{' ', b[j]})
+			i++
+			j++
+		}
+	}
+	return script
+}
+
+// funcName returns the line git shows after a hunk header: the closest line
+// before the hunk that starts with a letter, '_' or '$', cut at 80 bytes.
+func funcName(lines []string, before int) string {
+	for i := before - 1; i >= 0; i-- {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		if c := line[0]; c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if len(line) > 80 {
+				line = line[:80]
+			}
+			return strings.TrimRight(line, " \t\r\n\v\f")
+		}
+	}
+	return ""
+}
+
+// hunkRange formats one side of a hunk header. An empty range is given as
+// the line before it, and a count of 1 is left out.
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// writeHunks writes the unified diff hunks between a and b:
+//
+//	@@ -<start>,<count> +<start>,<count> @@ <function>
+//	 context
+//	-removed
+//	+added
+//
+// Changes closer than twice the context are shown in the same hunk. With
+// ignoreBlankLines, changes made of blank lines only are shown when they are
+// in the hunk of another change, but don't make one.
+func writeHunks(w io.Writer, a []string, b []string, opts *diffOptions) {
+	script := editScript(a, b, opts.lineKey())
+
+	// which lines are part of a change that doesn't count
+	ignorable := make([]bool, len(script))
+	if opts.ignoreBlankLines {
+		for i := 0; i < len(script); {
+			if script[i].kind == ' ' {
+				i++
+				continue
+			}
+			end, blank := i, true
+			for ; end < len(script) && script[end].kind != ' '; end++ {
+				blank = blank && isBlankLine(script[end].text)
+			}
+			for ; i < end; i++ {
+				ignorable[i] = blank
+			}
+		}
+	}
+	changed := func(i int) bool {
+		return script[i].kind != ' ' && !ignorable[i]
+	}
+
+	// like git, the blank lines added at the end of b are whitespace errors
+	blankAtEOF := len(b)
+	if trailingBlankLines(b) > trailingBlankLines(a) {
+		blankAtEOF = len(b) - trailingBlankLines(b)
+	}
+
+	for start := 0; start < len(script); {
+		if !changed(start) {
+			start++
+			continue
+		}
+
+		// extend the hunk until a run of unchanged lines is long enough to
+		// split it
+		end := start
+		for i := start; i < len(script); i++ {
+			if changed(i) {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+
+		from := start - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := end + diffContext
+		if to > len(script) {
+			to = len(script)
+		}
+
+		// position of the hunk in a and b
+		aStart, bStart := 0, 0
+		for _, line := range script[:from] {
+			if line.kind != '+' {
+				aStart++
+			}
+			if line.kind != '-' {
+				bStart++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, line := range script[from:to] {
+			if line.kind != '+' {
+				aCount++
+			}
+			if line.kind != '-' {
+				bCount++
+			}
+		}
+
+		header := colored(colorCyan, fmt.Sprintf("@@ -%s +%s @@", hunkRange(aStart, aCount), hunkRange(bStart, bCount)))
+		if name := funcName(a, aStart); name != "" {
+			header += " " + name
+		}
+		fmt.Fprintln(w, header)
+
+		if opts.wordDiff != "" {
+			writeWordDiff(w, script[from:to], opts.wordRegex, wordDiffStyles[opts.wordDiff])
+			start = to
+			continue
+		}
+		bLine := bStart
+		for _, line := range script[from:to] {
+			color := map[byte]string{'-': colorRed, '+': colorGreen}[line.kind]
+			text := strings.TrimSuffix(line.text, "\n")
+			switch {
+			case !useColor || !opts.wsHighlight[line.kind]:
+				text = colored(color, string(line.kind)+text)
+			case line.kind == '+' && bLine >= blankAtEOF:
+				text = colored(colorWhitespace, "+"+text)
+			default:
+				text = highlightWhitespace(line.kind, text, color)
+			}
+			fmt.Fprintln(w, text)
+			if !strings.HasSuffix(line.text, "\n") {
+				fmt.Fprintln(w, "\\ No newline at end of file")
+			}
+			if line.kind != '-' {
+				bLine++
+			}
+		}
+
+		start = to
+	}
+}
+
+// trailingBlankLines counts the blank lines at the end of lines.
+func trailingBlankLines(lines []string) int {
+	n := 0
+	for n < len(lines) && isBlankLine(lines[len(lines)-1-n]) {
+		n++
+	}
+	return n
+}
+
+// highlightWhitespace colors a line of a patch, without its newline, with
+// the whitespace errors git finds by default highlighted: whitespace at the
+// end of the line, and spaces before a tab in the indent.
+func highlightWhitespace(kind byte, line string, color string) string {
+	var out strings.Builder
+	out.WriteString(colored(color, string(kind)))
+
+	trailing := len(line)
+	for trailing > 0 && isSpace(line[trailing-1]) {
+		trailing--
+	}
+
+	// the indent is written as is, but for the spaces before a tab
+	written := 0
+	for i := 0; i < trailing; i++ {
+		if line[i] == ' ' {
+			continue
+		}
+		if line[i] != '\t' {
+			break
+		}
+		if written < i {
+			out.WriteString(colored(colorWhitespace, line[written:i]) + "\t")
+		} else {
+			out.WriteString(line[written : i+1])
+		}
+		written = i + 1
+	}
+
+	if written < trailing {
+		out.WriteString(colored(color, line[written:trailing]))
+	}
+	if trailing < len(line) {
+		out.WriteString(colored(colorWhitespace, line[trailing:]))
+	}
+	return out.String()
+}
+
+// isBinary uses git's heuristic: content with a NUL byte in its first 8000
+// bytes is binary.
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// readBlob returns the content of a blob, or nothing for the missing side
+// of a change.
+func readBlob(sha string) ([]byte, error) {
+	if sha == "" {
+		return nil, nil
+	}
+	_, content, err := readObject(sha)
+	return content, err
+}
+
+// writePatch writes the patch of a single change the way `git diff` does:
+//
+//	diff --git a/<path> b/<path>
+//	new file mode <mode> | deleted file mode <mode> | old mode/new mode
+//	index <old sha>..<new sha> [<mode>]
+//	--- a/<path>
+//	+++ b/<path>
+//	<hunks>
+//
+// A type change is written as a deletion followed by an addition.
+func writePatch(w io.Writer, change treeChange, opts *diffOptions) error {
+	if change.status == 'T' {
+		oldPath := change.path
+		if change.oldPath != "" {
+			oldPath = change.oldPath
+		}
+		err := writePatch(w, treeChange{status: 'D', path: oldPath, old: change.old}, opts)
+		if err != nil {
+			return err
+		}
+		return writePatch(w, treeChange{status: 'A', path: change.path, new: change.new}, opts)
+	}
+
+	// the header lines are bold when colored
+	meta := func(format string, a ...any) {
+		fmt.Fprintln(w, colored(colorBold, fmt.Sprintf(format, a...)))
+	}
+	oldPath := change.path
+	if change.oldPath != "" {
+		oldPath = change.oldPath
+	}
+	meta("diff --git a/%s b/%s", oldPath, change.path)
+
+	abbrev := func(sha string) string {
+		if sha == "" {
+			return nullSha[:7]
+		}
+		return sha[:7]
+	}
+	index := fmt.Sprintf("index %s..%s", abbrev(change.old.sha), abbrev(change.new.sha))
+
+	switch {
+	case change.status == 'A':
+		meta("new file mode %s", change.new.mode)
+		meta("%s", index)
+	case change.status == 'D':
+		meta("deleted file mode %s", change.old.mode)
+		meta("%s", index)
+	default:
+		if change.old.mode != change.new.mode {
+			meta("old mode %s", change.old.mode)
+			meta("new mode %s", change.new.mode)
+		}
+		if change.status == 'R' {
+			meta("similarity index %d%%", change.score*100/maxScore)
+			meta("rename from %s", oldPath)
+			meta("rename to %s", change.path)
+		}
+		switch {
+		case change.old.sha == change.new.sha:
+			return nil
+		case change.old.mode != change.new.mode:
+			meta("%s", index)
+		default:
+			meta("%s %s", index, change.new.mode)
+		}
+	}
+
+	if change.old.mode == modeSubmodule || change.new.mode == modeSubmodule {
+		// a submodule is a commit, there is no content to compare
+		meta("--- a/%s", oldPath)
+		meta("+++ b/%s", change.path)
+		a := []string{"Subproject commit " + change.old.sha + "\n"}
+		b := []string{"Subproject commit " + change.new.sha + "\n"}
+		if change.old.sha == "" {
+			a = nil
+		}
+		if change.new.sha == "" {
+			b = nil
+		}
+		writeHunks(w, a, b, opts)
+		return nil
+	}
+
+	oldContent, err := opts.readBlob(change.old.sha)
+	if err != nil {
+		return err
+	}
+	newContent, err := opts.readBlob(change.new.sha)
+	if err != nil {
+		return err
+	}
+
+	oldName, newName := "a/"+oldPath, "b/"+change.path
+	if change.status == 'A' {
+		oldName = "/dev/null"
+	}
+	if change.status == 'D' {
+		newName = "/dev/null"
+	}
+
+	if isBinary(oldContent) || isBinary(newContent) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return nil
+	}
+	if len(oldContent) == 0 && len(newContent) == 0 {
+		return nil
+	}
+
+	meta("--- %s", oldName)
+	meta("+++ %s", newName)
+	writeHunks(w, splitLines(oldContent), splitLines(newContent), opts)
+	return nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexFiles returns the files of the index, keyed by path. Unmerged
+// entries are left out, they have no single content to compare.
+func indexFiles(idx *index) map[string]treeEntry {
+	files := map[string]treeEntry{}
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 {
+			continue
+		}
+		mode := strconv.FormatUint(uint64(entry.mode), 8)
+		files[entry.path] = treeEntry{mode: mode, name: entry.path, sha: entry.sha}
+	}
+	return files
+}
+
+// workTreeFiles returns the files of the work tree that are in the index,
+// keyed by path, as they would be added: a file whose size and mtime are
+// those of the index has the sha of the index, the others are hashed after
+// applying their attributes, and their content is kept in opts.blobs.
+// Deleted files are left out.
+func workTreeFiles(idx *index, opts *diffOptions) (map[string]treeEntry, error) {
+	trustMode := true
+	if value, ok := configGet("core.fileMode"); ok {
+		trustMode, _ = parseBool(value)
+	}
+	attrs := newAttrMatcher()
+
+	files := map[string]treeEntry{}
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 {
+			continue
+		}
+		indexMode := strconv.FormatUint(uint64(entry.mode), 8)
+		if indexMode == modeSubmodule {
+			// the commit of a submodule is whatever the index says
+			files[entry.path] = treeEntry{mode: indexMode, name: entry.path, sha: entry.sha}
+			continue
+		}
+
+		info, err := os.Lstat(entry.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+
+		mode := modeFile
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			mode = modeSymlink
+		case !trustMode && modeKind(indexMode) == "file":
+			mode = indexMode
+		case info.Mode()&0111 != 0:
+			mode = modeExecutable
+		}
+
+		sha := entry.sha
+		mtime := info.ModTime()
+		if uint32(mtime.Unix()) != entry.mtimeSec || uint32(mtime.Nanosecond()) != entry.mtimeNsec || uint32(info.Size()) != entry.size {
+			var content []byte
+			if mode == modeSymlink {
+				target, err := os.Readlink(entry.path)
+				if err != nil {
+					return nil, err
+				}
+				content = []byte(target)
+			} else {
+				if content, err = os.ReadFile(entry.path); err != nil {
+					return nil, err
+				}
+				content = cleanText(content, attrs.attributes(entry.path))
+			}
+			sha = objectHash("blob", content)
+			opts.blobs[sha] = content
+		}
+
+		files[entry.path] = treeEntry{mode: mode, name: entry.path, sha: sha}
+	}
+	return files, nil
+}
+
+// diffFiles compares two sets of files keyed by path, the way diffTrees
+// compares trees, and returns the changes ordered by path.
+func diffFiles(a map[string]treeEntry, b map[string]treeEntry) []treeChange {
+	var paths []string
+	for path := range a {
+		paths = append(paths, path)
+	}
+	for path := range b {
+		if _, ok := a[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []treeChange
+	for _, path := range paths {
+		old, inA := a[path]
+		new, inB := b[path]
+		switch {
+		case !inA:
+			changes = append(changes, treeChange{status: 'A', path: path, new: new})
+		case !inB:
+			changes = append(changes, treeChange{status: 'D', path: path, old: old})
+		case old.sha != new.sha || old.mode != new.mode:
+			status := byte('M')
+			if modeKind(old.mode) != modeKind(new.mode) {
+				status = 'T'
+			}
+			changes = append(changes, treeChange{status: status, path: path, old: old, new: new})
+		}
+	}
+	return changes
+}
+
+// parseWsErrorHighlight parses the value of --ws-error-highlight, a comma
+// separated list of the kinds of lines whose whitespace errors are
+// highlighted: context, old, new, all, none, or default for new, the
+// default. It returns them as the first character of the lines.
+func parseWsErrorHighlight(value string) (map[byte]bool, error) {
+	if value == "" {
+		return map[byte]bool{'+': true}, nil
+	}
+	kinds := map[byte]bool{}
+	for _, kind := range strings.Split(value, ",") {
+		switch kind {
+		case "none":
+			kinds = map[byte]bool{}
+		case "default", "new":
+			kinds['+'] = true
+		case "old":
+			kinds['-'] = true
+		case "context":
+			kinds[' '] = true
+		case "all":
+			kinds = map[byte]bool{'+': true, '-': true, ' ': true}
+		default:
+			return nil, fmt.Errorf("unknown value after ws-error-highlight=%s", kind)
+		}
+	}
+	return kinds, nil
+}
+
+// diffCmd implements `git diff [--cached] [--stat[=<width>[,<name-width>]] | --shortstat] [--numstat] [-M[<n>]] [-w | -b | --ignore-space-at-eol] [--ignore-blank-lines] [--ws-error-highlight=<kind>] [--word-diff[=<mode>]] [--word-diff-regex=<regex>] [--color[=<when>]] [<commit> [<commit>]] [[--] <path>...]`
+//
+// It shows the patch of the changes:
+//
+//	git diff                     the work tree against the index
+//	git diff --cached [<commit>] the index against a commit, HEAD by default
+//	git diff <commit>            the work tree against a commit
+//	git diff <commit> <commit>   a commit against another, also <commit>..<commit>
+//	git diff --no-index <path> <path> two files of the filesystem, see diffNoIndex
+//
+// Only the files of the index are in the work tree, untracked files are
+// never shown. With paths, the patch is limited to the changes under them.
+// Two files outside of the repository, or when there is none, are compared
+// as if --no-index were given.
+//
+// With --stat, a diffstat is shown instead of the patch, see writeDiffStat,
+// and with --shortstat only its summary. --numstat shows the counts for
+// scripts instead, see writeNumStat.
+//
+// -M, or --find-renames, shows a deleted and an added file whose content is
+// at least 50% similar, or the score -M<n> gives, as a rename, see
+// detectRenames, eg: with -M75%, files that kept 3/4 of their lines.
+//
+// With --word-diff, the changed lines are shown word by word, see
+// writeWordDiff, in plain (the default), color or porcelain mode, see
+// wordDiffStyles; --word-diff-regex tells what a word is instead of runs of
+// non-whitespace, eg: . compares character by character.
+//
+// -w, -b and --ignore-space-at-eol compare lines without all their
+// whitespace, the changes in its amount, or the one at their end, and
+// --ignore-blank-lines leaves out the changes made of blank lines only. With
+// color, the whitespace errors of the added lines are highlighted, or those
+// of the kinds of lines --ws-error-highlight tells, eg: old,new.
+func diffCmd(args []string) {
+	// everything after -- is a path
+	var paths []string
+	for i, arg := range args {
+		if arg == "--" {
+			paths = args[i+1:]
+			args = args[:i]
+			break
+		}
+	}
+
+	args, renameScore, findRenames := cutRenameScore(args)
+	flag := flag.NewFlagSet("git diff", flag.ContinueOnError)
+	var (
+		cached    = flag.Bool("cached", false, "compare the index with a commit, HEAD by default")
+		staged    = flag.Bool("staged", false, "same as --cached")
+		wordDiff  = &optionalString{value: "plain"}
+		wordRegex = flag.String("word-diff-regex", "", "what a word is, for --word-diff")
+		stat      = &optionalString{}
+		shortStat = flag.Bool("shortstat", false, "only show the number of changed files, insertions and deletions")
+		numStat   = flag.Bool("numstat", false, "show the number of added and deleted lines of each file, for scripts")
+
+		ignoreAllSpace    = flag.Bool("ignore-all-space", false, "ignore whitespace when comparing lines")
+		ignoreSpaceChange = flag.Bool("ignore-space-change", false, "ignore changes in amount of whitespace")
+		ignoreSpaceAtEOL  = flag.Bool("ignore-space-at-eol", false, "ignore changes in whitespace at EOL")
+		ignoreBlankLines  = flag.Bool("ignore-blank-lines", false, "ignore changes whose lines are all blank")
+		noIndex           = flag.Bool("no-index", false, "compare two paths on the filesystem, outside of any repository")
+		wsHighlight       = flag.String("ws-error-highlight", "", "highlight whitespace errors in the `<kind>` lines: context, old, new, all, none or default")
+	)
+	flag.BoolVar(ignoreAllSpace, "w", false, "same as --ignore-all-space")
+	flag.BoolVar(ignoreSpaceChange, "b", false, "same as --ignore-space-change")
+	flag.Var(wordDiff, "word-diff", "show the changed words, in `<mode>`: plain, color, porcelain or none")
+	flag.Var(stat, "stat", "show a diffstat instead of the patch, `<width>[,<name-width>]` of the lines")
+	color := colorFlag(flag, "color.diff")
+	colorGiven := false
+	for _, arg := range args {
+		if arg == "--no-color" || arg == "--color" || strings.HasPrefix(arg, "--color=") {
+			colorGiven = true
+		}
+	}
+	parsePagedFlags(flag, args)
+	args = flag.Args()
+	useColor = color()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		exit(128)
+	}
+
+	opts := &diffOptions{
+		blobs:             map[string][]byte{},
+		ignoreAllSpace:    *ignoreAllSpace,
+		ignoreSpaceChange: *ignoreSpaceChange,
+		ignoreSpaceAtEOL:  *ignoreSpaceAtEOL,
+		ignoreBlankLines:  *ignoreBlankLines,
+	}
+	if *wsHighlight == "" {
+		*wsHighlight, _ = configGet("diff.wsErrorHighlight")
+	}
+	kinds, err := parseWsErrorHighlight(*wsHighlight)
+	if err != nil {
+		fail(err)
+	}
+	opts.wsHighlight = kinds
+	minimumScore, err := parseRenameScore(renameScore)
+	if err != nil {
+		fail(err)
+	}
+	if wordDiff.set || *wordRegex != "" {
+		if _, ok := wordDiffStyles[wordDiff.value]; !ok && wordDiff.value != "none" {
+			fail(fmt.Errorf("bad --word-diff argument: %s", wordDiff.value))
+		}
+		if wordDiff.value != "none" {
+			opts.wordDiff = wordDiff.value
+		}
+		// like git, color implies --color, unless told otherwise
+		if wordDiff.value == "color" {
+			useColor = color() || !colorGiven
+		}
+	}
+	if *wordRegex != "" {
+		re, err := regexp.Compile(*wordRegex)
+		if err != nil {
+			fail(fmt.Errorf("invalid regular expression: %s", *wordRegex))
+		}
+		opts.wordRegex = re
+	}
+
+	if *noIndex || impliesNoIndex(append(args, paths...)) {
+		changes, err := diffNoIndex(append(args, paths...), opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			exit(1)
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		err = writeChanges(out, changes, nil, opts, stat, *shortStat, *numStat)
+		out.Flush()
+		if err != nil {
+			fail(err)
+		}
+		// like diff, the exit code tells whether the files differ
+		if len(changes) > 0 {
+			exit(1)
+		}
+		return
+	}
+
+	pathsGiven := paths != nil
+	var revisions []string
+	for _, arg := range args {
+		if from, to, ok := strings.Cut(arg, ".."); ok && from != "" && to != "" {
+			revisions = append(revisions, from, to)
+			continue
+		}
+		revisions = append(revisions, arg)
+	}
+
+	var trees []string
+	for _, arg := range revisions {
+		tree, err := resolveTree(arg)
+		if err != nil {
+			// like git, a file that isn't a revision is a path
+			if _, statErr := os.Stat(arg); statErr == nil && !pathsGiven {
+				paths = append(paths, arg)
+				continue
+			}
+			fail(err)
+		}
+		trees = append(trees, tree)
+	}
+	for i, path := range paths {
+		paths[i] = cleanPath(path)
+	}
+
+	var changes []treeChange
+	switch {
+	case len(trees) > 2 || len(trees) == 2 && (*cached || *staged):
+		fmt.Fprintln(os.Stderr, "usage: git diff [--cached] [--stat[=<width>[,<name-width>]] | --shortstat] [--numstat] [-M[<n>]] [--word-diff[=<mode>]] [--word-diff-regex=<regex>] [<commit> [<commit>]] [[--] <path>...]")
+		exit(129)
+
+	case len(trees) == 2:
+		changes, err = diffTrees(trees[0], trees[1], true)
+
+	default:
+		idx, err := readIndex()
+		if err != nil {
+			fail(fmt.Errorf("unable to read the index: %s", err))
+		}
+
+		var old, new map[string]treeEntry
+		if *cached || *staged {
+			new = indexFiles(idx)
+		} else if bareRepository {
+			fail(fmt.Errorf("this operation must be run in a work tree"))
+		} else if new, err = workTreeFiles(idx, opts); err != nil {
+			fail(err)
+		}
+
+		switch {
+		case len(trees) == 1:
+			old, err = flattenTree(trees[0])
+		case *cached || *staged:
+			// before the first commit, everything in the index is new
+			old = map[string]treeEntry{}
+			if tree, headErr := resolveTree("HEAD"); headErr == nil {
+				old, err = flattenTree(tree)
+			}
+		default:
+			old = indexFiles(idx)
+		}
+		if err != nil {
+			fail(err)
+		}
+		changes = diffFiles(old, new)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if findRenames {
+		if changes, err = detectRenames(changes, minimumScore, opts, nil); err != nil {
+			fail(err)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	err = writeChanges(out, changes, paths, opts, stat, *shortStat, *numStat)
+	out.Flush()
+	if err != nil {
+		fail(err)
+	}
+}
+
+// writeChanges writes the changes under paths the way diff shows them: as
+// patches, or as a diffstat with --stat and --shortstat, after the counts of
+// --numstat.
+func writeChanges(w io.Writer, changes []treeChange, paths []string, opts *diffOptions, stat *optionalString, shortStat bool, numStat bool) error {
+	if stat.set || shortStat || numStat {
+		width, nameWidth, err := parseStatWidths(stat.value)
+		if err != nil {
+			return err
+		}
+
+		var stats []fileStat
+		for _, change := range changes {
+			if !touchesPath(change, paths) {
+				continue
+			}
+			s, err := statChange(change, opts)
+			if err != nil {
+				return err
+			}
+			stats = append(stats, s)
+		}
+
+		if numStat {
+			writeNumStat(w, stats)
+		}
+		if stat.set {
+			writeDiffStat(w, stats, width, nameWidth)
+		} else if shortStat {
+			writeStatSummary(w, stats)
+		}
+		return nil
+	}
+
+	for _, change := range changes {
+		if !touchesPath(change, paths) {
+			continue
+		}
+		if err := writePatch(w, change, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// fileStat is how many lines a change adds and deletes. For a binary file,
+// they are the sizes of the new and old content instead.
+type fileStat struct {
+	path           string
+	added, deleted int
+	binary         bool
+}
+
+// statChange counts the lines a change adds and deletes, the way its patch
+// would show them, see writePatch.
+func statChange(change treeChange, opts *diffOptions) (fileStat, error) {
+	stat := fileStat{path: change.path}
+	if change.oldPath != "" && change.oldPath != change.path {
+		stat.path = renameName(change.oldPath, change.path)
+	}
+	if change.old.mode == modeSubmodule || change.new.mode == modeSubmodule {
+		if change.old.sha != "" {
+			stat.deleted = 1
+		}
+		if change.new.sha != "" {
+			stat.added = 1
+		}
+		return stat, nil
+	}
+
+	oldContent, err := opts.readBlob(change.old.sha)
+	if err != nil {
+		return stat, err
+	}
+	newContent, err := opts.readBlob(change.new.sha)
+	if err != nil {
+		return stat, err
+	}
+
+	if isBinary(oldContent) || isBinary(newContent) {
+		stat.binary = true
+		stat.added, stat.deleted = len(newContent), len(oldContent)
+		return stat, nil
+	}
+
+	removed, added := diffLinesBy(splitLines(oldContent), splitLines(newContent), opts.lineKey())
+	for _, r := range removed {
+		if r {
+			stat.deleted++
+		}
+	}
+	for _, a := range added {
+		if a {
+			stat.added++
+		}
+	}
+	return stat, nil
+}
+
+// renameName is how a diffstat names a file whose path changed, with the
+// directories both paths start and end with outside of braces, like git:
+//
+//	cmd/{mygit => git}/diff.go
+func renameName(oldPath string, newPath string) string {
+	prefix := 0
+	for i := 0; i < len(oldPath) && i < len(newPath) && oldPath[i] == newPath[i]; i++ {
+		if oldPath[i] == '/' {
+			prefix = i + 1
+		}
+	}
+
+	suffix := 0
+	for i, j := len(oldPath)-1, len(newPath)-1; i > prefix && j > prefix && oldPath[i] == newPath[j]; i, j = i-1, j-1 {
+		if oldPath[i] == '/' {
+			suffix = len(oldPath) - i
+		}
+	}
+
+	if prefix+suffix == 0 {
+		return oldPath + " => " + newPath
+	}
+	return oldPath[:prefix] + "{" + oldPath[prefix:max(len(oldPath)-suffix, prefix)] + " => " +
+		newPath[prefix:max(len(newPath)-suffix, prefix)] + "}" + oldPath[len(oldPath)-suffix:]
+}
+
+// parseStatWidths parses the value of --stat=<width>[,<name-width>], 0
+// being the default for either.
+func parseStatWidths(value string) (int, int, error) {
+	var widths [2]int
+	for i, field := range strings.SplitN(value, ",", 2) {
+		if field == "" {
+			continue
+		}
+		width, err := strconv.Atoi(field)
+		if err != nil || width < 0 {
+			return 0, 0, fmt.Errorf("invalid --stat value: %s", value)
+		}
+		widths[i] = width
+	}
+	return widths[0], widths[1], nil
+}
+
+// writeDiffStat writes a line per file with its number of changed lines
+// and a graph of them, then the summary, see writeStatSummary:
+//
+//	cmd/mygit/diff.go | 12 +++++++-----
+//	logo.png          | Bin 1024 -> 2048 bytes
+//	2 files changed, 7 insertions(+), 5 deletions(-)
+//
+// The lines fit in width columns, the terminal's by default, and the names
+// in nameWidth, by default whatever the graph leaves. Like git, a name too
+// long is cut from the start, eg: .../diff.go, and the graph is scaled
+// down when the largest change doesn't fit.
+func writeDiffStat(w io.Writer, stats []fileStat, width int, nameWidth int) {
+	if len(stats) == 0 {
+		return
+	}
+	if width == 0 {
+		width = terminalWidth()
+	}
+
+	maxLen, maxChange, numberWidth, binWidth := 0, 0, 0, 0
+	for _, stat := range stats {
+		maxLen = max(maxLen, len(stat.path))
+		if stat.binary {
+			// "Bin <deleted> -> <added> bytes", with the counts aligned with Bin
+			binWidth = max(binWidth, 14+len(strconv.Itoa(stat.added))+len(strconv.Itoa(stat.deleted)))
+			numberWidth = 3
+			continue
+		}
+		maxChange = max(maxChange, stat.added+stat.deleted)
+	}
+	numberWidth = max(numberWidth, len(strconv.Itoa(maxChange)))
+
+	// room for the name, " | ", the number, a space and the graph
+	width = max(width, 16+6+numberWidth)
+	graphWidth := maxChange
+	if maxChange+4 <= binWidth {
+		graphWidth = binWidth - 4
+	}
+	if nameWidth == 0 || nameWidth > maxLen {
+		nameWidth = maxLen
+	}
+	if nameWidth+numberWidth+6+graphWidth > width {
+		if graphWidth > width*3/8-numberWidth-6 {
+			graphWidth = max(width*3/8-numberWidth-6, 6)
+		}
+		if nameWidth > width-numberWidth-6-graphWidth {
+			nameWidth = width - numberWidth - 6 - graphWidth
+		} else {
+			graphWidth = width - numberWidth - 6 - nameWidth
+		}
+	}
+
+	scale := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		return 1 + n*(graphWidth-1)/maxChange
+	}
+
+	for _, stat := range stats {
+		name := stat.path
+		if len(name) > nameWidth {
+			keep := max(nameWidth-3, 0)
+			name = name[len(name)-keep:]
+			if slash := strings.Index(name, "/"); slash >= 0 {
+				name = name[slash:]
+			}
+			name = "..." + name
+		}
+		fmt.Fprintf(w, " %-*s | ", nameWidth, name)
+
+		if stat.binary {
+			if stat.added == 0 && stat.deleted == 0 {
+				fmt.Fprintf(w, "%*s\n", numberWidth, "Bin")
+				continue
+			}
+			fmt.Fprintf(w, "%*s %s -> %s bytes\n", numberWidth, "Bin",
+				colored(colorRed, strconv.Itoa(stat.deleted)), colored(colorGreen, strconv.Itoa(stat.added)))
+			continue
+		}
+
+		added, deleted := stat.added, stat.deleted
+		if graphWidth <= maxChange {
+			total := scale(added + deleted)
+			if total < 2 && added > 0 && deleted > 0 {
+				total = 2
+			}
+			if added < deleted {
+				added = scale(added)
+				deleted = total - added
+			} else {
+				deleted = scale(deleted)
+				added = total - deleted
+			}
+		}
+
+		fmt.Fprintf(w, "%*d", numberWidth, stat.added+stat.deleted)
+		if stat.added+stat.deleted > 0 {
+			io.WriteString(w, " ")
+		}
+		if added > 0 {
+			io.WriteString(w, colored(colorGreen, strings.Repeat("+", added)))
+		}
+		if deleted > 0 {
+			io.WriteString(w, colored(colorRed, strings.Repeat("-", deleted)))
+		}
+		io.WriteString(w, "\n")
+	}
+	writeStatSummary(w, stats)
+}
+
+// writeNumStat writes the stats the way --numstat does, for scripts:
+//
+//	<added>\t<deleted>\t<path>
+//
+// A binary file has no lines to count, so it shows - for both.
+func writeNumStat(w io.Writer, stats []fileStat) {
+	for _, stat := range stats {
+		if stat.binary {
+			fmt.Fprintf(w, "-\t-\t%s\n", stat.path)
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\n", stat.added, stat.deleted, stat.path)
+	}
+}
+
+// writeStatSummary writes the totals of the stats, what --shortstat shows:
+//
+//	2 files changed, 7 insertions(+), 5 deletions(-)
+//
+// Like git, insertions and deletions are only left out when there are none
+// while the other isn't.
+func writeStatSummary(w io.Writer, stats []fileStat) {
+	if len(stats) == 0 {
+		return
+	}
+
+	insertions, deletions := 0, 0
+	for _, stat := range stats {
+		if !stat.binary {
+			insertions += stat.added
+			deletions += stat.deleted
+		}
+	}
+
+	plural := func(n int, singular string, several string) string {
+		if n == 1 {
+			return fmt.Sprintf(singular, n)
+		}
+		return fmt.Sprintf(several, n)
+	}
+	summary := plural(len(stats), " %d file changed", " %d files changed")
+	if insertions > 0 || deletions == 0 {
+		summary += plural(insertions, ", %d insertion(+)", ", %d insertions(+)")
+	}
+	if deletions > 0 || insertions == 0 {
+		summary += plural(deletions, ", %d deletion(-)", ", %d deletions(-)")
+	}
+	fmt.Fprintln(w, summary)
+}
+
+// writeSummary writes what --summary shows, the files created, deleted,
+// renamed or whose mode changed, each line starting with a space:
+//
+//	create mode 100644 <path>
+//	delete mode 100644 <path>
+//	mode change 100644 => 100755 <path>
+//	rename <old> => <new> (<similarity>%)
+func writeSummary(w io.Writer, changes []treeChange) {
+	for _, change := range changes {
+		switch {
+		case change.status == 'A':
+			fmt.Fprintf(w, " create mode %s %s\n", change.new.mode, change.path)
+		case change.status == 'D':
+			fmt.Fprintf(w, " delete mode %s %s\n", change.old.mode, change.path)
+		case change.status == 'R':
+			fmt.Fprintf(w, " rename %s (%d%%)\n", renameName(change.oldPath, change.path), change.score*100/maxScore)
+		case change.old.mode != change.new.mode:
+			fmt.Fprintf(w, " mode change %s => %s %s\n", change.old.mode, change.new.mode, change.path)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testStatChanges counts the lines of a small change, the way git does:
+// a file modified, a binary one, and one added.
+func testStatChanges(t *testing.T) []fileStat {
+	t.Helper()
+	blob := func(content string) treeEntry {
+		sha, err := writeObject("blob", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return treeEntry{mode: "100644", sha: sha}
+	}
+	changes := []treeChange{
+		{status: 'M', path: "a.txt", old: blob("one\ntwo\nthree\nfour\n"), new: blob("one\n2\nthree\nfour\nfive\nsix\n")},
+		{status: 'M', path: "bin.dat", old: blob("x\x00y"), new: blob("x\x00yz")},
+		{status: 'A', path: "new.txt", new: blob("new\n")},
+	}
+
+	var stats []fileStat
+	for _, change := range changes {
+		stat, err := statChange(change, &diffOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func TestStatChange(t *testing.T) {
+	testRepository(t)
+	got := testStatChanges(t)
+	want := []fileStat{
+		{path: "a.txt", added: 3, deleted: 1},
+		{path: "bin.dat", added: 4, deleted: 3, binary: true},
+		{path: "new.txt", added: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteNumStat(t *testing.T) {
+	testRepository(t)
+	var out bytes.Buffer
+	writeNumStat(&out, testStatChanges(t))
+	want := "3\t1\ta.txt\n-\t-\tbin.dat\n1\t0\tnew.txt\n"
+	if out.String() != want {
+		t.Errorf("got\n%q\nwant\n%q", out.String(), want)
+	}
+}
+
+func TestWriteDiffStat(t *testing.T) {
+	testRepository(t)
+	var out bytes.Buffer
+	writeDiffStat(&out, testStatChanges(t), 80, 0)
+	want := " a.txt   |   4 +++-\n" +
+		" bin.dat | Bin 3 -> 4 bytes\n" +
+		" new.txt |   1 +\n" +
+		" 3 files changed, 4 insertions(+), 1 deletion(-)\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// treeChange is a single difference between two trees. The side that
+// doesn't exist is the zero treeEntry. oldPath is only set when the old
+// side has another path, eg: the files compared by diff --no-index, or the
+// source of a rename (R), whose similarity is score, see detectRenames.
+type treeChange struct {
+	status   byte
+	path     string
+	oldPath  string
+	old, new treeEntry
+	score    int
+}
+
+const nullSha = "0000000000000000000000000000000000000000"
+
+// fullMode returns the mode as git prints it in diffs, with 6 digits.
+func fullMode(mode string) string {
+	if mode == "" {
+		return "000000"
+	}
+	return strings.Repeat("0", 6-len(mode)) + mode
+}
+
+// modeKind tells files, symlinks, submodules and trees apart, a change of
+// kind is reported as T instead of M.
+func modeKind(mode string) string {
+	switch mode {
+	case modeFile, modeExecutable:
+		return "file"
+	default:
+		return mode
+	}
+}
+
+// diffTrees compares two trees and returns the changes, ordered by path.
+// Either sha can be empty to compare against the empty tree.
+//
+// When recursive is false, a changed subtree is reported as one M entry and
+// added or removed subtrees aren't descended into either.
+func diffTrees(a string, b string, recursive bool) ([]treeChange, error) {
+	var changes []treeChange
+
+	read := func(sha string) ([]treeEntry, error) {
+		if sha == "" {
+			return nil, nil
+		}
+		entries, err := readTree(sha)
+		sortTreeEntries(entries)
+		return entries, err
+	}
+
+	var walk func(a, b, prefix string) error
+	walk = func(a, b, prefix string) error {
+		oldEntries, err := read(a)
+		if err != nil {
+			return err
+		}
+		newEntries, err := read(b)
+		if err != nil {
+			return err
+		}
+
+		// a side only exists as a whole, so descend into it with nothing on
+		// the other side
+		added := func(entry treeEntry) error {
+			if entry.isTree() && recursive {
+				return walk("", entry.sha, prefix+entry.name+"/")
+			}
+			changes = append(changes, treeChange{status: 'A', path: prefix + entry.name, new: entry})
+			return nil
+		}
+		deleted := func(entry treeEntry) error {
+			if entry.isTree() && recursive {
+				return walk(entry.sha, "", prefix+entry.name+"/")
+			}
+			changes = append(changes, treeChange{status: 'D', path: prefix + entry.name, old: entry})
+			return nil
+		}
+
+		// both lists are in tree order, where a directory sorts as "name/",
+		// so a file replaced by a directory shows up as a delete and an add
+		key := func(e treeEntry) string {
+			if e.isTree() {
+				return e.name + "/"
+			}
+			return e.name
+		}
+
+		i, j := 0, 0
+		for i < len(oldEntries) || j < len(newEntries) {
+			switch {
+			case j == len(newEntries) || (i < len(oldEntries) && key(oldEntries[i]) < key(newEntries[j])):
+				err = deleted(oldEntries[i])
+				i++
+
+			case i == len(oldEntries) || key(oldEntries[i]) > key(newEntries[j]):
+				err = added(newEntries[j])
+				j++
+
+			default:
+				old, new := oldEntries[i], newEntries[j]
+				i++
+				j++
+
+				if old.sha == new.sha && old.mode == new.mode {
+					continue
+				}
+				if old.isTree() && recursive {
+					err = walk(old.sha, new.sha, prefix+old.name+"/")
+					break
+				}
+
+				status := byte('M')
+				if modeKind(old.mode) != modeKind(new.mode) {
+					status = 'T'
+				}
+				changes = append(changes, treeChange{status: status, path: prefix + old.name, old: old, new: new})
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return changes, walk(a, b, "")
+}
+
+// resolveTree turns a revision into a tree: a tree is used as is, commits
+// and tags pointing at commits give their tree.
+func resolveTree(name string) (string, error) {
+	sha, err := resolveRevision(name)
+	if err != nil {
+		return "", err
+	}
+
+	sha, objectType, err := peelTag(sha)
+	if err != nil {
+		return "", err
+	}
+
+	switch objectType {
+	case "tree":
+		return sha, nil
+	case "commit":
+		c, err := readCommit(sha)
+		if err != nil {
+			return "", err
+		}
+		return c.tree, nil
+	default:
+		return "", fmt.Errorf("'%s' is a %s, not a tree", name, objectType)
+	}
+}
+
+// formatStatus formats the status and the path of a change, the way
+// --name-status prints them, a rename with its score and both paths:
+//
+//	<status>\t<path>
+//	R<score>\t<old path>\t<new path>
+func formatStatus(change treeChange) string {
+	if change.status == 'R' {
+		return fmt.Sprintf("R%03d\t%s\t%s", change.score*100/maxScore, change.oldPath, change.path)
+	}
+	return fmt.Sprintf("%c\t%s", change.status, change.path)
+}
+
+// formatRawChange formats a change the way `git diff-tree` prints it, with
+// the shas abbreviated to 7 characters with abbrev:
+//
+//	:<old mode> <new mode> <old sha> <new sha> <status>\t<path>
+//
+// see formatStatus for the status and the path.
+func formatRawChange(change treeChange, abbrev bool) string {
+	oldSha, newSha := change.old.sha, change.new.sha
+	if oldSha == "" {
+		oldSha = nullSha
+	}
+	if newSha == "" {
+		newSha = nullSha
+	}
+	if abbrev {
+		oldSha, newSha = oldSha[:7], newSha[:7]
+	}
+
+	return fmt.Sprintf(":%s %s %s %s %s", fullMode(change.old.mode), fullMode(change.new.mode), oldSha, newSha, formatStatus(change))
+}
+
+// diffTree implements `git diff-tree [-r] [--name-status] [-M[<n>]] <tree-ish> [<tree-ish>]`
+//
+// It compares two trees, or a commit with its first parent, and prints the
+// added (A), deleted (D), modified (M) and type changed (T) paths in the raw
+// format. Without -r, subtrees are compared as a whole.
+//
+// With a single commit, its sha is printed first; a root commit is compared
+// against the empty tree.
+//
+// -M, or --find-renames, pairs the deleted and added files whose content is
+// at least 50% similar, or the score -M<n> gives, into renames, see
+// detectRenames:
+//
+//	:100644 100644 <old sha> <new sha> R100\tparser.go\tparse/parser.go
+func diffTree(args []string) {
+	args, renameScore, findRenames := cutRenameScore(args)
+	flag := flag.NewFlagSet("git diff-tree", flag.ExitOnError)
+	var (
+		recursive  = flag.Bool("r", false, "recurse into subtrees")
+		nameStatus = flag.Bool("name-status", false, "only show the status and path of each change")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: git diff-tree [-r] [--name-status] [-M[<n>]] <tree-ish> [<tree-ish>]")
+		os.Exit(1)
+	}
+
+	minimumScore, err := parseRenameScore(renameScore)
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	var a, b string
+	if len(args) == 2 {
+		a, err = resolveTree(args[0])
+		if err == nil {
+			b, err = resolveTree(args[1])
+		}
+	} else {
+		var sha string
+		var c *commit
+		sha, err = resolveRevision(args[0])
+		if err == nil {
+			sha, _, err = peelTag(sha)
+		}
+		if err == nil {
+			c, err = readCommit(sha)
+		}
+		if err == nil {
+			fmt.Println(sha)
+			b = c.tree
+			if len(c.parents) > 0 {
+				a, err = resolveTree(c.parents[0])
+			}
+		}
+	}
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	changes, err := diffTrees(a, b, *recursive)
+	if err != nil {
+		error := fmt.Sprintf("Failed to compare trees: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+	if findRenames {
+		if changes, err = detectRenames(changes, minimumScore, &diffOptions{}, nil); err != nil {
+			error := fmt.Sprintf("fatal: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+	}
+
+	for _, change := range changes {
+		if *nameStatus {
+			fmt.Println(formatStatus(change))
+		} else {
+			fmt.Println(formatRawChange(change, false))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// editorCommand figures out which editor to use, in git's order of
+// precedence:
+//
+//	$GIT_EDITOR, [core] editor, $VISUAL, $EDITOR, vi
+func editorCommand() string {
+	if editor, ok := os.LookupEnv("GIT_EDITOR"); ok {
+		return editor
+	}
+	if editor, ok := configGet("core.editor"); ok {
+		return editor
+	}
+	if editor, ok := os.LookupEnv("VISUAL"); ok && os.Getenv("TERM") != "dumb" {
+		return editor
+	}
+	if editor, ok := os.LookupEnv("EDITOR"); ok {
+		return editor
+	}
+	return "vi"
+}
+
+// launchEditor lets the user edit a file and waits for the editor to exit.
+//
+// Like the pager, the editor is started through `sh -c` so it can contain
+// arguments; the absolute path of the file is added after them. The editor
+// ":" leaves the file as it is.
+func launchEditor(path string) error {
+	editor := editorCommand()
+	if editor == ":" {
+		return nil
+	}
+	if editor == "vi" && os.Getenv("TERM") == "dumb" {
+		return fmt.Errorf("terminal is dumb, but EDITOR unset")
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	trace("run editor %s", editor)
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s'", editor)
+	}
+	return nil
+}
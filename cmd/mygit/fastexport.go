@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fastExport holds the state of a running export.
+type fastExport struct {
+	out           *bufio.Writer
+	marks         map[string]int
+	lastMark      int
+	signedTags    string
+	tagOfFiltered string
+}
+
+// mark assigns the next mark to an object.
+func (fe *fastExport) mark(sha string) int {
+	fe.lastMark++
+	fe.marks[sha] = fe.lastMark
+	return fe.lastMark
+}
+
+// reference returns how the stream refers to an object: by its mark when it
+// was exported, by its sha otherwise.
+func (fe *fastExport) reference(sha string) string {
+	if mark, ok := fe.marks[sha]; ok {
+		return fmt.Sprintf(":%d", mark)
+	}
+	return sha
+}
+
+// data writes `data <count>` followed by the raw bytes.
+func (fe *fastExport) data(content []byte) {
+	fmt.Fprintf(fe.out, "data %d\n", len(content))
+	fe.out.Write(content)
+	fe.out.WriteString("\n")
+}
+
+// quotePath quotes a path the way fast-import expects when it has
+// characters that would be ambiguous on a command line.
+func quotePath(path string) string {
+	if strings.ContainsAny(path, "\"\\\n") {
+		return strconv.Quote(path)
+	}
+	return path
+}
+
+// commitFiles returns the files of a commit's tree, and of its first parent.
+// A root commit is compared against nothing.
+func commitFiles(c *commit) (map[string]treeEntry, map[string]treeEntry, error) {
+	files, err := flattenTree(c.tree)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parentFiles := map[string]treeEntry{}
+	if len(c.parents) > 0 {
+		parent, err := readCommit(c.parents[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		if parentFiles, err = flattenTree(parent.tree); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return files, parentFiles, nil
+}
+
+// commit writes a commit record, preceded by the blobs it introduces.
+func (fe *fastExport) commit(sha string, ref string, reset bool) error {
+	c, err := readCommit(sha)
+	if err != nil {
+		return err
+	}
+
+	files, parentFiles, err := commitFiles(c)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for path, entry := range files {
+		if parentFiles[path] != entry {
+			paths = append(paths, path)
+		}
+	}
+	for path := range parentFiles {
+		if _, ok := files[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		entry, ok := files[path]
+		if !ok || entry.mode == modeSubmodule {
+			continue
+		}
+		if _, exported := fe.marks[entry.sha]; exported {
+			continue
+		}
+
+		_, content, err := readObject(entry.sha)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(fe.out, "blob\nmark :%d\n", fe.mark(entry.sha))
+		fe.data(content)
+	}
+
+	if reset {
+		fmt.Fprintf(fe.out, "reset %s\n", ref)
+	}
+	fmt.Fprintf(fe.out, "commit %s\nmark :%d\n", ref, fe.mark(sha))
+	fmt.Fprintf(fe.out, "author %s\ncommitter %s\n", c.author, c.committer)
+	fmt.Fprintf(fe.out, "data %d\n%s", len(c.message), c.message)
+
+	for i, parent := range c.parents {
+		command := "merge"
+		if i == 0 {
+			command = "from"
+		}
+		fmt.Fprintf(fe.out, "%s %s\n", command, fe.reference(parent))
+	}
+
+	for _, path := range paths {
+		entry, ok := files[path]
+		if !ok {
+			fmt.Fprintf(fe.out, "D %s\n", quotePath(path))
+			continue
+		}
+		fmt.Fprintf(fe.out, "M %s %s %s\n", entry.mode, fe.reference(entry.sha), quotePath(path))
+	}
+	fe.out.WriteString("\n")
+
+	return nil
+}
+
+// stripSignature removes a trailing signature from a tag message, and
+// reports whether there was one.
+func stripSignature(message string) (string, bool) {
+	for _, marker := range []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN PGP MESSAGE-----", "-----BEGIN SSH SIGNATURE-----", "-----BEGIN SIGNED MESSAGE-----"} {
+		if strings.HasPrefix(message, marker) {
+			return "", true
+		}
+		if i := strings.Index(message, "\n"+marker); i >= 0 {
+			return message[:i+1], true
+		}
+	}
+	return message, false
+}
+
+// tag writes a tag record for an annotated tag, applying --signed-tags and
+// --tag-of-filtered-object.
+func (fe *fastExport) tag(r ref) error {
+	_, content, err := readObject(r.sha)
+	if err != nil {
+		return err
+	}
+	t, err := parseTag(content)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(r.name, "refs/tags/")
+
+	target := t.object
+	if _, exported := fe.marks[target]; !exported {
+		switch fe.tagOfFiltered {
+		case "drop":
+			return nil
+		case "rewrite":
+			target, err = fe.exportedAncestor(target)
+			if err != nil {
+				return err
+			}
+			if target == "" {
+				return nil
+			}
+		default:
+			return fmt.Errorf("tag %s tags unexported object; use --tag-of-filtered-object=<mode> to handle it", name)
+		}
+	}
+
+	message, signed := stripSignature(t.message)
+	if signed {
+		switch fe.signedTags {
+		case "verbatim":
+			message = t.message
+		case "warn":
+			fmt.Fprintf(os.Stderr, "warning: exporting signed tag %s\n", name)
+			message = t.message
+		case "warn-strip":
+			fmt.Fprintf(os.Stderr, "warning: stripping signature from tag %s\n", name)
+		case "strip":
+		default:
+			return fmt.Errorf("encountered signed tag %s; use --signed-tags=<mode> to handle it", name)
+		}
+	}
+
+	fmt.Fprintf(fe.out, "tag %s\nfrom %s\n", name, fe.reference(target))
+	if t.tagger != "" {
+		fmt.Fprintf(fe.out, "tagger %s\n", t.tagger)
+	}
+	fe.data([]byte(message))
+	return nil
+}
+
+// exportedAncestor returns the nearest ancestor of a commit that was
+// exported, following first parents. It's empty when there is none.
+func (fe *fastExport) exportedAncestor(sha string) (string, error) {
+	for {
+		if _, exported := fe.marks[sha]; exported {
+			return sha, nil
+		}
+
+		node, err := readCommitNode(sha)
+		if err != nil {
+			return "", err
+		}
+		if len(node.parents) == 0 {
+			return "", nil
+		}
+		sha = node.parents[0]
+	}
+}
+
+// exportMarks writes the mark table as `:<n> <sha>` lines.
+func (fe *fastExport) exportMarks(path string) error {
+	lines := make([]string, fe.lastMark)
+	for sha, mark := range fe.marks {
+		lines[mark-1] = fmt.Sprintf(":%d %s\n", mark, sha)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+}
+
+// fastExportCmd implements `git fast-export [--all] [<ref>|^<rev>|<rev>..<ref>]...`
+//
+// It writes the history of the given refs as a fast-import stream: a blob
+// record the first time an object is seen, a commit record with from/merge
+// parents and the file changes against the first parent, and a tag record
+// for each annotated tag. Parents are always written before their children.
+//
+// Commits reachable from an excluded revision aren't exported, their
+// children refer to them by sha instead of by mark. HEAD is exported as the
+// branch it's on, and a revision that isn't a ref under its own name, eg: a
+// sha.
+func fastExportCmd(args []string) {
+	flag := flag.NewFlagSet("git fast-export", flag.ExitOnError)
+	var (
+		all           = flag.Bool("all", false, "export all refs")
+		signedTags    = flag.String("signed-tags", "abort", "how to handle signed tags: verbatim, warn, warn-strip, strip or abort")
+		tagOfFiltered = flag.String("tag-of-filtered-object", "abort", "how to handle tags of unexported commits: abort, drop or rewrite")
+		exportMarks   = flag.String("export-marks", "", "write the mark table to `<file>` when done")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	var refs []ref
+	var excludes []string
+	if *all {
+		allRefs, err := listRefs()
+		if err != nil {
+			fail(err)
+		}
+		refs = allRefs
+	}
+	for _, arg := range args {
+		if from, to, isRange := strings.Cut(arg, ".."); isRange {
+			excludes = append(excludes, from)
+			arg = to
+		} else if exclude, found := strings.CutPrefix(arg, "^"); found {
+			excludes = append(excludes, exclude)
+			continue
+		}
+
+		var sha string
+		name, err := expandRefName(arg)
+		if err == nil {
+			// the commits of HEAD go on the branch it's on, like git
+			if target, symbolic, _ := readSymbolicRef(name); symbolic {
+				name = target
+			}
+			sha, err = readRef(name)
+		} else {
+			// like git, a revision that isn't a ref is used as the ref name
+			name = arg
+			sha, err = resolveRevision(arg)
+		}
+		if err != nil {
+			fail(err)
+		}
+		refs = append(refs, ref{name: name, sha: sha})
+	}
+
+	if len(refs) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git fast-export [--all] [<ref>|^<rev>|<rev>..<ref>]...")
+		os.Exit(1)
+	}
+
+	// the commit each ref points at, and the annotated tags to export after
+	// the commits
+	var starts []string
+	var annotated []ref
+	tips := map[string]string{}
+	for _, r := range refs {
+		sha, objectType, err := peelTag(r.sha)
+		if err != nil {
+			fail(err)
+		}
+		if objectType != "commit" {
+			fmt.Fprintf(os.Stderr, "warning: skipping %s, it doesn't point at a commit\n", r.name)
+			continue
+		}
+
+		starts = append(starts, sha)
+		if sha != r.sha {
+			annotated = append(annotated, r)
+		} else {
+			tips[r.name] = sha
+		}
+	}
+
+	excluded := map[string]bool{}
+	var excludeStarts []string
+	for _, exclude := range excludes {
+		sha, err := resolveRevision(exclude)
+		if err != nil {
+			fail(err)
+		}
+		if sha, _, err = peelTag(sha); err != nil {
+			fail(err)
+		}
+		excludeStarts = append(excludeStarts, sha)
+	}
+	err := walkCommits(excludeStarts, func(node *commitNode) bool {
+		excluded[node.sha] = true
+		return true
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	ordered, err := parentsFirst(starts, func(sha string) bool { return excluded[sha] })
+	if err != nil {
+		fail(err)
+	}
+	nodes := map[string]*commitNode{}
+	for _, node := range ordered {
+		nodes[node.sha] = node
+	}
+
+	// every commit is written on the first ref that reaches it
+	names := make([]string, 0, len(tips))
+	for name := range tips {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// commits only reachable from an annotated tag go on the tag's ref, the
+	// tag record replaces it afterwards
+	labelTips := make([]ref, 0, len(refs))
+	for _, name := range names {
+		labelTips = append(labelTips, ref{name: name, sha: tips[name]})
+	}
+	for _, r := range annotated {
+		sha, _, _ := peelTag(r.sha)
+		labelTips = append(labelTips, ref{name: r.name, sha: sha})
+	}
+
+	labels := map[string]string{}
+	for _, tip := range labelTips {
+		pending := []string{tip.sha}
+		for len(pending) > 0 {
+			sha := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			if labels[sha] != "" || nodes[sha] == nil {
+				continue
+			}
+			labels[sha] = tip.name
+			pending = append(pending, nodes[sha].parents...)
+		}
+	}
+
+	fe := &fastExport{
+		out:           bufio.NewWriter(os.Stdout),
+		marks:         map[string]int{},
+		signedTags:    *signedTags,
+		tagOfFiltered: *tagOfFiltered,
+	}
+
+	last := map[string]string{}
+	for _, node := range ordered {
+		sha := node.sha
+		ref := labels[sha]
+		root := len(node.parents) == 0
+		if err := fe.commit(sha, ref, root && last[ref] != ""); err != nil {
+			fail(err)
+		}
+		last[ref] = sha
+	}
+
+	for _, name := range names {
+		tip := tips[name]
+		if last[name] == tip {
+			continue
+		}
+		if _, exported := fe.marks[tip]; !exported {
+			continue
+		}
+		fmt.Fprintf(fe.out, "reset %s\nfrom %s\n\n", name, fe.reference(tip))
+	}
+
+	for _, r := range annotated {
+		if err := fe.tag(r); err != nil {
+			fe.out.Flush()
+			fail(err)
+		}
+	}
+
+	if err := fe.out.Flush(); err != nil {
+		fail(err)
+	}
+
+	if *exportMarks != "" {
+		if err := fe.exportMarks(*exportMarks); err != nil {
+			fail(err)
+		}
+	}
+}
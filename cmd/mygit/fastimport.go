@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fastImportBranch is the state of a branch while importing: its tip and
+// the files of that tip, which the next commit on the branch starts from.
+type fastImportBranch struct {
+	commit string
+	files  map[string]treeEntry
+}
+
+// fastImport holds the state of a running import.
+type fastImport struct {
+	in       *bufio.Reader
+	pushback *string
+	marks    map[string]string
+	branches map[string]*fastImportBranch
+	tags     map[string]string
+	counts   map[string]int
+}
+
+// readLine returns the next command line without its newline, skipping
+// comments. io.EOF is returned at the end of the stream.
+func (fi *fastImport) readLine() (string, error) {
+	if fi.pushback != nil {
+		line := *fi.pushback
+		fi.pushback = nil
+		return line, nil
+	}
+
+	for {
+		line, err := fi.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if !strings.HasPrefix(line, "#") {
+			return line, nil
+		}
+	}
+}
+
+// unreadLine hands the line back to the next readLine.
+func (fi *fastImport) unreadLine(line string) {
+	fi.pushback = &line
+}
+
+// optional reads the next line and returns its argument if it's the given
+// command, eg: `mark :1`. Otherwise the line is handed back.
+func (fi *fastImport) optional(command string) (string, bool, error) {
+	line, err := fi.readLine()
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if argument, found := strings.CutPrefix(line, command+" "); found {
+		return argument, true, nil
+	}
+	fi.unreadLine(line)
+	return "", false, nil
+}
+
+// readData reads a `data <count>` command followed by exactly count bytes,
+// and an optional newline after them, or the delimited form, the lines up
+// to one that is the delimiter alone:
+//
+//	data <<EOF
+//	<lines, each with its newline>
+//	EOF
+func (fi *fastImport) readData() ([]byte, error) {
+	line, err := fi.readLine()
+	if err != nil {
+		return nil, fmt.Errorf("expected data: %s", err)
+	}
+
+	count, found := strings.CutPrefix(line, "data ")
+	if !found {
+		return nil, fmt.Errorf("expected data, got '%s'", line)
+	}
+
+	if delimiter, delimited := strings.CutPrefix(count, "<<"); delimited {
+		var data []byte
+		for {
+			line, err := fi.in.ReadString('\n')
+			if strings.TrimSuffix(line, "\n") == delimiter && (err == nil || line != "") {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("EOF in data (terminator '%s' not found)", delimiter)
+			}
+			data = append(data, line...)
+		}
+
+		if next, err := fi.in.Peek(1); err == nil && next[0] == '\n' {
+			fi.in.ReadByte()
+		}
+		return data, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad data count '%s'", count)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(fi.in, data); err != nil {
+		return nil, fmt.Errorf("truncated data: %s", err)
+	}
+
+	if next, err := fi.in.Peek(1); err == nil && next[0] == '\n' {
+		fi.in.ReadByte()
+	}
+	return data, nil
+}
+
+// resolve turns a `from`/`merge`/dataref argument into a sha: a mark (:N),
+// a full sha, a branch of this import, or an existing ref in the repository.
+func (fi *fastImport) resolve(name string) (string, error) {
+	if strings.HasPrefix(name, ":") {
+		sha, ok := fi.marks[name]
+		if !ok {
+			return "", fmt.Errorf("mark %s not declared", name)
+		}
+		return sha, nil
+	}
+
+	if branch, ok := fi.branches[name]; ok && branch.commit != "" {
+		return branch.commit, nil
+	}
+
+	return resolveRevision(name)
+}
+
+// mark records the sha for a `mark :N` command.
+func (fi *fastImport) mark(mark string, sha string) {
+	if mark != "" {
+		fi.marks[mark] = sha
+	}
+}
+
+// branch returns the state of a branch, loading the tip of an existing ref
+// when the import hasn't touched the branch yet.
+func (fi *fastImport) branch(name string) (*fastImportBranch, error) {
+	if branch, ok := fi.branches[name]; ok {
+		return branch, nil
+	}
+
+	branch := &fastImportBranch{files: map[string]treeEntry{}}
+	if sha, err := readRef(name); err == nil {
+		if err := branch.reset(sha); err != nil {
+			return nil, err
+		}
+	}
+
+	fi.branches[name] = branch
+	return branch, nil
+}
+
+// reset moves a branch to a commit and loads its files.
+func (b *fastImportBranch) reset(sha string) error {
+	c, err := readCommit(sha)
+	if err != nil {
+		return err
+	}
+
+	files, err := flattenTree(c.tree)
+	if err != nil {
+		return err
+	}
+
+	b.commit = sha
+	b.files = files
+	return nil
+}
+
+// blob handles:
+//
+//	blob
+//	mark :<n>?
+//	data (<count> | <<<delimiter>)
+func (fi *fastImport) blob() error {
+	mark, _, err := fi.optional("mark")
+	if err != nil {
+		return err
+	}
+	if _, _, err := fi.optional("original-oid"); err != nil {
+		return err
+	}
+
+	data, err := fi.readData()
+	if err != nil {
+		return err
+	}
+
+	sha, err := writeObject("blob", data)
+	if err != nil {
+		return err
+	}
+
+	fi.mark(mark, sha)
+	fi.counts["blob"]++
+	return nil
+}
+
+// commit handles:
+//
+//	commit <ref>
+//	mark :<n>?
+//	author <ident>?
+//	committer <ident>
+//	data (<count> | <<<delimiter>)
+//	from <commit-ish>?
+//	merge <commit-ish>*
+//	(M <mode> <dataref> <path> | D <path> | C <src> <dst> | R <src> <dst> | deleteall)*
+func (fi *fastImport) commit(ref string) error {
+	branch, err := fi.branch(ref)
+	if err != nil {
+		return err
+	}
+
+	mark, _, err := fi.optional("mark")
+	if err != nil {
+		return err
+	}
+	if _, _, err := fi.optional("original-oid"); err != nil {
+		return err
+	}
+	author, _, err := fi.optional("author")
+	if err != nil {
+		return err
+	}
+	committer, found, err := fi.optional("committer")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("expected committer in commit %s", ref)
+	}
+	if author == "" {
+		author = committer
+	}
+	if _, _, err := fi.optional("encoding"); err != nil {
+		return err
+	}
+
+	message, err := fi.readData()
+	if err != nil {
+		return err
+	}
+
+	var parents []string
+	if from, found, err := fi.optional("from"); err != nil {
+		return err
+	} else if found {
+		sha, err := fi.resolve(from)
+		if err != nil {
+			return err
+		}
+		if err := branch.reset(sha); err != nil {
+			return err
+		}
+	}
+	if branch.commit != "" {
+		parents = append(parents, branch.commit)
+	}
+
+	for {
+		merge, found, err := fi.optional("merge")
+		if err != nil {
+			return err
+		}
+		if !found {
+			break
+		}
+
+		sha, err := fi.resolve(merge)
+		if err != nil {
+			return err
+		}
+		parents = append(parents, sha)
+	}
+
+	if err := fi.fileChanges(branch.files); err != nil {
+		return err
+	}
+
+	tree, err := writeTreeFromFiles(branch.files)
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "tree %s\n", tree)
+	for _, parent := range parents {
+		fmt.Fprintf(&content, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&content, "author %s\ncommitter %s\n\n%s", author, committer, message)
+
+	sha, err := writeObject("commit", []byte(content.String()))
+	if err != nil {
+		return err
+	}
+
+	branch.commit = sha
+	fi.mark(mark, sha)
+	fi.counts["commit"]++
+	return nil
+}
+
+// fileChanges applies the M/D/C/R/deleteall commands of a commit to files.
+func (fi *fastImport) fileChanges(files map[string]treeEntry) error {
+	for {
+		line, err := fi.readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		command, arguments, _ := strings.Cut(line, " ")
+		switch command {
+		case "M":
+			fields := strings.SplitN(arguments, " ", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("bad filemodify '%s'", line)
+			}
+
+			mode, ok := map[string]string{
+				"644": modeFile, "100644": modeFile,
+				"755": modeExecutable, "100755": modeExecutable,
+				"120000": modeSymlink, "160000": modeSubmodule,
+			}[fields[0]]
+			if !ok {
+				return fmt.Errorf("unsupported mode %s", fields[0])
+			}
+
+			var sha string
+			if fields[1] == "inline" {
+				data, err := fi.readData()
+				if err != nil {
+					return err
+				}
+				if sha, err = writeObject("blob", data); err != nil {
+					return err
+				}
+				fi.counts["blob"]++
+			} else if sha, err = fi.resolve(fields[1]); err != nil {
+				return err
+			}
+
+			files[unquotePath(fields[2])] = treeEntry{mode: mode, sha: sha}
+
+		case "D":
+			path := unquotePath(arguments)
+			delete(files, path)
+			for file := range files {
+				if strings.HasPrefix(file, path+"/") {
+					delete(files, file)
+				}
+			}
+
+		case "C", "R":
+			source, destination, err := splitPathPair(arguments)
+			if err != nil {
+				return err
+			}
+			for file, entry := range files {
+				if file == source || strings.HasPrefix(file, source+"/") {
+					files[destination+strings.TrimPrefix(file, source)] = entry
+					if command == "R" {
+						delete(files, file)
+					}
+				}
+			}
+
+		case "deleteall":
+			for file := range files {
+				delete(files, file)
+			}
+
+		case "":
+			// blank lines between commands are allowed
+
+		default:
+			fi.unreadLine(line)
+			return nil
+		}
+	}
+}
+
+// tag handles:
+//
+//	tag <name>
+//	mark :<n>?
+//	from <commit-ish>
+//	tagger <ident>?
+//	data (<count> | <<<delimiter>)
+func (fi *fastImport) tag(name string) error {
+	mark, _, err := fi.optional("mark")
+	if err != nil {
+		return err
+	}
+
+	from, found, err := fi.optional("from")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("expected from in tag %s", name)
+	}
+	object, err := fi.resolve(from)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := fi.optional("original-oid"); err != nil {
+		return err
+	}
+	tagger, _, err := fi.optional("tagger")
+	if err != nil {
+		return err
+	}
+
+	message, err := fi.readData()
+	if err != nil {
+		return err
+	}
+
+	objectType, _, err := readObject(object)
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "object %s\ntype %s\ntag %s\n", object, objectType, name)
+	if tagger != "" {
+		fmt.Fprintf(&content, "tagger %s\n", tagger)
+	}
+	fmt.Fprintf(&content, "\n%s", message)
+
+	sha, err := writeObject("tag", []byte(content.String()))
+	if err != nil {
+		return err
+	}
+
+	fi.tags["refs/tags/"+name] = sha
+	fi.mark(mark, sha)
+	fi.counts["tag"]++
+	return nil
+}
+
+// reset handles:
+//
+//	reset <ref>
+//	from <commit-ish>?
+//
+// Without a from, the next commit on the branch has no parent.
+func (fi *fastImport) reset(ref string) error {
+	branch := &fastImportBranch{files: map[string]treeEntry{}}
+	fi.branches[ref] = branch
+
+	from, found, err := fi.optional("from")
+	if err != nil || !found {
+		return err
+	}
+
+	sha, err := fi.resolve(from)
+	if err != nil {
+		return err
+	}
+	return branch.reset(sha)
+}
+
+// updateRefs points every branch and tag of the import at its new object.
+func (fi *fastImport) updateRefs() error {
+	for ref, branch := range fi.branches {
+		if branch.commit == "" {
+			continue
+		}
+		if err := updateRef(ref, branch.commit); err != nil {
+			return err
+		}
+	}
+
+	for ref, sha := range fi.tags {
+		if err := updateRef(ref, sha); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportMarks writes the mark table as `:<n> <sha>` lines.
+func (fi *fastImport) exportMarks(path string) error {
+	marks := make([]string, 0, len(fi.marks))
+	for mark := range fi.marks {
+		marks = append(marks, mark)
+	}
+	sort.Slice(marks, func(i, j int) bool {
+		a, _ := strconv.Atoi(marks[i][1:])
+		b, _ := strconv.Atoi(marks[j][1:])
+		return a < b
+	})
+
+	var content strings.Builder
+	for _, mark := range marks {
+		fmt.Fprintf(&content, "%s %s\n", mark, fi.marks[mark])
+	}
+	return os.WriteFile(path, []byte(content.String()), 0644)
+}
+
+// unquotePath handles the C-style quoting of paths with special characters.
+func unquotePath(path string) string {
+	if strings.HasPrefix(path, "\"") {
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			return unquoted
+		}
+	}
+	return path
+}
+
+// splitPathPair splits the `<src> <dst>` arguments of C and R, where the
+// source must be quoted if it contains a space.
+func splitPathPair(arguments string) (string, string, error) {
+	if strings.HasPrefix(arguments, "\"") {
+		source, err := strconv.QuotedPrefix(arguments)
+		if err != nil {
+			return "", "", fmt.Errorf("bad quoted path '%s'", arguments)
+		}
+		return unquotePath(source), unquotePath(strings.TrimPrefix(arguments[len(source):], " ")), nil
+	}
+
+	source, destination, found := strings.Cut(arguments, " ")
+	if !found {
+		return "", "", fmt.Errorf("missing destination in '%s'", arguments)
+	}
+	return source, unquotePath(destination), nil
+}
+
+// fastImportCmd implements `git fast-import [--export-marks=<file>]`
+//
+// It reads a fast-import stream from stdin, the format other VCS importers
+// produce, and creates the blobs, trees, commits and tags it describes.
+// Supported commands are blob, commit, tag, reset, checkpoint, progress and
+// done. Objects can be referred to by marks (:<n>), and the refs of the
+// imported branches and tags are updated at checkpoints and at the end.
+func fastImportCmd(args []string) {
+	flag := flag.NewFlagSet("git fast-import", flag.ExitOnError)
+	var (
+		exportMarks = flag.String("export-marks", "", "write the mark table to `<file>` when done")
+	)
+	flag.Parse(args)
+
+	fi := &fastImport{
+		in:       bufio.NewReaderSize(os.Stdin, 64*1024),
+		marks:    map[string]string{},
+		branches: map[string]*fastImportBranch{},
+		tags:     map[string]string{},
+		counts:   map[string]int{},
+	}
+
+	checkpoint := func() {
+		err := fi.updateRefs()
+		if err == nil && *exportMarks != "" {
+			err = fi.exportMarks(*exportMarks)
+		}
+		if err != nil {
+			error := fmt.Sprintf("Failed to update refs: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+	}
+
+	for {
+		line, err := fi.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			error := fmt.Sprintf("Failed to read stream: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+
+		command, argument, _ := strings.Cut(line, " ")
+		switch command {
+		case "blob":
+			err = fi.blob()
+		case "commit":
+			err = fi.commit(argument)
+		case "tag":
+			err = fi.tag(argument)
+		case "reset":
+			err = fi.reset(argument)
+		case "checkpoint":
+			checkpoint()
+		case "progress":
+			fmt.Println(line)
+		case "feature", "option", "":
+			// nothing to do for the features/options we support
+		case "done":
+			checkpoint()
+			fmt.Fprintf(os.Stderr, "Imported %d blobs, %d commits, %d tags\n", fi.counts["blob"], fi.counts["commit"], fi.counts["tag"])
+			return
+		default:
+			err = fmt.Errorf("unsupported command: %s", line)
+		}
+
+		if err != nil {
+			error := fmt.Sprintf("fatal: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+	}
+
+	checkpoint()
+	fmt.Fprintf(os.Stderr, "Imported %d blobs, %d commits, %d tags\n", fi.counts["blob"], fi.counts["commit"], fi.counts["tag"])
+}
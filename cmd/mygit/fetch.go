@@ -0,0 +1,417 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// fetchOptions are the options of fetch.
+type fetchOptions struct {
+	force    bool      // update the refs even when it's not a fast-forward
+	allTags  bool      // fetch every tag, as if refs/tags/*:refs/tags/* was given
+	noTags   bool      // don't follow the tags pointing at what is fetched
+	filter   string    // the objects to leave out, see parseObjectFilter
+	depth    int       // the commits of history to fetch from the tips, 0 for all
+	progress io.Writer // where to report progress, nowhere when nil
+}
+
+// fetchedRef is a ref of the remote fetched, and the ref it updates here,
+// if any.
+type fetchedRef struct {
+	remote   remoteRef
+	local    string
+	force    bool
+	forMerge bool // the ref to merge, for FETCH_HEAD
+}
+
+// resolveRemote returns the URL of a remote, and whether name is a remote
+// configured, rather than a URL or a path.
+func resolveRemote(name string) (string, bool) {
+	if url, ok := configGet("remote." + name + ".url"); ok {
+		return url, true
+	}
+	return name, false
+}
+
+// defaultRemote returns the remote of the current branch,
+// branch.<name>.remote, or origin.
+func defaultRemote() string {
+	if head, symbolic, err := readSymbolicRef("HEAD"); err == nil && symbolic {
+		if remote, ok := configGet("branch." + strings.TrimPrefix(head, "refs/heads/") + ".remote"); ok {
+			return remote
+		}
+	}
+	return "origin"
+}
+
+// fetchRemote fetches the refs of a remote the refspecs map, or those of
+// remote.<name>.fetch when there are none, or else HEAD, and updates the
+// refs they map them to, see updateFetchedRefs. Tags pointing at what is
+// fetched are fetched too, unless noTags.
+//
+// The objects the filter says, or else remote.<name>.partialclonefilter,
+// are left out, eg: the blobs of a partial clone, see PromisorStore. With a
+// depth, history is cut that many commits from the tips, the boundary
+// recorded in .git/shallow.
+//
+// It returns whether all the refs could be updated.
+func fetchRemote(remote string, specs []string, opts fetchOptions, out io.Writer) (bool, error) {
+	url, named := resolveRemote(remote)
+	fromCommandLine := len(specs) > 0
+	if !fromCommandLine && named {
+		specs = configGetAll("remote." + remote + ".fetch")
+	}
+	if len(specs) == 0 {
+		specs, fromCommandLine = []string{"HEAD"}, true
+	}
+	var refspecs []refspec
+	for _, spec := range specs {
+		r, err := parseRefspec(spec)
+		if err != nil {
+			return false, err
+		}
+		refspecs = append(refspecs, r)
+	}
+	given := len(refspecs)
+	if opts.allTags {
+		refspecs = append(refspecs, refspec{src: "refs/tags/*", dst: "refs/tags/*"})
+	}
+
+	t, err := openTransport(remote, url)
+	if err != nil {
+		return false, err
+	}
+	defer t.close()
+	if opts.filter == "" && named {
+		opts.filter, _ = configGet("remote." + remote + ".partialclonefilter")
+	}
+	if pack, ok := t.(*packTransport); ok && opts.filter != "" {
+		if err := parseObjectFilter(opts.filter); err != nil {
+			return false, err
+		}
+		pack.filter = opts.filter
+	}
+	if pack, ok := t.(*packTransport); ok {
+		pack.depth, pack.progress = opts.depth, opts.progress
+	} else if opts.depth > 0 {
+		return false, fmt.Errorf("--depth isn't supported by the remote helper of %s", url)
+	}
+	remoteRefs, err := t.list(false)
+	if err != nil {
+		return false, err
+	}
+
+	merge := ""
+	if head, symbolic, err := readSymbolicRef("HEAD"); err == nil && symbolic && !fromCommandLine {
+		branch := strings.TrimPrefix(head, "refs/heads/")
+		if branchRemote, _ := configGet("branch." + branch + ".remote"); branchRemote == remote {
+			merge, _ = configGet("branch." + branch + ".merge")
+		}
+	}
+
+	var fetched []*fetchedRef
+	for i, spec := range refspecs {
+		matched := false
+		for _, r := range findRemoteRefs(remoteRefs, spec) {
+			local, _ := spec.match(r.name)
+			forMerge := fromCommandLine && i < given || r.name == merge
+			fetched = append(fetched, &fetchedRef{remote: r, local: local, force: spec.force || opts.force, forMerge: forMerge})
+			matched = true
+		}
+		if !matched && !spec.isGlob() && fromCommandLine {
+			return false, fmt.Errorf("couldn't find remote ref %s", spec.src)
+		}
+	}
+	if err := fetchMissing(t, fetched, opts.depth > 0); err != nil {
+		return false, err
+	}
+
+	if !opts.noTags && !opts.allTags {
+		followed := followTags(remoteRefs, fetched)
+		if err := fetchMissing(t, followed, false); err != nil {
+			return false, err
+		}
+		fetched = append(fetched, followed...)
+	}
+
+	if err := writeFetchHead(url, fetched); err != nil {
+		return false, err
+	}
+	return updateFetchedRefs(remote, url, fetched, out)
+}
+
+// findRemoteRefs returns the refs of the remote a refspec matches. The
+// source of a refspec without a * names a single ref, looked up like
+// resolveRevision does: as is, then in refs/, refs/tags/, refs/heads/ and
+// refs/remotes/.
+func findRemoteRefs(refs []remoteRef, spec refspec) []remoteRef {
+	var found []remoteRef
+	for _, prefix := range []string{"", "refs/", "refs/tags/", "refs/heads/", "refs/remotes/"} {
+		for _, r := range refs {
+			if r.sha == "" || strings.HasSuffix(r.name, "^{}") {
+				continue
+			}
+			if spec.isGlob() {
+				if _, ok := spec.match(r.name); ok && prefix == "" {
+					found = append(found, r)
+				}
+			} else if r.name == prefix+spec.src {
+				return []remoteRef{r}
+			}
+		}
+	}
+	return found
+}
+
+// followTags returns the tags of the remote that point at objects we have
+// now, which we don't have yet, like git does by default. An annotated tag
+// is advertised with what it points to, as `<tag>^{}`.
+func followTags(refs []remoteRef, fetched []*fetchedRef) []*fetchedRef {
+	peeled := map[string]string{}
+	for _, r := range refs {
+		if name, found := strings.CutSuffix(r.name, "^{}"); found {
+			peeled[name] = r.sha
+		}
+	}
+	updated := map[string]bool{}
+	for _, f := range fetched {
+		updated[f.local] = true
+	}
+
+	var followed []*fetchedRef
+	for _, r := range refs {
+		if !strings.HasPrefix(r.name, "refs/tags/") || strings.HasSuffix(r.name, "^{}") || r.sha == "" || updated[r.name] {
+			continue
+		}
+		if _, err := readRef(r.name); err == nil {
+			continue
+		}
+		target, ok := peeled[r.name]
+		if !ok {
+			target = r.sha
+		}
+		if objects.Has(target) {
+			followed = append(followed, &fetchedRef{remote: r, local: r.name})
+		}
+	}
+	return followed
+}
+
+// fetchMissing fetches the refs whose objects we don't have yet, and checks
+// the remote sent them. When deepening a shallow repository, every ref is
+// fetched, as the history under the ones we have can be missing too.
+func fetchMissing(t transport, fetched []*fetchedRef, deepen bool) error {
+	var missing []remoteRef
+	for _, f := range fetched {
+		if deepen || !objects.Has(f.remote.sha) {
+			missing = append(missing, f.remote)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := t.fetch(missing); err != nil {
+		return err
+	}
+	for _, r := range missing {
+		if !objects.Has(r.sha) {
+			return fmt.Errorf("remote did not send all necessary objects")
+		}
+	}
+	return nil
+}
+
+// writeFetchHead records the refs fetched in FETCH_HEAD, the ones to merge
+// first, the others marked not-for-merge:
+//
+//	<sha>		branch 'main' of <url>
+//	<sha>	not-for-merge	tag 'v1.0' of <url>
+func writeFetchHead(url string, fetched []*fetchedRef) error {
+	sorted := append([]*fetchedRef{}, fetched...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].forMerge && !sorted[j].forMerge })
+
+	var content strings.Builder
+	for _, f := range sorted {
+		mark := ""
+		if !f.forMerge {
+			mark = "not-for-merge"
+		}
+		description := url
+		if kind := refKind(f.remote.name); kind != "" {
+			description = fmt.Sprintf("%s '%s' of %s", kind, shortRefName(f.remote.name), url)
+		} else if f.remote.name != "HEAD" {
+			description = fmt.Sprintf("'%s' of %s", f.remote.name, url)
+		}
+		fmt.Fprintf(&content, "%s\t%s\t%s\n", f.remote.sha, mark, description)
+	}
+	return os.WriteFile(gitPath("FETCH_HEAD"), []byte(content.String()), 0644)
+}
+
+// refKind names the kind of a ref, for the messages: branch, tag, or
+// nothing for any other ref.
+func refKind(name string) string {
+	switch {
+	case strings.HasPrefix(name, "refs/heads/"):
+		return "branch"
+	case strings.HasPrefix(name, "refs/tags/"):
+		return "tag"
+	}
+	return ""
+}
+
+// updateFetchedRefs updates the refs the refs fetched map to, and reports
+// it the way git does:
+//
+//	From ../upstream
+//	 * [new branch]      topic      -> origin/topic
+//	   5d1e2a3..9f8e7d6  main       -> origin/main
+//	 + 1a2b3c4...4c3b2a1 next       -> origin/next  (forced update)
+//	 ! [rejected]        v1.0       -> v1.0  (would clobber existing tag)
+//
+// An update must be a fast-forward, unless forced, and a tag is never
+// moved unless forced. It returns whether all the refs could be updated.
+func updateFetchedRefs(remote string, url string, fetched []*fetchedRef, out io.Writer) (bool, error) {
+	type reportLine struct {
+		flag, summary, from, to, reason string
+	}
+	var report []reportLine
+	ok := true
+	for _, f := range fetched {
+		from := shortRefName(f.remote.name)
+		if f.local == "" {
+			summary := refKind(f.remote.name)
+			if f.remote.name == "HEAD" {
+				summary = "branch"
+			} else if summary == "" {
+				summary = "[new ref]"
+			}
+			report = append(report, reportLine{"*", summary, from, "FETCH_HEAD", ""})
+			continue
+		}
+
+		to := shortRefName(f.local)
+		sha := f.remote.sha
+		old, err := readRef(f.local)
+		if err != nil {
+			old = ""
+		}
+		line := reportLine{to: to, from: from}
+		action := ""
+		switch {
+		case old == sha:
+			continue
+		case old == "":
+			line.flag, line.summary, action = "*", "[new ref]", "storing ref"
+			switch refKind(f.remote.name) {
+			case "branch":
+				line.summary, action = "[new branch]", "storing head"
+			case "tag":
+				line.summary, action = "[new tag]", "storing tag"
+			}
+		case strings.HasPrefix(f.local, "refs/tags/") && !f.force:
+			line.flag, line.summary, line.reason = "!", "[rejected]", "would clobber existing tag"
+		default:
+			fastForward, err := isAncestor(old, sha)
+			if err != nil {
+				fastForward = false
+			}
+			switch {
+			case fastForward:
+				line.flag, line.summary, action = " ", old[:7]+".."+sha[:7], "fast-forward"
+			case f.force:
+				line.flag, line.summary, line.reason, action = "+", old[:7]+"..."+sha[:7], "forced update", "forced-update"
+			default:
+				line.flag, line.summary, line.reason = "!", "[rejected]", "non-fast-forward"
+			}
+		}
+
+		if action != "" {
+			if err := updateRefIf(f.local, sha, old); err != nil {
+				return false, fmt.Errorf("cannot lock ref '%s': %s", f.local, err)
+			}
+			if err := appendReflog(f.local, old, sha, "fetch "+remote+": "+action); err != nil {
+				return false, err
+			}
+		} else {
+			ok = false
+		}
+		report = append(report, line)
+	}
+
+	if len(report) == 0 {
+		return ok, nil
+	}
+	width := 10
+	for _, line := range report {
+		width = max(width, len(line.from))
+	}
+	fmt.Fprintf(out, "From %s\n", url)
+	for _, line := range report {
+		text := fmt.Sprintf(" %s %-17s %-*s -> %s", line.flag, line.summary, width, line.from, line.to)
+		if line.reason != "" {
+			text += "  (" + line.reason + ")"
+		}
+		fmt.Fprintln(out, text)
+	}
+	return ok, nil
+}
+
+// fetch implements `git fetch [-f] [--tags | --no-tags] [--filter=<filter-spec>] [--depth=<depth>] [--progress | --no-progress] [<repository> [<refspec>...]]`
+//
+// It downloads the objects of the refs of another repository, and updates
+// the refs here they map to, see fetchRemote:
+//
+//	$ git fetch origin
+//	From ../upstream
+//	   5d1e2a3..9f8e7d6  main       -> origin/main
+//
+// The repository is the name of a remote, whose remote.<name>.fetch
+// refspecs say which refs to fetch where, a path or a URL. It is the remote
+// of the current branch, or origin, when not given. The refs fetched are
+// recorded in FETCH_HEAD too. With --filter, the objects it says are left
+// out, see PromisorStore, and with --depth, history is cut that many commits
+// from the refs fetched, which can deepen a shallow repository. The progress
+// of the remote and of the unpacking is reported, see progressFlag.
+//
+// Besides local repositories and http(s), a URL can name a remote helper,
+// git-remote-<transport>, that does the transfer, see remoteHelperFor.
+func fetch(args []string) {
+	flag := flag.NewFlagSet("git fetch", flag.ExitOnError)
+	var opts fetchOptions
+	flag.BoolVar(&opts.force, "force", false, "update the refs even when it's not a fast-forward")
+	flag.BoolVar(&opts.force, "f", false, "same as --force")
+	flag.BoolVar(&opts.allTags, "tags", false, "fetch all the tags")
+	flag.BoolVar(&opts.allTags, "t", false, "same as --tags")
+	flag.BoolVar(&opts.noTags, "no-tags", false, "don't fetch the tags pointing at what is fetched")
+	flag.BoolVar(&opts.noTags, "n", false, "same as --no-tags")
+	flag.StringVar(&opts.filter, "filter", "", "leave out the objects the filter says, eg: blob:none")
+	flag.IntVar(&opts.depth, "depth", 0, "fetch only `<depth>` commits of history from the tips")
+	progress := progressFlag(flag)
+	flag.Parse(args)
+	opts.progress = progress()
+	args = flag.Args()
+
+	remote := defaultRemote()
+	if len(args) > 0 {
+		remote, args = args[0], args[1:]
+	}
+	if _, named := resolveRemote(remote); !named && len(flag.Args()) == 0 {
+		fmt.Fprintln(os.Stderr, "fatal: No remote repository specified. Please, specify either a URL or a")
+		fmt.Fprintln(os.Stderr, "remote name from which new revisions should be fetched.")
+		os.Exit(128)
+	}
+
+	ok, err := fetchRemote(remote, args, opts, os.Stderr)
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"plugin"
+	"strings"
+	"time"
+)
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// filterRepo holds the transformations applied to every commit.
+type filterRepo struct {
+	paths           []string
+	invertPaths     bool
+	renames         [][2]string
+	messageCallback func([]byte) []byte
+	write           func(string, []byte) (string, error)
+}
+
+// filterFiles keeps the files selected by --path/--invert-paths and applies
+// --path-rename to them.
+func (fr *filterRepo) filterFiles(files map[string]treeEntry) map[string]treeEntry {
+	filtered := map[string]treeEntry{}
+
+	for path, entry := range files {
+		if len(fr.paths) > 0 {
+			matched := false
+			for _, pattern := range fr.paths {
+				// paths match like ref patterns: a glob, or a directory prefix
+				if matchRefPattern(pattern, path) {
+					matched = true
+					break
+				}
+			}
+			if matched == fr.invertPaths {
+				continue
+			}
+		}
+
+		for _, rename := range fr.renames {
+			from, to := strings.TrimSuffix(rename[0], "/"), strings.TrimSuffix(rename[1], "/")
+			if path == from {
+				path = to
+				break
+			}
+			if rest, found := strings.CutPrefix(path, from+"/"); found {
+				path = to + "/" + rest
+				break
+			}
+		}
+
+		filtered[path] = entry
+	}
+
+	return filtered
+}
+
+// rewriteCommit rebuilds the raw content of a commit with a new tree, new
+// parents and a transformed message. Other headers are kept, except for
+// signatures which can't be valid anymore.
+func (fr *filterRepo) rewriteCommit(content []byte, tree string, parents []string) []byte {
+	headers, message, _ := strings.Cut(string(content), "\n\n")
+
+	var rewritten strings.Builder
+	inSignature := false
+	for _, line := range strings.Split(headers, "\n") {
+		if inSignature && strings.HasPrefix(line, " ") {
+			continue
+		}
+		inSignature = false
+
+		key, _, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			fmt.Fprintf(&rewritten, "tree %s\n", tree)
+			for _, parent := range parents {
+				fmt.Fprintf(&rewritten, "parent %s\n", parent)
+			}
+		case "parent":
+		case "gpgsig", "gpgsig-sha256":
+			inSignature = true
+		default:
+			rewritten.WriteString(line + "\n")
+		}
+	}
+
+	if fr.messageCallback != nil {
+		message = string(fr.messageCallback([]byte(message)))
+	}
+	rewritten.WriteString("\n" + message)
+
+	return []byte(rewritten.String())
+}
+
+// loadMessageCallback opens a Go plugin built with `go build -buildmode=plugin`
+// that exports:
+//
+//	func MessageCallback(message []byte) []byte
+func loadMessageCallback(path string) (func([]byte) []byte, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol, err := p.Lookup("MessageCallback")
+	if err != nil {
+		return nil, err
+	}
+
+	callback, ok := symbol.(func([]byte) []byte)
+	if !ok {
+		return nil, fmt.Errorf("MessageCallback in '%s' is a %T, expected func([]byte) []byte", path, symbol)
+	}
+	return callback, nil
+}
+
+// filterRepoCmd implements
+// `git filter-repo [--path <pattern>]... [--invert-paths] [--path-rename <old>:<new>]...
+// [--message-callback <plugin>] [--dry-run]`
+//
+// It rewrites all the history reachable from refs/: every commit gets the
+// tree left after filtering and renaming its paths, and its parents are
+// replaced by their rewritten versions. Commits that become empty are
+// pruned, unless they were empty to begin with. Branches and tags are then
+// moved to the rewritten commits; annotated tags are rewritten too.
+//
+// The old to new mapping is written to .git/filter-repo/commit-map, with
+// pruned commits mapped to 0000000000000000000000000000000000000000:
+//
+//	old                                      new
+//	<old sha> <new sha>
+//
+// Like git, the index and the work tree are then reset to the rewritten
+// HEAD, so the rewrite has to start from a clean work tree, unless in a bare
+// repository.
+func filterRepoCmd(args []string) {
+	flag := flag.NewFlagSet("git filter-repo", flag.ExitOnError)
+	var (
+		paths           stringList
+		renames         stringList
+		invertPaths     = flag.Bool("invert-paths", false, "remove the files matching --path instead of keeping them")
+		messageCallback = flag.String("message-callback", "", "Go `<plugin>` exporting MessageCallback(message []byte) []byte")
+		dryRun          = flag.Bool("dry-run", false, "only print what would change")
+	)
+	flag.Var(&paths, "path", "only keep files matching `<pattern>`, can be given several times")
+	flag.Var(&renames, "path-rename", "rename `<old>:<new>` paths, can be given several times")
+	flag.Parse(args)
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	fr := &filterRepo{paths: paths, invertPaths: *invertPaths, write: writeObject}
+	if *dryRun {
+		fr.write = func(objectType string, content []byte) (string, error) {
+			return objectHash(objectType, content), nil
+		}
+	}
+	for _, rename := range renames {
+		from, to, found := strings.Cut(rename, ":")
+		if !found {
+			fail(fmt.Errorf("--path-rename expects <old>:<new>, got '%s'", rename))
+		}
+		fr.renames = append(fr.renames, [2]string{from, to})
+	}
+	if *messageCallback != "" {
+		callback, err := loadMessageCallback(*messageCallback)
+		if err != nil {
+			fail(fmt.Errorf("failed to load message callback: %s", err))
+		}
+		fr.messageCallback = callback
+	}
+
+	defer tracePerformance(time.Now(), "filter-repo")
+
+	// what the rewrite would leave in the index and the work tree would be
+	// lost once they're reset
+	if !bareRepository && !*dryRun {
+		idx, err := readIndex()
+		if err != nil {
+			fail(err)
+		}
+		if changed, err := localChanges(idx); err != nil {
+			fail(err)
+		} else if len(changed) > 0 {
+			fail(fmt.Errorf("Cannot rewrite history: You have uncommitted changes."))
+		}
+	}
+	head, _ := resolveRevision("HEAD")
+
+	refs, err := listRefs()
+	if err != nil {
+		fail(err)
+	}
+
+	var starts []string
+	for _, r := range refs {
+		sha, objectType, err := peelTag(r.sha)
+		if err != nil {
+			fail(err)
+		}
+		if objectType == "commit" {
+			starts = append(starts, sha)
+		}
+	}
+
+	ordered, err := parentsFirst(starts, func(string) bool { return false })
+	if err != nil {
+		fail(err)
+	}
+
+	// rewritten maps every old commit to its new sha. A pruned commit maps to
+	// the rewritten ancestor standing in for it, or to "" when there is none.
+	// trees keeps the tree of each rewritten commit to detect empty ones.
+	rewritten := map[string]string{}
+	pruned := map[string]bool{}
+	trees := map[string]string{}
+	for _, node := range ordered {
+		_, content, err := readObject(node.sha)
+		if err != nil {
+			fail(err)
+		}
+		c, err := parseCommit(content)
+		if err != nil {
+			fail(err)
+		}
+
+		files, err := flattenTree(c.tree)
+		if err != nil {
+			fail(err)
+		}
+		tree, err := buildTree(fr.filterFiles(files), fr.write)
+		if err != nil {
+			fail(err)
+		}
+
+		var parents []string
+		seen := map[string]bool{}
+		for _, parent := range c.parents {
+			if sha := rewritten[parent]; sha != "" && !seen[sha] {
+				seen[sha] = true
+				parents = append(parents, sha)
+			}
+		}
+
+		// a commit that doesn't change anything anymore is pruned, unless it
+		// was already empty before filtering
+		if len(parents) <= 1 {
+			parentTree := emptyTreeSha
+			originalParentTree := emptyTreeSha
+			if len(parents) == 1 {
+				parentTree = trees[parents[0]]
+			}
+			if len(c.parents) > 0 {
+				parent, err := readCommit(c.parents[0])
+				if err != nil {
+					fail(err)
+				}
+				originalParentTree = parent.tree
+			}
+
+			if tree == parentTree && (c.tree != originalParentTree || len(c.parents) > 1) {
+				pruned[node.sha] = true
+				if len(parents) == 1 {
+					rewritten[node.sha] = parents[0]
+				} else {
+					rewritten[node.sha] = ""
+				}
+				continue
+			}
+		}
+
+		sha, err := fr.write("commit", fr.rewriteCommit(content, tree, parents))
+		if err != nil {
+			fail(err)
+		}
+		rewritten[node.sha] = sha
+		trees[sha] = tree
+	}
+
+	var commitMap strings.Builder
+	commitMap.WriteString("old                                      new\n")
+	for _, node := range ordered {
+		sha := rewritten[node.sha]
+		if pruned[node.sha] {
+			sha = nullSha
+		}
+		commitMap.WriteString(node.sha + " " + sha + "\n")
+
+		if *dryRun && sha != node.sha {
+			c, _ := readCommit(node.sha)
+			if pruned[node.sha] {
+				fmt.Printf("%s pruned %s\n", node.sha, subject(c.message))
+			} else {
+				fmt.Printf("%s -> %s %s\n", node.sha, sha, subject(c.message))
+			}
+		}
+	}
+
+	// move the refs, rewriting annotated tags on the way. A symbolic ref,
+	// eg: refs/remotes/origin/HEAD, follows the ref it points to.
+	for _, r := range refs {
+		if _, symbolic, err := readSymbolicRef(r.name); err != nil {
+			fail(err)
+		} else if symbolic {
+			continue
+		}
+		sha, err := fr.rewriteRef(r, rewritten)
+		if err != nil {
+			fail(err)
+		}
+		if sha == r.sha {
+			continue
+		}
+		if sha == "" {
+			fmt.Fprintf(os.Stderr, "warning: %s has no commits left, leaving it alone\n", r.name)
+			continue
+		}
+
+		if *dryRun {
+			fmt.Printf("update %s %s -> %s\n", r.name, r.sha, sha)
+			continue
+		}
+		if err := updateRef(r.name, sha); err != nil {
+			fail(err)
+		}
+	}
+
+	if *dryRun {
+		return
+	}
+
+	// a detached HEAD is moved like the refs, and the work tree follows
+	if _, symbolic, err := readSymbolicRef("HEAD"); err == nil && !symbolic && rewritten[head] != "" && rewritten[head] != head {
+		if err := updateRef("HEAD", rewritten[head]); err != nil {
+			fail(err)
+		}
+	}
+	if newHead, err := resolveRevision("HEAD"); err == nil && !bareRepository && newHead != head {
+		if _, err := resetCommit(newHead); err != nil {
+			fail(err)
+		}
+	}
+
+	err = os.MkdirAll(gitPath("filter-repo"), 0750)
+	if err == nil {
+		err = os.WriteFile(gitPath("filter-repo/commit-map"), []byte(commitMap.String()), 0644)
+	}
+	if err != nil {
+		fail(fmt.Errorf("failed to write commit-map: %s", err))
+	}
+}
+
+// rewriteRef returns what a ref should point to after the rewrite: the
+// rewritten commit, or a rewritten copy of an annotated tag.
+func (fr *filterRepo) rewriteRef(r ref, rewritten map[string]string) (string, error) {
+	objectType, content, err := readObject(r.sha)
+	if err != nil {
+		return "", err
+	}
+
+	switch objectType {
+	case "commit":
+		return rewritten[r.sha], nil
+
+	case "tag":
+		t, err := parseTag(content)
+		if err != nil {
+			return "", err
+		}
+		target, err := fr.rewriteRef(ref{name: r.name, sha: t.object}, rewritten)
+		if err != nil || target == "" || target == t.object {
+			return target, err
+		}
+
+		message, _ := stripSignature(t.message)
+		var tagContent strings.Builder
+		fmt.Fprintf(&tagContent, "object %s\ntype %s\ntag %s\n", target, t.objectType, t.name)
+		if t.tagger != "" {
+			fmt.Fprintf(&tagContent, "tagger %s\n", t.tagger)
+		}
+		tagContent.WriteString("\n" + message)
+		return fr.write("tag", []byte(tagContent.String()))
+
+	default:
+		return r.sha, nil
+	}
+}
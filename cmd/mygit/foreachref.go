@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// refAtoms are the %(atom)s for-each-ref knows about.
+var refAtoms = []string{"refname", "refname:short", "objectname", "objectname:short", "objecttype", "subject"}
+
+// formatRef fills in the atoms of a parsed format for a single ref.
+//
+// The object is only read when the format asks for its type or subject.
+func formatRef(parts []formatPart, r ref) (string, error) {
+	var objectType, objectSubject string
+	var objectRead bool
+
+	return expandFormat(parts, func(atom string) (string, error) {
+		switch atom {
+		case "refname":
+			return r.name, nil
+		case "refname:short":
+			return shortRefName(r.name), nil
+		case "objectname":
+			return r.sha, nil
+		case "objectname:short":
+			if len(r.sha) < 7 {
+				return r.sha, nil
+			}
+			return r.sha[:7], nil
+		}
+
+		if !objectRead {
+			var content []byte
+			var err error
+
+			objectType, content, err = readObject(r.sha)
+			if err != nil {
+				return "", err
+			}
+
+			switch objectType {
+			case "commit":
+				c, err := parseCommit(content)
+				if err != nil {
+					return "", err
+				}
+				objectSubject = subject(c.message)
+			case "tag":
+				t, err := parseTag(content)
+				if err != nil {
+					return "", err
+				}
+				objectSubject = subject(t.message)
+			}
+			objectRead = true
+		}
+
+		if atom == "objecttype" {
+			return objectType, nil
+		}
+		return objectSubject, nil
+	})
+}
+
+// matchRefPattern checks a ref against a for-each-ref pattern.
+//
+// Like git, a pattern either matches as a glob (where '*' does not cross a
+// '/'), or literally from the beginning of the ref name up to a slash, so
+// `refs/heads` matches every branch.
+func matchRefPattern(pattern string, name string) bool {
+	if matched, _ := path.Match(pattern, name); matched {
+		return true
+	}
+
+	prefix := strings.TrimSuffix(pattern, "/")
+	return name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// forEachRef implements `git for-each-ref [--format=<format>] [<pattern>...]`
+//
+// It lists every loose and packed ref, optionally filtered by patterns, and
+// prints the fields requested by the format for each of them. Supported atoms:
+//
+//	%(refname) %(refname:short) %(objectname) %(objectname:short)
+//	%(objecttype) %(subject)
+func forEachRef(args []string) {
+	flag := flag.NewFlagSet("git for-each-ref", flag.ExitOnError)
+	var (
+		format = flag.String("format", "%(objectname) %(objecttype)\t%(refname)", "format to use for the output")
+	)
+	flag.Parse(args)
+	patterns := flag.Args()
+
+	parts, err := parseFormat(*format, refAtoms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		os.Exit(1)
+	}
+
+	refs, err := listRefs()
+	if err != nil {
+		error := fmt.Sprintf("Failed to list refs: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	for _, r := range refs {
+		if len(patterns) > 0 {
+			matched := false
+			for _, pattern := range patterns {
+				if matchRefPattern(pattern, r.name) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		line, err := formatRef(parts, r)
+		if err != nil {
+			error := fmt.Sprintf("Failed to format '%s': %s", r.name, err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// formatPart is a piece of a parsed --format string: either literal text
+// or a %(atom) to fill in.
+type formatPart struct {
+	literal string
+	atom    string
+}
+
+// parseFormat splits a --format string into literal text and atoms once,
+// so it can be applied to many refs/objects without re-parsing.
+//
+// `%%` is a literal '%'. Atoms that aren't in knownAtoms are rejected.
+func parseFormat(format string, knownAtoms []string) ([]formatPart, error) {
+	var parts []formatPart
+	var literal strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		switch {
+		case strings.HasPrefix(format[i:], "%%"):
+			literal.WriteByte('%')
+			i++
+
+		case strings.HasPrefix(format[i:], "%("):
+			end := strings.IndexByte(format[i:], ')')
+			if end < 0 {
+				return nil, fmt.Errorf("malformed format string %s", format[i:])
+			}
+
+			atom := format[i+2 : i+end]
+			known := false
+			for _, knownAtom := range knownAtoms {
+				if atom == knownAtom {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown field name: %s", atom)
+			}
+
+			parts = append(parts, formatPart{literal: literal.String()}, formatPart{atom: atom})
+			literal.Reset()
+			i += end
+
+		default:
+			literal.WriteByte(format[i])
+		}
+	}
+
+	return append(parts, formatPart{literal: literal.String()}), nil
+}
+
+// expandFormat fills in the atoms of a parsed format using expand.
+func expandFormat(parts []formatPart, expand func(atom string) (string, error)) (string, error) {
+	var out strings.Builder
+	for _, part := range parts {
+		if part.atom == "" {
+			out.WriteString(part.literal)
+			continue
+		}
+
+		value, err := expand(part.atom)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+	}
+
+	return out.String(), nil
+}
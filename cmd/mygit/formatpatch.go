@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mailDate is the format of the dates of emails, RFC 2822.
+const mailDate = "Mon, 2 Jan 2006 15:04:05 -0700"
+
+// patchFileName names the file of the n-th patch after its subject, the
+// way git does: 0001-Fix-the-parser.patch. Only letters, digits, dots and
+// underscores are kept, the rest become dashes, and the name is cut to fit
+// in 64 characters.
+func patchFileName(n int, subject string) string {
+	var name strings.Builder
+	fmt.Fprintf(&name, "%04d-", n)
+	start := name.Len()
+
+	// 2 drops what starts the subject, 1 turns it into a dash
+	space := 2
+	for i := 0; i < len(subject); i++ {
+		c := subject[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' {
+			if space == 1 {
+				name.WriteByte('-')
+			}
+			space = 0
+			name.WriteByte(c)
+			for c == '.' && i+1 < len(subject) && subject[i+1] == '.' {
+				i++
+			}
+		} else {
+			space |= 1
+		}
+	}
+
+	result := name.String()
+	if len(result) > 64-len(".patch")-1 {
+		result = result[:64-len(".patch")-1]
+	}
+	for len(result) > start && (strings.HasSuffix(result, ".") || strings.HasSuffix(result, "-")) {
+		result = result[:len(result)-1]
+	}
+	return result + ".patch"
+}
+
+// patchSignature ends the patches, format.signature or mygit.
+func patchSignature() string {
+	if signature, ok := configGet("format.signature"); ok {
+		return signature
+	}
+	return "mygit"
+}
+
+// writePatchStat writes the diffstat and the summary of the changes of a
+// patch, 72 columns wide to fit in an email.
+func writePatchStat(w io.Writer, changes []treeChange) error {
+	var stats []fileStat
+	for _, change := range changes {
+		stat, err := statChange(change, &diffOptions{})
+		if err != nil {
+			return err
+		}
+		stats = append(stats, stat)
+	}
+	writeDiffStat(w, stats, 72, 0)
+	writeSummary(w, changes)
+	return nil
+}
+
+// writePatchMail writes a commit as an email, a patch that `git am` can
+// apply:
+//
+//	From <sha> Mon Sep 17 00:00:00 2001
+//	From: <author>
+//	Date: <author date>
+//	Subject: [PATCH <n>/<total>] <subject>
+//
+//	<body>
+//	---
+//	<diffstat>
+//
+//	<patch>
+//	--
+//	<signature>
+//
+// The "From <sha>" line makes a mailbox out of the patches, its date is
+// always the same.
+func writePatchMail(w io.Writer, sha string, c *commit, prefix string) error {
+	changes, err := commitChanges(c)
+	if err != nil {
+		return err
+	}
+
+	name, email, when := parseIdent(c.author)
+	subject, body := messageParts(c.message)
+	fmt.Fprintf(w, "From %s Mon Sep 17 00:00:00 2001\n", sha)
+	fmt.Fprintf(w, "From: %s <%s>\n", strings.TrimSpace(name), email)
+	fmt.Fprintf(w, "Date: %s\n", when.Format(mailDate))
+	if prefix != "" {
+		subject = prefix + " " + subject
+	}
+	// like git, long subjects are folded, see RFC 2822
+	io.WriteString(w, wrapText("Subject: "+subject, 78, 0, 1))
+	fmt.Fprintln(w)
+	if body = strings.TrimRight(body, "\n"); body != "" {
+		fmt.Fprintf(w, "%s\n", body)
+	}
+	fmt.Fprintln(w, "---")
+
+	if err := writePatchStat(w, changes); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	for _, change := range changes {
+		if err := writePatch(w, change, &diffOptions{}); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "-- \n%s\n\n", patchSignature())
+	return nil
+}
+
+// coverText returns the subject and the body of a cover letter, from the
+// description of the branch, see `git branch --edit-description`, as mode
+// says:
+//
+//	message  the description is the body, the default
+//	subject  its first paragraph is the subject, the rest the body
+//	auto     like subject, unless the first paragraph is over 100 characters
+//	none     the description is left out
+//
+// What the description doesn't fill in is a placeholder, to be edited
+// before sending.
+func coverText(branch string, mode string) (string, string) {
+	subject, body := "*** SUBJECT HERE ***", "*** BLURB HERE ***"
+	description, _ := configGet("branch." + branch + ".description")
+	description = strings.TrimSpace(description)
+	if mode == "none" || branch == "" || description == "" {
+		return subject, body
+	}
+
+	first, rest, _ := strings.Cut(description, "\n\n")
+	first = strings.Join(strings.Fields(first), " ")
+	if mode == "subject" || mode == "auto" && len(first) <= 100 {
+		return first, strings.TrimSpace(rest)
+	}
+	return subject, description
+}
+
+// wrapText wraps text at width columns, the first line indented by indent
+// spaces and the others by hangingIndent.
+func wrapText(text string, width int, indent int, hangingIndent int) string {
+	var wrapped strings.Builder
+	line := strings.Repeat(" ", indent)
+	empty := true
+	for _, word := range strings.Fields(text) {
+		if !empty && len(line)+1+len(word) > width {
+			wrapped.WriteString(line + "\n")
+			line = strings.Repeat(" ", hangingIndent)
+			empty = true
+		}
+		if !empty {
+			line += " "
+		}
+		line += word
+		empty = false
+	}
+	wrapped.WriteString(line + "\n")
+	return wrapped.String()
+}
+
+// writeCoverLetter writes the cover letter of a series of patches, patch
+// 0, which presents them: a placeholder subject and body, see coverText,
+// the shortlog of the commits and the diffstat of the whole series.
+func writeCoverLetter(w io.Writer, commits []*rangeCommit, fromTree string, toTree string, subject string, body string) error {
+	ident, err := makeIdent("COMMITTER")
+	if err != nil {
+		return err
+	}
+	name, email, when := parseIdent(ident)
+
+	fmt.Fprintf(w, "From %s Mon Sep 17 00:00:00 2001\n", commits[len(commits)-1].sha)
+	fmt.Fprintf(w, "From: %s <%s>\n", strings.TrimSpace(name), email)
+	fmt.Fprintf(w, "Date: %s\n", when.Format(mailDate))
+	io.WriteString(w, wrapText(fmt.Sprintf("Subject: [PATCH 0/%d] %s", len(commits), subject), 78, 0, 1))
+	fmt.Fprintln(w)
+	if body != "" {
+		fmt.Fprintf(w, "%s\n", body)
+	}
+	fmt.Fprintln(w)
+
+	groups := map[string]*shortlogGroup{}
+	var authors []string
+	for _, rc := range commits {
+		author, _, _ := parseIdent(rc.commit.author)
+		author = strings.TrimSpace(author)
+		group, ok := groups[author]
+		if !ok {
+			group = &shortlogGroup{author: author}
+			groups[author] = group
+			authors = append(authors, author)
+		}
+		subject, _ := messageParts(rc.commit.message)
+		group.subjects = append(group.subjects, subject)
+	}
+	sort.Strings(authors)
+	for _, author := range authors {
+		group := groups[author]
+		fmt.Fprintf(w, "%s (%d):\n", author, len(group.subjects))
+		for _, subject := range group.subjects {
+			io.WriteString(w, wrapText(subject, 72, 2, 4))
+		}
+		fmt.Fprintln(w)
+	}
+
+	changes, err := diffTrees(fromTree, toTree, true)
+	if err != nil {
+		return err
+	}
+	if err := writePatchStat(w, changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n-- \n%s\n\n", patchSignature())
+	return nil
+}
+
+// formatPatch implements `git format-patch [-o <dir>] [--cover-letter] [--cover-from-description=<mode>] (<since> | <revision range>)`
+//
+// It writes the commits since <since>, or of the range, as emails ready to
+// be sent, see writePatchMail, one file per commit, and prints their names:
+//
+//	$ git format-patch main
+//	0001-Fix-the-parser.patch
+//	0002-Add-a-test-for-the-parser.patch
+//
+// Merges are left out. The files go to the current directory, or to -o.
+//
+// --cover-letter adds a 0000-cover-letter.patch first, see
+// writeCoverLetter, to be edited before sending. With it, the subjects are
+// always numbered, [PATCH 1/1] even for a single patch, which otherwise is
+// just [PATCH]. --cover-from-description fills the cover letter from the
+// description of the branch, see coverText, format.coverFromDescription by
+// default.
+func formatPatch(args []string) {
+	flag := flag.NewFlagSet("git format-patch", flag.ExitOnError)
+	var (
+		outputDir   = flag.String("o", ".", "write the patches in `<dir>`")
+		coverLetter = flag.Bool("cover-letter", false, "write a cover letter too")
+		description = flag.String("cover-from-description", "", "fill the cover letter from the branch description as `<mode>`: message, subject, auto, none or default")
+	)
+	flag.StringVar(outputDir, "output-directory", ".", "same as -o")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git format-patch [-o <dir>] [--cover-letter] [--cover-from-description=<mode>] (<since> | <revision range>)")
+		os.Exit(129)
+	}
+
+	mode := *description
+	if mode == "" {
+		mode, _ = configGet("format.coverFromDescription")
+	}
+	switch mode {
+	case "", "default":
+		mode = "message"
+	case "message", "subject", "auto", "none":
+	default:
+		fail(fmt.Errorf("%s: invalid cover from description mode", mode))
+	}
+
+	from, to, isRange := strings.Cut(args[0], "..")
+	if !isRange || to == "" {
+		to = "HEAD"
+	}
+	commits, err := rangeCommits(from + ".." + to)
+	if err != nil {
+		fail(err)
+	}
+	if len(commits) == 0 {
+		return
+	}
+
+	if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+		fail(err)
+	}
+	write := func(name string, content []byte) {
+		path := filepath.Join(*outputDir, name)
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			fail(err)
+		}
+		fmt.Println(path)
+	}
+
+	if *coverLetter {
+		fromTree, err := resolveTree(from)
+		if err != nil {
+			fail(err)
+		}
+		toTree, err := resolveTree(to)
+		if err != nil {
+			fail(err)
+		}
+
+		branch := to
+		if target, symbolic, err := readSymbolicRef(to); err == nil && symbolic {
+			branch = target
+		}
+		if ref, err := expandRefName(branch); err == nil {
+			branch = ref
+		}
+		branch, isBranch := strings.CutPrefix(branch, "refs/heads/")
+		if !isBranch {
+			branch = ""
+		}
+
+		var cover bytes.Buffer
+		subject, body := coverText(branch, mode)
+		if err := writeCoverLetter(&cover, commits, fromTree, toTree, subject, body); err != nil {
+			fail(err)
+		}
+		write("0000-cover-letter.patch", cover.Bytes())
+	}
+
+	for n, rc := range commits {
+		prefix := "[PATCH]"
+		if len(commits) > 1 || *coverLetter {
+			prefix = fmt.Sprintf("[PATCH %d/%d]", n+1, len(commits))
+		}
+
+		var mail bytes.Buffer
+		if err := writePatchMail(&mail, rc.sha, rc.commit, prefix); err != nil {
+			fail(err)
+		}
+		subject, _ := messageParts(rc.commit.message)
+		write(patchFileName(n+1, subject), mail.Bytes())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"compress/zlib"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// objectStoreSize returns the size on disk of the objects folder: the loose
+// objects, the packs and their indexes.
+func objectStoreSize() (int64, error) {
+	var size int64
+	err := filepath.WalkDir(gitPath("objects"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// humanSize formats a size in bytes the way git does, eg: 1.50 KiB.
+func humanSize(size int64) string {
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	if size < 1024 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	value := float64(size) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f %s", value, units[unit])
+}
+
+// gc implements `git gc [--aggressive] [--quiet] [--progress | --no-progress]`
+//
+// It packs all the objects of the repository into a single pack and deletes
+// the packs and loose objects that became redundant, like `git repack -a -d
+// -l`, then reports how much the object store shrank:
+//
+//	$ git gc --aggressive
+//	Object store: 1.21 MiB -> 402.18 KiB
+//
+// The new pack is written like `git repack` would, see findDeltas. With
+// --aggressive, the deltas are all computed again instead of reused, among
+// a larger window of gc.aggressiveWindow objects, 250 by default, in chains
+// of gc.aggressiveDepth deltas, 50 by default, and the pack is compressed
+// at the best zlib level. That's much slower but gives a smaller pack, to
+// squeeze a repository being archived.
+//
+// Like git, the old entries of the reflogs are expired first, see
+// expireReflogs. The progress of the repacking is reported, see
+// progressFlag, unless --quiet.
+func gc(args []string) {
+	flag := flag.NewFlagSet("git gc", flag.ExitOnError)
+	var (
+		aggressive = flag.Bool("aggressive", false, "compress the objects as much as possible, at the cost of time")
+		quiet      = flag.Bool("quiet", false, "don't report progress nor sizes")
+		progress   = progressFlag(flag)
+	)
+	flag.Parse(args)
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	defer tracePerformance(time.Now(), "gc")
+
+	var out io.Writer
+	if !*quiet {
+		out = progress()
+	}
+
+	if err := expireReflogs(); err != nil {
+		fail(err)
+	}
+
+	before, err := objectStoreSize()
+	if err != nil {
+		fail(err)
+	}
+
+	opts := repackOptions{all: true, prune: true, local: true, pack: defaultPackOptions()}
+	if *aggressive {
+		opts.pack = packOptions{
+			level:  zlib.BestCompression,
+			window: configInt("gc.aggressiveWindow", 250),
+			depth:  configInt("gc.aggressiveDepth", 50),
+		}
+	}
+	if _, err := repackObjects(opts, out); err != nil {
+		fail(err)
+	}
+
+	after, err := objectStoreSize()
+	if err != nil {
+		fail(err)
+	}
+	if !*quiet {
+		fmt.Printf("Object store: %s -> %s\n", humanSize(before), humanSize(after))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const graftsFile = "info/grafts"
+
+var graftedParents map[string][]string
+
+// loadGrafts reads .git/info/grafts once: a commit per line, followed by
+// the parents history walks should see instead of its own, eg: to stitch a
+// partial history onto an older one without rewriting commits.
+//
+//	<commit sha> [<parent sha>...]
+//
+// A commit without parents is grafted as a root commit. Blank lines and
+// lines starting with '#' are skipped.
+//
+// Like in git, grafts are deprecated in favor of replace refs, see replace,
+// which can be shared, but they are still supported for compatibility.
+func loadGrafts() map[string][]string {
+	if graftedParents != nil {
+		return graftedParents
+	}
+	graftedParents = map[string][]string{}
+
+	content, err := os.ReadFile(gitPath(graftsFile))
+	if err != nil {
+		return graftedParents
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		shas := strings.Fields(line)
+		valid := true
+		for _, sha := range shas {
+			valid = valid && isObjectName(sha)
+		}
+		if !valid {
+			fmt.Fprintf(os.Stderr, "error: bad graft data: %s\n", line)
+			continue
+		}
+		graftedParents[shas[0]] = shas[1:]
+	}
+
+	if len(graftedParents) > 0 && configBool("advice.graftFileDeprecated", true) {
+		fmt.Fprintln(os.Stderr, "hint: Support for <GIT_DIR>/info/grafts is deprecated, use replace refs instead.")
+		fmt.Fprintln(os.Stderr, "hint: Turn this message off by running")
+		fmt.Fprintln(os.Stderr, "hint: \"git config advice.graftFileDeprecated false\"")
+	}
+	return graftedParents
+}
+
+// graftParents returns the parents a commit is grafted onto, if it is.
+func graftParents(sha string) ([]string, bool) {
+	parents, ok := loadGrafts()[sha]
+	return parents, ok
+}
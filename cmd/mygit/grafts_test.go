@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGraftRootOntoAnotherHistory(t *testing.T) {
+	testRepository(t)
+	if err := os.WriteFile(".git/config", []byte("[advice]\n\tgraftFileDeprecated = false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+	oldRoot := writeTestCommit(t, "old root")
+	oldTip := writeTestCommit(t, "old tip", oldRoot)
+	newRoot := writeTestCommit(t, "new root")
+	newTip := writeTestCommit(t, "new tip", newRoot)
+	if err := updateRef("refs/heads/main", newTip); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := captureStdout(t, func() { logCmd([]string{"--format=%s"}) }), "new tip\nnew root\n"; got != want {
+		t.Fatalf("before the graft, log printed\n%s\nexpected\n%s", got, want)
+	}
+
+	// the new root gets the old history as its parent
+	if err := os.MkdirAll(".git/info", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gitPath(graftsFile), []byte(newRoot+" "+oldTip+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	graftedParents = nil
+
+	if got, want := captureStdout(t, func() { logCmd([]string{"--format=%s"}) }), "new tip\nnew root\nold tip\nold root\n"; got != want {
+		t.Errorf("with the graft, log printed\n%s\nexpected\n%s", got, want)
+	}
+	if ancestor, err := isAncestor(oldRoot, newTip); err != nil || !ancestor {
+		t.Errorf("the old root isn't an ancestor of the new tip through the graft (%v)", err)
+	}
+
+	// the object itself is left as it is
+	_, content, err := readObject(newRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseCommit(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.parents) != 0 {
+		t.Errorf("the grafted commit was rewritten with parents %v", c.parents)
+	}
+}
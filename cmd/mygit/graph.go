@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// logGraph draws the history next to the commits of log --graph, the way
+// git's graph.c does:
+//
+//	$ git log --graph --oneline
+//	*   1d2c3b4 Merge branch 'side'
+//	|\
+//	| * 5e6f7a8 side work
+//	* | 9b0c1d2 main work
+//	|/
+//	* 3e4f5a6 initial commit
+//
+// Every commit is given to update, in the order they are shown, with its
+// parents that are shown too. nextLine then returns the lines of the graph
+// one at a time: the ones leading to the commit, the one of the commit and
+// the ones after it, until the branch lines are back in their columns.
+type logGraph struct {
+	commit          string
+	parents         []string
+	width           int
+	expansionRow    int
+	state           graphState
+	prevState       graphState
+	commitIndex     int
+	prevCommitIndex int
+	// the layout of a merge: 0 when the first parent is to the left of
+	// the merge commit, 1 when it goes straight down, -1 when not chosen yet
+	mergeLayout    int
+	edgesAdded     int
+	prevEdgesAdded int
+	// the branch lines, by the commit they lead to, before and after the
+	// commit
+	columns    []string
+	newColumns []string
+	// where each screen column of the line after the commit goes, the index
+	// of its column in newColumns or -1
+	mapping    []int
+	oldMapping []int
+}
+
+type graphState int
+
+const (
+	graphPadding graphState = iota
+	graphSkip
+	graphPreCommit
+	graphCommit
+	graphPostMerge
+	graphCollapsing
+)
+
+// the characters drawn from a merge to its parents, by layout
+var graphMergeChars = []byte{'/', '|', '\\'}
+
+func newLogGraph() *logGraph {
+	return &logGraph{}
+}
+
+// update moves the graph to the next commit shown, with the parents of it
+// that are shown.
+func (g *logGraph) update(sha string, parents []string) {
+	g.commit = sha
+	g.parents = parents
+	g.prevCommitIndex = g.commitIndex
+	g.updateColumns()
+	g.expansionRow = 0
+
+	switch {
+	case g.state != graphPadding:
+		// the lines of the previous commit weren't all shown
+		g.state = graphSkip
+	case g.needsPreCommitLine():
+		g.state = graphPreCommit
+	default:
+		g.state = graphCommit
+	}
+}
+
+// updateColumns lays out the branch lines after the commit: its parents
+// take its column, and the other ones are kept.
+func (g *logGraph) updateColumns() {
+	g.columns, g.newColumns = g.newColumns, g.columns[:0]
+
+	size := 2 * (len(g.columns) + len(g.parents))
+	g.mapping = make([]int, size)
+	for i := range g.mapping {
+		g.mapping[i] = -1
+	}
+	if len(g.oldMapping) < size {
+		g.oldMapping = append(g.oldMapping, make([]int, size-len(g.oldMapping))...)
+	}
+
+	g.width = 0
+	g.prevEdgesAdded = g.edgesAdded
+	g.edgesAdded = 0
+
+	seen := false
+	for i := 0; i <= len(g.columns); i++ {
+		var column string
+		if i == len(g.columns) {
+			if seen {
+				break
+			}
+			column = g.commit
+		} else {
+			column = g.columns[i]
+		}
+
+		if column != g.commit {
+			g.insertIntoNewColumns(column, -1)
+			continue
+		}
+		seen = true
+		g.commitIndex = i
+		g.mergeLayout = -1
+		for _, parent := range g.parents {
+			g.insertIntoNewColumns(parent, i)
+		}
+		// the commit takes at least its own column
+		if len(g.parents) == 0 {
+			g.width += 2
+		}
+	}
+
+	for len(g.mapping) > 1 && g.mapping[len(g.mapping)-1] < 0 {
+		g.mapping = g.mapping[:len(g.mapping)-1]
+	}
+}
+
+// insertIntoNewColumns adds the line to a commit to the columns after the
+// current commit, unless it already is there. index is the column of the
+// current commit when the commit is one of its parents, or -1.
+func (g *logGraph) insertIntoNewColumns(sha string, index int) {
+	i := g.findNewColumn(sha)
+	if i < 0 {
+		i = len(g.newColumns)
+		g.newColumns = append(g.newColumns, sha)
+	}
+
+	var mappingIndex int
+	switch {
+	case len(g.parents) > 1 && index > -1 && g.mergeLayout == -1:
+		// the first parent of a merge chooses its layout, depending on
+		// whether the parent is to the left of the merge
+		distance := index - i
+		shift := 1
+		if distance > 1 {
+			shift = 2*distance - 3
+		}
+		g.mergeLayout = 1
+		if distance > 0 {
+			g.mergeLayout = 0
+		}
+		g.edgesAdded = len(g.parents) + g.mergeLayout - 2
+
+		mappingIndex = g.width + (g.mergeLayout-1)*shift
+		g.width += 2 * g.mergeLayout
+	case g.edgesAdded > 0 && i == g.mapping[g.width-2]:
+		// the edges of the merge join the last existing column right away
+		mappingIndex = g.width - 2
+		g.edgesAdded = -1
+	default:
+		mappingIndex = g.width
+		g.width += 2
+	}
+	g.mapping[mappingIndex] = i
+}
+
+func (g *logGraph) findNewColumn(sha string) int {
+	for i, column := range g.newColumns {
+		if column == sha {
+			return i
+		}
+	}
+	return -1
+}
+
+// numDashedParents is the number of parents of an octopus merge drawn with
+// dashes, --.
+func (g *logGraph) numDashedParents() int {
+	return len(g.parents) + g.mergeLayout - 3
+}
+
+// needsPreCommitLine reports whether the graph must make room for an
+// octopus merge before its line.
+func (g *logGraph) needsPreCommitLine() bool {
+	return len(g.parents) >= 3 &&
+		g.commitIndex < len(g.columns)-1 &&
+		g.expansionRow < 2*g.numDashedParents()
+}
+
+// isMappingCorrect reports whether every branch line is in its column, or
+// one to the right of it, where a / gets it there on the next line.
+func (g *logGraph) isMappingCorrect() bool {
+	for i, target := range g.mapping {
+		if target >= 0 && target != i/2 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *logGraph) updateState(state graphState) {
+	g.prevState = g.state
+	g.state = state
+}
+
+// finished reports whether all the lines of the current commit were shown.
+func (g *logGraph) finished() bool {
+	return g.state == graphPadding
+}
+
+// nextLine returns the next line of the graph, padded to the width of the
+// lines of the current commit, and whether it's the line of the commit.
+func (g *logGraph) nextLine() (string, bool) {
+	var line strings.Builder
+	commitLine := false
+	switch g.state {
+	case graphPadding:
+		for range g.newColumns {
+			line.WriteString("| ")
+		}
+	case graphSkip:
+		g.writeSkipLine(&line)
+	case graphPreCommit:
+		g.writePreCommitLine(&line)
+	case graphCommit:
+		g.writeCommitLine(&line)
+		commitLine = true
+	case graphPostMerge:
+		g.writePostMergeLine(&line)
+	case graphCollapsing:
+		g.writeCollapsingLine(&line)
+	}
+	return g.pad(&line), commitLine
+}
+
+func (g *logGraph) pad(line *strings.Builder) string {
+	if line.Len() < g.width {
+		line.WriteString(strings.Repeat(" ", g.width-line.Len()))
+	}
+	return line.String()
+}
+
+// paddingLine returns a line that keeps every branch line as it is, to
+// show more lines of the current commit.
+func (g *logGraph) paddingLine() string {
+	if g.state != graphCommit {
+		line, _ := g.nextLine()
+		return line
+	}
+
+	var line strings.Builder
+	for _, column := range g.columns {
+		line.WriteByte('|')
+		if column == g.commit && len(g.parents) > 2 {
+			line.WriteString(strings.Repeat(" ", (len(g.parents)-2)*2))
+		} else {
+			line.WriteByte(' ')
+		}
+	}
+	g.prevState = graphPadding
+	return g.pad(&line)
+}
+
+// writeSkipLine writes ... where lines of the previous commit are missing.
+func (g *logGraph) writeSkipLine(line *strings.Builder) {
+	line.WriteString("...")
+	if g.needsPreCommitLine() {
+		g.updateState(graphPreCommit)
+	} else {
+		g.updateState(graphCommit)
+	}
+}
+
+// writePreCommitLine writes one of the lines moving the columns right of an
+// octopus merge away, two for every parent after the second.
+func (g *logGraph) writePreCommitLine(line *strings.Builder) {
+	seen := false
+	for i, column := range g.columns {
+		switch {
+		case column == g.commit:
+			seen = true
+			line.WriteByte('|')
+			line.WriteString(strings.Repeat(" ", g.expansionRow))
+		case seen && g.expansionRow == 0:
+			// the lines after a merge were \ on the line before
+			if g.prevState == graphPostMerge && g.prevCommitIndex < i {
+				line.WriteByte('\\')
+			} else {
+				line.WriteByte('|')
+			}
+		case seen:
+			line.WriteByte('\\')
+		default:
+			line.WriteByte('|')
+		}
+		line.WriteByte(' ')
+	}
+
+	g.expansionRow++
+	if !g.needsPreCommitLine() {
+		g.updateState(graphCommit)
+	}
+}
+
+func (g *logGraph) writeCommitLine(line *strings.Builder) {
+	seen := false
+	for i := 0; i <= len(g.columns); i++ {
+		var column string
+		if i == len(g.columns) {
+			if seen {
+				break
+			}
+			column = g.commit
+		} else {
+			column = g.columns[i]
+		}
+
+		switch {
+		case column == g.commit:
+			seen = true
+			line.WriteByte('*')
+			if len(g.parents) > 2 {
+				dashed := g.numDashedParents()
+				for j := 0; j < dashed; j++ {
+					line.WriteByte('-')
+					if j == dashed-1 {
+						line.WriteByte('.')
+					} else {
+						line.WriteByte('-')
+					}
+				}
+			}
+		case seen && g.edgesAdded > 1:
+			line.WriteByte('\\')
+		case seen && g.edgesAdded == 1:
+			// the line into the merge may have been \ after the
+			// previous merge
+			if g.prevState == graphPostMerge && g.prevEdgesAdded > 0 && g.prevCommitIndex < i {
+				line.WriteByte('\\')
+			} else {
+				line.WriteByte('|')
+			}
+		case g.prevState == graphCollapsing && g.oldMapping[2*i+1] == i && g.mapping[2*i] < i:
+			line.WriteByte('/')
+		default:
+			line.WriteByte('|')
+		}
+		line.WriteByte(' ')
+	}
+
+	switch {
+	case len(g.parents) > 1:
+		g.updateState(graphPostMerge)
+	case g.isMappingCorrect():
+		g.updateState(graphPadding)
+	default:
+		g.updateState(graphCollapsing)
+	}
+}
+
+// writePostMergeLine writes the line from a merge to its parents.
+func (g *logGraph) writePostMergeLine(line *strings.Builder) {
+	seen := false
+	for i := 0; i <= len(g.columns); i++ {
+		var column string
+		if i == len(g.columns) {
+			if seen {
+				break
+			}
+			column = g.commit
+		} else {
+			column = g.columns[i]
+		}
+
+		switch {
+		case column == g.commit:
+			seen = true
+			layout := g.mergeLayout
+			for j := range g.parents {
+				line.WriteByte(graphMergeChars[layout])
+				if layout == 2 {
+					if g.edgesAdded > 0 || j < len(g.parents)-1 {
+						line.WriteByte(' ')
+					}
+				} else {
+					layout++
+				}
+			}
+			if g.edgesAdded == 0 {
+				line.WriteByte(' ')
+			}
+		case seen:
+			if g.edgesAdded > 0 {
+				line.WriteByte('\\')
+			} else {
+				line.WriteByte('|')
+			}
+			line.WriteByte(' ')
+		default:
+			line.WriteByte('|')
+			if g.mergeLayout != 0 || i != g.commitIndex-1 {
+				line.WriteByte(' ')
+			}
+		}
+	}
+
+	if g.isMappingCorrect() {
+		g.updateState(graphPadding)
+	} else {
+		g.updateState(graphCollapsing)
+	}
+}
+
+// writeCollapsingLine writes a line moving the branch lines left, towards
+// their columns. Lines going to the same commit merge, and only one line
+// at a time crosses others, with _ when it has far to go.
+func (g *logGraph) writeCollapsingLine(line *strings.Builder) {
+	horizontalEdge := -1
+	horizontalEdgeTarget := -1
+	usedHorizontal := false
+
+	g.mapping, g.oldMapping = g.oldMapping[:len(g.mapping)], g.mapping
+	for i := range g.mapping {
+		g.mapping[i] = -1
+	}
+
+	for i, target := range g.oldMapping[:len(g.mapping)] {
+		if target < 0 {
+			continue
+		}
+
+		// branch lines only ever move left, so that when they cross
+		// only one of them changes direction
+		switch {
+		case target*2 == i:
+			g.mapping[i] = target
+		case g.mapping[i-1] < 0:
+			// nothing to the left, move left by one
+			g.mapping[i-1] = target
+			if horizontalEdge == -1 {
+				horizontalEdge = i
+				horizontalEdgeTarget = target
+				for j := target*2 + 3; j < i-2; j += 2 {
+					g.mapping[j] = target
+				}
+			}
+		case g.mapping[i-1] == target:
+			// the line to the left goes to the same commit, join it
+		default:
+			// cross the line to the left
+			g.mapping[i-2] = target
+			if horizontalEdge == -1 {
+				horizontalEdgeTarget = target
+				horizontalEdge = i - 1
+				for j := target*2 + 3; j < i-2; j += 2 {
+					g.mapping[j] = target
+				}
+			}
+		}
+	}
+
+	g.oldMapping = append(g.oldMapping[:0], g.mapping...)
+	if g.mapping[len(g.mapping)-1] < 0 {
+		g.mapping = g.mapping[:len(g.mapping)-1]
+	}
+
+	for i, target := range g.mapping {
+		switch {
+		case target < 0:
+			line.WriteByte(' ')
+		case target*2 == i:
+			line.WriteByte('|')
+		case target == horizontalEdgeTarget && i != horizontalEdge-1:
+			// only the first segment continues on the next line
+			if i != target*2+3 {
+				g.mapping[i] = -1
+			}
+			usedHorizontal = true
+			line.WriteByte('_')
+		default:
+			if usedHorizontal && i < horizontalEdge {
+				g.mapping[i] = -1
+			}
+			line.WriteByte('/')
+		}
+	}
+
+	if g.isMappingCorrect() {
+		g.updateState(graphPadding)
+	}
+}
+
+// writeCommit writes the lines of the graph leading to the commit and its
+// line, without a newline for the commit to follow.
+func (g *logGraph) writeCommit(w io.Writer) {
+	if g.finished() {
+		io.WriteString(w, g.paddingLine())
+		return
+	}
+	for !g.finished() {
+		line, commitLine := g.nextLine()
+		io.WriteString(w, line)
+		if commitLine {
+			return
+		}
+		io.WriteString(w, "\n")
+	}
+}
+
+// writeMessage writes the text shown for the commit after its line, with
+// the graph before every line of it, and then the lines of the graph
+// left for the commit.
+func (g *logGraph) writeMessage(w io.Writer, text []byte) {
+	terminated := bytes.HasSuffix(text, []byte("\n"))
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		w.Write(text[:end])
+		text = text[end:]
+		if len(text) > 0 {
+			line, _ := g.nextLine()
+			io.WriteString(w, line)
+		}
+	}
+
+	if g.finished() {
+		return
+	}
+	if !terminated {
+		io.WriteString(w, "\n")
+	}
+	g.writeRemainder(w)
+	if terminated {
+		io.WriteString(w, "\n")
+	}
+}
+
+// writeRemainder writes the lines of the graph left for the commit, without
+// a newline after the last one.
+func (g *logGraph) writeRemainder(w io.Writer) {
+	for !g.finished() {
+		line, _ := g.nextLine()
+		io.WriteString(w, line)
+		if !g.finished() {
+			io.WriteString(w, "\n")
+		}
+	}
+}
+
+// graphPrefixWriter writes the padding of the graph at the start of every
+// line, for the patches shown with log --graph.
+type graphPrefixWriter struct {
+	w       io.Writer
+	graph   *logGraph
+	midLine bool
+}
+
+func (p *graphPrefixWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if !p.midLine {
+			if _, err := io.WriteString(p.w, p.graph.paddingLine()); err != nil {
+				return written, err
+			}
+			p.midLine = true
+		}
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		} else {
+			p.midLine = false
+		}
+		n, err := p.w.Write(data[:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[end:]
+	}
+	return written, nil
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"crypto/sha1"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // findNullByteIndex goes and find the first location in a byte-array
@@ -24,3 +28,184 @@ func sha1Hash(text []byte) []byte {
 
 	return []byte(hash)
 }
+
+// isTerminal reports whether the file is a terminal, as opposed to a pipe,
+// a regular file or another character device, eg: /dev/null. Like isatty,
+// a terminal is what has terminal attributes, see hasTermios.
+func isTerminal(file *os.File) bool {
+	return hasTermios(file)
+}
+
+// optionalString is a flag that can be given both as `--flag` and as
+// `--flag=<value>`, eg: `--batch-check` and `--batch-check=<format>`.
+type optionalString struct {
+	set   bool
+	value string
+}
+
+func (o *optionalString) String() string {
+	return o.value
+}
+
+func (o *optionalString) Set(value string) error {
+	o.set = true
+	if value != "true" {
+		o.value = value
+	}
+	return nil
+}
+
+// IsBoolFlag lets the flag package accept the flag without a value.
+func (o *optionalString) IsBoolFlag() bool {
+	return true
+}
+
+// expandShortFlags splits combined single-letter flags the way git accepts
+// them, eg: `-fdx` becomes `-f -d -x`, as long as every letter is in letters.
+//
+// The flag package only knows about one flag per argument.
+func expandShortFlags(args []string, letters string) []string {
+	var expanded []string
+	for i, arg := range args {
+		if arg == "--" {
+			return append(expanded, args[i:]...)
+		}
+		if len(arg) < 3 || arg[0] != '-' || arg[1] == '-' || strings.Trim(arg[1:], letters) != "" {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		for _, letter := range arg[1:] {
+			expanded = append(expanded, "-"+string(letter))
+		}
+	}
+	return expanded
+}
+
+// gitDateLayouts are the absolute dates parseGitDate accepts, besides
+// timestamps. Those without a timezone are in local time.
+var gitDateLayouts = []string{
+	time.RFC1123Z, // Mon, 02 Jan 2006 15:04:05 -0700, as in emails
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	gitDateFormat, // Mon Jan 2 15:04:05 2006 -0700, as log shows them
+	time.RFC3339,  // 2006-01-02T15:04:05+02:00
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// gitDateUnits are the units of relative dates, eg: `2 weeks ago`.
+var gitDateUnits = map[string]func(t time.Time, n int) time.Time{
+	"second": func(t time.Time, n int) time.Time { return t.Add(-time.Duration(n) * time.Second) },
+	"minute": func(t time.Time, n int) time.Time { return t.Add(-time.Duration(n) * time.Minute) },
+	"hour":   func(t time.Time, n int) time.Time { return t.Add(-time.Duration(n) * time.Hour) },
+	"day":    func(t time.Time, n int) time.Time { return t.AddDate(0, 0, -n) },
+	"week":   func(t time.Time, n int) time.Time { return t.AddDate(0, 0, -7*n) },
+	"month":  func(t time.Time, n int) time.Time { return t.AddDate(0, -n, 0) },
+	"year":   func(t time.Time, n int) time.Time { return t.AddDate(-n, 0, 0) },
+}
+
+// parseGitDate parses a date the way git commands accept them, eg: for
+// `log --since`:
+//
+//	1705316400                       a Unix timestamp, or @1705316400
+//	1705316400 +0200                 a timestamp and a timezone, as in commits
+//	Mon, 15 Jan 2024 13:00:00 +0200  RFC 2822
+//	2024-01-15 13:00:00 +0200        ISO 8601, or 2024-01-15T13:00:00+02:00
+//	2024-01-15                       that day, at the current time like git
+//	2 weeks ago                      relative to now, also 2.weeks.ago
+//	yesterday, last week, last monday, noon yesterday
+//
+// Relative dates count seconds, minutes, hours, days, weeks, months and
+// years back from now, in local time.
+func parseGitDate(s string) (time.Time, error) {
+	value := strings.TrimSpace(s)
+	now := time.Now()
+
+	fields := strings.Fields(strings.TrimPrefix(value, "@"))
+	if len(fields) == 1 || len(fields) == 2 && len(fields[1]) == 5 {
+		if timestamp, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			if len(fields) == 1 {
+				return time.Unix(timestamp, 0), nil
+			}
+			zone, err := time.Parse("-0700", fields[1])
+			if err == nil {
+				return time.Unix(timestamp, 0).In(zone.Location()), nil
+			}
+		}
+	}
+
+	for _, layout := range gitDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if day, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return time.Date(day.Year(), day.Month(), day.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.Local), nil
+	}
+
+	t, number := now, -1
+	words := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool { return r == ' ' || r == '.' })
+	if len(words) == 0 {
+		return time.Time{}, fmt.Errorf("invalid date '%s'", s)
+	}
+	for _, word := range words {
+		if n, err := strconv.Atoi(word); err == nil {
+			number = n
+			continue
+		}
+
+		switch word {
+		case "now", "today", "ago":
+			continue
+		case "last":
+			number = 1
+			continue
+		case "yesterday":
+			t = t.AddDate(0, 0, -1)
+			continue
+		case "noon", "midnight":
+			hour := 12
+			if word == "midnight" {
+				hour = 0
+			}
+			// the latest one, eg: noon yesterday before noon
+			day := time.Date(t.Year(), t.Month(), t.Day(), hour, 0, 0, 0, time.Local)
+			if day.After(t) {
+				day = day.AddDate(0, 0, -1)
+			}
+			t = day
+			continue
+		}
+
+		if back, ok := gitDateUnits[strings.TrimSuffix(word, "s")]; ok && number >= 0 {
+			t, number = back(t, number), -1
+			continue
+		}
+
+		weekday := -1
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if len(word) >= 3 && strings.HasPrefix(strings.ToLower(day.String()), word) {
+				weekday = int(day)
+			}
+		}
+		if weekday < 0 {
+			return time.Time{}, fmt.Errorf("invalid date '%s'", s)
+		}
+		// like git, `last monday` is the latest monday before today, and a
+		// plain `monday` doesn't go back at all
+		days := (int(t.Weekday()) - weekday + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		if number > 0 {
+			t = t.AddDate(0, 0, -days-7*(number-1))
+		}
+		number = -1
+	}
+
+	return t, nil
+}
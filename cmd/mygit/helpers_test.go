@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRepository makes an empty repository in a temporary directory the
+// current one, for the time of a test, the way `git init` would, with HOME
+// pointing at it so no global config gets in the way, and an ident set.
+func testRepository(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", dir)
+	for _, role := range []string{"AUTHOR", "COMMITTER"} {
+		t.Setenv("GIT_"+role+"_NAME", "A U Thor")
+		t.Setenv("GIT_"+role+"_EMAIL", "author@example.com")
+	}
+	t.Cleanup(func() {
+		os.Chdir(previous)
+		setupGitDir()
+	})
+
+	for _, folder := range []string{".git/objects", ".git/refs/heads", ".git/refs/tags"} {
+		if err := os.MkdirAll(folder, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(".git/HEAD", []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupGitDir(); err != nil {
+		t.Fatal(err)
+	}
+	commitGraphLoaded, commitGraphCache = false, nil
+	graftedParents = nil
+	return dir
+}
+
+// memoryObjects makes the objects of the repository an empty MemoryStore
+// for the time of a test, so what it writes never reaches the disk.
+func memoryObjects(t *testing.T) *MemoryStore {
+	t.Helper()
+	previous := objects
+	store := NewMemoryStore()
+	objects = store
+	t.Cleanup(func() { objects = previous })
+	return store
+}
+
+// testCommitTime is when the commits of writeTestCommit are made, one second
+// apart from each other.
+var testCommitTime int64 = 1700000000
+
+// writeTestCommit stores a commit of the empty tree, with the given
+// parents, and returns its sha.
+func writeTestCommit(t testing.TB, message string, parents ...string) string {
+	t.Helper()
+	tree, err := writeObject("tree", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommitTime++
+	ident := fmt.Sprintf("A U Thor <author@example.com> %d +0000", testCommitTime)
+	c := &commit{tree: tree, parents: parents, author: ident, committer: ident, message: message + "\n"}
+	sha, err := writeObject("commit", c.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// writeTestFiles writes files of the work tree, by path.
+func writeTestFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fileExists tells whether a path of the work tree is there.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// captureStdout returns what run writes to stdout, eg: the output of a
+// command.
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(r)
+		output <- string(content)
+	}()
+
+	defer func() {
+		os.Stdout = previous
+	}()
+	run()
+	w.Close()
+	return <-output
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// hookPath returns the path of a hook, eg: .git/hooks/pre-receive, when
+// there is one and it is executable. core.hooksPath moves the hooks to
+// another folder.
+func hookPath(name string) (string, bool) {
+	dir, ok := configGet("core.hooksPath")
+	if !ok {
+		dir = gitPath("hooks")
+	}
+
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return "", false
+	}
+	return path, true
+}
+
+// runHookWith runs a hook with the given arguments and stdin, from the top
+// of the work tree and with GIT_DIR set. Its stdout and stderr both go to
+// output. A missing hook counts as a success.
+func runHookWith(name string, stdin []byte, output io.Writer, args ...string) error {
+	path, ok := hookPath(name)
+	if !ok {
+		return nil
+	}
+	dir, err := filepath.Abs(gitDir)
+	if err != nil {
+		return err
+	}
+
+	trace("run hook %s", name)
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+dir)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %s", name, err)
+	}
+	return nil
+}
+
+// runHook runs a hook the way git runs most of them, without stdin and
+// with its output on stderr, so that it doesn't mix with the output of the
+// command, eg:
+//
+//	pre-commit                      before a commit, can refuse it
+//	commit-msg <message file>       can edit or refuse the message
+//	post-commit                     once the commit is made
+//	post-checkout <old> <new> <1>   once a commit is checked out
+//	pre-rebase <upstream>           before a rebase, can refuse it
+//
+// A missing hook counts as a success.
+func runHook(name string, args ...string) error {
+	return runHookWith(name, nil, os.Stderr, args...)
+}
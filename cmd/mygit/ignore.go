@@ -0,0 +1,308 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is a single pattern from a .gitignore (or exclude) file.
+type ignoreRule struct {
+	pattern  string
+	negate   bool   // `!pattern` re-includes what an earlier pattern excluded
+	dirOnly  bool   // `pattern/` only matches directories
+	anchored bool   // a pattern with a slash matches the path relative to base, not the basename
+	base     string // directory of the .gitignore, "" for the top-level one
+	source   string // file the pattern came from
+	line     int
+	text     string // the pattern as written, eg: !/build/
+}
+
+// parseIgnoreFile parses the content of a .gitignore file found in base.
+//
+// Blank lines and lines starting with '#' are skipped, trailing spaces are
+// dropped unless escaped with a backslash.
+func parseIgnoreFile(content []byte, base string, source string) []ignoreRule {
+	var rules []ignoreRule
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		rule := ignoreRule{base: base, source: source, line: i + 1, text: line}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// matches checks the rule against a path relative to the top of the repository.
+func (r ignoreRule) matches(name string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.base != "" {
+		if !strings.HasPrefix(name, r.base+"/") {
+			return false
+		}
+		name = name[len(r.base)+1:]
+	}
+
+	if r.anchored {
+		return wildmatch(r.pattern, name)
+	}
+	return wildmatch(r.pattern, path.Base(name))
+}
+
+// ignoreMatcher decides which paths are ignored, using (from the highest to
+// the lowest precedence):
+//
+//   - the .gitignore of the path's directory, then of its parents up to the top
+//   - .git/info/exclude
+//   - core.excludesFile (defaults to ~/.config/git/ignore)
+//
+// Within a file the last matching pattern wins. The per-directory .gitignore
+// files are loaded lazily the first time a path in that directory is checked.
+type ignoreMatcher struct {
+	perDir map[string][]ignoreRule
+	global []ignoreRule
+}
+
+func newIgnoreMatcher() *ignoreMatcher {
+	m := &ignoreMatcher{perDir: map[string][]ignoreRule{}}
+
+	excludesFile, ok := configGet("core.excludesfile")
+	if ok && strings.HasPrefix(excludesFile, "~/") {
+		home, _ := os.UserHomeDir()
+		excludesFile = filepath.Join(home, excludesFile[2:])
+	}
+	if !ok {
+		configHome := os.Getenv("XDG_CONFIG_HOME")
+		if configHome == "" {
+			home, _ := os.UserHomeDir()
+			configHome = filepath.Join(home, ".config")
+		}
+		excludesFile = filepath.Join(configHome, "git", "ignore")
+	}
+
+	// global is kept in file order, so the last rule has the highest precedence
+	for _, file := range []string{excludesFile, gitPath("info/exclude")} {
+		if content, err := os.ReadFile(file); err == nil {
+			m.global = append(m.global, parseIgnoreFile(content, "", file)...)
+		}
+	}
+
+	return m
+}
+
+// rulesFor returns the rules of the .gitignore in dir ("" for the top-level).
+func (m *ignoreMatcher) rulesFor(dir string) []ignoreRule {
+	if rules, loaded := m.perDir[dir]; loaded {
+		return rules
+	}
+
+	file := path.Join(dir, ".gitignore")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		m.perDir[dir] = nil
+		return nil
+	}
+
+	m.perDir[dir] = parseIgnoreFile(content, dir, file)
+	return m.perDir[dir]
+}
+
+// match returns the rule that decides whether the path itself is ignored,
+// or nil if no pattern matches. A negated rule means the path is included.
+//
+// This does not look at the parent directories, see isIgnored.
+func (m *ignoreMatcher) match(name string, isDir bool) *ignoreRule {
+	dir := path.Dir(name)
+	for {
+		if dir == "." {
+			dir = ""
+		}
+
+		rules := m.rulesFor(dir)
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].matches(name, isDir) {
+				return &rules[i]
+			}
+		}
+
+		if dir == "" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+
+	for i := len(m.global) - 1; i >= 0; i-- {
+		if m.global[i].matches(name, isDir) {
+			return &m.global[i]
+		}
+	}
+
+	return nil
+}
+
+// isIgnored reports whether a path is ignored, either by itself or because
+// one of its parent directories is. Like git, a file can't be re-included
+// when its directory is excluded.
+func (m *ignoreMatcher) isIgnored(name string, isDir bool) bool {
+	rule := m.decidingRule(name, isDir)
+	return rule != nil && !rule.negate
+}
+
+// decidingRule returns the rule that decides whether a path is ignored: the
+// one excluding a parent directory, else the one matching the path itself,
+// see match. It's nil when no pattern matches.
+func (m *ignoreMatcher) decidingRule(name string, isDir bool) *ignoreRule {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if rule := m.match(strings.Join(parts[:i], "/"), true); rule != nil && !rule.negate {
+			return rule
+		}
+	}
+	return m.match(name, isDir)
+}
+
+// wildmatch matches a path against a gitignore-style glob:
+//
+//	a*.go    '*' matches anything except '/'
+//	a?.go    '?' matches any single character except '/'
+//	[a-z]    a character class, [!a-z] or [^a-z] negates it
+//	a/**/b   '**' matches anything including '/', so this matches a/b, a/x/b and a/x/y/b
+//	\#       a backslash makes the next character literal
+func wildmatch(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			if strings.HasPrefix(pattern, "**") {
+				rest := pattern[2:]
+				if strings.HasPrefix(rest, "/") && wildmatch(rest[1:], name) {
+					return true
+				}
+				for i := 0; i <= len(name); i++ {
+					if wildmatch(rest, name[i:]) {
+						return true
+					}
+				}
+				return false
+			}
+
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if wildmatch(rest, name[i:]) {
+					return true
+				}
+				if i < len(name) && name[i] == '/' {
+					break
+				}
+			}
+			return false
+
+		case '?':
+			if name == "" || name[0] == '/' {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+
+		case '[':
+			end, matched, ok := matchCharClass(pattern, name)
+			if !ok {
+				// no closing bracket, treat '[' as a literal
+				if name == "" || name[0] != '[' {
+					return false
+				}
+				pattern, name = pattern[1:], name[1:]
+				continue
+			}
+			if !matched {
+				return false
+			}
+			pattern, name = pattern[end:], name[1:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+
+	return name == ""
+}
+
+// matchCharClass matches the first character of name against the [...] class
+// at the start of pattern. It returns the length of the class in the pattern,
+// whether it matched, and false if the class isn't closed.
+func matchCharClass(pattern string, name string) (int, bool, bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	first := true
+	for ; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == ']' && !first {
+			if name == "" || name[0] == '/' {
+				return i + 1, false, true
+			}
+			return i + 1, matched != negate, true
+		}
+		first = false
+
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			if name != "" && c <= name[0] && name[0] <= pattern[i+2] {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+
+		if name != "" && name[0] == c {
+			matched = true
+		}
+	}
+
+	return 0, false, false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const indexFile = "index"
+
+// indexEntry is a single file in the index (the staging area).
+type indexEntry struct {
+	ctimeSec, ctimeNsec uint32
+	mtimeSec, mtimeNsec uint32
+	dev, ino            uint32
+	mode                uint32
+	uid, gid            uint32
+	size                uint32
+	sha                 string
+	flags               uint16
+	extendedFlags       uint16
+	path                string
+}
+
+// stage returns the merge stage of the entry: 0 for a normal entry,
+// 1 (base), 2 (ours) and 3 (theirs) for the sides of a conflict.
+func (e indexEntry) stage() int {
+	return int(e.flags>>12) & 0x3
+}
+
+// index is the parsed content of .git/index.
+type index struct {
+	version uint32
+	entries []indexEntry
+}
+
+// readIndex reads and parses .git/index.
+//
+// A missing index is simply empty. The format is:
+//
+//	header:  "DIRC" <version> <number of entries>
+//	entries: sorted by path, see parseIndexEntry
+//	extensions (skipped)
+//	trailer: SHA-1 checksum of everything above
+func readIndex() (*index, error) {
+	content, err := os.ReadFile(gitPath(indexFile))
+	if os.IsNotExist(err) {
+		return &index{version: 2}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) < 12+sha1.Size || string(content[:4]) != "DIRC" {
+		return nil, fmt.Errorf("bad index file signature")
+	}
+
+	checksum := sha1.Sum(content[:len(content)-sha1.Size])
+	if !bytes.Equal(checksum[:], content[len(content)-sha1.Size:]) {
+		return nil, fmt.Errorf("bad index file sha1 signature")
+	}
+
+	idx := &index{version: binary.BigEndian.Uint32(content[4:8])}
+	if idx.version < 2 || idx.version > 4 {
+		return nil, fmt.Errorf("index file version %d is not supported", idx.version)
+	}
+
+	count := binary.BigEndian.Uint32(content[8:12])
+	data := content[12 : len(content)-sha1.Size]
+	previousPath := ""
+	for i := uint32(0); i < count; i++ {
+		entry, size, err := parseIndexEntry(data, idx.version, previousPath)
+		if err != nil {
+			return nil, err
+		}
+
+		idx.entries = append(idx.entries, entry)
+		previousPath = entry.path
+		data = data[size:]
+	}
+
+	return idx, nil
+}
+
+// parseIndexEntry parses one index entry and returns how many bytes it took:
+//
+//	ctime, mtime (seconds + nanoseconds), dev, ino, mode, uid, gid, size (32-bit each)
+//	20-byte sha
+//	16-bit flags: assume-valid, extended, 2-bit stage, 12-bit name length
+//	16-bit extended flags (version 3+, when the extended flag is set)
+//	path, NUL-terminated and padded to a multiple of 8 bytes (versions 2 and 3)
+//
+// Version 4 drops the padding and prefix-compresses the path against the
+// previous entry: a varint of bytes to strip from it, then the new suffix.
+func parseIndexEntry(data []byte, version uint32, previousPath string) (indexEntry, int, error) {
+	if len(data) < 62 {
+		return indexEntry{}, 0, fmt.Errorf("truncated index entry")
+	}
+
+	fields := make([]uint32, 10)
+	for i := range fields {
+		fields[i] = binary.BigEndian.Uint32(data[i*4:])
+	}
+
+	entry := indexEntry{
+		ctimeSec: fields[0], ctimeNsec: fields[1],
+		mtimeSec: fields[2], mtimeNsec: fields[3],
+		dev: fields[4], ino: fields[5],
+		mode: fields[6],
+		uid:  fields[7], gid: fields[8],
+		size:  fields[9],
+		sha:   hex.EncodeToString(data[40:60]),
+		flags: binary.BigEndian.Uint16(data[60:62]),
+	}
+
+	offset := 62
+	if entry.flags&0x4000 != 0 {
+		if version < 3 || len(data) < 64 {
+			return indexEntry{}, 0, fmt.Errorf("bad extended index entry")
+		}
+		entry.extendedFlags = binary.BigEndian.Uint16(data[62:64])
+		offset = 64
+	}
+
+	if version == 4 {
+		strip, n := binary.Uvarint(data[offset:])
+		if n <= 0 || int(strip) > len(previousPath) {
+			return indexEntry{}, 0, fmt.Errorf("bad compressed path in index entry")
+		}
+		offset += n
+
+		end := bytes.IndexByte(data[offset:], 0)
+		if end < 0 {
+			return indexEntry{}, 0, fmt.Errorf("unterminated path in index entry")
+		}
+		entry.path = previousPath[:len(previousPath)-int(strip)] + string(data[offset:offset+end])
+		return entry, offset + end + 1, nil
+	}
+
+	end := bytes.IndexByte(data[offset:], 0)
+	if end < 0 {
+		return indexEntry{}, 0, fmt.Errorf("unterminated path in index entry")
+	}
+	entry.path = string(data[offset : offset+end])
+
+	// pad with 1 to 8 NUL bytes so the entry length is a multiple of 8
+	size := (offset + end + 8) &^ 7
+	if size > len(data) {
+		return indexEntry{}, 0, fmt.Errorf("truncated index entry")
+	}
+	return entry, size, nil
+}
+
+// trackedPaths returns the set of paths in the index, and the set of
+// directories that contain at least one of them.
+func (idx *index) trackedPaths() (map[string]bool, map[string]bool) {
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+
+	for _, entry := range idx.entries {
+		files[entry.path] = true
+
+		dir := entry.path
+		for {
+			slash := strings.LastIndexByte(dir, '/')
+			if slash < 0 {
+				break
+			}
+			dir = dir[:slash]
+			dirs[dir] = true
+		}
+	}
+
+	return files, dirs
+}
+
+// writeIndex writes the index to .git/index, in version 2 without any
+// extension. The entries must be sorted by path.
+func writeIndex(idx *index) error {
+	defer tracePerformance(time.Now(), "write index")
+	trace("write index %s, %d entries", gitPath(indexFile), len(idx.entries))
+
+	var content bytes.Buffer
+	content.WriteString("DIRC")
+	binary.Write(&content, binary.BigEndian, uint32(2))
+	binary.Write(&content, binary.BigEndian, uint32(len(idx.entries)))
+
+	for _, entry := range idx.entries {
+		start := content.Len()
+		for _, field := range []uint32{
+			entry.ctimeSec, entry.ctimeNsec, entry.mtimeSec, entry.mtimeNsec,
+			entry.dev, entry.ino, entry.mode, entry.uid, entry.gid, entry.size,
+		} {
+			binary.Write(&content, binary.BigEndian, field)
+		}
+		sha, err := hex.DecodeString(entry.sha)
+		if err != nil || len(sha) != sha1.Size {
+			return fmt.Errorf("bad sha '%s' for '%s' in index", entry.sha, entry.path)
+		}
+		content.Write(sha)
+
+		// the flags end with the length of the path, capped at 0xfff
+		flags := entry.flags&^0x4fff | uint16(min(len(entry.path), 0xfff))
+		binary.Write(&content, binary.BigEndian, flags)
+		content.WriteString(entry.path)
+
+		// pad with 1 to 8 NUL bytes so the entry length is a multiple of 8
+		size := (content.Len() - start + 8) &^ 7
+		content.Write(make([]byte, size-(content.Len()-start)))
+	}
+
+	checksum := sha1.Sum(content.Bytes())
+	content.Write(checksum[:])
+	return os.WriteFile(gitPath(indexFile), content.Bytes(), 0644)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// indexPack implements `git index-pack [-v] [-o <idx>] <pack>` and
+// `git index-pack --stdin [-v] [<pack>]`
+//
+// It reads a packfile, verifies its trailing checksum, resolves all deltas
+// to learn the name of every object and writes the matching .idx next to
+// the pack. That's what makes a downloaded pack usable by the repository.
+//
+// With --stdin the pack is read from stdin and stored as
+// .git/objects/pack/pack-<checksum>.pack, unless a path is given.
+//
+// With -v, the progress of indexing the objects and resolving the deltas
+// is reported on stderr.
+func indexPack(args []string) {
+	flag := flag.NewFlagSet("git index-pack", flag.ExitOnError)
+	var (
+		stdin   = flag.Bool("stdin", false, "read the pack from stdin and store it in the repository")
+		output  = flag.String("o", "", "write the index to `<idx>`")
+		verbose = flag.Bool("v", false, "report progress")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if !*stdin && len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git index-pack [-v] [-o <idx>] <pack>")
+		fmt.Fprintln(os.Stderr, "   or: git index-pack --stdin [-v] [<pack>]")
+		os.Exit(1)
+	}
+	defer tracePerformance(time.Now(), "index-pack")
+
+	var pack []byte
+	var err error
+	if *stdin {
+		pack, err = io.ReadAll(os.Stdin)
+	} else {
+		pack, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		error := fmt.Sprintf("Failed to read pack: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	var progress io.Writer
+	if *verbose {
+		progress = os.Stderr
+	}
+	entries, checksum, err := parsePack(pack, progress)
+	if err == nil {
+		err = resolvePackDeltas(entries, progress)
+	}
+	if err != nil {
+		error := fmt.Sprintf("Failed to index pack: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+	name := hex.EncodeToString(checksum)
+
+	packPath := ""
+	if len(args) > 0 {
+		packPath = args[0]
+	}
+	if *stdin {
+		if packPath == "" {
+			packPath = filepath.Join(gitPath(packDir), "pack-"+name+".pack")
+		}
+		err = os.MkdirAll(filepath.Dir(packPath), 0750)
+		if err == nil {
+			err = writeObjectFile(packPath, pack, 0444)
+		}
+		if err != nil {
+			error := fmt.Sprintf("Failed to write pack: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+	}
+
+	indexPath := *output
+	if indexPath == "" {
+		indexPath = strings.TrimSuffix(packPath, ".pack") + ".idx"
+	}
+
+	err = writePackIndex(indexPath, entries, checksum)
+	if err != nil {
+		error := fmt.Sprintf("Failed to write index '%s': %s", indexPath, err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	if *stdin {
+		fmt.Printf("pack\t%s\n", name)
+	} else {
+		fmt.Println(name)
+	}
+}
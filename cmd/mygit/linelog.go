@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lineRange is a range of lines of a file, counted from 0, end excluded.
+type lineRange struct {
+	start int
+	end   int
+}
+
+// lineHunk is a run of changed lines between two versions of a file: the
+// lines [aStart, aEnd) of the old one became [bStart, bEnd) of the new one.
+type lineHunk struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// trackedLines are the line ranges followed through history, per path.
+type trackedLines map[string][]lineRange
+
+// add adds a range to the ones of path, merging the ranges that overlap or
+// touch.
+func (t trackedLines) add(path string, r lineRange) {
+	ranges := append(t[path], r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end {
+			last.end = max(last.end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	t[path] = merged
+}
+
+// parseLineRange parses the argument of -L for the given lines of path:
+//
+//	<start>,<end>:<file>      lines start to end, counted from 1
+//	<start>,+<count>:<file>   count lines from start
+func parseLineRange(spec string, path string, lines []string) (lineRange, error) {
+	bounds, _, _ := strings.Cut(spec, ":")
+	from, to, found := strings.Cut(bounds, ",")
+	if !found {
+		return lineRange{}, fmt.Errorf("-L argument not 'start,end:file': %s", spec)
+	}
+
+	start, err := strconv.Atoi(from)
+	if err != nil || start < 1 {
+		return lineRange{}, fmt.Errorf("-L invalid start '%s'", from)
+	}
+	if start > len(lines) {
+		return lineRange{}, fmt.Errorf("file %s has only %d lines", path, len(lines))
+	}
+
+	var end int
+	if count, relative := strings.CutPrefix(to, "+"); relative {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return lineRange{}, fmt.Errorf("-L invalid end '%s'", to)
+		}
+		end = start + n - 1
+	} else if end, err = strconv.Atoi(to); err != nil || end < start {
+		return lineRange{}, fmt.Errorf("-L invalid end '%s'", to)
+	}
+
+	return lineRange{start: start - 1, end: min(end, len(lines))}, nil
+}
+
+// diffHunks returns the runs of changed lines between a and b.
+func diffHunks(a []string, b []string) []lineHunk {
+	removed, added := diffLines(a, b)
+
+	var hunks []lineHunk
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		h := lineHunk{aStart: i, bStart: j}
+		for ; i < len(a) && removed[i]; i++ {
+		}
+		for ; j < len(b) && added[j]; j++ {
+		}
+		h.aEnd, h.bEnd = i, j
+		if h.aEnd > h.aStart || h.bEnd > h.bStart {
+			hunks = append(hunks, h)
+		}
+		if i < len(a) && j < len(b) {
+			i++
+			j++
+		}
+	}
+	return hunks
+}
+
+// mapLineRange finds where the lines of r, in the new version of a file,
+// come from in the old one, and whether a hunk changed any of them.
+//
+// Unchanged lines just move by the lines added and removed before them. A
+// hunk touching the range brings in all the old lines it replaced, so the
+// old range may be larger, or empty when all the lines were added.
+func mapLineRange(r lineRange, hunks []lineHunk) (lineRange, bool) {
+	// offset is how much further the old lines are than the new ones
+	offset := 0
+	var mapped lineRange
+	touched := false
+
+	for _, h := range hunks {
+		inRange := h.bStart < r.end && h.bEnd > r.start
+		if h.bStart == h.bEnd {
+			// a deletion only counts between two lines of the range
+			inRange = h.bStart > r.start && h.bStart < r.end
+		}
+		if !inRange && h.bStart >= r.end {
+			break
+		}
+
+		if inRange && !touched {
+			mapped.start = min(h.aStart, r.start+offset)
+			touched = true
+		}
+		offset += (h.aEnd - h.aStart) - (h.bEnd - h.bStart)
+		if inRange {
+			mapped.end = max(h.aEnd, r.end+offset)
+		}
+	}
+
+	if !touched {
+		return lineRange{start: r.start + offset, end: r.end + offset}, false
+	}
+	return mapped, true
+}
+
+// writeLineRangeDiff writes the part of the diff between a and b that is
+// in the given ranges, one hunk per range, with all the lines of the range
+// instead of a few lines of context.
+func writeLineRangeDiff(w io.Writer, fromPath string, toPath string, a []string, b []string, ranges [][2]lineRange) {
+	fromName, toName := "a/"+fromPath, "b/"+toPath
+	newFile := fromPath == ""
+	if newFile {
+		fromName, fromPath = "/dev/null", toPath
+	}
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n--- %s\n+++ %s\n", fromPath, toPath, fromName, toName)
+
+	script := editScript(a, b, nil)
+	for _, pair := range ranges {
+		from, to := pair[0], pair[1]
+		fromHeader := fmt.Sprintf("%d,%d", from.start+1, from.end-from.start)
+		if newFile {
+			fromHeader = "0,0"
+		}
+		fmt.Fprintf(w, "@@ -%s +%d,%d @@\n", fromHeader, to.start+1, to.end-to.start)
+
+		i, j := 0, 0
+		for _, line := range script {
+			inFrom, inTo := i >= from.start && i < from.end, j >= to.start && j < to.end
+			show := (line.kind == '-' && inFrom) || (line.kind == '+' && inTo) || (line.kind == ' ' && inFrom && inTo)
+			if show {
+				fmt.Fprintf(w, "%c%s", line.kind, line.text)
+				if !strings.HasSuffix(line.text, "\n") {
+					fmt.Fprintln(w)
+				}
+			}
+			if line.kind != '+' {
+				i++
+			}
+			if line.kind != '-' {
+				j++
+			}
+		}
+	}
+}
+
+// blobLines reads the lines of the file at path in a tree, and returns
+// false when there's no such file.
+func blobLines(tree string, path string) ([]string, bool, error) {
+	entry, found, err := lookupTreePath(tree, path)
+	if err != nil || !found || entry.isTree() {
+		return nil, false, err
+	}
+
+	content, err := readBlob(entry.sha)
+	if err != nil {
+		return nil, false, err
+	}
+	return splitLines(content), true, nil
+}
+
+// findRenameSource looks for the file a new file at path was renamed from:
+// a file deleted from the parent tree with the same content, or else the
+// one with the most lines in common, if at least half of them.
+func findRenameSource(parentTree string, tree string, path string, lines []string) (string, []string, error) {
+	changes, err := diffTrees(parentTree, tree, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	bestPath, bestLines, bestScore := "", []string(nil), 0.5
+	for _, change := range changes {
+		if change.status != 'D' || change.old.mode == modeSubmodule {
+			continue
+		}
+
+		content, err := readBlob(change.old.sha)
+		if err != nil {
+			return "", nil, err
+		}
+		candidate := splitLines(content)
+
+		removed, _ := diffLines(candidate, lines)
+		common := 0
+		for _, r := range removed {
+			if !r {
+				common++
+			}
+		}
+		score := 1.0
+		if total := len(candidate) + len(lines); total > 0 {
+			score = float64(2*common) / float64(total)
+		}
+		if score >= bestScore {
+			bestPath, bestLines, bestScore = change.path, candidate, score
+			if score == 1 {
+				break
+			}
+		}
+	}
+	return bestPath, bestLines, nil
+}
+
+// lineChange is how the tracked lines of one file changed between a commit
+// and one of its parents.
+type lineChange struct {
+	fromPath string
+	toPath   string
+	from     []string
+	to       []string
+	ranges   [][2]lineRange
+	touched  bool
+}
+
+// traceLines maps the tracked lines of a commit's tree to the tree of one
+// of its parents, "" for a root commit. It returns the lines to track in
+// the parent, and how each file changed.
+func traceLines(tracked trackedLines, parentTree string, tree string) (trackedLines, []lineChange, error) {
+	parentTracked := trackedLines{}
+	var changes []lineChange
+
+	paths := make([]string, 0, len(tracked))
+	for path := range tracked {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		lines, _, err := blobLines(tree, path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		change := lineChange{fromPath: path, toPath: path, to: lines}
+		parentLines, found, err := blobLines(parentTree, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !found {
+			change.fromPath = ""
+			if parentTree != "" {
+				change.fromPath, parentLines, err = findRenameSource(parentTree, tree, path, lines)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		change.from = parentLines
+
+		hunks := diffHunks(parentLines, lines)
+		for _, r := range tracked[path] {
+			parentRange, touched := mapLineRange(r, hunks)
+			if change.fromPath == "" {
+				parentRange, touched = lineRange{}, true
+			}
+			change.ranges = append(change.ranges, [2]lineRange{parentRange, r})
+			change.touched = change.touched || touched
+
+			// the lines stop being followed where they first appear
+			if change.fromPath != "" && parentRange.start < parentRange.end {
+				parentTracked.add(change.fromPath, parentRange)
+			}
+		}
+		changes = append(changes, change)
+	}
+	return parentTracked, changes, nil
+}
+
+// lineLog implements `git log -L <start>,<end>:<file>`
+//
+// It follows the given lines back through history, from the starting
+// commits, and shows the commits that changed them with the part of their
+// diff that is in the lines. At each commit, the lines are mapped to where
+// they were in its parent; they're followed across renames, and until they
+// first appear.
+//
+// A merge passes the lines on to the first parent that has them unchanged
+// and isn't shown; otherwise it's shown without a diff and the lines are
+// followed into every parent.
+func lineLog(w io.Writer, starts []string, specs []string, format *prettyFormat, maxCount int) error {
+	tracked := trackedLines{}
+	for _, spec := range specs {
+		_, path, found := strings.Cut(spec, ":")
+		if !found || path == "" {
+			return fmt.Errorf("-L argument not 'start,end:file': %s", spec)
+		}
+		path = cleanPath(path)
+
+		c, err := readCommit(starts[0])
+		if err != nil {
+			return err
+		}
+		lines, found, err := blobLines(c.tree, path)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("there is no path %s in the commit", path)
+		}
+
+		r, err := parseLineRange(spec, path, lines)
+		if err != nil {
+			return err
+		}
+		tracked.add(path, r)
+	}
+
+	pending := map[string]trackedLines{}
+	for _, sha := range starts {
+		pending[sha] = tracked
+	}
+	pass := func(sha string, lines trackedLines) {
+		if pending[sha] == nil {
+			pending[sha] = trackedLines{}
+		}
+		for path, ranges := range lines {
+			for _, r := range ranges {
+				pending[sha].add(path, r)
+			}
+		}
+	}
+
+	// children come before their parents, so the lines of a commit are
+	// all known by the time it's reached
+	nodes, err := parentsFirst(starts, func(string) bool { return false })
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for n := len(nodes) - 1; n >= 0 && len(pending) > 0 && count != maxCount; n-- {
+		node := nodes[n]
+		tracked, ok := pending[node.sha]
+		if !ok {
+			continue
+		}
+		delete(pending, node.sha)
+
+		c, err := readCommit(node.sha)
+		if err != nil {
+			return err
+		}
+
+		parents := c.parents
+		if len(parents) == 0 {
+			parents = []string{""}
+		}
+
+		var perParent []trackedLines
+		var changes [][]lineChange
+		unchanged := false
+		for _, parent := range parents {
+			parentTree := ""
+			if parent != "" {
+				parentCommit, err := readCommit(parent)
+				if err != nil {
+					return err
+				}
+				parentTree = parentCommit.tree
+			}
+
+			parentTracked, parentChanges, err := traceLines(tracked, parentTree, c.tree)
+			if err != nil {
+				return err
+			}
+
+			touched := false
+			for _, change := range parentChanges {
+				touched = touched || change.touched
+			}
+			if !touched {
+				// same lines as in this parent: it gets all of the history
+				pass(parent, parentTracked)
+				unchanged = true
+				break
+			}
+
+			perParent = append(perParent, parentTracked)
+			changes = append(changes, parentChanges)
+		}
+		if unchanged {
+			continue
+		}
+
+		for i, parent := range parents {
+			if parent != "" {
+				pass(parent, perParent[i])
+			}
+		}
+
+		writeLogEntry(w, count > 0, node.sha, c, format)
+		count++
+
+		// unlike with -p, there's always a blank line after the commit, and
+		// merges don't get a diff
+		fmt.Fprintln(w)
+		if len(parents) == 1 {
+			for _, change := range changes[0] {
+				if change.touched {
+					writeLineRangeDiff(w, change.fromPath, change.toPath, change.from, change.to, change.ranges)
+				}
+			}
+		}
+	}
+	return nil
+}
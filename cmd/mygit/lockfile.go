@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultStaleLockTimeout is how old a lock file must be for --force-lock to
+// break it, unless core.staleLockTimeout (in seconds) says otherwise.
+const defaultStaleLockTimeout = 10 * time.Minute
+
+// forceLock is set by `git --force-lock <command>`, to break stale locks.
+var forceLock bool
+
+// Lockfile guards the update of a file, eg: a ref, the way git does: the
+// new content goes to <path>.lock, which is created only if it doesn't
+// exist yet, so a single process can hold the lock. Commit then renames it
+// over path, so readers see either the old or the new content, and
+// Rollback drops it.
+type Lockfile struct {
+	path string
+	file *os.File
+}
+
+// AcquireLock creates <path>.lock, failing when another process holds the
+// lock. With --force-lock, a lock older than the stale lock timeout is taken
+// over, as the process that created it most likely died.
+func AcquireLock(path string) (*Lockfile, error) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) && forceLock && isStaleLock(lockPath) {
+		trace("break stale lock %s", lockPath)
+		os.Remove(lockPath)
+		file, err = os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if errors.Is(err, os.ErrExist) {
+		hint := "another git process seems to be running in this repository"
+		if isStaleLock(lockPath) {
+			hint = "if no other git process is running, remove the file or use --force-lock"
+		}
+		return nil, fmt.Errorf("Unable to create '%s': File exists; %s", lockPath, hint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create '%s': %s", lockPath, err)
+	}
+	return &Lockfile{path: path, file: file}, nil
+}
+
+// isStaleLock tells whether a lock file is older than the stale lock
+// timeout.
+func isStaleLock(lockPath string) bool {
+	timeout := defaultStaleLockTimeout
+	if value, ok := configGet("core.staleLockTimeout"); ok {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			timeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	info, err := os.Stat(lockPath)
+	return err == nil && time.Since(info.ModTime()) > timeout
+}
+
+// Write writes to the lock file, the new content of the file.
+func (l *Lockfile) Write(p []byte) (int, error) {
+	return l.file.Write(p)
+}
+
+// Commit replaces the file with the lock file, releasing the lock.
+func (l *Lockfile) Commit() error {
+	lockPath := l.file.Name()
+	if err := l.file.Close(); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	if err := os.Rename(lockPath, l.path); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return nil
+}
+
+// Rollback releases the lock, leaving the file as it was.
+func (l *Lockfile) Rollback() error {
+	l.file.Close()
+	return os.Remove(l.file.Name())
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// gitDateFormat is how git shows dates by default.
+const gitDateFormat = "Mon Jan 2 15:04:05 2006 -0700"
+
+// writeCommitHeader writes a commit the way `git log` shows it by default:
+//
+//	commit <sha>
+//	Merge: <parent> <parent>     (merges only)
+//	Author: <name> <<email>>
+//	Date:   <date>
+//
+//	    <message, indented by 4 spaces>
+func writeCommitHeader(w io.Writer, sha string, c *commit) {
+	fmt.Fprintln(w, colored(colorYellow, "commit "+sha))
+
+	if len(c.parents) > 1 {
+		var parents []string
+		for _, parent := range c.parents {
+			parents = append(parents, parent[:7])
+		}
+		fmt.Fprintf(w, "Merge: %s\n", strings.Join(parents, " "))
+	}
+
+	name, email, when := parseIdent(c.author)
+	fmt.Fprintf(w, "Author: %s <%s>\n", name, email)
+	fmt.Fprintf(w, "Date:   %s\n\n", when.Format(gitDateFormat))
+
+	for _, line := range strings.Split(strings.TrimRight(c.message, "\n"), "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
+
+// commitChanges returns what a commit changed compared to its first parent,
+// or to the empty tree for a root commit.
+func commitChanges(c *commit) ([]treeChange, error) {
+	parentTree := ""
+	if len(c.parents) > 0 {
+		parent, err := readCommit(c.parents[0])
+		if err != nil {
+			return nil, err
+		}
+		parentTree = parent.tree
+	}
+
+	return diffTrees(parentTree, c.tree, true)
+}
+
+// touchesPath reports whether a change is on one of the paths or somewhere
+// under it. No paths at all means every change counts.
+func touchesPath(change treeChange, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, path := range paths {
+		if path == "" || change.path == path || strings.HasPrefix(change.path, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// pathsDiffer reports whether anything on the paths differs between two
+// trees, by comparing what's at each path: a blob, or the tree of a
+// directory, which changes whenever something under it does.
+func pathsDiffer(from string, to string, paths []string) (bool, error) {
+	for _, path := range paths {
+		if path == "" {
+			if from != to {
+				return true, nil
+			}
+			continue
+		}
+
+		before, inFrom, err := lookupTreePath(from, path)
+		if err != nil {
+			return false, err
+		}
+		after, inTo, err := lookupTreePath(to, path)
+		if err != nil {
+			return false, err
+		}
+		if inFrom != inTo || before.sha != after.sha || before.mode != after.mode {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cleanPath turns a path the user typed into one relative to the top of the
+// tree, eg: ./cmd/ becomes cmd, and . becomes "", the whole tree.
+func cleanPath(path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "./")
+	if path == "." {
+		return ""
+	}
+	return path
+}
+
+// writeLogEntry writes a commit of the log in the given format, with the
+// separator or terminator that goes around it. An empty format gets no
+// terminator.
+func writeLogEntry(w io.Writer, shownOne bool, sha string, c *commit, format *prettyFormat) {
+	if shownOne && !format.terminator {
+		fmt.Fprintln(w)
+	}
+	writeCommit(w, sha, c, format)
+	if format.terminator && !format.empty() {
+		fmt.Fprintln(w)
+	}
+}
+
+// logEntry is a commit log --graph shows, with the changes shown after it.
+type logEntry struct {
+	commit  *commit
+	changes []treeChange
+}
+
+// writeGraphLog writes the entries of log --graph, the commits walked that
+// are shown, in the order of graphOrder with the graph before their lines.
+// The edges of the graph go to the parents shown, like in git, so for
+// instance the commits of an excluded range end the branch lines.
+func writeGraphLog(w io.Writer, walked []*commitNode, entries map[string]*logEntry, maxCount int, format *prettyFormat,
+	writeChanges func(io.Writer, []treeChange) error) error {
+	graph := newLogGraph()
+	count := 0
+	missingNewline := false
+	for _, node := range graphOrder(walked) {
+		entry := entries[node.sha]
+		if entry == nil {
+			continue
+		}
+		if count == maxCount {
+			break
+		}
+
+		var parents []string
+		for _, parent := range node.parents {
+			if entries[parent] != nil {
+				parents = append(parents, parent)
+			}
+		}
+		graph.update(node.sha, parents)
+
+		// the separator is drawn as a line of the graph too, unless the
+		// previous entry didn't end its line
+		if count > 0 && !format.terminator {
+			if !missingNewline {
+				io.WriteString(w, graph.paddingLine())
+			}
+			fmt.Fprintln(w)
+		}
+		graph.writeCommit(w)
+		var text bytes.Buffer
+		writeCommit(&text, node.sha, entry.commit, format)
+		missingNewline = !bytes.HasSuffix(text.Bytes(), []byte("\n"))
+		graph.writeMessage(w, text.Bytes())
+		if format.terminator && !format.empty() {
+			if !missingNewline {
+				io.WriteString(w, graph.paddingLine())
+			}
+			fmt.Fprintln(w)
+		}
+		count++
+
+		if len(entry.changes) > 0 {
+			if err := writeChanges(&graphPrefixWriter{w: w, graph: graph}, entry.changes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startLogPatch writes what goes between a commit and its patch: a blank
+// line, or nothing after a oneline commit or an empty user format.
+func startLogPatch(w io.Writer, format *prettyFormat) {
+	if format.name != "oneline" && !format.empty() {
+		fmt.Fprintln(w)
+	}
+}
+
+// commitFilter limits the commits log shows, with --author, --committer,
+// --grep, --since and --until. Several patterns of a kind match when any of
+// them does, or all of them for --grep with --all-match. Commits must match
+// every kind given.
+type commitFilter struct {
+	authors    []*regexp.Regexp // against `Name <email>`
+	committers []*regexp.Regexp
+	messages   []*regexp.Regexp // against each line of the message
+	allMatch   bool
+	invertGrep bool      // show the commits whose message matches none instead
+	since      time.Time // the oldest commit date shown, when not zero
+	until      time.Time // the newest commit date shown, when not zero
+	mailmap    bool      // match the canonical identities, see mailmap
+}
+
+// compileLogPattern compiles a pattern of --author, --committer or --grep,
+// a regular expression matching the leftmost-longest text like POSIX ones,
+// unless fixed. ^ and $ match at each line.
+func compileLogPattern(pattern string, ignoreCase bool, fixed bool) (*regexp.Regexp, error) {
+	expr := pattern
+	if fixed {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile("(?m)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("command line, '%s': %s", pattern, err)
+	}
+	re.Longest()
+	return re, nil
+}
+
+func (f *commitFilter) matches(c *commit) bool {
+	anyMatch := func(patterns []*regexp.Regexp, text string) bool {
+		for _, re := range patterns {
+			if re.MatchString(text) {
+				return true
+			}
+		}
+		return len(patterns) == 0
+	}
+	ident := func(value string) string {
+		if f.mailmap {
+			value = loadMailmap().rewriteIdent(value)
+		}
+		name, email, _ := parseIdent(value)
+		return fmt.Sprintf("%s <%s>", name, email)
+	}
+
+	if !anyMatch(f.authors, ident(c.author)) || !anyMatch(f.committers, ident(c.committer)) {
+		return false
+	}
+	_, _, when := parseIdent(c.committer)
+	if !f.since.IsZero() && when.Before(f.since) || !f.until.IsZero() && when.After(f.until) {
+		return false
+	}
+	if len(f.messages) == 0 {
+		return true
+	}
+
+	// like git, --invert-grep leaves out commits matching any pattern, even
+	// with --all-match
+	for _, re := range f.messages {
+		matched := re.MatchString(c.message)
+		if matched && (f.invertGrep || !f.allMatch) {
+			return !f.invertGrep
+		}
+		if !matched && f.allMatch && !f.invertGrep {
+			return false
+		}
+	}
+	return f.allMatch || f.invertGrep
+}
+
+// logCmd implements `git log [-p] [-n <count>] [--follow [-M<n>]] [--author=<pattern>] [--committer=<pattern>] [--grep=<pattern> [--all-match] [--invert-grep]] [-i] [-F] [--since=<date>] [--until=<date>] [-S <string> [--pickaxe-regex] | -G <regex>] [--pickaxe-all] [--[no-]use-mailmap] [--pretty=<format> | --oneline] [--color[=<when>]] [-L <start>,<end>:<file>] [<revision>...] [[--] <path>...]`
+//
+// It shows the commits reachable from the given revisions, or HEAD, most
+// recent first, in the given format (see parsePrettyFormat). With -p, each
+// commit is followed by its patch against its first parent; merges don't
+// get one. A root commit is compared against the empty tree.
+//
+// With paths, files or directories, only the commits changing something
+// under them are shown, and their patches are limited to them. A merge is
+// shown when it differs from each of its parents there.
+//
+// With --follow and a single file, its history goes on past the commits
+// that renamed it, under its older names. A rename is a file deleted in the
+// commit adding the file followed, whose content is at least 50% similar,
+// or the score -M<n> gives, see parseRenameScore and detectRenames.
+//
+// -S and -G only show the commits adding or removing some text, see
+// pickaxe. With -p, their patches only show the files where it was found,
+// unless --pickaxe-all.
+//
+// --author, --committer and --grep only show the commits matching them, see
+// commitFilter. -i makes the patterns ignore case, -F makes them plain
+// strings. --since and --until only show the commits made between two
+// dates, see parseGitDate.
+//
+// Authors and committers are shown and matched with their canonical names
+// and emails, see mailmap, unless --no-use-mailmap or log.mailmap is false.
+//
+// With -L, the history of some lines is shown instead, see lineLog.
+//
+// --graph draws the history to the left of the commits, see logGraph, which
+// are then shown in topological order, see graphOrder.
+//
+// On a terminal, the commit lines are yellow and the patches are colored,
+// see colorFlag.
+func logCmd(args []string) {
+	runLog("git log", args, false)
+}
+
+// whatchanged implements `git whatchanged [<log options>]`
+//
+// It's log with the files each commit changed in the raw format of
+// diff-tree, abbreviated, instead of patches, see formatRawChange. Merges
+// are compared with their first parent, and the commits changing nothing
+// aren't shown. -p shows the patches instead, like git.
+func whatchanged(args []string) {
+	runLog("git whatchanged", args, true)
+}
+
+// runLog is log, or whatchanged with raw.
+func runLog(name string, args []string, raw bool) {
+	// everything after -- is a path
+	var paths []string
+	for i, arg := range args {
+		if arg == "--" {
+			paths = args[i+1:]
+			args = args[:i]
+			break
+		}
+	}
+
+	args, renameScore, _ := cutRenameScore(args)
+
+	// like git, -S and -G take their value glued too, eg: -Sfoo
+	var split []string
+	for _, arg := range args {
+		if len(arg) > 2 && (strings.HasPrefix(arg, "-S") || strings.HasPrefix(arg, "-G")) && arg[2] != '=' {
+			split = append(split, arg[:2], arg[2:])
+		} else {
+			split = append(split, arg)
+		}
+	}
+	args = split
+
+	flag := flag.NewFlagSet(name, flag.ContinueOnError)
+	var (
+		follow   = flag.Bool("follow", false, "continue listing the history of a file beyond renames")
+		patch    = flag.Bool("p", false, "show the patch of each commit")
+		maxCount = flag.Int("n", -1, "limit the number of commits to output")
+		pretty   = &optionalString{value: "medium"}
+		format   = &optionalString{}
+		oneline  = flag.Bool("oneline", false, "same as --pretty=oneline")
+		graph    = flag.Bool("graph", false, "draw the history next to the commits")
+		lines    stringList
+
+		authors    stringList
+		committers stringList
+		greps      stringList
+		allMatch   = flag.Bool("all-match", false, "show the commits matching all --grep patterns, not any")
+		invertGrep = flag.Bool("invert-grep", false, "show the commits whose message doesn't match --grep")
+		ignoreCase = flag.Bool("regexp-ignore-case", false, "match the patterns regardless of case")
+		fixed      = flag.Bool("fixed-strings", false, "take the patterns as fixed strings, not regular expressions")
+		pickString = flag.String("S", "", "show the commits changing the number of times `<string>` appears in a file")
+		pickLines  = flag.String("G", "", "show the commits adding or removing lines matching `<regex>`")
+		pickRegex  = flag.Bool("pickaxe-regex", false, "take the -S string as a regular expression")
+		pickAll    = flag.Bool("pickaxe-all", false, "show all the changes of the commits -S or -G finds")
+		since      = flag.String("since", "", "show the commits more recent than `<date>`")
+		until      = flag.String("until", "", "show the commits older than `<date>`")
+		mailmap    = flag.Bool("use-mailmap", useMailmap(), "show the canonical names and emails of the .mailmap")
+		noMailmap  = flag.Bool("no-use-mailmap", false, "show the names and emails as they were committed")
+	)
+	flag.BoolVar(mailmap, "mailmap", useMailmap(), "same as --use-mailmap")
+	flag.StringVar(since, "after", "", "same as --since")
+	flag.StringVar(until, "before", "", "same as --until")
+	flag.Var(&lines, "L", "follow the lines `<start>,<end>:<file>` through history")
+	flag.Var(&authors, "author", "show the commits whose author matches `<pattern>`")
+	flag.Var(&committers, "committer", "show the commits whose committer matches `<pattern>`")
+	flag.Var(&greps, "grep", "show the commits whose message matches `<pattern>`")
+	flag.BoolVar(ignoreCase, "i", false, "same as --regexp-ignore-case")
+	flag.BoolVar(fixed, "F", false, "same as --fixed-strings")
+	flag.Var(format, "format", "same as --pretty=tformat:`<format>`")
+	flag.Var(pretty, "pretty", "show the commits in `<format>`: oneline, short, medium, full, fuller or format:<string>")
+	color := colorFlag(flag, "color.diff")
+	parsePagedFlags(flag, args)
+	args = flag.Args()
+	useColor = color()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		exit(1)
+	}
+
+	prettyValue := pretty.value
+	switch {
+	case *oneline:
+		prettyValue = "oneline"
+	case format.set && !strings.Contains(format.value, ":"):
+		prettyValue = "tformat:" + format.value
+	case format.set:
+		prettyValue = format.value
+	}
+	commitFormat, err := parsePrettyFormat(prettyValue)
+	if err != nil {
+		fail(err)
+	}
+	// --oneline is a shorthand for --pretty=oneline --abbrev-commit
+	commitFormat.abbrev = *oneline
+	commitFormat.mailmap = *mailmap && !*noMailmap
+
+	pathsGiven := paths != nil
+	var starts []string
+	for _, arg := range args {
+		sha, err := resolveRevision(arg)
+		if err != nil {
+			// like git, a file that isn't a revision is a path
+			if _, statErr := os.Stat(arg); statErr == nil && !pathsGiven {
+				paths = append(paths, arg)
+				continue
+			}
+			fail(err)
+		}
+		if sha, _, err = peelTag(sha); err != nil {
+			fail(err)
+		}
+		starts = append(starts, sha)
+	}
+	if len(starts) == 0 {
+		sha, err := resolveRevision("HEAD")
+		if err != nil {
+			fail(fmt.Errorf("your current branch does not have any commits yet"))
+		}
+		starts = append(starts, sha)
+	}
+	for i, path := range paths {
+		paths[i] = cleanPath(path)
+	}
+	minimumScore, err := parseRenameScore(renameScore)
+	if err != nil {
+		fail(err)
+	}
+	if *follow && len(paths) != 1 {
+		fail(fmt.Errorf("--follow requires exactly one pathspec"))
+	}
+
+	var pick *pickaxe
+	switch {
+	case *pickString != "" && *pickLines != "":
+		fail(fmt.Errorf("options '-G' and '-S' cannot be used together"))
+	case *pickLines != "" && *pickRegex:
+		fail(fmt.Errorf("options '-G' and '--pickaxe-regex' cannot be used together, use '--pickaxe-regex' with '-S'"))
+	case *pickString != "":
+		pick = &pickaxe{text: *pickString, all: *pickAll}
+		if *pickRegex {
+			if pick.re, err = regexp.Compile(*pickString); err != nil {
+				fail(fmt.Errorf("invalid regex: %s", err))
+			}
+		}
+	case *pickLines != "":
+		pick = &pickaxe{grep: true, all: *pickAll}
+		if pick.re, err = regexp.Compile(*pickLines); err != nil {
+			fail(fmt.Errorf("invalid regex: %s", err))
+		}
+	}
+
+	filter := &commitFilter{allMatch: *allMatch, invertGrep: *invertGrep, mailmap: commitFormat.mailmap}
+	for _, date := range []struct {
+		value string
+		parse *time.Time
+	}{
+		{*since, &filter.since},
+		{*until, &filter.until},
+	} {
+		if date.value == "" {
+			continue
+		}
+		if *date.parse, err = parseGitDate(date.value); err != nil {
+			fail(err)
+		}
+	}
+	for _, patterns := range []struct {
+		values  stringList
+		compile *[]*regexp.Regexp
+	}{
+		{authors, &filter.authors},
+		{committers, &filter.committers},
+		{greps, &filter.messages},
+	} {
+		for _, pattern := range patterns.values {
+			re, err := compileLogPattern(pattern, *ignoreCase, *fixed)
+			if err != nil {
+				fail(err)
+			}
+			*patterns.compile = append(*patterns.compile, re)
+		}
+	}
+
+	defer tracePerformance(time.Now(), "log")
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if len(lines) > 0 {
+		if *graph {
+			fail(fmt.Errorf("options '-L' and '--graph' cannot be used together"))
+		}
+		if err := lineLog(out, starts, lines, commitFormat, *maxCount); err != nil {
+			out.Flush()
+			fail(err)
+		}
+		return
+	}
+
+	writeChanges := func(w io.Writer, changes []treeChange) error {
+		startLogPatch(w, commitFormat)
+		for _, change := range changes {
+			if raw && !*patch {
+				fmt.Fprintln(w, formatRawChange(change, true))
+				continue
+			}
+			if err := writePatch(w, change, &diffOptions{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// with --graph, the commits are shown once all of them are known, in
+	// the order of the graph
+	var walked []*commitNode
+	entries := map[string]*logEntry{}
+
+	count := 0
+	var walkErr error
+	err = walkCommits(starts, func(node *commitNode) bool {
+		if *graph {
+			walked = append(walked, node)
+		} else if count == *maxCount {
+			return false
+		}
+
+		c, err := readCommit(node.sha)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+
+		if len(paths) > 0 {
+			// a commit is only shown if it differs from every parent on the
+			// paths, a root commit if it has anything there
+			parents := c.parents
+			if len(parents) == 0 {
+				parents = []string{""}
+			}
+			for _, parent := range parents {
+				parentTree := ""
+				if parent != "" {
+					parentCommit, err := readCommit(parent)
+					if err != nil {
+						walkErr = err
+						return false
+					}
+					parentTree = parentCommit.tree
+				}
+
+				differ, err := pathsDiffer(parentTree, c.tree, paths)
+				if err != nil {
+					walkErr = err
+					return false
+				}
+				if !differ {
+					return true
+				}
+			}
+		}
+
+		var changes []treeChange
+		renamedFrom := ""
+		if (*patch || *follow || pick != nil || raw) && (len(c.parents) <= 1 || raw) {
+			all, err := commitChanges(c)
+			if err != nil {
+				walkErr = err
+				return false
+			}
+			if *follow {
+				// the file followed was added here, maybe as a rename
+				all, err = detectRenames(all, minimumScore, &diffOptions{}, func(path string) bool {
+					return path == paths[0]
+				})
+				if err != nil {
+					walkErr = err
+					return false
+				}
+			}
+			for _, change := range all {
+				if !touchesPath(change, paths) {
+					continue
+				}
+				if change.status == 'R' {
+					renamedFrom = change.oldPath
+				}
+				changes = append(changes, change)
+			}
+		}
+
+		if renamedFrom != "" {
+			// older commits had the file under its old name
+			paths[0] = renamedFrom
+		}
+		if !filter.matches(c) {
+			return true
+		}
+		if pick != nil {
+			// merges have no changes to look into, so they aren't shown
+			if changes, err = pick.filter(changes); err != nil {
+				walkErr = err
+				return false
+			}
+			if len(changes) == 0 {
+				return true
+			}
+		}
+		if raw && len(changes) == 0 {
+			return true
+		}
+		if !*patch && !raw {
+			changes = nil
+		}
+
+		if *graph {
+			entries[node.sha] = &logEntry{commit: c, changes: changes}
+			return true
+		}
+
+		writeLogEntry(out, count > 0, node.sha, c, commitFormat)
+		count++
+
+		if len(changes) > 0 {
+			if err := writeChanges(out, changes); err != nil {
+				walkErr = err
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err == nil && *graph {
+		err = writeGraphLog(out, walked, entries, *maxCount, commitFormat, writeChanges)
+	}
+	if err != nil {
+		out.Flush()
+		error := fmt.Sprintf("Failed to walk history: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestLogGraph(t *testing.T) {
+	testRepository(t)
+	// branches forking from and merged into main, made in this order
+	init := writeTestCommit(t, "init")
+	a1 := writeTestCommit(t, "a1", init)
+	a2 := writeTestCommit(t, "a2", a1)
+	m1 := writeTestCommit(t, "m1", init)
+	b1 := writeTestCommit(t, "b1", m1)
+	a3 := writeTestCommit(t, "a3", a2)
+	m2 := writeTestCommit(t, "m2", m1)
+	c1 := writeTestCommit(t, "c1", m2)
+	mergeA := writeTestCommit(t, "merge a", m2, a3)
+	b2 := writeTestCommit(t, "b2", b1)
+	m3 := writeTestCommit(t, "m3", mergeA)
+	mergeBC := writeTestCommit(t, "merge b c", m3, b2, c1)
+	d1 := writeTestCommit(t, "d1", m2)
+	m4 := writeTestCommit(t, "m4", mergeBC)
+	mergeD := writeTestCommit(t, "merge d", m4, d1)
+	if err := updateRef("refs/heads/main", mergeD); err != nil {
+		t.Fatal(err)
+	}
+
+	// as git draws it
+	want := "*   merge d\n" +
+		"|\\  \n" +
+		"| * d1\n" +
+		"* | m4\n" +
+		"| |     \n" +
+		"|  \\    \n" +
+		"*-. \\   merge b c\n" +
+		"|\\ \\ \\  \n" +
+		"| | * | c1\n" +
+		"| | |/  \n" +
+		"| * | b2\n" +
+		"| * | b1\n" +
+		"* | | m3\n" +
+		"* | |   merge a\n" +
+		"|\\ \\ \\  \n" +
+		"| |_|/  \n" +
+		"|/| |   \n" +
+		"| * | a3\n" +
+		"| * | a2\n" +
+		"| * | a1\n" +
+		"* | | m2\n" +
+		"| |/  \n" +
+		"|/|   \n" +
+		"* | m1\n" +
+		"|/  \n" +
+		"* init\n"
+	if got := captureStdout(t, func() { logCmd([]string{"--graph", "--format=%s"}) }); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// the lines of the message follow the graph too
+	want = "* commit " + m1 + "\n" +
+		"| Author: A U Thor <author@example.com>\n" +
+		"| Date:   " + testCommitDate(t, m1) + "\n" +
+		"| \n" +
+		"|     m1\n" +
+		"| \n" +
+		"* commit " + init + "\n" +
+		"  Author: A U Thor <author@example.com>\n" +
+		"  Date:   " + testCommitDate(t, init) + "\n" +
+		"  \n" +
+		"      init\n"
+	if got := captureStdout(t, func() { logCmd([]string{"--graph", m1}) }); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// testCommitDate returns the date of a commit as log shows it.
+func testCommitDate(t *testing.T, sha string) string {
+	t.Helper()
+	c, err := readCommit(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, when := parseIdent(c.author)
+	return when.Format(gitDateFormat)
+}
+
+// BenchmarkLog runs log over a history of 10k commits, first parsing each
+// commit it walks, then with the parents read from the commit-graph.
+func BenchmarkLog(b *testing.B) {
+	testRepository(b)
+	tip := ""
+	for i := 0; i < 10000; i++ {
+		if tip == "" {
+			tip = writeTestCommit(b, "commit 0")
+		} else {
+			tip = writeTestCommit(b, fmt.Sprintf("commit %d", i), tip)
+		}
+	}
+	if err := updateRef("refs/heads/main", tip); err != nil {
+		b.Fatal(err)
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+
+	run := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			logCmd([]string{"--format=%H"})
+		}
+	}
+	b.Run("without commit-graph", run)
+
+	commitGraph([]string{"write", "--no-progress"})
+	commitGraphLoaded, commitGraphCache = false, nil
+	if !fileExists(gitPath(commitGraphFile)) {
+		b.Fatal("the commit-graph wasn't written")
+	}
+	b.Run("with commit-graph", run)
+}
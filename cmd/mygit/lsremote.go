@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// listRemoteRefs returns the refs of the repository at url, for the remote
+// named remote, see openTransport. The refs a remote helper doesn't know
+// the value of are left out.
+func listRemoteRefs(remote string, url string) ([]ref, error) {
+	t, err := openTransport(remote, url)
+	if err != nil {
+		return nil, err
+	}
+	remoteRefs, err := t.list(false)
+	if closeErr := t.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []ref
+	for _, r := range remoteRefs {
+		if r.sha != "" {
+			refs = append(refs, ref{name: r.name, sha: r.sha})
+		}
+	}
+	return refs, nil
+}
+
+// lsRemote implements `git ls-remote [--heads] [--tags] <repository> [<pattern>...]`
+//
+// It lists the refs of a remote repository without fetching anything, as
+// `<sha>\t<ref>`, annotated tags followed by what they point to as
+// `<tag>^{}`:
+//
+//	$ git ls-remote https://github.com/cvanlabe/mygit
+//	83870400529af1846862e722642e48d07cd3937d	HEAD
+//	83870400529af1846862e722642e48d07cd3937d	refs/heads/main
+//
+// The repository is a URL, a path, or the name of a remote. --heads and
+// --tags limit the refs to branches and tags, and patterns to the refs
+// whose name ends with one of them, eg: main.
+func lsRemote(args []string) {
+	flag := flag.NewFlagSet("git ls-remote", flag.ExitOnError)
+	var (
+		heads = flag.Bool("heads", false, "limit to branches")
+		tags  = flag.Bool("tags", false, "limit to tags")
+	)
+	flag.BoolVar(heads, "h", false, "same as --heads")
+	flag.BoolVar(tags, "t", false, "same as --tags")
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git ls-remote [--heads] [--tags] <repository> [<pattern>...]")
+		os.Exit(129)
+	}
+
+	remote, patterns := args[0], args[1:]
+	url := remote
+	if remoteURL, ok := configGet("remote." + remote + ".url"); ok {
+		url = remoteURL
+	}
+
+	refs, err := listRemoteRefs(remote, url)
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, r := range refs {
+		if (*heads || *tags) &&
+			!(*heads && strings.HasPrefix(r.name, "refs/heads/")) &&
+			!(*tags && strings.HasPrefix(r.name, "refs/tags/")) {
+			continue
+		}
+		if len(patterns) > 0 {
+			matched := false
+			for _, pattern := range patterns {
+				if r.name == pattern || strings.HasSuffix(r.name, "/"+pattern) {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		fmt.Fprintf(out, "%s\t%s\n", r.sha, r.name)
+	}
+}
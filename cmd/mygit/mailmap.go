@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mailmapEntry maps the identity used in commits to the canonical one.
+// An empty name or email leaves that part as it is.
+type mailmapEntry struct {
+	name, email string
+	commitName  string // "" matches any name used with the email
+}
+
+// mailmap canonicalizes the identities of contributors, eg: to use a
+// single name and email for someone who committed with several. Entries
+// are keyed by the lowercased commit email.
+type mailmap map[string][]mailmapEntry
+
+// parseMailmapLine parses a line of a .mailmap file, one of:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+//
+// Anything after a # is a comment.
+func parseMailmapLine(line string) (entry mailmapEntry, commitEmail string, ok bool) {
+	line, _, _ = strings.Cut(line, "#")
+
+	parse := func(s string) (name, email, rest string, ok bool) {
+		name, rest, ok = strings.Cut(s, "<")
+		if !ok {
+			return "", "", "", false
+		}
+		email, rest, ok = strings.Cut(rest, ">")
+		return strings.TrimSpace(name), strings.TrimSpace(email), rest, ok
+	}
+
+	name, email, rest, ok := parse(line)
+	if !ok {
+		return mailmapEntry{}, "", false
+	}
+	commitName, secondEmail, _, ok := parse(rest)
+	if !ok {
+		return mailmapEntry{name: name}, email, true
+	}
+	return mailmapEntry{name: name, email: email, commitName: commitName}, secondEmail, true
+}
+
+// add parses the content of a mailmap file. Later entries for the same
+// identity take precedence.
+func (m mailmap) add(content []byte) {
+	for _, line := range strings.Split(string(content), "\n") {
+		entry, commitEmail, ok := parseMailmapLine(line)
+		if !ok || entry.name == "" && entry.email == "" {
+			continue
+		}
+		key := strings.ToLower(commitEmail)
+		m[key] = append(m[key], entry)
+	}
+}
+
+// readMailmap reads the .mailmap at the top of the work tree, then the
+// file given by mailmap.file.
+func readMailmap() mailmap {
+	m := mailmap{}
+	if content, err := os.ReadFile(".mailmap"); err == nil {
+		m.add(content)
+	}
+	if path, ok := configGet("mailmap.file"); ok {
+		if strings.HasPrefix(path, "~/") {
+			home, _ := os.UserHomeDir()
+			path = filepath.Join(home, path[2:])
+		}
+		if content, err := os.ReadFile(path); err == nil {
+			m.add(content)
+		}
+	}
+	return m
+}
+
+// lookup returns the canonical name and email for an identity. Emails and
+// names are matched regardless of case, and an entry for the name as well
+// as the email wins over one for the email alone.
+func (m mailmap) lookup(name, email string) (string, string) {
+	var match *mailmapEntry
+	entries := m[strings.ToLower(email)]
+	for i, entry := range entries {
+		switch {
+		case strings.EqualFold(entry.commitName, name) && entry.commitName != "":
+			match = &entries[i]
+		case entry.commitName == "" && (match == nil || match.commitName == ""):
+			match = &entries[i]
+		}
+	}
+	if match == nil {
+		return name, email
+	}
+	if match.name != "" {
+		name = match.name
+	}
+	if match.email != "" {
+		email = match.email
+	}
+	return name, email
+}
+
+// rewriteIdent returns an author or committer line with the canonical name
+// and email, and the same date:
+//
+//	Name <email> 1700000000 +0100
+func (m mailmap) rewriteIdent(ident string) string {
+	name, rest, _ := strings.Cut(ident, "<")
+	email, date, found := strings.Cut(rest, ">")
+	if !found {
+		return ident
+	}
+	name, email = m.lookup(strings.TrimSpace(name), email)
+	return fmt.Sprintf("%s <%s>%s", name, email, date)
+}
+
+var mailmapCache mailmap
+
+// loadMailmap reads the mailmap once, see readMailmap.
+func loadMailmap() mailmap {
+	if mailmapCache == nil {
+		mailmapCache = readMailmap()
+	}
+	return mailmapCache
+}
+
+// useMailmap tells whether log shows the canonical identities, which is
+// the log.mailmap config, true by default.
+func useMailmap() bool {
+	if value, ok := configGet("log.mailmap"); ok {
+		use, _ := parseBool(value)
+		return use
+	}
+	return true
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
-	"compress/zlib"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Implements the git init command
@@ -14,10 +17,25 @@ import (
 // It creates the .git/ folder and its children:
 //
 //	.git/HEAD
+//	.git/config
 //	.git/objects
 //	.git/refs
-func initCmd() {
-	foldersToCreate := []string{".git/", ".git/objects", ".git/refs"}
+//
+// HEAD points at the default branch, see defaultBranch.
+//
+// With --bare, they are created in the current directory instead, for a
+// repository without a work tree, eg: the one a server pushes to, and
+// core.bare is true.
+func initCmd(args []string) {
+	flag := flag.NewFlagSet("git init", flag.ExitOnError)
+	bare := flag.Bool("bare", false, "create a bare repository, without a work tree")
+	flag.Parse(args)
+
+	dir := ".git"
+	if *bare {
+		dir = "."
+	}
+	foldersToCreate := []string{dir, filepath.Join(dir, "objects"), filepath.Join(dir, "refs")}
 
 	for _, folder := range foldersToCreate {
 		err := os.Mkdir(folder, 0750)
@@ -28,8 +46,8 @@ func initCmd() {
 		}
 	}
 
-	filesToCreate := ".git/HEAD"
-	headContent := []byte("ref: refs/heads/main\n")
+	filesToCreate := filepath.Join(dir, "HEAD")
+	headContent := []byte("ref: refs/heads/" + defaultBranch() + "\n")
 
 	err := os.WriteFile(filesToCreate, headContent, 0644)
 	if err != nil {
@@ -37,6 +55,25 @@ func initCmd() {
 		fmt.Fprintln(os.Stderr, error)
 		os.Exit(1)
 	}
+
+	config, err := readConfigFile(filepath.Join(dir, "config"))
+	if err == nil {
+		var found []configEntry
+		if found, err = config.find("core.bare"); err == nil && len(found) == 0 {
+			config.add("core.bare", strconv.FormatBool(*bare))
+			err = config.write()
+		}
+	}
+	if err != nil {
+		error := fmt.Sprintf("Failed to create config: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	if *bare {
+		fmt.Println("Initialized bare repository")
+		return
+	}
 	fmt.Println("Initialized .git directory")
 }
 
@@ -53,54 +90,270 @@ func initCmd() {
 //	blog <size>\0<actual content>
 //
 // It's therefore important that if we pretty-print, we discard that header first.
+// A tree is binary, so it's listed instead, see writeTreeListing.
+//
+// With --show-size, a footer follows the content on stderr, so that it
+// doesn't end up in a redirected stdout:
+//
+//	--- 341 bytes, 9 lines ---
+//
+// Like git, one of the modes has to be given:
+//
+//	git cat-file -p <object>        the content, pretty-printed
+//	git cat-file -t <object>        the type
+//	git cat-file -s <object>        the size of the content
+//	git cat-file -e <object>        nothing, exits with 1 when it's missing
+//	git cat-file <type> <object>    the content, see catFileTyped
 func catFile(args []string) {
 	flag := flag.NewFlagSet("git cat-file", flag.ExitOnError)
 	var (
-		pprint = flag.Bool("p", false, "pretty-print the contents of <object> based on its type")
+		pprint     = flag.Bool("p", false, "pretty-print the contents of <object> based on its type")
+		showType   = flag.Bool("t", false, "show the type of <object>")
+		size       = flag.Bool("s", false, "show the size of <object>")
+		exists     = flag.Bool("e", false, "exit with zero status if <object> exists")
+		filters    = flag.Bool("filters", false, "show the content as checkout would write it, following .gitattributes")
+		path       = flag.String("path", "", "use `<path>` for --filters when <object> is a blob sha")
+		showSize   = flag.Bool("show-size", false, "with -p, write the number of bytes and lines of the content to stderr")
+		batch      = &optionalString{value: defaultBatchFormat}
+		batchCheck = &optionalString{value: defaultBatchFormat}
+		batchCmd   = &optionalString{value: defaultBatchFormat}
+		buffer     = flag.Bool("buffer", false, "buffer the output of the batch modes, flushed at the end or on flush")
 	)
+	flag.Var(batch, "batch", "show info and content of objects fed from stdin, `<format>` defaults to \""+defaultBatchFormat+"\"")
+	flag.Var(batchCheck, "batch-check", "show info about objects fed from stdin, `<format>` defaults to \""+defaultBatchFormat+"\"")
+	flag.Var(batchCmd, "batch-command", "read commands from stdin, contents, info or flush, `<format>` defaults to \""+defaultBatchFormat+"\"")
 	flag.Parse(args)
 	args = flag.Args()
 
-	if *pprint {
-		//fmt.Println("pretty-print enabled")
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: git cat-file <type> <object>")
+		fmt.Fprintln(os.Stderr, "   or: git cat-file (-e | -p [--show-size]) <object>")
+		fmt.Fprintln(os.Stderr, "   or: git cat-file (-t | -s) <object>")
+		fmt.Fprintln(os.Stderr, "   or: git cat-file [-p] --filters [--path=<path>] <object>")
+		fmt.Fprintln(os.Stderr, "   or: git cat-file (--batch | --batch-check | --batch-command)[=<format>] [--buffer]")
+		os.Exit(129)
 	}
 
-	if len(args) <= 0 {
-		fmt.Fprintln(os.Stderr, "usage: git cat-file [-p] <blob_sha>")
-		os.Exit(1)
+	if batchCmd.set {
+		catFileBatchCommand(batchCmd.value, *buffer)
+		return
+	}
+	if batch.set || batchCheck.set {
+		if batch.set {
+			catFileBatch(batch.value, true, *buffer)
+		} else {
+			catFileBatch(batchCheck.value, false, *buffer)
+		}
+		return
+	}
+	if *buffer {
+		fmt.Fprintln(os.Stderr, "fatal: '--buffer' requires a batch mode")
+		fmt.Fprintln(os.Stderr)
+		usage()
+	}
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	// -p --filters is --filters, which pretty-prints the blob anyway
+	var modes []string
+	for _, mode := range []struct {
+		name string
+		set  bool
+	}{{"-p", *pprint}, {"-t", *showType}, {"-s", *size}, {"-e", *exists}, {"--filters", *filters && !*pprint}} {
+		if mode.set {
+			modes = append(modes, mode.name)
+		}
+	}
+	if len(modes) > 1 {
+		fmt.Fprintf(os.Stderr, "error: %s is incompatible with %s\n", modes[1], modes[0])
+		usage()
+	}
+	if len(modes) == 0 {
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "fatal: only two arguments allowed in <type> <object> mode, not %d\n\n", len(args))
+			usage()
+		}
+		catFileTyped(args[0], args[1])
+		return
+	}
+	if len(args) != 1 {
+		usage()
 	}
 
-	// eg: object 0a5159e4fd9efdc3530c880fa15b672f08d47421
-	// would be stored in .git/0a/5159e4fd9efdc3530c880fa15b672f08d47421
 	object := args[0]
-	dir := object[:2]
-	filename := object[2:]
-	file := fmt.Sprintf(".git/objects/%s/%s", dir, filename)
 
-	fileContents, err := os.ReadFile(file)
+	if *filters {
+		catFileFiltered(object, *path)
+		return
+	}
 
+	// the header is skipped by openObject, and the content is streamed so
+	// huge blobs don't need to fit in memory
+	sha, err := resolveRevision(object)
 	if err != nil {
-		error := fmt.Sprintf("Failed to read '%s': %s", file, err)
+		if !*pprint {
+			fail(fmt.Errorf("Not a valid object name %s", object))
+		}
+		error := fmt.Sprintf("Failed to read '%s': %s", object, err)
 		fmt.Fprintln(os.Stderr, error)
 		os.Exit(1)
 	}
+	objectType, objectSize, reader, err := openObject(sha)
+	switch {
+	case err != nil && *exists:
+		os.Exit(1)
+	case err != nil && !*pprint:
+		fail(fmt.Errorf("git cat-file: could not get object info"))
+	case err != nil:
+		error := fmt.Sprintf("Failed to read '%s': %s", object, err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+	defer reader.Close()
+
+	switch {
+	case *exists:
+		return
+	case *showType:
+		fmt.Println(objectType)
+		return
+	case *size:
+		fmt.Println(objectSize)
+		return
+	}
 
-	bytesReader := bytes.NewReader(fileContents)
-	zReader, err := zlib.NewReader(bytesReader)
-
-	if err != nil {
-		error := fmt.Sprintf("Failed to decompress content of '%s': %s", file, err)
+	// the footer goes to stderr so that stdout is the content only
+	counter := &lineCounter{}
+	out := io.MultiWriter(os.Stdout, counter)
+	if objectType == "tree" {
+		var entries []treeEntry
+		content, err := io.ReadAll(reader)
+		if err == nil {
+			entries, err = parseTree(content)
+		}
+		if err != nil {
+			error := fmt.Sprintf("Failed to read '%s': %s", object, err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+		writeTreeListing(out, entries)
+	} else if _, err := io.Copy(out, reader); err != nil {
+		error := fmt.Sprintf("Failed to decompress content of '%s': %s", object, err)
 		fmt.Fprintln(os.Stderr, error)
 		os.Exit(1)
 	}
+	if *showSize {
+		fmt.Fprintf(os.Stderr, "--- %d bytes, %d lines ---\n", counter.bytes, counter.lines())
+	}
+}
+
+// catFileTyped implements `git cat-file <type> <object>`
+//
+// It prints the content of an object as it is stored, after checking its
+// type. Like git, an object that leads to one of the type is taken too:
+// the object a tag points to, or the tree of a commit.
+func catFileTyped(wanted string, object string) {
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	switch wanted {
+	case "blob", "tree", "commit", "tag":
+	default:
+		fail(fmt.Errorf("invalid object type \"%s\"", wanted))
+	}
+	sha, err := resolveRevision(object)
+	if err != nil {
+		fail(fmt.Errorf("Not a valid object name %s", object))
+	}
+
+	for {
+		objectType, content, err := readObject(sha)
+		if err != nil {
+			fail(err)
+		}
+		switch {
+		case objectType == wanted:
+			os.Stdout.Write(content)
+			return
+		case objectType == "tag":
+			t, err := parseTag(content)
+			if err != nil {
+				fail(err)
+			}
+			sha = t.object
+		case objectType == "commit" && wanted == "tree":
+			c, err := parseCommit(content)
+			if err != nil {
+				fail(err)
+			}
+			sha = c.tree
+		default:
+			fail(fmt.Errorf("git cat-file %s: bad file", object))
+		}
+	}
+}
+
+// lineCounter counts the bytes and lines written to it, a last line without
+// a newline included.
+type lineCounter struct {
+	bytes    int64
+	newlines int64
+	last     byte
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.bytes += int64(len(p))
+		c.newlines += int64(bytes.Count(p, []byte{'\n'}))
+		c.last = p[len(p)-1]
+	}
+	return len(p), nil
+}
 
-	defer zReader.Close()
+func (c *lineCounter) lines() int64 {
+	if c.bytes > 0 && c.last != '\n' {
+		return c.newlines + 1
+	}
+	return c.newlines
+}
 
-	decompressedContents, _ := io.ReadAll(zReader)
-	headerEndOffset := findNullByteIndex(decompressedContents)
+// catFileFiltered implements `git cat-file --filters (<tree-ish>:<path> | --path=<path> <blob>)`
+//
+// It prints a blob the way checkout would write it to path, eg: with CRLF
+// line endings for a path with `eol=crlf` in .gitattributes.
+func catFileFiltered(object string, path string) {
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
 
-	fmt.Print(string(decompressedContents[headerEndOffset+1:]))
+	if path == "" {
+		_, treePath, found := strings.Cut(object, ":")
+		if !found || isObjectName(object) {
+			fail(fmt.Errorf("<object>:<path> required, only <object> '%s' given", object))
+		}
+		path = treePath
+	}
 
+	sha, err := resolveRevision(object)
+	if err != nil {
+		fail(err)
+	}
+	objectType, content, err := readObject(sha)
+	if err != nil {
+		fail(err)
+	}
+	if objectType == "blob" {
+		content = smudgeText(content, newAttrMatcher().attributes(cleanPath(path)))
+	}
+	os.Stdout.Write(content)
 }
 
 // hashObject -w <file> reads a provided file
@@ -110,72 +363,88 @@ func catFile(args []string) {
 // The content will be:
 //
 //	blob <size in bytes>\0<actual content>
+//
+// Like `git add`, the content is cleaned first following the attributes of
+// its path, eg: CRLF line endings become LF for a `text` file. --stdin reads
+// the content from stdin instead, before any file. Which path's attributes
+// apply goes, from the highest precedence:
+//
+//	--no-filters    none, the content is hashed as is
+//	--path=<path>   the attributes of path, for stdin and every file
+//	<file>          the attributes of the file itself, none for stdin
 func hashObject(args []string) {
 	flag := flag.NewFlagSet("git hash-object", flag.ExitOnError)
 	var (
-		write = flag.Bool("w", false, "Actually write the object into the object database")
+		write     = flag.Bool("w", false, "Actually write the object into the object database")
+		stdin     = flag.Bool("stdin", false, "read the object from stdin")
+		path      = flag.String("path", "", "process the content as if it were from this path")
+		noFilters = flag.Bool("no-filters", false, "store the content as is, without any filter")
 	)
 	flag.Parse(args)
 	args = flag.Args()
 
-	file := args[0]
-
-	fileContent, err := os.ReadFile(file)
-	if err != nil {
-		error := fmt.Sprintf("Failed to read file '%s'. Error: %s", file, err)
-		fmt.Fprintln(os.Stderr, error)
-		os.Exit(1)
+	if *path != "" && *noFilters {
+		fmt.Fprintln(os.Stderr, "fatal: Can't use --path with --no-filters")
+		os.Exit(128)
+	}
+	if !*stdin && len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git hash-object [-w] [--stdin] [--path=<file> | --no-filters] [--] <file>...")
+		os.Exit(129)
 	}
 
-	byteSize := len(fileContent)
-
-	// Write the header: `blob <byteSize>\0<actual file content>`
-	blobContents := []byte(fmt.Sprintf("blob %d\x00%s", byteSize, fileContent))
-
-	// 40 character SHA-1 hash is based on the entire uncompressed content WITH header
-	hash := sha1Hash(blobContents)
-
-	fmt.Println(string(hash))
-
-	if *write {
-		// filename for objects database is based on the hash
-		objectFolder := hash[:2]
-		objectFile := hash[2:]
+	attrs := newAttrMatcher()
+	hash := func(name string, content []byte, attrPath string) {
+		if !*noFilters && attrPath != "" {
+			content = cleanText(content, attrs.attributes(cleanPath(attrPath)))
+		}
 
-		// create the object directory
-		err := os.Mkdir(fmt.Sprintf(".git/objects/%s", objectFolder), 0750)
-		if err != nil && !os.IsExist(err) {
-			error := fmt.Sprintf("Failed to create folder '%s'. Error: %s", objectFolder, err)
-			fmt.Fprintln(os.Stderr, error)
-			os.Exit(1)
+		if *write {
+			hash, err := writeObject("blob", content)
+			if err != nil {
+				error := fmt.Sprintf("Failed to write object for '%s': %s", name, err)
+				fmt.Fprintln(os.Stderr, error)
+				os.Exit(1)
+			}
+			fmt.Println(hash)
+			return
 		}
 
-		// create the file to write zlib compressed data to
-		compressedFile := fmt.Sprintf(".git/objects/%s/%s", objectFolder, objectFile)
-		compressedBlobContents, err := os.Create(compressedFile)
+		// the header is `blob <byteSize>\0`, and the 40 character SHA-1 hash is
+		// based on the entire uncompressed content WITH header
+		fmt.Println(objectHash("blob", content))
+	}
 
+	if *stdin {
+		content, err := io.ReadAll(os.Stdin)
 		if err != nil {
-			error := fmt.Sprintf("Failed to create compressed file '%s'. Error: %s", objectFile, err)
+			error := fmt.Sprintf("Failed to read stdin: %s", err)
 			fmt.Fprintln(os.Stderr, error)
 			os.Exit(1)
 		}
+		hash("stdin", content, *path)
+	}
 
-		compressedWriter := zlib.NewWriter(compressedBlobContents)
-		defer compressedWriter.Close()
-
-		_, err = compressedWriter.Write(blobContents)
+	for _, file := range args {
+		fileContent, err := os.ReadFile(file)
 		if err != nil {
-			error := fmt.Sprintf("Failed to write zlib compressed data to '%s': %s", compressedFile, err)
+			error := fmt.Sprintf("Failed to read file '%s'. Error: %s", file, err)
 			fmt.Fprintln(os.Stderr, error)
 			os.Exit(1)
 		}
 
+		attrPath := file
+		if *path != "" {
+			attrPath = *path
+		}
+		hash(file, fileContent, attrPath)
 	}
 }
 
-// Usage: your_git.sh <command> <arg1> <arg2> ...
+// Usage: your_git.sh [--force-lock] [--no-replace-objects] <command> <arg1> <arg2> ...
 func main() {
 
+	flag.BoolVar(&forceLock, "force-lock", false, "break lock files left behind by a process that died")
+	flag.BoolVar(&noReplaceObjects, "no-replace-objects", os.Getenv("GIT_NO_REPLACE_OBJECTS") != "", "read objects as stored, ignoring refs/replace/")
 	flag.Parse()
 	arguments := flag.Args()
 
@@ -184,9 +453,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	switch command, commandArgs := arguments[0], arguments[1:]; command {
+	command, commandArgs := arguments[0], arguments[1:]
+	if replaceFreeCommands[command] {
+		noReplaceObjects = true
+	}
+
+	setupTrace()
+	trace("built-in: git %s", strings.Join(arguments, " "))
+	defer tracePerformance(time.Now(), "git command: git "+strings.Join(arguments, " "))
+
+	if err := setupGitDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
+		os.Exit(128)
+	}
+	if bareRepository && workTreeCommands[command] {
+		fmt.Fprintln(os.Stderr, "fatal: this operation must be run in a work tree")
+		os.Exit(128)
+	}
+
+	setupPager(command)
+	defer stopPager()
+
+	switch command {
 	case "init":
-		initCmd()
+		initCmd(commandArgs)
 
 	case "cat-file":
 		catFile(commandArgs)
@@ -194,8 +484,176 @@ func main() {
 	case "hash-object":
 		hashObject(commandArgs)
 
+	case "log":
+		logCmd(commandArgs)
+
+	case "whatchanged":
+		whatchanged(commandArgs)
+
+	case "shortlog":
+		shortlog(commandArgs)
+
+	case "format-patch":
+		formatPatch(commandArgs)
+
+	case "patch-id":
+		patchIDCmd(commandArgs)
+
+	case "range-diff":
+		rangeDiff(commandArgs)
+
+	case "bisect":
+		bisect(commandArgs)
+
+	case "stash":
+		stash(commandArgs)
+
+	case "reflog":
+		reflog(commandArgs)
+
+	case "repack":
+		repack(commandArgs)
+
+	case "prune-packed":
+		prunePacked(commandArgs)
+
+	case "archive":
+		archive(commandArgs)
+
+	case "gc":
+		gc(commandArgs)
+
+	case "rev-parse":
+		revParse(commandArgs)
+
+	case "update-ref":
+		updateRefCmd(commandArgs)
+
+	case "var":
+		varCmd(commandArgs)
+
+	case "stripspace":
+		stripspaceCmd(commandArgs)
+
+	case "merge":
+		merge(commandArgs)
+
+	case "status":
+		status(commandArgs)
+
+	case "rerere":
+		rerereCmd(commandArgs)
+
+	case "rebase":
+		rebase(commandArgs)
+
+	case "merge-tree":
+		mergeTree(commandArgs)
+
+	case "apply":
+		apply(commandArgs)
+
+	case "checkout":
+		checkout(commandArgs)
+
+	case "mergetool":
+		mergetool(commandArgs)
+
+	case "rev-list":
+		revList(commandArgs)
+
+	case "commit":
+		commitCmd(commandArgs)
+
+	case "commit-graph":
+		commitGraph(commandArgs)
+
+	case "for-each-ref":
+		forEachRef(commandArgs)
+
+	case "check-attr":
+		checkAttr(commandArgs)
+
+	case "check-ignore":
+		checkIgnore(commandArgs)
+
+	case "check-mailmap":
+		checkMailmap(commandArgs)
+
+	case "clean":
+		clean(commandArgs)
+
+	case "config":
+		configCmd(commandArgs)
+
+	case "diff":
+		diffCmd(commandArgs)
+
+	case "diff-tree":
+		diffTree(commandArgs)
+
+	case "fast-import":
+		fastImportCmd(commandArgs)
+
+	case "fast-export":
+		fastExportCmd(commandArgs)
+
+	case "filter-repo":
+		filterRepoCmd(commandArgs)
+
+	case "index-pack":
+		indexPack(commandArgs)
+
+	case "column":
+		column(commandArgs)
+
+	case "branch":
+		branch(commandArgs)
+
+	case "tag":
+		tagCmd(commandArgs)
+
+	case "replace":
+		replace(commandArgs)
+
+	case "notes":
+		notesCmd(commandArgs)
+
+	case "multi-pack-index":
+		multiPackIndexCmd(commandArgs)
+
+	case "ls-remote":
+		lsRemote(commandArgs)
+
+	case "clone":
+		clone(commandArgs)
+
+	case "fetch":
+		fetch(commandArgs)
+
+	case "push":
+		push(commandArgs)
+
+	case "upload-archive":
+		uploadArchive(commandArgs)
+
+	case "upload-pack":
+		uploadPack(commandArgs)
+
+	case "receive-pack":
+		receivePack(commandArgs)
+
+	case "worktree":
+		worktreeCmd(commandArgs)
+
+	case "verify-commit":
+		verifyCommit(commandArgs)
+
+	case "verify-tag":
+		verifyTag(commandArgs)
+
 	default:
 		fmt.Fprintln(os.Stderr, "Not yet implemented git command")
-		os.Exit(1)
+		exit(1)
 	}
 }
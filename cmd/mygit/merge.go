@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// mergeFiles are the files of .git a merge stopped on conflicts keeps its
+// state in, until it's committed or aborted.
+var mergeFiles = []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE", "AUTO_MERGE", "SQUASH_MSG", mergeRRFile}
+
+// errMergeConflicts is returned when a merge stopped on conflicts.
+var errMergeConflicts = errors.New("merge conflicts")
+
+// merge implements `git merge [--no-ff | --ff-only | --squash] [--no-commit] [-m <message>] <commit>`
+// and `git merge --abort`
+//
+// It joins the history of a commit to the current branch. When the branch
+// is an ancestor of the commit, the branch is fast-forwarded to it, unless
+// --no-ff. Otherwise the changes of both since their merge base, see
+// mergeBases, are merged, see mergeTrees, into a merge commit, which
+// --ff-only refuses to make:
+//
+//	$ git merge side
+//	Auto-merging parser.go
+//	Merge made by the 'ort' strategy.
+//	 parser.go | 2 +-
+//	 1 file changed, 1 insertion(+), 1 deletion(-)
+//
+// The message is -m, or names what was merged, like "Merge branch 'side'".
+// Like git, the changes to the index and the files since HEAD are kept,
+// unless the merge changes the same paths, and then it refuses to start.
+//
+// When there are conflicts, the merged files are left in the work tree with
+// the conflict markers, and their versions in the index, for the user to
+// resolve them and commit the result. The merge is recorded like git does
+// until then:
+//
+//	.git/MERGE_HEAD   the commit merged
+//	.git/MERGE_MSG    the message of the merge commit, with the conflicts
+//	.git/MERGE_MODE   no-ff when the merge wasn't to fast-forward
+//	.git/AUTO_MERGE   the tree merged, with the conflict markers
+//	.git/ORIG_HEAD    the commit before the merge
+//
+// --no-commit stops before the merge commit, like on conflicts, for the
+// user to look at the result, and change it, before they commit it:
+//
+//	$ git merge --no-commit side
+//	Automatic merge went well; stopped before committing as requested
+//
+// --squash merges the files the same way, but leaves the result in the
+// index and the work tree, for the next commit, a single one with the first
+// parent only. HEAD isn't moved, and the message of that commit is left in
+// .git/SQUASH_MSG, see squashMessage:
+//
+//	$ git merge --squash side
+//	Automatic merge went well; stopped before committing as requested
+//	Squash commit -- not updating HEAD
+//
+// When rerere is enabled, the conflicts are recorded, and the ones resolved
+// before are resolved the same way again, see rerere.
+//
+// merge --abort goes back to before the merge: the index and the work tree
+// are those of HEAD again, and the state of the merge is removed.
+func merge(args []string) {
+	flag := flag.NewFlagSet("git merge", flag.ExitOnError)
+	var (
+		abort    = flag.Bool("abort", false, "abort the merge in progress")
+		noFF     = flag.Bool("no-ff", false, "make a merge commit even when the branch can be fast-forwarded")
+		ffOnly   = flag.Bool("ff-only", false, "refuse to merge unless the branch can be fast-forwarded")
+		squash   = flag.Bool("squash", false, "merge the files, but don't commit nor move HEAD")
+		noCommit = flag.Bool("no-commit", false, "stop before the merge commit")
+		messages stringList
+	)
+	flag.Var(&messages, "m", "use `<message>` as the message of the merge commit")
+	flag.Parse(args)
+	args = flag.Args()
+
+	// errors are fatal, unless they say they're only errors
+	fail := func(err error) {
+		if strings.HasPrefix(err.Error(), "error: ") {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if *abort {
+		if len(args) > 0 || *noFF || *ffOnly || *squash || *noCommit || len(messages) > 0 {
+			fail(fmt.Errorf("--abort expects no arguments"))
+		}
+		if err := mergeAbort(); err != nil {
+			fail(err)
+		}
+		return
+	}
+	if len(args) != 1 || *noFF && *ffOnly {
+		fmt.Fprintln(os.Stderr, "usage: git merge [--no-ff | --ff-only | --squash] [--no-commit] [-m <message>] <commit>")
+		fmt.Fprintln(os.Stderr, "   or: git merge --abort")
+		os.Exit(129)
+	}
+	if *squash && *noFF {
+		fail(fmt.Errorf("options '--squash' and '--no-ff.' cannot be used together"))
+	}
+	idx, err := readIndex()
+	if err != nil {
+		fail(err)
+	}
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 {
+			fmt.Fprintln(os.Stderr, "error: Merging is not possible because you have unmerged files.")
+			fmt.Fprintln(os.Stderr, "hint: Fix them up in the work tree, and then use 'git add/rm <file>'")
+			fmt.Fprintln(os.Stderr, "hint: as appropriate to mark resolution and make a commit.")
+			fail(fmt.Errorf("Exiting because of an unresolved conflict."))
+		}
+	}
+	if _, err := os.Stat(gitPath("MERGE_HEAD")); err == nil {
+		fail(fmt.Errorf("You have not concluded your merge (MERGE_HEAD exists).\nPlease, commit your changes before you merge."))
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	opts := &mergeOptions{noFF: *noFF, ffOnly: *ffOnly, squash: *squash, noCommit: *noCommit}
+	if len(messages) > 0 {
+		opts.message = stripSpace(strings.Join(messages, "\n\n"), false)
+	}
+	err = mergeCommit(out, args[0], opts)
+	if errors.Is(err, errMergeConflicts) {
+		out.Flush()
+		if err := rerere(os.Stderr); err != nil {
+			fail(err)
+		}
+		fmt.Fprintln(out, "Automatic merge failed; fix conflicts and then commit the result.")
+		out.Flush()
+		os.Exit(1)
+	}
+	var changes *localChangesError
+	if errors.As(err, &changes) {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		fmt.Fprintln(os.Stderr, "Merge with strategy ort failed.")
+		os.Exit(2)
+	}
+	if err != nil {
+		out.Flush()
+		fail(err)
+	}
+}
+
+// mergeOptions are how mergeCommit merges.
+type mergeOptions struct {
+	noFF     bool
+	ffOnly   bool
+	squash   bool
+	noCommit bool
+	message  string // the message of the merge commit, or the one of mergeMessage
+}
+
+// mergeCommit merges the commit a revision names into HEAD, see merge. It
+// returns errMergeConflicts when the merge stopped on conflicts.
+func mergeCommit(w io.Writer, revision string, opts *mergeOptions) error {
+	theirs, err := resolveRevision(revision)
+	if err == nil {
+		theirs, _, err = peelTag(theirs)
+	}
+	if err != nil {
+		return fmt.Errorf("%s - not something we can merge", revision)
+	}
+	theirCommit, err := readCommit(theirs)
+	if err != nil {
+		return fmt.Errorf("%s - not something we can merge", revision)
+	}
+	head, branch := readWorktreeHead(gitDir)
+	if head == zeroSha || head == "" {
+		return fmt.Errorf("merging into an empty branch isn't supported")
+	}
+	headCommit, err := readCommit(head)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(gitPath("ORIG_HEAD"), []byte(head+"\n"), 0644); err != nil {
+		return err
+	}
+
+	bases, err := mergeBases(head, theirs)
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		return fmt.Errorf("refusing to merge unrelated histories")
+	}
+	if bases[0] == theirs {
+		if opts.squash {
+			fmt.Fprintln(w, "Already up to date. (nothing to squash)")
+		} else {
+			fmt.Fprintln(w, "Already up to date.")
+		}
+		return nil
+	}
+
+	fastForward := bases[0] == head && !opts.noFF
+	if !fastForward && opts.ffOnly {
+		return fmt.Errorf("Not possible to fast-forward, aborting.")
+	}
+	ref := "HEAD"
+	if branch != "" {
+		ref = branch
+	}
+
+	if fastForward {
+		files, err := flattenTree(theirCommit.tree)
+		if err != nil {
+			return err
+		}
+		if err := switchFiles(files, nil, "merge"); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Updating %s..%s\n", head[:7], theirs[:7])
+		fmt.Fprintln(w, "Fast-forward")
+		if opts.squash {
+			if err := writeSquashMessage(w, head, theirs); err != nil {
+				return err
+			}
+			if err := writeMergeStat(w, headCommit.tree, theirCommit.tree); err != nil {
+				return err
+			}
+			runHook("post-merge", "1")
+			return nil
+		}
+		if err := updateMergedRef(ref, head, theirs, "merge "+revision+": Fast-forward"); err != nil {
+			return err
+		}
+		if err := writeMergeStat(w, headCommit.tree, theirCommit.tree); err != nil {
+			return err
+		}
+		runHook("post-merge", "0")
+		return nil
+	}
+	base, err := readCommit(bases[0])
+	if err != nil {
+		return err
+	}
+	result, err := mergeTrees(base.tree, headCommit.tree, theirCommit.tree, "HEAD", revision)
+	if err != nil {
+		return err
+	}
+	// like git, the tree merged is recorded before the work tree is touched
+	if err := os.WriteFile(gitPath("AUTO_MERGE"), []byte(result.tree+"\n"), 0644); err != nil {
+		return err
+	}
+	files, err := flattenTree(result.tree)
+	if err != nil {
+		return err
+	}
+	if err := switchFiles(files, result.stages, "merge"); err != nil {
+		return err
+	}
+	for _, message := range result.messages {
+		fmt.Fprintln(w, message)
+	}
+
+	if opts.squash {
+		if err := writeSquashMessage(w, head, theirs); err != nil {
+			return err
+		}
+		runHook("post-merge", "1")
+		if len(result.stages) > 0 {
+			return recordMerge(theirs, "", result, opts)
+		}
+		fmt.Fprintln(os.Stderr, "Automatic merge went well; stopped before committing as requested")
+		return nil
+	}
+
+	message := opts.message
+	if message == "" {
+		message = mergeMessage(revision, branch)
+	}
+	if len(result.stages) > 0 || opts.noCommit {
+		if err := recordMerge(theirs, message, result, opts); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Automatic merge went well; stopped before committing as requested")
+		return nil
+	}
+
+	c := &commit{tree: result.tree, parents: []string{head, theirs}, message: message}
+	if c.author, err = makeIdent("AUTHOR"); err != nil {
+		return err
+	}
+	if c.committer, err = makeIdent("COMMITTER"); err != nil {
+		return err
+	}
+	sha, err := writeObject("commit", c.encode())
+	if err != nil {
+		return err
+	}
+	if err := removeMergeState(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "Merge made by the 'ort' strategy.")
+	if err := updateMergedRef(ref, head, sha, "merge "+revision+": Merge made by the 'ort' strategy."); err != nil {
+		return err
+	}
+	if err := writeMergeStat(w, headCommit.tree, result.tree); err != nil {
+		return err
+	}
+	runHook("post-merge", "0")
+	return nil
+}
+
+// mergeMessage is the message of the commit merging what revision names
+// into a branch, the way git words it:
+//
+//	Merge branch 'side'
+//	Merge remote-tracking branch 'origin/side' into topic
+//	Merge tag 'v1.0'
+//	Merge commit '1a2b3c4'
+//
+// Like git, merges into main or master don't name the branch, and merges
+// into a detached HEAD say so.
+func mergeMessage(revision string, branch string) string {
+	kind := "commit"
+	switch ref, _ := expandRefName(revision); {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		kind, revision = "branch", shortRefName(ref)
+	case strings.HasPrefix(ref, "refs/tags/"):
+		kind, revision = "tag", shortRefName(ref)
+	case strings.HasPrefix(ref, "refs/remotes/"):
+		kind, revision = "remote-tracking branch", shortRefName(ref)
+	default:
+		if _, err := readRef("refs/remotes/" + revision); err == nil {
+			kind = "remote-tracking branch"
+		}
+	}
+
+	message := fmt.Sprintf("Merge %s '%s'", kind, revision)
+	switch name := shortRefName(branch); {
+	case branch == "":
+		message += " into HEAD"
+	case name != "main" && name != "master":
+		message += " into " + name
+	}
+	return message + "\n"
+}
+
+// writeSquashMessage writes .git/SQUASH_MSG, see squashMessage, for a
+// squash of theirs into head, and says HEAD stays where it is.
+func writeSquashMessage(w io.Writer, head string, theirs string) error {
+	message, err := squashMessage(head, theirs)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(gitPath("SQUASH_MSG"), []byte(message), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "Squash commit -- not updating HEAD")
+	return nil
+}
+
+// squashMessage is the message of the commit of a squash of theirs into
+// head: the commits squashed, most recent first, the way git log shows
+// them, see writeCommitHeader.
+//
+//	Squashed commit of the following:
+//
+//	commit 1a2b3c4d...
+//	Author: A U Thor <author@example.com>
+//	Date:   Thu Apr 7 15:13:13 2005 -0700
+//
+//	    Fix the parser
+func squashMessage(head string, theirs string) (string, error) {
+	merged := map[string]bool{}
+	err := walkCommits([]string{head}, func(node *commitNode) bool {
+		merged[node.sha] = true
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var message strings.Builder
+	message.WriteString("Squashed commit of the following:\n")
+	err = walkCommits([]string{theirs}, func(node *commitNode) bool {
+		if merged[node.sha] {
+			return true
+		}
+		var c *commit
+		if c, err = readCommit(node.sha); err != nil {
+			return false
+		}
+		message.WriteString("\n")
+		writeCommitHeader(&message, node.sha, c)
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// recordMerge writes the state of a merge stopped before its commit, see
+// merge. It returns errMergeConflicts when there are conflicts, and their
+// paths are listed in comments in the message. A squash only records the
+// message, as HEAD won't get a second parent.
+func recordMerge(theirs string, message string, result *treeMerge, opts *mergeOptions) error {
+	var paths []string
+	for path := range result.stages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if len(paths) > 0 {
+		message += "\n" + commentChar() + " Conflicts:\n"
+	}
+	for _, path := range paths {
+		message += commentChar() + "\t" + path + "\n"
+	}
+
+	mode := ""
+	if opts.noFF {
+		mode = "no-ff"
+	}
+	for _, file := range []struct {
+		name, content string
+	}{
+		{"MERGE_HEAD", theirs + "\n"},
+		{"MERGE_MSG", message},
+		{"MERGE_MODE", mode},
+	} {
+		if opts.squash && (file.name == "MERGE_HEAD" || file.name == "MERGE_MODE") {
+			continue
+		}
+		if err := os.WriteFile(gitPath(file.name), []byte(file.content), 0644); err != nil {
+			return err
+		}
+	}
+	if len(paths) > 0 {
+		return errMergeConflicts
+	}
+	return nil
+}
+
+// updateMergedRef moves the branch merged into, or the detached HEAD, from
+// old to sha, with the reflog message of the merge.
+func updateMergedRef(ref string, old string, sha string, message string) error {
+	if err := updateRefIf(ref, sha, old); err != nil {
+		return fmt.Errorf("cannot update ref '%s': %s", ref, err)
+	}
+	logged := []string{ref}
+	if ref != "HEAD" {
+		logged = append(logged, "HEAD")
+	}
+	for _, name := range logged {
+		if err := appendReflog(name, old, sha, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMergeStat writes what a merge changed, as a diffstat with its
+// summary, the renames found.
+func writeMergeStat(w io.Writer, from string, to string) error {
+	changes, err := diffTrees(from, to, true)
+	if err != nil {
+		return err
+	}
+	if changes, err = detectRenames(changes, defaultRenameScore, &diffOptions{}, nil); err != nil {
+		return err
+	}
+	var stats []fileStat
+	for _, change := range changes {
+		stat, err := statChange(change, &diffOptions{})
+		if err != nil {
+			return err
+		}
+		stats = append(stats, stat)
+	}
+	writeDiffStat(w, stats, 80, 0)
+	writeSummary(w, changes)
+	return nil
+}
+
+// mergeAbort goes back to before the merge stopped on conflicts, see merge.
+func mergeAbort() error {
+	if _, err := os.Stat(gitPath("MERGE_HEAD")); err != nil {
+		return fmt.Errorf("There is no merge to abort (MERGE_HEAD missing).")
+	}
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+	if _, err := resetCommit(head); err != nil {
+		return err
+	}
+	// like git, the reset is in the reflogs
+	_, branch := readWorktreeHead(gitDir)
+	for _, name := range []string{branch, "HEAD"} {
+		if name == "" {
+			continue
+		}
+		if err := appendReflog(name, head, head, "reset: moving to HEAD"); err != nil {
+			return err
+		}
+	}
+	return removeMergeState()
+}
+
+// removeMergeState forgets about the merge in progress.
+func removeMergeState() error {
+	for _, name := range mergeFiles {
+		if err := os.Remove(gitPath(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTestTreeCommit writes a commit of files, keyed by their path, like
+// writeTestCommit.
+func writeTestTreeCommit(t *testing.T, files map[string]string, message string, parents ...string) string {
+	t.Helper()
+	entries := map[string]treeEntry{}
+	for path, content := range files {
+		sha, err := writeObject("blob", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[path] = treeEntry{mode: modeFile, name: path, sha: sha}
+	}
+	tree, err := writeTreeFromFiles(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommitTime++
+	ident := fmt.Sprintf("A U Thor <author@example.com> %d +0000", testCommitTime)
+	c := &commit{tree: tree, parents: parents, author: ident, committer: ident, message: message + "\n"}
+	sha, err := writeObject("commit", c.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// testMergeHistory makes main and side change f from a common base, and
+// checks out main.
+func testMergeHistory(t *testing.T, side map[string]string) (main string, theirs string) {
+	t.Helper()
+	testRepository(t)
+	base := writeTestTreeCommit(t, map[string]string{"f": "1\n2\n3\n", "g": "x\n"}, "base")
+	main = writeTestTreeCommit(t, map[string]string{"f": "1\nM\n3\n", "g": "x\n"}, "main", base)
+	theirs = writeTestTreeCommit(t, side, "side", base)
+	for ref, sha := range map[string]string{"refs/heads/main": main, "refs/heads/side": theirs} {
+		if err := updateRef(ref, sha); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := checkoutCommit(main); err != nil {
+		t.Fatal(err)
+	}
+	return main, theirs
+}
+
+func TestMergeConflict(t *testing.T) {
+	main, theirs := testMergeHistory(t, map[string]string{"f": "1\nS\n3\n", "g": "x\n", "h": "new\n"})
+
+	var out bytes.Buffer
+	err := mergeCommit(&out, "side", &mergeOptions{})
+	if !errors.Is(err, errMergeConflicts) {
+		t.Fatalf("merge returned %v, expected the conflicts", err)
+	}
+	if got, want := out.String(), "Auto-merging f\nCONFLICT (content): Merge conflict in f\n"; got != want {
+		t.Errorf("merge printed\n%s\nexpected\n%s", got, want)
+	}
+
+	content, _ := os.ReadFile("f")
+	if got, want := string(content), "1\n<<<<<<< HEAD\nM\n=======\nS\n>>>>>>> side\n3\n"; got != want {
+		t.Errorf("f is\n%s\nexpected\n%s", got, want)
+	}
+	if content, _ := os.ReadFile("h"); string(content) != "new\n" {
+		t.Errorf("h added on side is %q", content)
+	}
+	idx, err := readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stages []string
+	for _, entry := range idx.entries {
+		stages = append(stages, fmt.Sprintf("%s:%d", entry.path, entry.stage()))
+	}
+	if got, want := strings.Join(stages, " "), "f:1 f:2 f:3 g:0 h:0"; got != want {
+		t.Errorf("the index has %s, expected %s", got, want)
+	}
+
+	if head, _ := os.ReadFile(gitPath("MERGE_HEAD")); string(head) != theirs+"\n" {
+		t.Errorf("MERGE_HEAD is %q, expected %s", head, theirs)
+	}
+	if message, _ := os.ReadFile(gitPath("MERGE_MSG")); string(message) != "Merge branch 'side'\n\n# Conflicts:\n#\tf\n" {
+		t.Errorf("MERGE_MSG is %q", message)
+	}
+	if head, _ := resolveRevision("HEAD"); head != main {
+		t.Errorf("HEAD moved to %s on conflicts", head)
+	}
+
+	if err := mergeAbort(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile("f"); string(content) != "1\nM\n3\n" {
+		t.Errorf("after --abort, f is %q", content)
+	}
+	if fileExists("h") {
+		t.Error("after --abort, h added on side is still there")
+	}
+	for _, name := range mergeFiles {
+		if _, err := os.Stat(gitPath(name)); err == nil {
+			t.Errorf("after --abort, %s is still there", name)
+		}
+	}
+	if err := mergeAbort(); err == nil {
+		t.Error("--abort without a merge in progress succeeded")
+	}
+}
+
+func TestMergeCommit(t *testing.T) {
+	main, theirs := testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "y\n"})
+
+	var out bytes.Buffer
+	if err := mergeCommit(&out, "side", &mergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "Merge made by the 'ort' strategy.\n g | 2 +-\n") {
+		t.Errorf("merge printed\n%s", out.String())
+	}
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readCommit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.parents) != 2 || c.parents[0] != main || c.parents[1] != theirs {
+		t.Errorf("the merge commit has parents %v, expected %s and %s", c.parents, main, theirs)
+	}
+	if c.message != "Merge branch 'side'\n" {
+		t.Errorf("the merge commit has message %q", c.message)
+	}
+	for path, want := range map[string]string{"f": "1\nM\n3\n", "g": "y\n"} {
+		if content, _ := os.ReadFile(path); string(content) != want {
+			t.Errorf("%s is %q, expected %q", path, content, want)
+		}
+	}
+
+	out.Reset()
+	if err := mergeCommit(&out, "side", &mergeOptions{}); err != nil || out.String() != "Already up to date.\n" {
+		t.Errorf("merging again printed %q (%v)", out.String(), err)
+	}
+}
+
+func TestMergeFastForward(t *testing.T) {
+	testRepository(t)
+	base := writeTestTreeCommit(t, map[string]string{"f": "1\n"}, "base")
+	ahead := writeTestTreeCommit(t, map[string]string{"f": "2\n"}, "ahead", base)
+	if err := updateRef("refs/heads/main", base); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkoutCommit(base); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mergeCommit(&bytes.Buffer{}, ahead, &mergeOptions{ffOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := resolveRevision("HEAD"); head != ahead {
+		t.Errorf("HEAD is %s after a fast-forward, expected %s", head, ahead)
+	}
+	if content, _ := os.ReadFile("f"); string(content) != "2\n" {
+		t.Errorf("f is %q after a fast-forward", content)
+	}
+}
+
+func TestMergeKeepsLocalChanges(t *testing.T) {
+	testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "y\n"})
+
+	// f isn't changed by the merge, so its change is kept
+	writeTestFiles(t, map[string]string{"f": "local\n"})
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile("f"); string(content) != "local\n" {
+		t.Errorf("f is %q after the merge, expected the local change", content)
+	}
+
+	// g is, so the merge refuses to lose its change
+	testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "y\n"})
+	writeTestFiles(t, map[string]string{"g": "local\n"})
+	var changes *localChangesError
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); !errors.As(err, &changes) {
+		t.Fatalf("merge returned %v, expected it to refuse", err)
+	}
+	if len(changes.paths) != 1 || changes.paths[0] != "g" {
+		t.Errorf("the merge refused for %v, expected g", changes.paths)
+	}
+	if content, _ := os.ReadFile("g"); string(content) != "local\n" {
+		t.Errorf("g is %q, expected the local change", content)
+	}
+}
+
+func TestMergeStatus(t *testing.T) {
+	testMergeHistory(t, map[string]string{"f": "1\nS\n3\n", "g": "x\n"})
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); !errors.Is(err, errMergeConflicts) {
+		t.Fatalf("merge returned %v, expected the conflicts", err)
+	}
+
+	got := captureStdout(t, func() { status(nil) })
+	want := "On branch main\nYou have unmerged paths.\n" +
+		"  (fix conflicts and run \"git commit\")\n" +
+		"  (use \"git merge --abort\" to abort the merge)\n\n" +
+		"Unmerged paths:\n"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("status printed\n%s\nexpected it to start with\n%s", got, want)
+	}
+}
+
+func TestMergeKeepsUntrackedFiles(t *testing.T) {
+	testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "x\n", "h": "theirs\n"})
+
+	// h is added by the merge, so it refuses to overwrite the untracked one
+	writeTestFiles(t, map[string]string{"h": "mine\n"})
+	var untracked *untrackedFilesError
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); !errors.As(err, &untracked) {
+		t.Fatalf("merge returned %v, expected it to refuse", err)
+	}
+	if len(untracked.paths) != 1 || untracked.paths[0] != "h" {
+		t.Errorf("the merge refused for %v, expected h", untracked.paths)
+	}
+	if content, _ := os.ReadFile("h"); string(content) != "mine\n" {
+		t.Errorf("h is %q, expected the untracked file", content)
+	}
+
+	// unless it's ignored
+	writeTestFiles(t, map[string]string{".gitignore": "h\n"})
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile("h"); string(content) != "theirs\n" {
+		t.Errorf("h is %q after the merge, expected the merged one", content)
+	}
+}
+
+func TestMergeSquash(t *testing.T) {
+	main, theirs := testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "y\n"})
+
+	var out bytes.Buffer
+	if err := mergeCommit(&out, "side", &mergeOptions{squash: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "Squash commit -- not updating HEAD\n"; got != want {
+		t.Errorf("merge --squash printed %q, expected %q", got, want)
+	}
+	if head, _ := resolveRevision("HEAD"); head != main {
+		t.Errorf("HEAD moved to %s on a squash", head)
+	}
+	if fileExists(gitPath("MERGE_HEAD")) {
+		t.Error("a squash wrote MERGE_HEAD")
+	}
+	if content, _ := os.ReadFile("g"); string(content) != "y\n" {
+		t.Errorf("g is %q after the squash", content)
+	}
+
+	message, ok := readMergeMessage()
+	prefix := "Squashed commit of the following:\n\ncommit " + theirs + "\nAuthor: A U Thor <author@example.com>\n"
+	if !ok || !strings.HasPrefix(message, prefix) || !strings.HasSuffix(message, "\n\n    side\n") {
+		t.Errorf("the message of the squash is\n%s", message)
+	}
+}
+
+func TestMergeNoCommit(t *testing.T) {
+	main, theirs := testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "y\n"})
+
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{noCommit: true}); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := resolveRevision("HEAD"); head != main {
+		t.Errorf("HEAD moved to %s with --no-commit", head)
+	}
+	if heads, err := readMergeHeads(); err != nil || len(heads) != 1 || heads[0] != theirs {
+		t.Errorf("the commits merged are %v (%v), expected %s", heads, err, theirs)
+	}
+
+	// the commit concludes the merge, with its message
+	captureStdout(t, func() { commitCmd([]string{"--no-edit"}) })
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readCommit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.parents) != 2 || c.parents[0] != main || c.parents[1] != theirs {
+		t.Errorf("the commit has parents %v, expected %s and %s", c.parents, main, theirs)
+	}
+	if c.message != "Merge branch 'side'\n" {
+		t.Errorf("the commit has message %q", c.message)
+	}
+	for _, name := range mergeFiles {
+		if fileExists(gitPath(name)) {
+			t.Errorf("%s is still there after the commit", name)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mergeToolDriver is how to run a merge tool. The command is run by sh,
+// with the files of a conflict in the environment:
+//
+//	$BASE    the version of the merge base, stage 1
+//	$LOCAL   our version, stage 2
+//	$REMOTE  their version, stage 3
+//	$MERGED  the file of the work tree, with the conflict markers
+//
+// When trustExitCode, the exit code of the tool tells whether the merge
+// was resolved, otherwise the file has to be changed.
+type mergeToolDriver struct {
+	command       string
+	trustExitCode bool
+}
+
+// mergeTools are the tools mergetool knows, by name. Other tools can be
+// added with mergetool.<tool>.cmd, like git, see findMergeTool.
+var mergeTools = map[string]mergeToolDriver{
+	"vimdiff":  {command: `vim -f -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`},
+	"nvimdiff": {command: `nvim -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`},
+	"gvimdiff": {command: `gvim -f -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`},
+	"meld":     {command: `meld --output="$MERGED" "$LOCAL" "$BASE" "$REMOTE"`},
+	"kdiff3": {
+		command:       `kdiff3 --auto --L1 "$MERGED (Base)" --L2 "$MERGED (Local)" --L3 "$MERGED (Remote)" -o "$MERGED" "$BASE" "$LOCAL" "$REMOTE"`,
+		trustExitCode: true,
+	},
+	"opendiff": {command: `opendiff "$LOCAL" "$REMOTE" -ancestor "$BASE" -merge "$MERGED" | cat`},
+	"tkdiff":   {command: `tkdiff -a "$BASE" -o "$MERGED" "$LOCAL" "$REMOTE"`, trustExitCode: true},
+	"emerge":   {command: `emacs -f emerge-files-with-ancestor-command "$LOCAL" "$REMOTE" "$BASE" "$(basename "$MERGED")"`, trustExitCode: true},
+	"xxdiff":   {command: `xxdiff -X --show-merged-pane --merged-file "$MERGED" "$LOCAL" "$BASE" "$REMOTE"`},
+}
+
+// findMergeTool returns the driver of a tool: mergetool.<tool>.cmd when
+// it's set, or one of mergeTools. mergetool.<tool>.trustExitCode overrides
+// whether its exit code is trusted.
+func findMergeTool(name string) (mergeToolDriver, error) {
+	driver, known := mergeTools[name]
+	if command, ok := configGet("mergetool." + name + ".cmd"); ok {
+		driver, known = mergeToolDriver{command: command}, true
+	}
+	if !known {
+		return driver, fmt.Errorf("unknown merge tool %s", name)
+	}
+	if value, ok := configGet("mergetool." + name + ".trustExitCode"); ok {
+		driver.trustExitCode, _ = parseBool(value)
+	}
+	return driver, nil
+}
+
+// mergeToolAvailable tells whether the program of a tool is installed.
+func mergeToolAvailable(driver mergeToolDriver) bool {
+	program, _, _ := strings.Cut(driver.command, " ")
+	_, err := exec.LookPath(program)
+	return err == nil
+}
+
+// mergeToolFile names a temporary file with a version of a conflicted
+// file, next to it, the way git does: dir/parser_BASE_1234.go.
+func mergeToolFile(path string, version string) string {
+	ext := filepath.Ext(path)
+	if strings.HasPrefix(filepath.Base(path), ".") && ext == filepath.Base(path) {
+		ext = ""
+	}
+	return fmt.Sprintf("%s_%s_%d%s", strings.TrimSuffix(path, ext), version, os.Getpid(), ext)
+}
+
+// resolveIndexPath marks a path as resolved, the way `git add` would: its
+// stages are replaced by the file of the work tree.
+func resolveIndexPath(idx *index, path string, mode uint32) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	content = cleanText(content, newAttrMatcher().attributes(path))
+	sha, err := writeObject("blob", content)
+	if err != nil {
+		return err
+	}
+
+	resolved := indexEntry{mode: mode, sha: sha, path: path}
+	resolved.mtimeSec = uint32(info.ModTime().Unix())
+	resolved.mtimeNsec = uint32(info.ModTime().Nanosecond())
+	resolved.ctimeSec, resolved.ctimeNsec = resolved.mtimeSec, resolved.mtimeNsec
+	resolved.size = uint32(info.Size())
+
+	var entries []indexEntry
+	for _, entry := range idx.entries {
+		if entry.path != path {
+			entries = append(entries, entry)
+		} else if resolved.path != "" {
+			// in place of the first stage, to keep the entries sorted
+			entries = append(entries, resolved)
+			resolved.path = ""
+		}
+	}
+	idx.entries = entries
+	return writeIndex(idx)
+}
+
+// mergetool implements `git mergetool [--tool=<tool>] [-y | --no-prompt] [<file>...]`
+//
+// It runs a merge tool on each file with conflicts in the index, or those
+// given, to resolve them:
+//
+//	$ git mergetool --tool=meld
+//	Merging:
+//	parser.go
+//
+//	Normal merge conflict for 'parser.go':
+//	  {local}: modified file
+//	  {remote}: modified file
+//	Hit return to start merge resolution tool (meld):
+//
+// The tool is --tool, merge.tool, or vimdiff, see findMergeTool, and gets
+// the versions of the file as temporary files. Once it resolved the
+// conflict, the file is marked resolved in the index, as `git add` would,
+// and the file with its conflict markers is kept as <file>.orig, unless
+// mergetool.keepBackup is false.
+//
+// It asks before each file, unless -y, --no-prompt or mergetool.prompt is
+// false. --tool-help lists the tools, installed or not.
+func mergetool(args []string) {
+	flag := flag.NewFlagSet("git mergetool", flag.ExitOnError)
+	var (
+		tool     = flag.String("tool", "", "use the merge tool `<tool>`")
+		noPrompt = flag.Bool("no-prompt", false, "don't ask before launching the merge tool")
+		prompt   = flag.Bool("prompt", false, "ask before launching the merge tool")
+		toolHelp = flag.Bool("tool-help", false, "list the merge tools")
+	)
+	flag.StringVar(tool, "t", "", "same as --tool")
+	flag.BoolVar(noPrompt, "y", false, "same as --no-prompt")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if *toolHelp {
+		var available, missing []string
+		for name, driver := range mergeTools {
+			if mergeToolAvailable(driver) {
+				available = append(available, name)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		sort.Strings(available)
+		sort.Strings(missing)
+		fmt.Println("'git mergetool --tool=<tool>' may be set to one of the following:")
+		for _, name := range available {
+			fmt.Printf("\t\t%s\n", name)
+		}
+		fmt.Println()
+		fmt.Println("The following tools are valid, but not currently available:")
+		for _, name := range missing {
+			fmt.Printf("\t\t%s\n", name)
+		}
+		return
+	}
+
+	name := *tool
+	if name == "" {
+		name, _ = configGet("merge.tool")
+	}
+	if name == "" {
+		name = "vimdiff"
+	}
+	driver, err := findMergeTool(name)
+	if err != nil {
+		fail(err)
+	}
+
+	ask := true
+	if value, ok := configGet("mergetool.prompt"); ok {
+		ask, _ = parseBool(value)
+	}
+	if *noPrompt {
+		ask = false
+	} else if *prompt {
+		ask = true
+	}
+	keepBackup := true
+	if value, ok := configGet("mergetool.keepBackup"); ok {
+		keepBackup, _ = parseBool(value)
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		fail(fmt.Errorf("unable to read the index: %s", err))
+	}
+	for i, path := range args {
+		args[i] = cleanPath(path)
+	}
+	stages := map[string]*[4]indexEntry{}
+	var paths []string
+	for _, entry := range idx.entries {
+		if entry.stage() == 0 || !touchesPath(treeChange{path: entry.path}, args) {
+			continue
+		}
+		if _, ok := stages[entry.path]; !ok {
+			stages[entry.path] = &[4]indexEntry{}
+			paths = append(paths, entry.path)
+		}
+		stages[entry.path][entry.stage()] = entry
+	}
+	if len(paths) == 0 {
+		fmt.Println("No files need merging")
+		return
+	}
+
+	fmt.Println("Merging:")
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	answer := func(question string) string {
+		fmt.Print(question)
+		line, _ := stdin.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	failed := false
+	for _, path := range paths {
+		fmt.Println()
+		versions := stages[path]
+		if versions[2].sha == "" || versions[3].sha == "" {
+			fmt.Printf("Deleted merge conflict for '%s', not handled, resolve it by hand\n", path)
+			failed = true
+			continue
+		}
+
+		fmt.Printf("Normal merge conflict for '%s':\n", path)
+		fmt.Println("  {local}: modified file")
+		fmt.Println("  {remote}: modified file")
+		if ask {
+			answer(fmt.Sprintf("Hit return to start merge resolution tool (%s): ", name))
+		}
+
+		before, err := os.ReadFile(path)
+		if err != nil {
+			fail(err)
+		}
+		files := map[string]string{"BASE": "", "LOCAL": "", "REMOTE": ""}
+		for version, stage := range map[string]int{"BASE": 1, "LOCAL": 2, "REMOTE": 3} {
+			var content []byte
+			if versions[stage].sha != "" {
+				if _, content, err = readObject(versions[stage].sha); err != nil {
+					fail(err)
+				}
+			}
+			files[version] = mergeToolFile(path, version)
+			if err := os.WriteFile(files[version], content, 0644); err != nil {
+				fail(err)
+			}
+		}
+
+		trace("run merge tool %s", name)
+		cmd := exec.Command("sh", "-c", driver.command)
+		cmd.Env = append(os.Environ(), "BASE="+files["BASE"], "LOCAL="+files["LOCAL"], "REMOTE="+files["REMOTE"], "MERGED="+path)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		runErr := cmd.Run()
+		for _, file := range files {
+			os.Remove(file)
+		}
+
+		// like git, the exit code of a tool that isn't trusted is ignored
+		resolved := runErr == nil || !driver.trustExitCode
+		if !driver.trustExitCode {
+			after, err := os.ReadFile(path)
+			if err != nil {
+				fail(err)
+			}
+			if bytes.Equal(before, after) {
+				fmt.Printf("%s seems unchanged.\n", path)
+				resolved = strings.HasPrefix(answer("Was the merge successful [y/n]? "), "y")
+			}
+		}
+		if !resolved {
+			fmt.Printf("merge of %s failed\n", path)
+			failed = true
+			continue
+		}
+
+		if keepBackup {
+			if err := os.WriteFile(path+".orig", before, 0644); err != nil {
+				fail(err)
+			}
+		}
+		if err := resolveIndexPath(idx, path, versions[2].mode); err != nil {
+			fail(err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
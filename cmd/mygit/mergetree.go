@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// mergeLines merges the changes from base to ours and from base to theirs,
+// the way git merges files: the lines none of them changed, or only one
+// changed, are merged cleanly, and the ones both changed differently are
+// a conflict, left between markers:
+//
+//	<<<<<<< <ours label>
+//	<our lines>
+//	=======
+//	<their lines>
+//	>>>>>>> <their label>
+//
+// Like git, the lines at the start and end of a conflict that both sides
+// have in common are left out of it. It returns whether there was any
+// conflict.
+func mergeLines(base, ours, theirs []string, oursLabel, theirsLabel string) (string, bool) {
+	// matching[i] is where line i of base is on a side, -1 when it changed
+	matching := func(side []string) []int {
+		removed, added := diffLines(base, side)
+		indexes := make([]int, len(base))
+		j := 0
+		for i := range base {
+			for j < len(side) && added[j] {
+				j++
+			}
+			if removed[i] {
+				indexes[i] = -1
+				continue
+			}
+			indexes[i] = j
+			j++
+		}
+		return indexes
+	}
+	inOurs, inTheirs := matching(ours), matching(theirs)
+
+	equal := func(a, b []string) bool {
+		return strings.Join(a, "") == strings.Join(b, "")
+	}
+	var merged strings.Builder
+	write := func(lines []string) {
+		for _, line := range lines {
+			merged.WriteString(line)
+		}
+	}
+	writeSide := func(lines []string) {
+		write(lines)
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			merged.WriteString("\n")
+		}
+	}
+
+	conflict := false
+	i, j, k := 0, 0, 0
+	for i < len(base) || j < len(ours) || k < len(theirs) {
+		// lines both sides kept as they were
+		if i < len(base) && inOurs[i] == j && inTheirs[i] == k {
+			write(base[i : i+1])
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+
+		// up to the next line both kept
+		next := i
+		for next < len(base) && (inOurs[next] < 0 || inTheirs[next] < 0) {
+			next++
+		}
+		oursEnd, theirsEnd := len(ours), len(theirs)
+		if next < len(base) {
+			oursEnd, theirsEnd = inOurs[next], inTheirs[next]
+		}
+		was, a, b := base[i:next], ours[j:oursEnd], theirs[k:theirsEnd]
+		i, j, k = next, oursEnd, theirsEnd
+
+		switch {
+		case equal(a, was):
+			write(b)
+		case equal(b, was), equal(a, b):
+			write(a)
+		default:
+			conflict = true
+			for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+				write(a[:1])
+				a, b = a[1:], b[1:]
+			}
+			common := 0
+			for common < len(a) && common < len(b) && a[len(a)-1-common] == b[len(b)-1-common] {
+				common++
+			}
+			fmt.Fprintf(&merged, "<<<<<<< %s\n", oursLabel)
+			writeSide(a[:len(a)-common])
+			merged.WriteString("=======\n")
+			writeSide(b[:len(b)-common])
+			fmt.Fprintf(&merged, ">>>>>>> %s\n", theirsLabel)
+			write(a[len(a)-common:])
+		}
+	}
+	return merged.String(), conflict
+}
+
+// treeMerge is the result of mergeTrees.
+type treeMerge struct {
+	tree     string
+	stages   map[string][3]*treeEntry // the base, our and their versions of the conflicting paths
+	messages []string
+}
+
+// mergeTrees merges the changes from base to ours and from base to theirs
+// into a new tree, written to the object database along with the merged
+// files, without touching the index or the work tree.
+//
+// A path changed on one side only takes that side, and a file changed on
+// both is merged with mergeLines. When that conflicts, the file is written
+// with the conflict markers. A file deleted on one side and changed on the
+// other is kept as changed, and a file in the way of a directory is moved
+// to <path>~<label>. Those are conflicts too: each gets the base, our and
+// their version, the stages 1, 2 and 3 of git, and a message.
+func mergeTrees(base, ours, theirs string, oursLabel, theirsLabel string) (*treeMerge, error) {
+	var sides [3]map[string]treeEntry
+	for n, sha := range []string{base, ours, theirs} {
+		files, err := flattenTree(sha)
+		if err != nil {
+			return nil, err
+		}
+		sides[n] = files
+	}
+
+	var paths []string
+	seen := map[string]bool{}
+	for _, files := range sides {
+		for path := range files {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	result := &treeMerge{stages: map[string][3]*treeEntry{}}
+	merged := map[string]treeEntry{}
+	conflicted := func(path string) {
+		var stages [3]*treeEntry
+		for n, files := range sides {
+			if entry, ok := files[path]; ok {
+				stages[n] = &entry
+			}
+		}
+		result.stages[path] = stages
+	}
+
+	for _, path := range paths {
+		o, inBase := sides[0][path]
+		a, inOurs := sides[1][path]
+		b, inTheirs := sides[2][path]
+		same := func(x treeEntry, inX bool, y treeEntry, inY bool) bool {
+			return inX == inY && x.sha == y.sha && x.mode == y.mode
+		}
+
+		switch {
+		case same(a, inOurs, b, inTheirs), same(b, inTheirs, o, inBase):
+			if inOurs {
+				merged[path] = a
+			}
+		case same(a, inOurs, o, inBase):
+			if inTheirs {
+				merged[path] = b
+			}
+
+		case !inOurs || !inTheirs:
+			kept, keptLabel, deletedLabel := a, oursLabel, theirsLabel
+			if !inOurs {
+				kept, keptLabel, deletedLabel = b, theirsLabel, oursLabel
+			}
+			merged[path] = kept
+			conflicted(path)
+			result.messages = append(result.messages, fmt.Sprintf("CONFLICT (modify/delete): %s deleted in %s and modified in %s.  Version %s of %s left in tree.", path, deletedLabel, keptLabel, keptLabel, path))
+
+		case modeKind(a.mode) != "file" || modeKind(b.mode) != "file":
+			// symlinks and submodules can't be merged line by line
+			merged[path] = a
+			conflicted(path)
+			result.messages = append(result.messages, fmt.Sprintf("CONFLICT (content): Merge conflict in %s", path))
+
+		default:
+			var baseLines []string
+			if inBase {
+				content, err := readBlob(o.sha)
+				if err != nil {
+					return nil, err
+				}
+				baseLines = splitLines(content)
+			}
+			oursContent, err := readBlob(a.sha)
+			if err != nil {
+				return nil, err
+			}
+			theirsContent, err := readBlob(b.sha)
+			if err != nil {
+				return nil, err
+			}
+
+			result.messages = append(result.messages, "Auto-merging "+path)
+			content, conflict := mergeLines(baseLines, splitLines(oursContent), splitLines(theirsContent), oursLabel, theirsLabel)
+			sha, err := writeObject("blob", []byte(content))
+			if err != nil {
+				return nil, err
+			}
+			mode := a.mode
+			if inBase && a.mode == o.mode {
+				mode = b.mode
+			}
+			merged[path] = treeEntry{mode: mode, sha: sha}
+
+			if conflict {
+				conflicted(path)
+				kind := "content"
+				if !inBase {
+					kind = "add/add"
+				}
+				result.messages = append(result.messages, fmt.Sprintf("CONFLICT (%s): Merge conflict in %s", kind, path))
+			}
+		}
+	}
+
+	// a file can't be where the other side has a directory
+	for path, entry := range merged {
+		for other := range merged {
+			if !strings.HasPrefix(other, path+"/") {
+				continue
+			}
+			label := theirsLabel
+			if a, ok := sides[1][path]; ok && a.sha == entry.sha {
+				label = oursLabel
+			}
+			moved := path + "~" + label
+			delete(merged, path)
+			merged[moved] = entry
+			conflicted(path)
+			result.messages = append(result.messages, fmt.Sprintf("CONFLICT (file/directory): directory in the way of %s from %s; moving it to %s instead.", path, label, moved))
+			break
+		}
+	}
+
+	tree, err := writeTreeFromFiles(merged)
+	if err != nil {
+		return nil, err
+	}
+	result.tree = tree
+	return result, nil
+}
+
+// mergeTree implements `git merge-tree <base-tree> <our-tree> <their-tree>`
+//
+// It merges the changes from the base tree to the two others, see
+// mergeTrees, and prints the resulting tree, which is written to the
+// object database. Nothing else is touched, not even the index, so a merge
+// can be done in a bare repository, or be tried out first. Commits can be
+// given for their trees, and their names label the conflict markers.
+//
+// When there are conflicts, it exits with 1 and the tree is followed by the
+// versions of the conflicting files, then by the messages about the merge,
+// like `git merge-tree --write-tree` does:
+//
+//	<tree>
+//	<mode> <object> <stage>\t<path>
+//
+//	Auto-merging <path>
+//	CONFLICT (content): Merge conflict in <path>
+func mergeTree(args []string) {
+	flag := flag.NewFlagSet("git merge-tree", flag.ExitOnError)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: git merge-tree <base-tree> <our-tree> <their-tree>")
+		os.Exit(129)
+	}
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	var trees []string
+	for _, arg := range args {
+		tree, err := resolveTree(arg)
+		if err != nil {
+			fail(err)
+		}
+		trees = append(trees, tree)
+	}
+
+	result, err := mergeTrees(trees[0], trees[1], trees[2], args[1], args[2])
+	if err != nil {
+		fail(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	fmt.Fprintln(out, result.tree)
+	if len(result.stages) == 0 {
+		out.Flush()
+		return
+	}
+
+	var paths []string
+	for path := range result.stages {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for n, entry := range result.stages[path] {
+			if entry != nil {
+				fmt.Fprintf(out, "%s %s %d\t%s\n", fullMode(entry.mode), entry.sha, n+1, path)
+			}
+		}
+	}
+	fmt.Fprintln(out)
+	for _, message := range result.messages {
+		fmt.Fprintln(out, message)
+	}
+	out.Flush()
+	os.Exit(1)
+}
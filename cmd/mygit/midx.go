@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	multiPackIndexFile = "multi-pack-index"
+	packDir            = "objects/pack"
+)
+
+// Values used in the OOFF chunk for the offsets.
+const (
+	midxLargeOffset  = 0x80000000
+	midxChunkLookup  = 12
+	midxOffsetWidth  = 8
+	midxChunkAlign   = 4
+	midxHeaderLength = 12
+)
+
+// multiPackIndex is a parsed multi-pack-index file.
+type multiPackIndex struct {
+	packNames []string // pack-<checksum>.pack, by pack id
+	fanout    []byte
+	oids      []byte
+	offsets   []byte
+	large     []byte
+}
+
+// multiPackIndexCmd implements `git multi-pack-index (write | verify)`
+//
+// With many packs, looking up an object means searching the index of each
+// of them in turn. The multi-pack-index in .git/objects/pack indexes the
+// objects of all the packs at once, PackStore uses it before the pack
+// indexes.
+//
+// The file follows git's multi-pack-index v1 format:
+//
+//	header:  "MIDX" <version=1> <hash version=1> <number of chunks> <0> <4-byte number of packs>
+//	chunk lookup table: (<chunk id> <8-byte offset>)* followed by a 0 id
+//	PNAM: the sorted names of the pack indexes, NUL terminated and padded
+//	      to a multiple of 4 bytes
+//	OIDF: 256 fan-out entries, the number of objects with first byte <= i
+//	OIDL: the sorted object ids
+//	OOFF: per object the pack id (position in PNAM) and offset in the pack,
+//	      or the position in LOFF when the top bit is set
+//	LOFF: the offsets that don't fit in 31 bits (optional)
+//	trailer: SHA-1 checksum of everything above
+//
+// verify checks the file against the pack indexes.
+func multiPackIndexCmd(args []string) {
+	if len(args) == 0 || (args[0] != "write" && args[0] != "verify") {
+		fmt.Fprintln(os.Stderr, "usage: git multi-pack-index (write | verify)")
+		os.Exit(1)
+	}
+
+	flag := flag.NewFlagSet("git multi-pack-index "+args[0], flag.ExitOnError)
+	flag.Parse(args[1:])
+
+	path := filepath.Join(gitPath(packDir), multiPackIndexFile)
+
+	if args[0] == "verify" {
+		problems, err := verifyMultiPackIndex(gitPath(packDir))
+		if err != nil {
+			error := fmt.Sprintf("Failed to verify '%s': %s", path, err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(1)
+		}
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	defer tracePerformance(time.Now(), "write multi-pack-index")
+
+	midx, err := buildMultiPackIndex(gitPath(packDir))
+	if err != nil {
+		error := fmt.Sprintf("Failed to build multi-pack-index: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+	if midx == nil {
+		// like git, no packs means no multi-pack-index
+		os.Remove(path)
+		return
+	}
+
+	err = os.WriteFile(path, midx, 0644)
+	if err != nil {
+		error := fmt.Sprintf("Failed to write '%s': %s", path, err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
+
+// midxObject is an object of one of the packs being indexed.
+type midxObject struct {
+	sha    []byte
+	pack   uint32
+	mtime  time.Time
+	offset int64
+}
+
+// buildMultiPackIndex serializes the objects of every pack in dir into the
+// multi-pack-index format. It returns nil when there are no packs.
+//
+// An object found in several packs is taken from the most recently
+// modified pack, then from the one with the lowest pack id, like git does.
+func buildMultiPackIndex(dir string) ([]byte, error) {
+	store := NewPackStore(dir)
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if len(store.packs) == 0 {
+		return nil, nil
+	}
+
+	// the pack ids follow the sorted index names
+	packs := append([]*packFile{}, store.packs...)
+	sort.Slice(packs, func(i, j int) bool {
+		return packs[i].name < packs[j].name
+	})
+
+	var entries []midxObject
+	for id, p := range packs {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < p.index.count(); i++ {
+			entries = append(entries, midxObject{
+				sha:    p.index.shas[i*sha1.Size : (i+1)*sha1.Size],
+				pack:   uint32(id),
+				mtime:  info.ModTime(),
+				offset: p.index.offsets[i],
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if cmp := bytes.Compare(a.sha, b.sha); cmp != 0 {
+			return cmp < 0
+		}
+		if !a.mtime.Equal(b.mtime) {
+			return a.mtime.After(b.mtime)
+		}
+		return a.pack < b.pack
+	})
+
+	var names, fanout, oids, offsets, large bytes.Buffer
+	for _, p := range packs {
+		names.WriteString(strings.TrimSuffix(p.name, ".pack") + ".idx\x00")
+	}
+	if pad := names.Len() % midxChunkAlign; pad != 0 {
+		names.Write(make([]byte, midxChunkAlign-pad))
+	}
+
+	var count [256]uint32
+	var previous []byte
+	for _, entry := range entries {
+		if bytes.Equal(entry.sha, previous) {
+			continue
+		}
+		previous = entry.sha
+
+		count[entry.sha[0]]++
+		oids.Write(entry.sha)
+
+		offset := uint32(entry.offset)
+		if entry.offset>>31 != 0 {
+			offset = midxLargeOffset | uint32(large.Len()/midxOffsetWidth)
+			binary.Write(&large, binary.BigEndian, uint64(entry.offset))
+		}
+		binary.Write(&offsets, binary.BigEndian, entry.pack)
+		binary.Write(&offsets, binary.BigEndian, offset)
+	}
+
+	total := uint32(0)
+	for _, n := range count {
+		total += n
+		binary.Write(&fanout, binary.BigEndian, total)
+	}
+
+	chunks := []struct {
+		id   string
+		data []byte
+	}{
+		{"PNAM", names.Bytes()},
+		{"OIDF", fanout.Bytes()},
+		{"OIDL", oids.Bytes()},
+		{"OOFF", offsets.Bytes()},
+	}
+	if large.Len() > 0 {
+		chunks = append(chunks, struct {
+			id   string
+			data []byte
+		}{"LOFF", large.Bytes()})
+	}
+
+	var midx bytes.Buffer
+	midx.WriteString("MIDX")
+	midx.Write([]byte{1, 1, byte(len(chunks)), 0})
+	binary.Write(&midx, binary.BigEndian, uint32(len(packs)))
+
+	offset := uint64(midx.Len() + (len(chunks)+1)*midxChunkLookup)
+	for _, chunk := range chunks {
+		midx.WriteString(chunk.id)
+		binary.Write(&midx, binary.BigEndian, offset)
+		offset += uint64(len(chunk.data))
+	}
+	midx.Write([]byte{0, 0, 0, 0})
+	binary.Write(&midx, binary.BigEndian, offset)
+
+	for _, chunk := range chunks {
+		midx.Write(chunk.data)
+	}
+
+	checksum := sha1.Sum(midx.Bytes())
+	midx.Write(checksum[:])
+
+	return midx.Bytes(), nil
+}
+
+// readMultiPackIndex reads a multi-pack-index file, the error satisfies
+// os.IsNotExist when there is none.
+func readMultiPackIndex(path string) (*multiPackIndex, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	midx, err := parseMultiPackIndex(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return midx, nil
+}
+
+// parseMultiPackIndex parses the content of a multi-pack-index file.
+func parseMultiPackIndex(content []byte) (*multiPackIndex, error) {
+	if len(content) < midxHeaderLength+midxChunkLookup+sha1.Size || string(content[:4]) != "MIDX" {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if content[4] != 1 || content[5] != 1 {
+		return nil, fmt.Errorf("unsupported version %d or hash version %d", content[4], content[5])
+	}
+
+	chunkCount := int(content[6])
+	packCount := int(binary.BigEndian.Uint32(content[8:12]))
+	if len(content) < midxHeaderLength+(chunkCount+1)*midxChunkLookup+sha1.Size {
+		return nil, fmt.Errorf("truncated chunk lookup table")
+	}
+
+	midx := &multiPackIndex{}
+	var names []byte
+	for i := 0; i < chunkCount; i++ {
+		entry := content[midxHeaderLength+i*midxChunkLookup:]
+		start := binary.BigEndian.Uint64(entry[4:12])
+		end := binary.BigEndian.Uint64(entry[4+midxChunkLookup : 12+midxChunkLookup])
+		if start > end || end > uint64(len(content)-sha1.Size) {
+			return nil, fmt.Errorf("chunk '%s' is out of bounds", entry[:4])
+		}
+
+		chunk := content[start:end]
+		switch string(entry[:4]) {
+		case "PNAM":
+			names = chunk
+		case "OIDF":
+			midx.fanout = chunk
+		case "OIDL":
+			midx.oids = chunk
+		case "OOFF":
+			midx.offsets = chunk
+		case "LOFF":
+			midx.large = chunk
+		}
+	}
+
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name != "" {
+			midx.packNames = append(midx.packNames, strings.TrimSuffix(name, ".idx")+".pack")
+		}
+	}
+	if len(midx.packNames) != packCount {
+		return nil, fmt.Errorf("missing or bad PNAM chunk")
+	}
+
+	if len(midx.fanout) != 256*4 {
+		return nil, fmt.Errorf("missing or bad OIDF chunk")
+	}
+	count := midx.count()
+	if len(midx.oids) != count*sha1.Size || len(midx.offsets) != count*midxOffsetWidth {
+		return nil, fmt.Errorf("missing or bad OIDL/OOFF chunk")
+	}
+
+	return midx, nil
+}
+
+// count returns the number of objects in the multi-pack-index.
+func (m *multiPackIndex) count() int {
+	return int(binary.BigEndian.Uint32(m.fanout[255*4:]))
+}
+
+// object returns the pack name and offset of the object at position i.
+func (m *multiPackIndex) object(i int) (string, int64, error) {
+	entry := m.offsets[i*midxOffsetWidth:]
+	pack := binary.BigEndian.Uint32(entry[:4])
+	offset := binary.BigEndian.Uint32(entry[4:8])
+	if int(pack) >= len(m.packNames) {
+		return "", 0, fmt.Errorf("bad pack id %d", pack)
+	}
+
+	if offset&midxLargeOffset == 0 {
+		return m.packNames[pack], int64(offset), nil
+	}
+	at := int(offset&^midxLargeOffset) * midxOffsetWidth
+	if at+midxOffsetWidth > len(m.large) {
+		return "", 0, fmt.Errorf("bad large offset %d", offset&^midxLargeOffset)
+	}
+	return m.packNames[pack], int64(binary.BigEndian.Uint64(m.large[at:])), nil
+}
+
+// find looks up an object using the fan-out table, it returns the name of
+// the pack having it and the offset there.
+func (m *multiPackIndex) find(sha string) (string, int64, bool) {
+	id, err := hex.DecodeString(sha)
+	if err != nil || len(id) != sha1.Size {
+		return "", 0, false
+	}
+
+	lo := 0
+	if id[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(m.fanout[(int(id[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(m.fanout[int(id[0])*4:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(m.oids[(lo+i)*sha1.Size:(lo+i+1)*sha1.Size], id) >= 0
+	})
+	if i >= hi || !bytes.Equal(m.oids[i*sha1.Size:(i+1)*sha1.Size], id) {
+		return "", 0, false
+	}
+
+	name, offset, err := m.object(i)
+	if err != nil {
+		return "", 0, false
+	}
+	return name, offset, true
+}
+
+// verifyMultiPackIndex checks the multi-pack-index of dir: its checksum,
+// the order of its objects and that every object is where the index of its
+// pack says. It returns the problems found, an error means the file
+// couldn't be read at all.
+func verifyMultiPackIndex(dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, multiPackIndexFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	trailer := len(content) - sha1.Size
+	if trailer < 0 {
+		return nil, fmt.Errorf("file is too small")
+	}
+	if checksum := sha1.Sum(content[:trailer]); !bytes.Equal(checksum[:], content[trailer:]) {
+		problems = append(problems, "incorrect checksum")
+	}
+
+	midx, err := parseMultiPackIndex(content)
+	if err != nil {
+		return nil, err
+	}
+
+	packs := map[string]*packIndex{}
+	for i, name := range midx.packNames {
+		if i > 0 && name <= midx.packNames[i-1] {
+			problems = append(problems, fmt.Sprintf("pack names out of order: '%s' before '%s'", midx.packNames[i-1], name))
+		}
+		index, err := readPackIndex(filepath.Join(dir, strings.TrimSuffix(name, ".pack")+".idx"))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to load pack in position %d: %s", i, err))
+			continue
+		}
+		packs[name] = index
+	}
+
+	for i := 1; i < 256; i++ {
+		if binary.BigEndian.Uint32(midx.fanout[(i-1)*4:]) > binary.BigEndian.Uint32(midx.fanout[i*4:]) {
+			problems = append(problems, fmt.Sprintf("oid fanout out of order: fanout[%d] > fanout[%d]", i-1, i))
+		}
+	}
+
+	for i := 0; i < midx.count(); i++ {
+		sha := hex.EncodeToString(midx.oids[i*sha1.Size : (i+1)*sha1.Size])
+		if i > 0 && bytes.Compare(midx.oids[(i-1)*sha1.Size:i*sha1.Size], midx.oids[i*sha1.Size:(i+1)*sha1.Size]) >= 0 {
+			problems = append(problems, fmt.Sprintf("oid lookup out of order: oid[%d] >= oid[%d]", i-1, i))
+		}
+
+		name, offset, err := midx.object(i)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("oid[%d] = %s: %s", i, sha, err))
+			continue
+		}
+		index, ok := packs[name]
+		if !ok {
+			continue
+		}
+		packOffset, ok := index.find(sha)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("failed to load pack entry for oid[%d] = %s", i, sha))
+		} else if packOffset != offset {
+			problems = append(problems, fmt.Sprintf("incorrect object offset for oid[%d] = %s: %x != %x", i, sha, offset, packOffset))
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// impliesNoIndex tells whether diff compares two files as with --no-index
+// without being told: outside of a repository, or when either file is
+// outside the work tree. Inside of a repository, - is a path like any other.
+func impliesNoIndex(paths []string) bool {
+	if len(paths) != 2 {
+		return false
+	}
+	_, err := os.Stat(gitDir)
+	inRepository := err == nil
+
+	outside := false
+	for _, path := range paths {
+		if path == "-" && !inRepository {
+			continue
+		}
+		if _, err := os.Lstat(path); err != nil {
+			return false
+		}
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return false
+		}
+		workTree, err := os.Getwd()
+		if err != nil {
+			return false
+		}
+		relative, err := filepath.Rel(workTree, absolute)
+		if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+			outside = true
+		}
+	}
+	return !inRepository || outside
+}
+
+// readNoIndexFile reads a file compared by diff --no-index, as a treeEntry
+// whose content is in opts.blobs. Like git, the content of - is read from
+// stdin, and is shown with the null sha since it isn't hashed.
+func readNoIndexFile(path string, opts *diffOptions) (treeEntry, error) {
+	name := strings.TrimLeft(path, "/")
+	if path == "-" {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return treeEntry{}, err
+		}
+		opts.blobs[nullSha] = content
+		return treeEntry{mode: modeFile, name: name, sha: nullSha}, nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return treeEntry{}, fmt.Errorf("Could not access '%s'", path)
+	}
+
+	var content []byte
+	mode := modeFile
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return treeEntry{}, err
+		}
+		content, mode = []byte(target), modeSymlink
+	case info.IsDir():
+		return treeEntry{}, fmt.Errorf("'%s' is a directory, only files can be compared", path)
+	default:
+		if content, err = os.ReadFile(path); err != nil {
+			return treeEntry{}, err
+		}
+		if info.Mode()&0111 != 0 {
+			mode = modeExecutable
+		}
+	}
+
+	sha := objectHash("blob", content)
+	opts.blobs[sha] = content
+	return treeEntry{mode: mode, name: name, sha: sha}, nil
+}
+
+// diffNoIndex implements `git diff --no-index <path> <path>`
+//
+// It compares two files of the filesystem, rather than the ones of a
+// repository, so that it can stand in for `diff -u`:
+//
+//	$ git diff --no-index old.txt new.txt
+//	diff --git a/old.txt b/new.txt
+//	index 422c2b7..0f7bc76 100644
+//	--- a/old.txt
+//	+++ b/new.txt
+//	@@ -1,2 +1,2 @@
+//
+// Either path can be - for stdin. It returns the change between the files,
+// none when they are the same.
+func diffNoIndex(paths []string, opts *diffOptions) ([]treeChange, error) {
+	if len(paths) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: git diff --no-index [<options>] <path> <path>")
+		exit(129)
+	}
+	if paths[0] == "-" && paths[1] == "-" {
+		return nil, fmt.Errorf("cannot compare stdin to stdin")
+	}
+
+	old, err := readNoIndexFile(paths[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	new, err := readNoIndexFile(paths[1], opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if old.sha == new.sha && old.mode == new.mode && old.sha != nullSha {
+		return nil, nil
+	}
+	status := byte('M')
+	if modeKind(old.mode) != modeKind(new.mode) {
+		status = 'T'
+	}
+	return []treeChange{{status: status, path: new.name, oldPath: old.name, old: old, new: new}}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// notesRef is where the notes are kept. Only the default notes ref is
+// supported.
+const notesRef = "refs/notes/commits"
+
+// notes are the notes of notesRef: a commit whose tree has a blob per
+// annotated object, named after the object's sha. Big notes trees fan out
+// into subtrees named after the first bytes of the sha, eg: ab/cdef...
+type notes struct {
+	commit  string
+	entries map[string]treeEntry
+}
+
+// readNotes reads the notes tree, there are no notes when notesRef doesn't
+// exist yet.
+func readNotes() (*notes, error) {
+	n := &notes{entries: map[string]treeEntry{}}
+
+	sha, err := readRef(notesRef)
+	if err != nil {
+		return n, nil
+	}
+	c, err := readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	files, err := flattenTree(c.tree)
+	if err != nil {
+		return nil, err
+	}
+
+	n.commit = sha
+	for path, entry := range files {
+		if object := strings.ReplaceAll(path, "/", ""); isObjectName(object) {
+			n.entries[object] = entry
+		}
+	}
+	return n, nil
+}
+
+// write stores the notes as a new commit on top of the current one, and
+// moves notesRef to it.
+func (n *notes) write(message string) error {
+	files := map[string]treeEntry{}
+	for object, entry := range n.entries {
+		files[object] = treeEntry{mode: modeFile, name: object, sha: entry.sha}
+	}
+
+	tree, err := writeTreeFromFiles(files)
+	if err != nil {
+		return err
+	}
+
+	c := &commit{tree: tree, message: message}
+	if n.commit != "" {
+		c.parents = []string{n.commit}
+	}
+	if c.author, err = makeIdent("AUTHOR"); err != nil {
+		return err
+	}
+	if c.committer, err = makeIdent("COMMITTER"); err != nil {
+		return err
+	}
+
+	sha, err := writeObject("commit", c.encode())
+	if err != nil {
+		return err
+	}
+	n.commit = sha
+	return updateRef(notesRef, sha)
+}
+
+// resolveNoteObject resolves the object a note is about, HEAD by default.
+func resolveNoteObject(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("too many arguments")
+	}
+	name := "HEAD"
+	if len(args) == 1 {
+		name = args[0]
+	}
+
+	sha, err := resolveRevision(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve '%s' as a valid ref", name)
+	}
+	return sha, nil
+}
+
+// notesCmd implements `git notes [list [<object>] | add [-f] -m <msg> [<object>] | show [<object>]]`
+//
+// Notes attach a message to an object, eg: a commit, without changing it:
+//
+//	list   prints `<note blob> <object>` for each annotated object, or the
+//	       note blob of the given object
+//	add    adds a note, -m can be given several times for several
+//	       paragraphs and -f replaces an existing note
+//	show   prints the note of an object
+func notesCmd(args []string) {
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	flag := flag.NewFlagSet("git notes "+subcommand, flag.ExitOnError)
+	var (
+		messages stringList
+		force    = flag.Bool("f", false, "replace an existing note")
+	)
+	flag.Var(&messages, "m", "note `<message>`, given several times for several paragraphs")
+	flag.Parse(args)
+	args = flag.Args()
+
+	n, err := readNotes()
+	if err != nil {
+		fail(err)
+	}
+
+	switch subcommand {
+	case "list":
+		if len(args) == 0 {
+			objects := make([]string, 0, len(n.entries))
+			for object := range n.entries {
+				objects = append(objects, object)
+			}
+			sort.Strings(objects)
+			for _, object := range objects {
+				fmt.Printf("%s %s\n", n.entries[object].sha, object)
+			}
+			return
+		}
+
+		object, err := resolveNoteObject(args)
+		if err != nil {
+			fail(err)
+		}
+		entry, ok := n.entries[object]
+		if !ok {
+			fail(fmt.Errorf("no note found for object %s.", object))
+		}
+		fmt.Println(entry.sha)
+
+	case "show":
+		object, err := resolveNoteObject(args)
+		if err != nil {
+			fail(err)
+		}
+		entry, ok := n.entries[object]
+		if !ok {
+			fail(fmt.Errorf("no note found for object %s.", object))
+		}
+		content, err := readBlob(entry.sha)
+		if err != nil {
+			fail(err)
+		}
+		os.Stdout.Write(content)
+
+	case "add":
+		object, err := resolveNoteObject(args)
+		if err != nil {
+			fail(err)
+		}
+		if _, ok := n.entries[object]; ok {
+			if !*force {
+				fail(fmt.Errorf("Cannot add notes. Found existing notes for object %s. Use '-f' to overwrite existing notes", object))
+			}
+			fmt.Fprintf(os.Stderr, "Overwriting existing notes for object %s\n", object)
+		}
+
+		var paragraphs []string
+		for _, message := range messages {
+			// like git, trailing whitespace and blank lines around go
+			lines := strings.Split(message, "\n")
+			for i, line := range lines {
+				lines[i] = strings.TrimRight(line, " \t\r")
+			}
+			if message = strings.Trim(strings.Join(lines, "\n"), "\n"); message != "" {
+				paragraphs = append(paragraphs, message)
+			}
+		}
+		if len(paragraphs) == 0 {
+			fail(fmt.Errorf("no note message given, use -m <message>"))
+		}
+
+		blob, err := writeObject("blob", []byte(strings.Join(paragraphs, "\n\n")+"\n"))
+		if err != nil {
+			fail(err)
+		}
+		n.entries[object] = treeEntry{mode: modeFile, name: object, sha: blob}
+		if err := n.write("Notes added by 'git notes add'\n"); err != nil {
+			fail(err)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, "usage: git notes [list [<object>] | add [-f] -m <msg> [<object>] | show [<object>]]")
+		os.Exit(1)
+	}
+}
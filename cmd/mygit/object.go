@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// objectReader streams the content of an object, after its header.
+type objectReader struct {
+	io.Reader
+	close func() error
+}
+
+func (r *objectReader) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+// openObject opens an object of the repository and reads its header,
+// leaving the reader positioned at the start of the content. A replaced
+// object is read from its replacement, see replaceObject.
+//
+// Every object is stored as:
+//
+//	<type> <size>\0<actual content>
+//
+// It returns the type (blob, tree, commit or tag), the size of the content
+// and a reader for it. Loose objects and packed ones that aren't deltas are
+// streamed, so large objects never have to fit in memory.
+func openObject(sha string) (string, int64, *objectReader, error) {
+	sha, err := replaceObject(sha)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if loose := looseStore(); loose != nil && loose.Has(sha) {
+		return loose.Open(sha)
+	}
+	if packs := packStore(); packs != nil && packs.Has(sha) {
+		return packs.Open(sha)
+	}
+
+	content, objectType, err := objects.Read(sha)
+	if err != nil {
+		if objectType, ok := emptyObject(sha); ok {
+			return objectType, 0, &objectReader{Reader: bytes.NewReader(nil)}, nil
+		}
+		return "", 0, nil, err
+	}
+	return objectType, int64(len(content)), &objectReader{Reader: bytes.NewReader(content)}, nil
+}
+
+// readObject reads an object of the repository entirely, or its
+// replacement, see replaceObject. The empty tree and blob can always be
+// read, see emptyObject.
+//
+// It returns the type (blob, tree, commit or tag) and the actual content.
+func readObject(sha string) (string, []byte, error) {
+	sha, err := replaceObject(sha)
+	if err != nil {
+		return "", nil, err
+	}
+	content, objectType, err := objects.Read(sha)
+	if err != nil {
+		if objectType, ok := emptyObject(sha); ok {
+			return objectType, nil, nil
+		}
+	}
+	return objectType, content, err
+}
+
+// emptyObjects are the objects git knows without storing them, the empty
+// tree and the empty blob, for each object format since their names differ.
+var emptyObjects = map[string]map[string]string{
+	"sha1": {
+		emptyTreeSha: "tree",
+		"e69de29bb2d1d6434b8b29ae775ad8c2e48c5391": "blob",
+	},
+	"sha256": {
+		"6ef19b41225c5369f1c104d45d8d85efa9b057b53b14b4b9b939dd74decc5321": "tree",
+		"473a0f4c3be8a93681a267e3b1e9a7dcda1185436fe141f7749120a303721813": "blob",
+	},
+}
+
+// emptyObject returns the type of a well-known empty object of the
+// repository's object format, see emptyObjects, so that it can be read
+// even when it was never written, eg: to diff a root commit against the
+// empty tree.
+func emptyObject(sha string) (string, bool) {
+	format, ok := configGet("extensions.objectFormat")
+	if !ok {
+		format = "sha1"
+	}
+	objectType, ok := emptyObjects[strings.ToLower(format)][sha]
+	return objectType, ok
+}
+
+// listObjects returns the sha of every object of the repository.
+func listObjects() ([]string, error) {
+	var shas []string
+	err := objects.Iterate(func(sha string) {
+		shas = append(shas, sha)
+	})
+	return shas, err
+}
+
+// writeObject stores an object in the repository and returns its sha.
+//
+// Objects are content-addressed, so an object that already exists is left alone.
+func writeObject(objectType string, content []byte) (string, error) {
+	return objects.Write(objectType, content)
+}
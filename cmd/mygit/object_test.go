@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// BenchmarkCatFileLargeBlob runs cat-file -p on blobs of growing sizes,
+// loose then packed, which are streamed to stdout: the memory allocated
+// for each has to stay the same, whatever the size of the blob.
+func BenchmarkCatFileLargeBlob(b *testing.B) {
+	testRepository(b)
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+
+	for _, size := range []int{1 << 20, 16 << 20, 64 << 20} {
+		var content bytes.Buffer
+		for i := 0; content.Len() < size; i++ {
+			fmt.Fprintf(&content, "line %d of a large blob\n", i)
+		}
+		sha, err := writeObject("blob", content.Bytes())
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkCatFile(b, fmt.Sprintf("loose/%dMB", size>>20), sha, size, devNull)
+
+		// the same blob, alone in a pack
+		var pack bytes.Buffer
+		if _, err := writePack(&pack, []string{sha}, defaultPackOptions(), nil); err != nil {
+			b.Fatal(err)
+		}
+		if err := storePack(pack.Bytes(), 0, nil); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.Remove(looseStore().path(sha)); err != nil {
+			b.Fatal(err)
+		}
+		benchmarkCatFile(b, fmt.Sprintf("packed/%dMB", size>>20), sha, size, devNull)
+	}
+}
+
+func benchmarkCatFile(b *testing.B, name string, sha string, size int, devNull *os.File) {
+	b.Helper()
+	b.Run(name, func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(size))
+		stdout := os.Stdout
+		os.Stdout = devNull
+		defer func() { os.Stdout = stdout }()
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < b.N; i++ {
+			catFile([]string{"-p", sha})
+		}
+		runtime.ReadMemStats(&after)
+
+		if allocated := (after.TotalAlloc - before.TotalAlloc) / uint64(b.N); allocated > 1<<20 {
+			b.Errorf("cat-file -p of a %dMB blob allocated %d bytes, the blob isn't streamed", size>>20, allocated)
+		}
+	})
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Object types as they are encoded in a packfile entry header.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packObjectTypes = map[int]string{
+	packCommit: "commit",
+	packTree:   "tree",
+	packBlob:   "blob",
+	packTag:    "tag",
+}
+
+// packTypeOf returns the pack type of an object type, 0 for an unknown one.
+func packTypeOf(objectType string) int {
+	for packType, name := range packObjectTypes {
+		if name == objectType {
+			return packType
+		}
+	}
+	return 0
+}
+
+// packEntry is a single object of a packfile.
+//
+// Deltified entries keep their delta in data until resolvePackDeltas
+// replaces it with the object content and fills in objectType and sha.
+type packEntry struct {
+	offset     int64
+	dataOffset int64 // where the zlib data starts, after the header
+	packType   int
+	crc        uint32
+	data       []byte
+	baseOffset int64
+	baseSha    string
+	objectType string
+	sha        string
+}
+
+// parsePack reads all entries of a packfile held in memory.
+//
+// A pack is laid out as:
+//
+//	PACK <version: 4 bytes> <object count: 4 bytes>
+//	<entry>*
+//	<sha-1 of everything above: 20 bytes>
+//
+// Each entry starts with a variable length header holding its type and
+// inflated size, followed by the zlib compressed data. Delta entries put
+// the base before the data: a negative offset for OFS_DELTA or a 20-byte
+// object name for REF_DELTA.
+//
+// It returns the entries and the pack checksum, which is verified. The
+// entries read are reported to progress, when not nil.
+func parsePack(pack []byte, progress io.Writer) ([]*packEntry, []byte, error) {
+	if len(pack) < 32 || string(pack[:4]) != "PACK" {
+		return nil, nil, fmt.Errorf("not a packfile")
+	}
+	version := binary.BigEndian.Uint32(pack[4:8])
+	if version != 2 && version != 3 {
+		return nil, nil, fmt.Errorf("unsupported pack version %d", version)
+	}
+	count := binary.BigEndian.Uint32(pack[8:12])
+
+	trailer := len(pack) - sha1.Size
+	checksum := sha1.Sum(pack[:trailer])
+	if !bytes.Equal(checksum[:], pack[trailer:]) {
+		return nil, nil, fmt.Errorf("pack checksum mismatch")
+	}
+
+	reader := bytes.NewReader(pack[:trailer])
+	reader.Seek(12, io.SeekStart)
+
+	p := startProgress(progress, "Indexing objects", int(count))
+	entries := make([]*packEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		offset := reader.Size() - int64(reader.Len())
+		entry, err := parsePackEntry(reader, offset)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad object at offset %d: %s", offset, err)
+		}
+
+		end := reader.Size() - int64(reader.Len())
+		entry.crc = crc32.ChecksumIEEE(pack[offset:end])
+		entries = append(entries, entry)
+		p.update(len(entries))
+	}
+	p.done()
+
+	if reader.Len() != 0 {
+		return nil, nil, fmt.Errorf("pack has %d bytes of garbage after its objects", reader.Len())
+	}
+
+	return entries, checksum[:], nil
+}
+
+// parsePackEntry reads the entry at the current position of reader.
+//
+// bytes.Reader is an io.ByteReader, so zlib stops reading exactly at the
+// end of the compressed stream and the next entry starts right after it.
+func parsePackEntry(reader *bytes.Reader, offset int64) (*packEntry, error) {
+	packType, size, err := readPackEntryHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	entry := &packEntry{offset: offset, packType: packType}
+
+	switch entry.packType {
+	case packOfsDelta:
+		c, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		distance := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = reader.ReadByte(); err != nil {
+				return nil, err
+			}
+			distance = (distance+1)<<7 | int64(c&0x7f)
+		}
+		if distance <= 0 || distance > offset {
+			return nil, fmt.Errorf("delta base offset out of bounds")
+		}
+		entry.baseOffset = offset - distance
+
+	case packRefDelta:
+		base := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(reader, base); err != nil {
+			return nil, err
+		}
+		entry.baseSha = hex.EncodeToString(base)
+
+	default:
+		entry.objectType = packObjectTypes[entry.packType]
+		if entry.objectType == "" {
+			return nil, fmt.Errorf("unknown object type %d", entry.packType)
+		}
+	}
+
+	entry.dataOffset = reader.Size() - int64(reader.Len())
+	zReader, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer zReader.Close()
+
+	entry.data, err = io.ReadAll(zReader)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(entry.data)) != size {
+		return nil, fmt.Errorf("inflated to %d bytes, expected %d", len(entry.data), size)
+	}
+
+	return entry, nil
+}
+
+// readPackEntryHeader reads the type and the inflated size at the start of
+// a pack entry.
+func readPackEntryHeader(reader io.ByteReader) (int, int64, error) {
+	c, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	packType := int(c>>4) & 7
+	size := int64(c & 0x0f)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if c, err = reader.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+	return packType, size, nil
+}
+
+// readDeltaSize reads one of the little-endian base-128 sizes at the start
+// of a delta.
+func readDeltaSize(delta []byte) (int, []byte) {
+	size, shift := 0, 0
+	for len(delta) > 0 {
+		c := delta[0]
+		delta = delta[1:]
+		size |= int(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	return size, delta
+}
+
+// applyDelta rebuilds an object from its base and a delta.
+//
+// A delta is the size of the base and of the result, followed by
+// instructions that either copy a range of the base or insert new data:
+//
+//	1xxxxxxx <offset: 0-4 bytes> <size: 0-3 bytes>  copy from base
+//	0xxxxxxx <data>                                  insert x bytes
+//
+// The low 4 bits of a copy say which offset bytes follow, the next 3 which
+// size bytes follow. A size of 0 means 0x10000.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	baseSize, delta := readDeltaSize(delta)
+	if baseSize != len(base) {
+		return nil, fmt.Errorf("delta base has size %d, expected %d", len(base), baseSize)
+	}
+	resultSize, delta := readDeltaSize(delta)
+
+	result := make([]byte, 0, resultSize)
+	for len(delta) > 0 {
+		c := delta[0]
+		delta = delta[1:]
+
+		if c&0x80 == 0 {
+			if c == 0 || int(c) > len(delta) {
+				return nil, fmt.Errorf("bad delta insert instruction")
+			}
+			result = append(result, delta[:c]...)
+			delta = delta[c:]
+			continue
+		}
+
+		var offset, size int
+		for i := 0; i < 7; i++ {
+			if c&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, fmt.Errorf("truncated delta copy instruction")
+			}
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				size |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if offset+size > len(base) {
+			return nil, fmt.Errorf("delta copies outside of its base")
+		}
+		result = append(result, base[offset:offset+size]...)
+	}
+
+	if len(result) != resultSize {
+		return nil, fmt.Errorf("delta produced %d bytes, expected %d", len(result), resultSize)
+	}
+	return result, nil
+}
+
+// objectHash computes the sha of an object the way it is named in the
+// object database: the sha-1 of `<type> <size>\0<content>`.
+func objectHash(objectType string, content []byte) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s %d\x00", objectType, len(content))
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// resolvePackDeltas applies the deltas of a pack, so every entry ends up
+// with its full content, type and sha.
+//
+// The base of a REF_DELTA may be another entry of the pack or, for a thin
+// pack, an object that is already in the repository.
+//
+// The deltas resolved are reported to progress, when not nil.
+func resolvePackDeltas(entries []*packEntry, progress io.Writer) error {
+	byOffset := map[int64]*packEntry{}
+	bySha := map[string]*packEntry{}
+	deltas := 0
+	for _, entry := range entries {
+		byOffset[entry.offset] = entry
+		if entry.objectType != "" {
+			entry.sha = objectHash(entry.objectType, entry.data)
+			bySha[entry.sha] = entry
+		} else {
+			deltas++
+		}
+	}
+
+	if deltas == 0 {
+		// like git, no line at all without deltas
+		progress = nil
+	}
+	p := startProgress(progress, "Resolving deltas", deltas)
+	resolved := 0
+
+	var resolve func(entry *packEntry, depth int) error
+	resolve = func(entry *packEntry, depth int) error {
+		if entry.sha != "" {
+			return nil
+		}
+		if depth > 10000 {
+			return fmt.Errorf("delta chain too deep at offset %d", entry.offset)
+		}
+
+		var baseType string
+		var baseData []byte
+
+		if entry.packType == packOfsDelta {
+			base, ok := byOffset[entry.baseOffset]
+			if !ok {
+				return fmt.Errorf("no object at delta base offset %d", entry.baseOffset)
+			}
+			if err := resolve(base, depth+1); err != nil {
+				return err
+			}
+			baseType, baseData = base.objectType, base.data
+		} else if base, ok := bySha[entry.baseSha]; ok {
+			if err := resolve(base, depth+1); err != nil {
+				return err
+			}
+			baseType, baseData = base.objectType, base.data
+		} else {
+			// the pack is thin, its base should already be in the repository
+			objectType, content, err := readObject(entry.baseSha)
+			if err != nil {
+				return fmt.Errorf("delta base %s not found: %s", entry.baseSha, err)
+			}
+			baseType, baseData = objectType, content
+		}
+
+		data, err := applyDelta(baseData, entry.data)
+		if err != nil {
+			return fmt.Errorf("object at offset %d: %s", entry.offset, err)
+		}
+
+		entry.objectType = baseType
+		entry.data = data
+		entry.sha = objectHash(entry.objectType, entry.data)
+		bySha[entry.sha] = entry
+		resolved++
+		p.update(resolved)
+		return nil
+	}
+
+	// REF_DELTA bases can come after the delta, so resolve everything that
+	// doesn't depend on a sha first
+	for _, entry := range entries {
+		if entry.packType != packRefDelta {
+			if err := resolve(entry, 0); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range entries {
+		if err := resolve(entry, 0); err != nil {
+			return err
+		}
+	}
+	p.done()
+
+	return nil
+}
+
+// writePackIndex writes a version 2 pack index for the entries:
+//
+//	\377tOc <version: 4 bytes>
+//	<fan-out: 256 x 4 bytes, number of objects with a first byte <= i>
+//	<object names: N x 20 bytes, sorted>
+//	<crc32 of each packed entry: N x 4 bytes>
+//	<offsets: N x 4 bytes, MSB set means an index into the next table>
+//	<large offsets: 8 bytes each>
+//	<pack checksum: 20 bytes>
+//	<index checksum: 20 bytes>
+func writePackIndex(path string, entries []*packEntry, packChecksum []byte) error {
+	sorted := append([]*packEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].sha < sorted[j].sha })
+
+	var index bytes.Buffer
+	index.Write([]byte{0xff, 't', 'O', 'c', 0, 0, 0, 2})
+
+	var fanout [256]uint32
+	for _, entry := range sorted {
+		first, _ := hex.DecodeString(entry.sha[:2])
+		fanout[first[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&index, binary.BigEndian, fanout)
+
+	for _, entry := range sorted {
+		sha, _ := hex.DecodeString(entry.sha)
+		index.Write(sha)
+	}
+	for _, entry := range sorted {
+		binary.Write(&index, binary.BigEndian, entry.crc)
+	}
+
+	var large []uint64
+	for _, entry := range sorted {
+		if entry.offset < 0x80000000 {
+			binary.Write(&index, binary.BigEndian, uint32(entry.offset))
+			continue
+		}
+		binary.Write(&index, binary.BigEndian, uint32(0x80000000|len(large)))
+		large = append(large, uint64(entry.offset))
+	}
+	binary.Write(&index, binary.BigEndian, large)
+
+	index.Write(packChecksum)
+	checksum := sha1.Sum(index.Bytes())
+	index.Write(checksum[:])
+
+	return writeObjectFile(path, index.Bytes(), 0444)
+}
+
+// writePack writes the given objects as a version 2 pack, see parsePack for
+// its layout. How each one is stored, whole or as a delta, is up to
+// findDeltas. A delta always comes after its base, as an OFS_DELTA. The
+// objects are compressed at the zlib level of the options, see
+// packCompression, and those written are reported to progress, when not
+// nil. It returns how many objects were written as deltas, and how many of
+// those were reused as they were.
+func writePack(w io.Writer, shas []string, opts packOptions, progress io.Writer) (packStats, error) {
+	stats := packStats{total: len(shas)}
+	candidates, err := findDeltas(shas, opts, progress)
+	if err != nil {
+		return stats, err
+	}
+
+	hash := sha1.New()
+	pack := io.MultiWriter(w, hash)
+
+	header := []byte{'P', 'A', 'C', 'K', 0, 0, 0, 2}
+	header = binary.BigEndian.AppendUint32(header, uint32(len(shas)))
+	if _, err := pack.Write(header); err != nil {
+		return stats, err
+	}
+
+	offsets := make(map[string]int64, len(shas))
+	offset := int64(len(header))
+	p := startProgress(progress, "Writing objects", len(shas))
+	var write func(candidate *packCandidate) error
+	write = func(candidate *packCandidate) error {
+		if _, ok := offsets[candidate.sha]; ok {
+			return nil
+		}
+		if candidate.base != "" {
+			if err := write(candidates[candidate.base]); err != nil {
+				return err
+			}
+		}
+
+		var entry []byte
+		var err error
+		switch {
+		case candidate.reused != nil:
+			entry = encodeOfsDeltaHeader(len(candidate.reused.entry.data), offset-offsets[candidate.base])
+			entry = append(entry, candidate.reused.zlibData()...)
+		case candidate.delta != nil:
+			entry, err = encodeOfsDelta(candidate.delta, offset-offsets[candidate.base], opts.level)
+		default:
+			var objectType string
+			var content []byte
+			if objectType, content, err = readObject(candidate.sha); err == nil {
+				entry, err = encodePackEntry(objectType, content, opts.level)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("object '%s': %s", candidate.sha, err)
+		}
+		if _, err := pack.Write(entry); err != nil {
+			return err
+		}
+
+		offsets[candidate.sha] = offset
+		offset += int64(len(entry))
+		if candidate.base != "" {
+			stats.deltas++
+		}
+		if candidate.reused != nil {
+			stats.reused++
+		}
+		p.update(len(offsets))
+		return nil
+	}
+	for _, sha := range shas {
+		if err := write(candidates[sha]); err != nil {
+			return stats, err
+		}
+	}
+	p.done()
+
+	_, err = w.Write(hash.Sum(nil))
+	return stats, err
+}
+
+// packStats are what writePack reports: how many objects it wrote, how many
+// as deltas, and how many of those deltas it reused from the packs.
+type packStats struct {
+	total  int
+	deltas int
+	reused int
+}
+
+// String formats the stats the way git reports them once a pack is written.
+func (s packStats) String() string {
+	return fmt.Sprintf("Total %d (delta %d), reused %d (delta %d), pack-reused 0", s.total, s.deltas, s.reused, s.reused)
+}
+
+// encodePackEntryHeader encodes the type and inflated size that start a pack
+// entry, 4 bits of the size in the first byte then 7 per byte.
+func encodePackEntryHeader(packType int, size int) []byte {
+	header := []byte{byte(packType<<4 | size&0x0f)}
+	for size >>= 4; size > 0; size >>= 7 {
+		header[len(header)-1] |= 0x80
+		header = append(header, byte(size&0x7f))
+	}
+	return header
+}
+
+// encodeOfsDeltaHeader encodes the header of an OFS_DELTA entry: its type
+// and size, then how far back its base is, big-endian 7 bits per byte,
+// each byte but the last adding one to what it continues.
+func encodeOfsDeltaHeader(size int, distance int64) []byte {
+	header := encodePackEntryHeader(packOfsDelta, size)
+	encoded := []byte{byte(distance & 0x7f)}
+	for distance >>= 7; distance > 0; distance >>= 7 {
+		distance--
+		encoded = append([]byte{byte(0x80 | distance&0x7f)}, encoded...)
+	}
+	return append(header, encoded...)
+}
+
+// encodeOfsDelta encodes a delta as an OFS_DELTA pack entry, whose base is
+// distance bytes before it, compressed at the given zlib level.
+func encodeOfsDelta(delta []byte, distance int64, level int) ([]byte, error) {
+	compressed, err := zlibCompress(delta, level)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeOfsDeltaHeader(len(delta), distance), compressed...), nil
+}
+
+// encodePackEntry encodes an object as a whole (undeltified) pack entry,
+// compressed at the given zlib level.
+func encodePackEntry(objectType string, content []byte, level int) ([]byte, error) {
+	packType := packTypeOf(objectType)
+	if packType == 0 {
+		return nil, fmt.Errorf("unknown object type '%s'", objectType)
+	}
+	compressed, err := zlibCompress(content, level)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodePackEntryHeader(packType, len(content)), compressed...), nil
+}
+
+// zlibCompress compresses data at the given zlib level.
+func zlibCompress(data []byte, level int) ([]byte, error) {
+	var compressed bytes.Buffer
+	zWriter, err := zlib.NewWriterLevel(&compressed, level)
+	if err != nil {
+		return nil, err
+	}
+	zWriter.Write(data)
+	if err := zWriter.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// packCompression returns the zlib level for the objects of new packs:
+// pack.compression, or core.compression, from -1 (zlib's default) to 9 (the
+// best compression).
+func packCompression() int {
+	for _, key := range []string{"pack.compression", "core.compression"} {
+		value, ok := configGet(key)
+		if !ok {
+			continue
+		}
+		if level, err := strconv.Atoi(value); err == nil && level >= -1 && level <= 9 {
+			return level
+		}
+	}
+	return zlib.DefaultCompression
+}
+
+// packRecorder keeps a copy of every byte read through it.
+type packRecorder struct {
+	reader *bufio.Reader
+	data   []byte
+}
+
+func (r *packRecorder) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.data = append(r.data, p[:n]...)
+	return n, err
+}
+
+func (r *packRecorder) ReadByte() (byte, error) {
+	c, err := r.reader.ReadByte()
+	if err == nil {
+		r.data = append(r.data, c)
+	}
+	return c, err
+}
+
+// readPackStream reads a pack from a stream that goes on after it, eg: a
+// push, where the client waits for an answer after sending the pack. The
+// entries have to be inflated to know where the pack ends. bufio.Reader is
+// an io.ByteReader, so zlib doesn't read past the end of each entry.
+func readPackStream(reader *bufio.Reader) ([]byte, error) {
+	r := &packRecorder{reader: reader}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "PACK" {
+		return nil, fmt.Errorf("not a packfile")
+	}
+	count := binary.BigEndian.Uint32(header[8:12])
+
+	for i := uint32(0); i < count; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		packType := int(c>>4) & 7
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return nil, err
+			}
+		}
+
+		switch packType {
+		case packOfsDelta:
+			for c, err = r.ReadByte(); err == nil && c&0x80 != 0; {
+				c, err = r.ReadByte()
+			}
+		case packRefDelta:
+			_, err = io.ReadFull(r, make([]byte, sha1.Size))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		zReader, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(io.Discard, zReader)
+		zReader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(r, make([]byte, sha1.Size)); err != nil {
+		return nil, err
+	}
+	return r.data, nil
+}
+
+// completeThinPack appends to a thin pack the objects its deltas are based
+// on but that it doesn't contain, so the pack can be used on its own. The
+// entries must be resolved already, see resolvePackDeltas. It returns the
+// completed pack, its entries and checksum.
+func completeThinPack(pack []byte, entries []*packEntry) ([]byte, []*packEntry, []byte, error) {
+	inPack := map[string]bool{}
+	for _, entry := range entries {
+		inPack[entry.sha] = true
+	}
+
+	trailer := len(pack) - sha1.Size
+	completed := append([]byte{}, pack[:trailer]...)
+	for _, entry := range entries {
+		if entry.packType != packRefDelta || inPack[entry.baseSha] {
+			continue
+		}
+		inPack[entry.baseSha] = true
+
+		objectType, content, err := readObject(entry.baseSha)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("delta base %s not found: %s", entry.baseSha, err)
+		}
+		data, err := encodePackEntry(objectType, content, packCompression())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		entries = append(entries, &packEntry{
+			offset:     int64(len(completed)),
+			packType:   packTypeOf(objectType),
+			crc:        crc32.ChecksumIEEE(data),
+			data:       content,
+			objectType: objectType,
+			sha:        entry.baseSha,
+		})
+		completed = append(completed, data...)
+	}
+	if len(completed) == trailer {
+		return pack, entries, pack[trailer:], nil
+	}
+
+	binary.BigEndian.PutUint32(completed[8:12], uint32(len(entries)))
+	checksum := sha1.Sum(completed)
+	return append(completed, checksum[:]...), entries, checksum[:], nil
+}
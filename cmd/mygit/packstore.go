@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// packIndex is a version 2 pack index, see writePackIndex for its layout.
+type packIndex struct {
+	fanout  [256]uint32
+	shas    []byte // sorted object names, 20 bytes each
+	offsets []int64
+}
+
+// readPackIndex reads and checks the index of a pack.
+func readPackIndex(path string) (*packIndex, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < 8+256*4+2*sha1.Size || !bytes.Equal(content[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		return nil, fmt.Errorf("%s is not a version 2 pack index", path)
+	}
+	trailer := len(content) - sha1.Size
+	if checksum := sha1.Sum(content[:trailer]); !bytes.Equal(checksum[:], content[trailer:]) {
+		return nil, fmt.Errorf("%s has a bad checksum", path)
+	}
+
+	idx := &packIndex{}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(content[8+4*i:])
+	}
+	count := int(idx.fanout[255])
+
+	shasAt := 8 + 256*4
+	offsetsAt := shasAt + count*sha1.Size + count*4
+	largeAt := offsetsAt + count*4
+	if largeAt+2*sha1.Size > len(content) {
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+
+	idx.shas = content[shasAt : shasAt+count*sha1.Size]
+	idx.offsets = make([]int64, count)
+	for i := range idx.offsets {
+		offset := binary.BigEndian.Uint32(content[offsetsAt+4*i:])
+		if offset&0x80000000 == 0 {
+			idx.offsets[i] = int64(offset)
+			continue
+		}
+
+		at := largeAt + 8*int(offset&0x7fffffff)
+		if at+8 > trailer-sha1.Size {
+			return nil, fmt.Errorf("%s has a bad large offset", path)
+		}
+		idx.offsets[i] = int64(binary.BigEndian.Uint64(content[at:]))
+	}
+
+	return idx, nil
+}
+
+// count returns the number of objects in the pack.
+func (idx *packIndex) count() int {
+	return len(idx.offsets)
+}
+
+// sha returns the name of the i-th object, in sorted order.
+func (idx *packIndex) sha(i int) string {
+	return hex.EncodeToString(idx.shas[i*sha1.Size : (i+1)*sha1.Size])
+}
+
+// find returns the offset of an object in the pack, using the fan-out to
+// narrow down the search to the objects with the same first byte.
+func (idx *packIndex) find(sha string) (int64, bool) {
+	name, err := hex.DecodeString(sha)
+	if err != nil || len(name) != sha1.Size {
+		return 0, false
+	}
+
+	lo := 0
+	if name[0] > 0 {
+		lo = int(idx.fanout[name[0]-1])
+	}
+	hi := int(idx.fanout[name[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.shas[(lo+i)*sha1.Size:(lo+i+1)*sha1.Size], name) >= 0
+	})
+	if i < hi && bytes.Equal(idx.shas[i*sha1.Size:(i+1)*sha1.Size], name) {
+		return idx.offsets[i], true
+	}
+	return 0, false
+}
+
+// packFile is a pack and its index. The pack itself is only read when an
+// object is needed from it.
+type packFile struct {
+	name       string // pack-<checksum>.pack
+	path       string
+	index      *packIndex
+	data       []byte
+	offsetShas map[int64]string // the names of the objects by offset, see shaAt
+}
+
+// entry parses the entry at offset, a delta left as it is, and returns the
+// offset where it ends.
+func (p *packFile) entry(offset int64) (*packEntry, int64, error) {
+	if p.data == nil {
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(data) < 12+sha1.Size || string(data[:4]) != "PACK" {
+			return nil, 0, fmt.Errorf("%s is not a packfile", p.path)
+		}
+		p.data = data
+	}
+
+	reader := bytes.NewReader(p.data[:len(p.data)-sha1.Size])
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	entry, err := parsePackEntry(reader, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad object at offset %d of %s: %s", offset, p.name, err)
+	}
+	return entry, reader.Size() - int64(reader.Len()), nil
+}
+
+// shaAt returns the name of the object at an offset of the pack, eg: the
+// base of an OFS_DELTA.
+func (p *packFile) shaAt(offset int64) (string, bool) {
+	if p.offsetShas == nil {
+		p.offsetShas = make(map[int64]string, p.index.count())
+		for i := 0; i < p.index.count(); i++ {
+			p.offsetShas[p.index.offsets[i]] = p.index.sha(i)
+		}
+	}
+	sha, ok := p.offsetShas[offset]
+	return sha, ok
+}
+
+// read returns the content and type of the object at offset, applying its
+// deltas. The base of a REF_DELTA is looked up in the pack first, then with
+// readObject.
+func (p *packFile) read(offset int64, depth int) ([]byte, string, error) {
+	if depth > 10000 {
+		return nil, "", fmt.Errorf("delta chain too deep at offset %d of %s", offset, p.name)
+	}
+	entry, _, err := p.entry(offset)
+	if err != nil {
+		return nil, "", err
+	}
+	if entry.objectType != "" {
+		return entry.data, entry.objectType, nil
+	}
+
+	var base []byte
+	var baseType string
+	if entry.packType == packOfsDelta {
+		base, baseType, err = p.read(entry.baseOffset, depth+1)
+	} else if baseOffset, ok := p.index.find(entry.baseSha); ok {
+		base, baseType, err = p.read(baseOffset, depth+1)
+	} else {
+		baseType, base, err = readObject(entry.baseSha)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := applyDelta(base, entry.data)
+	if err != nil {
+		return nil, "", fmt.Errorf("object at offset %d of %s: %s", offset, p.name, err)
+	}
+	return content, baseType, nil
+}
+
+// packedObject is how an object is stored in a pack: its entry as it is,
+// a delta unresolved, where it starts and ends, and the name of its base
+// for a delta.
+type packedObject struct {
+	pack    *packFile
+	entry   *packEntry
+	offset  int64
+	end     int64
+	baseSha string
+}
+
+// diskSize is the size the object takes in the pack, its header included,
+// the way git reports it with %(objectsize:disk).
+func (o *packedObject) diskSize() int64 {
+	return o.end - o.offset
+}
+
+// zlibData returns the compressed data of the entry, as it is in the pack.
+func (o *packedObject) zlibData() []byte {
+	return o.pack.data[o.entry.dataOffset:o.end]
+}
+
+// PackStore reads the objects of the packs in a folder, eg:
+// .git/objects/pack. When the folder has a multi-pack-index, objects are
+// looked up there first instead of in each pack index.
+//
+// Packs are only ever written whole, by index-pack, so Write fails. Like
+// git, the folder is scanned again when an object isn't found, in case a
+// pack was added in the meantime.
+type PackStore struct {
+	dir     string
+	scanned time.Time // modification time of dir when it was last scanned
+	packs   []*packFile
+	midx    *multiPackIndex
+}
+
+// NewPackStore returns the store of the packs in dir. Nothing is read until
+// the first lookup.
+func NewPackStore(dir string) *PackStore {
+	return &PackStore{dir: dir}
+}
+
+// load reads the pack indexes and the multi-pack-index, if any, unless dir
+// didn't change since the last time. A pack without an index isn't usable
+// yet and is skipped.
+func (s *PackStore) load() error {
+	info, err := os.Stat(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.scanned) {
+		return nil
+	}
+
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".idx") {
+			continue
+		}
+
+		packName := strings.TrimSuffix(name, ".idx") + ".pack"
+		if s.pack(packName) != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, packName)); err != nil {
+			continue
+		}
+		index, err := readPackIndex(filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+		s.packs = append(s.packs, &packFile{name: packName, path: filepath.Join(s.dir, packName), index: index})
+	}
+
+	midx, err := readMultiPackIndex(filepath.Join(s.dir, multiPackIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.midx = midx
+
+	s.scanned = info.ModTime()
+	return nil
+}
+
+// pack returns the pack with the given name, eg: pack-<checksum>.pack.
+func (s *PackStore) pack(name string) *packFile {
+	for _, p := range s.packs {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// find returns the pack holding an object and its offset there.
+func (s *PackStore) find(sha string) (*packFile, int64, bool) {
+	if p, offset, ok := s.lookup(sha); ok {
+		return p, offset, true
+	}
+
+	// maybe the object is in a new pack
+	if err := s.load(); err != nil {
+		return nil, 0, false
+	}
+	return s.lookup(sha)
+}
+
+// lookup finds an object in the packs known so far.
+func (s *PackStore) lookup(sha string) (*packFile, int64, bool) {
+	covered := map[string]bool{}
+	if s.midx != nil {
+		if name, offset, ok := s.midx.find(sha); ok {
+			if p := s.pack(name); p != nil {
+				return p, offset, true
+			}
+		}
+		for _, name := range s.midx.packNames {
+			covered[name] = true
+		}
+	}
+
+	// packs written after the multi-pack-index aren't in it
+	for _, p := range s.packs {
+		if covered[p.name] {
+			continue
+		}
+		if offset, ok := p.index.find(sha); ok {
+			return p, offset, true
+		}
+	}
+	return nil, 0, false
+}
+
+// packed returns how an object is stored in the packs, without reading its
+// deltas.
+func (s *PackStore) packed(sha string) (*packedObject, error) {
+	p, offset, ok := s.find(sha)
+	if !ok {
+		return nil, fmt.Errorf("object '%s' not found in packs", sha)
+	}
+	entry, end, err := p.entry(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &packedObject{pack: p, entry: entry, offset: offset, end: end, baseSha: entry.baseSha}
+	if entry.packType == packOfsDelta {
+		if object.baseSha, ok = p.shaAt(entry.baseOffset); !ok {
+			return nil, fmt.Errorf("no object at delta base offset %d of %s", entry.baseOffset, p.name)
+		}
+	}
+	return object, nil
+}
+
+func (s *PackStore) Read(sha string) ([]byte, string, error) {
+	p, offset, ok := s.find(sha)
+	if !ok {
+		return nil, "", fmt.Errorf("object '%s' not found in packs", sha)
+	}
+
+	trace("read object %s from %s", sha, p.name)
+	content, objectType, err := p.read(offset, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, objectType, nil
+}
+
+// Open streams an object of the packs, like LooseStore.Open, straight from
+// the pack file, which is never read entirely for it. A delta is read
+// entirely instead, since it has to be applied to its base.
+func (s *PackStore) Open(sha string) (string, int64, *objectReader, error) {
+	p, offset, ok := s.find(sha)
+	if !ok {
+		return "", 0, nil, fmt.Errorf("object '%s' not found in packs", sha)
+	}
+
+	trace("read object %s from %s", sha, p.name)
+	file, err := os.Open(p.path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return "", 0, nil, err
+	}
+	buffered := bufio.NewReader(file)
+	packType, size, err := readPackEntryHeader(buffered)
+	if err != nil {
+		file.Close()
+		return "", 0, nil, fmt.Errorf("bad object at offset %d of %s: %s", offset, p.name, err)
+	}
+
+	if packType == packOfsDelta || packType == packRefDelta {
+		file.Close()
+		content, objectType, err := p.read(offset, 0)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return objectType, int64(len(content)), &objectReader{Reader: bytes.NewReader(content)}, nil
+	}
+	objectType := packObjectTypes[packType]
+	if objectType == "" {
+		file.Close()
+		return "", 0, nil, fmt.Errorf("bad object at offset %d of %s: unknown object type %d", offset, p.name, packType)
+	}
+	zReader, err := zlib.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return "", 0, nil, fmt.Errorf("failed to decompress object '%s': %s", sha, err)
+	}
+	return objectType, size, &objectReader{Reader: zReader, close: func() error {
+		zReader.Close()
+		return file.Close()
+	}}, nil
+}
+
+func (s *PackStore) Write(objectType string, content []byte) (string, error) {
+	return "", fmt.Errorf("packs are read-only")
+}
+
+func (s *PackStore) Has(sha string) bool {
+	_, _, ok := s.find(sha)
+	return ok
+}
+
+// Iterate visits the objects pack by pack, an object in several packs is
+// visited for each of them.
+func (s *PackStore) Iterate(visit func(sha string)) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	for _, p := range s.packs {
+		for i := 0; i < p.index.count(); i++ {
+			visit(p.index.sha(i))
+		}
+	}
+	return nil
+}
+
+// StackedStore looks objects up in several stores in turn, eg: the loose
+// objects and then the packs, and writes to the first one.
+type StackedStore struct {
+	stores []ObjectStore
+}
+
+// NewStackedStore returns a store over the given ones, in lookup order.
+func NewStackedStore(stores ...ObjectStore) *StackedStore {
+	return &StackedStore{stores: stores}
+}
+
+func (s *StackedStore) Read(sha string) ([]byte, string, error) {
+	for _, store := range s.stores {
+		if store.Has(sha) {
+			return store.Read(sha)
+		}
+	}
+	return nil, "", fmt.Errorf("object '%s' not found", sha)
+}
+
+func (s *StackedStore) Write(objectType string, content []byte) (string, error) {
+	return s.stores[0].Write(objectType, content)
+}
+
+func (s *StackedStore) Has(sha string) bool {
+	for _, store := range s.stores {
+		if store.Has(sha) {
+			return true
+		}
+	}
+	return false
+}
+
+// Iterate visits every object once, even when several stores have it.
+func (s *StackedStore) Iterate(visit func(sha string)) error {
+	seen := map[string]bool{}
+	for _, store := range s.stores {
+		err := store.Iterate(func(sha string) {
+			if !seen[sha] {
+				seen[sha] = true
+				visit(sha)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// packTransport talks to git on the other end: upload-pack to fetch and
+// receive-pack to push, run here for a path or a file:// URL, or over the
+// smart HTTP protocol for an http(s) URL.
+//
+// Each fetch or push is a single request and its response, like the
+// stateless protocol of http, even to a local upload-pack: the client sends
+// all the commits it has at once, rather than negotiating over rounds.
+type packTransport struct {
+	url          string
+	service      string // upload-pack or receive-pack, once listed
+	conn         packConnection
+	capabilities map[string]bool
+	refs         []remoteRef
+	filter       string    // the objects to leave out of fetches, see parseObjectFilter
+	depth        int       // the commits of history to fetch, 0 for all of it
+	progress     io.Writer // where fetches report progress, nowhere when nil
+}
+
+// packConnection is a connection to upload-pack or receive-pack.
+type packConnection interface {
+	// advertisement returns the stream of the refs advertised.
+	advertisement() (*bufio.Reader, error)
+	// request sends a request and returns the stream of the response.
+	request(body []byte) (*bufio.Reader, error)
+	close() error
+}
+
+// newPackTransport returns the transport to the repository at url. Nothing
+// is run or requested until the refs are listed.
+func newPackTransport(url string) (*packTransport, error) {
+	if scheme, _, found := strings.Cut(url, "://"); found && scheme != "file" && scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("transport '%s' not supported", scheme)
+	}
+	return &packTransport{url: url}, nil
+}
+
+// connect starts the service, unless it's the one running already.
+func (t *packTransport) connect(service string) error {
+	if t.service == service {
+		return nil
+	}
+	if t.conn != nil {
+		if err := t.conn.close(); err != nil {
+			return err
+		}
+		t.conn, t.service = nil, ""
+	}
+
+	var conn packConnection
+	if strings.HasPrefix(t.url, "http://") || strings.HasPrefix(t.url, "https://") {
+		conn = &httpConnection{url: strings.TrimSuffix(t.url, "/"), service: service}
+	} else {
+		process, err := startPackProcess(service, strings.TrimPrefix(t.url, "file://"))
+		if err != nil {
+			return err
+		}
+		conn = process
+	}
+
+	r, err := conn.advertisement()
+	if err == nil {
+		t.refs, t.capabilities, err = readAdvertisedRemoteRefs(r)
+	}
+	if err != nil {
+		conn.close()
+		return err
+	}
+	t.conn, t.service = conn, service
+	return nil
+}
+
+// readAdvertisedRemoteRefs reads the refs advertised, with the capabilities
+// following the first one. HEAD gets the ref it points to from the symref
+// capability.
+func readAdvertisedRemoteRefs(r *bufio.Reader) ([]remoteRef, map[string]bool, error) {
+	var refs []remoteRef
+	capabilities := map[string]bool{}
+	symrefs := map[string]string{}
+	for {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if flush {
+			break
+		}
+
+		line, advertised, found := strings.Cut(line, "\x00")
+		if found {
+			for _, capability := range strings.Fields(advertised) {
+				capabilities[capability] = true
+				if symref, found := strings.CutPrefix(capability, "symref="); found {
+					name, target, _ := strings.Cut(symref, ":")
+					symrefs[name] = target
+				}
+			}
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if !ok || !isObjectName(sha) {
+			return nil, nil, fmt.Errorf("protocol error: unexpected '%s'", line)
+		}
+		if name == "capabilities^{}" {
+			continue
+		}
+		refs = append(refs, remoteRef{name: name, sha: sha, symref: symrefs[name]})
+	}
+	return refs, capabilities, nil
+}
+
+func (t *packTransport) list(forPush bool) ([]remoteRef, error) {
+	service := "upload-pack"
+	if forPush {
+		service = "receive-pack"
+	}
+	if err := t.connect(service); err != nil {
+		return nil, err
+	}
+	return t.refs, nil
+}
+
+// fetch asks upload-pack for the refs, telling it about the tips of every
+// ref here and of the refs of the remote we have, and stores the pack it sends, see storePack:
+//
+//	want <sha> <capabilities>
+//	want <sha>
+//	shallow <sha>
+//	deepen <depth>
+//	filter <filter-spec>
+//	0000
+//	have <sha>
+//	done
+//
+// The shallow lines are the commits of .git/shallow, and deepen the depth
+// asked for, if any. upload-pack then answers with the commits to add to
+// .git/shallow and those to remove from it, see sendShallowInfo, and a
+// flush. Without multi_ack, it answers with a single ACK for the first
+// commit we have in common, or a NAK, before the pack.
+func (t *packTransport) fetch(refs []remoteRef) error {
+	shas := make([]string, 0, len(refs))
+	for _, r := range refs {
+		shas = append(shas, r.sha)
+	}
+	return t.fetchObjects(shas, true)
+}
+
+// fetchObjects asks upload-pack for objects, which can be any object when
+// the remote allows it, see uploadPackCapabilities, and stores the pack it
+// sends. Without negotiate, no haves are sent, eg: to get the blobs missing
+// from a partial clone, see PromisorStore.
+func (t *packTransport) fetchObjects(shas []string, negotiate bool) error {
+	if err := t.connect("upload-pack"); err != nil {
+		return err
+	}
+	// the request uses up the connection
+	defer t.close()
+
+	// objects fetched to complete a partial clone have nothing to do with
+	// the history, see PromisorStore
+	var shallows []string
+	if negotiate {
+		shallows = sortedKeys(loadShallow())
+	}
+	deepen := negotiate && (t.depth > 0 || len(shallows) > 0)
+	if deepen && !t.capabilities["shallow"] {
+		return fmt.Errorf("Server does not support shallow clients")
+	}
+
+	capabilities := []string{"side-band-64k", "ofs-delta"}
+	if deepen {
+		capabilities = append(capabilities, "shallow")
+	}
+	if t.filter != "" {
+		capabilities = append(capabilities, "filter")
+	}
+	// objects missing from a partial clone are fetched quietly
+	progress := t.progress
+	if !negotiate {
+		progress = nil
+	}
+	if progress == nil {
+		capabilities = append(capabilities, "no-progress")
+	}
+
+	var body bytes.Buffer
+	wanted := map[string]bool{}
+	for _, sha := range shas {
+		if wanted[sha] {
+			continue
+		}
+		line := "want " + sha
+		if len(wanted) == 0 {
+			line += " " + t.requestCapabilities(capabilities...)
+		}
+		wanted[sha] = true
+		writePktLine(&body, line+"\n")
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	for _, sha := range shallows {
+		writePktLine(&body, "shallow "+sha+"\n")
+	}
+	if negotiate && t.depth > 0 {
+		writePktLine(&body, fmt.Sprintf("deepen %d\n", t.depth))
+	}
+	if t.filter != "" {
+		if t.capabilities["filter"] {
+			writePktLine(&body, "filter "+t.filter+"\n")
+		} else {
+			fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+		}
+	}
+	writeFlushPkt(&body)
+
+	if negotiate {
+		// the refs of the remote we have are as good as ours, eg: when
+		// following tags after a first fetch
+		ours, err := listRefs()
+		if err != nil {
+			return err
+		}
+		for _, r := range t.refs {
+			if objects.Has(r.sha) {
+				ours = append(ours, ref{name: r.name, sha: r.sha})
+			}
+		}
+		haves := map[string]bool{}
+		for _, r := range ours {
+			if sha, objectType, err := peelTag(r.sha); err == nil && objectType == "commit" && !haves[sha] {
+				haves[sha] = true
+				writePktLine(&body, "have "+sha+"\n")
+			}
+		}
+	}
+	writePktLine(&body, "done\n")
+
+	r, err := t.conn.request(body.Bytes())
+	if err != nil {
+		return err
+	}
+	var shallow, unshallow []string
+	if deepen {
+		for {
+			line, flush, err := readPktLine(r)
+			if err != nil {
+				return fmt.Errorf("expected shallow list, got EOF")
+			}
+			if flush {
+				break
+			}
+			if sha, ok := strings.CutPrefix(line, "shallow "); ok && isObjectName(sha) {
+				shallow = append(shallow, sha)
+			} else if sha, ok := strings.CutPrefix(line, "unshallow "); ok && isObjectName(sha) {
+				unshallow = append(unshallow, sha)
+			} else if strings.HasPrefix(line, "ERR ") {
+				return fmt.Errorf("remote error: %s", strings.TrimPrefix(line, "ERR "))
+			} else {
+				return fmt.Errorf("expected shallow/unshallow, got '%s'", line)
+			}
+		}
+	}
+	line, _, err := readPktLine(r)
+	if err != nil {
+		return fmt.Errorf("expected ACK/NAK, got EOF")
+	}
+	if strings.HasPrefix(line, "ERR ") {
+		return fmt.Errorf("remote error: %s", strings.TrimPrefix(line, "ERR "))
+	}
+	if line != "NAK" && !strings.HasPrefix(line, "ACK ") {
+		return fmt.Errorf("expected ACK/NAK, got '%s'", line)
+	}
+
+	var pack bytes.Buffer
+	if t.capabilities["side-band-64k"] {
+		err = readSideband(r, &pack, progress)
+	} else {
+		_, err = io.Copy(&pack, r)
+	}
+	if err != nil {
+		return err
+	}
+	if err := storePack(pack.Bytes(), unpackLimit("fetch.unpackLimit"), progress); err != nil {
+		return err
+	}
+	return updateShallow(shallow, unshallow)
+}
+
+// push sends receive-pack the updates, and a pack of the objects they need
+// that the remote doesn't have, unless they only delete refs:
+//
+//	<old> <new> <ref>\0<capabilities>
+//	<old> <new> <ref>
+//	0000
+//	<pack>
+//
+// A missing old or new object is a zeroSha. receive-pack answers with the
+// outcome of the unpacking and of each update, see receivePack.
+func (t *packTransport) push(updates []pushUpdate) ([]pushStatus, error) {
+	if len(updates) == 0 {
+		return nil, nil
+	}
+	if err := t.connect("receive-pack"); err != nil {
+		return nil, err
+	}
+	defer t.close()
+
+	var body bytes.Buffer
+	var news []string
+	for i, update := range updates {
+		old, sha := update.old, update.sha
+		if old == "" {
+			old = zeroSha
+		}
+		if sha == "" {
+			sha = zeroSha
+		} else {
+			news = append(news, sha)
+		}
+		line := old + " " + sha + " " + update.dst
+		if i == 0 {
+			line += "\x00" + t.requestCapabilities("report-status", "side-band-64k", "ofs-delta")
+		}
+		writePktLine(&body, line+"\n")
+	}
+	writeFlushPkt(&body)
+
+	if len(news) > 0 {
+		// whatever the remote has that we have too isn't sent
+		var haves []string
+		for _, r := range t.refs {
+			if objects.Has(r.sha) {
+				haves = append(haves, r.sha)
+			}
+		}
+		shas, err := objectsToSend(news, haves, nil, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writePack(&body, shas, defaultPackOptions(), os.Stderr); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := t.conn.request(body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if !t.capabilities["report-status"] {
+		var statuses []pushStatus
+		for _, update := range updates {
+			statuses = append(statuses, pushStatus{ref: update.dst})
+		}
+		return statuses, nil
+	}
+	if t.capabilities["side-band-64k"] {
+		var report bytes.Buffer
+		if err := readSideband(r, &report, os.Stderr); err != nil {
+			return nil, err
+		}
+		r = bufio.NewReader(&report)
+	}
+	return readPushReport(r)
+}
+
+// readPushReport reads the report-status of receive-pack:
+//
+//	unpack ok
+//	ok refs/heads/main
+//	ng refs/heads/topic non-fast-forward
+//	0000
+func readPushReport(r *bufio.Reader) ([]pushStatus, error) {
+	line, _, err := readPktLine(r)
+	if err != nil {
+		return nil, fmt.Errorf("the remote end hung up unexpectedly")
+	}
+	if unpack, found := strings.CutPrefix(line, "unpack "); !found {
+		return nil, fmt.Errorf("protocol error: expected unpack status, got '%s'", line)
+	} else if unpack != "ok" {
+		return nil, fmt.Errorf("remote unpack failed: %s", unpack)
+	}
+
+	var statuses []pushStatus
+	for {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return statuses, nil
+		}
+		if ref, found := strings.CutPrefix(line, "ok "); found {
+			statuses = append(statuses, pushStatus{ref: ref})
+		} else if rest, found := strings.CutPrefix(line, "ng "); found {
+			ref, why, _ := strings.Cut(rest, " ")
+			statuses = append(statuses, pushStatus{ref: ref, err: why})
+		} else {
+			return nil, fmt.Errorf("protocol error: invalid ref status from remote: %s", line)
+		}
+	}
+}
+
+// requestCapabilities returns the capabilities to ask for, those the remote
+// advertised.
+func (t *packTransport) requestCapabilities(wanted ...string) string {
+	var requested []string
+	for _, capability := range wanted {
+		if t.capabilities[capability] {
+			requested = append(requested, capability)
+		}
+	}
+	return strings.Join(append(requested, "agent=mygit"), " ")
+}
+
+func (t *packTransport) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.close()
+	t.conn, t.service = nil, ""
+	return err
+}
+
+// packProcess is upload-pack or receive-pack run on a local repository.
+type packProcess struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    *bufio.Reader
+	requested bool
+}
+
+// startPackProcess runs a service on the repository at dir.
+func startPackProcess(service string, dir string) (*packProcess, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	trace("run %s %s", service, dir)
+	cmd := exec.Command(self, service, dir)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &packProcess{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+func (p *packProcess) advertisement() (*bufio.Reader, error) {
+	return p.stdout, nil
+}
+
+func (p *packProcess) request(body []byte) (*bufio.Reader, error) {
+	p.requested = true
+	_, err := p.stdin.Write(body)
+	p.stdin.Close()
+	if err != nil {
+		return nil, fmt.Errorf("the remote end hung up unexpectedly")
+	}
+	return p.stdout, nil
+}
+
+// close hangs up, with a flush when nothing was asked for, and waits for the
+// process to quit.
+func (p *packProcess) close() error {
+	if !p.requested {
+		writeFlushPkt(p.stdin)
+		p.stdin.Close()
+	}
+	io.Copy(io.Discard, p.stdout)
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("could not read from remote repository")
+	}
+	return nil
+}
+
+// httpConnection is a service of the smart HTTP protocol:
+//
+//	GET <url>/info/refs?service=git-<service>    the refs advertised
+//	POST <url>/git-<service>                     a request
+type httpConnection struct {
+	url      string
+	service  string
+	response *http.Response
+}
+
+// do sends a request and checks its response is of the given type.
+func (c *httpConnection) do(request *http.Request, contentType string) (*bufio.Reader, error) {
+	request.Header.Set("User-Agent", "git/mygit")
+	trace("%s: %s %s", c.service, request.Method, request.URL)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access '%s': %s", c.url, err)
+	}
+	if c.response != nil {
+		c.response.Body.Close()
+	}
+	c.response = response
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to access '%s': The requested URL returned error: %d", c.url, response.StatusCode)
+	}
+	if response.Header.Get("Content-Type") != contentType {
+		if request.Method == "GET" {
+			return nil, fmt.Errorf("'%s' only supports the dumb HTTP protocol, which isn't supported", c.url)
+		}
+		return nil, fmt.Errorf("invalid content-type: '%s'", response.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(response.Body), nil
+}
+
+// advertisement fetches the refs, after a line naming the service:
+//
+//	001e# service=git-upload-pack\n
+//	0000
+//	<the refs, as the service advertises them>
+func (c *httpConnection) advertisement() (*bufio.Reader, error) {
+	request, err := http.NewRequest("GET", c.url+"/info/refs?service=git-"+c.service, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.do(request, "application/x-git-"+c.service+"-advertisement")
+	if err != nil {
+		return nil, err
+	}
+
+	line, _, err := readPktLine(r)
+	if err != nil || line != "# service=git-"+c.service {
+		return nil, fmt.Errorf("invalid server response; expected service, got '%s'", line)
+	}
+	// the flush after the service line is optional
+	if header, err := r.Peek(pktLineHeader); err == nil && string(header) == "0000" {
+		io.ReadFull(r, header)
+	}
+	return r, nil
+}
+
+func (c *httpConnection) request(body []byte) (*bufio.Reader, error) {
+	request, err := http.NewRequest("POST", c.url+"/git-"+c.service, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-git-"+c.service+"-request")
+	request.Header.Set("Accept", "application/x-git-"+c.service+"-result")
+	return c.do(request, "application/x-git-"+c.service+"-result")
+}
+
+func (c *httpConnection) close() error {
+	if c.response != nil {
+		c.response.Body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// pagedCommands are the commands whose output goes through the pager by
+// default. `[pager "<command>"] enabled` (or git's `pager.<command>`) in the
+// config turns paging on or off for any command.
+var pagedCommands = map[string]bool{
+	"log":   true,
+	"diff":  true,
+	"show":  true,
+	"blame": true,
+}
+
+// pager is the running pager process, if any.
+var pager struct {
+	cmd    *exec.Cmd
+	stdout *os.File
+	pipe   *os.File
+}
+
+// pagerCommand figures out which pager to use, in git's order of precedence:
+//
+//	$GIT_PAGER, [core] pager, $PAGER, less -FRX
+//
+// An empty pager or "cat" means no paging at all.
+func pagerCommand() string {
+	if pager, ok := os.LookupEnv("GIT_PAGER"); ok {
+		return pager
+	}
+	if pager, ok := configGet("core.pager"); ok {
+		return pager
+	}
+	if pager, ok := os.LookupEnv("PAGER"); ok {
+		return pager
+	}
+	return "less -FRX"
+}
+
+// pagerEnabled checks the config for the given command, falling back to
+// whether the command is paged by default.
+func pagerEnabled(command string) bool {
+	enabled := configBool("pager."+command, pagedCommands[command])
+	return configBool("pager."+command+".enabled", enabled)
+}
+
+// setupPager starts the pager and redirects os.Stdout into it, when stdout
+// is a terminal and paging is enabled for the command.
+//
+// The pager is started through `sh -c` so $PAGER can contain arguments.
+func setupPager(command string) {
+	if !isTerminal(os.Stdout) || !pagerEnabled(command) {
+		return
+	}
+
+	pagerCmd := pagerCommand()
+	if pagerCmd == "" || pagerCmd == "cat" {
+		return
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		error := fmt.Sprintf("Failed to start pager '%s': %s", pagerCmd, err)
+		fmt.Fprintln(os.Stderr, error)
+		return
+	}
+
+	cmd := exec.Command("sh", "-c", pagerCmd)
+	cmd.Stdin = reader
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	reader.Close()
+	if err != nil {
+		writer.Close()
+		error := fmt.Sprintf("Failed to start pager '%s': %s", pagerCmd, err)
+		fmt.Fprintln(os.Stderr, error)
+		return
+	}
+
+	pager.cmd = cmd
+	pager.stdout = os.Stdout
+	pager.pipe = writer
+	os.Stdout = writer
+}
+
+// stopPager closes the pager's input and waits for the user to quit it.
+//
+// Commands must have flushed their output before this is called.
+func stopPager() {
+	if pager.cmd == nil {
+		return
+	}
+
+	os.Stdout = pager.stdout
+	pager.pipe.Close()
+	pager.cmd.Wait()
+	pager.cmd = nil
+}
+
+// exit stops the pager and exits with code. Paged commands exit through it
+// rather than os.Exit, which skips the deferred stopPager and leaves the
+// pager behind, cut short or fighting the shell for the terminal.
+func exit(code int) {
+	stopPager()
+	os.Exit(code)
+}
+
+// parsePagedFlags parses the flags of a paged command, whose FlagSet
+// continues on errors so that a bad flag exits through exit, as
+// flag.ExitOnError would otherwise exit without stopping the pager.
+func parsePagedFlags(flags *flag.FlagSet, args []string) {
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		exit(0)
+	}
+	if err != nil {
+		exit(2)
+	}
+}
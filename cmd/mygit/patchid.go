@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// patchID is the id of one commit's patch read by patchIDReader.
+type patchID struct {
+	id     string
+	commit string
+}
+
+// patchIDReader computes patch ids the way `git patch-id` does: a patch id
+// is the sha-1 of the diff with all whitespace, line numbers and index
+// lines left out, so the same change gets the same id wherever it applies.
+//
+// With stable, each file is hashed on its own and the hashes are added up,
+// which makes the id independent of the order of the files.
+type patchIDReader struct {
+	in     *bufio.Reader
+	stable bool
+	next   string
+}
+
+// removeSpace drops every whitespace character of a line.
+func removeSpace(line string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\v' || r == '\f' {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+// flushHunk adds the hash of one file to the result, a 20-byte sum with
+// carry, and starts a new hash.
+func flushHunk(result []byte, h hash.Hash) {
+	sum := h.Sum(nil)
+	h.Reset()
+
+	carry := 0
+	for i := range result {
+		carry += int(result[i]) + int(sum[i])
+		result[i] = byte(carry)
+		carry >>= 8
+	}
+}
+
+// scanHunkHeader returns the number of old and new lines of a hunk:
+//
+//	@@ -<start>[,<count>] +<start>[,<count>] @@
+func scanHunkHeader(line string) (int, int) {
+	count := func(r string) int {
+		_, n, found := strings.Cut(r, ",")
+		if !found {
+			return 1
+		}
+		c, _ := strconv.Atoi(n)
+		return c
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, 0
+	}
+	return count(fields[1]), count(fields[2])
+}
+
+// objectNameAfter returns the sha that follows a `commit ` or `From ` line.
+func objectNameAfter(line string) (string, bool) {
+	for _, prefix := range []string{"commit ", "From ", "diff-tree "} {
+		if rest, found := strings.CutPrefix(line, prefix); found && len(rest) >= 40 && isObjectName(rest[:40]) {
+			return rest[:40], true
+		}
+	}
+	return "", false
+}
+
+// readOne reads the patch of the next commit. It returns false once there is
+// nothing left.
+func (r *patchIDReader) readOne() (patchID, bool) {
+	result := make([]byte, sha1.Size)
+	h := sha1.New()
+	patchLength := 0
+	before, after := -1, -1
+	binary := false
+	var preImage, postImage string
+
+	commit := r.next
+	r.next = ""
+
+	for {
+		line, err := r.in.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+
+		if sha, found := objectNameAfter(line); found {
+			if commit == "" && patchLength == 0 {
+				commit = sha
+				continue
+			}
+			r.next = sha
+			break
+		}
+		if strings.HasPrefix(line, "\\ ") && len(line) > 12 {
+			continue
+		}
+
+		// skip the commit message
+		if patchLength == 0 && !strings.HasPrefix(line, "diff ") {
+			continue
+		}
+
+		// in the header of a file
+		if before == -1 {
+			if strings.HasPrefix(line, "GIT binary patch") || strings.HasPrefix(line, "Binary files") {
+				binary = true
+				before = 0
+				h.Write([]byte(preImage))
+				h.Write([]byte(postImage))
+				if r.stable {
+					flushHunk(result, h)
+				}
+				continue
+			} else if index, found := strings.CutPrefix(line, "index "); found {
+				pre, post, _ := strings.Cut(strings.TrimRight(index, "\n"), "..")
+				post, _, _ = strings.Cut(post, " ")
+				preImage, postImage = pre, post
+				continue
+			} else if strings.HasPrefix(line, "--- ") {
+				before, after = 1, 1
+			} else if c := line[0]; !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+				break
+			}
+		}
+
+		if binary {
+			if strings.HasPrefix(line, "diff ") {
+				binary = false
+				before = -1
+			}
+			continue
+		}
+
+		// between two hunks
+		if before == 0 && after == 0 {
+			if strings.HasPrefix(line, "@@ -") {
+				before, after = scanHunkHeader(line)
+				continue
+			}
+			if !strings.HasPrefix(line, "diff ") {
+				break
+			}
+			if r.stable {
+				flushHunk(result, h)
+			}
+			before, after = -1, -1
+		}
+
+		if line[0] == '-' || line[0] == ' ' {
+			before--
+		}
+		if line[0] == '+' || line[0] == ' ' {
+			after--
+		}
+
+		stripped := removeSpace(line)
+		patchLength += len(stripped)
+		h.Write([]byte(stripped))
+	}
+
+	flushHunk(result, h)
+
+	if patchLength == 0 {
+		if r.next == "" {
+			return patchID{}, false
+		}
+		return r.readOne()
+	}
+	return patchID{id: hex.EncodeToString(result), commit: commit}, true
+}
+
+// commitPatch returns the patch of a commit against its first parent, as
+// `git log -p` shows it.
+func commitPatch(c *commit) ([]byte, error) {
+	changes, err := commitChanges(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var patch bytes.Buffer
+	for _, change := range changes {
+		if err := writePatch(&patch, change, &diffOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	return patch.Bytes(), nil
+}
+
+// commitPatchID computes the patch id of a commit, it's empty for a commit
+// that doesn't change anything.
+func commitPatchID(sha string, c *commit) (string, error) {
+	patch, err := commitPatch(c)
+	if err != nil {
+		return "", err
+	}
+
+	r := &patchIDReader{in: bufio.NewReader(bytes.NewReader(patch)), next: sha}
+	id, _ := r.readOne()
+	return id.id, nil
+}
+
+// patchIDCmd implements `git patch-id [--stable | --unstable] < <patch>`
+//
+// It reads patches from stdin, eg: the output of `git log -p`, and prints
+// a line for each commit that has one:
+//
+//	<patch id> <commit>
+func patchIDCmd(args []string) {
+	flag := flag.NewFlagSet("git patch-id", flag.ExitOnError)
+	var (
+		stable   = flag.Bool("stable", false, "use the sum of the hashes of each file")
+		unstable = flag.Bool("unstable", false, "hash the whole patch at once (default)")
+	)
+	flag.Parse(args)
+
+	useStable := *stable
+	if !*stable && !*unstable {
+		useStable = configBool("patchid.stable", false)
+	}
+
+	r := &patchIDReader{in: bufio.NewReader(os.Stdin), stable: useStable}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	for {
+		id, ok := r.readOne()
+		if !ok {
+			break
+		}
+		commit := id.commit
+		if commit == "" {
+			commit = nullSha
+		}
+		fmt.Fprintf(out, "%s %s\n", id.id, commit)
+	}
+
+	if _, err := r.in.Peek(1); err != nil && err != io.EOF {
+		error := fmt.Sprintf("Failed to read patch: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
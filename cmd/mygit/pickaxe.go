@@ -0,0 +1,86 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pickaxe finds the changes adding or removing some text, for `log -S` and
+// `log -G`:
+//
+//	-S <string>    the number of times the string appears in the file changed
+//	-G <regex>     an added or removed line matches the regex
+//
+// With --pickaxe-regex, the -S string is a regex too. Binary files are left
+// out of -G, like git does without textconv.
+type pickaxe struct {
+	text string         // -S
+	re   *regexp.Regexp // -G, or -S with --pickaxe-regex
+	grep bool           // -G
+	all  bool           // --pickaxe-all, keep all the changes of a commit matching
+}
+
+// count is how many times the -S string appears in content.
+func (p *pickaxe) count(content []byte) int {
+	if p.re != nil {
+		return len(p.re.FindAllIndex(content, -1))
+	}
+	return strings.Count(string(content), p.text)
+}
+
+// matches checks a single change.
+func (p *pickaxe) matches(change treeChange) (bool, error) {
+	if change.old.mode == modeSubmodule || change.new.mode == modeSubmodule {
+		return false, nil
+	}
+	oldContent, err := readBlob(change.old.sha)
+	if err != nil {
+		return false, err
+	}
+	newContent, err := readBlob(change.new.sha)
+	if err != nil {
+		return false, err
+	}
+
+	if !p.grep {
+		return p.count(oldContent) != p.count(newContent), nil
+	}
+
+	if isBinary(oldContent) || isBinary(newContent) {
+		return false, nil
+	}
+	a, b := splitLines(oldContent), splitLines(newContent)
+	removed, added := diffLines(a, b)
+	for i, line := range a {
+		if removed[i] && p.re.MatchString(line) {
+			return true, nil
+		}
+	}
+	for j, line := range b {
+		if added[j] && p.re.MatchString(line) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// filter returns the changes the pickaxe finds something in, or all of them
+// with --pickaxe-all when it finds something in any. A commit without any
+// is left out of log.
+func (p *pickaxe) filter(changes []treeChange) ([]treeChange, error) {
+	var found []treeChange
+	for _, change := range changes {
+		matched, err := p.matches(change)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			found = append(found, change)
+		}
+	}
+
+	if p.all && len(found) > 0 {
+		return changes, nil
+	}
+	return found, nil
+}
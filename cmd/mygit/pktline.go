@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits of a pkt-line, including its 4-byte length.
+const (
+	pktLineMax    = 65520
+	pktLineHeader = 4
+)
+
+// writePktLine writes a line in the pkt-line format of the git protocols:
+// the length of the whole line, including the 4 hexadecimal digits of the
+// length itself, followed by the data.
+//
+//	0009done\n
+func writePktLine(w io.Writer, line string) error {
+	if len(line)+pktLineHeader > pktLineMax {
+		return fmt.Errorf("pkt-line too long: %d bytes", len(line))
+	}
+	tracePacket('>', []byte(line))
+	_, err := fmt.Fprintf(w, "%04x%s", len(line)+pktLineHeader, line)
+	return err
+}
+
+// writeFlushPkt writes a flush-pkt, `0000`, which ends a section.
+func writeFlushPkt(w io.Writer) error {
+	tracePacket('>', []byte("0000"))
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// readPktLine reads a pkt-line and returns its data, without the trailing
+// newline. A flush-pkt returns flush set.
+func readPktLine(r *bufio.Reader) (line string, flush bool, err error) {
+	data, flush, err := readPktData(r)
+	if n := len(data); n > 0 && data[n-1] == '\n' {
+		data = data[:n-1]
+	}
+	return string(data), flush, err
+}
+
+// readPktData reads a pkt-line and returns its data as is, for the binary
+// ones, like those of a sideband. A flush-pkt returns flush set.
+func readPktData(r *bufio.Reader) (data []byte, flush bool, err error) {
+	header := make([]byte, pktLineHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, false, err
+	}
+
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("protocol error: bad line length character: %s", header)
+	}
+	if length == 0 {
+		tracePacket('<', []byte("0000"))
+		return nil, true, nil
+	}
+	if length < pktLineHeader || length > pktLineMax {
+		return nil, false, fmt.Errorf("protocol error: bad line length %d", length)
+	}
+
+	data = make([]byte, length-pktLineHeader)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, err
+	}
+	tracePacket('<', data)
+	return data, false, nil
+}
+
+// sideband multiplexes the pack, progress and errors over pkt-lines, each
+// prefixed with its band: 1 for data, 2 for progress and 3 for a fatal
+// error. With side-band, lines are at most 1000 bytes, with side-band-64k
+// they use the full pkt-line size.
+type sideband struct {
+	w    io.Writer
+	band byte
+	max  int
+}
+
+// Write sends p on the band, split over as many pkt-lines as needed.
+func (s *sideband) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), s.max-pktLineHeader-1)
+		_, err := fmt.Fprintf(s.w, "%04x%c", n+pktLineHeader+1, s.band)
+		if err == nil {
+			_, err = s.w.Write(p[:n])
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// readSideband reads sideband pkt-lines up to a flush, or the end of the
+// stream: the data goes to w, the progress to progress. An error sent on
+// band 3 is returned.
+func readSideband(r *bufio.Reader, w io.Writer, progress io.Writer) error {
+	for {
+		data, flush, err := readPktData(r)
+		if err == io.EOF || flush {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case 1:
+			if _, err := w.Write(data[1:]); err != nil {
+				return err
+			}
+		case 2:
+			if progress != nil {
+				progress.Write(data[1:])
+			}
+		case 3:
+			return fmt.Errorf("remote error: %s", strings.TrimSpace(string(data[1:])))
+		default:
+			return fmt.Errorf("protocol error: bad band #%d", data[0])
+		}
+	}
+}
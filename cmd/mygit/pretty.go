@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// prettyFormat is how `git log --pretty=<format>` shows a commit: one of the
+// built-in formats (oneline, short, medium, full, fuller) or a user format
+// with placeholders.
+//
+// With terminator, each commit ends with a newline; otherwise a newline
+// separates two commits, which for the multi-line built-in formats makes the
+// blank line between them. With abbrev, oneline shows abbreviated hashes.
+// With mailmap, the Author: and Commit: lines show the canonical
+// identities, see mailmap; %an and the like stay as they were committed.
+type prettyFormat struct {
+	name       string
+	user       string
+	terminator bool
+	abbrev     bool
+	mailmap    bool
+}
+
+// parsePrettyFormat parses the value of --pretty:
+//
+//	oneline | short | medium | full | fuller
+//	format:<string>     placeholders, commits separated by a newline
+//	tformat:<string>    placeholders, each commit followed by a newline
+//	<string with a %>   same as tformat:<string>
+func parsePrettyFormat(value string) (*prettyFormat, error) {
+	switch value {
+	case "", "medium":
+		return &prettyFormat{name: "medium"}, nil
+	case "short", "full", "fuller":
+		return &prettyFormat{name: value}, nil
+	case "oneline":
+		return &prettyFormat{name: value, terminator: true}, nil
+	}
+
+	if user, found := strings.CutPrefix(value, "format:"); found {
+		return &prettyFormat{name: "format", user: user}, nil
+	}
+	if user, found := strings.CutPrefix(value, "tformat:"); found {
+		return &prettyFormat{name: "format", user: user, terminator: true}, nil
+	}
+	if strings.Contains(value, "%") {
+		return &prettyFormat{name: "format", user: value, terminator: true}, nil
+	}
+	return nil, fmt.Errorf("invalid --pretty format: %s", value)
+}
+
+// empty reports whether the format shows nothing at all, eg: --format=.
+func (f *prettyFormat) empty() bool {
+	return f.name == "format" && f.user == ""
+}
+
+// messageParts splits a commit message into its subject, the first
+// paragraph joined on one line, and its body, the rest.
+func messageParts(message string) (string, string) {
+	message = strings.TrimLeft(message, "\n")
+	title, body, _ := strings.Cut(message, "\n\n")
+	return strings.Join(strings.Split(strings.TrimSpace(title), "\n"), " "), strings.TrimLeft(body, "\n")
+}
+
+// expandPlaceholder expands the placeholder at the start of s, the text
+// right after a %, and returns its value and length. It returns false for
+// an unknown placeholder, which git leaves as it is.
+//
+//	%H %h       commit hash, abbreviated
+//	%T %t       tree hash, abbreviated
+//	%P %p       parent hashes, abbreviated
+//	%an %ae     author name and email, %cn %ce for the committer
+//	%aN %aE     same, after the mailmap, %cN %cE for the committer
+//	%ad %at %ai author date, as a timestamp and in ISO format; %c. for the committer
+//	%s %b %B    subject, body and raw message
+//	%n %%       newline and a %
+//	%x<hh>      the byte with hex code hh
+func expandPlaceholder(s string, sha string, c *commit) (string, int, bool) {
+	if s == "" {
+		return "", 0, false
+	}
+
+	switch s[0] {
+	case 'H':
+		return sha, 1, true
+	case 'h':
+		return sha[:7], 1, true
+	case 'T':
+		return c.tree, 1, true
+	case 't':
+		return c.tree[:7], 1, true
+	case 'P', 'p':
+		var parents []string
+		for _, parent := range c.parents {
+			if s[0] == 'p' {
+				parent = parent[:7]
+			}
+			parents = append(parents, parent)
+		}
+		return strings.Join(parents, " "), 1, true
+	case 's':
+		subject, _ := messageParts(c.message)
+		return subject, 1, true
+	case 'b':
+		_, body := messageParts(c.message)
+		return body, 1, true
+	case 'B':
+		return c.message, 1, true
+	case 'n':
+		return "\n", 1, true
+	case '%':
+		return "%", 1, true
+	case 'x':
+		if len(s) < 3 {
+			return "", 0, false
+		}
+		b, err := strconv.ParseUint(s[1:3], 16, 8)
+		if err != nil {
+			return "", 0, false
+		}
+		return string([]byte{byte(b)}), 3, true
+	case 'a', 'c':
+		if len(s) < 2 {
+			return "", 0, false
+		}
+		ident := c.author
+		if s[0] == 'c' {
+			ident = c.committer
+		}
+		name, email, when := parseIdent(ident)
+		switch s[1] {
+		case 'n':
+			return name, 2, true
+		case 'e':
+			return email, 2, true
+		case 'N':
+			name, _ = loadMailmap().lookup(name, email)
+			return name, 2, true
+		case 'E':
+			_, email = loadMailmap().lookup(name, email)
+			return email, 2, true
+		case 'd':
+			return when.Format(gitDateFormat), 2, true
+		case 't':
+			return strconv.FormatInt(when.Unix(), 10), 2, true
+		case 'i':
+			return when.Format("2006-01-02 15:04:05 -0700"), 2, true
+		}
+	}
+	return "", 0, false
+}
+
+// expandUserFormat fills in the placeholders of a user format.
+func expandUserFormat(format string, sha string, c *commit) string {
+	var out strings.Builder
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			out.WriteString(format)
+			return out.String()
+		}
+		out.WriteString(format[:i])
+		format = format[i+1:]
+
+		value, length, ok := expandPlaceholder(format, sha, c)
+		if !ok {
+			out.WriteByte('%')
+			continue
+		}
+		out.WriteString(value)
+		format = format[length:]
+	}
+}
+
+// writeCommit writes a commit in the given format, without the separator or
+// terminator around it:
+//
+//	oneline:  <sha> <subject>
+//	short:    commit, Merge and Author lines, and the subject
+//	medium:   see writeCommitHeader
+//	full:     like short, with a Commit line and the whole message
+//	fuller:   like full, with AuthorDate and CommitDate lines
+func writeCommit(w io.Writer, sha string, c *commit, format *prettyFormat) {
+	if format.mailmap && format.name != "format" {
+		mapped := *c
+		mapped.author = loadMailmap().rewriteIdent(c.author)
+		mapped.committer = loadMailmap().rewriteIdent(c.committer)
+		c = &mapped
+	}
+
+	switch format.name {
+	case "format":
+		io.WriteString(w, expandUserFormat(format.user, sha, c))
+		return
+	case "oneline":
+		subject, _ := messageParts(c.message)
+		if format.abbrev {
+			sha = sha[:7]
+		}
+		fmt.Fprintf(w, "%s %s", colored(colorYellow, sha), subject)
+		return
+	case "medium":
+		writeCommitHeader(w, sha, c)
+		return
+	}
+
+	fmt.Fprintln(w, colored(colorYellow, "commit "+sha))
+	if len(c.parents) > 1 {
+		var parents []string
+		for _, parent := range c.parents {
+			parents = append(parents, parent[:7])
+		}
+		fmt.Fprintf(w, "Merge: %s\n", strings.Join(parents, " "))
+	}
+
+	authorName, authorEmail, authorDate := parseIdent(c.author)
+	committerName, committerEmail, committerDate := parseIdent(c.committer)
+	switch format.name {
+	case "short":
+		fmt.Fprintf(w, "Author: %s <%s>\n", authorName, authorEmail)
+	case "full":
+		fmt.Fprintf(w, "Author: %s <%s>\n", authorName, authorEmail)
+		fmt.Fprintf(w, "Commit: %s <%s>\n", committerName, committerEmail)
+	case "fuller":
+		fmt.Fprintf(w, "Author:     %s <%s>\n", authorName, authorEmail)
+		fmt.Fprintf(w, "AuthorDate: %s\n", authorDate.Format(gitDateFormat))
+		fmt.Fprintf(w, "Commit:     %s <%s>\n", committerName, committerEmail)
+		fmt.Fprintf(w, "CommitDate: %s\n", committerDate.Format(gitDateFormat))
+	}
+	fmt.Fprintln(w)
+
+	message := strings.TrimRight(c.message, "\n")
+	if format.name == "short" {
+		message, _, _ = strings.Cut(strings.TrimLeft(message, "\n"), "\n\n")
+	}
+	for _, line := range strings.Split(message, "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progressInterval is how often a progress line is updated, at most.
+const progressInterval = 100 * time.Millisecond
+
+// progress reports how far a long operation got, the way git does:
+//
+//	Counting objects: 1234
+//	Receiving objects:  45% (450/1000)
+//	Receiving objects: 100% (1000/1000), done.
+//
+// The line is updated in place with a carriage return, unless it goes to a
+// file or a pipe, which only get the final line. A nil progress reports
+// nothing, so that operations can take one whether progress is on or not.
+type progress struct {
+	w     io.Writer
+	title string
+	total int // 0 when unknown, only the count is shown then
+	count int
+	live  bool
+	shown time.Time
+}
+
+// startProgress starts reporting progress to w, nowhere when w is nil.
+func startProgress(w io.Writer, title string, total int) *progress {
+	if w == nil {
+		return nil
+	}
+	live := true
+	if file, ok := w.(*os.File); ok {
+		live = isTerminal(file)
+	}
+	return &progress{w: w, title: title, total: total, live: live}
+}
+
+// update sets how far the operation got.
+func (p *progress) update(count int) {
+	if p == nil {
+		return
+	}
+	p.count = count
+	if !p.live || time.Since(p.shown) < progressInterval {
+		return
+	}
+	p.shown = time.Now()
+	p.write("\r")
+}
+
+// done writes the final line.
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.write(", done.\n")
+}
+
+func (p *progress) write(end string) {
+	if p.total == 0 {
+		fmt.Fprintf(p.w, "%s: %d%s", p.title, p.count, end)
+		return
+	}
+	fmt.Fprintf(p.w, "%s: %3d%% (%d/%d)%s", p.title, p.count*100/p.total, p.count, p.total, end)
+}
+
+// progressFlag adds --progress and --no-progress to a command's flags. The
+// returned function gives where to report progress: stderr when it's a
+// terminal or with --progress, nowhere (nil) otherwise. Progress never goes
+// to stdout, which may be piped to another command.
+func progressFlag(flag *flag.FlagSet) func() io.Writer {
+	force := flag.Bool("progress", false, "report progress on stderr, even when it isn't a terminal")
+	none := flag.Bool("no-progress", false, "don't report progress")
+
+	return func() io.Writer {
+		if *none || !*force && !isTerminal(os.Stderr) {
+			return nil
+		}
+		return os.Stderr
+	}
+}
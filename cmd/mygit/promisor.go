@@ -0,0 +1,117 @@
+package main
+
+import "fmt"
+
+// PromisorStore is the object store of a partial clone, see clone: the
+// objects the clone left out, eg: every blob with --filter=blob:none, are
+// promised by the remote of extensions.partialClone. An object missing from
+// the local stores is fetched from it on the first read, so that checkout,
+// cat-file and the others don't have to know about it:
+//
+//	want <sha>
+//	0000
+//	done
+//
+// The remote has to allow wanting objects no ref points to, see
+// uploadPackCapabilities. Objects that couldn't be fetched aren't asked for
+// again.
+type PromisorStore struct {
+	local    ObjectStore
+	missing  map[string]bool
+	fetching bool
+}
+
+// NewPromisorStore returns the store over the local stores, which the
+// fetched objects end up in.
+func NewPromisorStore(local ObjectStore) *PromisorStore {
+	return &PromisorStore{local: local, missing: map[string]bool{}}
+}
+
+// promisorRemote returns the remote promising the missing objects, if the
+// repository is a partial clone.
+func promisorRemote() (string, bool) {
+	return configGet("extensions.partialClone")
+}
+
+// fetch gets objects from the promisor remote.
+func (s *PromisorStore) fetch(shas []string) error {
+	remote, ok := promisorRemote()
+	if !ok {
+		return fmt.Errorf("not a partial clone")
+	}
+	url, _ := resolveRemote(remote)
+	t, err := openTransport(remote, url)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	pack, ok := t.(*packTransport)
+	if !ok {
+		return fmt.Errorf("remote '%s' can't fetch missing objects", remote)
+	}
+
+	trace("fetch %d missing objects from %s", len(shas), remote)
+	s.fetching = true
+	defer func() { s.fetching = false }()
+	return pack.fetchObjects(shas, false)
+}
+
+// prefetch fetches the objects missing among shas at once, rather than
+// one at a time as they are read, eg: the files of a checkout.
+func (s *PromisorStore) prefetch(shas []string) error {
+	if _, ok := promisorRemote(); !ok {
+		return nil
+	}
+	var missing []string
+	for _, sha := range shas {
+		if _, empty := emptyObject(sha); !empty && !s.local.Has(sha) && !s.missing[sha] {
+			missing = append(missing, sha)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, sha := range missing {
+		s.missing[sha] = true
+	}
+	return s.fetch(missing)
+}
+
+func (s *PromisorStore) Read(sha string) ([]byte, string, error) {
+	if s.local.Has(sha) {
+		return s.local.Read(sha)
+	}
+	if _, empty := emptyObject(sha); s.fetching || empty || s.missing[sha] || !isObjectName(sha) {
+		return nil, "", fmt.Errorf("object '%s' not found", sha)
+	}
+	if _, ok := promisorRemote(); !ok {
+		return nil, "", fmt.Errorf("object '%s' not found", sha)
+	}
+	s.missing[sha] = true
+	if err := s.fetch([]string{sha}); err != nil {
+		return nil, "", fmt.Errorf("could not fetch %s from promisor remote: %s", sha, err)
+	}
+	return s.local.Read(sha)
+}
+
+func (s *PromisorStore) Write(objectType string, content []byte) (string, error) {
+	return s.local.Write(objectType, content)
+}
+
+// Has only reports the objects here, not the promised ones.
+func (s *PromisorStore) Has(sha string) bool {
+	return s.local.Has(sha)
+}
+
+func (s *PromisorStore) Iterate(visit func(sha string)) error {
+	return s.local.Iterate(visit)
+}
+
+// prefetchObjects fetches the objects missing among shas from the promisor
+// remote, when the repository is a partial clone, see PromisorStore.
+func prefetchObjects(shas []string) error {
+	if store, ok := objects.(*PromisorStore); ok {
+		return store.prefetch(shas)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// prunePackedObjects deletes the loose objects that are in a pack too, as
+// found through the pack indexes, and writes a line for each to w:
+//
+//	rm -f .git/objects/<xx>/<rest of the sha>
+//
+// With dryRun, it only writes the lines. Like git, the fan-out folders are
+// deleted once empty.
+func prunePackedObjects(dryRun bool, w io.Writer) error {
+	packs := NewPackStore(gitPath(packDir))
+	if err := packs.load(); err != nil {
+		return err
+	}
+
+	loose := NewLooseStore(gitPath("objects"))
+	var packed []string
+	err := loose.Iterate(func(sha string) {
+		if packs.Has(sha) {
+			packed = append(packed, sha)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sha := range packed {
+		path := loose.path(sha)
+		if w != nil {
+			fmt.Fprintf(w, "rm -f %s\n", path)
+		}
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(filepath.Dir(path))
+	}
+	return nil
+}
+
+// prunePacked implements `git prune-packed [-n] [-q]`
+//
+// It deletes the loose objects that are in a pack too, eg: after a repack
+// without -d, see prunePackedObjects. With -n, it only shows what it would
+// delete:
+//
+//	$ git prune-packed -n
+//	rm -f .git/objects/0a/5159e4fd9efdc3530c880fa15b672f08d47421
+//
+// -q keeps it quiet, which it is anyway unless -n.
+func prunePacked(args []string) {
+	flag := flag.NewFlagSet("git prune-packed", flag.ExitOnError)
+	var (
+		dryRun = flag.Bool("n", false, "only show the loose objects that would be deleted")
+		quiet  = flag.Bool("q", false, "don't show anything")
+	)
+	flag.BoolVar(dryRun, "dry-run", false, "same as -n")
+	flag.BoolVar(quiet, "quiet", false, "same as -q")
+	flag.Parse(expandShortFlags(args, "nq"))
+
+	var w io.Writer
+	if *dryRun && !*quiet {
+		w = os.Stdout
+	}
+	if err := prunePackedObjects(*dryRun, w); err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+}
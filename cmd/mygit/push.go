@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// pushOptions are the options of push.
+type pushOptions struct {
+	force    bool // update the refs even when it's not a fast-forward
+	noVerify bool // don't run the pre-push hook
+}
+
+// pushUpdates turns the refspecs of a push into the updates of the refs of
+// the remote, whose refs are given. The source of a refspec is a ref or a
+// revision here, nothing to delete the destination, which defaults to the
+// source ref. A refspec with a * pushes every ref it matches.
+func pushUpdates(specs []string, force bool, remoteRefs []remoteRef) ([]pushUpdate, error) {
+	theirs := map[string]string{}
+	for _, r := range remoteRefs {
+		theirs[r.name] = r.sha
+	}
+	ours, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []pushUpdate
+	add := func(src string, dst string, sha string, spec refspec) {
+		updates = append(updates, pushUpdate{src: src, dst: dst, sha: sha, old: theirs[dst], force: spec.force || force})
+	}
+	for _, s := range specs {
+		spec, err := parseRefspec(s)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case spec.isGlob():
+			for _, r := range ours {
+				if dst, ok := spec.match(r.name); ok {
+					add(r.name, dst, r.sha, spec)
+				}
+			}
+
+		case spec.src == "":
+			dst := spec.dst
+			if !strings.HasPrefix(dst, "refs/") {
+				for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+					if _, ok := theirs[prefix+dst]; ok {
+						dst = prefix + dst
+						break
+					}
+				}
+			}
+			add("", dst, "", spec)
+
+		default:
+			src, err := expandRefName(spec.src)
+			var sha string
+			if err == nil {
+				sha, err = readRef(src)
+			} else if sha, err = resolveRevision(spec.src); err == nil {
+				src = sha
+			}
+			if err != nil {
+				return nil, fmt.Errorf("src refspec %s does not match any", spec.src)
+			}
+
+			dst := spec.dst
+			switch {
+			case dst == "" && strings.HasPrefix(src, "refs/"):
+				dst = src
+			case dst == "":
+				return nil, fmt.Errorf("the destination of '%s' has to be a full ref name", s)
+			case !strings.HasPrefix(dst, "refs/"):
+				dst = refspec{dst: dst}.expandDst(src)
+			}
+			add(src, dst, sha, spec)
+		}
+	}
+	return updates, nil
+}
+
+// pushStatusLine is how the outcome of the update of a ref is reported.
+type pushStatusLine struct {
+	flag, summary, reason string
+	update                pushUpdate
+}
+
+// checkPushUpdate rejects an update that isn't a fast-forward, unless
+// forced, the way git does before sending anything: the old commit has to
+// be one we have, and an ancestor of the new one. A tag is never moved
+// unless forced. It returns the line reporting the update as if it
+// succeeded, and whether it's rejected.
+func checkPushUpdate(update pushUpdate) (pushStatusLine, bool) {
+	line := pushStatusLine{update: update}
+	switch {
+	case update.sha == "":
+		line.flag, line.summary = "-", "[deleted]"
+	case update.old == "":
+		line.flag, line.summary = "*", "[new reference]"
+		if kind := refKind(update.dst); kind != "" {
+			line.summary = "[new " + kind + "]"
+		}
+	case update.force:
+		line.flag, line.summary = "+", update.old[:7]+"..."+update.sha[:7]
+		if fastForward, err := isAncestor(update.old, update.sha); err != nil || !fastForward {
+			line.reason = "forced update"
+		} else {
+			line.flag, line.summary = " ", update.old[:7]+".."+update.sha[:7]
+		}
+	case strings.HasPrefix(update.dst, "refs/tags/"):
+		line.flag, line.summary, line.reason = "!", "[rejected]", "already exists"
+		return line, true
+	case !objects.Has(update.old):
+		line.flag, line.summary, line.reason = "!", "[rejected]", "fetch first"
+		return line, true
+	default:
+		if fastForward, err := isAncestor(update.old, update.sha); err != nil || !fastForward {
+			line.flag, line.summary, line.reason = "!", "[rejected]", "non-fast-forward"
+			return line, true
+		}
+		line.flag, line.summary = " ", update.old[:7]+".."+update.sha[:7]
+	}
+	return line, false
+}
+
+// pushRemote updates the refs of a remote the refspecs say, or its branch
+// of the same name as the current one, and reports it the way git does:
+//
+//	To ../upstream
+//	   5d1e2a3..9f8e7d6  main -> main
+//	 * [new branch]      topic -> topic
+//	 ! [rejected]        next -> next (non-fast-forward)
+//
+// Unless noVerify, the pre-push hook is run first with the remote and its
+// URL, and a line per ref to update on stdin, see prePushInput, and can
+// refuse the push. The refs of a remote configured that track the refs
+// updated, through remote.<name>.fetch, are updated too. It returns whether
+// all the refs could be updated.
+func pushRemote(remote string, specs []string, opts pushOptions, out io.Writer) (bool, error) {
+	url, named := resolveRemote(remote)
+	if len(specs) == 0 {
+		head, symbolic, err := readSymbolicRef("HEAD")
+		if err != nil || !symbolic {
+			return false, fmt.Errorf("You are not currently on a branch.")
+		}
+		specs = []string{head + ":" + head}
+	}
+
+	t, err := openTransport(remote, url)
+	if err != nil {
+		return false, err
+	}
+	defer t.close()
+	remoteRefs, err := t.list(true)
+	if err != nil {
+		return false, err
+	}
+	updates, err := pushUpdates(specs, opts.force, remoteRefs)
+	if err != nil {
+		return false, err
+	}
+
+	var lines []pushStatusLine
+	var send []pushUpdate
+	ok := true
+	for _, update := range updates {
+		if update.sha == "" && update.old == "" {
+			fmt.Fprintf(out, "error: unable to delete '%s': remote ref does not exist\n", shortRefName(update.dst))
+			ok = false
+			continue
+		}
+		if update.sha == update.old {
+			continue
+		}
+		line, rejected := checkPushUpdate(update)
+		if rejected {
+			ok = false
+		} else {
+			send = append(send, update)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		if ok {
+			fmt.Fprintln(out, "Everything up-to-date")
+		}
+		return ok, nil
+	}
+
+	if !opts.noVerify && len(send) > 0 {
+		// like git, nothing more is said than that the push failed
+		if err := runHookWith("pre-push", prePushInput(send), out, remote, url); err != nil {
+			return false, nil
+		}
+	}
+
+	statuses, err := t.push(send)
+	if err != nil {
+		return false, err
+	}
+	failed := map[string]string{}
+	for _, status := range statuses {
+		if status.err != "" {
+			failed[status.ref] = status.err
+		}
+	}
+
+	fmt.Fprintf(out, "To %s\n", url)
+	for _, line := range lines {
+		if why, refused := failed[line.update.dst]; refused {
+			line.flag, line.summary, line.reason = "!", "[remote rejected]", why
+			ok = false
+		} else if line.flag != "!" && named {
+			if err := updateTrackingRef(remote, line.update); err != nil {
+				return false, err
+			}
+		}
+
+		text := fmt.Sprintf(" %s %-17s ", line.flag, line.summary)
+		if line.update.sha == "" {
+			text += shortRefName(line.update.dst)
+		} else {
+			text += shortRefName(line.update.src) + " -> " + shortRefName(line.update.dst)
+		}
+		if line.reason != "" {
+			text += " (" + line.reason + ")"
+		}
+		fmt.Fprintln(out, text)
+	}
+	return ok, nil
+}
+
+// prePushInput is what the pre-push hook reads, a line per ref to update,
+// with zeroSha for a ref to create or to delete:
+//
+//	<local ref> <local sha> <remote ref> <remote sha>
+//	(delete) <zeroSha> <remote ref> <remote sha>
+func prePushInput(updates []pushUpdate) []byte {
+	var input strings.Builder
+	for _, update := range updates {
+		src, sha, old := update.src, update.sha, update.old
+		if sha == "" {
+			src, sha = "(delete)", zeroSha
+		}
+		if old == "" {
+			old = zeroSha
+		}
+		fmt.Fprintf(&input, "%s %s %s %s\n", src, sha, update.dst, old)
+	}
+	return []byte(input.String())
+}
+
+// updateTrackingRef updates the ref tracking a ref of a remote that was
+// pushed, if any, the way a fetch would have.
+func updateTrackingRef(remote string, update pushUpdate) error {
+	for _, s := range configGetAll("remote." + remote + ".fetch") {
+		spec, err := parseRefspec(s)
+		if err != nil {
+			continue
+		}
+		tracking, ok := spec.match(update.dst)
+		if !ok || tracking == "" {
+			continue
+		}
+		if update.sha == "" {
+			return deleteRef(tracking)
+		}
+		old, _ := readRef(tracking)
+		if err := updateRef(tracking, update.sha); err != nil {
+			return err
+		}
+		return appendReflog(tracking, old, update.sha, "update by push")
+	}
+	return nil
+}
+
+// push implements `git push [-f] [--no-verify] [<repository> [<refspec>...]]`
+//
+// It updates the refs of another repository, and sends it the objects they
+// need, see pushRemote:
+//
+//	$ git push origin main
+//	To ../upstream
+//	   5d1e2a3..9f8e7d6  main -> main
+//
+// The repository is the name of a remote, a path or a URL, the remote of
+// the current branch or origin when not given. Each refspec is
+// `[+]<src>[:<dst>]`, pushing the current branch when there's none. Unless
+// forced, with -f or a +, an update must be a fast-forward. The pre-push
+// hook can refuse the push, unless --no-verify.
+//
+// Besides local repositories and http(s), a URL can name a remote helper,
+// git-remote-<transport>, that does the transfer, see remoteHelperFor.
+func push(args []string) {
+	flag := flag.NewFlagSet("git push", flag.ExitOnError)
+	var opts pushOptions
+	flag.BoolVar(&opts.force, "force", false, "update the refs even when it's not a fast-forward")
+	flag.BoolVar(&opts.force, "f", false, "same as --force")
+	flag.BoolVar(&opts.noVerify, "no-verify", false, "don't run the pre-push hook")
+	flag.Parse(args)
+	args = flag.Args()
+
+	remote := defaultRemote()
+	if len(args) > 0 {
+		remote, args = args[0], args[1:]
+	}
+	if _, named := resolveRemote(remote); !named && len(flag.Args()) == 0 {
+		fmt.Fprintln(os.Stderr, "fatal: No configured push destination.")
+		os.Exit(128)
+	}
+
+	ok, err := pushRemote(remote, args, opts, os.Stderr)
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+	if !ok {
+		url, _ := resolveRemote(remote)
+		fmt.Fprintf(os.Stderr, "error: failed to push some refs to '%s'\n", url)
+		os.Exit(1)
+	}
+}
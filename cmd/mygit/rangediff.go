@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rangeCommit is a commit of one side of a range-diff.
+type rangeCommit struct {
+	sha      string
+	commit   *commit
+	patchID  string
+	text     string
+	matching int
+	shown    bool
+}
+
+// rangeCommits lists the non-merge commits of `<from>..<to>`, oldest first.
+func rangeCommits(spec string) ([]*rangeCommit, error) {
+	from, to, found := strings.Cut(spec, "..")
+	if !found {
+		return nil, fmt.Errorf("need a commit range, eg: main..topic, got '%s'", spec)
+	}
+
+	resolve := func(name string) (string, error) {
+		sha, err := resolveRevision(name)
+		if err != nil {
+			return "", err
+		}
+		sha, _, err = peelTag(sha)
+		return sha, err
+	}
+	fromSha, err := resolve(from)
+	if err != nil {
+		return nil, err
+	}
+	toSha, err := resolve(to)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := map[string]bool{}
+	err = walkCommits([]string{fromSha}, func(node *commitNode) bool {
+		excluded[node.sha] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []*rangeCommit
+	var walkErr error
+	err = walkCommits([]string{toSha}, func(node *commitNode) bool {
+		if excluded[node.sha] || len(node.parents) > 1 {
+			return true
+		}
+
+		rc, err := newRangeCommit(node.sha)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		commits = append([]*rangeCommit{rc}, commits...)
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	return commits, err
+}
+
+// newRangeCommit reads a commit with its patch id and its range-diff text.
+func newRangeCommit(sha string) (*rangeCommit, error) {
+	c, err := readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := commitPatch(c)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := (&patchIDReader{in: bufio.NewReader(bytes.NewReader(patch)), next: sha}).readOne()
+
+	return &rangeCommit{sha: sha, commit: c, patchID: id.id, text: rangeDiffText(c, patch), matching: -1}, nil
+}
+
+// rangeDiffText turns a commit into the text that is compared between the
+// two ranges, made of sections:
+//
+//	 ## Metadata ##
+//	Author: <name> <<email>>
+//
+//	 ## Commit message ##
+//	    <message>
+//
+//	 ## <path> [(new) | (deleted) | (mode change <old> => <new>)] ##
+//	@@ [<path>: <function>]
+//	<patch lines, with # for context, < for removed and > for added lines>
+//
+// Line numbers are left out, so a patch that moved still compares equal,
+// and the other markers keep the nested diff readable.
+func rangeDiffText(c *commit, patch []byte) string {
+	var text strings.Builder
+
+	name, email, _ := parseIdent(c.author)
+	fmt.Fprintf(&text, " ## Metadata ##\nAuthor: %s <%s>\n\n ## Commit message ##\n", name, email)
+	for _, line := range strings.Split(strings.TrimRight(c.message, "\n"), "\n") {
+		fmt.Fprintln(&text, strings.TrimRight("    "+line, " \t"))
+	}
+
+	path, section, oldMode := "", "", ""
+	flush := func() {
+		if section != "" {
+			fmt.Fprintf(&text, "\n ## %s ##\n", section)
+			section = ""
+		}
+	}
+
+	for _, line := range splitLines(patch) {
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			flush()
+			_, path, _ = strings.Cut(line, " b/")
+			section = path
+		case strings.HasPrefix(line, "new file mode "):
+			section += " (new)"
+		case strings.HasPrefix(line, "deleted file mode "):
+			section += " (deleted)"
+		case strings.HasPrefix(line, "old mode "):
+			oldMode = strings.TrimPrefix(line, "old mode ")
+		case strings.HasPrefix(line, "new mode "):
+			section += fmt.Sprintf(" (mode change %s => %s)", oldMode, strings.TrimPrefix(line, "new mode "))
+		case strings.HasPrefix(line, "index "), strings.HasPrefix(line, "--- "), strings.HasPrefix(line, "+++ "):
+		case strings.HasPrefix(line, "@@ "):
+			flush()
+			_, function, _ := strings.Cut(line[2:], "@@")
+			if function != "" {
+				function = " " + path + ":" + function
+			}
+			fmt.Fprintf(&text, "@@%s\n", function)
+		case line == "":
+		default:
+			flush()
+			switch line[0] {
+			case '+':
+				line = ">" + line[1:]
+			case '-':
+				line = "<" + line[1:]
+			case ' ':
+				line = "#" + line[1:]
+			}
+			fmt.Fprintln(&text, line)
+		}
+	}
+	flush()
+
+	return text.String()
+}
+
+// defaultCreationFactor is how much of a commit may change, in percent, for
+// it to still be paired with its other version rather than shown as removed
+// and added.
+const defaultCreationFactor = 60
+
+// patchSize is the number of lines of the patch in the text of a commit,
+// see rangeDiffText, without the metadata, the message and blank lines.
+func (rc *rangeCommit) patchSize() int {
+	_, rest, _ := strings.Cut(rc.text, " ## Commit message ##\n")
+	size, inPatch := 0, false
+	for _, line := range strings.Split(rest, "\n") {
+		// message lines are indented, the sections after them aren't
+		inPatch = inPatch || strings.HasPrefix(line, " ## ")
+		if inPatch && line != "" {
+			size++
+		}
+	}
+	return size
+}
+
+// matchRanges pairs up the commits of both ranges: first the ones with the
+// same patch id, then, greedily, the ones whose texts differ the least.
+//
+// Like git, pairing two commits costs the number of lines of the diff
+// between their texts, and leaving a commit alone costs the creation factor
+// of the size of its patch. A pair is only made when it costs no more than
+// leaving both commits alone.
+func matchRanges(a []*rangeCommit, b []*rangeCommit, creationFactor int) {
+	pair := func(i, j int) {
+		a[i].matching = j
+		b[j].matching = i
+	}
+
+	for i, left := range a {
+		for j, right := range b {
+			if left.patchID != "" && right.matching < 0 && left.patchID == right.patchID {
+				pair(i, j)
+				break
+			}
+		}
+	}
+
+	type candidate struct{ i, j, cost int }
+	var candidates []candidate
+	for i, left := range a {
+		if left.matching >= 0 {
+			continue
+		}
+		for j, right := range b {
+			if right.matching >= 0 {
+				continue
+			}
+			var diff bytes.Buffer
+			writeHunks(&diff, splitLines([]byte(left.text)), splitLines([]byte(right.text)), &diffOptions{})
+			cost := len(splitLines(diff.Bytes()))
+			if cost <= left.patchSize()*creationFactor/100+right.patchSize()*creationFactor/100 {
+				candidates = append(candidates, candidate{i, j, cost})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(k, l int) bool { return candidates[k].cost < candidates[l].cost })
+	for _, c := range candidates {
+		if a[c.i].matching < 0 && b[c.j].matching < 0 {
+			pair(c.i, c.j)
+		}
+	}
+}
+
+// writeRangeDiff writes the pairs in the order of the second range, with
+// the unmatched commits of the first range where they used to be:
+//
+//	<n>:  <sha> = <n>:  <sha> <subject>   same patch and message
+//	<n>:  <sha> ! <n>:  <sha> <subject>   changed, followed by the nested diff
+//	<n>:  <sha> < -:  ------- <subject>   only in the first range
+//	-:  ------- > <n>:  <sha> <subject>   only in the second range
+func writeRangeDiff(w io.Writer, a []*rangeCommit, b []*rangeCommit) {
+	width := len(strconv.Itoa(max(len(a), len(b))))
+
+	side := func(commits []*rangeCommit, i int) string {
+		if i < 0 {
+			return fmt.Sprintf("%*s:  %s", width, "-", strings.Repeat("-", 7))
+		}
+		return fmt.Sprintf("%*d:  %s", width, i+1, commits[i].sha[:7])
+	}
+
+	writePair := func(i, j int) {
+		var status byte
+		var rc *rangeCommit
+		switch {
+		case j < 0:
+			status, rc = '<', a[i]
+		case i < 0:
+			status, rc = '>', b[j]
+		case a[i].text != b[j].text:
+			// like git, a changed commit goes by its old subject
+			status, rc = '!', a[i]
+		default:
+			status, rc = '=', b[j]
+		}
+
+		fmt.Fprintf(w, "%s %c %s %s\n", side(a, i), status, side(b, j), subject(rc.commit.message))
+		if status == '!' {
+			writeNestedDiff(w, a[i].text, b[j].text)
+		}
+	}
+
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		if i < len(a) && a[i].shown {
+			i++
+			continue
+		}
+		if i < len(a) && a[i].matching < 0 {
+			writePair(i, -1)
+			i++
+			continue
+		}
+		for ; j < len(b) && b[j].matching < 0; j++ {
+			writePair(-1, j)
+		}
+		if j < len(b) {
+			writePair(b[j].matching, j)
+			a[b[j].matching].shown = true
+			j++
+		}
+	}
+}
+
+// writeNestedDiff writes the diff between the texts of two commits,
+// indented by 4 spaces. Hunk headers name the section or patch hunk they
+// are in, and the patch lines get their usual markers back.
+func writeNestedDiff(w io.Writer, a string, b string) {
+	aLines, bLines := splitLines([]byte(a)), splitLines([]byte(b))
+
+	var hunks bytes.Buffer
+	writeHunks(&hunks, aLines, bLines, &diffOptions{})
+
+	for _, line := range splitLines(hunks.Bytes()) {
+		if strings.HasPrefix(line, "@@ -") {
+			ranges := strings.Fields(line)
+			start, _ := strconv.Atoi(strings.Split(ranges[1][1:], ",")[0])
+
+			section := ""
+			for k := start - 2; k >= 0 && k < len(aLines); k-- {
+				header := strings.TrimSuffix(aLines[k], "\n")
+				if strings.HasPrefix(header, " ## ") {
+					section = strings.TrimSuffix(strings.TrimPrefix(header, " ## "), " ##")
+					break
+				}
+				if strings.HasPrefix(header, "@@ ") {
+					section = strings.TrimPrefix(header, "@@ ")
+					break
+				}
+			}
+			line = strings.TrimSpace("@@ "+section) + "\n"
+		} else if len(line) > 1 {
+			if marker := strings.IndexByte("#<>", line[1]); marker >= 0 {
+				line = line[:1] + string(" -+"[marker]) + line[2:]
+			}
+		}
+		fmt.Fprintf(w, "    %s", line)
+	}
+}
+
+// rangeDiff implements `git range-diff [--creation-factor=<percent>] <from>..<to> <from>..<to>`
+//
+// It compares two versions of a series of commits, eg: before and after a
+// rebase. Commits are paired by patch id, or by how similar they are when
+// the patch changed, see matchRanges, and each pair is shown with whether
+// it's the same, and if not, a diff of the two patches.
+func rangeDiff(args []string) {
+	flag := flag.NewFlagSet("git range-diff", flag.ExitOnError)
+	creationFactor := flag.Int("creation-factor", defaultCreationFactor, "how much of a commit may change, in `<percent>`, for it to be paired")
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: git range-diff [--creation-factor=<percent>] <old-base>..<old-tip> <new-base>..<new-tip>")
+		os.Exit(1)
+	}
+
+	a, err := rangeCommits(args[0])
+	if err == nil {
+		var b []*rangeCommit
+		b, err = rangeCommits(args[1])
+		if err == nil {
+			matchRanges(a, b, *creationFactor)
+
+			out := bufio.NewWriter(os.Stdout)
+			writeRangeDiff(out, a, b)
+			out.Flush()
+		}
+	}
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,1062 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rebaseApplyDir is where a rebase keeps its state while it replays the
+// commits, like the apply backend of git:
+//
+//	.git/rebase-apply/head-name   the branch rebased, or "detached HEAD"
+//	.git/rebase-apply/onto        the commit the branch is rebased onto
+//	.git/rebase-apply/orig-head   the commit of the branch before
+//	.git/rebase-apply/next        the number of the commit to replay next
+//	.git/rebase-apply/last        the number of commits to replay
+//	.git/rebase-apply/0001...     the commits to replay, as patches
+//	.git/rebase-apply/rewritten   the commits replayed, and their copies
+const rebaseApplyDir = "rebase-apply"
+
+// rebaseMergeDir is where a rebase of merges keeps its state, like the
+// merge backend of git. It has the files of rebaseApplyDir, but for the
+// patches: the steps to take are in .git/rebase-merge/git-rebase-todo
+// instead, one per line, see rebaseTodo.
+const rebaseMergeDir = "rebase-merge"
+
+// rebaseLabelPrefix is where the labels of a rebase of merges are kept.
+const rebaseLabelPrefix = "refs/rewritten/"
+
+// errRebaseStopped is returned when a rebase stopped on conflicts.
+var errRebaseStopped = errors.New("rebase stopped")
+
+// rebaseState is the state of a rebase in progress, see rebaseApplyDir and
+// rebaseMergeDir.
+type rebaseState struct {
+	dir      string
+	headName string
+	onto     string
+	origHead string
+	next     int
+	last     int
+	todo     []string // the steps of a rebase of merges
+}
+
+// path is the path of a file of the state of the rebase.
+func (s *rebaseState) path(name string) string {
+	return gitPath(filepath.Join(s.dir, name))
+}
+
+// readRebaseState returns the state of the rebase in progress, or nil.
+func readRebaseState() (*rebaseState, error) {
+	state := &rebaseState{}
+	for _, dir := range []string{rebaseApplyDir, rebaseMergeDir} {
+		if _, err := os.Stat(gitPath(dir)); err == nil {
+			state.dir = dir
+		}
+	}
+	if state.dir == "" {
+		return nil, nil
+	}
+
+	values := map[string]string{}
+	for _, name := range []string{"head-name", "onto", "orig-head", "next", "last"} {
+		content, err := os.ReadFile(state.path(name))
+		if err != nil {
+			return nil, err
+		}
+		values[name] = strings.TrimSpace(string(content))
+	}
+	state.headName, state.onto, state.origHead = values["head-name"], values["onto"], values["orig-head"]
+	var err error
+	if state.next, err = strconv.Atoi(values["next"]); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %s", state.path("next"), err)
+	}
+	if state.last, err = strconv.Atoi(values["last"]); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %s", state.path("last"), err)
+	}
+	if state.dir == rebaseMergeDir {
+		content, err := os.ReadFile(state.path("git-rebase-todo"))
+		if err != nil {
+			return nil, err
+		}
+		state.todo = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(state.todo) != state.last {
+			return nil, fmt.Errorf("corrupt %s", state.path("git-rebase-todo"))
+		}
+	}
+	return state, nil
+}
+
+// write writes the state of the rebase, see rebaseApplyDir.
+func (s *rebaseState) write() error {
+	if err := os.MkdirAll(gitPath(s.dir), 0750); err != nil {
+		return err
+	}
+	files := []struct {
+		name, content string
+	}{
+		{"head-name", s.headName},
+		{"onto", s.onto},
+		{"orig-head", s.origHead},
+		{"next", strconv.Itoa(s.next)},
+		{"last", strconv.Itoa(s.last)},
+	}
+	if s.dir == rebaseMergeDir {
+		files = append(files, struct{ name, content string }{"git-rebase-todo", strings.Join(s.todo, "\n")})
+	}
+	for _, file := range files {
+		if err := os.WriteFile(s.path(file.name), []byte(file.content+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patch returns the n-th commit to replay, from the "From <sha>" line its
+// patch starts with.
+func (s *rebaseState) patch(n int) (string, *commit, error) {
+	f, err := os.Open(s.path(fmt.Sprintf("%04d", n)))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	sha, ok := objectNameAfter(line)
+	if !ok {
+		return "", nil, fmt.Errorf("corrupt patch %04d", n)
+	}
+	c, err := readCommit(sha)
+	return sha, c, err
+}
+
+// rebaseCommits returns the commits of head to replay onto upstream, parents
+// first: the ones upstream doesn't have, but the ones whose change upstream
+// has already, with the same patch id, see commitPatchID. Those are returned
+// with their first parent, for their children to be replayed in their place.
+// The merges are left out too, unless they are rebased, see rebaseTodo.
+func rebaseCommits(head string, upstream string, merges bool) ([]*commitNode, map[string]string, error) {
+	inUpstream := map[string]bool{}
+	err := walkCommits([]string{upstream}, func(node *commitNode) bool {
+		inUpstream[node.sha] = true
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	inHead := map[string]bool{}
+	err = walkCommits([]string{head}, func(node *commitNode) bool {
+		inHead[node.sha] = true
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the changes upstream has since the branch forked
+	applied := map[string]bool{}
+	for sha := range inUpstream {
+		if inHead[sha] {
+			continue
+		}
+		c, err := readCommit(sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(c.parents) > 1 {
+			continue
+		}
+		id, err := commitPatchID(sha, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		applied[id] = true
+	}
+
+	nodes, err := parentsFirst([]string{head}, func(sha string) bool { return inUpstream[sha] })
+	if err != nil {
+		return nil, nil, err
+	}
+	var commits []*commitNode
+	dropped := map[string]string{}
+	for _, node := range nodes {
+		if len(node.parents) > 1 {
+			if merges {
+				commits = append(commits, node)
+			}
+			continue
+		}
+		if len(applied) > 0 {
+			c, err := readCommit(node.sha)
+			if err != nil {
+				return nil, nil, err
+			}
+			id, err := commitPatchID(node.sha, c)
+			if err != nil {
+				return nil, nil, err
+			}
+			if applied[id] {
+				if len(node.parents) > 0 {
+					dropped[node.sha] = node.parents[0]
+				}
+				continue
+			}
+		}
+		commits = append(commits, node)
+	}
+	return commits, dropped, nil
+}
+
+// rebaseTodo returns the steps of a rebase of merges, which replays the
+// commits, see rebaseCommits, with the merges between them, like the
+// todo list of `git rebase --rebase-merges`:
+//
+//	label onto
+//	reset onto
+//	pick 1a2b3c4 Fix the parser
+//	label parser
+//	reset onto
+//	pick 5d6e7f8 Update the docs
+//	merge -C 9a8b7c6 parser # Merge branch 'parser'
+//
+// label names HEAD, as refs/rewritten/<label>, reset checks out what a
+// label names, pick replays a commit on HEAD, and merge replays a merge
+// of HEAD and what a label names. The branches merged come before the
+// branch they're merged into, so that a merge follows its first parent.
+// The parents that aren't rebased are kept as they are, but the first
+// ones, which are replaced by onto.
+func rebaseTodo(commits []*commitNode, dropped map[string]string) ([]string, error) {
+	nodes := map[string]*commitNode{}
+	for _, node := range commits {
+		nodes[node.sha] = node
+	}
+
+	// the merges last, and their first parents right before them
+	var ordered []*commitNode
+	done := map[string]bool{}
+	var visit func(node *commitNode)
+	visit = func(node *commitNode) {
+		if node == nil || done[node.sha] {
+			return
+		}
+		done[node.sha] = true
+		for i := len(node.parents) - 1; i >= 0; i-- {
+			parent := node.parents[i]
+			for dropped[parent] != "" {
+				parent = dropped[parent]
+			}
+			visit(nodes[parent])
+		}
+		ordered = append(ordered, node)
+	}
+	for i := len(commits) - 1; i >= 0; i-- {
+		visit(commits[i])
+	}
+
+	// where the parent of a commit replayed is: a commit replayed, onto,
+	// or a commit that isn't rebased
+	parentOf := func(parent string, first bool) string {
+		for dropped[parent] != "" {
+			parent = dropped[parent]
+		}
+		if nodes[parent] == nil && first {
+			return "onto"
+		}
+		return parent
+	}
+
+	// the commits replayed that are reset to or merged get a label, named
+	// after the branch merged, or else after their subject
+	labels := map[string]string{}
+	used := map[string]bool{"onto": true}
+	label := func(sha string, name string) {
+		if nodes[sha] == nil || labels[sha] != "" {
+			return
+		}
+		name = strings.Trim(labelChars.ReplaceAllString(name, "-"), "-")
+		if name == "" {
+			name = "branch-point"
+		}
+		unique := name
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", name, n)
+		}
+		used[unique] = true
+		labels[sha] = unique
+	}
+	subjects := map[string]string{}
+	at := ""
+	for _, node := range ordered {
+		c, err := readCommit(node.sha)
+		if err != nil {
+			return nil, err
+		}
+		subjects[node.sha], _ = messageParts(c.message)
+		if len(node.parents) > 2 {
+			return nil, fmt.Errorf("octopus merge %s can't be rebased", node.sha)
+		}
+		if len(node.parents) == 2 {
+			name := subjects[node.sha]
+			if m := mergedBranch.FindStringSubmatch(name); m != nil {
+				name = m[1]
+			}
+			label(parentOf(node.parents[1], false), name)
+		}
+		if first := parentOf(node.parents[0], true); first != at {
+			label(first, "branch-point")
+		}
+		at = node.sha
+	}
+
+	todo := []string{"label onto"}
+	at = ""
+	for _, node := range ordered {
+		first := parentOf(node.parents[0], true)
+		if first != at {
+			name := first
+			if labels[first] != "" {
+				name = labels[first]
+			}
+			todo = append(todo, "reset "+name)
+		}
+		if len(node.parents) == 2 {
+			other := parentOf(node.parents[1], false)
+			if labels[other] != "" {
+				other = labels[other]
+			}
+			todo = append(todo, fmt.Sprintf("merge -C %s %s # %s", node.sha, other, subjects[node.sha]))
+		} else {
+			todo = append(todo, fmt.Sprintf("pick %s %s", node.sha, subjects[node.sha]))
+		}
+		if labels[node.sha] != "" {
+			todo = append(todo, "label "+labels[node.sha])
+		}
+		at = node.sha
+	}
+	return todo, nil
+}
+
+var (
+	// labelChars are the characters a label can't have, see rebaseTodo
+	labelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	// mergedBranch is the branch a merge message says was merged
+	mergedBranch = regexp.MustCompile(`^Merge (?:remote-tracking )?branch '([^']+)'`)
+)
+
+// rebaseStart starts rebasing the branch checked out onto upstream: HEAD is
+// detached at upstream, and the commits to replay are written down, see
+// rebaseCommits, or the steps to take when merges are rebased too, see
+// rebaseTodo. The pre-rebase hook can refuse the rebase first.
+func rebaseStart(w io.Writer, revision string, merges bool) (*rebaseState, error) {
+	upstream, err := resolveRevision(revision)
+	if err == nil {
+		upstream, _, err = peelTag(upstream)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream '%s'", revision)
+	}
+	head, branch := readWorktreeHead(gitDir)
+	if head == zeroSha || head == "" {
+		return nil, fmt.Errorf("rebasing an unborn branch isn't supported")
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	status, err := readCommitStatus(idx, head, branch)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(status.unstaged) > 0 && len(status.staged) > 0:
+		return nil, fmt.Errorf("error: cannot rebase: You have unstaged changes.\nerror: additionally, your index contains uncommitted changes.\nerror: Please commit or stash them.")
+	case len(status.unstaged) > 0:
+		return nil, fmt.Errorf("error: cannot rebase: You have unstaged changes.\nerror: Please commit or stash them.")
+	case len(status.staged) > 0:
+		return nil, fmt.Errorf("error: cannot rebase: Your index contains uncommitted changes.\nerror: Please commit or stash them.")
+	}
+
+	// the branch is the one checked out, which pre-rebase isn't given
+	if err := runHook("pre-rebase", revision); err != nil {
+		return nil, fmt.Errorf("The pre-rebase hook refused to rebase.")
+	}
+
+	headName := "detached HEAD"
+	if branch != "" {
+		headName = branch
+	}
+	bases, err := mergeBases(head, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 1 && bases[0] == upstream {
+		fmt.Fprintf(w, "Current branch %s is up to date.\n", shortRefName(headName))
+		return nil, nil
+	}
+
+	commits, dropped, err := rebaseCommits(head, upstream, merges)
+	if err != nil {
+		return nil, err
+	}
+	state := &rebaseState{dir: rebaseApplyDir, headName: headName, onto: upstream, origHead: head, next: 1, last: len(commits)}
+	if merges {
+		state.dir = rebaseMergeDir
+		if len(commits) > 0 {
+			if state.todo, err = rebaseTodo(commits, dropped); err != nil {
+				return nil, err
+			}
+		}
+		state.last = len(state.todo)
+	}
+	if err := os.WriteFile(gitPath("ORIG_HEAD"), []byte(head+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	if err := state.write(); err != nil {
+		return nil, err
+	}
+	if !merges {
+		for n, node := range commits {
+			if err := writeRebasePatch(state.path(fmt.Sprintf("%04d", n+1)), node.sha); err != nil {
+				return nil, err
+			}
+		}
+		fmt.Fprintln(w, "First, rewinding head to replay your work on top of it...")
+	}
+	onto, err := readCommit(upstream)
+	if err != nil {
+		return nil, err
+	}
+	files, err := flattenTree(onto.tree)
+	if err != nil {
+		return nil, err
+	}
+	if err := switchFiles(files, nil, "checkout"); err != nil {
+		return nil, fmt.Errorf("error: %s", err)
+	}
+	if err := updateRef("HEAD", upstream); err != nil {
+		return nil, err
+	}
+	if err := appendReflog("HEAD", head, upstream, "rebase (start): checkout "+revision); err != nil {
+		return nil, err
+	}
+
+	if len(commits) == 0 && bases[0] == head {
+		if err := rebaseFinish(state); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(w, "Fast-forwarded %s to %s.\n", shortRefName(headName), revision)
+		return nil, nil
+	}
+	return state, nil
+}
+
+// writeRebasePatch writes a commit to replay as a patch, see
+// writePatchMail.
+func writeRebasePatch(path string, sha string) error {
+	c, err := readCommit(sha)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writePatchMail(f, sha, c, "")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rebasePick replays a commit on HEAD: its changes are merged, see
+// mergeTrees, and committed with its author and message. It returns
+// errRebaseStopped when they conflict, with the conflicts left to resolve,
+// like merge does.
+func rebasePick(w io.Writer, state *rebaseState, sha string, c *commit) error {
+	subject, _ := messageParts(c.message)
+	if state.dir == rebaseApplyDir {
+		fmt.Fprintf(w, "Applying: %s\n", subject)
+	}
+
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+	headCommit, err := readCommit(head)
+	if err != nil {
+		return err
+	}
+	base := ""
+	if len(c.parents) > 0 {
+		parent, err := readCommit(c.parents[0])
+		if err != nil {
+			return err
+		}
+		base = parent.tree
+	}
+	theirsLabel := subject
+	if state.dir == rebaseMergeDir {
+		theirsLabel = sha[:7] + " (" + subject + ")"
+	}
+	result, err := mergeTrees(base, headCommit.tree, c.tree, "HEAD", theirsLabel)
+	if err != nil {
+		return err
+	}
+
+	if len(result.stages) > 0 && state.dir == rebaseApplyDir {
+		// like git, which couldn't apply the patch, says which files of
+		// HEAD it's merged with
+		fmt.Fprintln(w, "Using index info to reconstruct a base tree...")
+		changes, err := diffTrees(base, c.tree, true)
+		if err != nil {
+			return err
+		}
+		headFiles, err := flattenTree(headCommit.tree)
+		if err != nil {
+			return err
+		}
+		var changed []string
+		for _, change := range changes {
+			if change.old.sha == "" {
+				continue
+			}
+			if entry, ok := headFiles[change.path]; !ok {
+				changed = append(changed, "D\t"+change.path)
+			} else if entry.sha != change.old.sha || entry.mode != change.old.mode {
+				changed = append(changed, "M\t"+change.path)
+			}
+		}
+		sort.Slice(changed, func(i, j int) bool { return changed[i][2:] < changed[j][2:] })
+		for _, line := range changed {
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w, "Falling back to patching base and 3-way merge...")
+	}
+
+	if err := rebaseCheckout(w, result); err != nil {
+		return err
+	}
+	if len(result.stages) > 0 {
+		return rebaseStop(w, state, sha, "apply", subject)
+	}
+	return rebaseCommit(state, []string{head}, sha, c, result.tree)
+}
+
+// rebaseMerge replays a merge of HEAD and the commit other names, a label
+// or a commit, see rebaseTodo: their changes are merged, see mergeTrees,
+// and committed with the author and message of the merge. It returns
+// errRebaseStopped when they conflict, like rebasePick.
+func rebaseMerge(w io.Writer, state *rebaseState, sha string, c *commit, other string) error {
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+	theirs, err := rebaseLabel(other)
+	if err != nil {
+		return err
+	}
+	bases, err := mergeBases(head, theirs)
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		return fmt.Errorf("refusing to merge unrelated histories")
+	}
+	if bases[0] == theirs {
+		// like git, nothing is left to merge when the branch merged is
+		// already there
+		return nil
+	}
+	headCommit, err := readCommit(head)
+	if err != nil {
+		return err
+	}
+	theirCommit, err := readCommit(theirs)
+	if err != nil {
+		return err
+	}
+	base, err := readCommit(bases[0])
+	if err != nil {
+		return err
+	}
+	result, err := mergeTrees(base.tree, headCommit.tree, theirCommit.tree, "HEAD", other)
+	if err != nil {
+		return err
+	}
+
+	if err := rebaseCheckout(w, result); err != nil {
+		return err
+	}
+	if len(result.stages) > 0 {
+		return rebaseStop(w, state, sha, "merge", other)
+	}
+	return rebaseCommit(state, []string{head, theirs}, sha, c, result.tree)
+}
+
+// rebaseLabel returns the commit a label names, or the commit itself when
+// it isn't a label, see rebaseTodo.
+func rebaseLabel(name string) (string, error) {
+	if name == "onto" || !isObjectName(name) {
+		sha, err := readRef(rebaseLabelPrefix + name)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve '%s'", name)
+		}
+		return sha, nil
+	}
+	return name, nil
+}
+
+// rebaseCheckout checks the tree of a merge out, with its conflicts.
+func rebaseCheckout(w io.Writer, result *treeMerge) error {
+	files, err := flattenTree(result.tree)
+	if err != nil {
+		return err
+	}
+	if err := switchFiles(files, result.stages, "checkout"); err != nil {
+		return fmt.Errorf("error: %s", err)
+	}
+	for _, message := range result.messages {
+		fmt.Fprintln(w, message)
+	}
+	return nil
+}
+
+// rebaseStop stops the rebase on the conflicts of a commit, and tells how
+// to go on.
+func rebaseStop(w io.Writer, state *rebaseState, sha string, action string, subject string) error {
+	if err := os.WriteFile(gitPath("REBASE_HEAD"), []byte(sha+"\n"), 0644); err != nil {
+		return err
+	}
+	if w, ok := w.(*bufio.Writer); ok {
+		w.Flush()
+	}
+	if state.dir == rebaseApplyDir {
+		fmt.Fprintln(os.Stderr, "error: Failed to merge in the changes.")
+		fmt.Fprintln(os.Stderr, "hint: Use 'git am --show-current-patch=diff' to see the failed patch")
+		fmt.Fprintf(w, "Patch failed at %04d %s\n", state.next, subject)
+		fmt.Fprintln(w, "Resolve all conflicts manually, mark them as resolved with")
+		fmt.Fprintln(w, "\"git add/rm <conflicted_files>\", then run \"git rebase --continue\".")
+		fmt.Fprintln(w, "You can instead skip this commit: run \"git rebase --skip\".")
+		fmt.Fprintln(w, "To abort and get back to the state before \"git rebase\", run \"git rebase --abort\".")
+		return errRebaseStopped
+	}
+	fmt.Fprintf(os.Stderr, "error: could not %s %s... %s\n", action, sha[:7], subject)
+	fmt.Fprintln(os.Stderr, "hint: Resolve all conflicts manually, mark them as resolved with")
+	fmt.Fprintln(os.Stderr, "hint: \"git add/rm <conflicted_files>\", then run \"git rebase --continue\".")
+	fmt.Fprintln(os.Stderr, "hint: You can instead skip this commit: run \"git rebase --skip\".")
+	fmt.Fprintln(os.Stderr, "hint: To abort and get back to the state before \"git rebase\", run \"git rebase --abort\".")
+	fmt.Fprintf(w, "Could not %s %s... %s\n", action, sha[:7], subject)
+	return errRebaseStopped
+}
+
+// rebaseCommit commits tree on HEAD, the first of parents, as the copy of a
+// commit replayed, and records it in the rewritten list.
+func rebaseCommit(state *rebaseState, parents []string, sha string, c *commit, tree string) error {
+	copied := &commit{tree: tree, parents: parents, author: c.author, message: c.message}
+	var err error
+	if copied.committer, err = makeIdent("COMMITTER"); err != nil {
+		return err
+	}
+	copy, err := writeObject("commit", copied.encode())
+	if err != nil {
+		return err
+	}
+	head := parents[0]
+	if err := updateRefIf("HEAD", copy, head); err != nil {
+		return fmt.Errorf("cannot update ref 'HEAD': %s", err)
+	}
+	subject, _ := messageParts(c.message)
+	action := "pick"
+	if len(parents) > 1 {
+		action = "merge"
+	}
+	if err := appendReflog("HEAD", head, copy, "rebase ("+action+"): "+subject); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(state.path("rewritten"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", sha, copy)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rebaseStep takes a step of a rebase of merges, see rebaseTodo.
+func rebaseStep(w io.Writer, state *rebaseState, step string) error {
+	command, args, _ := strings.Cut(step, " ")
+	switch command {
+	case "label":
+		head, err := resolveRevision("HEAD")
+		if err != nil {
+			return err
+		}
+		return updateRef(rebaseLabelPrefix+args, head)
+
+	case "reset":
+		head, err := resolveRevision("HEAD")
+		if err != nil {
+			return err
+		}
+		sha, err := rebaseLabel(args)
+		if err != nil {
+			return err
+		}
+		if _, err := resetCommit(sha); err != nil {
+			return err
+		}
+		if err := updateRef("HEAD", sha); err != nil {
+			return err
+		}
+		return appendReflog("HEAD", head, sha, "rebase (reset): '"+args+"'")
+
+	case "pick", "merge":
+		sha, c, other, err := rebaseStepCommit(step)
+		if err != nil {
+			return err
+		}
+		if command == "pick" {
+			return rebasePick(w, state, sha, c)
+		}
+		return rebaseMerge(w, state, sha, c, other)
+	}
+	return fmt.Errorf("invalid line in %s: %s", state.path("git-rebase-todo"), step)
+}
+
+// rebaseStepCommit returns the commit a pick or merge step replays, and
+// what is merged.
+func rebaseStepCommit(step string) (string, *commit, string, error) {
+	fields := strings.Fields(step)
+	var sha, other string
+	switch {
+	case len(fields) >= 2 && fields[0] == "pick":
+		sha = fields[1]
+	case len(fields) >= 4 && fields[0] == "merge" && fields[1] == "-C":
+		sha, other = fields[2], fields[3]
+	default:
+		return "", nil, "", fmt.Errorf("invalid step: %s", step)
+	}
+	c, err := readCommit(sha)
+	return sha, c, other, err
+}
+
+// rebaseRun replays the commits left, see rebasePick, or takes the steps
+// left, see rebaseStep, and then finishes the rebase, see rebaseFinish.
+func rebaseRun(w io.Writer, state *rebaseState) error {
+	for ; state.next <= state.last; state.next++ {
+		if err := state.write(); err != nil {
+			return err
+		}
+		if state.dir == rebaseMergeDir {
+			if err := rebaseStep(w, state, state.todo[state.next-1]); err != nil {
+				return err
+			}
+		} else {
+			sha, c, err := state.patch(state.next)
+			if err != nil {
+				return err
+			}
+			if err := rebasePick(w, state, sha, c); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rebaseFinish(state); err != nil {
+		return err
+	}
+	if state.dir == rebaseMergeDir {
+		fmt.Fprintf(w, "Successfully rebased and updated %s.\n", state.headName)
+	}
+	return nil
+}
+
+// rebaseFinish moves the branch rebased to HEAD, checks it out again, and
+// forgets about the rebase. The post-rewrite hook gets the commits replayed
+// and their copies.
+func rebaseFinish(state *rebaseState) error {
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(state.headName, "refs/") {
+		if err := updateRefIf(state.headName, head, state.origHead); err != nil {
+			return fmt.Errorf("cannot update ref '%s': %s", state.headName, err)
+		}
+		if err := appendReflog(state.headName, state.origHead, head, "rebase (finish): "+state.headName+" onto "+state.onto); err != nil {
+			return err
+		}
+		if err := updateSymbolicRef("HEAD", state.headName); err != nil {
+			return err
+		}
+		if err := appendReflog("HEAD", head, head, "rebase (finish): returning to "+state.headName); err != nil {
+			return err
+		}
+	}
+
+	rewritten, err := os.ReadFile(state.path("rewritten"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeRebaseState(state); err != nil {
+		return err
+	}
+	if len(rewritten) > 0 {
+		runHookWith("post-rewrite", rewritten, os.Stderr, "rebase")
+	}
+	return nil
+}
+
+// rebaseContinue commits the resolution of the conflicts the rebase
+// stopped on, as the copy of the commit that conflicted, and goes on.
+func rebaseContinue(w io.Writer, state *rebaseState) error {
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+	var unmerged []string
+	for _, entry := range idx.entries {
+		if entry.stage() != 0 && (len(unmerged) == 0 || unmerged[len(unmerged)-1] != entry.path) {
+			unmerged = append(unmerged, entry.path)
+		}
+	}
+	if len(unmerged) > 0 {
+		for _, path := range unmerged {
+			fmt.Fprintf(w, "%s: needs merge\n", path)
+		}
+		return fmt.Errorf("error: You must edit all merge conflicts and then\nmark them as resolved using git add")
+	}
+
+	if _, err := os.Stat(gitPath("REBASE_HEAD")); err == nil && state.next <= state.last {
+		var (
+			sha   string
+			c     *commit
+			other string
+		)
+		if state.dir == rebaseMergeDir {
+			sha, c, other, err = rebaseStepCommit(state.todo[state.next-1])
+		} else {
+			sha, c, err = state.patch(state.next)
+		}
+		if err != nil {
+			return err
+		}
+		if state.dir == rebaseApplyDir {
+			subject, _ := messageParts(c.message)
+			fmt.Fprintf(w, "Applying: %s\n", subject)
+		}
+
+		head, err := resolveRevision("HEAD")
+		if err != nil {
+			return err
+		}
+		headCommit, err := readCommit(head)
+		if err != nil {
+			return err
+		}
+		tree, err := writeTreeFromFiles(indexFiles(idx))
+		if err != nil {
+			return err
+		}
+		parents := []string{head}
+		if other != "" {
+			theirs, err := rebaseLabel(other)
+			if err != nil {
+				return err
+			}
+			parents = append(parents, theirs)
+		} else if tree == headCommit.tree {
+			return fmt.Errorf("error: No changes - did you forget to use 'git add'?\n" +
+				"If there is nothing left to stage, chances are that something else\n" +
+				"already introduced the same changes; you might want to skip this patch.\n" +
+				"Resolve all conflicts manually, mark them as resolved with\n" +
+				"\"git add/rm <conflicted_files>\", then run \"git rebase --continue\".\n" +
+				"You can instead skip this commit: run \"git rebase --skip\".\n" +
+				"To abort and get back to the state before \"git rebase\", run \"git rebase --abort\".")
+		}
+		if err := rebaseCommit(state, parents, sha, c, tree); err != nil {
+			return err
+		}
+		if err := os.Remove(gitPath("REBASE_HEAD")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		state.next++
+		if err := state.write(); err != nil {
+			return err
+		}
+	}
+	return rebaseRun(w, state)
+}
+
+// rebaseSkip drops the commit the rebase stopped on, and goes on.
+func rebaseSkip(w io.Writer, state *rebaseState) error {
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+	if _, err := resetCommit(head); err != nil {
+		return err
+	}
+	if err := os.Remove(gitPath("REBASE_HEAD")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	state.next++
+	if err := state.write(); err != nil {
+		return err
+	}
+	return rebaseRun(w, state)
+}
+
+// rebaseAbort goes back to the branch as it was before the rebase.
+func rebaseAbort(state *rebaseState) error {
+	head, err := resolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+	if _, err := resetCommit(state.origHead); err != nil {
+		return err
+	}
+	if strings.HasPrefix(state.headName, "refs/") {
+		err = updateSymbolicRef("HEAD", state.headName)
+	} else {
+		err = updateRef("HEAD", state.origHead)
+	}
+	if err != nil {
+		return err
+	}
+	if err := appendReflog("HEAD", head, state.origHead, "rebase (abort): returning to "+state.headName); err != nil {
+		return err
+	}
+	return removeRebaseState(state)
+}
+
+// removeRebaseState forgets about the rebase in progress, and the labels
+// of a rebase of merges.
+func removeRebaseState(state *rebaseState) error {
+	if err := os.Remove(gitPath("REBASE_HEAD")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	refs, err := listRefs()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.name, rebaseLabelPrefix) {
+			if err := deleteRef(ref.name); err != nil {
+				return err
+			}
+		}
+	}
+	os.Remove(filepath.Join(commonDir, rebaseLabelPrefix))
+	return os.RemoveAll(gitPath(state.dir))
+}
+
+// rebase implements `git rebase [--rebase-merges] <upstream>` and `git rebase (--continue | --skip | --abort)`
+//
+// It replays the commits of the branch checked out that upstream doesn't
+// have on top of upstream, one after the other, see rebasePick, and moves
+// the branch to the last copy:
+//
+//	$ git rebase main
+//	First, rewinding head to replay your work on top of it...
+//	Applying: Fix the parser
+//	Applying: Test the parser
+//
+// Merges aren't replayed, the history rebased is linear, and neither are
+// the commits whose change upstream already has. With --rebase-merges, or
+// -r, the merges are replayed too, so the history rebased keeps its shape,
+// following the steps of a todo list, see rebaseTodo.
+//
+// When a commit conflicts, the rebase stops for the conflicts to be
+// resolved, with its state in .git/rebase-apply, see rebaseApplyDir, or in
+// .git/rebase-merge, see rebaseMergeDir. Then --continue commits the
+// resolution and goes on, --skip drops the commit, and --abort goes back
+// to the branch as it was before the rebase.
+func rebase(args []string) {
+	flag := flag.NewFlagSet("git rebase", flag.ExitOnError)
+	var (
+		continueRebase = flag.Bool("continue", false, "commit the resolution of the conflicts and go on")
+		skip           = flag.Bool("skip", false, "drop the commit that conflicted and go on")
+		abort          = flag.Bool("abort", false, "go back to the branch as it was before the rebase")
+		merges         bool
+	)
+	flag.BoolVar(&merges, "rebase-merges", false, "replay the merges too, keeping the shape of the history")
+	flag.BoolVar(&merges, "r", false, "short for --rebase-merges")
+	flag.Parse(args)
+	args = flag.Args()
+
+	// errors are fatal, unless they say they're only errors
+	fail := func(err error) {
+		if strings.HasPrefix(err.Error(), "error: ") {
+			fmt.Fprintln(os.Stderr, strings.TrimPrefix(err.Error(), "error: "))
+			os.Exit(1)
+		}
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	actions := 0
+	for _, set := range []bool{*continueRebase, *skip, *abort} {
+		if set {
+			actions++
+		}
+	}
+	if actions > 1 || actions == 1 && (len(args) > 0 || merges) || actions == 0 && len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git rebase [--rebase-merges] <upstream>")
+		fmt.Fprintln(os.Stderr, "   or: git rebase (--continue | --skip | --abort)")
+		os.Exit(129)
+	}
+
+	state, err := readRebaseState()
+	if err != nil {
+		fail(err)
+	}
+	if actions == 0 && state != nil {
+		fail(fmt.Errorf("It seems that there is already a %s directory, and\n"+
+			"I wonder if you are in the middle of another rebase.  If that is the\n"+
+			"case, please try\n"+
+			"\tgit rebase (--continue | --abort | --skip)\n"+
+			"If that is not the case, please\n"+
+			"\trm -fr \"%s\"\n"+
+			"and run me again.  I am stopping in case you still have something\n"+
+			"valuable there.\n", state.dir, filepath.Join(gitDir, state.dir)))
+	}
+	if actions == 1 && state == nil {
+		fail(fmt.Errorf("No rebase in progress?"))
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	switch {
+	case *abort:
+		err = rebaseAbort(state)
+	case *skip:
+		err = rebaseSkip(out, state)
+	case *continueRebase:
+		err = rebaseContinue(out, state)
+	default:
+		if state, err = rebaseStart(out, args[0], merges); err == nil && state != nil {
+			err = rebaseRun(out, state)
+		}
+	}
+	out.Flush()
+	if errors.Is(err, errRebaseStopped) {
+		os.Exit(1)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
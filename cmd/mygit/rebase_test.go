@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRebase(t *testing.T) {
+	main, theirs := testMergeHistory(t, map[string]string{"f": "1\n2\n3\n", "g": "y\n"})
+	// the change of g upstream already has isn't replayed
+	main = writeTestTreeCommit(t, map[string]string{"f": "1\nM\n3\n", "g": "y\n"}, "g on main", main)
+	if err := updateRef("refs/heads/main", main); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkoutCommit(main); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	state, err := rebaseStart(&out, "side", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rebaseRun(&out, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "First, rewinding head to replay your work on top of it...\nApplying: main\n"; got != want {
+		t.Errorf("rebase printed\n%s\nexpected\n%s", got, want)
+	}
+
+	head, err := resolveRevision("refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readCommit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.parents) != 1 || c.parents[0] != theirs || c.message != "main\n" {
+		t.Errorf("main is %q on %v, expected main on %s", c.message, c.parents, theirs)
+	}
+	if content, _ := os.ReadFile(gitPath("HEAD")); string(content) != "ref: refs/heads/main\n" {
+		t.Errorf("HEAD is %q after the rebase", content)
+	}
+	for path, want := range map[string]string{"f": "1\nM\n3\n", "g": "y\n"} {
+		if content, _ := os.ReadFile(path); string(content) != want {
+			t.Errorf("%s is %q, expected %q", path, content, want)
+		}
+	}
+	if fileExists(gitPath(rebaseApplyDir)) {
+		t.Errorf("%s is still there after the rebase", rebaseApplyDir)
+	}
+
+	out.Reset()
+	if state, err := rebaseStart(&out, "side", false); err != nil || state != nil || out.String() != "Current branch main is up to date.\n" {
+		t.Errorf("rebasing again printed %q (%v)", out.String(), err)
+	}
+}
+
+func TestRebaseConflict(t *testing.T) {
+	main, _ := testMergeHistory(t, map[string]string{"f": "1\nS\n3\n", "g": "x\n"})
+
+	var out bytes.Buffer
+	state, err := rebaseStart(&out, "side", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rebaseRun(&out, state); !errors.Is(err, errRebaseStopped) {
+		t.Fatalf("rebase returned %v, expected it to stop", err)
+	}
+	if !strings.Contains(out.String(), "CONFLICT (content): Merge conflict in f\n") {
+		t.Errorf("rebase printed\n%s", out.String())
+	}
+	if head, _ := os.ReadFile(gitPath("REBASE_HEAD")); string(head) != main+"\n" {
+		t.Errorf("REBASE_HEAD is %q, expected %s", head, main)
+	}
+
+	// --continue refuses while f is unmerged
+	state, err = readRebaseState()
+	if err != nil || state == nil {
+		t.Fatalf("reading the rebase state returned %v (%v)", state, err)
+	}
+	if err := rebaseContinue(&bytes.Buffer{}, state); err == nil {
+		t.Error("--continue with conflicts left succeeded")
+	}
+
+	if err := rebaseAbort(state); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := resolveRevision("HEAD"); head != main {
+		t.Errorf("HEAD is %s after --abort, expected %s", head, main)
+	}
+	if content, _ := os.ReadFile("f"); string(content) != "1\nM\n3\n" {
+		t.Errorf("after --abort, f is %q", content)
+	}
+	if state, err := readRebaseState(); state != nil || err != nil {
+		t.Errorf("after --abort, the rebase state is %v (%v)", state, err)
+	}
+}
+
+func TestRebaseMerges(t *testing.T) {
+	testRepository(t)
+	base := writeTestTreeCommit(t, map[string]string{"f": "1\n"}, "base")
+	upstream := writeTestTreeCommit(t, map[string]string{"f": "1\n", "u": "u\n"}, "upstream", base)
+	topic := writeTestTreeCommit(t, map[string]string{"f": "1\n", "t": "t\n"}, "T", base)
+	b := writeTestTreeCommit(t, map[string]string{"f": "1\n", "b": "b\n"}, "B", base)
+	merge := writeTestTreeCommit(t, map[string]string{"f": "1\n", "b": "b\n", "t": "t\n"}, "Merge branch 'topic'", b, topic)
+	for ref, sha := range map[string]string{"refs/heads/main": merge, "refs/heads/up": upstream} {
+		if err := updateRef(ref, sha); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := checkoutCommit(merge); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	state, err := rebaseStart(&out, "up", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"label onto",
+		"reset onto",
+		"pick " + topic + " T",
+		"label topic",
+		"reset onto",
+		"pick " + b + " B",
+		"merge -C " + merge + " topic # Merge branch 'topic'",
+	}
+	if got := strings.Join(state.todo, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("the todo list is\n%s\nexpected\n%s", got, strings.Join(want, "\n"))
+	}
+	if err := rebaseRun(&out, state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "Successfully rebased and updated refs/heads/main.\n"; got != want {
+		t.Errorf("rebase printed %q, expected %q", got, want)
+	}
+
+	head, err := resolveRevision("refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := readCommit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.parents) != 2 || c.message != "Merge branch 'topic'\n" {
+		t.Fatalf("main is %q with parents %v, expected the merge", c.message, c.parents)
+	}
+	for n, subject := range []string{"B", "T"} {
+		parent, err := readCommit(c.parents[n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := messageParts(parent.message); got != subject || len(parent.parents) != 1 || parent.parents[0] != upstream {
+			t.Errorf("parent %d is %q on %v, expected %s on %s", n+1, got, parent.parents, subject, upstream)
+		}
+	}
+	for path, want := range map[string]string{"b": "b\n", "t": "t\n", "u": "u\n"} {
+		if content, _ := os.ReadFile(path); string(content) != want {
+			t.Errorf("%s is %q, expected %q", path, content, want)
+		}
+	}
+	if _, err := readRef(rebaseLabelPrefix + "topic"); err == nil {
+		t.Error("the labels are still there after the rebase")
+	}
+}
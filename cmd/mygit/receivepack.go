@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// receivePackCapabilities are advertised after the first ref.
+const receivePackCapabilities = "report-status delete-refs side-band-64k quiet ofs-delta"
+
+// refCommand is a ref update asked for by a push. A zeroSha old value
+// creates the ref, a zeroSha new value deletes it.
+type refCommand struct {
+	old, new, ref string
+	err           string // why the update was refused, for report-status
+}
+
+// receivePack implements `git receive-pack [--stateless-rpc] [--advertise-refs] <directory>`
+//
+// It is the server side of push, speaking protocol v0 over stdin and
+// stdout:
+//
+//  1. the refs are advertised, with the capabilities after the first one
+//  2. the client sends `<old> <new> <ref>` lines and a flush, then a pack
+//     with the objects the server doesn't have yet, unless it only deletes
+//  3. the pack is unpacked into loose objects when it has fewer than
+//     receive.unpackLimit (100) objects, kept as a pack otherwise
+//  4. the hooks run: pre-receive with all the updates on stdin, update for
+//     each ref, and post-receive after the refs are updated. A failing
+//     pre-receive refuses the whole push, a failing update only its ref
+//  5. with report-status, the client gets `unpack ok` and `ok <ref>` or
+//     `ng <ref> <reason>` for each update
+//
+// Like git, the checked out branch can't be updated unless
+// receive.denyCurrentBranch is ignore or warn, or the repository is bare,
+// without any branch checked out. receive.denyDeletes refuses
+// deletes and receive.denyNonFastForwards refuses updates that lose
+// commits.
+func receivePack(args []string) {
+	flag := flag.NewFlagSet("git receive-pack", flag.ExitOnError)
+	var (
+		statelessRPC  = flag.Bool("stateless-rpc", false, "quit after a single request/response exchange")
+		advertiseRefs = flag.Bool("advertise-refs", false, "only advertise the refs")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git receive-pack [--stateless-rpc] [--advertise-refs] <directory>")
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	in := bufio.NewReader(os.Stdin)
+
+	fail := func(err error) {
+		out.Flush()
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	// the directory is the work tree or, when git is the client, its .git,
+	// unless it is a bare repository
+	dir := args[0]
+	if filepath.Base(dir) == ".git" {
+		dir = filepath.Dir(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil && !isGitDirectory(dir) {
+		fail(fmt.Errorf("'%s' does not appear to be a git repository", args[0]))
+	}
+	if err := os.Chdir(dir); err != nil {
+		fail(err)
+	}
+	if err := setupGitDir(); err != nil {
+		fail(err)
+	}
+
+	refs, err := listRefs()
+	if err != nil {
+		fail(err)
+	}
+	if !*statelessRPC || *advertiseRefs {
+		advertised := refs
+		if len(advertised) == 0 {
+			advertised = []ref{{name: "capabilities^{}", sha: zeroSha}}
+		}
+		for i, r := range advertised {
+			line := r.sha + " " + r.name
+			if i == 0 {
+				line += "\x00" + receivePackCapabilities + " object-format=sha1 agent=mygit"
+			}
+			if err := writePktLine(out, line+"\n"); err != nil {
+				fail(err)
+			}
+		}
+		writeFlushPkt(out)
+		out.Flush()
+	}
+	if *advertiseRefs {
+		return
+	}
+
+	commands, capabilities, err := readRefCommands(in)
+	if err != nil {
+		fail(err)
+	}
+	if len(commands) == 0 {
+		return
+	}
+
+	var progress io.Writer = os.Stderr
+	if capabilities["side-band-64k"] {
+		progress = &sideband{w: out, band: 2, max: pktLineMax}
+	}
+
+	unpackErr := error(nil)
+	for _, command := range commands {
+		if command.new != zeroSha {
+			unpackErr = receivePackData(in, capabilities["quiet"], progress)
+			break
+		}
+	}
+	if unpackErr != nil {
+		for _, command := range commands {
+			command.err = "unpacker error"
+		}
+	} else {
+		updateRefs(commands, refs, progress)
+	}
+
+	if capabilities["report-status"] {
+		var report bytes.Buffer
+		if unpackErr != nil {
+			writePktLine(&report, "unpack "+unpackErr.Error()+"\n")
+		} else {
+			writePktLine(&report, "unpack ok\n")
+		}
+		for _, command := range commands {
+			if command.err == "" {
+				writePktLine(&report, "ok "+command.ref+"\n")
+			} else {
+				writePktLine(&report, "ng "+command.ref+" "+command.err+"\n")
+			}
+		}
+		writeFlushPkt(&report)
+
+		if capabilities["side-band-64k"] {
+			(&sideband{w: out, band: 1, max: pktLineMax}).Write(report.Bytes())
+		} else {
+			out.Write(report.Bytes())
+		}
+	}
+	if capabilities["side-band-64k"] {
+		writeFlushPkt(out)
+	}
+	if err := out.Flush(); err != nil {
+		fail(err)
+	}
+}
+
+// readRefCommands reads the ref updates up to the flush, the capabilities
+// of the client come after the first one.
+func readRefCommands(r *bufio.Reader) ([]*refCommand, map[string]bool, error) {
+	var commands []*refCommand
+	capabilities := map[string]bool{}
+	for {
+		line, flush, err := readPktLine(r)
+		if err == io.EOF && len(commands) == 0 {
+			// the client hung up after the advertisement
+			return nil, capabilities, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if flush {
+			return commands, capabilities, nil
+		}
+		if strings.HasPrefix(line, "shallow ") {
+			continue
+		}
+
+		line, requested, found := strings.Cut(line, "\x00")
+		if found {
+			for _, capability := range strings.Fields(requested) {
+				capabilities[capability] = true
+			}
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !isObjectName(fields[0]) || !isObjectName(fields[1]) {
+			return nil, nil, fmt.Errorf("protocol error: expected old/new/ref, got '%s'", line)
+		}
+		commands = append(commands, &refCommand{old: fields[0], new: fields[1], ref: fields[2]})
+	}
+}
+
+// receivePackData reads the pack following the ref updates and stores it,
+// see storePack.
+func receivePackData(r *bufio.Reader, quiet bool, progress io.Writer) error {
+	pack, err := readPackStream(r)
+	if err != nil {
+		return err
+	}
+	if quiet {
+		progress = nil
+	}
+	return storePack(pack, unpackLimit("receive.unpackLimit"), progress)
+}
+
+// unpackLimit returns under how many objects a pack received is unpacked
+// into loose objects: the first of key and transfer.unpackLimit set, or
+// 100.
+func unpackLimit(key string) int {
+	for _, key := range []string{key, "transfer.unpackLimit"} {
+		if value, ok := configGet(key); ok {
+			if n, err := strconv.Atoi(value); err == nil {
+				return n
+			}
+		}
+	}
+	return 100
+}
+
+// storePack stores the objects of a pack received, loose when there are
+// fewer than limit, as a pack otherwise. A thin pack, with deltas against
+// objects of the repository, gets these objects appended to be usable on
+// its own.
+func storePack(pack []byte, limit int, progress io.Writer) error {
+	entries, checksum, err := parsePack(pack, nil)
+	if err == nil {
+		err = resolvePackDeltas(entries, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(entries) < limit {
+		p := startProgress(progress, "Unpacking objects", len(entries))
+		for i, entry := range entries {
+			if _, err := writeObject(entry.objectType, entry.data); err != nil {
+				return err
+			}
+			p.update(i + 1)
+		}
+		p.done()
+		return nil
+	}
+
+	pack, entries, checksum, err = completeThinPack(pack, entries)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(gitPath(packDir), "pack-"+hex.EncodeToString(checksum)+".pack")
+	if err := os.MkdirAll(gitPath(packDir), 0750); err != nil {
+		return err
+	}
+	if err := writeObjectFile(path, pack, 0444); err != nil {
+		return err
+	}
+	if err := writePackIndex(strings.TrimSuffix(path, ".pack")+".idx", entries, checksum); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if progress != nil {
+		fmt.Fprintf(progress, "Indexed %d objects, done.\n", len(entries))
+	}
+	return nil
+}
+
+// updateRefs applies the updates that pass the checks and the hooks,
+// setting err on the others.
+func updateRefs(commands []*refCommand, refs []ref, progress io.Writer) {
+	current := map[string]string{}
+	var tips []string
+	for _, r := range refs {
+		current[r.name] = r.sha
+		tips = append(tips, r.sha)
+	}
+
+	// a detached HEAD has no branch checked out
+	head, symbolic, _ := readSymbolicRef("HEAD")
+	if !symbolic {
+		head = ""
+	}
+	denyCurrentBranch, ok := configGet("receive.denyCurrentBranch")
+	if !ok {
+		denyCurrentBranch = "refuse"
+	}
+	if b, ok := parseBool(denyCurrentBranch); ok {
+		denyCurrentBranch = map[bool]string{true: "refuse", false: "ignore"}[b]
+	}
+
+	for _, command := range commands {
+		old := current[command.ref]
+		if old == "" {
+			old = zeroSha
+		}
+
+		switch {
+		case !strings.HasPrefix(command.ref, "refs/") || strings.Contains(command.ref, ".."):
+			command.err = "funny refname"
+
+		case command.old != old:
+			command.err = "failed to update ref"
+
+		case command.new == zeroSha && command.ref == head:
+			command.err = "deletion of the current branch prohibited"
+
+		case command.new == zeroSha && configBool("receive.denyDeletes", false):
+			command.err = "deletion prohibited"
+
+		case command.new != zeroSha && command.ref == head && !bareRepository && denyCurrentBranch != "ignore" && denyCurrentBranch != "warn":
+			fmt.Fprintf(progress, "error: refusing to update checked out branch: %s\n", command.ref)
+			command.err = "branch is currently checked out"
+
+		case command.new != zeroSha:
+			// every object the ref needs must be there now
+			if _, err := objectsToSend([]string{command.new}, tips, nil, nil, ""); err != nil {
+				command.err = "missing necessary objects"
+				break
+			}
+			if command.ref == head && !bareRepository && denyCurrentBranch == "warn" {
+				fmt.Fprintf(progress, "warning: updating the current branch\n")
+			}
+			if old != zeroSha && configBool("receive.denyNonFastForwards", false) {
+				if ancestor, err := isAncestor(old, command.new); err != nil || !ancestor {
+					command.err = "non-fast-forward"
+				}
+			}
+		}
+	}
+
+	var input strings.Builder
+	for _, command := range commands {
+		if command.err == "" {
+			fmt.Fprintf(&input, "%s %s %s\n", command.old, command.new, command.ref)
+		}
+	}
+	if input.Len() == 0 {
+		return
+	}
+	if err := runHookWith("pre-receive", []byte(input.String()), progress); err != nil {
+		for _, command := range commands {
+			if command.err == "" {
+				command.err = "pre-receive hook declined"
+			}
+		}
+		return
+	}
+
+	input.Reset()
+	for _, command := range commands {
+		if command.err != "" {
+			continue
+		}
+		if err := runHookWith("update", nil, progress, command.ref, command.old, command.new); err != nil {
+			command.err = "hook declined"
+			continue
+		}
+
+		var err error
+		if command.new == zeroSha {
+			err = deleteRef(command.ref)
+		} else {
+			err = updateRef(command.ref, command.new)
+		}
+		if err != nil {
+			fmt.Fprintf(progress, "error: %s\n", err)
+			command.err = "failed to update ref"
+			continue
+		}
+		fmt.Fprintf(&input, "%s %s %s\n", command.old, command.new, command.ref)
+	}
+
+	if input.Len() > 0 {
+		runHookWith("post-receive", []byte(input.String()), progress)
+	}
+}
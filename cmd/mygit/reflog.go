@@ -0,0 +1,366 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// reflogEntry is a line of the reflog of a ref, .git/logs/<ref>, which
+// records each of its updates:
+//
+//	<old sha> <new sha> <ident>\t<message>
+type reflogEntry struct {
+	old     string
+	new     string
+	ident   string
+	message string
+}
+
+// time is when the update was made, as a Unix timestamp.
+func (e reflogEntry) time() int64 {
+	_, _, when := parseIdent(e.ident)
+	return when.Unix()
+}
+
+// readReflog returns the reflog of a ref, oldest first like in the file.
+func readReflog(ref string) ([]reflogEntry, error) {
+	content, err := os.ReadFile(gitPath("logs/" + ref))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []reflogEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		header, message, _ := strings.Cut(line, "\t")
+		fields := strings.SplitN(header, " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		entries = append(entries, reflogEntry{old: fields[0], new: fields[1], ident: fields[2], message: message})
+	}
+	return entries, nil
+}
+
+// writeReflog replaces the reflog of a ref, through a lock file so that
+// readers see either the old or the new one.
+func writeReflog(ref string, entries []reflogEntry) error {
+	lock, err := AcquireLock(gitPath("logs/" + ref))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := fmt.Fprintf(lock, "%s %s %s\t%s\n", entry.old, entry.new, entry.ident, entry.message); err != nil {
+			lock.Rollback()
+			return err
+		}
+	}
+	return lock.Commit()
+}
+
+// appendReflog records an update of a ref at the end of its reflog, with
+// the committer as ident, unless core.logAllRefUpdates is false, which it
+// is by default in a bare repository. old is empty for a new ref.
+//
+// Like git, an unknown committer doesn't fail the update, see defaultIdent.
+func appendReflog(ref string, old string, new string, message string) error {
+	if !configBool("core.logAllRefUpdates", !bareRepository) {
+		return nil
+	}
+	ident, err := defaultIdent("COMMITTER")
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		old = nullSha
+	}
+
+	if err := os.MkdirAll(filepath.Dir(gitPath("logs/"+ref)), 0750); err != nil {
+		return err
+	}
+	entries, err := readReflog(ref)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeReflog(ref, append(entries, reflogEntry{old: old, new: new, ident: ident, message: message}))
+}
+
+// reflogRefs lists the refs that have a reflog, HEAD first.
+func reflogRefs() ([]string, error) {
+	var refs []string
+	if _, err := os.Stat(gitPath("logs/HEAD")); err == nil {
+		refs = append(refs, "HEAD")
+	}
+
+	dir := filepath.Join(commonDir, "logs")
+	err := filepath.WalkDir(filepath.Join(dir, "refs"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, ".lock") {
+			return err
+		}
+		refs = append(refs, filepath.ToSlash(strings.TrimPrefix(path, dir+"/")))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// parseExpiry parses the date of --expire and --expire-unreachable, see
+// parseGitDate, as a Unix timestamp: the entries before it expire. never
+// keeps them all and all, or now, expires them all.
+func parseExpiry(value string) (int64, error) {
+	switch value {
+	case "never", "false":
+		return 0, nil
+	case "all", "now":
+		return math.MaxInt64, nil
+	}
+	when, err := parseGitDate(value)
+	if err != nil {
+		return 0, err
+	}
+	return when.Unix(), nil
+}
+
+// expireReflog drops the entries of the reflog of a ref that are older than
+// expire, and the ones older than expireUnreachable for a commit that isn't
+// in the history of the ref anymore, eg: one that was amended. For HEAD,
+// any ref counts.
+func expireReflog(ref string, expire int64, expireUnreachable int64) error {
+	entries, err := readReflog(ref)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// like git, when the ref points nowhere, no commit is reachable
+	tip, err := readRef(ref)
+	always := err != nil || expireUnreachable <= expire
+
+	var reachable map[string]bool
+	unreachable := func(sha string) (bool, error) {
+		if sha == nullSha {
+			return false, nil
+		}
+		if reachable == nil {
+			starts := []string{tip}
+			if ref == "HEAD" {
+				refs, err := listRefs()
+				if err != nil {
+					return false, err
+				}
+				for _, r := range refs {
+					starts = append(starts, r.sha)
+				}
+			}
+			reachable = map[string]bool{}
+			err := walkCommits(starts, func(node *commitNode) bool {
+				reachable[node.sha] = true
+				return true
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+		return !reachable[sha], nil
+	}
+
+	var kept []reflogEntry
+	for _, entry := range entries {
+		when := entry.time()
+		if when < expire {
+			continue
+		}
+		if when < expireUnreachable {
+			if always {
+				continue
+			}
+			oldGone, err := unreachable(entry.old)
+			if err != nil {
+				return err
+			}
+			newGone, err := unreachable(entry.new)
+			if err != nil {
+				return err
+			}
+			if oldGone || newGone {
+				continue
+			}
+		}
+		kept = append(kept, entry)
+	}
+
+	if len(kept) == len(entries) {
+		return nil
+	}
+	return writeReflog(ref, kept)
+}
+
+// reflogExpiries parses the dates of --expire and --expire-unreachable,
+// see parseExpiry. When not given, they are gc.reflogExpire and
+// gc.reflogExpireUnreachable, or 90 and 30 days ago.
+func reflogExpiries(expire string, expireUnreachable string) (int64, int64, error) {
+	dates := []struct {
+		value, option, key, fallback string
+		parsed                       int64
+	}{
+		{expire, "--expire", "gc.reflogExpire", "90.days.ago", 0},
+		{expireUnreachable, "--expire-unreachable", "gc.reflogExpireUnreachable", "30.days.ago", 0},
+	}
+	for i, date := range dates {
+		value := date.value
+		if value == "" {
+			var ok bool
+			if value, ok = configGet(date.key); !ok {
+				value = date.fallback
+			}
+		}
+		parsed, err := parseExpiry(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid timestamp '%s' given to '%s'", value, date.option)
+		}
+		dates[i].parsed = parsed
+	}
+	return dates[0].parsed, dates[1].parsed, nil
+}
+
+// expireReflogs expires the reflogs of all refs at the default dates, see
+// reflogExpiries, the way `git reflog expire --all` does.
+func expireReflogs() error {
+	expire, expireUnreachable, err := reflogExpiries("", "")
+	if err != nil {
+		return err
+	}
+	refs, err := reflogRefs()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := expireReflog(ref, expire, expireUnreachable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteReflogEntry deletes the n-th entry of the reflog of a ref, counting
+// from the newest, <ref>@{0}. The entries before it are renumbered.
+func deleteReflogEntry(ref string, n int) error {
+	entries, err := readReflog(ref)
+	if err != nil {
+		return err
+	}
+	if n >= len(entries) {
+		return nil
+	}
+	i := len(entries) - 1 - n
+	return writeReflog(ref, append(entries[:i:i], entries[i+1:]...))
+}
+
+// reflog implements `git reflog expire [--expire=<date>] [--expire-unreachable=<date>] (--all | <ref>...)`
+// and `git reflog delete <ref>@{<n>}...`
+//
+// The reflog of a ref records its updates, see reflogEntry. expire prunes
+// the old entries, see expireReflog: the ones older than --expire, and
+// sooner, the ones older than --expire-unreachable whose commits were left
+// behind, see reflogExpiries for their defaults.
+//
+// delete drops single entries, the newest being <ref>@{0}:
+//
+//	$ git reflog delete HEAD@{1}
+//
+// Several entries of a reflog are deleted one after the other, with the
+// entries renumbered each time. Only git writes reflogs, mygit can only
+// trim them.
+func reflog(args []string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git reflog expire [--expire=<date>] [--expire-unreachable=<date>] [--all] <ref>...")
+		fmt.Fprintln(os.Stderr, "   or: git reflog delete <ref>@{<n>}...")
+		os.Exit(129)
+	}
+	subcommand, args := args[0], args[1:]
+
+	flag := flag.NewFlagSet("git reflog "+subcommand, flag.ExitOnError)
+	var (
+		all               = flag.Bool("all", false, "expire the reflogs of all refs")
+		expire            = flag.String("expire", "", "expire the entries older than `<date>`")
+		expireUnreachable = flag.String("expire-unreachable", "", "expire the entries older than `<date>` whose commits were left behind")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	switch subcommand {
+	case "expire":
+		expire, expireUnreachable, err := reflogExpiries(*expire, *expireUnreachable)
+		if err != nil {
+			error := fmt.Sprintf("fatal: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(128)
+		}
+
+		refs := args
+		if *all {
+			if refs, err = reflogRefs(); err != nil {
+				fail(fmt.Errorf("fatal: %s", err))
+			}
+		}
+		status := 0
+		for _, name := range refs {
+			ref, err := expandRefName(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s points nowhere!\n", name)
+				status = 1
+				continue
+			}
+			if err := expireReflog(ref, expire, expireUnreachable); err != nil {
+				fail(fmt.Errorf("error: %s", err))
+			}
+		}
+		os.Exit(status)
+
+	case "delete":
+		if len(args) == 0 {
+			fail(fmt.Errorf("error: no reflog specified to delete"))
+		}
+		status := 0
+		for _, spec := range args {
+			name, index, found := strings.Cut(spec, "@{")
+			n, err := strconv.Atoi(strings.TrimSuffix(index, "}"))
+			if !found || !strings.HasSuffix(index, "}") || err != nil || n < 0 {
+				fmt.Fprintf(os.Stderr, "error: not a reflog: %s\n", spec)
+				status = 1
+				continue
+			}
+
+			ref, err := expandRefName(name)
+			if err == nil {
+				err = deleteReflogEntry(ref, n)
+			}
+			if err != nil {
+				if os.IsNotExist(err) || ref == "" {
+					fmt.Fprintf(os.Stderr, "error: no reflog for '%s'\n", spec)
+					status = 1
+					continue
+				}
+				fail(fmt.Errorf("error: %s", err))
+			}
+		}
+		os.Exit(status)
+
+	default:
+		fail(fmt.Errorf("fatal: unknown subcommand: %s", subcommand))
+	}
+}
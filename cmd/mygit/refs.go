@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isObjectName reports whether name is a full 40-character hex SHA-1.
+func isObjectName(name string) bool {
+	if len(name) != 40 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// readRef reads a single ref, eg: HEAD or refs/heads/main, and follows
+// symbolic refs (`ref: refs/heads/main`) until it reaches an object name.
+//
+// Loose refs in .git/ win over the ones listed in .git/packed-refs.
+func readRef(name string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		content, err := os.ReadFile(gitPath(name))
+		if os.IsNotExist(err) {
+			return readPackedRef(name)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		value := strings.TrimSpace(string(content))
+		target, symbolic := strings.CutPrefix(value, "ref: ")
+		if !symbolic {
+			return value, nil
+		}
+		name = target
+	}
+
+	return "", fmt.Errorf("symbolic ref '%s' nests too deep", name)
+}
+
+// readSymbolicRef reads what a symbolic ref, eg: HEAD, points to, like
+// refs/heads/main. It returns false when the ref holds an object name
+// instead, as a detached HEAD does, or isn't a loose ref at all.
+func readSymbolicRef(name string) (string, bool, error) {
+	content, err := os.ReadFile(gitPath(name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	target, symbolic := strings.CutPrefix(strings.TrimSpace(string(content)), "ref: ")
+	return target, symbolic, nil
+}
+
+// readPackedRef looks up a ref in .git/packed-refs.
+//
+// Each line is `<sha> <refname>`, comments start with '#' and peeled tags
+// are listed on a following `^<sha>` line.
+func readPackedRef(name string) (string, error) {
+	file, err := os.Open(gitPath("packed-refs"))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("ref '%s' not found", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		sha, refname, found := strings.Cut(scanner.Text(), " ")
+		if found && refname == name {
+			if !isObjectName(sha) {
+				return "", fmt.Errorf("unexpected line in packed-refs: %s", scanner.Text())
+			}
+			return sha, nil
+		}
+	}
+
+	return "", fmt.Errorf("ref '%s' not found", name)
+}
+
+// updateRef points a ref, eg: refs/heads/main, at an object by writing the
+// loose ref file. A loose ref shadows the same ref in .git/packed-refs.
+//
+// The ref is locked while it's written, see AcquireLock.
+func updateRef(name string, sha string) error {
+	return writeRef(name, sha, nil)
+}
+
+// updateRefIf is updateRef as a compare-and-swap: the ref is only updated
+// when it still points at old, or doesn't exist when old is empty, see
+// checkRef. The check is made once the ref is locked, so no other update
+// can come in between.
+func updateRefIf(name string, sha string, old string) error {
+	return writeRef(name, sha, func() error { return checkRef(name, old) })
+}
+
+// checkRef fails unless a ref points at old, or doesn't exist when old is
+// empty, with the messages of git.
+func checkRef(name string, old string) error {
+	current, err := readRef(name)
+	switch {
+	case err != nil && old == "":
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to resolve reference '%s'", name)
+	case old == "":
+		return fmt.Errorf("reference already exists")
+	case current != old:
+		return fmt.Errorf("is at %s but expected %s", current, old)
+	}
+	return nil
+}
+
+// writeRef writes a ref for updateRef and updateRefIf, once check, if any,
+// passes with the ref locked.
+func writeRef(name string, sha string, check func() error) error {
+	path := gitPath(name)
+
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+
+	trace("update ref %s %s", name, sha)
+	lock, err := AcquireLock(path)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			lock.Rollback()
+			return err
+		}
+	}
+	if _, err := lock.Write([]byte(sha + "\n")); err != nil {
+		lock.Rollback()
+		return err
+	}
+	return lock.Commit()
+}
+
+// updateSymbolicRef points a symbolic ref, eg: HEAD, at another ref, like
+// refs/heads/main, locking it like updateRef does.
+func updateSymbolicRef(name string, target string) error {
+	trace("update symbolic ref %s %s", name, target)
+	lock, err := AcquireLock(gitPath(name))
+	if err != nil {
+		return err
+	}
+	if _, err := lock.Write([]byte("ref: " + target + "\n")); err != nil {
+		lock.Rollback()
+		return err
+	}
+	return lock.Commit()
+}
+
+// deleteRef removes a ref, both the loose ref file and its entry in
+// .git/packed-refs, with the peeled line that may follow it. Both the ref
+// and packed-refs are locked meanwhile.
+func deleteRef(name string) error {
+	return removeRef(name, nil)
+}
+
+// deleteRefIf is deleteRef as a compare-and-swap, like updateRefIf: the
+// ref is only deleted when it still points at old.
+func deleteRefIf(name string, old string) error {
+	return removeRef(name, func() error { return checkRef(name, old) })
+}
+
+// removeRef deletes a ref for deleteRef and deleteRefIf, once check, if
+// any, passes with the ref locked.
+func removeRef(name string, check func() error) error {
+	trace("delete ref %s", name)
+	path := gitPath(name)
+	lock, err := AcquireLock(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	if err := deletePackedRef(name); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deletePackedRef rewrites .git/packed-refs without a ref.
+func deletePackedRef(name string) error {
+	packedRefs := gitPath("packed-refs")
+	if _, err := os.Stat(packedRefs); os.IsNotExist(err) {
+		return nil
+	}
+
+	lock, err := AcquireLock(packedRefs)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(packedRefs)
+	if err != nil {
+		lock.Rollback()
+		return err
+	}
+
+	var kept []string
+	deleted, found := false, false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if deleted && strings.HasPrefix(line, "^") {
+			continue
+		}
+		_, refname, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		deleted = refname == name
+		if deleted {
+			found = true
+		} else {
+			kept = append(kept, line)
+		}
+	}
+	if !found {
+		return lock.Rollback()
+	}
+
+	if _, err := lock.Write([]byte(strings.Join(kept, ""))); err != nil {
+		lock.Rollback()
+		return err
+	}
+	return lock.Commit()
+}
+
+// ref is a single entry of the ref namespace.
+type ref struct {
+	name string
+	sha  string
+}
+
+// listRefs enumerates all refs under refs/, both the loose ones in .git/refs
+// and the ones in .git/packed-refs, sorted by name.
+//
+// A loose ref shadows a packed ref with the same name.
+func listRefs() ([]ref, error) {
+	shas := map[string]string{}
+
+	content, err := os.ReadFile(gitPath("packed-refs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if !ok || !isObjectName(sha) {
+			return nil, fmt.Errorf("unexpected line in packed-refs: %s", line)
+		}
+		shas[name] = sha
+	}
+
+	err = filepath.WalkDir(filepath.Join(commonDir, "refs"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		name := filepath.ToSlash(strings.TrimPrefix(path, commonDir+"/"))
+		if strings.HasSuffix(name, ".lock") {
+			// a ref being updated, see AcquireLock
+			return nil
+		}
+		sha, err := readRef(name)
+		if err != nil {
+			return err
+		}
+		shas[name] = sha
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	refs := make([]ref, 0, len(shas))
+	for name, sha := range shas {
+		refs = append(refs, ref{name: name, sha: sha})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].name < refs[j].name })
+
+	return refs, nil
+}
+
+// shortRefName strips the well-known prefixes off a ref name, eg:
+// refs/heads/main becomes main. Other refs keep their full name, eg:
+// refs/stash.
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if short, found := strings.CutPrefix(name, prefix); found {
+			return short
+		}
+	}
+	return name
+}
+
+// expandRefName finds the full name of a ref the user typed, eg: main becomes
+// refs/heads/main. It looks at the name itself, then in refs/, refs/tags/ and
+// refs/heads/.
+func expandRefName(name string) (string, error) {
+	candidates := []string{name}
+	if !strings.HasPrefix(name, "refs/") && name != "HEAD" {
+		candidates = append(candidates, "refs/"+name, "refs/tags/"+name, "refs/heads/"+name)
+	}
+
+	for _, candidate := range candidates {
+		if _, err := readRef(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown ref '%s'", name)
+}
+
+// resolveRevision turns what the user typed into an object name.
+//
+// It accepts, in this order:
+//   - a full 40-character SHA-1
+//   - HEAD or a full ref name (refs/heads/main)
+//   - a short name that is looked up in refs/, refs/tags/ and refs/heads/
+//   - <revision>:<path>, the object at path in the tree of a revision
+//   - <revision>^{<type>}, the revision peeled to an object of that type,
+//     see peelRevision
+func resolveRevision(name string) (string, error) {
+	if isObjectName(name) {
+		return name, nil
+	}
+
+	if revision, path, found := strings.Cut(name, ":"); found && revision != "" {
+		return resolveTreePath(revision, path)
+	}
+
+	if open := strings.LastIndex(name, "^{"); open > 0 && strings.HasSuffix(name, "}") {
+		sha, err := resolveRevision(name[:open])
+		if err != nil {
+			return "", err
+		}
+		sha, err = peelRevision(sha, name[open+2:len(name)-1])
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", name, err)
+		}
+		return sha, nil
+	}
+
+	if ref, err := expandRefName(name); err == nil {
+		return readRef(ref)
+	}
+
+	return "", fmt.Errorf("unknown revision '%s'", name)
+}
+
+// peelRevision peels an object to the given type, the way git does for
+// <revision>^{<type>}:
+//
+//	v1.0^{}          the object the tag points to, through chained tags
+//	v1.0^{commit}    the commit, following tags
+//	main^{tree}      the tree of the commit, following tags
+//	v1.0^{tag}       the tag itself, which must be one
+//	sha^{object}     the object, which must exist
+func peelRevision(sha string, objectType string) (string, error) {
+	switch objectType {
+	case "object", "tag":
+		actual, _, err := readObject(sha)
+		if err != nil {
+			return "", err
+		}
+		if objectType == "tag" && actual != "tag" {
+			return "", fmt.Errorf("expected tag type, but the object is a %s", actual)
+		}
+		return sha, nil
+
+	case "":
+		peeled, _, err := peelTag(sha)
+		return peeled, err
+
+	case "commit", "tree", "blob":
+		peeled, actual, err := peelTag(sha)
+		if err != nil {
+			return "", err
+		}
+		if actual == "commit" && objectType == "tree" {
+			c, err := readCommit(peeled)
+			if err != nil {
+				return "", err
+			}
+			return c.tree, nil
+		}
+		if actual != objectType {
+			return "", fmt.Errorf("expected %s type, but the object dereferences to %s type", objectType, actual)
+		}
+		return peeled, nil
+	}
+	return "", fmt.Errorf("unknown object type '%s'", objectType)
+}
+
+// resolveTreePath finds the object at path in the tree of a revision, which
+// can be a commit, a tree or a tag of either. An empty path is the tree.
+func resolveTreePath(revision string, path string) (string, error) {
+	sha, err := resolveRevision(revision)
+	if err != nil {
+		return "", err
+	}
+	sha, objectType, err := peelTag(sha)
+	if err != nil {
+		return "", err
+	}
+
+	tree := sha
+	switch objectType {
+	case "commit":
+		c, err := readCommit(sha)
+		if err != nil {
+			return "", err
+		}
+		tree = c.tree
+	case "tree":
+	default:
+		return "", fmt.Errorf("'%s' is a %s, not a tree", revision, objectType)
+	}
+
+	path = cleanPath(path)
+	if path == "" {
+		return tree, nil
+	}
+	entry, found, err := lookupTreePath(tree, path)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("path '%s' does not exist in '%s'", path, revision)
+	}
+	return entry.sha, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdateRefIfConcurrent(t *testing.T) {
+	testRepository(t)
+	const name = "refs/heads/main"
+	const updaters = 20
+	initial := fmt.Sprintf("%040x", 0)
+	if err := updateRef(name, initial); err != nil {
+		t.Fatal(err)
+	}
+
+	// each updater moves the ref from the value it read to its own, trying
+	// again until no one else got in between
+	var mu sync.Mutex
+	next := map[string]string{}
+	var wg sync.WaitGroup
+	for i := 1; i <= updaters; i++ {
+		wg.Add(1)
+		go func(sha string) {
+			defer wg.Done()
+			for {
+				old, err := readRef(name)
+				if err != nil {
+					// only while the lock file is renamed over the ref
+					runtime.Gosched()
+					continue
+				}
+				if err := updateRefIf(name, sha, old); err != nil {
+					runtime.Gosched()
+					continue
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if previous, ok := next[old]; ok {
+					t.Errorf("%s was updated to both %s and %s", old, previous, sha)
+				}
+				next[old] = sha
+				return
+			}
+		}(fmt.Sprintf("%040x", i))
+	}
+	wg.Wait()
+
+	// the updates make a single chain, none was lost
+	sha, seen := initial, 0
+	for {
+		following, ok := next[sha]
+		if !ok {
+			break
+		}
+		sha, seen = following, seen+1
+	}
+	if seen != updaters {
+		t.Errorf("the chain of updates has %d of them, expected %d", seen, updaters)
+	}
+	content, err := os.ReadFile(gitPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != sha+"\n" {
+		t.Errorf("the ref holds %q, expected the last update, %s", content, sha)
+	}
+	if fileExists(gitPath(name) + ".lock") {
+		t.Error("a lock file was left behind")
+	}
+}
+
+func TestUpdateRefIfLocked(t *testing.T) {
+	testRepository(t)
+	const name = "refs/heads/main"
+	old := fmt.Sprintf("%040x", 1)
+	if err := updateRef(name, old); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := AcquireLock(gitPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateRefIf(name, fmt.Sprintf("%040x", 2), old); err == nil {
+		t.Error("a ref another updater holds the lock of was updated")
+	}
+	lock.Rollback()
+
+	if err := updateRefIf(name, fmt.Sprintf("%040x", 2), old); err != nil {
+		t.Errorf("the ref can't be updated once the lock is released: %s", err)
+	}
+}
+
+func TestUpdateRefIfMismatch(t *testing.T) {
+	testRepository(t)
+	current := fmt.Sprintf("%040x", 1)
+	other := fmt.Sprintf("%040x", 2)
+	if err := updateRef("refs/heads/main", current); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, old, err string
+	}{
+		{"refs/heads/main", other, "is at " + current + " but expected " + other},
+		{"refs/heads/main", "", "reference already exists"},
+		{"refs/heads/missing", current, "unable to resolve reference 'refs/heads/missing'"},
+	}
+	for _, test := range tests {
+		err := updateRefIf(test.name, other, test.old)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("updateRefIf(%s, %s) failed with %v, expected %q", test.name, test.old, err, test.err)
+		}
+		err = deleteRefIf(test.name, test.old)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("deleteRefIf(%s, %s) failed with %v, expected %q", test.name, test.old, err, test.err)
+		}
+	}
+
+	// nothing was changed, and nothing is left locked
+	if sha, err := readRef("refs/heads/main"); err != nil || sha != current {
+		t.Errorf("refs/heads/main is %s (%v) after rejected updates, expected %s", sha, err, current)
+	}
+	if fileExists(gitPath("refs/heads/missing")) {
+		t.Error("a rejected update created refs/heads/missing")
+	}
+	if fileExists(gitPath("refs/heads/main") + ".lock") {
+		t.Error("a rejected update left the ref locked")
+	}
+}
+
+func TestDetachedHead(t *testing.T) {
+	testRepository(t)
+	first := writeTestCommit(t, "first")
+	second := writeTestCommit(t, "second", first)
+	third := writeTestCommit(t, "third", second)
+	if err := updateRef("refs/heads/main", third); err != nil {
+		t.Fatal(err)
+	}
+	// HEAD holds the sha itself, away from the branch
+	if err := os.WriteFile(".git/HEAD", []byte(second+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command func([]string)
+		args    []string
+		want    string
+	}{
+		{revParse, []string{"HEAD"}, second + "\n"},
+		{revParse, []string{"main"}, third + "\n"},
+		{revParse, []string{"--abbrev-ref", "HEAD"}, "HEAD\n"},
+		{logCmd, []string{"--format=%H %s"}, second + " second\n" + first + " first\n"},
+		{logCmd, []string{"--format=%s", "HEAD"}, "second\nfirst\n"},
+	}
+	for _, test := range tests {
+		if got := captureStdout(t, func() { test.command(test.args) }); got != test.want {
+			t.Errorf("with a detached HEAD, %v printed\n%s\nexpected\n%s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestReflogWithoutIdentity(t *testing.T) {
+	testRepository(t)
+	for _, env := range []string{"GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		os.Unsetenv(env)
+	}
+	if _, err := makeIdent("COMMITTER"); err == nil {
+		t.Fatal("makeIdent succeeded without an identity")
+	}
+
+	// like git, the update is logged with the ident it falls back to
+	sha := writeTestCommit(t, "c")
+	if err := appendReflog("refs/heads/main", "", sha, "branch: Created from HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readReflog("refs/heads/main")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("read the reflog as %v (%v)", entries, err)
+	}
+	if name, email, _ := parseIdent(entries[0].ident); name == "" || !strings.Contains(email, "@") {
+		t.Errorf("the reflog was written with %q", entries[0].ident)
+	}
+}
+
+func TestFormatRef(t *testing.T) {
+	testRepository(t)
+	sha := writeTestCommit(t, "first line\nof the subject\n\nbody\n")
+	parts, err := parseFormat("%(refname:short) %(objectname:short) %(subject)", refAtoms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"refs/heads/main":    "main " + sha[:7] + " first line of the subject",
+		"refs/stash":         "refs/stash " + sha[:7] + " first line of the subject",
+		"refs/notes/commits": "refs/notes/commits " + sha[:7] + " first line of the subject",
+	} {
+		if got, err := formatRef(parts, ref{name: name, sha: sha}); err != nil || got != want {
+			t.Errorf("formatRef of %s = %q, %v, expected %q", name, got, err, want)
+		}
+	}
+
+	if err := os.WriteFile(gitPath("packed-refs"), []byte("abc refs/heads/broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listRefs(); err == nil {
+		t.Error("listRefs read a packed ref with a malformed object name")
+	}
+}
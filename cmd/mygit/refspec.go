@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// refspec maps the refs of one repository to the refs of another, those of
+// a remote to ours for fetch, ours to the remote's for push:
+//
+//	+refs/heads/*:refs/remotes/origin/*
+//
+// A leading + allows updates that aren't fast-forwards. A * in the source
+// matches any part of a name, and that part replaces the * of the
+// destination. Without a destination, nothing is updated: fetch only
+// records the refs in FETCH_HEAD.
+type refspec struct {
+	force    bool
+	src, dst string
+}
+
+// parseRefspec parses a refspec. Only one * is allowed on each side, and
+// both sides have one or neither does.
+func parseRefspec(spec string) (refspec, error) {
+	var r refspec
+	rest, force := strings.CutPrefix(spec, "+")
+	r.force = force
+	r.src, r.dst, _ = strings.Cut(rest, ":")
+
+	srcGlobs, dstGlobs := strings.Count(r.src, "*"), strings.Count(r.dst, "*")
+	if srcGlobs > 1 || dstGlobs > 1 || r.dst != "" && srcGlobs != dstGlobs || r.src == "" && r.dst == "" {
+		return r, fmt.Errorf("invalid refspec '%s'", spec)
+	}
+	return r, nil
+}
+
+// isGlob tells whether the refspec maps a set of refs.
+func (r refspec) isGlob() bool {
+	return strings.Contains(r.src, "*")
+}
+
+// match tells whether a ref of the source side matches the refspec, and
+// returns its name on the destination side, if any. A source without a *
+// matches the ref it names, in full or short, eg: main matches
+// refs/heads/main, see expandRefName.
+func (r refspec) match(name string) (string, bool) {
+	if !r.isGlob() {
+		for _, prefix := range []string{"", "refs/", "refs/tags/", "refs/heads/", "refs/remotes/"} {
+			if name == prefix+r.src {
+				return r.expandDst(name), true
+			}
+		}
+		return "", false
+	}
+
+	prefix, suffix, _ := strings.Cut(r.src, "*")
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	matched := name[len(prefix) : len(name)-len(suffix)]
+	return strings.Replace(r.dst, "*", matched, 1), true
+}
+
+// expandDst returns the full name of the destination of a ref matched,
+// like git: a short destination is a branch, or a tag when the ref is one.
+func (r refspec) expandDst(name string) string {
+	if r.dst == "" || strings.HasPrefix(r.dst, "refs/") || r.dst == "HEAD" {
+		return r.dst
+	}
+	if strings.HasPrefix(name, "refs/tags/") {
+		return "refs/tags/" + r.dst
+	}
+	return "refs/heads/" + r.dst
+}
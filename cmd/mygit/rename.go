@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxScore is what a similarity score of 100% is, like git: scores are
+// kept as fractions of it so that thresholds such as -M33% compare exactly.
+const maxScore = 60000
+
+// defaultRenameScore is the similarity above which a deleted and an added
+// file are a rename when no threshold is given, 50%.
+const defaultRenameScore = maxScore / 2
+
+// parseRenameScore parses the value of -M<n>, the way git does: a
+// percentage when it ends with %, eg: 75%, otherwise the digits of a
+// fraction, so that 5 and 50 both mean 50%, or a decimal, eg: 0.5.
+func parseRenameScore(value string) (int, error) {
+	if value == "" {
+		return defaultRenameScore, nil
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		n, err := strconv.ParseFloat(percent, 64)
+		if err != nil || n < 0 || n > 100 {
+			return 0, fmt.Errorf("invalid rename score '%s'", value)
+		}
+		return int(n * maxScore / 100), nil
+	}
+	if !strings.Contains(value, ".") {
+		value = "0." + value
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 || n > 1 {
+		return 0, fmt.Errorf("invalid rename score '%s'", value)
+	}
+	return int(n * maxScore), nil
+}
+
+// cutRenameScore takes -M<n> and --find-renames[=<n>] out of args, since
+// the flag package can't parse a value glued to a short flag, eg: -M75%.
+// It returns the other args, the value of the last one, see
+// parseRenameScore, and whether one was given.
+func cutRenameScore(args []string) ([]string, string, bool) {
+	var rest []string
+	value, given := "", false
+	for _, arg := range args {
+		score, isScore := strings.CutPrefix(arg, "-M")
+		if !isScore {
+			score, isScore = strings.CutPrefix(arg, "--find-renames")
+			if isScore && score != "" && !strings.HasPrefix(score, "=") {
+				isScore = false
+			}
+			score = strings.TrimPrefix(score, "=")
+		}
+		if !isScore {
+			rest = append(rest, arg)
+			continue
+		}
+		value, given = score, true
+	}
+	return rest, value, given
+}
+
+// similarityChunks splits content the way git does to compare files: into
+// lines, or 64 bytes of a longer line, and counts the bytes of each chunk.
+// The CR of a CRLF doesn't count in text, so that changing the line endings
+// of a file keeps it similar.
+func similarityChunks(content []byte) map[string]int {
+	text := !isBinary(content)
+	chunks := map[string]int{}
+	var chunk []byte
+	for i, c := range content {
+		if text && c == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+			continue
+		}
+		chunk = append(chunk, c)
+		if c == '\n' || len(chunk) == 64 {
+			chunks[string(chunk)] += len(chunk)
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 {
+		chunks[string(chunk)] += len(chunk)
+	}
+	return chunks
+}
+
+// similarity scores how much of b was copied from a, out of maxScore: the
+// bytes of the chunks both have, see similarityChunks, against the size of
+// the larger one. Like git, files whose sizes are too different to reach
+// minimum are scored 0 without being compared.
+func similarity(a []byte, b []byte, minimum int) int {
+	base, largest := min(len(a), len(b)), max(len(a), len(b))
+	if largest == 0 {
+		return maxScore
+	}
+	if base*maxScore < (largest-base)*minimum {
+		return 0
+	}
+
+	chunksB := similarityChunks(b)
+	copied := 0
+	for chunk, count := range similarityChunks(a) {
+		copied += min(count, chunksB[chunk])
+	}
+	return copied * maxScore / largest
+}
+
+// detectRenames pairs the deleted files of changes with the added ones
+// whose content is at least minimum similar, see similarity, and returns
+// the changes with each pair made into a single R change from the deleted
+// path. Identical contents are paired first, then the most similar pairs
+// win, each file being part of one rename at most. Only the added paths
+// accepted by isTarget are looked for, all of them when it's nil. Like
+// git, trees, when not compared recursively, are never renamed.
+func detectRenames(changes []treeChange, minimum int, opts *diffOptions, isTarget func(string) bool) ([]treeChange, error) {
+	var sources, targets []int
+	for i, change := range changes {
+		switch {
+		case change.status == 'D' && change.old.mode != modeSubmodule && !change.old.isTree():
+			sources = append(sources, i)
+		case change.status == 'A' && change.new.mode != modeSubmodule && !change.new.isTree() && (isTarget == nil || isTarget(change.path)):
+			targets = append(targets, i)
+		}
+	}
+	if len(sources) == 0 || len(targets) == 0 {
+		return changes, nil
+	}
+
+	type candidate struct {
+		source, target int
+		score          int
+		sameName       bool
+	}
+	var candidates []candidate
+	contents := map[string][]byte{}
+	read := func(sha string) ([]byte, error) {
+		if content, ok := contents[sha]; ok {
+			return content, nil
+		}
+		content, err := opts.readBlob(sha)
+		contents[sha] = content
+		return content, err
+	}
+	for _, target := range targets {
+		for _, source := range sources {
+			old, new := changes[source].old, changes[target].new
+			sameName := path.Base(changes[source].path) == path.Base(changes[target].path)
+			if old.sha == new.sha {
+				candidates = append(candidates, candidate{source, target, maxScore, sameName})
+				continue
+			}
+			// like git, a file isn't renamed into a symlink or the reverse
+			if modeKind(old.mode) != modeKind(new.mode) {
+				continue
+			}
+			a, err := read(old.sha)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(new.sha)
+			if err != nil {
+				return nil, err
+			}
+			if score := similarity(a, b, minimum); score >= minimum {
+				candidates = append(candidates, candidate{source, target, score, sameName})
+			}
+		}
+	}
+	// on a tie, a file keeping its name in another directory wins
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].sameName && !candidates[j].sameName
+	})
+
+	renamed := map[int]bool{}
+	renames := map[int]treeChange{}
+	for _, c := range candidates {
+		if renamed[c.source] || renamed[c.target] {
+			continue
+		}
+		renamed[c.source], renamed[c.target] = true, true
+		source, target := changes[c.source], changes[c.target]
+		renames[c.target] = treeChange{
+			status:  'R',
+			path:    target.path,
+			oldPath: source.path,
+			old:     source.old,
+			new:     target.new,
+			score:   c.score,
+		}
+	}
+
+	var result []treeChange
+	for i, change := range changes {
+		if rename, ok := renames[i]; ok {
+			result = append(result, rename)
+		} else if !renamed[i] {
+			result = append(result, change)
+		}
+	}
+	return result, nil
+}
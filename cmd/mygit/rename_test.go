@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testRenameChanges deletes the files of before and adds those of after,
+// the changes of a diff before rename detection, the contents written as
+// blobs.
+func testRenameChanges(t *testing.T, before map[string]string, after map[string]string) []treeChange {
+	t.Helper()
+	var changes []treeChange
+	for _, files := range []struct {
+		status  byte
+		content map[string]string
+	}{{'D', before}, {'A', after}} {
+		for path, content := range files.content {
+			sha, err := writeObject("blob", []byte(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			change := treeChange{status: files.status, path: path}
+			entry := treeEntry{mode: "100644", name: path, sha: sha}
+			if files.status == 'D' {
+				change.old = entry
+			} else {
+				change.new = entry
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// testRenameStatuses detects the renames of changes and returns them the
+// way --name-status prints them, sorted.
+func testRenameStatuses(t *testing.T, changes []treeChange, minimum int) []string {
+	t.Helper()
+	changes, err := detectRenames(changes, minimum, &diffOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, change := range changes {
+		statuses = append(statuses, formatStatus(change))
+	}
+	sort.Strings(statuses)
+	return statuses
+}
+
+func TestDetectExactRenames(t *testing.T) {
+	testRepository(t)
+	changes := testRenameChanges(t,
+		map[string]string{"same.txt": "moved as is\n", "gone.txt": "deleted\n"},
+		map[string]string{"moved/same.txt": "moved as is\n", "new.txt": "something else entirely\n"})
+
+	got := testRenameStatuses(t, changes, defaultRenameScore)
+	want := []string{"A\tnew.txt", "D\tgone.txt", "R100\tsame.txt\tmoved/same.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDetectNearRenames(t *testing.T) {
+	testRepository(t)
+	var lines []string
+	for i := 1; i <= 10; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+	before := strings.Join(lines, "")
+	after := strings.Replace(before, "line 5\n", "line five\n", 1)
+	changes := testRenameChanges(t, map[string]string{"a.txt": before}, map[string]string{"b.txt": after})
+
+	// 64 of the 74 bytes of b.txt come from a.txt, what git scores 86%
+	if got, want := testRenameStatuses(t, changes, defaultRenameScore), []string{"R086\ta.txt\tb.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// below the threshold, the files stay a deletion and an addition
+	minimum, err := parseRenameScore("90%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := testRenameStatuses(t, changes, minimum), []string{"A\tb.txt", "D\ta.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with -M90%%, got %q, want %q", got, want)
+	}
+}
+
+func TestDetectRenamesMostSimilarWins(t *testing.T) {
+	testRepository(t)
+	content := strings.Repeat("shared line\n", 8)
+	changes := testRenameChanges(t,
+		map[string]string{"old.txt": content + "first\n"},
+		map[string]string{"close.txt": content + "first!\n", "far.txt": content + "completely different ending\n"})
+
+	got := testRenameStatuses(t, changes, defaultRenameScore)
+	if len(got) != 2 || !strings.HasPrefix(got[1], "R") || !strings.HasSuffix(got[1], "\told.txt\tclose.txt") || got[0] != "A\tfar.txt" {
+		t.Errorf("got %q, want old.txt renamed to close.txt, and far.txt added", got)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeNewPack writes the objects as a new pack and its index in dir, and
+// returns the name of the pack, pack-<checksum>.pack. How the objects are
+// stored, as deltas or not, and compressed is up to the options, see
+// writePack.
+//
+// Both files are written to temporary files first and renamed in place, the
+// pack before its index, so the pack is never used before it's complete.
+// The index is read back and checked against the objects before that.
+func writeNewPack(dir string, shas []string, opts packOptions, progress io.Writer) (string, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	tmpPack := file.Name()
+	defer os.Remove(tmpPack)
+	stats, err := writePack(file, shas, opts, progress)
+	if err == nil && progress != nil {
+		fmt.Fprintln(progress, stats)
+	}
+	if err == nil {
+		err = syncObjectFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	pack, err := os.ReadFile(tmpPack)
+	if err != nil {
+		return "", err
+	}
+	entries, checksum, err := parsePack(pack, nil)
+	if err == nil {
+		err = resolvePackDeltas(entries, nil)
+	}
+	if err != nil {
+		return "", fmt.Errorf("new pack is corrupt: %s", err)
+	}
+
+	tmpIndex := filepath.Join(dir, strings.Replace(filepath.Base(tmpPack), "tmp_pack_", "tmp_idx_", 1))
+	defer os.Remove(tmpIndex)
+	if err := writePackIndex(tmpIndex, entries, checksum); err != nil {
+		return "", err
+	}
+
+	index, err := readPackIndex(tmpIndex)
+	if err != nil {
+		return "", fmt.Errorf("new pack index is corrupt: %s", err)
+	}
+	if index.count() != len(shas) {
+		return "", fmt.Errorf("new pack index has %d objects instead of %d", index.count(), len(shas))
+	}
+	for _, sha := range shas {
+		if _, ok := index.find(sha); !ok {
+			return "", fmt.Errorf("object %s is missing from the new pack index", sha)
+		}
+	}
+
+	name := "pack-" + hex.EncodeToString(checksum)
+	if err := os.Chmod(tmpPack, 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPack, filepath.Join(dir, name+".pack")); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpIndex, filepath.Join(dir, name+".idx")); err != nil {
+		return "", err
+	}
+	return name + ".pack", nil
+}
+
+// repackOptions are what repackObjects does, see repack.
+type repackOptions struct {
+	all   bool        // pack the objects of the existing packs too
+	prune bool        // delete the packs and loose objects repacked
+	local bool        // leave out the objects of alternate object directories
+	pack  packOptions // how the new pack is written
+}
+
+// repackObjects packs the loose objects, and the packed ones with all, into
+// a new pack, see repack. It returns the name of the pack, or "" when there
+// was nothing to pack.
+func repackObjects(opts repackOptions, progress io.Writer) (string, error) {
+	dir := gitPath(packDir)
+	packs := NewPackStore(dir)
+	if err := packs.load(); err != nil {
+		return "", err
+	}
+
+	// the objects of kept packs stay there
+	kept := map[string]bool{}
+	var repacked []*packFile
+	for _, p := range packs.packs {
+		if _, err := os.Stat(strings.TrimSuffix(p.path, ".pack") + ".keep"); err == nil {
+			for i := 0; i < p.index.count(); i++ {
+				kept[p.index.sha(i)] = true
+			}
+			continue
+		}
+		if opts.all {
+			repacked = append(repacked, p)
+		}
+	}
+
+	selected := map[string]bool{}
+	add := func(sha string) {
+		if !kept[sha] {
+			selected[sha] = true
+		}
+	}
+	loose := NewLooseStore(gitPath("objects"))
+	var looseShas []string
+	err := loose.Iterate(func(sha string) {
+		looseShas = append(looseShas, sha)
+		add(sha)
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, p := range repacked {
+		for i := 0; i < p.index.count(); i++ {
+			add(p.index.sha(i))
+		}
+	}
+	if opts.all && !opts.local {
+		if err := NewAlternatesStore(gitPath("objects")).Iterate(add); err != nil {
+			return "", err
+		}
+	}
+
+	if len(selected) == 0 {
+		return "", nil
+	}
+
+	var shas []string
+	for sha := range selected {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	p := startProgress(progress, "Enumerating objects", 0)
+	p.update(len(shas))
+	p.done()
+
+	name, err := writeNewPack(dir, shas, opts.pack, progress)
+	if err != nil {
+		return "", fmt.Errorf("failed to write the new pack: %s", err)
+	}
+	trace("repack: wrote %s with %d objects", name, len(shas))
+
+	if opts.prune {
+		for _, p := range repacked {
+			if p.name == name {
+				continue
+			}
+			// without its index, the pack isn't used anymore
+			base := strings.TrimSuffix(p.path, ".pack")
+			if err := os.Remove(base + ".idx"); err != nil {
+				return "", err
+			}
+			os.Remove(p.path)
+		}
+
+		for _, sha := range looseShas {
+			if !selected[sha] {
+				continue
+			}
+			path := loose.path(sha)
+			os.Remove(path)
+			// like git, the fan-out folder goes once empty
+			os.Remove(filepath.Dir(path))
+		}
+	}
+
+	midxPath := filepath.Join(dir, multiPackIndexFile)
+	if _, err := os.Stat(midxPath); err == nil {
+		midx, err := buildMultiPackIndex(dir)
+		if err == nil && midx == nil {
+			err = os.Remove(midxPath)
+		} else if err == nil {
+			err = os.WriteFile(midxPath, midx, 0644)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to update the multi-pack-index: %s", err)
+		}
+	}
+	return name, nil
+}
+
+// repack implements `git repack [-a] [-d] [-l] [-f] [-q] [--window=<n>] [--depth=<n>]`
+//
+// It packs the loose objects into a new pack. With -a, the objects of the
+// existing packs go into it too, so the repository ends up with a single
+// pack, and so do the objects of alternate object directories, unless -l
+// is given. A pack with a .keep file is left alone, and its objects aren't
+// packed again.
+//
+// Objects are stored as deltas of each other where that's smaller, see
+// findDeltas: the deltas of the existing packs are kept, unless -f is
+// given to compute them all again, and new ones are searched among
+// --window objects, in chains of --depth deltas at most, pack.window and
+// pack.depth by default.
+//
+// With -d, what became redundant is then deleted: the packs that were
+// repacked, and the loose objects now packed. That only happens once the
+// new pack is in place, see writeNewPack.
+//
+// A multi-pack-index is rewritten to cover the new packs.
+func repack(args []string) {
+	opts := repackOptions{pack: defaultPackOptions()}
+	flag := flag.NewFlagSet("git repack", flag.ExitOnError)
+	var (
+		all   = flag.Bool("a", false, "pack everything into a single pack")
+		prune = flag.Bool("d", false, "delete redundant packs and loose objects")
+		local = flag.Bool("l", false, "leave out the objects of alternate object directories")
+		force = flag.Bool("f", false, "compute the deltas again instead of reusing those of the packs")
+		quiet = flag.Bool("q", false, "don't report progress")
+	)
+	flag.IntVar(&opts.pack.window, "window", opts.pack.window, "search deltas among `<n>` objects")
+	flag.IntVar(&opts.pack.depth, "depth", opts.pack.depth, "make chains of `<n>` deltas at most")
+	flag.Parse(expandShortFlags(args, "adlfq"))
+
+	defer tracePerformance(time.Now(), "repack")
+
+	var progress io.Writer
+	if !*quiet && isTerminal(os.Stderr) {
+		progress = os.Stderr
+	}
+
+	opts.all, opts.prune, opts.local = *all, *prune, *local
+	opts.pack.reuse = !*force
+	name, err := repackObjects(opts, progress)
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+	if name == "" && !*quiet {
+		fmt.Println("Nothing new to pack.")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// noReplaceObjects is set by `git --no-replace-objects <command>`, or
+// GIT_NO_REPLACE_OBJECTS, to read objects as they are stored.
+var noReplaceObjects bool
+
+// replaceFreeCommands are the commands that never replace objects, like
+// git, since they copy or index objects as they are stored: a replacement
+// packed under the sha of the object it replaces would corrupt the pack.
+var replaceFreeCommands = map[string]bool{
+	"repack":           true,
+	"gc":               true,
+	"index-pack":       true,
+	"upload-pack":      true,
+	"receive-pack":     true,
+	"commit-graph":     true,
+	"multi-pack-index": true,
+}
+
+// maxReplaceDepth is how many replacements of replacements are followed,
+// like git, so that a cycle of them fails instead of looping.
+const maxReplaceDepth = 5
+
+// replaceRefs maps the objects that are replaced to their replacement, as
+// refs/replace/<sha> says, once read by replacements.
+var replaceRefs map[string]string
+
+// replacements returns the replace refs, read on the first call.
+func replacements() map[string]string {
+	if replaceRefs != nil {
+		return replaceRefs
+	}
+	replaceRefs = map[string]string{}
+	refs, err := listRefs()
+	if err != nil {
+		return replaceRefs
+	}
+	for _, r := range refs {
+		if sha, ok := strings.CutPrefix(r.name, "refs/replace/"); ok && isObjectName(sha) {
+			replaceRefs[sha] = r.sha
+		}
+	}
+	return replaceRefs
+}
+
+// replaceObject returns the sha of the object to read in place of sha: its
+// replacement, the replacement of that one, and so on, or sha itself when
+// it isn't replaced.
+func replaceObject(sha string) (string, error) {
+	if noReplaceObjects {
+		return sha, nil
+	}
+	replaced := sha
+	for depth := 0; ; depth++ {
+		replacement, ok := replacements()[replaced]
+		if !ok {
+			return replaced, nil
+		}
+		if depth == maxReplaceDepth {
+			return "", fmt.Errorf("replace depth too high for object %s", sha)
+		}
+		replaced = replacement
+	}
+}
+
+// exportObject returns the content of an object in a form to edit, see
+// editReplacement, the way `git cat-file -p` shows it: a tree is listed,
+// see writeTreeListing, and the other objects are as they are stored, a
+// commit with its tree, parent, author and committer lines, then its
+// message.
+func exportObject(objectType string, content []byte) ([]byte, error) {
+	if objectType != "tree" {
+		return content, nil
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return nil, err
+	}
+	var listing bytes.Buffer
+	writeTreeListing(&listing, entries)
+	return listing.Bytes(), nil
+}
+
+// importObject turns what exportObject returned, once edited, back into
+// the content of an object, checking that it is well-formed.
+func importObject(objectType string, edited []byte) ([]byte, error) {
+	switch objectType {
+	case "commit":
+		if _, err := parseCommit(edited); err != nil {
+			return nil, fmt.Errorf("corrupt commit")
+		}
+		return edited, nil
+	case "tree":
+		var entries []treeEntry
+		for _, line := range strings.Split(strings.TrimSuffix(string(edited), "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			header, name, _ := strings.Cut(line, "\t")
+			fields := strings.Fields(header)
+			if len(fields) != 3 || name == "" || !isObjectName(fields[2]) {
+				return nil, fmt.Errorf("malformed tree line: %s", line)
+			}
+			mode := strings.TrimPrefix(fields[0], "0")
+			switch mode {
+			case modeFile, modeExecutable, modeSymlink, modeSubmodule, modeTree:
+			default:
+				return nil, fmt.Errorf("malformed tree line: %s", line)
+			}
+			entries = append(entries, treeEntry{mode: mode, name: name, sha: fields[2]})
+		}
+		return encodeTree(entries), nil
+	}
+	return edited, nil
+}
+
+// editReplacement lets the user edit an object in the editor, as its
+// replacement says when it's replaced already, see exportObject, and
+// replaces the object with the result. Unless force, an object can't be
+// replaced again.
+func editReplacement(name string, force bool) error {
+	object, err := resolveRevision(name)
+	if err != nil {
+		return fmt.Errorf("failed to resolve '%s' as a valid ref", name)
+	}
+	if _, ok := replacements()[object]; ok && !force {
+		return fmt.Errorf("replace ref 'refs/replace/%s' already exists", object)
+	}
+
+	objectType, content, err := readObject(object)
+	if err != nil {
+		return err
+	}
+	exported, err := exportObject(objectType, content)
+	if err != nil {
+		return err
+	}
+
+	path := gitPath("REPLACE_EDITOBJ")
+	if err := os.WriteFile(path, exported, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := launchEditor(path); err != nil {
+		return err
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	imported, err := importObject(objectType, edited)
+	if err != nil {
+		return err
+	}
+	replacement, err := writeObject(objectType, imported)
+	if err != nil {
+		return err
+	}
+	if replacement == object {
+		return fmt.Errorf("new object is the same as the old one: '%s'", object)
+	}
+	return updateRef("refs/replace/"+object, replacement)
+}
+
+// replace implements `git replace [-f] <object> <replacement>`,
+// `git replace [-f] --edit <object>`, `git replace -d <object>...` and `git replace [--format=<format>] [-l [<pattern>]]`
+//
+// A replace ref makes every command read another object in place of one,
+// without rewriting the history that points to it:
+//
+//	refs/replace/<sha of the object>  <sha of the replacement>
+//
+// Both objects must have the same type, and a replacement that would end up
+// replacing itself is refused. -f overwrites an existing replace ref, and
+// -d deletes them. --edit makes the replacement in the editor, from the
+// object, see editReplacement, eg: to fix a typo in an old commit message:
+//
+//	$ git replace --edit HEAD~3
+//
+// Without arguments, or with -l, the replaced objects are
+// listed, those matching a pattern when one is given, in the format short
+// (<object>), medium (<object> -> <replacement>) or long, which adds their
+// types.
+//
+// `git --no-replace-objects <command>` reads objects as they are stored.
+func replace(args []string) {
+	flag := flag.NewFlagSet("git replace", flag.ExitOnError)
+	var (
+		force  = flag.Bool("f", false, "replace the ref if it exists")
+		remove = flag.Bool("d", false, "delete replace refs")
+		list   = flag.Bool("l", false, "list replace refs")
+		edit   = flag.Bool("edit", false, "edit an object to make its replacement")
+		format = flag.String("format", "short", "use this `<format>` to list: short, medium or long")
+	)
+	flag.BoolVar(force, "force", false, "same as -f")
+	flag.BoolVar(remove, "delete", false, "same as -d")
+	flag.BoolVar(edit, "e", false, "same as --edit")
+	flag.BoolVar(list, "list", false, "same as -l")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	switch {
+	case *remove:
+		if len(args) == 0 {
+			fail(fmt.Errorf("-d needs at least one argument"))
+		}
+		failed := false
+		for _, name := range args {
+			sha, err := resolveRevision(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: failed to resolve '%s' as a valid ref\n", name)
+				failed = true
+				continue
+			}
+			if _, ok := replacements()[sha]; !ok {
+				fmt.Fprintf(os.Stderr, "error: replace ref '%s' not found\n", sha)
+				failed = true
+				continue
+			}
+			if err := deleteRef("refs/replace/" + sha); err != nil {
+				fail(err)
+			}
+			fmt.Printf("Deleted replace ref '%s'\n", sha)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case *edit:
+		if len(args) != 1 {
+			fail(fmt.Errorf("-e needs exactly one argument"))
+		}
+		if err := editReplacement(args[0], *force); err != nil {
+			fail(err)
+		}
+
+	case *list || len(args) < 2:
+		if len(args) > 1 {
+			fail(fmt.Errorf("only one pattern can be given with -l"))
+		}
+		pattern := "*"
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		if *format != "short" && *format != "medium" && *format != "long" {
+			fail(fmt.Errorf("invalid replace format '%s'\nvalid formats are 'short', 'medium' and 'long'", *format))
+		}
+
+		refs, err := listRefs()
+		if err != nil {
+			fail(err)
+		}
+		// the objects as they are stored, not as replaced
+		noReplaceObjects = true
+		for _, r := range refs {
+			sha, ok := strings.CutPrefix(r.name, "refs/replace/")
+			if !ok {
+				continue
+			}
+			if matched, _ := path.Match(pattern, sha); !matched {
+				continue
+			}
+			switch *format {
+			case "short":
+				fmt.Println(sha)
+			case "medium":
+				fmt.Printf("%s -> %s\n", sha, r.sha)
+			case "long":
+				objectType, _, err := readObject(sha)
+				if err != nil {
+					fail(err)
+				}
+				replacementType, _, err := readObject(r.sha)
+				if err != nil {
+					fail(err)
+				}
+				fmt.Printf("%s (%s) -> %s (%s)\n", sha, objectType, r.sha, replacementType)
+			}
+		}
+
+	case len(args) == 2:
+		object, err := resolveRevision(args[0])
+		if err != nil {
+			fail(fmt.Errorf("failed to resolve '%s' as a valid ref", args[0]))
+		}
+		replacement, err := resolveRevision(args[1])
+		if err != nil {
+			fail(fmt.Errorf("failed to resolve '%s' as a valid ref", args[1]))
+		}
+		if object == replacement {
+			fail(fmt.Errorf("new object is the same as the old one: '%s'", object))
+		}
+		if _, ok := replacements()[object]; ok && !*force {
+			fail(fmt.Errorf("replace ref 'refs/replace/%s' already exists", object))
+		}
+
+		// a replacement replaced in turn by the object would be a cycle
+		for sha, depth := replacement, 0; depth <= maxReplaceDepth; depth++ {
+			next, ok := replacements()[sha]
+			if !ok {
+				break
+			}
+			if next == object {
+				fail(fmt.Errorf("replacing '%s' with '%s' would create a cycle", object, replacement))
+			}
+			sha = next
+		}
+
+		noReplaceObjects = true
+		objectType, _, err := readObject(object)
+		if err != nil {
+			fail(err)
+		}
+		replacementType, _, err := readObject(replacement)
+		if err != nil {
+			fail(err)
+		}
+		if objectType != replacementType {
+			fail(fmt.Errorf("Objects must be of the same type.\n"+
+				"'%s' points to a replaced object of type '%s'\n"+
+				"while '%s' points to a replacement object of type '%s'.",
+				args[0], objectType, args[1], replacementType))
+		}
+
+		if err := updateRef("refs/replace/"+object, replacement); err != nil {
+			fail(err)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, "usage: git replace [-f] <object> <replacement>\n   or: git replace [-f] --edit <object>\n   or: git replace -d <object>...\n   or: git replace [--format=<format>] [-l [<pattern>]]")
+		os.Exit(129)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitDir is the git directory of the work tree, and commonDir the one with
+// what is shared between the worktrees of a repository: the objects, the
+// refs, the config... Both are .git, except in a linked worktree (see
+// worktreeCmd).
+var (
+	gitDir    = ".git"
+	commonDir = ".git"
+)
+
+// bareRepository is set in a repository without a work tree, see
+// setupGitDir.
+var bareRepository bool
+
+// workTreeCommands are the commands that need a work tree, which a bare
+// repository doesn't have.
+var workTreeCommands = map[string]bool{
+	"commit":    true,
+	"checkout":  true,
+	"mergetool": true,
+	"clean":     true,
+	"stash":     true,
+	"bisect":    true,
+	"merge":     true,
+	"status":    true,
+	"rerere":    true,
+	"rebase":    true,
+}
+
+// isGitDirectory tells whether a directory looks like a git directory, the
+// way git does to find bare repositories: it has a HEAD, objects and refs.
+func isGitDirectory(dir string) bool {
+	if info, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || info.IsDir() {
+		return false
+	}
+	for _, name := range []string{"objects", "refs"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// setupGitDir finds the git directories of the current directory. .git is
+// either the git directory itself or, in a linked worktree, a file pointing
+// to it:
+//
+//	gitdir: <main work tree>/.git/worktrees/<name>
+//
+// in which the commondir file gives the path of the main .git, relative to
+// the worktree's git directory.
+//
+// Without .git, a current directory that is a git directory itself, see
+// isGitDirectory, is a bare repository, as is one whose core.bare is true.
+func setupGitDir() error {
+	gitDir, commonDir = ".git", ".git"
+	bare := false
+	defer func() {
+		objects = newObjectStore()
+		configCache = nil
+		replaceRefs = nil
+		shallowCommits = nil
+		bareRepository = bare || configBool("core.bare", false)
+	}()
+
+	info, err := os.Stat(".git")
+	if os.IsNotExist(err) && isGitDirectory(".") {
+		gitDir, commonDir, bare = ".", ".", true
+		trace("bare git dir %s", gitDir)
+		return nil
+	}
+	if err != nil || info.IsDir() {
+		return nil
+	}
+
+	content, err := os.ReadFile(".git")
+	if err != nil {
+		return err
+	}
+	dir, found := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir: ")
+	if !found || dir == "" {
+		return fmt.Errorf("invalid gitfile format: .git")
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("not a git repository: %s", dir)
+	}
+	gitDir = filepath.Clean(dir)
+	commonDir = gitDir
+
+	content, err = os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err == nil {
+		dir := strings.TrimSpace(string(content))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(gitDir, dir)
+		}
+		commonDir = filepath.Clean(dir)
+	}
+	trace("git dir %s, common dir %s", gitDir, commonDir)
+	return nil
+}
+
+// gitPath returns the path of a file of the repository, eg: gitPath("HEAD").
+// The files of sharedPaths are in commonDir, shared by the worktrees, and
+// anything else, eg: HEAD, the index, MERGE_MSG or the state of a rebase or
+// a bisect, is in gitDir, each worktree having its own.
+func gitPath(name string) string {
+	if isWorktreePath(name) {
+		return filepath.Join(gitDir, name)
+	}
+	return filepath.Join(commonDir, name)
+}
+
+// sharedPaths are the files and folders of the repository the worktrees
+// share, like git's common_list, but for worktreeOnlyPaths within them.
+var sharedPaths = []string{
+	"branches", "common", "config", "description", "hooks", "info", "logs",
+	"lost-found", "objects", "packed-refs", "refs", "remotes", "rr-cache",
+	"shallow", "svn", "worktrees",
+}
+
+// worktreeOnlyPaths are the exceptions to sharedPaths.
+var worktreeOnlyPaths = []string{
+	"info/sparse-checkout", "logs/HEAD", "logs/refs/bisect",
+	"logs/refs/rewritten", "logs/refs/worktree", "refs/bisect",
+	"refs/rewritten", "refs/worktree",
+}
+
+// isWorktreePath tells whether a file of the repository belongs to the
+// worktree rather than being shared. The lock of a file goes with it.
+func isWorktreePath(name string) bool {
+	name = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(name)), ".lock")
+	within := func(dir string) bool {
+		return name == dir || strings.HasPrefix(name, dir+"/")
+	}
+	for _, dir := range worktreeOnlyPaths {
+		if within(dir) {
+			return true
+		}
+	}
+	for _, dir := range sharedPaths {
+		if within(dir) {
+			return false
+		}
+	}
+	return true
+}
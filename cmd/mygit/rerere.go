@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// rerereCache is where the conflicts seen and their resolutions are kept,
+// in a directory named after their conflict ID, see normalizeConflicts:
+//
+//	.git/rr-cache/<id>/preimage    the conflict, normalized
+//	.git/rr-cache/<id>/postimage   the file the user resolved it to
+const rerereCache = "rr-cache"
+
+// mergeRRFile lists the paths in conflict whose resolution is yet to be
+// recorded, with their conflict ID, as "<id>\t<path>\0".
+const mergeRRFile = "MERGE_RR"
+
+// rerereEnabled tells whether resolutions are recorded and replayed: when
+// rerere.enabled is set, or else when .git/rr-cache exists, like git.
+func rerereEnabled() bool {
+	if _, ok := configGet("rerere.enabled"); ok {
+		return configBool("rerere.enabled", false)
+	}
+	info, err := os.Stat(gitPath(rerereCache))
+	return err == nil && info.IsDir()
+}
+
+// normalizeConflicts returns a file with its conflicts written the same way
+// whatever the labels and the order of the sides, and the ID of the
+// conflicts: the sha1 of their sides, each followed by a NUL.
+//
+//	<<<<<<<
+//	<the side that sorts first>
+//	=======
+//	<the other side>
+//	>>>>>>>
+//
+// The base of the diff3 style is left out. It returns how many conflicts
+// there are.
+func normalizeConflicts(data []byte) ([]byte, string, int, error) {
+	conflicts, err := ParseConflicts(data)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	var normalized bytes.Buffer
+	hash := sha1.New()
+	last := 0
+	for _, c := range conflicts {
+		one, two := c.Ours, c.Theirs
+		if bytes.Compare(one, two) > 0 {
+			one, two = two, one
+		}
+		hash.Write(one)
+		hash.Write([]byte{0})
+		hash.Write(two)
+		hash.Write([]byte{0})
+
+		normalized.Write(data[last:c.start])
+		fmt.Fprintf(&normalized, "%s\n%s%s\n%s%s\n", strings.Repeat("<", conflictMarkerSize), one,
+			strings.Repeat("=", conflictMarkerSize), two, strings.Repeat(">", conflictMarkerSize))
+		last = c.end
+	}
+	normalized.Write(data[last:])
+	return normalized.Bytes(), hex.EncodeToString(hash.Sum(nil)), len(conflicts), nil
+}
+
+// rerereImage is the path of the preimage or the postimage of a conflict.
+func rerereImage(id string, image string) string {
+	return gitPath(filepath.Join(rerereCache, id, image))
+}
+
+// readMergeRR returns the paths of .git/MERGE_RR, with their conflict ID.
+func readMergeRR() (map[string]string, error) {
+	content, err := os.ReadFile(gitPath(mergeRRFile))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]string{}
+	for _, record := range strings.Split(string(content), "\x00") {
+		if record == "" {
+			continue
+		}
+		id, path, ok := strings.Cut(record, "\t")
+		if !ok {
+			return nil, fmt.Errorf("corrupt MERGE_RR")
+		}
+		paths[path] = id
+	}
+	return paths, nil
+}
+
+// writeMergeRR writes .git/MERGE_RR, see readMergeRR, sorted by path.
+func writeMergeRR(paths map[string]string) error {
+	var content strings.Builder
+	for _, path := range sortedMergeRR(paths) {
+		fmt.Fprintf(&content, "%s\t%s\x00", paths[path], path)
+	}
+	return os.WriteFile(gitPath(mergeRRFile), []byte(content.String()), 0644)
+}
+
+// sortedMergeRR returns the paths of MERGE_RR, sorted.
+func sortedMergeRR(paths map[string]string) []string {
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// rerere records the conflicts of the paths the index has in conflict,
+// and the resolutions of the ones recorded before, once their conflict
+// markers are gone. A conflict resolved before is resolved the same way
+// again, when the resolution applies cleanly. It says what it did on w:
+//
+//	Recorded preimage for 'parser.go'
+//	Recorded resolution for 'parser.go'.
+//	Resolved 'parser.go' using previous resolution.
+//
+// It does nothing unless rerere is enabled, see rerereEnabled.
+func rerere(w io.Writer) error {
+	if !rerereEnabled() {
+		return nil
+	}
+	paths, err := readMergeRR()
+	if err != nil {
+		return err
+	}
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	// the conflicts just seen, not recorded yet
+	fresh := map[string]bool{}
+	for _, entry := range idx.entries {
+		if entry.stage() != 2 {
+			continue
+		}
+		content, err := os.ReadFile(entry.path)
+		if err != nil {
+			continue
+		}
+		_, id, count, err := normalizeConflicts(content)
+		if err != nil {
+			continue
+		}
+		if old, ok := paths[entry.path]; ok && count > 0 {
+			os.Remove(rerereImage(old, "preimage"))
+			delete(paths, entry.path)
+		}
+		if count > 0 {
+			paths[entry.path], fresh[entry.path] = id, true
+		}
+	}
+
+	for _, path := range sortedMergeRR(paths) {
+		id := paths[path]
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		normalized, _, count, err := normalizeConflicts(content)
+		if err != nil {
+			continue
+		}
+
+		if !fresh[path] && count == 0 {
+			if err := os.WriteFile(rerereImage(id, "postimage"), content, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "Recorded resolution for '%s'.\n", path)
+			delete(paths, path)
+			continue
+		}
+
+		if resolved, ok := replayResolution(id, normalized); ok {
+			if err := os.WriteFile(path, resolved, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "Resolved '%s' using previous resolution.\n", path)
+			delete(paths, path)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(rerereImage(id, "preimage")), 0750); err != nil {
+			return err
+		}
+		if err := os.WriteFile(rerereImage(id, "preimage"), normalized, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Recorded preimage for '%s'\n", path)
+	}
+	return writeMergeRR(paths)
+}
+
+// replayResolution applies the resolution recorded for a conflict to a
+// file in conflict, normalized: the changes from the preimage to the
+// postimage are merged with the ones from the preimage to the file. It
+// tells whether there was a resolution that applied cleanly.
+func replayResolution(id string, normalized []byte) ([]byte, bool) {
+	preimage, err := os.ReadFile(rerereImage(id, "preimage"))
+	if err != nil {
+		return nil, false
+	}
+	postimage, err := os.ReadFile(rerereImage(id, "postimage"))
+	if err != nil {
+		return nil, false
+	}
+	merged, conflict := mergeLines(splitLines(preimage), splitLines(normalized), splitLines(postimage), "", "")
+	if conflict {
+		return nil, false
+	}
+	return []byte(merged), true
+}
+
+// rerereClear forgets the conflicts whose resolution is yet to be
+// recorded.
+func rerereClear() error {
+	paths, err := readMergeRR()
+	if err != nil {
+		return err
+	}
+	for _, id := range paths {
+		if _, err := os.Stat(rerereImage(id, "postimage")); err == nil {
+			continue
+		}
+		if err := os.RemoveAll(gitPath(filepath.Join(rerereCache, id))); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(gitPath(mergeRRFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rerereCmd implements `git rerere [clear | status | diff]`
+//
+// Without a subcommand, it records the conflicts and the resolutions, see
+// rerere, which merge and commit do on their own.
+//
+// status lists the paths whose resolution is yet to be recorded, and diff
+// shows how they were resolved so far, from their conflict:
+//
+//	$ git rerere diff
+//	--- a/parser.go
+//	+++ b/parser.go
+//	@@ -1,7 +1,3 @@
+//	 func parse() {
+//	-<<<<<<<
+//	-	return nil
+//	-=======
+//	-	return errors.New("unsupported")
+//	->>>>>>>
+//	+	return parseLine()
+//	 }
+//
+// clear forgets them.
+func rerereCmd(args []string) {
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: git rerere [clear | status | diff]")
+		os.Exit(129)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	switch subcommand {
+	case "":
+		if err := rerere(os.Stderr); err != nil {
+			fail(err)
+		}
+
+	case "clear":
+		if err := rerereClear(); err != nil {
+			fail(err)
+		}
+
+	case "status", "diff":
+		paths, err := readMergeRR()
+		if err != nil {
+			fail(err)
+		}
+		for _, path := range sortedMergeRR(paths) {
+			if subcommand == "status" {
+				fmt.Fprintln(out, path)
+				continue
+			}
+			preimage, err := os.ReadFile(rerereImage(paths[path], "preimage"))
+			if err != nil {
+				fail(err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				fail(err)
+			}
+			fmt.Fprintf(out, "--- a/%s\n+++ b/%s\n", path, path)
+			writeHunks(out, splitLines(preimage), splitLines(content), &diffOptions{})
+		}
+
+	default:
+		fail(fmt.Errorf("unknown rerere subcommand: %s", subcommand))
+	}
+}
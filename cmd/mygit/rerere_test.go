@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestNormalizeConflicts(t *testing.T) {
+	normalized, id, count, err := normalizeConflicts([]byte("1\n<<<<<<< HEAD\nS\n=======\nM\n>>>>>>> side\n3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(normalized), "1\n<<<<<<<\nM\n=======\nS\n>>>>>>>\n3\n"; got != want {
+		t.Errorf("normalized to\n%s\nexpected\n%s", got, want)
+	}
+	// the ID git gives the conflict
+	if want := "53677f26a67b47a436b7c3836be6a91787fb7842"; id != want || count != 1 {
+		t.Errorf("conflict ID %s of %d conflicts, expected %s of 1", id, count, want)
+	}
+}
+
+func TestRerereReplaysResolution(t *testing.T) {
+	main, _ := testMergeHistory(t, map[string]string{"f": "1\nS\n3\n", "g": "x\n"})
+	if err := os.WriteFile(".git/config", []byte("[rerere]\n\tenabled = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); !errors.Is(err, errMergeConflicts) {
+		t.Fatalf("merge returned %v, expected the conflicts", err)
+	}
+	var messages bytes.Buffer
+	if err := rerere(&messages); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := readMergeRR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths["f"] == "" {
+		t.Fatalf("MERGE_RR has %v, expected f", paths)
+	}
+
+	// resolved by hand, and recorded
+	writeTestFiles(t, map[string]string{"f": "1\nR\n3\n"})
+	if err := rerere(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messages.String(), "Recorded preimage for 'f'\nRecorded resolution for 'f'.\n"; got != want {
+		t.Errorf("rerere said\n%s\nexpected\n%s", got, want)
+	}
+
+	// the same conflict again is resolved the same way
+	if err := mergeAbort(); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := resolveRevision("HEAD"); head != main {
+		t.Fatalf("HEAD is %s after --abort", head)
+	}
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); !errors.Is(err, errMergeConflicts) {
+		t.Fatalf("merge returned %v, expected the conflicts", err)
+	}
+	messages.Reset()
+	if err := rerere(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messages.String(), "Resolved 'f' using previous resolution.\n"; got != want {
+		t.Errorf("rerere said %q, expected %q", got, want)
+	}
+	if content, _ := os.ReadFile("f"); string(content) != "1\nR\n3\n" {
+		t.Errorf("f is %q, expected the previous resolution", content)
+	}
+}
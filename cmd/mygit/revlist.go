@@ -0,0 +1,292 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// queuedCommit is a commit waiting in the commitQueue.
+//
+// The insertion order breaks ties between commits with the same time.
+type queuedCommit struct {
+	node  *commitNode
+	order int
+}
+
+// commitQueue is a priority queue of commits, most recent commit time first.
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	if q[i].node.time != q[j].node.time {
+		return q[i].node.time > q[j].node.time
+	}
+	return q[i].order < q[j].order
+}
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// walkCommits visits every commit reachable from the given starting commits,
+// in reverse chronological order (like git's default ordering).
+//
+// The walk stops early when visit returns false.
+func walkCommits(starts []string, visit func(*commitNode) bool) error {
+	seen := map[string]bool{}
+	queue := &commitQueue{}
+	order := 0
+	push := func(node *commitNode) {
+		heap.Push(queue, queuedCommit{node: node, order: order})
+		order++
+	}
+
+	for _, sha := range starts {
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+
+		node, err := readCommitNode(sha)
+		if err != nil {
+			return err
+		}
+		push(node)
+	}
+
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(queuedCommit).node
+		if !visit(node) {
+			return nil
+		}
+
+		for _, parent := range node.parents {
+			if seen[parent] {
+				continue
+			}
+			seen[parent] = true
+
+			parentNode, err := readCommitNode(parent)
+			if err != nil {
+				return err
+			}
+			push(parentNode)
+		}
+	}
+
+	return nil
+}
+
+// isAncestor reports whether ancestor is reachable from sha, a commit
+// being its own ancestor.
+func isAncestor(ancestor string, sha string) (bool, error) {
+	found := false
+	err := walkCommits([]string{sha}, func(node *commitNode) bool {
+		found = node.sha == ancestor
+		return !found
+	})
+	return found, err
+}
+
+// mergeBases returns the best common ancestors of two commits, the ones
+// that aren't the ancestor of another common ancestor, most recent first.
+// There is more than one after criss-cross merges, and none when the
+// histories are unrelated.
+func mergeBases(one string, other string) ([]string, error) {
+	ancestors := map[string]bool{}
+	err := walkCommits([]string{one}, func(node *commitNode) bool {
+		ancestors[node.sha] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the common ancestors found first, most recent first; the others are
+	// reachable from them
+	var common []string
+	below := map[string]bool{}
+	err = walkCommits([]string{other}, func(node *commitNode) bool {
+		if below[node.sha] {
+			for _, parent := range node.parents {
+				below[parent] = true
+			}
+			return true
+		}
+		if ancestors[node.sha] {
+			common = append(common, node.sha)
+			for _, parent := range node.parents {
+				below[parent] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a common ancestor found before one of its descendants, when dates are
+	// skewed, isn't one of the best
+	var bases []string
+	for i, sha := range common {
+		best := true
+		for j, candidate := range common {
+			if i == j {
+				continue
+			}
+			reachable, err := isAncestor(sha, candidate)
+			if err != nil {
+				return nil, err
+			}
+			if reachable {
+				best = false
+				break
+			}
+		}
+		if best {
+			bases = append(bases, sha)
+		}
+	}
+	return bases, nil
+}
+
+// parentsFirst returns the commits reachable from the given starting commits
+// ordered so that every parent comes before its children, which is the
+// order needed to rewrite or replay history. Commits for which skip returns
+// true are left out.
+func parentsFirst(starts []string, skip func(sha string) bool) ([]*commitNode, error) {
+	nodes := map[string]*commitNode{}
+	var walked []*commitNode
+	err := walkCommits(starts, func(node *commitNode) bool {
+		if !skip(node.sha) {
+			nodes[node.sha] = node
+			walked = append(walked, node)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := make([]*commitNode, 0, len(walked))
+	done := map[string]bool{}
+	var visit func(node *commitNode)
+	visit = func(node *commitNode) {
+		if node == nil || done[node.sha] {
+			return
+		}
+		done[node.sha] = true
+		for _, parent := range node.parents {
+			visit(nodes[parent])
+		}
+		ordered = append(ordered, node)
+	}
+
+	// oldest first, so unrelated branches keep their chronological order
+	for i := len(walked) - 1; i >= 0; i-- {
+		visit(walked[i])
+	}
+	return ordered, nil
+}
+
+// graphOrder orders walked commits, most recent first, so that no parent
+// comes before its children, and the commits of a branch stay together like
+// git's --topo-order: a commit is followed by the last of its parents whose
+// children were all shown. The parents that weren't walked are ignored.
+func graphOrder(walked []*commitNode) []*commitNode {
+	// the number of children not shown yet, plus one, for every commit
+	indegree := map[string]int{}
+	for _, node := range walked {
+		indegree[node.sha] = 1
+	}
+	for _, node := range walked {
+		for _, parent := range node.parents {
+			if indegree[parent] > 0 {
+				indegree[parent]++
+			}
+		}
+	}
+	nodes := map[string]*commitNode{}
+	var stack []*commitNode
+	for _, node := range walked {
+		nodes[node.sha] = node
+		if indegree[node.sha] == 1 {
+			stack = append(stack, node)
+		}
+	}
+	// the tips come in the order of the walk
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+
+	ordered := make([]*commitNode, 0, len(walked))
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, parent := range node.parents {
+			if indegree[parent] == 0 {
+				continue
+			}
+			indegree[parent]--
+			if indegree[parent] == 1 {
+				stack = append(stack, nodes[parent])
+			}
+		}
+		indegree[node.sha] = 0
+		ordered = append(ordered, node)
+	}
+	return ordered
+}
+
+// revList implements `git rev-list <commit>...`
+//
+// It lists the commits reachable from the given commits, most recent first.
+// The parents are taken from the commit-graph when one was written.
+func revList(args []string) {
+	flag := flag.NewFlagSet("git rev-list", flag.ExitOnError)
+	var (
+		maxCount = flag.Int("n", -1, "limit the number of commits to output")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git rev-list [-n <count>] <commit>...")
+		os.Exit(1)
+	}
+
+	var starts []string
+	for _, arg := range args {
+		sha, err := resolveRevision(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		starts = append(starts, sha)
+	}
+
+	defer tracePerformance(time.Now(), "walk history")
+
+	count := 0
+	err := walkCommits(starts, func(node *commitNode) bool {
+		if count == *maxCount {
+			return false
+		}
+		count++
+
+		fmt.Println(node.sha)
+		return true
+	})
+	if err != nil {
+		error := fmt.Sprintf("Failed to walk history: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(1)
+	}
+}
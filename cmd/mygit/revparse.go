@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// abbrevRefName returns the short name of the ref a revision names, eg:
+// main for HEAD when on branch main. Symbolic refs are followed, so a
+// detached HEAD stays HEAD. It returns false when the revision isn't a ref,
+// like a sha.
+func abbrevRefName(revision string) (string, bool, error) {
+	name, err := expandRefName(revision)
+	if err != nil {
+		return "", false, nil
+	}
+
+	for depth := 0; depth < 5; depth++ {
+		target, symbolic, err := readSymbolicRef(name)
+		if err != nil {
+			return "", false, err
+		}
+		if !symbolic {
+			break
+		}
+		name = target
+	}
+	return shortRefName(name), true, nil
+}
+
+// revParse implements `git rev-parse [--abbrev-ref] <revision>...`
+//
+// It prints the object name of each revision, or with --abbrev-ref the short
+// name of the ref it is, eg: to show the current branch:
+//
+//	$ git rev-parse --abbrev-ref HEAD
+//	main
+//
+// A detached HEAD prints HEAD, and revisions that aren't refs print nothing.
+func revParse(args []string) {
+	flag := flag.NewFlagSet("git rev-parse", flag.ExitOnError)
+	var (
+		abbrevRef = flag.Bool("abbrev-ref", false, "print the short name of refs instead of object names")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	for _, arg := range args {
+		sha, err := resolveRevision(arg)
+		if err != nil {
+			fail(fmt.Errorf("ambiguous argument '%s': unknown revision or path not in the working tree.", arg))
+		}
+
+		if !*abbrevRef {
+			fmt.Println(sha)
+			continue
+		}
+
+		name, isRef, err := abbrevRefName(arg)
+		if err != nil {
+			fail(err)
+		}
+		if isRef {
+			fmt.Println(name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+const shallowFile = "shallow"
+
+var shallowCommits map[string]bool
+
+// loadShallow reads .git/shallow once: the boundary commits of a shallow
+// clone, one sha per line.
+//
+// The parents of these commits were never fetched, so history walks treat
+// them as root commits.
+func loadShallow() map[string]bool {
+	if shallowCommits != nil {
+		return shallowCommits
+	}
+	shallowCommits = map[string]bool{}
+
+	content, err := os.ReadFile(gitPath(shallowFile))
+	if err != nil {
+		return shallowCommits
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if sha := strings.TrimSpace(line); isObjectName(sha) {
+			shallowCommits[sha] = true
+		}
+	}
+	return shallowCommits
+}
+
+// isShallow reports whether a commit is on the shallow boundary.
+func isShallow(sha string) bool {
+	return loadShallow()[sha]
+}
+
+// updateShallow records the boundary commits a fetch added to .git/shallow,
+// and drops the ones it fetched the parents of, removing the file when no
+// commit is left. The file is locked meanwhile, like a ref.
+func updateShallow(add []string, remove []string) error {
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+	commits := map[string]bool{}
+	for sha := range loadShallow() {
+		commits[sha] = true
+	}
+	for _, sha := range add {
+		commits[sha] = true
+	}
+	for _, sha := range remove {
+		delete(commits, sha)
+	}
+	shallowCommits = nil
+
+	path := gitPath(shallowFile)
+	if len(commits) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	lock, err := AcquireLock(path)
+	if err != nil {
+		return err
+	}
+	var content strings.Builder
+	for _, sha := range sortedKeys(commits) {
+		content.WriteString(sha + "\n")
+	}
+	if _, err := lock.Write([]byte(content.String())); err != nil {
+		lock.Rollback()
+		return err
+	}
+	return lock.Commit()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestUpdateShallow(t *testing.T) {
+	testRepository(t)
+	root := writeTestCommit(t, "root")
+	child := writeTestCommit(t, "child", root)
+
+	if err := updateShallow([]string{child}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(gitPath(shallowFile)); string(content) != child+"\n" {
+		t.Errorf(".git/shallow is %q, expected %s", content, child)
+	}
+	if node, err := readCommitNode(child); err != nil || len(node.parents) != 0 {
+		t.Errorf("the shallow commit has parents %v (%v), expected none", node.parents, err)
+	}
+
+	// fetching the parents of the boundary makes the repository complete
+	if err := updateShallow(nil, []string{child}); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(gitPath(shallowFile)) {
+		t.Error(".git/shallow is still there without shallow commits")
+	}
+	if node, err := readCommitNode(child); err != nil || len(node.parents) != 1 {
+		t.Errorf("the commit has parents %v (%v) once unshallowed", node.parents, err)
+	}
+}
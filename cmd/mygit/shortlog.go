@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// shortlogGroup is the commits of an author, for shortlog.
+type shortlogGroup struct {
+	author   string
+	subjects []string
+}
+
+// shortlog implements `git shortlog [-n] [-s] [-e] [--no-use-mailmap] [<revision>...]`
+//
+// It summarizes the history reachable from the revisions, or HEAD, by
+// author, sorted by name, with the subjects of their commits, oldest first:
+//
+//	Jo Doe (2):
+//	      Add the parser
+//	      Fix the parser
+//
+// Authors are grouped by their canonical name, see mailmap, unless
+// --no-use-mailmap. With -e, their emails are shown and tell them apart
+// too, so that the same name with two emails is two authors:
+//
+//	Jo Doe <jo@example.org> (2):
+//
+// -n sorts them by number of commits instead, and -s only shows the
+// numbers.
+//
+// Unlike git, which reads a log from stdin when it isn't a terminal, HEAD is
+// the default revision.
+func shortlog(args []string) {
+	flag := flag.NewFlagSet("git shortlog", flag.ExitOnError)
+	var (
+		numbered  = flag.Bool("n", false, "sort the authors by number of commits")
+		summary   = flag.Bool("s", false, "only show the number of commits of each author")
+		email     = flag.Bool("e", false, "show the email of each author, and group them by it too")
+		noMailmap = flag.Bool("no-use-mailmap", false, "group the authors by the names they committed with")
+	)
+	flag.BoolVar(email, "email", false, "same as -e")
+	flag.BoolVar(numbered, "numbered", false, "same as -n")
+	flag.BoolVar(summary, "summary", false, "same as -s")
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if len(args) == 0 {
+		args = []string{"HEAD"}
+	}
+	var starts []string
+	for _, arg := range args {
+		sha, err := resolveRevision(arg)
+		if err != nil {
+			fail(err)
+		}
+		if sha, _, err = peelTag(sha); err != nil {
+			fail(err)
+		}
+		starts = append(starts, sha)
+	}
+
+	groups := map[string]*shortlogGroup{}
+	var walkErr error
+	err := walkCommits(starts, func(node *commitNode) bool {
+		c, err := readCommit(node.sha)
+		if err != nil {
+			walkErr = err
+			return false
+		}
+
+		ident := c.author
+		if !*noMailmap {
+			ident = loadMailmap().rewriteIdent(ident)
+		}
+		author, address, _ := parseIdent(ident)
+		if *email {
+			author = fmt.Sprintf("%s <%s>", author, address)
+		}
+		group, ok := groups[author]
+		if !ok {
+			group = &shortlogGroup{author: author}
+			groups[author] = group
+		}
+		subject, _ := messageParts(c.message)
+		// the walk is newest first
+		group.subjects = append([]string{subject}, group.subjects...)
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	sorted := make([]*shortlogGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].author < sorted[j].author })
+	if *numbered {
+		sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].subjects) > len(sorted[j].subjects) })
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, group := range sorted {
+		if *summary {
+			fmt.Fprintf(out, "%6d\t%s\n", len(group.subjects), group.author)
+			continue
+		}
+		fmt.Fprintf(out, "%s (%d):\n", group.author, len(group.subjects))
+		for _, subject := range group.subjects {
+			fmt.Fprintf(out, "      %s\n", subject)
+		}
+		fmt.Fprintln(out)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// signatureResult is the outcome of checking a signature.
+type signatureResult struct {
+	output string // what the tool says, for a human
+	status string // what the tool says, for a machine (--raw)
+	good   bool
+}
+
+// signatureVerifier checks a signature against the payload that was signed.
+// The actual checking is left to an external tool, eg: gpg or ssh-keygen.
+type signatureVerifier interface {
+	verify(payload []byte, signature []byte) (*signatureResult, error)
+}
+
+// verifierFor picks the verifier for a signature from its armor.
+func verifierFor(signature []byte) (signatureVerifier, error) {
+	switch {
+	case bytes.HasPrefix(signature, []byte("-----BEGIN PGP SIGNATURE-----")):
+		program, ok := configGet("gpg.openpgp.program")
+		if !ok {
+			program, ok = configGet("gpg.program")
+		}
+		if !ok {
+			program = "gpg"
+		}
+		return &gpgVerifier{program: program}, nil
+
+	case bytes.HasPrefix(signature, []byte("-----BEGIN SSH SIGNATURE-----")):
+		program, ok := configGet("gpg.ssh.program")
+		if !ok {
+			program = "ssh-keygen"
+		}
+		allowedSigners, _ := configGet("gpg.ssh.allowedSignersFile")
+		if _, err := os.Stat(allowedSigners); allowedSigners == "" || err != nil {
+			return nil, fmt.Errorf("gpg.ssh.allowedSignersFile needs to be configured and exist for ssh signature verification")
+		}
+		return &sshVerifier{program: program, allowedSigners: allowedSigners}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported signature format")
+}
+
+// writeSignatureFile stores a signature in a temporary file, as the tools
+// read the payload from stdin. The caller removes the file.
+func writeSignatureFile(signature []byte) (string, error) {
+	file, err := os.CreateTemp("", ".git_vtag_tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(signature)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// gpgVerifier checks OpenPGP signatures with:
+//
+//	gpg --keyid-format=long --status-fd=1 --verify <signature file> -
+//
+// The signature is good when gpg reports a GOODSIG on its status output.
+type gpgVerifier struct {
+	program string
+}
+
+func (v *gpgVerifier) verify(payload []byte, signature []byte) (*signatureResult, error) {
+	path, err := writeSignatureFile(signature)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(v.program, "--keyid-format=long", "--status-fd=1", "--verify", path, "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if _, failed := err.(*exec.ExitError); err != nil && !failed {
+		return nil, fmt.Errorf("failed to run %s: %s", v.program, err)
+	}
+
+	result := &signatureResult{output: stderr.String(), status: stdout.String()}
+	result.good = err == nil && strings.Contains("\n"+result.status, "\n[GNUPG:] GOODSIG ")
+	return result, nil
+}
+
+// sshVerifier checks SSH signatures against the allowed signers file, in
+// which each line gives the principals (emails) allowed to use a key.
+// ssh-keygen first finds the principals of the key that signed, then
+// verifies the signature as one of them:
+//
+//	ssh-keygen -Y find-principals -f <allowed signers> -s <signature file>
+//	ssh-keygen -Y verify -n git -f <allowed signers> -I <principal> -s <signature file>
+//
+// A signature from a key that isn't allowed is still checked, but isn't
+// good.
+type sshVerifier struct {
+	program        string
+	allowedSigners string
+}
+
+func (v *sshVerifier) verify(payload []byte, signature []byte) (*signatureResult, error) {
+	path, err := writeSignatureFile(signature)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	run := func(stdin []byte, args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(v.program, args...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if _, failed := err.(*exec.ExitError); err != nil && !failed {
+			return "", fmt.Errorf("failed to run %s: %s", v.program, err)
+		}
+		// ssh-keygen may end its messages with CRLF
+		return strings.ReplaceAll(stdout.String()+stderr.String(), "\r\n", "\n"), err
+	}
+
+	principals, err := run(nil, "-Y", "find-principals", "-f", v.allowedSigners, "-s", path)
+	if err != nil {
+		if _, failed := err.(*exec.ExitError); !failed {
+			return nil, err
+		}
+
+		output, err := run(payload, "-Y", "check-novalidate", "-n", "git", "-s", path)
+		if _, failed := err.(*exec.ExitError); err != nil && !failed {
+			return nil, err
+		}
+		if err == nil {
+			output += "No principal matched.\n"
+		}
+		return &signatureResult{output: output, status: output}, nil
+	}
+
+	var output string
+	for _, principal := range strings.Split(strings.TrimSpace(principals), "\n") {
+		output, err = run(payload, "-Y", "verify", "-n", "git", "-f", v.allowedSigners, "-I", principal, "-s", path)
+		if err == nil {
+			return &signatureResult{output: output, status: output, good: true}, nil
+		}
+		if _, failed := err.(*exec.ExitError); !failed {
+			return nil, err
+		}
+	}
+	return &signatureResult{output: output, status: output}, nil
+}
+
+// splitCommitSignature separates a commit object into the signed payload,
+// the commit without its gpgsig header, and the signature. The signature
+// spans the continuation lines of the header, which start with a space:
+//
+//	gpgsig -----BEGIN PGP SIGNATURE-----
+//	 <signature>
+//	 -----END PGP SIGNATURE-----
+func splitCommitSignature(content []byte) ([]byte, []byte) {
+	headers, message, _ := strings.Cut(string(content), "\n\n")
+
+	var payload, signature strings.Builder
+	inSignature := false
+	for _, line := range strings.Split(headers, "\n") {
+		if inSignature {
+			if continuation, found := strings.CutPrefix(line, " "); found {
+				signature.WriteString(continuation + "\n")
+				continue
+			}
+			inSignature = false
+		}
+		if value, found := strings.CutPrefix(line, "gpgsig "); found {
+			signature.WriteString(value + "\n")
+			inSignature = true
+			continue
+		}
+		payload.WriteString(line + "\n")
+	}
+	payload.WriteString("\n" + message)
+
+	return []byte(payload.String()), []byte(signature.String())
+}
+
+// splitTagSignature separates a tag object into the signed payload and the
+// signature appended to its message.
+func splitTagSignature(content []byte) ([]byte, []byte) {
+	payload, _ := stripSignature(string(content))
+	return []byte(payload), content[len(payload):]
+}
+
+// verifyCommit implements `git verify-commit [-v] [--raw] <commit>...`
+//
+// It checks the gpgsig signature of commits, with gpg for OpenPGP
+// signatures and ssh-keygen for SSH ones (see gpg.ssh.allowedSignersFile).
+// What the tool says goes to stderr, -v then prints the signed payload and
+// --raw the tool's status output instead. An unsigned commit fails silently.
+func verifyCommit(args []string) {
+	verifySignatures("verify-commit", "commit", splitCommitSignature, args)
+}
+
+// verifyTag implements `git verify-tag [-v] [--raw] <tag>...`
+//
+// It checks the signature at the end of annotated tags, like verify-commit.
+func verifyTag(args []string) {
+	verifySignatures("verify-tag", "tag", splitTagSignature, args)
+}
+
+// verifySignatures verifies the signature of each of args, objects of
+// objectType, and exits with 1 when one of them isn't good.
+func verifySignatures(command string, objectType string, split func([]byte) ([]byte, []byte), args []string) {
+	flag := flag.NewFlagSet("git "+command, flag.ExitOnError)
+	var (
+		verbose = flag.Bool("v", false, "print the "+objectType+" contents")
+		raw     = flag.Bool("raw", false, "print raw gpg status output")
+	)
+	flag.BoolVar(verbose, "verbose", false, "print the "+objectType+" contents")
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: git %s [-v | --verbose] [--raw] <%s>...\n", command, objectType)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, name := range args {
+		sha, err := resolveRevision(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s '%s' not found.\n", objectType, name)
+			failed = true
+			continue
+		}
+		actualType, content, err := readObject(sha)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s '%s' not found.\n", objectType, name)
+			failed = true
+			continue
+		}
+		if actualType != objectType {
+			fmt.Fprintf(os.Stderr, "error: %s: cannot verify a non-%s object of type %s.\n", name, objectType, actualType)
+			failed = true
+			continue
+		}
+
+		payload, signature := split(content)
+		if len(signature) == 0 {
+			// verify-tag still shows an unsigned tag, verify-commit is silent
+			if objectType == "tag" {
+				if *verbose {
+					os.Stdout.Write(payload)
+				}
+				fmt.Fprintln(os.Stderr, "error: no signature found")
+			}
+			failed = true
+			continue
+		}
+
+		verifier, err := verifierFor(signature)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			failed = true
+			continue
+		}
+		result, err := verifier.verify(payload, signature)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			failed = true
+			continue
+		}
+
+		if *raw {
+			fmt.Fprint(os.Stderr, result.status)
+		} else {
+			fmt.Fprint(os.Stderr, result.output)
+		}
+		if *verbose {
+			os.Stdout.Write(payload)
+		}
+		if !result.good {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
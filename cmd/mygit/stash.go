@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readStashes returns the stashes, the entries of the reflog of refs/stash,
+// newest first, so that stash@{n} is the n-th one.
+func readStashes() ([]reflogEntry, error) {
+	entries, err := readReflog("refs/stash")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stashes := make([]reflogEntry, len(entries))
+	for i, entry := range entries {
+		stashes[len(entries)-1-i] = entry
+	}
+	return stashes, nil
+}
+
+// stashIndex returns n for stash@{<n>}, or refs/stash@{<n>}, or just <n>,
+// the n-th stash.
+func stashIndex(name string) (int, bool) {
+	name = strings.TrimPrefix(name, "refs/")
+	if inner, found := strings.CutPrefix(name, "stash@{"); found && strings.HasSuffix(inner, "}") {
+		name = strings.TrimSuffix(inner, "}")
+	}
+	n, err := strconv.Atoi(name)
+	return n, err == nil && n >= 0
+}
+
+// writeStash writes the changes a stash keeps in the work tree, from the
+// commit it was made on: a diffstat, the patch, or both separated by a
+// blank line.
+func writeStash(w io.Writer, c *commit, stat bool, patch bool) error {
+	base, err := readCommit(c.parents[0])
+	if err != nil {
+		return err
+	}
+	changes, err := diffTrees(base.tree, c.tree, true)
+	if err != nil {
+		return err
+	}
+
+	if stat {
+		if err := writeChanges(w, changes, nil, &diffOptions{}, &optionalString{set: true}, false, false); err != nil {
+			return err
+		}
+		if patch {
+			fmt.Fprintln(w)
+		}
+	}
+	if patch {
+		return writeChanges(w, changes, nil, &diffOptions{}, &optionalString{}, false, false)
+	}
+	return nil
+}
+
+// readStash returns the commit of a stash: stash@{<n>}, or just <n>, or
+// any revision naming a commit made like a stash. n is the number of the
+// stash, or -1 for a revision.
+func readStash(name string, stashes []reflogEntry) (c *commit, n int, err error) {
+	sha := ""
+	n, ok := stashIndex(name)
+	if ok {
+		if n >= len(stashes) {
+			return nil, 0, fmt.Errorf("log for 'stash' only has %d entries", len(stashes))
+		}
+		sha = stashes[n].new
+	} else if sha, err = resolveRevision(name); err != nil {
+		return nil, 0, fmt.Errorf("error: %s is not a valid reference", name)
+	} else {
+		n = -1
+	}
+
+	// a stash is a merge of the commit it was made on and the index
+	c, err = readCommit(sha)
+	if err != nil || len(c.parents) < 2 {
+		return nil, 0, fmt.Errorf("'%s' is not a stash-like commit", name)
+	}
+	return c, n, nil
+}
+
+// stashBranch makes a new branch from the commit a stash was made on, and
+// checks it out with the changes of the stash, see applyStash. Like git,
+// it then shows the status.
+func stashBranch(w io.Writer, name string, c *commit) error {
+	ref := "refs/heads/" + name
+	if _, err := readRef(ref); err == nil {
+		return fmt.Errorf("a branch named '%s' already exists", name)
+	}
+	base, err := readCommit(c.parents[0])
+	if err != nil {
+		return err
+	}
+	files, err := flattenTree(base.tree)
+	if err != nil {
+		return err
+	}
+
+	head, branch := readWorktreeHead(gitDir)
+	from := head
+	if branch != "" {
+		from = shortRefName(branch)
+	}
+	if err := switchFiles(files, nil, "checkout"); err != nil {
+		return fmt.Errorf("error: %s", err)
+	}
+	if err := updateRef(ref, c.parents[0]); err != nil {
+		return err
+	}
+	if err := appendReflog(ref, nullSha, c.parents[0], "branch: Created from "+c.parents[0]); err != nil {
+		return err
+	}
+	if err := updateSymbolicRef("HEAD", ref); err != nil {
+		return err
+	}
+	if err := appendReflog("HEAD", head, c.parents[0], "checkout: moving from "+from+" to "+name); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Switched to a new branch '%s'\n", name)
+
+	if err := applyStash(c); err != nil {
+		return err
+	}
+	// like git, which resets to HEAD to apply it
+	if err := appendReflog("HEAD", c.parents[0], c.parents[0], "reset: moving to HEAD"); err != nil {
+		return err
+	}
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+	status, err := readCommitStatus(idx, c.parents[0], ref)
+	if err != nil {
+		return err
+	}
+	status.write(w, "")
+	return nil
+}
+
+// applyStash restores the changes of a stash on the commit it was made on,
+// checked out: its index, its work tree, and its untracked files, when it
+// has a third parent with them.
+func applyStash(c *commit) error {
+	index, err := readCommit(c.parents[1])
+	if err != nil {
+		return err
+	}
+	staged, err := flattenTree(index.tree)
+	if err != nil {
+		return err
+	}
+	if err := switchFiles(staged, nil, "checkout"); err != nil {
+		return fmt.Errorf("error: %s", err)
+	}
+
+	workTree, err := flattenTree(c.tree)
+	if err != nil {
+		return err
+	}
+	attrs := newAttrMatcher()
+	for _, change := range diffFiles(staged, workTree) {
+		if change.status == 'D' {
+			if err := os.Remove(change.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		os.Remove(change.path)
+		if err := writeWorkTreeFile(change.path, change.new, attrs); err != nil {
+			return err
+		}
+	}
+
+	if len(c.parents) < 3 {
+		return nil
+	}
+	untrackedCommit, err := readCommit(c.parents[2])
+	if err != nil {
+		return err
+	}
+	untracked, err := flattenTree(untrackedCommit.tree)
+	if err != nil {
+		return err
+	}
+	for path, entry := range untracked {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%s already exists, no checkout", path)
+		}
+		if err := writeWorkTreeFile(path, entry, attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropStash removes the n-th stash, and says so with its name.
+func dropStash(w io.Writer, name string, stashes []reflogEntry, n int) error {
+	if err := deleteReflogEntry("refs/stash", n); err != nil {
+		return err
+	}
+	remaining, err := readStashes()
+	if err != nil {
+		return err
+	}
+	if len(remaining) == 0 {
+		err = deleteRef("refs/stash")
+	} else {
+		err = updateRef("refs/stash", remaining[0].new)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Dropped %s (%s)\n", name, stashes[n].new)
+	return nil
+}
+
+// stash implements `git stash list`, `git stash show [-p] [--stat] [<stash>]`
+// and `git stash branch <branch> [<stash>]`
+//
+// A stash saves the local changes as a commit whose parents are the commit
+// it was made on and a commit of the index, and whose tree is the work
+// tree. The stashes are the reflog of refs/stash:
+//
+//	list   prints `stash@{<n>}: <message>` for each stash, newest first
+//	show   shows what a stash changed, as a diffstat by default or a patch
+//	       with -p, stash@{0} by default
+//	branch checks out a new branch from the commit a stash was made on,
+//	       with its changes, and drops it, see stashBranch
+//
+// Making stashes isn't supported, but the ones git made can be looked at.
+func stash(args []string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fatal := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	flag := flag.NewFlagSet("git stash "+subcommand, flag.ExitOnError)
+	var (
+		patch = flag.Bool("p", false, "show the patch")
+		stat  = flag.Bool("stat", false, "show a diffstat, the default without -p")
+	)
+	flag.BoolVar(patch, "patch", false, "same as -p")
+	flag.Parse(args)
+	args = flag.Args()
+
+	// errors are fatal, unless they say they're only errors
+	failStash := func(err error) {
+		if strings.HasPrefix(err.Error(), "error: ") {
+			fail(err)
+		}
+		fatal(err)
+	}
+
+	stashes, err := readStashes()
+	if err != nil {
+		fatal(err)
+	}
+
+	switch subcommand {
+	case "list":
+		for n, entry := range stashes {
+			fmt.Printf("stash@{%d}: %s\n", n, entry.message)
+		}
+
+	case "show":
+		if len(args) > 1 {
+			fail(fmt.Errorf("Too many revisions specified: '%s'", strings.Join(args, "' '")))
+		}
+		name := "stash@{0}"
+		if len(args) == 1 {
+			name = args[0]
+		} else if len(stashes) == 0 {
+			fail(fmt.Errorf("No stash entries found."))
+		}
+
+		c, _, err := readStash(name, stashes)
+		if err != nil {
+			failStash(err)
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		err = writeStash(out, c, *stat || !*patch, *patch)
+		out.Flush()
+		if err != nil {
+			fatal(err)
+		}
+
+	case "branch":
+		if len(args) == 0 {
+			fail(fmt.Errorf("No branch name specified"))
+		}
+		if len(args) > 2 {
+			fail(fmt.Errorf("Too many revisions specified: '%s'", strings.Join(args[1:], "' '")))
+		}
+		name := "refs/stash@{0}"
+		if len(args) == 2 {
+			name = args[1]
+		} else if len(stashes) == 0 {
+			fail(fmt.Errorf("No stash entries found."))
+		}
+		c, n, err := readStash(name, stashes)
+		if err != nil {
+			failStash(err)
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		err = stashBranch(out, args[0], c)
+		if err == nil && n >= 0 {
+			err = dropStash(out, name, stashes, n)
+		}
+		out.Flush()
+		// like git, whose checkout fails, it's fatal but exits with 1
+		if err != nil && !strings.HasPrefix(err.Error(), "error: ") {
+			err = fmt.Errorf("fatal: %s", err)
+		}
+		if err != nil {
+			fail(err)
+		}
+
+	default:
+		fatal(fmt.Errorf("unknown subcommand: %s", subcommand))
+	}
+}
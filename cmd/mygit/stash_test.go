@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestStashBranch(t *testing.T) {
+	testRepository(t)
+	base := writeTestTreeCommit(t, map[string]string{"a": "a\n", "b": "b\n"}, "base")
+	next := writeTestTreeCommit(t, map[string]string{"a": "a\n", "b": "b\n", "c": "c\n"}, "next", base)
+	if err := updateRef("refs/heads/main", next); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkoutCommit(next); err != nil {
+		t.Fatal(err)
+	}
+
+	// a staged, and b changed in the work tree, on base
+	index := writeTestTreeCommit(t, map[string]string{"a": "staged\n", "b": "b\n"}, "index on main", base)
+	stashed := writeTestTreeCommit(t, map[string]string{"a": "staged\n", "b": "changed\n"}, "WIP on main", base, index)
+	if err := updateRef("refs/stash", stashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendReflog("refs/stash", nullSha, stashed, "WIP on main"); err != nil {
+		t.Fatal(err)
+	}
+	stashes, err := readStashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, n, err := readStash("stash@{0}", stashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := stashBranch(&out, "topic", c); err != nil {
+		t.Fatal(err)
+	}
+	if err := dropStash(&out, "stash@{0}", stashes, n); err != nil {
+		t.Fatal(err)
+	}
+	want := "On branch topic\nChanges to be committed:\n\tmodified:   a\n\nChanges not staged for commit:\n\tmodified:   b\n\nDropped stash@{0} (" + stashed + ")\n"
+	if out.String() != want {
+		t.Errorf("stash branch printed\n%s\nexpected\n%s", out.String(), want)
+	}
+
+	if head, _ := resolveRevision("HEAD"); head != base {
+		t.Errorf("HEAD is %s, expected the commit the stash was made on %s", head, base)
+	}
+	if _, branch := readWorktreeHead(gitDir); branch != "refs/heads/topic" {
+		t.Errorf("the branch checked out is %q", branch)
+	}
+	if fileExists("c") {
+		t.Error("c of the previous branch is still there")
+	}
+	if stashes, _ := readStashes(); len(stashes) != 0 {
+		t.Errorf("the stash wasn't dropped: %v", stashes)
+	}
+
+	if err := stashBranch(&out, "topic", c); err == nil {
+		t.Error("stash branch made a branch that already exists")
+	}
+	if content, _ := os.ReadFile("b"); string(content) != "changed\n" {
+		t.Errorf("b is %q, expected the change of the stash", content)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// status implements `git status [--color[=<when>] | --no-color]`
+//
+// It shows the branch checked out, the changes the index has for the next
+// commit, those of the work tree that aren't added, and the untracked
+// files, see commitStatus:
+//
+//	On branch main
+//	Changes to be committed:
+//		modified:   parser.go
+//
+//	Untracked files:
+//		notes.txt
+//
+// While a merge stopped on conflicts, see merge, it says so, with how to
+// conclude or abort it, and the paths with conflicts are listed with the
+// versions they have, until each is resolved:
+//
+//	On branch main
+//	You have unmerged paths.
+//	  (fix conflicts and run "git commit")
+//	  (use "git merge --abort" to abort the merge)
+//
+// Like diff, the changes to be committed are colored green, and those not
+// added, the conflicts and the untracked files red, see colorFlag, with
+// color.status or color.ui.
+func status(args []string) {
+	flag := flag.NewFlagSet("git status", flag.ExitOnError)
+	color := colorFlag(flag, "color.status")
+	flag.Parse(args)
+	if flag.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: git status [--color[=<when>] | --no-color]")
+		os.Exit(129)
+	}
+	useColor = color()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	idx, err := readIndex()
+	if err != nil {
+		fail(fmt.Errorf("unable to read the index: %s", err))
+	}
+	head, branch := readWorktreeHead(gitDir)
+	if head == zeroSha {
+		head = ""
+	}
+	s, err := readCommitStatus(idx, head, branch)
+	if err != nil {
+		fail(err)
+	}
+	s.hints = true
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	s.write(out, "")
+	if summary := s.summary(); summary != "" {
+		fmt.Fprintln(out, summary)
+	}
+}
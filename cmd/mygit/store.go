@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ObjectStore is where objects are kept, by sha. Commands don't use a store
+// directly but go through readObject, writeObject and friends, which use
+// the store in objects.
+type ObjectStore interface {
+	// Read returns the content of an object, without its header, and its
+	// type (blob, tree, commit or tag).
+	Read(sha string) ([]byte, string, error)
+	// Write stores an object and returns its sha. An object that's already
+	// there is left alone.
+	Write(objectType string, content []byte) (string, error)
+	// Has reports whether the object is in the store.
+	Has(sha string) bool
+	// Iterate calls visit with the sha of every object in the store.
+	Iterate(visit func(sha string)) error
+}
+
+// objects is the object store of the repository: the loose objects, then
+// the packs, then the alternate object directories, and in a partial clone
+// the objects promised by its remote.
+var objects = newObjectStore()
+
+// newObjectStore returns the object store of the repository in gitDir.
+func newObjectStore() ObjectStore {
+	return NewPromisorStore(NewStackedStore(NewLooseStore(gitPath("objects")), NewPackStore(gitPath(packDir)), NewAlternatesStore(gitPath("objects"))))
+}
+
+// localObjects returns objects, without the promised objects of a partial
+// clone.
+func localObjects() ObjectStore {
+	if store, ok := objects.(*PromisorStore); ok {
+		return store.local
+	}
+	return objects
+}
+
+// looseStore returns the store of the loose objects in objects, or nil when
+// there is none.
+func looseStore() *LooseStore {
+	switch store := localObjects().(type) {
+	case *LooseStore:
+		return store
+	case *StackedStore:
+		for _, s := range store.stores {
+			if loose, ok := s.(*LooseStore); ok {
+				return loose
+			}
+		}
+	}
+	return nil
+}
+
+// packStore returns the store of the packs in objects, or nil when there is
+// none.
+func packStore() *PackStore {
+	switch store := localObjects().(type) {
+	case *PackStore:
+		return store
+	case *StackedStore:
+		for _, s := range store.stores {
+			if packs, ok := s.(*PackStore); ok {
+				return packs
+			}
+		}
+	}
+	return nil
+}
+
+// objectStorage returns how an object is stored in a store: the size it
+// takes on disk, and the name of its delta base, or nullSha when it's not a
+// delta, the way git reports them with %(objectsize:disk) and %(deltabase).
+func objectStorage(store ObjectStore, sha string) (int64, string, error) {
+	switch store := store.(type) {
+	case *LooseStore:
+		info, err := os.Stat(store.path(sha))
+		if err != nil {
+			return 0, "", err
+		}
+		return info.Size(), nullSha, nil
+	case *PackStore:
+		packed, err := store.packed(sha)
+		if err != nil {
+			return 0, "", err
+		}
+		if packed.baseSha == "" {
+			return packed.diskSize(), nullSha, nil
+		}
+		return packed.diskSize(), packed.baseSha, nil
+	case *AlternatesStore:
+		return objectStorage(store.load(), sha)
+	case *PromisorStore:
+		return objectStorage(store.local, sha)
+	case *StackedStore:
+		for _, s := range store.stores {
+			if s.Has(sha) {
+				return objectStorage(s, sha)
+			}
+		}
+	}
+	return 0, "", fmt.Errorf("object '%s' not found", sha)
+}
+
+// LooseStore keeps every object in its own zlib compressed file:
+//
+//	<dir>/<first 2 characters of the sha>/<remaining 38 characters>
+//
+// The file holds the object with a header:
+//
+//	<type> <size>\0<actual content>
+type LooseStore struct {
+	dir string
+}
+
+// NewLooseStore returns the store of the loose objects in dir, eg:
+// .git/objects.
+func NewLooseStore(dir string) *LooseStore {
+	return &LooseStore{dir: dir}
+}
+
+// path returns the location of a loose object.
+//
+// eg: object 0a5159e4fd9efdc3530c880fa15b672f08d47421
+// would be stored in .git/objects/0a/5159e4fd9efdc3530c880fa15b672f08d47421
+func (s *LooseStore) path(sha string) string {
+	return filepath.Join(s.dir, sha[:2], sha[2:])
+}
+
+// Open opens an object and reads its header, leaving the reader positioned
+// at the start of the content, so large objects never have to fit in
+// memory. It returns the type and the size of the content.
+func (s *LooseStore) Open(sha string) (string, int64, *objectReader, error) {
+	if len(sha) != 40 {
+		return "", 0, nil, fmt.Errorf("not a valid object name '%s'", sha)
+	}
+
+	trace("read object %s", sha)
+	file, err := os.Open(s.path(sha))
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	zReader, err := zlib.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return "", 0, nil, fmt.Errorf("failed to decompress object '%s': %s", sha, err)
+	}
+
+	buffered := bufio.NewReader(zReader)
+	reader := &objectReader{Reader: buffered, close: func() error {
+		zReader.Close()
+		return file.Close()
+	}}
+
+	header, err := buffered.ReadString(0)
+	if err != nil {
+		reader.Close()
+		return "", 0, nil, fmt.Errorf("object '%s' has no header", sha)
+	}
+
+	objectType, size, found := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	n, err := strconv.ParseInt(size, 10, 64)
+	if !found || err != nil {
+		reader.Close()
+		return "", 0, nil, fmt.Errorf("object '%s' has a malformed header", sha)
+	}
+
+	return objectType, n, reader, nil
+}
+
+func (s *LooseStore) Read(sha string) ([]byte, string, error) {
+	objectType, size, reader, err := s.Open(sha)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decompress object '%s': %s", sha, err)
+	}
+	if int64(len(content)) != size {
+		return nil, "", fmt.Errorf("object '%s' has a bad size", sha)
+	}
+
+	return content, objectType, nil
+}
+
+func (s *LooseStore) Write(objectType string, content []byte) (string, error) {
+	header := fmt.Sprintf("%s %d\x00", objectType, len(content))
+	data := append([]byte(header), content...)
+	sha := string(sha1Hash(data))
+
+	path := s.path(sha)
+	if _, err := os.Stat(path); err == nil {
+		return sha, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first, then rename it, so readers never see
+	// half an object. Two writers racing for the same object both write the
+	// same bytes, so it doesn't matter which rename wins.
+	trace("write object %s", sha)
+	file, err := os.CreateTemp(s.dir, "tmp_obj_")
+	if err != nil {
+		return "", err
+	}
+
+	zWriter := zlib.NewWriter(file)
+	_, err = zWriter.Write(data)
+	if err == nil {
+		err = zWriter.Close()
+	}
+	if err == nil {
+		err = syncObjectFile(file)
+	}
+	if err == nil {
+		err = file.Chmod(0444)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return sha, nil
+}
+
+// syncObjectFile flushes a new object file to disk before it's renamed in
+// place when core.fsyncObjectFiles is set, so that a crash can't leave an
+// object, or a pack, that is there but empty.
+func syncObjectFile(file *os.File) error {
+	if !configBool("core.fsyncObjectFiles", false) {
+		return nil
+	}
+	return file.Sync()
+}
+
+// writeObjectFile writes a pack or pack index the way loose objects are
+// written: to a temporary file in the same folder, renamed in place once
+// complete, so that readers never see part of it.
+func writeObjectFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "tmp_"+filepath.Base(path)+"_")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = syncObjectFile(file)
+	}
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (s *LooseStore) Has(sha string) bool {
+	if len(sha) != 40 {
+		return false
+	}
+	_, err := os.Stat(s.path(sha))
+	return err == nil
+}
+
+// Iterate walks the fan-out folders, so info/ and pack/ are skipped.
+func (s *LooseStore) Iterate(visit func(sha string)) error {
+	folders, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		if !folder.IsDir() || len(folder.Name()) != 2 {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(s.dir, folder.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if len(file.Name()) == 38 {
+				visit(folder.Name() + file.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
+// memoryObject is an object of a MemoryStore.
+type memoryObject struct {
+	objectType string
+	content    []byte
+}
+
+// MemoryStore keeps objects in memory only, eg: to try things out without
+// touching the repository.
+type MemoryStore struct {
+	objects map[string]memoryObject
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: map[string]memoryObject{}}
+}
+
+func (s *MemoryStore) Read(sha string) ([]byte, string, error) {
+	object, ok := s.objects[sha]
+	if !ok {
+		return nil, "", fmt.Errorf("object '%s' not found", sha)
+	}
+	return bytes.Clone(object.content), object.objectType, nil
+}
+
+func (s *MemoryStore) Write(objectType string, content []byte) (string, error) {
+	sha := objectHash(objectType, content)
+	if _, ok := s.objects[sha]; !ok {
+		s.objects[sha] = memoryObject{objectType: objectType, content: bytes.Clone(content)}
+	}
+	return sha, nil
+}
+
+func (s *MemoryStore) Has(sha string) bool {
+	_, ok := s.objects[sha]
+	return ok
+}
+
+// Iterate visits the objects sorted by sha.
+func (s *MemoryStore) Iterate(visit func(sha string)) error {
+	shas := make([]string, 0, len(s.objects))
+	for sha := range s.objects {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	for _, sha := range shas {
+		visit(sha)
+	}
+	return nil
+}
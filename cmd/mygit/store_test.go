@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestObjectStoragePacked(t *testing.T) {
+	testRepository(t)
+	content := strings.Repeat("a line of a file that changes little\n", 100)
+	base, err := writeObject("blob", []byte(content+"and one more line\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := writeObject("blob", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := packOptions{level: -1, window: 10, depth: 50}
+	if _, err := writeNewPack(gitPath(packDir), []string{base, delta}, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range []string{base, delta} {
+		if err := os.Remove(looseStore().path(sha)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size, deltaBase, err := objectStorage(objects, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deltaBase != base {
+		t.Errorf("delta base is %s, expected %s", deltaBase, base)
+	}
+	if size <= 0 || size >= int64(len(content))/10 {
+		t.Errorf("a delta of a few bytes takes %d bytes on disk", size)
+	}
+
+	size, deltaBase, err = objectStorage(objects, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deltaBase != nullSha {
+		t.Errorf("delta base of a whole object is %s, expected %s", deltaBase, nullSha)
+	}
+	if size <= 0 || size >= int64(len(content)) {
+		t.Errorf("a compressed object takes %d bytes on disk for %d bytes", size, len(content))
+	}
+
+	_, read, err := readObject(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != content {
+		t.Error("the delta doesn't read back as the object")
+	}
+}
+
+func TestObjectStorageLoose(t *testing.T) {
+	testRepository(t)
+	sha, err := writeObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(looseStore().path(sha))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, deltaBase, err := objectStorage(objects, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != info.Size() || deltaBase != nullSha {
+		t.Errorf("loose object stored as %d bytes, delta of %s, expected %d bytes, no delta", size, deltaBase, info.Size())
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	content := []byte("hello\n")
+	sha, err := store.Write("blob", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := objectHash("blob", content); sha != want {
+		t.Errorf("Write returned %s, expected %s", sha, want)
+	}
+	if !store.Has(sha) {
+		t.Error("the object written isn't in the store")
+	}
+
+	// what is read or written can't change the object stored
+	content[0] = 'j'
+	read, objectType, err := store.Read(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objectType != "blob" || string(read) != "hello\n" {
+		t.Errorf("Read returned %s %q, expected blob \"hello\\n\"", objectType, read)
+	}
+	read[0] = 'y'
+	if again, _, _ := store.Read(sha); string(again) != "hello\n" {
+		t.Errorf("changing what Read returned changed the object to %q", again)
+	}
+
+	if _, _, err := store.Read(nullSha); err == nil {
+		t.Error("reading a missing object should fail")
+	}
+	if store.Has(nullSha) {
+		t.Error("Has reports a missing object")
+	}
+
+	other, err := store.Write("blob", []byte("other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := store.Write("blob", []byte("hello\n")); err != nil || again != sha {
+		t.Errorf("writing an object again returned %s, %v", again, err)
+	}
+	var visited []string
+	store.Iterate(func(sha string) { visited = append(visited, sha) })
+	want := []string{sha, other}
+	if other < sha {
+		want = []string{other, sha}
+	}
+	if strings.Join(visited, " ") != strings.Join(want, " ") {
+		t.Errorf("Iterate visited %v, expected %v", visited, want)
+	}
+}
+
+func TestStackedStoreOverMemoryStores(t *testing.T) {
+	first, second := NewMemoryStore(), NewMemoryStore()
+	stacked := NewStackedStore(first, second)
+
+	shared, _ := second.Write("blob", []byte("shared\n"))
+	first.Write("blob", []byte("shared\n"))
+	below, _ := second.Write("blob", []byte("below\n"))
+
+	if _, objectType, err := stacked.Read(below); err != nil || objectType != "blob" {
+		t.Errorf("an object of the second store reads as %s, %v", objectType, err)
+	}
+	written, err := stacked.Write("blob", []byte("new\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Has(written) || second.Has(written) {
+		t.Error("a stacked store should write to its first store only")
+	}
+
+	count := map[string]int{}
+	stacked.Iterate(func(sha string) { count[sha]++ })
+	if len(count) != 3 || count[shared] != 1 {
+		t.Errorf("Iterate visited %v, expected 3 objects once each", count)
+	}
+}
+
+func TestHistoryInMemory(t *testing.T) {
+	testRepository(t)
+	memoryObjects(t)
+
+	blob, err := writeObject("blob", []byte("content\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := writeObject("tree", encodeTree([]treeEntry{{mode: "100644", name: "file", sha: blob}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident := "A U Thor <author@example.com> 1700000000 +0000"
+	root, err := writeObject("commit", (&commit{tree: tree, author: ident, committer: ident, message: "root\n"}).encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := writeTestCommit(t, "child", root)
+
+	if ancestor, err := isAncestor(root, child); err != nil || !ancestor {
+		t.Errorf("isAncestor(root, child) = %v, %v", ancestor, err)
+	}
+	files, err := flattenTree(tree)
+	if err != nil || files["file"].sha != blob {
+		t.Errorf("the tree reads back as %v, %v", files, err)
+	}
+	shas, err := objectsToSend([]string{child}, []string{root}, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shas) != 2 {
+		t.Errorf("objectsToSend found %v, expected the child commit and its empty tree", shas)
+	}
+
+	entries, err := os.ReadDir(gitPath("objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("objects were written to disk: %v", entries)
+	}
+}
+
+func TestObjectsToSendBlobNone(t *testing.T) {
+	testRepository(t)
+	commit := writeTestTreeCommit(t, map[string]string{"f": "f\n", "d/g": "g\n"}, "c")
+	blob, err := writeObject("blob", []byte("g\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		wants  []string
+		filter string
+		types  string
+	}{
+		{[]string{commit}, "", "blob blob commit tree tree"},
+		{[]string{commit}, "blob:none", "commit tree tree"},
+		// a blob wanted directly, eg: by a partial clone, is still sent
+		{[]string{blob}, "blob:none", "blob"},
+	} {
+		shas, err := objectsToSend(test.wants, nil, nil, nil, test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types []string
+		for _, sha := range shas {
+			objectType, _, err := readObject(sha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, objectType)
+		}
+		sort.Strings(types)
+		if got := strings.Join(types, " "); got != test.types {
+			t.Errorf("objectsToSend(%v, %q) sent %s, expected %s", test.wants, test.filter, got, test.types)
+		}
+	}
+}
+
+func TestWriteObjectConcurrent(t *testing.T) {
+	testRepository(t)
+	content := []byte(strings.Repeat("the same content, written by everyone\n", 1000))
+	want := objectHash("blob", content)
+
+	// the writers are released together so that they race for the object
+	const writers = 100
+	start := make(chan struct{})
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			sha, err := writeObject("blob", content)
+			if err == nil && sha != want {
+				err = fmt.Errorf("wrote %s, expected %s", sha, want)
+			}
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	objectType, read, err := readObject(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objectType != "blob" || string(read) != string(content) {
+		t.Errorf("the object reads back as a %s of %d bytes, expected the blob written", objectType, len(read))
+	}
+	temporary, _ := filepath.Glob(".git/objects/tmp_obj_*")
+	if len(temporary) > 0 {
+		t.Errorf("temporary files were left behind: %v", temporary)
+	}
+}
+
+func TestReadObjectWhileWritten(t *testing.T) {
+	testRepository(t)
+	if err := os.WriteFile(".git/config", []byte("[core]\n\tfsyncObjectFiles = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+	content := []byte(strings.Repeat("read while it's being written\n", 5000))
+	sha := objectHash("blob", content)
+
+	// readers that find the object must read all of it, whatever the
+	// writers are doing
+	const writers, readers = 10, 10
+	start := make(chan struct{})
+	errs := make(chan error, writers+readers)
+	var written, wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		written.Add(1)
+		go func() {
+			defer written.Done()
+			<-start
+			_, err := writeObject("blob", content)
+			errs <- err
+		}()
+	}
+	done := make(chan struct{})
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if !objects.Has(sha) {
+					continue
+				}
+				objectType, read, err := readObject(sha)
+				if err == nil && (objectType != "blob" || string(read) != string(content)) {
+					err = fmt.Errorf("read a %s of %d bytes, expected the blob written", objectType, len(read))
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	close(start)
+	written.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
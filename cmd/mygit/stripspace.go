@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// commentChar returns what starts a comment line in a message to edit,
+// core.commentChar or #.
+func commentChar() string {
+	if value, ok := configGet("core.commentChar"); ok && len(value) == 1 {
+		return value
+	}
+	return "#"
+}
+
+// stripSpace cleans up a message the way git stripspace does: trailing
+// whitespace is removed from each line, runs of blank lines are squeezed
+// into one and blank lines at the start and the end are dropped. A message
+// that isn't empty ends with a newline.
+//
+// With stripComments, the lines starting with the comment character are
+// removed first.
+func stripSpace(text string, stripComments bool) string {
+	comment := commentChar()
+
+	var result strings.Builder
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		if stripComments && strings.HasPrefix(line, comment) {
+			continue
+		}
+
+		line = strings.TrimRight(line, " \t\r\v\f")
+		if line == "" {
+			blank = true
+			continue
+		}
+		if blank && result.Len() > 0 {
+			result.WriteString("\n")
+		}
+		blank = false
+		result.WriteString(line + "\n")
+	}
+	return result.String()
+}
+
+// commentLines turns every line of text into a comment, the way git does
+// for the help of a message to edit: the comment character and a space
+// start each line, without the space when it's empty or starts with a tab.
+func commentLines(text string) string {
+	comment := commentChar()
+
+	var result strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" || strings.HasPrefix(line, "\t") {
+			result.WriteString(comment + line + "\n")
+		} else {
+			result.WriteString(comment + " " + line + "\n")
+		}
+	}
+	return result.String()
+}
+
+// stripspaceCmd implements `git stripspace [-s | --strip-comments]` and `git stripspace [-c | --comment-lines]`
+//
+// It cleans up the text on stdin the way commit cleans up messages, see
+// stripSpace, eg: for a script writing a commit message:
+//
+//	$ printf 'Fix the parser   \n\n\n\nIt crashed.\n\n' | git stripspace
+//	Fix the parser
+//
+//	It crashed.
+//
+// -s drops the comment lines too, those starting with core.commentChar, #
+// by default. -c turns every line into a comment instead, see
+// commentLines.
+func stripspaceCmd(args []string) {
+	flag := flag.NewFlagSet("git stripspace", flag.ExitOnError)
+	var (
+		stripComments = flag.Bool("s", false, "skip and remove all lines starting with the comment character")
+		commentOut    = flag.Bool("c", false, "prepend the comment character and a space to each line")
+	)
+	flag.BoolVar(stripComments, "strip-comments", false, "same as -s")
+	flag.BoolVar(commentOut, "comment-lines", false, "same as -c")
+	flag.Parse(args)
+	args = flag.Args()
+
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: git stripspace [-s | --strip-comments]")
+		fmt.Fprintln(os.Stderr, "   or: git stripspace [-c | --comment-lines]")
+		os.Exit(129)
+	}
+	if len(args) != 0 {
+		usage()
+	}
+	if *stripComments && *commentOut {
+		fmt.Fprintln(os.Stderr, "error: switch `c' is incompatible with --strip-comments")
+		usage()
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		error := fmt.Sprintf("fatal: could not read the input: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if *commentOut {
+		fmt.Print(commentLines(string(input)))
+	} else {
+		fmt.Print(stripSpace(string(input), *stripComments))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tag holds the parsed content of an annotated tag object:
+//
+//	object <sha>
+//	type <type of the tagged object>
+//	tag <name>
+//	tagger <ident>
+//
+//	<message>
+type tag struct {
+	object     string
+	objectType string
+	name       string
+	tagger     string
+	message    string
+}
+
+// parseTag parses the content of a tag object (without its header).
+func parseTag(content []byte) (*tag, error) {
+	headers, message, _ := strings.Cut(string(content), "\n\n")
+
+	t := &tag{message: message}
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "object":
+			t.object = value
+		case "type":
+			t.objectType = value
+		case "tag":
+			t.name = value
+		case "tagger":
+			t.tagger = value
+		}
+	}
+
+	if t.object == "" {
+		return nil, fmt.Errorf("tag has no object")
+	}
+
+	return t, nil
+}
+
+// subject returns the subject of a commit or tag message: its first
+// paragraph on one line, like git's %s, see messageParts.
+func subject(message string) string {
+	subject, _ := messageParts(message)
+	return subject
+}
+
+// peelTag follows annotated tags until it reaches an object that isn't a
+// tag, and returns that object and its type.
+func peelTag(sha string) (string, string, error) {
+	for depth := 0; depth < 10; depth++ {
+		objectType, content, err := readObject(sha)
+		if err != nil {
+			return "", "", err
+		}
+		if objectType != "tag" {
+			return sha, objectType, nil
+		}
+
+		t, err := parseTag(content)
+		if err != nil {
+			return "", "", err
+		}
+		sha = t.object
+	}
+
+	return "", "", fmt.Errorf("tag '%s' nests too deep", sha)
+}
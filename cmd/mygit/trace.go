@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The trace writers are set up from the environment by setupTrace:
+//
+//	GIT_TRACE              command names and key operations (object reads, writes...)
+//	GIT_TRACE_PACKET       every pkt-line read or written
+//	GIT_TRACE_PERFORMANCE  elapsed time of each major operation
+//
+// They default to io.Discard, so tracing costs next to nothing when disabled.
+var (
+	TraceWriter            io.Writer = io.Discard
+	TracePacketWriter      io.Writer = io.Discard
+	TracePerformanceWriter io.Writer = io.Discard
+)
+
+// traceTarget turns the value of a GIT_TRACE* variable into a writer:
+//
+//	unset, "", 0, false   tracing disabled
+//	1, 2, true            stderr
+//	/absolute/path        appended to that file
+func traceTarget(variable string) io.Writer {
+	value := os.Getenv(variable)
+
+	switch strings.ToLower(value) {
+	case "", "0", "false":
+		return io.Discard
+	case "1", "2", "true":
+		return os.Stderr
+	}
+
+	if !filepath.IsAbs(value) {
+		fmt.Fprintf(os.Stderr, "warning: %s=%s is not an absolute path, tracing disabled\n", variable, value)
+		return io.Discard
+	}
+
+	file, err := os.OpenFile(value, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not open '%s' for tracing: %s\n", value, err)
+		return io.Discard
+	}
+	return file
+}
+
+// setupTrace reads the GIT_TRACE* environment variables.
+func setupTrace() {
+	TraceWriter = traceTarget("GIT_TRACE")
+	TracePacketWriter = traceTarget("GIT_TRACE_PACKET")
+	TracePerformanceWriter = traceTarget("GIT_TRACE_PERFORMANCE")
+}
+
+// writeTrace writes one line prefixed with a timestamp and the process id:
+//
+//	15:04:05.000000 [1234] trace: read object 0a5159e4...
+func writeTrace(writer io.Writer, format string, a ...interface{}) {
+	if writer == io.Discard {
+		return
+	}
+
+	prefix := fmt.Sprintf("%s [%d] ", time.Now().Format("15:04:05.000000"), os.Getpid())
+	fmt.Fprintln(writer, prefix+fmt.Sprintf(format, a...))
+}
+
+// trace records a key operation when GIT_TRACE is set.
+func trace(format string, a ...interface{}) {
+	writeTrace(TraceWriter, "trace: "+format, a...)
+}
+
+// tracePacket records a pkt-line when GIT_TRACE_PACKET is set.
+//
+// direction is '<' for packets read and '>' for packets written.
+func tracePacket(direction byte, line []byte) {
+	writeTrace(TracePacketWriter, "packet: git%c %s", direction, strings.TrimSuffix(string(line), "\n"))
+}
+
+// tracePerformance records how long an operation took when
+// GIT_TRACE_PERFORMANCE is set. Use it as:
+//
+//	defer tracePerformance(time.Now(), "write commit-graph")
+func tracePerformance(start time.Time, operation string) {
+	writeTrace(TracePerformanceWriter, "performance: %.9f s: %s", time.Since(start).Seconds(), operation)
+}
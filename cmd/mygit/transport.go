@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// builtinTransports are the URL schemes git handles itself, any other one
+// goes to a remote helper.
+var builtinTransports = map[string]bool{
+	"file":    true,
+	"git":     true,
+	"ssh":     true,
+	"git+ssh": true,
+	"ssh+git": true,
+	"http":    true,
+	"https":   true,
+	"ftp":     true,
+	"ftps":    true,
+}
+
+// transport moves refs and objects between the repository and a remote:
+// git itself on the other end, see packTransport, or a remote helper, see
+// remoteHelper.
+type transport interface {
+	// list returns the refs of the remote, forPush asking for the refs
+	// push can update.
+	list(forPush bool) ([]remoteRef, error)
+	// fetch stores the objects of the refs, and what they reach, in the
+	// repository.
+	fetch(refs []remoteRef) error
+	// push updates the refs of the remote, sending the objects it lacks,
+	// and returns what happened to each of them.
+	push(updates []pushUpdate) ([]pushStatus, error)
+	close() error
+}
+
+// pushUpdate is an update of a ref of the remote by a push: dst, currently
+// old, is set to sha, the object src names in the repository. An empty src
+// and sha delete dst, an empty old creates it. Unless force, the update has
+// to be a fast-forward.
+type pushUpdate struct {
+	src, dst string
+	sha, old string
+	force    bool
+}
+
+// openTransport connects to the repository at url, for the remote named
+// remote, which is the url itself when there isn't one. A URL a remote
+// helper handles goes to the helper, see remoteHelperFor, any other one to
+// git on the other end.
+func openTransport(remote string, url string) (transport, error) {
+	if _, _, ok := remoteHelperFor(url); ok {
+		return startRemoteHelper(remote, url)
+	}
+	return newPackTransport(url)
+}
+
+// remoteHelperFor returns the remote helper handling a URL, if any, and the
+// address to give it. Like git, it is either named explicitly, the address
+// being what follows the `::`, or picked from the scheme of the URL, which
+// is given as is:
+//
+//	<transport>::<address>    git-remote-<transport> <remote> <address>
+//	<scheme>://<address>      git-remote-<scheme> <remote> <scheme>://<address>
+func remoteHelperFor(url string) (helper string, address string, ok bool) {
+	if transport, address, found := strings.Cut(url, "::"); found && isHelperName(transport) {
+		return transport, address, true
+	}
+	if scheme, _, found := strings.Cut(url, "://"); found && isHelperName(scheme) && !builtinTransports[scheme] {
+		return scheme, url, true
+	}
+	return "", "", false
+}
+
+// isHelperName checks that a transport name can be part of a program name.
+func isHelperName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteHelper is a running git-remote-<transport> program, which moves
+// objects and refs to and from a remote git doesn't know how to talk to,
+// eg: a Mercurial repository or a bucket. It reads commands on its stdin
+// and answers on its stdout, a command and its answer ending with a blank
+// line:
+//
+//	capabilities              the commands and options it supports
+//	list [for-push]           the refs of the remote, `<sha> <ref>`
+//	fetch <sha> <ref>...      fetches the objects of the refs into GIT_DIR
+//	push <src>:<dst>...       updates the refs of the remote
+//
+// Only helpers with the fetch and push capabilities are supported, not
+// connect, import or export.
+type remoteHelper struct {
+	name         string
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	stdout       *bufio.Reader
+	capabilities map[string]bool
+}
+
+// remoteRef is a ref listed by a remote helper. The value of a symbolic
+// ref is the ref it points to, and unknown when the helper answers `?`.
+type remoteRef struct {
+	name    string
+	sha     string
+	symref  string
+	unknown bool
+}
+
+// pushStatus is the outcome of a push to a remote helper.
+type pushStatus struct {
+	ref string
+	err string // why the remote refused the update, empty on success
+}
+
+// startRemoteHelper starts the helper handling url for the remote, which
+// may be the url itself for an unnamed remote, and reads its capabilities.
+func startRemoteHelper(remote string, url string) (*remoteHelper, error) {
+	name, address, ok := remoteHelperFor(url)
+	if !ok {
+		return nil, fmt.Errorf("no remote helper for '%s'", url)
+	}
+	program, err := exec.LookPath("git-remote-" + name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find remote helper for '%s'", name)
+	}
+	dir, err := filepath.Abs(gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	trace("run remote helper %s", program)
+	cmd := exec.Command(program, remote, address)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+dir)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run remote helper %s: %s", name, err)
+	}
+
+	helper := &remoteHelper{
+		name:         name,
+		cmd:          cmd,
+		stdin:        stdin,
+		stdout:       bufio.NewReader(stdout),
+		capabilities: map[string]bool{},
+	}
+	lines, err := helper.command("capabilities")
+	if err != nil {
+		helper.close()
+		return nil, err
+	}
+	for _, capability := range lines {
+		// a capability starting with * must be understood
+		capability, mandatory := strings.CutPrefix(capability, "*")
+		switch capability {
+		case "fetch", "push", "option", "check-connectivity":
+		default:
+			if mandatory {
+				helper.close()
+				return nil, fmt.Errorf("unknown mandatory capability %s; this remote helper probably needs newer version of Git", capability)
+			}
+		}
+		helper.capabilities[capability] = true
+	}
+	return helper, nil
+}
+
+// command sends the lines of a command and returns the lines of the
+// answer, up to the blank line ending it. A batch of fetch or push commands
+// ends with a blank line of its own.
+func (h *remoteHelper) command(lines ...string) ([]string, error) {
+	for _, line := range lines {
+		trace("remote-%s < %s", h.name, line)
+		if _, err := io.WriteString(h.stdin, line+"\n"); err != nil {
+			return nil, fmt.Errorf("failed to talk to remote helper %s: %s", h.name, err)
+		}
+	}
+
+	var answer []string
+	for {
+		line, err := h.stdout.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("remote helper %s quit unexpectedly", h.name)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		trace("remote-%s > %s", h.name, line)
+		if line == "" {
+			return answer, nil
+		}
+		answer = append(answer, line)
+	}
+}
+
+// require fails when the helper doesn't support a command.
+func (h *remoteHelper) require(capability string) error {
+	if !h.capabilities[capability] {
+		return fmt.Errorf("remote helper %s does not support %s", h.name, capability)
+	}
+	return nil
+}
+
+// list returns the refs of the remote, forPush asking for the refs that
+// can be pushed to.
+func (h *remoteHelper) list(forPush bool) ([]remoteRef, error) {
+	command := "list"
+	if forPush {
+		command = "list for-push"
+	}
+	lines, err := h.command(command)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []remoteRef
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed response in ref list: %s", line)
+		}
+		r := remoteRef{name: fields[1]}
+		switch value := fields[0]; {
+		case value == "?":
+			r.unknown = true
+		case strings.HasPrefix(value, "@"):
+			r.symref = value[1:]
+		case isObjectName(value):
+			r.sha = value
+		default:
+			return nil, fmt.Errorf("malformed response in ref list: %s", line)
+		}
+		refs = append(refs, r)
+	}
+
+	// symbolic refs get the value of the ref they point to
+	for i := range refs {
+		for _, r := range refs {
+			if refs[i].symref != "" && r.name == refs[i].symref {
+				refs[i].sha = r.sha
+			}
+		}
+	}
+	return refs, nil
+}
+
+// fetch has the helper write the objects of the refs into the repository.
+func (h *remoteHelper) fetch(refs []remoteRef) error {
+	if err := h.require("fetch"); err != nil {
+		return err
+	}
+	var lines []string
+	for _, r := range refs {
+		lines = append(lines, fmt.Sprintf("fetch %s %s", r.sha, r.name))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	answer, err := h.command(append(lines, "")...)
+	if err != nil {
+		return err
+	}
+	for _, line := range answer {
+		// lock <file> and connectivity-ok are informational
+		if !strings.HasPrefix(line, "lock ") && line != "connectivity-ok" {
+			return fmt.Errorf("%s unexpected line: '%s'", h.name, line)
+		}
+	}
+	return nil
+}
+
+// push has the helper update the refs of the remote, with a `push
+// [+]<src>:<dst>` line each, `:<dst>` deleting dst, and returns what
+// happened to each of them.
+func (h *remoteHelper) push(updates []pushUpdate) ([]pushStatus, error) {
+	if err := h.require("push"); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, update := range updates {
+		refspec := update.src + ":" + update.dst
+		if update.force {
+			refspec = "+" + refspec
+		}
+		lines = append(lines, "push "+refspec)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	answer, err := h.command(append(lines, "")...)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []pushStatus
+	for _, line := range answer {
+		if ref, found := strings.CutPrefix(line, "ok "); found {
+			statuses = append(statuses, pushStatus{ref: ref})
+			continue
+		}
+		if rest, found := strings.CutPrefix(line, "error "); found {
+			ref, why, _ := strings.Cut(rest, " ")
+			if why == "" {
+				why = "remote helper error"
+			}
+			statuses = append(statuses, pushStatus{ref: ref, err: why})
+			continue
+		}
+		return nil, fmt.Errorf("%s unexpected line: '%s'", h.name, line)
+	}
+	return statuses, nil
+}
+
+// close ends the session, with a blank line and closing the helper's stdin,
+// and waits for it to quit.
+func (h *remoteHelper) close() error {
+	io.WriteString(h.stdin, "\n")
+	h.stdin.Close()
+	if err := h.cmd.Wait(); err != nil {
+		return fmt.Errorf("remote helper %s failed: %s", h.name, err)
+	}
+	return nil
+}
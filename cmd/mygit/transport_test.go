@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary be git-remote-testfs, see
+// runTestRemoteHelper, when started as one.
+func TestMain(m *testing.M) {
+	if os.Getenv("MYGIT_TEST_REMOTE_HELPER") != "" {
+		if err := runTestRemoteHelper(os.Args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// installTestRemoteHelper puts a git-remote-testfs on the PATH that runs
+// the test binary as the helper, and returns the URL of an empty remote it
+// serves, a temporary directory.
+func installTestRemoteHelper(t *testing.T) string {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\nexec '%s' \"$@\"\n", self)
+	if err := os.WriteFile(filepath.Join(bin, "git-remote-testfs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("MYGIT_TEST_REMOTE_HELPER", "1")
+
+	store := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(store, "objects"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store, "refs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return "testfs://" + store
+}
+
+// runTestRemoteHelper serves the remote at url, a directory with a file
+// per object, objects/<sha> holding `<type> <content>`, and a refs file of
+// `<sha> <ref>` lines, to the repository of GIT_DIR. It supports the fetch
+// and push capabilities, moving the objects one at a time.
+func runTestRemoteHelper(url string) error {
+	store := strings.TrimPrefix(url, "testfs://")
+	if err := os.Chdir(filepath.Dir(os.Getenv("GIT_DIR"))); err != nil {
+		return err
+	}
+	if err := setupGitDir(); err != nil {
+		return err
+	}
+
+	storeRead := func(sha string) (string, []byte, error) {
+		data, err := os.ReadFile(filepath.Join(store, "objects", sha))
+		if err != nil {
+			return "", nil, err
+		}
+		objectType, content, _ := bytes.Cut(data, []byte(" "))
+		return string(objectType), content, nil
+	}
+	storeWrite := func(objectType string, content []byte) (string, error) {
+		sha := objectHash(objectType, content)
+		data := append([]byte(objectType+" "), content...)
+		return sha, os.WriteFile(filepath.Join(store, "objects", sha), data, 0644)
+	}
+	storeHas := func(sha string) bool {
+		_, err := os.Stat(filepath.Join(store, "objects", sha))
+		return err == nil
+	}
+	readRefs := func() (map[string]string, error) {
+		content, err := os.ReadFile(filepath.Join(store, "refs"))
+		refs := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if sha, name, ok := strings.Cut(line, " "); ok {
+				refs[name] = sha
+			}
+		}
+		return refs, err
+	}
+	writeRefs := func(refs map[string]string) error {
+		var content strings.Builder
+		for name, sha := range refs {
+			fmt.Fprintf(&content, "%s %s\n", sha, name)
+		}
+		return os.WriteFile(filepath.Join(store, "refs"), []byte(content.String()), 0644)
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for in.Scan() {
+		command, _, _ := strings.Cut(in.Text(), " ")
+		switch command {
+		case "":
+			return nil
+
+		case "capabilities":
+			fmt.Fprint(out, "fetch\npush\n\n")
+
+		case "list":
+			refs, err := readRefs()
+			if err != nil {
+				return err
+			}
+			for name, sha := range refs {
+				fmt.Fprintf(out, "%s %s\n", sha, name)
+			}
+			if _, ok := refs["refs/heads/main"]; ok {
+				fmt.Fprintln(out, "@refs/heads/main HEAD")
+			}
+			fmt.Fprintln(out)
+
+		case "fetch":
+			for line := in.Text(); line != ""; line = in.Text() {
+				sha, _, _ := strings.Cut(strings.TrimPrefix(line, "fetch "), " ")
+				if err := copyTestObjects(sha, storeRead, objects.Has, writeObject); err != nil {
+					return err
+				}
+				in.Scan()
+			}
+			fmt.Fprintln(out)
+
+		case "push":
+			refs, err := readRefs()
+			if err != nil {
+				return err
+			}
+			for line := in.Text(); line != ""; line = in.Text() {
+				spec, err := parseRefspec(strings.TrimPrefix(line, "push "))
+				if err != nil {
+					return err
+				}
+				if spec.src == "" {
+					delete(refs, spec.dst)
+					fmt.Fprintf(out, "ok %s\n", spec.dst)
+					in.Scan()
+					continue
+				}
+
+				sha, err := readRef(spec.src)
+				if err != nil {
+					return err
+				}
+				if old, ok := refs[spec.dst]; ok && !spec.force {
+					if fastForward, err := isAncestor(old, sha); err != nil || !fastForward {
+						fmt.Fprintf(out, "error %s non-fast-forward\n", spec.dst)
+						in.Scan()
+						continue
+					}
+				}
+				if err := copyTestObjects(sha, readObject, storeHas, storeWrite); err != nil {
+					return err
+				}
+				refs[spec.dst] = sha
+				fmt.Fprintf(out, "ok %s\n", spec.dst)
+				in.Scan()
+			}
+			if err := writeRefs(refs); err != nil {
+				return err
+			}
+			fmt.Fprintln(out)
+
+		default:
+			return fmt.Errorf("unknown command '%s'", command)
+		}
+		out.Flush()
+	}
+	return in.Err()
+}
+
+// copyTestObjects copies an object and everything it reaches that the
+// destination doesn't have.
+func copyTestObjects(sha string, read func(string) (string, []byte, error), has func(string) bool, write func(string, []byte) (string, error)) error {
+	if has(sha) {
+		return nil
+	}
+	objectType, content, err := read(sha)
+	if err != nil {
+		return err
+	}
+
+	var reached []string
+	switch objectType {
+	case "commit":
+		c, err := parseCommit(content)
+		if err != nil {
+			return err
+		}
+		reached = append([]string{c.tree}, c.parents...)
+	case "tree":
+		entries, err := parseTree(content)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			reached = append(reached, entry.sha)
+		}
+	case "tag":
+		tag, err := parseTag(content)
+		if err != nil {
+			return err
+		}
+		reached = append(reached, tag.object)
+	}
+	for _, sha := range reached {
+		if err := copyTestObjects(sha, read, has, write); err != nil {
+			return err
+		}
+	}
+	_, err = write(objectType, content)
+	return err
+}
+
+// writeTestRemoteConfig configures the remote origin, fetching the
+// branches into refs/remotes/origin/.
+func writeTestRemoteConfig(t *testing.T, url string) {
+	t.Helper()
+	config := fmt.Sprintf("[remote \"origin\"]\n\turl = %s\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n", url)
+	if err := os.WriteFile(".git/config", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configCache = nil
+}
+
+func TestRemoteHelperFor(t *testing.T) {
+	tests := []struct {
+		url, helper, address string
+		ok                   bool
+	}{
+		{"testfs://server/repo", "testfs", "testfs://server/repo", true},
+		{"hg::https://example.com/repo", "hg", "https://example.com/repo", true},
+		{"https://example.com/repo.git", "", "", false},
+		{"file:///tmp/repo", "", "", false},
+		{"../repo", "", "", false},
+	}
+	for _, test := range tests {
+		helper, address, ok := remoteHelperFor(test.url)
+		if helper != test.helper || address != test.address || ok != test.ok {
+			t.Errorf("remoteHelperFor(%q) = %q, %q, %v, want %q, %q, %v", test.url, helper, address, ok, test.helper, test.address, test.ok)
+		}
+	}
+}
+
+func TestRemoteHelperPushAndFetch(t *testing.T) {
+	url := installTestRemoteHelper(t)
+
+	testRepository(t)
+	first := writeTestCommit(t, "first")
+	second := writeTestCommit(t, "second", first)
+	if err := updateRef("refs/heads/main", second); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := pushRemote(url, []string{"main"}, pushOptions{}, &out)
+	if err != nil || !ok {
+		t.Fatalf("push failed: %v\n%s", err, out.String())
+	}
+	if want := " * [new branch]      main -> main\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("push reported\n%s\nwant a line %q", out.String(), want)
+	}
+
+	refs, err := listRemoteRefs(url, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]string{}
+	for _, r := range refs {
+		listed[r.name] = r.sha
+	}
+	if listed["refs/heads/main"] != second || listed["HEAD"] != second {
+		t.Errorf("the helper lists %v, want HEAD and refs/heads/main at %s", refs, second)
+	}
+
+	// a new repository gets everything back through the helper
+	testRepository(t)
+	writeTestRemoteConfig(t, url)
+	out.Reset()
+	ok, err = fetchRemote("origin", nil, fetchOptions{}, &out)
+	if err != nil || !ok {
+		t.Fatalf("fetch failed: %v\n%s", err, out.String())
+	}
+	if sha, err := readRef("refs/remotes/origin/main"); err != nil || sha != second {
+		t.Errorf("refs/remotes/origin/main is %s (%v), want %s", sha, err, second)
+	}
+	for _, sha := range []string{first, second} {
+		if !objects.Has(sha) {
+			t.Errorf("commit %s wasn't fetched", sha)
+		}
+	}
+	if want := " * [new branch]      main       -> origin/main\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("fetch reported\n%s\nwant a line %q", out.String(), want)
+	}
+}
+
+func TestRemoteHelperPushNonFastForward(t *testing.T) {
+	url := installTestRemoteHelper(t)
+
+	testRepository(t)
+	base := writeTestCommit(t, "base")
+	ours := writeTestCommit(t, "ours", base)
+	theirs := writeTestCommit(t, "theirs", base)
+	if err := updateRef("refs/heads/main", ours); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pushRemote(url, []string{"main"}, pushOptions{}, &bytes.Buffer{}); err != nil || !ok {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	if err := updateRef("refs/heads/main", theirs); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	ok, err := pushRemote(url, []string{"main"}, pushOptions{}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || !strings.Contains(out.String(), "[rejected]        main -> main (non-fast-forward)") {
+		t.Errorf("a push that isn't a fast-forward should be rejected, got\n%s", out.String())
+	}
+
+	// forced, the helper is asked to push +refs/heads/main:refs/heads/main
+	out.Reset()
+	ok, err = pushRemote(url, []string{"+main"}, pushOptions{}, &out)
+	if err != nil || !ok {
+		t.Fatalf("forced push failed: %v\n%s", err, out.String())
+	}
+	refs, err := listRemoteRefs(url, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range refs {
+		if r.name == "refs/heads/main" && r.sha != theirs {
+			t.Errorf("refs/heads/main of the remote is %s after a forced push, want %s", r.sha, theirs)
+		}
+	}
+}
+
+func TestPrePushHook(t *testing.T) {
+	url := installTestRemoteHelper(t)
+
+	testRepository(t)
+	sha := writeTestCommit(t, "first")
+	if err := updateRef("refs/heads/main", sha); err != nil {
+		t.Fatal(err)
+	}
+	// the hook saves what it's given, and refuses the push
+	hook := "#!/bin/sh\necho \"$@\" > args\ncat > input\nexit 1\n"
+	if err := os.MkdirAll(gitPath("hooks"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gitPath("hooks/pre-push"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := pushRemote(url, []string{"main"}, pushOptions{}, &bytes.Buffer{})
+	if err != nil || ok {
+		t.Fatalf("push refused by pre-push returned %v, %v", ok, err)
+	}
+	if args, _ := os.ReadFile("args"); string(args) != url+" "+url+"\n" {
+		t.Errorf("pre-push was given %q", args)
+	}
+	if input, _ := os.ReadFile("input"); string(input) != "refs/heads/main "+sha+" refs/heads/main "+zeroSha+"\n" {
+		t.Errorf("pre-push read %q", input)
+	}
+	if refs, err := listRemoteRefs(url, url); err != nil || len(refs) != 0 {
+		t.Errorf("the remote has %v (%v) after a refused push", refs, err)
+	}
+
+	if ok, err := pushRemote(url, []string{"main"}, pushOptions{noVerify: true}, &bytes.Buffer{}); err != nil || !ok {
+		t.Errorf("push with --no-verify returned %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Modes used in tree entries. Trees are written without a leading zero.
+const (
+	modeTree       = "40000"
+	modeFile       = "100644"
+	modeExecutable = "100755"
+	modeSymlink    = "120000"
+	modeSubmodule  = "160000"
+)
+
+// emptyTreeSha is the name of the tree without any entries.
+const emptyTreeSha = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// treeEntry is a single entry of a tree object.
+type treeEntry struct {
+	mode string
+	name string
+	sha  string
+}
+
+func (e treeEntry) isTree() bool {
+	return e.mode == modeTree
+}
+
+// objectType is the type of the object an entry points to: a tree, the
+// commit of a submodule, or a blob.
+func (e treeEntry) objectType() string {
+	switch e.mode {
+	case modeTree:
+		return "tree"
+	case modeSubmodule:
+		return "commit"
+	}
+	return "blob"
+}
+
+// writeTreeListing lists the entries of a tree the way `git cat-file -p`
+// and `git ls-tree` do:
+//
+//	<mode> <type> <sha>\t<name>
+func writeTreeListing(w io.Writer, entries []treeEntry) {
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s %s %s\t%s\n", fullMode(entry.mode), entry.objectType(), entry.sha, entry.name)
+	}
+}
+
+// parseTree parses the content of a tree object (without its header).
+//
+// A tree is a list of entries, each being:
+//
+//	<mode> <name>\0<20-byte sha>
+func parseTree(content []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+
+	for len(content) > 0 {
+		space := bytes.IndexByte(content, ' ')
+		nul := bytes.IndexByte(content, 0)
+		if space < 0 || nul < space || nul+21 > len(content) {
+			return nil, fmt.Errorf("malformed tree entry")
+		}
+
+		entries = append(entries, treeEntry{
+			mode: string(content[:space]),
+			name: string(content[space+1 : nul]),
+			sha:  hex.EncodeToString(content[nul+1 : nul+21]),
+		})
+		content = content[nul+21:]
+	}
+
+	return entries, nil
+}
+
+// readTree reads and parses the tree object with the given sha.
+func readTree(sha string) ([]treeEntry, error) {
+	objectType, content, err := readObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if objectType != "tree" {
+		return nil, fmt.Errorf("object '%s' is a %s, not a tree", sha, objectType)
+	}
+
+	return parseTree(content)
+}
+
+// sortTreeEntries sorts entries the way git expects them in a tree: by name,
+// where a subtree sorts as if its name ended with a '/'.
+func sortTreeEntries(entries []treeEntry) {
+	key := func(e treeEntry) string {
+		if e.isTree() {
+			return e.name + "/"
+		}
+		return e.name
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+}
+
+// encodeTree serializes entries into the content of a tree object.
+func encodeTree(entries []treeEntry) []byte {
+	sortTreeEntries(entries)
+
+	var content bytes.Buffer
+	for _, entry := range entries {
+		sha, _ := hex.DecodeString(entry.sha)
+		fmt.Fprintf(&content, "%s %s\x00", entry.mode, entry.name)
+		content.Write(sha)
+	}
+	return content.Bytes()
+}
+
+// flattenTree reads a tree recursively and returns all the non-tree entries,
+// keyed by their full path.
+func flattenTree(sha string) (map[string]treeEntry, error) {
+	files := map[string]treeEntry{}
+
+	var walk func(sha string, prefix string) error
+	walk = func(sha string, prefix string) error {
+		entries, err := readTree(sha)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.isTree() {
+				if err := walk(entry.sha, prefix+entry.name+"/"); err != nil {
+					return err
+				}
+				continue
+			}
+			files[prefix+entry.name] = entry
+		}
+		return nil
+	}
+
+	return files, walk(sha, "")
+}
+
+// lookupTreePath finds the entry at path, eg: cmd/mygit/main.go, in a tree,
+// reading only the trees along the way. It returns false when there's
+// nothing at path; the empty tree ("") never has anything.
+func lookupTreePath(sha string, path string) (treeEntry, bool, error) {
+	entry := treeEntry{mode: modeTree, sha: sha}
+	for _, name := range strings.Split(path, "/") {
+		if !entry.isTree() || entry.sha == "" {
+			return treeEntry{}, false, nil
+		}
+
+		entries, err := readTree(entry.sha)
+		if err != nil {
+			return treeEntry{}, false, err
+		}
+
+		found := false
+		for _, child := range entries {
+			if child.name == name {
+				entry, found = child, true
+				break
+			}
+		}
+		if !found {
+			return treeEntry{}, false, nil
+		}
+	}
+	return entry, true, nil
+}
+
+// writeTreeFromFiles writes the trees for a flat list of files keyed by
+// their full path, and returns the sha of the top-level tree.
+func writeTreeFromFiles(files map[string]treeEntry) (string, error) {
+	return buildTree(files, writeObject)
+}
+
+// buildTree builds the trees for a flat list of files keyed by their full
+// path, storing each one with write. Passing a write that only hashes gives
+// the sha of the top-level tree without touching the object database.
+func buildTree(files map[string]treeEntry, write func(string, []byte) (string, error)) (string, error) {
+	var entries []treeEntry
+	subtrees := map[string]map[string]treeEntry{}
+
+	for path, entry := range files {
+		dir, rest, nested := strings.Cut(path, "/")
+		if !nested {
+			entry.name = path
+			entries = append(entries, entry)
+			continue
+		}
+
+		if subtrees[dir] == nil {
+			subtrees[dir] = map[string]treeEntry{}
+		}
+		subtrees[dir][rest] = entry
+	}
+
+	for dir, subtree := range subtrees {
+		sha, err := buildTree(subtree, write)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, treeEntry{mode: modeTree, name: dir, sha: sha})
+	}
+
+	return write("tree", encodeTree(entries))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// updateRefCmd implements `git update-ref [--no-deref] (-d <ref> [<old-value>] | <ref> <new-value> [<old-value>])`
+//
+// It points a ref at an object, or deletes it with -d, eg:
+//
+//	$ git update-ref refs/heads/topic main
+//
+// The ref is taken as is, refs/heads/topic and not just topic, and a
+// symbolic ref like HEAD updates the ref it points to, unless --no-deref.
+// A branch can only point at a commit.
+//
+// The ref is locked meanwhile, see AcquireLock, so when another process is
+// updating it, update-ref fails instead of racing with it.
+//
+// With <old-value>, it's a compare-and-swap: the ref is only updated, or
+// deleted, when it still points at <old-value>, see updateRefIf. An empty
+// <old-value>, or 40 zeros, means the ref must not exist yet:
+//
+//	$ git update-ref refs/heads/topic main ""
+func updateRefCmd(args []string) {
+	flag := flag.NewFlagSet("git update-ref", flag.ExitOnError)
+	var (
+		remove  = flag.Bool("d", false, "delete the ref")
+		noDeref = flag.Bool("no-deref", false, "update a symbolic ref itself, not the ref it points to")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if *remove && (len(args) < 1 || len(args) > 2) || !*remove && (len(args) < 2 || len(args) > 3) {
+		fmt.Fprintln(os.Stderr, "usage: git update-ref [--no-deref] -d <refname> [<old-val>]")
+		fmt.Fprintln(os.Stderr, "   or: git update-ref [--no-deref] <refname> <new-val> [<old-val>]")
+		os.Exit(129)
+	}
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	name := args[0]
+	for depth := 0; !*noDeref; depth++ {
+		target, symbolic, err := readSymbolicRef(name)
+		if err != nil {
+			fail(err)
+		}
+		if !symbolic {
+			break
+		}
+		if depth == 5 {
+			fail(fmt.Errorf("symbolic ref '%s' nests too deep", args[0]))
+		}
+		name = target
+	}
+
+	// the old value comes last, after the new one unless deleting
+	var old string
+	checkOld := *remove && len(args) == 2 || len(args) == 3
+	if checkOld {
+		old = args[len(args)-1]
+		if old == nullSha {
+			old = ""
+		} else if old != "" {
+			sha, err := resolveRevision(old)
+			if err != nil {
+				fail(fmt.Errorf("%s: not a valid old SHA1", old))
+			}
+			old = sha
+		}
+	}
+
+	if *remove {
+		var err error
+		if checkOld {
+			err = deleteRefIf(name, old)
+		} else {
+			err = deleteRef(name)
+		}
+		if err != nil {
+			fail(fmt.Errorf("cannot lock ref '%s': %s", name, err))
+		}
+		return
+	}
+
+	sha, err := resolveRevision(args[1])
+	if err != nil {
+		fail(fmt.Errorf("%s: not a valid SHA1", args[1]))
+	}
+	if strings.HasPrefix(name, "refs/heads/") {
+		objectType, _, err := readObject(sha)
+		if err != nil {
+			fail(err)
+		}
+		if objectType != "commit" {
+			fail(fmt.Errorf("update_ref failed for ref '%s': cannot update ref '%s': trying to write non-commit object %s to branch '%s'", name, name, sha, name))
+		}
+	}
+	if checkOld {
+		err = updateRefIf(name, sha, old)
+	} else {
+		err = updateRef(name, sha)
+	}
+	if err != nil {
+		fail(fmt.Errorf("update_ref failed for ref '%s': cannot lock ref '%s': %s", name, name, err))
+	}
+}
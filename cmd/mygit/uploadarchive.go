@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxArchiveArguments is how many arguments a client may send, like git.
+const maxArchiveArguments = 64
+
+// uploadArchive implements `git upload-archive <directory>`
+//
+// It is the server side of `archive --remote`, over stdin and stdout:
+//
+//  1. the client sends the arguments of archive as `argument <arg>`
+//     pkt-lines, and a flush
+//  2. the server answers `ACK` and a flush, or `NACK <reason>` when it
+//     won't make the archive
+//  3. the archive follows on band 1 of a sideband, errors on band 3, and a
+//     flush ends it
+//
+// Only --format and --prefix are accepted. The tree-ish must be a ref, or
+// <ref>:<path>, so that only what's reachable can be archived, unless
+// uploadarchive.allowUnreachable is set.
+func uploadArchive(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git upload-archive <directory>")
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	in := bufio.NewReader(os.Stdin)
+
+	fail := func(err error) {
+		out.Flush()
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	// the client reports the errors sent to it
+	nack := func(err error) {
+		writePktLine(out, "NACK "+err.Error()+"\n")
+		writeFlushPkt(out)
+		out.Flush()
+		os.Exit(128)
+	}
+
+	// the directory is the work tree or, when git is the client, its .git,
+	// unless it is a bare repository
+	dir := args[0]
+	if filepath.Base(dir) == ".git" {
+		dir = filepath.Dir(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil && !isGitDirectory(dir) {
+		fail(fmt.Errorf("'%s' does not appear to be a git repository", args[0]))
+	}
+	if err := os.Chdir(dir); err != nil {
+		fail(err)
+	}
+	if err := setupGitDir(); err != nil {
+		fail(err)
+	}
+
+	var arguments []string
+	for {
+		line, flush, err := readPktLine(in)
+		if err != nil {
+			fail(err)
+		}
+		if flush {
+			break
+		}
+		arg, ok := strings.CutPrefix(line, "argument ")
+		if !ok {
+			nack(fmt.Errorf("'argument' token or flush expected"))
+		}
+		if len(arguments) == maxArchiveArguments {
+			nack(fmt.Errorf("Too many options (>%d)", maxArchiveArguments-1))
+		}
+		arguments = append(arguments, arg)
+	}
+
+	flag := flag.NewFlagSet("git upload-archive", flag.ContinueOnError)
+	flag.SetOutput(io.Discard)
+	var (
+		format = flag.String("format", "tar", "archive format")
+		prefix = flag.String("prefix", "", "prepend prefix to each path in the archive")
+	)
+	if err := flag.Parse(arguments); err != nil {
+		nack(err)
+	}
+	arguments = flag.Args()
+
+	if len(arguments) == 0 {
+		nack(fmt.Errorf("no tree-ish given"))
+	}
+	if !isArchiveFormat(*format) {
+		nack(fmt.Errorf("Unknown archive format '%s'", *format))
+	}
+	if !configBool("uploadarchive.allowUnreachable", false) {
+		name, _, _ := strings.Cut(arguments[0], ":")
+		if _, err := expandRefName(name); err != nil {
+			nack(fmt.Errorf("no such ref: %s", name))
+		}
+	}
+
+	writePktLine(out, "ACK\n")
+	writeFlushPkt(out)
+
+	data := bufio.NewWriterSize(&sideband{w: out, band: 1, max: pktLineMax}, pktLineMax-pktLineHeader-1)
+	err := writeArchive(data, *format, arguments[0], *prefix, arguments[1:])
+	if err == nil {
+		err = data.Flush()
+	}
+	if err != nil {
+		(&sideband{w: out, band: 3, max: pktLineMax}).Write([]byte(err.Error() + "\n"))
+		out.Flush()
+		os.Exit(128)
+	}
+	writeFlushPkt(out)
+	if err := out.Flush(); err != nil {
+		fail(err)
+	}
+}
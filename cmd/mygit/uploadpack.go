@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// uploadPackCapabilities are advertised after the first ref. Packs are
+// written without deltas, so ofs-delta only tells the client that it may
+// get them. Like git, filter is only advertised when uploadpack.allowFilter
+// is true, and objects that no ref points to can only be wanted when
+// uploadpack.allowAnySHA1InWant is, eg: for the lazy fetches of a partial
+// clone, see PromisorStore.
+const uploadPackCapabilities = "multi_ack side-band side-band-64k ofs-delta shallow no-progress"
+
+// zeroSha stands for a missing object in the protocols, eg: the first ref of
+// an empty repository.
+const zeroSha = "0000000000000000000000000000000000000000"
+
+// uploadRequest is what the client asks for before the negotiation.
+type uploadRequest struct {
+	wants        []string
+	capabilities map[string]bool
+	shallows     []string // the commits the client is shallow at
+	depth        int
+	filter       string // the objects left out, see parseObjectFilter
+}
+
+// uploadPack implements `git upload-pack [--stateless-rpc] [--advertise-refs] <directory>`
+//
+// It is the server side of fetch and clone, speaking protocol v0 over stdin
+// and stdout:
+//
+//  1. the refs are advertised, with the capabilities after the first one
+//  2. the client sends `want <sha>` lines, possibly `shallow <sha>` and
+//     `deepen <depth>` for a shallow fetch, `filter <filter-spec>` for a
+//     partial clone, and a flush
+//  3. the new shallow boundary is sent as `shallow` and `unshallow` lines
+//  4. the client sends `have <sha>` lines in rounds ending with a flush, and
+//     gets ACK or NAK for them, until it sends `done`
+//  5. the pack of the objects it wants but doesn't have is sent, over
+//     side-band when asked for
+//
+// With --stateless-rpc, eg: behind http, each request is handled on its
+// own: the refs aren't advertised and a flush during the negotiation ends
+// the exchange. --advertise-refs only advertises the refs.
+func uploadPack(args []string) {
+	flag := flag.NewFlagSet("git upload-pack", flag.ExitOnError)
+	var (
+		statelessRPC  = flag.Bool("stateless-rpc", false, "quit after a single request/response exchange")
+		advertiseRefs = flag.Bool("advertise-refs", false, "only advertise the refs")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: git upload-pack [--stateless-rpc] [--advertise-refs] <directory>")
+		os.Exit(1)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	in := bufio.NewReader(os.Stdin)
+
+	fail := func(err error) {
+		out.Flush()
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	// the directory is the work tree or, when git is the client, its .git,
+	// unless it is a bare repository
+	dir := args[0]
+	if filepath.Base(dir) == ".git" {
+		dir = filepath.Dir(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil && !isGitDirectory(dir) {
+		fail(fmt.Errorf("'%s' does not appear to be a git repository", args[0]))
+	}
+	if err := os.Chdir(dir); err != nil {
+		fail(err)
+	}
+	if err := setupGitDir(); err != nil {
+		fail(err)
+	}
+
+	ours, err := listAdvertisedRefs()
+	if err != nil {
+		fail(err)
+	}
+	if !*statelessRPC || *advertiseRefs {
+		if err := writeRefAdvertisement(out, ours); err != nil {
+			fail(err)
+		}
+		out.Flush()
+	}
+	if *advertiseRefs {
+		return
+	}
+
+	request, err := readUploadRequest(in, ours)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "not our ref") {
+			writePktLine(out, "ERR upload-pack: "+err.Error())
+		}
+		fail(err)
+	}
+	if len(request.wants) == 0 {
+		// eg: ls-remote only wanted the refs
+		return
+	}
+
+	// the parents of the commits that aren't shallow anymore are sent too
+	starts := request.wants
+	var shallow map[string]bool
+	if request.depth > 0 || len(request.shallows) > 0 {
+		var unshallow []string
+		if shallow, unshallow, err = sendShallowInfo(out, request); err != nil {
+			fail(err)
+		}
+		out.Flush()
+
+		for _, sha := range unshallow {
+			node, err := readCommitNode(sha)
+			if err != nil {
+				fail(err)
+			}
+			starts = append(starts, node.parents...)
+		}
+	}
+
+	haves, err := negotiate(in, out, request, *statelessRPC)
+	if err != nil {
+		fail(err)
+	}
+	out.Flush()
+
+	clientShallow := map[string]bool{}
+	for _, sha := range request.shallows {
+		clientShallow[sha] = true
+	}
+	shas, err := objectsToSend(starts, haves, shallow, clientShallow, request.filter)
+	if err != nil {
+		fail(err)
+	}
+
+	var pack io.Writer = out
+	var progress io.Writer = io.Discard
+	if request.capabilities["side-band-64k"] || request.capabilities["side-band"] {
+		max := 1000
+		if request.capabilities["side-band-64k"] {
+			max = pktLineMax
+		}
+		pack = &sideband{w: out, band: 1, max: max}
+		if !request.capabilities["no-progress"] {
+			progress = &sideband{w: out, band: 2, max: max}
+		}
+	}
+
+	// the objects are all found before the pack starts, there's only their
+	// number to report
+	p := startProgress(progress, "Enumerating objects", 0)
+	p.update(len(shas))
+	p.done()
+
+	trace("upload-pack: sending %d objects", len(shas))
+	stats, err := writePack(pack, shas, defaultPackOptions(), nil)
+	if err != nil {
+		if sb, ok := pack.(*sideband); ok {
+			(&sideband{w: out, band: 3, max: sb.max}).Write([]byte(err.Error() + "\n"))
+		}
+		fail(err)
+	}
+	fmt.Fprintln(progress, stats)
+	if _, ok := pack.(*sideband); ok {
+		writeFlushPkt(out)
+	}
+	if err := out.Flush(); err != nil {
+		fail(err)
+	}
+}
+
+// listAdvertisedRefs returns the refs to advertise: HEAD when it points to
+// a commit, then every ref, each annotated tag followed by what it peels to
+// as `<tag>^{}`.
+func listAdvertisedRefs() ([]ref, error) {
+	var advertised []ref
+	if sha, err := readRef("HEAD"); err == nil {
+		advertised = append(advertised, ref{name: "HEAD", sha: sha})
+	}
+
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		advertised = append(advertised, r)
+
+		objectType, _, err := readObject(r.sha)
+		if err != nil || objectType != "tag" {
+			continue
+		}
+		peeled, _, err := peelTag(r.sha)
+		if err != nil {
+			return nil, err
+		}
+		advertised = append(advertised, ref{name: r.name + "^{}", sha: peeled})
+	}
+	return advertised, nil
+}
+
+// writeRefAdvertisement writes one pkt-line per ref and a flush:
+//
+//	<sha> HEAD\0<capabilities>
+//	<sha> refs/heads/main
+//	<sha> refs/tags/v1.0
+//	<sha> refs/tags/v1.0^{}
+//
+// An empty repository only sends its capabilities, on a fake ref.
+func writeRefAdvertisement(w io.Writer, refs []ref) error {
+	capabilities := uploadPackCapabilities
+	if configBool("uploadpack.allowFilter", false) {
+		capabilities += " filter"
+	}
+	if configBool("uploadpack.allowAnySHA1InWant", false) {
+		capabilities += " allow-tip-sha1-in-want allow-reachable-sha1-in-want"
+	}
+	if target, symbolic, err := readSymbolicRef("HEAD"); err == nil && symbolic {
+		capabilities += " symref=HEAD:" + target
+	}
+	capabilities += " object-format=sha1 agent=mygit"
+
+	if len(refs) == 0 {
+		refs = []ref{{name: "capabilities^{}", sha: zeroSha}}
+	}
+	for i, r := range refs {
+		line := r.sha + " " + r.name
+		if i == 0 {
+			line += "\x00" + capabilities
+		}
+		if err := writePktLine(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return writeFlushPkt(w)
+}
+
+// readUploadRequest reads the wants of the client, up to the flush. Only
+// advertised objects can be wanted, unless uploadpack.allowAnySHA1InWant.
+func readUploadRequest(r *bufio.Reader, ours []ref) (*uploadRequest, error) {
+	advertised := map[string]bool{}
+	for _, ref := range ours {
+		advertised[ref.sha] = true
+	}
+	anyWanted := configBool("uploadpack.allowAnySHA1InWant", false)
+
+	request := &uploadRequest{capabilities: map[string]bool{}}
+	for {
+		line, flush, err := readPktLine(r)
+		if err == io.EOF && len(request.wants) == 0 {
+			// the client hung up after the advertisement
+			return request, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return request, nil
+		}
+
+		command, arg, _ := strings.Cut(line, " ")
+		switch command {
+		case "want":
+			sha, capabilities, _ := strings.Cut(arg, " ")
+			if !isObjectName(sha) {
+				return nil, fmt.Errorf("git upload-pack: protocol error, expected to get object ID, not '%s'", line)
+			}
+			if !advertised[sha] && !(anyWanted && objects.Has(sha)) {
+				return nil, fmt.Errorf("not our ref %s", sha)
+			}
+			if len(request.wants) == 0 {
+				for _, capability := range strings.Fields(capabilities) {
+					request.capabilities[capability] = true
+				}
+			}
+			request.wants = append(request.wants, sha)
+
+		case "shallow":
+			if !isObjectName(arg) {
+				return nil, fmt.Errorf("git upload-pack: protocol error, expected to get object ID, not '%s'", line)
+			}
+			request.shallows = append(request.shallows, arg)
+
+		case "deepen":
+			depth, err := strconv.Atoi(arg)
+			if err != nil || depth <= 0 {
+				return nil, fmt.Errorf("git upload-pack: protocol error, invalid depth '%s'", arg)
+			}
+			request.depth = depth
+
+		case "filter":
+			if !configBool("uploadpack.allowFilter", false) {
+				return nil, fmt.Errorf("git upload-pack: filtering capability not negotiated")
+			}
+			if err := parseObjectFilter(arg); err != nil {
+				return nil, err
+			}
+			request.filter = arg
+
+		default:
+			return nil, fmt.Errorf("git upload-pack: protocol error, expected to get object ID, not '%s'", line)
+		}
+	}
+}
+
+// parseObjectFilter checks a filter-spec, which says the objects to leave
+// out of a pack. Only blob:none, no blobs at all, is supported.
+func parseObjectFilter(spec string) error {
+	if spec != "blob:none" {
+		return fmt.Errorf("invalid filter-spec '%s'", spec)
+	}
+	return nil
+}
+
+// sendShallowInfo tells the client where its history will be cut: a
+// `shallow` line for each new boundary commit it isn't already shallow at,
+// and an `unshallow` line for each of its shallow commits that gets its
+// parents now. It returns the boundary and the unshallowed commits.
+//
+// With a depth of n, the boundary are the commits n-1 parents away from the
+// wanted ones, the wanted commits being at depth 1.
+func sendShallowInfo(w io.Writer, request *uploadRequest) (map[string]bool, []string, error) {
+	clientShallow := map[string]bool{}
+	for _, sha := range request.shallows {
+		clientShallow[sha] = true
+	}
+
+	boundary := map[string]bool{}
+	if request.depth == 0 {
+		// not deepening, the history stays cut where the client has it cut
+		for sha := range clientShallow {
+			boundary[sha] = true
+		}
+		return boundary, nil, writeFlushPkt(w)
+	}
+
+	// breadth first, so each commit gets the shortest depth
+	depths := map[string]int{}
+	var queue []string
+	for _, sha := range request.wants {
+		sha, objectType, err := peelTag(sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, seen := depths[sha]; !seen && objectType == "commit" {
+			depths[sha] = 1
+			queue = append(queue, sha)
+		}
+	}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if depths[sha] >= request.depth {
+			boundary[sha] = true
+			continue
+		}
+
+		node, err := readCommitNode(sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, parent := range node.parents {
+			if _, seen := depths[parent]; !seen {
+				depths[parent] = depths[sha] + 1
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	for _, sha := range sortedKeys(boundary) {
+		if !clientShallow[sha] {
+			if err := writePktLine(w, "shallow "+sha+"\n"); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	var unshallow []string
+	for _, sha := range request.shallows {
+		if _, reached := depths[sha]; reached && !boundary[sha] {
+			if err := writePktLine(w, "unshallow "+sha+"\n"); err != nil {
+				return nil, nil, err
+			}
+			unshallow = append(unshallow, sha)
+		}
+	}
+	return boundary, unshallow, writeFlushPkt(w)
+}
+
+// sortedKeys returns the keys of a set, sorted.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// negotiate finds the objects the client already has from its `have`
+// lines, until it sends `done`. It returns these common objects.
+//
+// With multi_ack, every common object is acknowledged with `ACK <sha>
+// continue` and every round ends with a NAK, so the client can keep looking
+// on other lines of history. An object we don't know is acknowledged as
+// well once every wanted commit reaches a common one, to tell the client it
+// can stop. Without multi_ack, only the first common object is
+// acknowledged.
+func negotiate(r *bufio.Reader, w *bufio.Writer, request *uploadRequest, statelessRPC bool) ([]string, error) {
+	multiAck := request.capabilities["multi_ack"]
+
+	var common []string
+	theyHave := map[string]bool{}
+	for {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if flush {
+			if len(common) == 0 || multiAck {
+				writePktLine(w, "NAK\n")
+			}
+			if statelessRPC {
+				w.Flush()
+				os.Exit(0)
+			}
+			w.Flush()
+			continue
+		}
+
+		if line == "done" {
+			if len(common) == 0 {
+				return common, writePktLine(w, "NAK\n")
+			}
+			if multiAck {
+				return common, writePktLine(w, "ACK "+common[len(common)-1]+"\n")
+			}
+			return common, nil
+		}
+
+		sha, found := strings.CutPrefix(line, "have ")
+		if !found || !isObjectName(sha) {
+			return nil, fmt.Errorf("git upload-pack: expected SHA1 list, got '%s'", line)
+		}
+
+		if !objects.Has(sha) || theyHave[sha] {
+			ok, err := okToGiveUp(request.wants, theyHave)
+			if err != nil {
+				return nil, err
+			}
+			if multiAck && ok {
+				writePktLine(w, "ACK "+sha+" continue\n")
+			}
+			continue
+		}
+
+		theyHave[sha] = true
+		if node, err := readCommitNode(sha); err == nil {
+			for _, parent := range node.parents {
+				theyHave[parent] = true
+			}
+		}
+		common = append(common, sha)
+
+		if multiAck {
+			writePktLine(w, "ACK "+sha+" continue\n")
+		} else if len(common) == 1 {
+			writePktLine(w, "ACK "+sha+"\n")
+		}
+	}
+}
+
+// okToGiveUp reports whether every wanted commit reaches a commit the
+// client has, in which case sending more haves won't make the pack smaller.
+func okToGiveUp(wants []string, theyHave map[string]bool) (bool, error) {
+	if len(theyHave) == 0 {
+		return false, nil
+	}
+
+	for _, want := range wants {
+		// a tag is wanted for what it points to
+		want, objectType, err := peelTag(want)
+		if err != nil {
+			return false, err
+		}
+		if objectType != "commit" {
+			continue
+		}
+		reached := false
+		err = walkCommits([]string{want}, func(node *commitNode) bool {
+			reached = theyHave[node.sha]
+			return !reached
+		})
+		if err != nil {
+			return false, err
+		}
+		if !reached {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// objectsToSend lists the objects reachable from wants but not from haves.
+//
+// History isn't walked past the commits in shallow, the boundary of a
+// shallow fetch, nor past the commits in clientShallow when walking from
+// haves, as the client doesn't have their parents.
+//
+// Like git, only the trees of the commits at the edge of what the client
+// has are walked to find the files it already has.
+//
+// A filter leaves out the objects it says, see parseObjectFilter, but the
+// ones wanted directly.
+func objectsToSend(wants []string, haves []string, shallow map[string]bool, clientShallow map[string]bool, filter string) ([]string, error) {
+	// everything reachable from haves
+	uninteresting := map[string]bool{}
+	edges := map[string]bool{}
+	stack := []string{}
+	for _, sha := range haves {
+		if sha, objectType, err := peelTag(sha); err == nil && objectType == "commit" {
+			stack = append(stack, sha)
+			edges[sha] = true
+		}
+	}
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if uninteresting[sha] {
+			continue
+		}
+		uninteresting[sha] = true
+
+		if clientShallow[sha] {
+			continue
+		}
+		node, err := readCommitNode(sha)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, node.parents...)
+	}
+
+	var shas, trees []string
+	seen := map[string]bool{}
+	stack = append(stack, wants...)
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[sha] || uninteresting[sha] {
+			continue
+		}
+		seen[sha] = true
+
+		objectType, content, err := readObject(sha)
+		if err != nil {
+			return nil, err
+		}
+		switch objectType {
+		case "tag":
+			t, err := parseTag(content)
+			if err != nil {
+				return nil, err
+			}
+			shas = append(shas, sha)
+			stack = append(stack, t.object)
+
+		case "commit":
+			c, err := parseCommit(content)
+			if err != nil {
+				return nil, err
+			}
+			shas = append(shas, sha)
+			trees = append(trees, c.tree)
+			if shallow[sha] || isShallow(sha) {
+				continue
+			}
+			for _, parent := range c.parents {
+				if uninteresting[parent] {
+					edges[parent] = true
+				}
+			}
+			stack = append(stack, c.parents...)
+
+		default:
+			// a tree or blob wanted directly, walked below
+			delete(seen, sha)
+			trees = append(trees, sha)
+		}
+	}
+
+	for sha := range edges {
+		c, err := readCommit(sha)
+		if err != nil {
+			return nil, err
+		}
+		if err := walkTreeObjects(c.tree, seen, true, func(string) {}); err != nil {
+			return nil, err
+		}
+	}
+	for _, tree := range trees {
+		if err := walkTreeObjects(tree, seen, filter != "blob:none", func(sha string) { shas = append(shas, sha) }); err != nil {
+			return nil, err
+		}
+	}
+
+	return shas, nil
+}
+
+// walkTreeObjects calls visit for a tree and every tree and blob under it,
+// or only the trees without blobs, skipping the ones in seen and submodule
+// commits. Visited objects are added to seen.
+func walkTreeObjects(sha string, seen map[string]bool, blobs bool, visit func(sha string)) error {
+	if seen[sha] {
+		return nil
+	}
+	seen[sha] = true
+	visit(sha)
+
+	objectType, content, err := readObject(sha)
+	if err != nil {
+		return err
+	}
+	if objectType != "tree" {
+		return nil
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		switch {
+		case entry.mode == modeTree:
+			if err := walkTreeObjects(entry.sha, seen, blobs, visit); err != nil {
+				return err
+			}
+		case entry.mode == modeSubmodule || !blobs || seen[entry.sha]:
+		default:
+			// blobs aren't read, eg: the ones a partial clone left out
+			seen[entry.sha] = true
+			visit(entry.sha)
+		}
+	}
+	return nil
+}
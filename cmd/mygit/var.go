@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// defaultBranch is the branch of a new repository, init.defaultBranch or
+// main.
+func defaultBranch() string {
+	if branch, ok := configGet("init.defaultBranch"); ok && branch != "" {
+		return branch
+	}
+	return "main"
+}
+
+// sequenceEditorCommand is the editor of the todo list of an interactive
+// rebase: $GIT_SEQUENCE_EDITOR, [sequence] editor, or else the editor, see
+// editorCommand.
+func sequenceEditorCommand() string {
+	if editor, ok := os.LookupEnv("GIT_SEQUENCE_EDITOR"); ok {
+		return editor
+	}
+	if editor, ok := configGet("sequence.editor"); ok {
+		return editor
+	}
+	return editorCommand()
+}
+
+// logicalVars are the variables of `git var`, in the order -l lists them.
+var logicalVars = []struct {
+	name  string
+	value func() (string, error)
+}{
+	{"GIT_COMMITTER_IDENT", func() (string, error) { return makeIdent("COMMITTER") }},
+	{"GIT_AUTHOR_IDENT", func() (string, error) { return makeIdent("AUTHOR") }},
+	{"GIT_EDITOR", func() (string, error) { return editorCommand(), nil }},
+	{"GIT_SEQUENCE_EDITOR", func() (string, error) { return sequenceEditorCommand(), nil }},
+	{"GIT_PAGER", func() (string, error) {
+		if pager := pagerCommand(); pager != "" {
+			return pager, nil
+		}
+		return "cat", nil
+	}},
+	{"GIT_DEFAULT_BRANCH", func() (string, error) { return defaultBranch(), nil }},
+}
+
+// varCmd implements `git var (-l | <variable>)`
+//
+// It prints what git would use for one of its logical variables, taken
+// from the environment, the config or the defaults, eg: for a script
+// that needs the editor:
+//
+//	$ git var GIT_EDITOR
+//	vim
+//
+// The variables are GIT_AUTHOR_IDENT and GIT_COMMITTER_IDENT, see
+// makeIdent, GIT_EDITOR, GIT_SEQUENCE_EDITOR, GIT_PAGER and
+// GIT_DEFAULT_BRANCH. -l lists the config, then the variables, as
+// <name>=<value>, leaving out an ident that can't be made.
+func varCmd(args []string) {
+	flag := flag.NewFlagSet("git var", flag.ExitOnError)
+	list := flag.Bool("l", false, "list the config and the logical variables")
+	flag.Parse(args)
+	args = flag.Args()
+
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: git var (-l | <variable>)")
+		os.Exit(129)
+	}
+
+	if *list {
+		if len(args) != 0 {
+			usage()
+		}
+		for _, entry := range loadConfig() {
+			if entry.noValue {
+				fmt.Println(entry.key)
+			} else {
+				fmt.Printf("%s=%s\n", entry.key, entry.value)
+			}
+		}
+		for _, v := range logicalVars {
+			if value, err := v.value(); err == nil {
+				fmt.Printf("%s=%s\n", v.name, value)
+			}
+		}
+		return
+	}
+
+	if len(args) != 1 {
+		usage()
+	}
+	for _, v := range logicalVars {
+		if v.name != args[0] {
+			continue
+		}
+		value, err := v.value()
+		if err != nil {
+			error := fmt.Sprintf("fatal: %s", err)
+			fmt.Fprintln(os.Stderr, error)
+			os.Exit(128)
+		}
+		fmt.Println(value)
+		return
+	}
+	usage()
+}
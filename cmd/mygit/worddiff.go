@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// wordSpan is a word of a text, by its offsets in the text.
+type wordSpan struct {
+	begin, end int
+}
+
+// isSpace is C's isspace, what git splits words on.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// splitWords finds the words of a text: the runs of non-whitespace, or the
+// matches of re. Like git, a match stops at the end of its line, an empty
+// match ends the words and, after the last match of re, the rest of the
+// text is split on whitespace.
+func splitWords(text string, re *regexp.Regexp) []wordSpan {
+	var words []wordSpan
+	for i := 0; i < len(text); {
+		if re != nil {
+			if match := re.FindStringIndex(text[i:]); match != nil {
+				begin, end := i+match[0], i+match[1]
+				if newline := strings.IndexByte(text[begin:end], '\n'); newline >= 0 {
+					end = begin + newline
+				}
+				if begin >= end {
+					break
+				}
+				words = append(words, wordSpan{begin, end})
+				i = end
+				continue
+			}
+		}
+
+		for i < len(text) && isSpace(text[i]) {
+			i++
+		}
+		if i == len(text) {
+			break
+		}
+		end := i + 1
+		for end < len(text) && !isSpace(text[end]) {
+			end++
+		}
+		words = append(words, wordSpan{i, end})
+		i = end
+	}
+	return words
+}
+
+// wordMark is how a --word-diff mode shows a run of words.
+type wordMark struct {
+	prefix, suffix, color string
+}
+
+// wordDiffStyle is how a --word-diff mode shows the removed, added and
+// unchanged words, and the newlines between them.
+type wordDiffStyle struct {
+	removed, added, context wordMark
+	newline                 string
+}
+
+// wordDiffStyles are the modes of --word-diff:
+//
+//	plain        one [-two-]{+TWO+} three
+//	color        the same without the markers, in colors only
+//	porcelain    a line per run of words, for scripts
+//
+// In porcelain, a run of words starts with -, + or a space, like the lines
+// of a patch, and ~ stands for a newline of the text:
+//
+//	 one
+//	-two
+//	+TWO
+//	  three
+//	~
+var wordDiffStyles = map[string]wordDiffStyle{
+	"plain": {
+		removed: wordMark{"[-", "-]", colorRed},
+		added:   wordMark{"{+", "+}", colorGreen},
+		newline: "\n",
+	},
+	"color": {
+		removed: wordMark{"", "", colorRed},
+		added:   wordMark{"", "", colorGreen},
+		newline: "\n",
+	},
+	"porcelain": {
+		removed: wordMark{"-", "\n", colorRed},
+		added:   wordMark{"+", "\n", colorGreen},
+		context: wordMark{" ", "\n", ""},
+		newline: "~\n",
+	},
+}
+
+// writeWordDiff writes the lines of a hunk the way --word-diff does: each
+// run of removed and added lines is diffed word by word, and written as the
+// new text with the removed and added words shown in the given style.
+// Context lines are written without their leading space:
+//
+//	one [-two-]{+TWO+} three
+func writeWordDiff(w io.Writer, script []diffLine, re *regexp.Regexp, style wordDiffStyle) {
+	var minus, plus strings.Builder
+	flush := func() {
+		writeChangedWords(w, minus.String(), plus.String(), re, style)
+		minus.Reset()
+		plus.Reset()
+	}
+
+	for _, line := range script {
+		switch line.kind {
+		case '-':
+			minus.WriteString(line.text)
+		case '+':
+			plus.WriteString(line.text)
+		default:
+			flush()
+			// like git, the line is reset after, even without a color
+			text := style.context.prefix + strings.TrimSuffix(line.text, "\n")
+			io.WriteString(w, colored("", text)+style.context.suffix+style.newline)
+		}
+	}
+	flush()
+}
+
+// writeChangedWords writes the word diff of removed lines (minus) replaced
+// by added ones (plus). The text between the words comes from plus, so only
+// the whitespace of removed words is lost.
+func writeChangedWords(w io.Writer, minus string, plus string, re *regexp.Regexp, style wordDiffStyle) {
+	if minus == "" && plus == "" {
+		return
+	}
+	if plus == "" {
+		writeWords(w, style.removed, style.newline, minus)
+		if !strings.HasSuffix(minus, "\n") {
+			io.WriteString(w, style.newline)
+		}
+		return
+	}
+
+	a, b := splitWords(minus, re), splitWords(plus, re)
+	words := func(text string, spans []wordSpan) []string {
+		result := make([]string, len(spans))
+		for i, span := range spans {
+			result[i] = text[span.begin:span.end]
+		}
+		return result
+	}
+	removed, added := diffLines(words(minus, a), words(plus, b))
+
+	written := 0
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && !removed[i] && !added[j] {
+			i++
+			j++
+			continue
+		}
+
+		firstRemoved, firstAdded := i, j
+		for i < len(a) && removed[i] {
+			i++
+		}
+		for j < len(b) && added[j] {
+			j++
+		}
+		if i == firstRemoved && j == firstAdded {
+			break
+		}
+
+		// without added words, the removed ones go after the previous word
+		plusBegin, plusEnd := 0, 0
+		if j > firstAdded {
+			plusBegin, plusEnd = b[firstAdded].begin, b[j-1].end
+		} else if j > 0 {
+			plusBegin, plusEnd = b[j-1].end, b[j-1].end
+		}
+
+		writeWords(w, style.context, style.newline, plus[written:plusBegin])
+		if i > firstRemoved {
+			writeWords(w, style.removed, style.newline, minus[a[firstRemoved].begin:a[i-1].end])
+		}
+		if j > firstAdded {
+			writeWords(w, style.added, style.newline, plus[plusBegin:plusEnd])
+		}
+		written = plusEnd
+	}
+
+	writeWords(w, style.context, style.newline, plus[written:])
+	if !strings.HasSuffix(plus, "\n") {
+		io.WriteString(w, style.newline)
+	}
+}
+
+// writeWords writes text with the mark, line by line, so that each line of
+// the output has its own, and newline for each newline of the text.
+func writeWords(w io.Writer, mark wordMark, newline string, text string) {
+	for {
+		line, rest, found := strings.Cut(text, "\n")
+		if line != "" {
+			line = mark.prefix + line + mark.suffix
+			if mark.color != "" {
+				line = colored(mark.color, line)
+			}
+			io.WriteString(w, line)
+		}
+		if !found {
+			return
+		}
+		io.WriteString(w, newline)
+		text = rest
+	}
+}
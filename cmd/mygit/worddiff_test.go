@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+// testWordDiff word-diffs the lines of before and after the way a hunk of
+// --word-diff=<mode> shows them.
+func testWordDiff(before string, after string, re *regexp.Regexp, mode string) string {
+	script := editScript(splitLines([]byte(before)), splitLines([]byte(after)), nil)
+	var out bytes.Buffer
+	writeWordDiff(&out, script, re, wordDiffStyles[mode])
+	return out.String()
+}
+
+func TestWordDiffSingleWord(t *testing.T) {
+	tests := []struct {
+		before, after, want string
+	}{
+		{"one two three\n", "one TWO three\n", "one [-two-]{+TWO+} three\n"},
+		{"first word\n", "FIRST word\n", "[-first-]{+FIRST+} word\n"},
+		{"last word\n", "last WORD\n", "last [-word-]{+WORD+}\n"},
+		{"one two three\n", "one three\n", "one[-two-] three\n"},
+		{"one three\n", "one two three\n", "one {+two+} three\n"},
+		{"keep\n", "keep\n", "keep\n"},
+	}
+	for _, test := range tests {
+		if got := testWordDiff(test.before, test.after, nil, "plain"); got != test.want {
+			t.Errorf("%q to %q gives %q, want %q", test.before, test.after, got, test.want)
+		}
+	}
+}
+
+func TestWordDiffPorcelain(t *testing.T) {
+	got := testWordDiff("one two three\n", "one TWO three\n", nil, "porcelain")
+	want := " one \n-two\n+TWO\n  three\n~\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWordDiffRegex(t *testing.T) {
+	re := regexp.MustCompile("[a-z]+")
+	if got, want := testWordDiff("f(a,b)\n", "f(a,c)\n", re, "plain"), "f(a,[-b-]{+c+})\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// without the regex, the whole line is a single word
+	if got, want := testWordDiff("f(a,b)\n", "f(a,c)\n", nil, "plain"), "[-f(a,b)-]{+f(a,c)+}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// worktree is a work tree of the repository, the main one or a linked one.
+type worktree struct {
+	path   string // absolute path of the work tree
+	sha    string // what HEAD points to
+	branch string // the branch checked out, empty when HEAD is detached
+}
+
+// worktreeCmd implements `git worktree add|list`
+//
+// A repository can have several work trees, each with its own HEAD and
+// index but sharing the objects, refs and config. A linked work tree has
+// a .git file instead of a directory (see setupGitDir), pointing to its
+// own git directory in the main one:
+//
+//	.git/worktrees/<name>/HEAD
+//	.git/worktrees/<name>/index
+//	.git/worktrees/<name>/commondir     ../.. (the main .git)
+//	.git/worktrees/<name>/gitdir        <path>/.git (the .git file)
+func worktreeCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: git worktree add [-b <new-branch>] [--detach] <path> [<commit-ish>]")
+		fmt.Fprintln(os.Stderr, "   or: git worktree list [--porcelain]")
+		os.Exit(129)
+	}
+
+	switch args[0] {
+	case "add":
+		worktreeAdd(args[1:])
+	case "list":
+		worktreeList(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown subcommand: `%s'\n", args[0])
+		os.Exit(129)
+	}
+}
+
+// worktreeAdd implements `git worktree add [-b <new-branch>] [--detach] <path> [<commit-ish>]`
+//
+// It checks out the branch, or the commit with a detached HEAD, in a new
+// linked work tree at path. Without a commit-ish, a new branch named after
+// the last component of path is created from HEAD. A branch can only be
+// checked out in one work tree at a time. The post-checkout hook runs in
+// the new work tree once it's checked out.
+func worktreeAdd(args []string) {
+	flag := flag.NewFlagSet("git worktree add", flag.ExitOnError)
+	var (
+		newBranch = flag.String("b", "", "create a new branch")
+		detach    = flag.Bool("detach", false, "detach HEAD at named commit")
+	)
+	flag.Parse(args)
+	args = flag.Args()
+
+	fail := func(err error) {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: git worktree add [-b <new-branch>] [--detach] <path> [<commit-ish>]")
+		os.Exit(129)
+	}
+	path := args[0]
+
+	commitish := "HEAD"
+	if len(args) == 2 {
+		commitish = args[1]
+	}
+
+	// figure out what to check out, and in which branch
+	branch := *newBranch
+	createBranch := branch != ""
+	if len(args) == 2 && !createBranch && !*detach {
+		if _, err := readRef("refs/heads/" + commitish); err == nil {
+			branch = commitish
+		}
+	}
+	if len(args) == 1 && !createBranch && !*detach {
+		branch = filepath.Base(path)
+		createBranch = true
+	}
+
+	sha, err := resolveRevision(commitish)
+	if err == nil {
+		sha, _, err = peelTag(sha)
+	}
+	if err != nil {
+		fail(fmt.Errorf("invalid reference: %s", commitish))
+	}
+	if _, err := readCommit(sha); err != nil {
+		fail(fmt.Errorf("invalid reference: %s", commitish))
+	}
+
+	switch {
+	case createBranch:
+		fmt.Fprintf(os.Stderr, "Preparing worktree (new branch '%s')\n", branch)
+	case branch != "":
+		fmt.Fprintf(os.Stderr, "Preparing worktree (checking out '%s')\n", branch)
+	default:
+		fmt.Fprintf(os.Stderr, "Preparing worktree (detached HEAD %s)\n", sha[:7])
+	}
+
+	if createBranch {
+		if !isBranchName(branch) {
+			fail(fmt.Errorf("'%s' is not a valid branch name", branch))
+		}
+		if _, err := readRef("refs/heads/" + branch); err == nil {
+			fail(fmt.Errorf("a branch named '%s' already exists", branch))
+		}
+	}
+	if branch != "" && !createBranch {
+		worktrees, err := listWorktrees()
+		if err != nil {
+			fail(err)
+		}
+		for _, wt := range worktrees {
+			if wt.branch == "refs/heads/"+branch {
+				fail(fmt.Errorf("'%s' is already checked out at '%s'", branch, wt.path))
+			}
+		}
+	}
+
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 || err != nil && !os.IsNotExist(err) {
+		fail(fmt.Errorf("'%s' already exists", path))
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fail(err)
+	}
+
+	// the git directory is named after the work tree, made unique
+	name := filepath.Base(absPath)
+	worktreeDir := filepath.Join(commonDir, "worktrees", name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(worktreeDir); os.IsNotExist(err) {
+			break
+		}
+		worktreeDir = filepath.Join(commonDir, "worktrees", name+strconv.Itoa(i))
+	}
+	absWorktreeDir, err := filepath.Abs(worktreeDir)
+	if err != nil {
+		fail(err)
+	}
+
+	if createBranch {
+		if err := updateRef("refs/heads/"+branch, sha); err != nil {
+			fail(err)
+		}
+	}
+
+	head := sha + "\n"
+	if branch != "" {
+		head = "ref: refs/heads/" + branch + "\n"
+	}
+	files := []struct {
+		path    string
+		content string
+	}{
+		{filepath.Join(worktreeDir, "HEAD"), head},
+		{filepath.Join(worktreeDir, "commondir"), "../..\n"},
+		{filepath.Join(worktreeDir, "gitdir"), filepath.Join(absPath, ".git") + "\n"},
+		{filepath.Join(path, ".git"), "gitdir: " + absWorktreeDir + "\n"},
+	}
+	for _, file := range files {
+		err := os.MkdirAll(filepath.Dir(file.path), 0750)
+		if err == nil {
+			err = os.WriteFile(file.path, []byte(file.content), 0644)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	// check out from the new work tree, to use its index and attributes
+	if err := os.Chdir(path); err != nil {
+		fail(err)
+	}
+	if err := setupGitDir(); err != nil {
+		fail(err)
+	}
+	c, err := checkoutCommit(sha)
+	if err != nil {
+		fail(err)
+	}
+
+	subject, _, _ := strings.Cut(strings.TrimLeft(c.message, "\n"), "\n")
+	fmt.Printf("HEAD is now at %s %s\n", sha[:7], subject)
+
+	// like git, the work tree is new, so nothing was checked out before
+	if err := runHook("post-checkout", nullSha, sha, "1"); err != nil {
+		os.Exit(1)
+	}
+}
+
+// checkoutCommit writes the files of a commit to an empty work tree, and
+// the index that goes with them, see checkoutFiles.
+func checkoutCommit(sha string) (*commit, error) {
+	c, err := readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	files, err := flattenTree(c.tree)
+	if err != nil {
+		return nil, err
+	}
+	return c, checkoutFiles(files, nil, nil)
+}
+
+// checkoutFiles writes files to an empty work tree, and the index that goes
+// with them. The .gitattributes files are written first, as the others are
+// converted following them.
+//
+// The paths of conflicts get their versions in the index instead, the
+// stages 1, 2 and 3 for the base, ours and theirs, like a merge leaves
+// them, while the file written is the one of files.
+//
+// The paths of kept are left as they are in the work tree, and keep their
+// entries in the index.
+func checkoutFiles(files map[string]treeEntry, conflicts map[string][3]*treeEntry, kept map[string][]indexEntry) error {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		if _, ok := kept[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var attrs *attrMatcher
+	for _, pass := range []bool{true, false} {
+		if !pass {
+			attrs = newAttrMatcher()
+		}
+		for _, path := range paths {
+			if (filepath.Base(path) == ".gitattributes") != pass {
+				continue
+			}
+			if err := writeWorkTreeFile(path, files[path], attrs); err != nil {
+				return err
+			}
+		}
+	}
+
+	idx := &index{version: 2}
+	for _, path := range paths {
+		if _, conflicted := conflicts[path]; conflicted {
+			continue
+		}
+		entry := files[path]
+		mode, _ := strconv.ParseUint(entry.mode, 8, 32)
+		indexed := indexEntry{mode: uint32(mode), sha: entry.sha, path: path}
+		if info, err := os.Lstat(path); err == nil && entry.mode != modeSubmodule {
+			indexed.mtimeSec = uint32(info.ModTime().Unix())
+			indexed.mtimeNsec = uint32(info.ModTime().Nanosecond())
+			indexed.ctimeSec, indexed.ctimeNsec = indexed.mtimeSec, indexed.mtimeNsec
+			indexed.size = uint32(info.Size())
+		}
+		idx.entries = append(idx.entries, indexed)
+	}
+	for _, entries := range kept {
+		idx.entries = append(idx.entries, entries...)
+	}
+	for path, stages := range conflicts {
+		for n, entry := range stages {
+			if entry == nil {
+				continue
+			}
+			mode, _ := strconv.ParseUint(entry.mode, 8, 32)
+			idx.entries = append(idx.entries, indexEntry{mode: uint32(mode), sha: entry.sha, path: path, flags: uint16(n+1) << 12})
+		}
+	}
+	sort.SliceStable(idx.entries, func(i, j int) bool {
+		a, b := idx.entries[i], idx.entries[j]
+		if a.path != b.path {
+			return a.path < b.path
+		}
+		return a.stage() < b.stage()
+	})
+	return writeIndex(idx)
+}
+
+// writeWorkTreeFile writes the file of a tree entry in the work tree,
+// converted following attrs, when not nil, see smudgeText.
+func writeWorkTreeFile(path string, entry treeEntry, attrs *attrMatcher) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	switch entry.mode {
+	case modeSubmodule:
+		return os.MkdirAll(path, 0750)
+	case modeSymlink:
+		_, target, err := readObject(entry.sha)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), path)
+	default:
+		_, content, err := readObject(entry.sha)
+		if err != nil {
+			return err
+		}
+		if attrs != nil {
+			content = smudgeText(content, attrs.attributes(path))
+		}
+		perm := os.FileMode(0644)
+		if entry.mode == modeExecutable {
+			perm = 0755
+		}
+		return os.WriteFile(path, content, perm)
+	}
+}
+
+// localChanges returns the paths whose files were changed since they were
+// added, or added since the commit checked out, sorted.
+func localChanges(idx *index) ([]string, error) {
+	indexed := indexFiles(idx)
+	workTree, err := workTreeFiles(idx, &diffOptions{blobs: map[string][]byte{}})
+	if err != nil {
+		return nil, err
+	}
+	head, err := headFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, change := range append(diffFiles(head, indexed), diffFiles(indexed, workTree)...) {
+		changed[change.path] = true
+	}
+	paths := make([]string, 0, len(changed))
+	for path := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// headFiles returns the files of the commit checked out, none on an
+// unborn branch.
+func headFiles() (map[string]treeEntry, error) {
+	sha, err := resolveRevision("HEAD")
+	if err != nil {
+		return map[string]treeEntry{}, nil
+	}
+	c, err := readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	return flattenTree(c.tree)
+}
+
+// removeIndexedFiles removes the files of the work tree that are in the
+// index, in any stage, and the directories they leave empty. The paths of
+// kept are left alone.
+func removeIndexedFiles(idx *index, kept map[string][]indexEntry) error {
+	for _, entry := range idx.entries {
+		if _, ok := kept[entry.path]; ok {
+			continue
+		}
+		if strconv.FormatUint(uint64(entry.mode), 8) == modeSubmodule {
+			continue
+		}
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// and the directories left empty, up to the top
+		for dir := filepath.Dir(entry.path); dir != "."; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// switchCommit replaces the files of the commit checked out, as listed in
+// the index, with those of another commit, see checkoutCommit. HEAD is left
+// to the caller.
+//
+// Like git, the files changed since they were added, or added since the
+// commit, keep their changes when the other commit has them as they were,
+// and otherwise it refuses to switch rather than lose the changes, see
+// localChangesError. Untracked files are left alone, unless the other
+// commit has them, when it refuses too, see untrackedFilesError; ignored
+// files are overwritten, like git.
+func switchCommit(sha string) (*commit, error) {
+	c, err := readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	files, err := flattenTree(c.tree)
+	if err != nil {
+		return nil, err
+	}
+	return c, switchFiles(files, nil, "checkout")
+}
+
+// switchFiles is switchCommit with the files to check out, and their
+// conflicts, see checkoutFiles. The command is the one refusing to lose
+// local changes: checkout or merge.
+func switchFiles(files map[string]treeEntry, conflicts map[string][3]*treeEntry, command string) error {
+	idx, err := readIndex()
+	if err != nil {
+		return err
+	}
+	changed, err := localChanges(idx)
+	if err != nil {
+		return err
+	}
+	head, err := headFiles()
+	if err != nil {
+		return err
+	}
+	indexed := indexFiles(idx)
+
+	// a change is kept when the path isn't changed from HEAD, or is changed
+	// the same way, and lost otherwise
+	kept := map[string][]indexEntry{}
+	var lost []string
+	for _, path := range changed {
+		target, inTarget := files[path]
+		_, conflicted := conflicts[path]
+		if !conflicted && (sameFile(target, inTarget, head, path) || sameFile(target, inTarget, indexed, path)) {
+			kept[path] = nil
+			continue
+		}
+		lost = append(lost, path)
+	}
+	if len(lost) > 0 {
+		return &localChangesError{paths: lost, command: command}
+	}
+	if untracked := overwrittenUntracked(idx, files, conflicts); len(untracked) > 0 {
+		return &untrackedFilesError{paths: untracked, command: command}
+	}
+	for _, entry := range idx.entries {
+		if _, ok := kept[entry.path]; ok {
+			kept[entry.path] = append(kept[entry.path], entry)
+		}
+	}
+
+	if err := removeIndexedFiles(idx, kept); err != nil {
+		return err
+	}
+	return checkoutFiles(files, conflicts, kept)
+}
+
+// sameFile reports whether the file of path in files is target, or both
+// are missing.
+func sameFile(target treeEntry, inTarget bool, files map[string]treeEntry, path string) bool {
+	entry, ok := files[path]
+	return ok == inTarget && (!ok || entry.sha == target.sha && entry.mode == target.mode)
+}
+
+// localChangesError is the error of switchFiles refusing to lose the local
+// changes of paths.
+type localChangesError struct {
+	paths   []string
+	command string // checkout or merge
+}
+
+func (e *localChangesError) Error() string {
+	action := e.command
+	if e.command == "checkout" {
+		action = "switch branches"
+	}
+	return fmt.Sprintf("Your local changes to the following files would be overwritten by %s:\n\t%s\nPlease commit your changes or stash them before you %s.\nAborting",
+		e.command, strings.Join(e.paths, "\n\t"), action)
+}
+
+// overwrittenUntracked returns the untracked files of the work tree that
+// checking out files, or conflicts, would overwrite, sorted. Ignored files
+// don't count.
+func overwrittenUntracked(idx *index, files map[string]treeEntry, conflicts map[string][3]*treeEntry) []string {
+	tracked := map[string]bool{}
+	for _, entry := range idx.entries {
+		tracked[entry.path] = true
+	}
+	targets := map[string]bool{}
+	for path := range files {
+		targets[path] = true
+	}
+	for path := range conflicts {
+		targets[path] = true
+	}
+
+	ignore := newIgnoreMatcher()
+	var paths []string
+	for path := range targets {
+		if tracked[path] {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil || info.IsDir() || ignore.isIgnored(path, false) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// untrackedFilesError is the error of switchFiles refusing to overwrite
+// untracked files.
+type untrackedFilesError struct {
+	paths   []string
+	command string // checkout or merge
+}
+
+func (e *untrackedFilesError) Error() string {
+	action := e.command
+	if e.command == "checkout" {
+		action = "switch branches"
+	}
+	return fmt.Sprintf("The following untracked working tree files would be overwritten by %s:\n\t%s\nPlease move or remove them before you %s.\nAborting",
+		e.command, strings.Join(e.paths, "\n\t"), action)
+}
+
+// resetCommit makes the index and the work tree those of a commit, like
+// `git reset --hard`, whatever was changed. Untracked files are left alone.
+func resetCommit(sha string) (*commit, error) {
+	idx, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := removeIndexedFiles(idx, nil); err != nil {
+		return nil, err
+	}
+	return checkoutCommit(sha)
+}
+
+// worktreeList implements `git worktree list [--porcelain]`
+//
+// It prints each work tree with its HEAD and branch, the main one first:
+//
+//	/path/to/main    8387040 [main]
+//	/path/to/linked  54663cc (detached HEAD)
+//
+// --porcelain prints a block of lines per work tree instead, for scripts.
+func worktreeList(args []string) {
+	flag := flag.NewFlagSet("git worktree list", flag.ExitOnError)
+	var (
+		porcelain = flag.Bool("porcelain", false, "machine-readable output")
+	)
+	flag.Parse(args)
+
+	worktrees, err := listWorktrees()
+	if err != nil {
+		error := fmt.Sprintf("fatal: %s", err)
+		fmt.Fprintln(os.Stderr, error)
+		os.Exit(128)
+	}
+
+	if *porcelain {
+		for _, wt := range worktrees {
+			fmt.Printf("worktree %s\n", wt.path)
+			fmt.Printf("HEAD %s\n", wt.sha)
+			if wt.branch != "" {
+				fmt.Printf("branch %s\n", wt.branch)
+			} else {
+				fmt.Println("detached")
+			}
+			fmt.Println()
+		}
+		return
+	}
+
+	width := 0
+	for _, wt := range worktrees {
+		width = max(width, len(wt.path))
+	}
+	for _, wt := range worktrees {
+		sha := wt.sha
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		where := "(detached HEAD)"
+		if wt.branch != "" {
+			where = "[" + shortRefName(wt.branch) + "]"
+		}
+		fmt.Printf("%-*s %s %s\n", width+1, wt.path, sha, where)
+	}
+}
+
+// listWorktrees returns the main work tree, then the linked ones sorted by
+// the name of their git directory.
+func listWorktrees() ([]worktree, error) {
+	mainDir, err := filepath.Abs(commonDir)
+	if err != nil {
+		return nil, err
+	}
+	primary := worktree{path: filepath.Dir(mainDir)}
+	primary.sha, primary.branch = readWorktreeHead(commonDir)
+	worktrees := []worktree{primary}
+
+	entries, err := os.ReadDir(filepath.Join(commonDir, "worktrees"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(commonDir, "worktrees", entry.Name())
+		content, err := os.ReadFile(filepath.Join(dir, "gitdir"))
+		if err != nil {
+			continue
+		}
+		wt := worktree{path: filepath.Dir(strings.TrimSpace(string(content)))}
+		wt.sha, wt.branch = readWorktreeHead(dir)
+		worktrees = append(worktrees, wt)
+	}
+	return worktrees, nil
+}
+
+// readWorktreeHead reads the HEAD in the git directory of a work tree, and
+// returns the commit it points to and the branch when it isn't detached.
+func readWorktreeHead(dir string) (string, string) {
+	content, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return zeroSha, ""
+	}
+	head := strings.TrimSpace(string(content))
+	branch, symbolic := strings.CutPrefix(head, "ref: ")
+	if !symbolic {
+		return head, ""
+	}
+	sha, err := readRef(branch)
+	if err != nil {
+		// a branch yet to be born
+		return zeroSha, branch
+	}
+	return sha, branch
+}
+
+// isBranchName checks the few rules of git-check-ref-format that matter
+// for the name of a new branch.
+func isBranchName(name string) bool {
+	if name == "" || name == "HEAD" || strings.HasPrefix(name, "-") || strings.HasPrefix(name, "/") ||
+		strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") || strings.HasSuffix(name, ".lock") ||
+		strings.Contains(name, "..") || strings.Contains(name, "//") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range name {
+		if c < ' ' || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
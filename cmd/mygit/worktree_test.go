@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkedWorktreeState(t *testing.T) {
+	main, _ := testMergeHistory(t, map[string]string{"f": "1\nS\n3\n", "g": "x\n"})
+	mainGitDir, err := filepath.Abs(".git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked := filepath.Join(t.TempDir(), "linked")
+	captureStdout(t, func() { worktreeAdd([]string{"-b", "linked", linked}) })
+
+	// a merge with conflicts, and a bisect, in the linked worktree
+	if err := mergeCommit(&bytes.Buffer{}, "side", &mergeOptions{}); !errors.Is(err, errMergeConflicts) {
+		t.Fatalf("merge returned %v, expected the conflicts", err)
+	}
+	if err := bisectStart(&bytes.Buffer{}, []string{main}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE", "AUTO_MERGE", "BISECT_START", "BISECT_LOG"} {
+		if fileExists(filepath.Join(mainGitDir, name)) {
+			t.Errorf("%s was written to the git directory of the main worktree", name)
+		}
+	}
+	for _, name := range []string{"MERGE_HEAD", "MERGE_MSG", "BISECT_START", "BISECT_LOG"} {
+		if !fileExists(filepath.Join(gitDir, name)) {
+			t.Errorf("%s is missing from the git directory of the linked worktree", name)
+		}
+	}
+	if gitPath("config") != filepath.Join(commonDir, "config") || gitPath("refs/heads/main") != filepath.Join(commonDir, "refs/heads/main") {
+		t.Error("the config and the branches aren't shared")
+	}
+	if _, err := os.Stat(filepath.Join(mainGitDir, "refs", "heads", "linked")); err != nil {
+		t.Errorf("the branch of the linked worktree isn't shared: %s", err)
+	}
+}